@@ -0,0 +1,70 @@
+package ctile
+
+import (
+	"fmt"
+)
+
+// alignedRangeHeader is the response header of a get-entries request rejected
+// by WithStrictAlignment that holds the query of the aligned range to ask for
+// instead, e.g. "start=256&end=511".
+const alignedRangeHeader = "X-Aligned-Range"
+
+// WithStrictAlignment rejects get-entries requests that don't start at the
+// start of a tile, or that continue past the end of the last tile a response
+// may be served from: the first, unless WithMaxRequestTiles allows more. They
+// get a 400 saying which aligned range to ask for instead, also given in the
+// X-Aligned-Range header as a query, e.g. "start=256&end=511". Aligned
+// requests are served from one cached tile each, so it's a way to train
+// clients into cache-friendly access patterns. Rejected requests are counted
+// in ctile_requests{result="bad_request",source="unaligned"}.
+func WithStrictAlignment(enabled bool) Option {
+	return func(o *options) {
+		o.strictAlignment = enabled
+	}
+}
+
+// unalignedError is the error for a get-entries request for the entries from
+// start to end, exclusive, that isn't aligned, with the aligned range that
+// should be asked for instead.
+type unalignedError struct {
+	start, end               int64
+	alignedStart, alignedEnd int64
+	tileSize                 int64
+}
+
+func (e unalignedError) Error() string {
+	return fmt.Sprintf("requested range %d-%d isn't aligned to tiles of %d entries; request %s instead",
+		e.start, e.end-1, e.tileSize, e.query())
+}
+
+// query returns the get-entries query of the aligned range.
+func (e unalignedError) query() string {
+	return fmt.Sprintf("start=%d&end=%d", e.alignedStart, e.alignedEnd-1)
+}
+
+// checkAlignment returns an unalignedError if WithStrictAlignment is set and
+// the entries from start to end, exclusive, aren't an aligned range. The
+// suggested range holds the whole tile with start, and as much of the
+// requested range after it as a response may.
+func (tch *Handler) checkAlignment(start, end int64) error {
+	if !tch.strictAlignment {
+		return nil
+	}
+	t := makeTile(start, int64(tch.tileSize), tch.logURL)
+	tiles := int64(tch.maxRequestTiles)
+	if tiles < 1 {
+		tiles = 1
+	}
+	last := t.start + tiles*t.size
+	if start == t.start && end <= last {
+		return nil
+	}
+	alignedEnd := end
+	if alignedEnd < t.end {
+		alignedEnd = t.end
+	}
+	if alignedEnd > last {
+		alignedEnd = last
+	}
+	return unalignedError{start, end, t.start, alignedEnd, t.size}
+}
@@ -0,0 +1,78 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestCheckAlignment(t *testing.T) {
+	for _, tc := range []struct {
+		maxRequestTiles int
+		start, end      int64 // end is inclusive, as in a query.
+		expected        string
+	}{
+		{0, 0, 4, ""},
+		{0, 5, 9, ""},
+		{0, 5, 6, ""},
+		{0, 7, 8, "start=5&end=9"},
+		{0, 7, 20, "start=5&end=9"},
+		{0, 5, 10, "start=5&end=9"},
+		{3, 5, 19, ""},
+		{3, 5, 20, "start=5&end=19"},
+		{3, 7, 12, "start=5&end=12"},
+		{3, 7, 8, "start=5&end=9"},
+	} {
+		tch := &Handler{tileSize: 5, strictAlignment: true, maxRequestTiles: tc.maxRequestTiles}
+		err := tch.checkAlignment(tc.start, tc.end+1)
+		var got string
+		if unaligned, ok := err.(unalignedError); ok {
+			got = unaligned.query()
+		} else if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if got != tc.expected {
+			t.Errorf("%d-%d with %d tiles: expected %q, got %q", tc.start, tc.end, tc.maxRequestTiles, tc.expected, got)
+		}
+	}
+
+	tch := &Handler{tileSize: 5}
+	if err := tch.checkAlignment(7, 9); err != nil {
+		t.Errorf("expected no error without strict alignment, got %s", err)
+	}
+}
+
+func TestStrictAlignment(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 10))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"), WithStrictAlignment(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ct/v1/get-entries?start=6&end=7", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get(alignedRangeHeader); got != "start=5&end=9" {
+		t.Errorf("expected %s: start=5&end=9, got %q", alignedRangeHeader, got)
+	}
+	if !strings.Contains(w.Body.String(), "start=5&end=9") {
+		t.Errorf("expected the aligned range in the body, got %q", w.Body)
+	}
+	if got := testutil.ToFloat64(handler.requestsMetric.WithLabelValues("bad_request", "unaligned")); got != 1 {
+		t.Errorf("expected 1 unaligned request, got %g", got)
+	}
+
+	_, _, err = getAndParseResp(t, handler, "/ct/v1/get-entries?start=5&end=9")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
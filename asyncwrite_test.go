@@ -0,0 +1,140 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// heldS3 is an in-memory S3 whose writes signal started, if it's set, wait
+// for release, and then fail with err if it's set.
+type heldS3 struct {
+	*s3mem.Client
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (h *heldS3) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if h.started != nil {
+		h.started <- struct{}{}
+	}
+	select {
+	case <-h.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if h.err != nil {
+		return nil, h.err
+	}
+	return h.Client.PutObject(ctx, in, opts...)
+}
+
+func TestAsyncWrites(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	expectSource := func(handler *Handler, url, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("expected X-Source %q, got %q", expected, source)
+		}
+	}
+
+	svc := &heldS3{Client: s3mem.New(), release: make(chan struct{})}
+	var cached []TileInfo
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithAsyncWrites(true),
+		WithHooks(Hooks{OnTileCached: func(_ context.Context, t TileInfo) { cached = append(cached, t) }}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response doesn't wait for the write, which is still held.
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "CT log")
+	if len(cached) != 0 {
+		t.Errorf("expected no tiles cached before the write, got %v", cached)
+	}
+
+	// Close waits for the write.
+	close(svc.release)
+	handler.Close()
+	if len(cached) != 1 {
+		t.Errorf("expected one tile cached after the write, got %v", cached)
+	}
+	reader, err := New(backend.URL, WithTileSize(3), WithS3(svc.Client, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(reader, "/ct/v1/get-entries?start=0&end=2", "S3")
+
+	// A failed write doesn't fail the request, but is counted.
+	svc.err = errors.New("S3 is down")
+	handler, err = New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithAsyncWrites(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, "/ct/v1/get-entries?start=3&end=5", "CT log")
+	handler.Close()
+	expectAndResetMetric(t, handler.requestsMetric, 1, "error", "s3_put")
+}
+
+func TestS3WriteOutlivesRequest(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	svc := &heldS3{Client: s3mem.New(), started: make(chan struct{}), release: make(chan struct{})}
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithTimeouts(Timeouts{FullRequest: 100 * time.Millisecond, S3Write: 5 * time.Second}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client goes away while the tile is being written.
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=2", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	<-svc.started
+	cancel()
+	// And the write takes longer than the full request timeout.
+	time.Sleep(200 * time.Millisecond)
+	close(svc.release)
+	<-done
+
+	reader, err := New(backend.URL, WithTileSize(3), WithS3(svc.Client, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getResp(reader, "/ct/v1/get-entries?start=0&end=2")
+	resp.Body.Close()
+	if source := resp.Header.Get("X-Source"); source != "S3" {
+		t.Errorf("expected the tile to be cached despite the canceled request, got X-Source %q", source)
+	}
+}
@@ -0,0 +1,124 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CircuitBreaker configures when a Handler stops sending requests to a
+// backend that keeps failing, so clients get a quick 503 instead of waiting
+// on it, and the backend gets room to recover.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failed requests, after trying
+	// every replica, that open the breaker. Zero disables it.
+	Failures int
+	// Cooldown is how long the breaker stays open. After that, one request
+	// is let through: if it succeeds, the breaker closes, and otherwise it
+	// opens again. Defaults to 30 seconds.
+	Cooldown time.Duration
+}
+
+// WithCircuitBreaker sets when to stop sending requests to a failing backend.
+func WithCircuitBreaker(cb CircuitBreaker) Option {
+	return func(o *options) {
+		o.circuitBreaker = cb
+	}
+}
+
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// errCircuitOpen is returned instead of contacting a backend whose circuit
+// breaker is open.
+var errCircuitOpen = errors.New("the backend is failing, so requests to it are paused; try again later")
+
+// circuitBreaker enforces CircuitBreaker. A nil *circuitBreaker allows
+// everything.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	openMetric prometheus.Gauge
+
+	// mu protects the fields below. openUntil is zero while the breaker is
+	// closed; trial is true while the request let through after the
+	// cooldown is in flight.
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time
+	trial       bool
+}
+
+func newCircuitBreaker(cb CircuitBreaker, promRegisterer prometheus.Registerer) *circuitBreaker {
+	if cb.Failures == 0 {
+		return nil
+	}
+	b := &circuitBreaker{
+		failures: cb.Failures,
+		cooldown: cb.Cooldown,
+		openMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ctile_circuit_breaker_open",
+			Help: "1 if requests to the backend are paused because it keeps failing, and 0 otherwise",
+		}),
+	}
+	if b.cooldown == 0 {
+		b.cooldown = defaultCircuitBreakerCooldown
+	}
+	promRegisterer.MustRegister(b.openMetric)
+	return b
+}
+
+// allow returns errCircuitOpen if a request must not be sent to the backend.
+// Otherwise, the caller must report how the request went to done.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return errCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// done records the outcome of a request allowed by allow, made with ctx.
+// Errors that aren't the backend's fault, such as 400s for entries past the
+// end of the log, count as successes. As in tryBackends, a cancellation
+// isn't held against the backend.
+func (b *circuitBreaker) done(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	if !isBackendFailure(err) {
+		if !b.openUntil.IsZero() {
+			log.Printf("backend recovered, resuming requests\n")
+		}
+		b.consecutive = 0
+		b.openUntil = time.Time{}
+		b.openMetric.Set(0)
+		return
+	}
+	b.consecutive++
+	if b.consecutive >= b.failures {
+		if b.openUntil.IsZero() {
+			log.Printf("warning: backend failed %d times in a row, pausing requests to it for %s: %s\n", b.consecutive, b.cooldown, err)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.openMetric.Set(1)
+	}
+}
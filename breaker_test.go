@@ -0,0 +1,70 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var broken atomic.Bool
+	var backendRequests atomic.Int64
+	fake := fakelog.New(10, 3)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+		if broken.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithCircuitBreaker(CircuitBreaker{Failures: 2, Cooldown: 50 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus := func(url string, expectedStatus int, expectedBackendRequests int64) {
+		t.Helper()
+		before := backendRequests.Load()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", url, expectedStatus, resp.StatusCode)
+		}
+		if n := backendRequests.Load() - before; n != expectedBackendRequests {
+			t.Errorf("%s: expected %d backend requests, got %d", url, expectedBackendRequests, n)
+		}
+	}
+
+	// Past-the-end requests don't count as failures.
+	expectStatus("/ct/v1/get-entries?start=12&end=12", http.StatusBadRequest, 1)
+	expectStatus("/ct/v1/get-entries?start=12&end=12", http.StatusBadRequest, 1)
+
+	broken.Store(true)
+	expectStatus("/ct/v1/get-entries?start=0&end=0", http.StatusInternalServerError, 1)
+	expectStatus("/ct/v1/get-entries?start=0&end=0", http.StatusInternalServerError, 1)
+	expectStatus("/ct/v1/get-entries?start=0&end=0", http.StatusServiceUnavailable, 0)
+	expectStatus("/ct/v1/get-sth", http.StatusServiceUnavailable, 0)
+
+	// After the cooldown, a failed trial opens the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	expectStatus("/ct/v1/get-entries?start=0&end=0", http.StatusInternalServerError, 1)
+	expectStatus("/ct/v1/get-entries?start=0&end=0", http.StatusServiceUnavailable, 0)
+
+	// A successful trial closes it.
+	broken.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	expectStatus("/ct/v1/get-entries?start=0&end=0", http.StatusOK, 1)
+	expectStatus("/ct/v1/get-entries?start=3&end=3", http.StatusOK, 1)
+}
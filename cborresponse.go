@@ -0,0 +1,53 @@
+package ctile
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cborContentType is the media type of get-entries responses encoded in
+// CBOR, in the same form as the JSON ones, as tiles are stored: a map with
+// "entries", each a map with "leaf_input" and "extra_data" as byte strings.
+// Clients ask for them with Accept: application/cbor.
+const cborContentType = "application/cbor"
+
+// acceptsCBOR returns whether r's Accept header names CBOR, and prefers it
+// to JSON. Clients that accept both equally get JSON, as do clients that only
+// accept CBOR through a wildcard, which are unlikely to be able to read it.
+func acceptsCBOR(r *http.Request) bool {
+	var cborWeight float64
+	// The weights of JSON by how specific their media ranges are: exact,
+	// application/*, and */*. The most specific one given decides.
+	var jsonWeights [3]float64
+	var jsonGiven [3]bool
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				var err error
+				weight, err = strconv.ParseFloat(q, 64)
+				if err != nil {
+					weight = 0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case cborContentType:
+			cborWeight = weight
+		case "application/json":
+			jsonWeights[0], jsonGiven[0] = weight, true
+		case "application/*":
+			jsonWeights[1], jsonGiven[1] = weight, true
+		case "*/*":
+			jsonWeights[2], jsonGiven[2] = weight, true
+		}
+	}
+	for i, given := range jsonGiven {
+		if given {
+			return cborWeight > jsonWeights[i]
+		}
+	}
+	return cborWeight > 0
+}
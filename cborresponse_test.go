@@ -0,0 +1,85 @@
+package ctile
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestAcceptsCBOR(t *testing.T) {
+	for _, test := range []struct {
+		accept   string
+		expected bool
+	}{
+		{"", false},
+		{"application/cbor", true},
+		{"application/json", false},
+		{"application/cbor, application/json", false},
+		{"application/cbor, application/json;q=0.9", true},
+		{"application/json;q=0.5, */*", false},
+		{"application/cbor;q=0.8, */*;q=0.5", true},
+		{"application/json;q=0.5, application/*", false},
+		{"*/*", false},
+		{"application/cbor;q=0", false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", test.accept)
+		if got := acceptsCBOR(req); got != test.expected {
+			t.Errorf("Accept %q: expected %t, got %t", test.accept, test.expected, got)
+		}
+	}
+}
+
+func TestCBORResponses(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 10))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=1&end=3", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("application/cbor")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/cbor" {
+		t.Errorf("expected Content-Type application/cbor, got %q", ct)
+	}
+	if vary := w.Header().Values("Vary"); len(vary) != 2 || vary[0] != "Accept-Encoding" || vary[1] != "Accept" {
+		t.Errorf("expected Vary: Accept-Encoding and Accept, got %q", vary)
+	}
+	var entries Entries
+	err = cbor.Unmarshal(w.Body.Bytes(), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries.Entries))
+	}
+	for i, entry := range entries.Entries {
+		if !bytes.Equal(entry.LeafInput, fakelog.LeafInput(int64(i+1))) || !bytes.Equal(entry.ExtraData, fakelog.ExtraData(int64(i+1))) {
+			t.Errorf("entry %d doesn't match the log's", i+1)
+		}
+	}
+
+	json := get("application/json")
+	if ct := json.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", ct)
+	}
+	if etag := json.Header().Get("ETag"); etag == "" || etag == w.Header().Get("ETag") {
+		t.Errorf("expected the JSON and CBOR responses to have different ETags, got %q and %q", etag, w.Header().Get("ETag"))
+	}
+}
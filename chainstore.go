@@ -0,0 +1,259 @@
+package ctile
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ChainStore configures a content-addressed store for the certificate chains
+// in entries' extra_data. Most entries of a log share a handful of chains, so
+// storing each once, and only its hash in tiles, makes tiles much smaller.
+type ChainStore struct {
+	// Bucket holds the chains. Defaults to the bucket set by WithS3.
+	Bucket string
+	// Prefix is put in front of the key of each chain, the hex SHA-256 of its
+	// contents. Logs may share a prefix, and so their chains. Empty disables
+	// the chain store.
+	Prefix string
+	// CacheSize is the number of chains kept in memory, so most tiles are
+	// read and written without requests for their chains. Defaults to
+	// DefaultChainCacheSize.
+	CacheSize int
+}
+
+// DefaultChainCacheSize is the number of chains kept in memory if
+// ChainStore.CacheSize isn't set.
+const DefaultChainCacheSize = 10000
+
+// WithChainStore stores the certificate chains in the extra_data of entries in
+// the given ChainStore, and only their hashes in tiles. Entries are
+// reconstructed in full when tiles are read. Tiles with an entry whose
+// extra_data can't be parsed are written whole.
+//
+// Tiles written this way are in a format version older versions of ctile
+// can't read, so upgrade every instance before enabling it. Tiles written
+// before are still read. Chains must never be deleted or expired while tiles
+// refer to them; a tile whose chain is missing is fetched from the CT log
+// again, and rewritten with its chain.
+func WithChainStore(c ChainStore) Option {
+	return func(o *options) {
+		o.chainStore = c
+	}
+}
+
+// chainStore stores chains in S3, keyed by their hash, with an LRU cache of
+// those recently read or written. A nil *chainStore disables deduplication.
+type chainStore struct {
+	svc      S3API
+	bucket   string
+	prefix   string
+	maxItems int
+
+	// mu protects the fields below.
+	mu    sync.Mutex
+	lru   *list.List // Of *chainCacheItem, most recently used first.
+	items map[[sha256.Size]byte]*list.Element
+}
+
+type chainCacheItem struct {
+	hash  [sha256.Size]byte
+	chain []byte
+}
+
+func newChainStore(c ChainStore, svc S3API, bucket string) *chainStore {
+	if c.Prefix == "" {
+		return nil
+	}
+	if c.Bucket != "" {
+		bucket = c.Bucket
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = DefaultChainCacheSize
+	}
+	return &chainStore{
+		svc:      svc,
+		bucket:   bucket,
+		prefix:   c.Prefix,
+		maxItems: c.CacheSize,
+		lru:      list.New(),
+		items:    make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// cached returns the chain with the given hash, if it's in the cache, which
+// also means it's in the store.
+func (c *chainStore) cached(hash [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[hash]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*chainCacheItem).chain, true
+}
+
+// add caches a chain that's in the store.
+func (c *chainStore) add(hash [sha256.Size]byte, chain []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[hash]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[hash] = c.lru.PushFront(&chainCacheItem{hash: hash, chain: chain})
+	for c.lru.Len() > c.maxItems {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*chainCacheItem).hash)
+	}
+}
+
+func (c *chainStore) key(hash [sha256.Size]byte) string {
+	return c.prefix + hex.EncodeToString(hash[:])
+}
+
+// put stores a chain, unless it's known to be stored already.
+func (c *chainStore) put(ctx context.Context, hash [sha256.Size]byte, chain []byte) error {
+	if _, ok := c.cached(hash); ok {
+		return nil
+	}
+	_, err := c.svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.key(hash)),
+		Body:   bytes.NewReader(chain),
+	})
+	if err != nil {
+		return fmt.Errorf("putting chain in bucket %q with key %q: %w", c.bucket, c.key(hash), err)
+	}
+	c.add(hash, chain)
+	return nil
+}
+
+// get returns the chain with the given hash. If it isn't in the store, the
+// error matches noSuchKey, so the tile referring to it is treated as missing.
+func (c *chainStore) get(ctx context.Context, hash [sha256.Size]byte) ([]byte, error) {
+	if chain, ok := c.cached(hash); ok {
+		return chain, nil
+	}
+	key := c.key(hash)
+	resp, err := c.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, fmt.Errorf("chain in bucket %q with key %q: %w", c.bucket, key, noSuchKey{})
+		}
+		return nil, fmt.Errorf("getting chain from bucket %q with key %q: %w", c.bucket, key, err)
+	}
+	defer resp.Body.Close()
+	chain, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading chain from bucket %q with key %q: %w", c.bucket, key, err)
+	}
+	if sha256.Sum256(chain) != hash {
+		return nil, fmt.Errorf("chain in bucket %q with key %q doesn't match its hash", c.bucket, key)
+	}
+	c.add(hash, chain)
+	return chain, nil
+}
+
+// dedup stores the chains of e's entries, and returns e with each chain
+// replaced by its hash. ok is false, and e should be written whole, if an
+// entry's extra_data can't be parsed.
+func (c *chainStore) dedup(ctx context.Context, e *Entries) (deduped *Entries, ok bool, err error) {
+	deduped = &Entries{Entries: make([]Entry, len(e.Entries))}
+	chains := make(map[[sha256.Size]byte][]byte)
+	for i, entry := range e.Entries {
+		own, chain, ok := splitChain(entry.LeafInput, entry.ExtraData)
+		if !ok {
+			return nil, false, nil
+		}
+		hash := sha256.Sum256(chain)
+		chains[hash] = chain
+		extraData := make([]byte, 0, len(own)+len(hash))
+		extraData = append(append(extraData, own...), hash[:]...)
+		deduped.Entries[i] = Entry{LeafInput: entry.LeafInput, ExtraData: extraData}
+	}
+	for hash, chain := range chains {
+		err := c.put(ctx, hash, chain)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return deduped, true, nil
+}
+
+// restore returns the entries of a tile written by dedup, with their chains
+// put back.
+func (c *chainStore) restore(ctx context.Context, e *Entries) (*Entries, error) {
+	restored := &Entries{Entries: make([]Entry, len(e.Entries))}
+	for i, entry := range e.Entries {
+		n := len(entry.ExtraData) - sha256.Size
+		if n < 0 {
+			return nil, fmt.Errorf("entry %d has no chain hash in its extra_data", i)
+		}
+		var hash [sha256.Size]byte
+		copy(hash[:], entry.ExtraData[n:])
+		chain, err := c.get(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+		extraData := make([]byte, 0, n+len(chain))
+		extraData = append(append(extraData, entry.ExtraData[:n]...), chain...)
+		restored.Entries[i] = Entry{LeafInput: entry.LeafInput, ExtraData: extraData}
+	}
+	return restored, nil
+}
+
+// splitChain splits the extra_data of the entry with the given leaf_input into
+// the part that's specific to the entry, if any, and the certificate chain.
+// ok is false if either can't be parsed.
+func splitChain(leafInput, extraData []byte) (own, chain []byte, ok bool) {
+	// The entry_type follows the version, leaf_type and timestamp, as in
+	// checkLeaves.
+	if len(leafInput) < 12 || leafInput[10] != 0 {
+		return nil, nil, false
+	}
+	switch leafInput[11] {
+	case 0:
+		// An x509_entry's extra_data is just the chain.
+		chain = extraData
+	case 1:
+		// A precert_entry's is the precertificate, then the chain.
+		n, ok := vectorLen(extraData)
+		if !ok {
+			return nil, nil, false
+		}
+		own, chain = extraData[:n], extraData[n:]
+	default:
+		return nil, nil, false
+	}
+	if n, ok := vectorLen(chain); !ok || n != len(chain) {
+		return nil, nil, false
+	}
+	return own, chain, true
+}
+
+// vectorLen returns the length, including its prefix, of the vector with a
+// 24-bit length at the start of b. ok is false if b is shorter.
+func vectorLen(b []byte) (n int, ok bool) {
+	if len(b) < 3 {
+		return 0, false
+	}
+	n = 3 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+	return n, n <= len(b)
+}
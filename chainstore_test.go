@@ -0,0 +1,121 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestSplitChain(t *testing.T) {
+	x509Leaf := make([]byte, 12)
+	precertLeaf := append(make([]byte, 11), 1)
+	chain := []byte{0, 0, 5, 0, 0, 2, 'h', 'i'}
+	precert := []byte{0, 0, 2, 'p', 'c'}
+
+	own, gotChain, ok := splitChain(x509Leaf, chain)
+	if !ok || len(own) != 0 || !bytes.Equal(gotChain, chain) {
+		t.Errorf("x509_entry: got %x, %x, %v", own, gotChain, ok)
+	}
+	own, gotChain, ok = splitChain(precertLeaf, append(append([]byte{}, precert...), chain...))
+	if !ok || !bytes.Equal(own, precert) || !bytes.Equal(gotChain, chain) {
+		t.Errorf("precert_entry: got %x, %x, %v", own, gotChain, ok)
+	}
+
+	for name, tc := range map[string]struct{ leaf, extraData []byte }{
+		"short leaf":          {x509Leaf[:11], chain},
+		"unknown entry type":  {append(make([]byte, 11), 2), chain},
+		"truncated chain":     {x509Leaf, chain[:6]},
+		"trailing data":       {x509Leaf, append(append([]byte{}, chain...), 0)},
+		"truncated precert":   {precertLeaf, precert[:4]},
+		"precert, no chain":   {precertLeaf, precert},
+		"empty extra_data":    {x509Leaf, nil},
+		"unknown leaf format": {append([]byte{}, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0), chain},
+	} {
+		if _, _, ok := splitChain(tc.leaf, tc.extraData); ok {
+			t.Errorf("%s: expected it not to split", name)
+		}
+	}
+}
+
+func TestChainStore(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	ctx := context.Background()
+	svc := s3mem.New()
+
+	newHandler := func(opts ...Option) *Handler {
+		t.Helper()
+		handler, err := New(backend.URL, append([]Option{WithTileSize(3), WithS3(svc, "bucket", "test/")}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	withChains := WithChainStore(ChainStore{Prefix: "chains/"})
+	get := func(handler *Handler, expectedSource string) []byte {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-entries?start=3&end=5")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expectedSource {
+			t.Errorf("expected X-Source %q, got %q", expectedSource, source)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	// Every entry of the fake log has the same, empty, chain.
+	hash := sha256.Sum256(fakelog.ExtraData(0))
+	chainKey := "chains/" + hex.EncodeToString(hash[:])
+	expectChain := func() {
+		t.Helper()
+		obj, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(chainKey)})
+		if err != nil {
+			t.Fatalf("expected the chain in S3, got %v", err)
+		}
+		obj.Body.Close()
+	}
+
+	expected := get(newHandler(withChains), "CT log")
+	expectChain()
+	_, err := GetTileObject(ctx, svc, "bucket", "test/"+TileKey(3, 3))
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected the tile to need a chain store, got %v", err)
+	}
+
+	// The entries are reconstructed in full.
+	if body := get(newHandler(withChains), "S3"); !bytes.Equal(body, expected) {
+		t.Errorf("expected %s, got %s", expected, body)
+	}
+
+	// Without the chain store, the tile is served from the backend.
+	get(newHandler(), "CT log")
+
+	// A tile whose chain is missing is fetched and written again.
+	_, err = svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String(chainKey)}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(newHandler(withChains), "CT log")
+	expectChain()
+}
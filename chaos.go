@@ -0,0 +1,58 @@
+//go:build chaos
+
+package ctile
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// This file is only included in builds with `-tags chaos`, which are meant for
+// staging. It provides flags to inject artificial latency and errors into calls
+// to S3 and the backend, for rehearsing incident behavior.
+
+// faultConfig describes the faults to inject into calls to one target.
+type faultConfig struct {
+	errorRate   float64
+	latencyRate float64
+	latency     time.Duration
+}
+
+var faultConfigs = map[faultTarget]*faultConfig{
+	faultTargetS3:      {},
+	faultTargetBackend: {},
+}
+
+// RegisterFaultFlags adds the -chaos-* fault injection flags to fs.
+func RegisterFaultFlags(fs *flag.FlagSet) {
+	for target, cfg := range faultConfigs {
+		fs.Float64Var(&cfg.errorRate, fmt.Sprintf("chaos-%s-error-rate", target), 0,
+			fmt.Sprintf("fraction (0-1) of %s calls that should fail with an injected error", target))
+		fs.Float64Var(&cfg.latencyRate, fmt.Sprintf("chaos-%s-latency-rate", target), 0,
+			fmt.Sprintf("fraction (0-1) of %s calls that should be delayed by -chaos-%s-latency", target, target))
+		fs.DurationVar(&cfg.latency, fmt.Sprintf("chaos-%s-latency", target), time.Second,
+			fmt.Sprintf("latency to inject into delayed %s calls", target))
+	}
+	log.Println("this is a chaos build: fault injection flags are available")
+}
+
+// injectFault possibly delays and/or fails a call to the given target,
+// according to the -chaos-* flags.
+func injectFault(ctx context.Context, target faultTarget) error {
+	cfg := faultConfigs[target]
+	if cfg.latencyRate > 0 && rand.Float64() < cfg.latencyRate {
+		select {
+		case <-time.After(cfg.latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if cfg.errorRate > 0 && rand.Float64() < cfg.errorRate {
+		return injectedFault{target}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !chaos
+
+package ctile
+
+import (
+	"context"
+	"flag"
+)
+
+// injectFault does nothing in builds without `-tags chaos`. See chaos.go.
+func injectFault(context.Context, faultTarget) error {
+	return nil
+}
+
+// RegisterFaultFlags does nothing in builds without `-tags chaos`.
+func RegisterFaultFlags(*flag.FlagSet) {}
@@ -0,0 +1,41 @@
+//go:build chaos
+
+package ctile
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInjectFault(t *testing.T) {
+	cfg := faultConfigs[faultTargetS3]
+	defer func() { *cfg = faultConfig{} }()
+
+	err := injectFault(context.Background(), faultTargetS3)
+	if err != nil {
+		t.Fatalf("expected no fault by default, got %s", err)
+	}
+
+	cfg.errorRate = 1
+	err = injectFault(context.Background(), faultTargetS3)
+	if !errors.As(err, &injectedFault{}) {
+		t.Fatalf("expected injected fault, got %v", err)
+	}
+
+	cfg.errorRate = 0
+	cfg.latencyRate = 1
+	cfg.latency = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = injectFault(ctx, faultTargetS3)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected injected latency to respect the context, got %v", err)
+	}
+
+	err = injectFault(context.Background(), faultTargetBackend)
+	if err != nil {
+		t.Fatalf("expected no fault for other targets, got %s", err)
+	}
+}
@@ -0,0 +1,112 @@
+package ctile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// checksumMetadataKey is the object metadata that holds the hex SHA-256 of a
+// tile's encoded body, as written by putTileObject. S3 returns it with
+// x-amz-meta- stripped.
+const checksumMetadataKey = "ctile-sha256"
+
+// tileChecksum returns the checksum of an encoded tile, as stored in its
+// metadata.
+func tileChecksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumMismatch indicates that an object's body doesn't match the checksum
+// in its metadata, because it's been corrupted or edited since it was written.
+type checksumMismatch struct {
+	bucket, key string
+}
+
+func (c checksumMismatch) Error() string {
+	return fmt.Sprintf("object in bucket %q with key %q doesn't match its checksum", c.bucket, c.key)
+}
+
+// ErrChecksumMismatch is returned by GetTileObject when an object doesn't match
+// the checksum it was written with. Objects written without a checksum, e.g.
+// by older versions or to stores that drop metadata, aren't checked.
+var ErrChecksumMismatch error = checksumMismatch{}
+
+// Is makes any checksumMismatch match ErrChecksumMismatch.
+func (checksumMismatch) Is(target error) bool {
+	_, ok := target.(checksumMismatch)
+	return ok
+}
+
+// verifyChecksum returns a checksumMismatch if body doesn't match the
+// checksum in metadata, if it has one.
+func verifyChecksum(bucket, key string, body []byte, metadata map[string]string) error {
+	expected, ok := metadata[checksumMetadataKey]
+	if !ok || expected == tileChecksum(body) {
+		return nil
+	}
+	return checksumMismatch{bucket, key}
+}
+
+// undecodableTile indicates that an object's body couldn't be decoded as a
+// tile, e.g. because it's truncated, or isn't gzip or CBOR at all. Tiles
+// without a checksum are only caught this way.
+type undecodableTile struct {
+	err error
+}
+
+func (u undecodableTile) Error() string {
+	return u.err.Error()
+}
+
+func (u undecodableTile) Unwrap() error {
+	return u.err
+}
+
+// dropCorrupt handles err from reading tile t from bucket and key in svc. If
+// the object didn't match its checksum, or couldn't be decoded, it's counted,
+// and, unless there's no backend to refetch it from, deleted and reported
+// missing, so it's written again, even with conditional writes.
+func (tch *Handler) dropCorrupt(ctx context.Context, svc S3API, t tile, bucket, key string, err error) error {
+	var undecodable undecodableTile
+	var reason string
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		tch.checksumMismatches.Inc()
+		reason = "doesn't match its checksum"
+	case errors.As(err, &undecodable):
+		tch.undecodableTiles.Inc()
+		reason = fmt.Sprintf("can't be decoded: %s", undecodable.err)
+	default:
+		return err
+	}
+	if tch.mode == ModeCacheOnly {
+		return err
+	}
+	tch.removeCorruptTile(ctx, svc, t, bucket, key, reason)
+	return noSuchKey{}
+}
+
+// removeCorruptTile deletes a tile whose object in bucket and key is corrupt,
+// for reason.
+func (tch *Handler) removeCorruptTile(ctx context.Context, svc S3API, t tile, bucket, key, reason string) {
+	log.Printf("warning: refetching tile %d-%d, whose object in bucket %q %s\n", t.start, t.end-1, bucket, reason)
+	if tch.dryRun {
+		return
+	}
+	_, err := svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String(key)}}, Quiet: true},
+	})
+	if err != nil {
+		log.Printf("warning: deleting corrupt tile %d-%d: %s\n", t.start, t.end-1, err)
+	}
+}
@@ -0,0 +1,165 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestChecksums(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	ctx := context.Background()
+	svc := s3mem.New()
+
+	expectSource := func(handler *Handler, expectedStatus int, expectedSource string) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d, got %d", expectedStatus, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); expectedSource != "" && source != expectedSource {
+			t.Errorf("expected X-Source %q, got %q", expectedSource, source)
+		}
+	}
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, http.StatusOK, "CT log")
+	expectSource(handler, http.StatusOK, "S3")
+
+	// Corrupt the tile by swapping in another tile's body, keeping the
+	// original's checksum.
+	key := "test/" + TileKey(3, 0)
+	corrupt := func() {
+		t.Helper()
+		obj, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := EncodeTile(&Entries{Entries: []Entry{{LeafInput: []byte("edited")}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = svc.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String("bucket"),
+			Key:      aws.String(key),
+			Body:     bytes.NewReader(other),
+			Metadata: obj.Metadata,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt()
+	_, err = GetTileObject(ctx, svc, "bucket", key)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	// The corrupt tile is refetched from the backend, and replaced.
+	expectSource(handler, http.StatusOK, "CT log")
+	if n := testutil.ToFloat64(handler.checksumMismatches); n != 1 {
+		t.Errorf("expected 1 checksum mismatch, got %g", n)
+	}
+	expectSource(handler, http.StatusOK, "S3")
+
+	// In cache-only mode, there's nothing to refetch it from.
+	corrupt()
+	handler, err = New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithMode(ModeCacheOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, http.StatusInternalServerError, "")
+
+	// Objects without a checksum aren't checked.
+	other, err := EncodeTile(&Entries{Entries: make([]Entry, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key), Body: bytes.NewReader(other)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := GetTileObject(ctx, svc, "bucket", key)
+	if err != nil || len(entries.Entries) != 3 {
+		t.Errorf("expected the tile without a checksum to be read, got %v", err)
+	}
+}
+
+func TestUndecodableTiles(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	ctx := context.Background()
+	svc := s3mem.New()
+
+	expectSource := func(handler *Handler, expectedStatus int, expectedSource string) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d, got %d", expectedStatus, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); expectedSource != "" && source != expectedSource {
+			t.Errorf("expected X-Source %q, got %q", expectedSource, source)
+		}
+	}
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, http.StatusOK, "CT log")
+
+	// Truncate the tile, dropping its checksum as older versions would have,
+	// so only decoding it catches it.
+	key := "test/" + TileKey(3, 0)
+	truncate := func() {
+		t.Helper()
+		obj, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(obj.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key), Body: bytes.NewReader(body[:len(body)/2])})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	truncate()
+
+	// The undecodable tile is refetched from the backend, and replaced.
+	expectSource(handler, http.StatusOK, "CT log")
+	if n := testutil.ToFloat64(handler.undecodableTiles); n != 1 {
+		t.Errorf("expected 1 undecodable tile, got %g", n)
+	}
+	expectSource(handler, http.StatusOK, "S3")
+
+	// In cache-only mode, there's nothing to refetch it from.
+	truncate()
+	handler, err = New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithMode(ModeCacheOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, http.StatusInternalServerError, "")
+	if n := testutil.ToFloat64(handler.undecodableTiles); n != 1 {
+		t.Errorf("expected 1 undecodable tile, got %g", n)
+	}
+}
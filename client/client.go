@@ -0,0 +1,254 @@
+// Package client reads a CT log through ctile. It requests tile-aligned
+// ranges of entries, so each request is served from a single cached tile,
+// reports the headers ctile adds to responses, and retries the failures that
+// are worth retrying.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// ErrPastTheEnd is returned for a range that starts past the end of the log.
+var ErrPastTheEnd = errors.New("requested range is past the end of the log")
+
+// StatusError is returned when ctile responds with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("status code %d: %s", e.StatusCode, e.Body)
+}
+
+// Client reads a CT log through the ctile instance serving it. Use New to
+// create one. It's safe for concurrent use.
+type Client struct {
+	logURL     string
+	tileSize   int64
+	httpClient *http.Client
+	signingKey []byte
+	maxRetries int
+	retryDelay time.Duration
+}
+
+// Option configures a Client. Pass Options to New.
+type Option func(*Client)
+
+// WithHTTPClient sets the client for requests to ctile. Defaults to
+// http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithSigningKey signs each request with key, for an instance that requires
+// signed requests. See ctile.RequestSigning.
+func WithSigningKey(key []byte) Option {
+	return func(c *Client) {
+		c.signingKey = key
+	}
+}
+
+// WithRetries sets how many times a request is retried after a failure that
+// may be temporary: a network error, a 429, or a 5xx. Retries wait delay,
+// doubling each time, or as long as a Retry-After header asks. Defaults to 3
+// retries, starting at 1 second.
+func WithRetries(maxRetries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryDelay = delay
+	}
+}
+
+// New returns a Client for the log served by ctile at logURL, e.g.
+// https://ctile.example.com/2024h1. tileSize must match the instance's tile
+// size, so requests line up with its tiles.
+func New(logURL string, tileSize int64, opts ...Option) (*Client, error) {
+	c := &Client{
+		logURL:     strings.TrimSuffix(logURL, "/"),
+		tileSize:   tileSize,
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		retryDelay: time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.logURL == "" {
+		return nil, errors.New("log URL must not be empty")
+	}
+	if c.tileSize <= 0 {
+		return nil, errors.New("tile size must be positive")
+	}
+	if c.maxRetries < 0 || c.retryDelay < 0 {
+		return nil, errors.New("retries and retry delay must not be negative")
+	}
+	return c, nil
+}
+
+// Batch is the response to a single get-entries request.
+type Batch struct {
+	// Start is the index of the first entry.
+	Start   int64
+	Entries []ctile.Entry
+	// Partial is true if the batch came from the last tile of the log, which
+	// isn't complete yet, so later requests may return more entries.
+	Partial bool
+	// Source is where ctile got the tile from, e.g. "S3" or "CT log".
+	Source string
+}
+
+// GetEntries requests the entries from start to end, inclusive, like the CT
+// get-entries endpoint. The request is cut off at the end of start's tile, so
+// the batch may hold fewer entries than asked for, and it holds fewer still at
+// the end of the log. If start is past the end of the log, it returns
+// ErrPastTheEnd.
+func (c *Client) GetEntries(ctx context.Context, start, end int64) (*Batch, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid range %d-%d", start, end)
+	}
+	if tileEnd := start - start%c.tileSize + c.tileSize - 1; end > tileEnd {
+		end = tileEnd
+	}
+	url := fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", c.logURL, start, end)
+	resp, body, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	var entries ctile.Entries
+	err = json.Unmarshal(body, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("decoding response from %s: %w", url, err)
+	}
+	return &Batch{
+		Start:   start,
+		Entries: entries.Entries,
+		Partial: resp.Header.Get("X-Partial-Tile") == "true",
+		Source:  resp.Header.Get("X-Source"),
+	}, nil
+}
+
+// Scan calls fn with each entry from start to end, inclusive, in order,
+// making as few requests as ctile's tiles allow. It stops without an error at
+// the end of the log, so end may be past it, and stops with fn's error if it
+// returns one.
+func (c *Client) Scan(ctx context.Context, start, end int64, fn func(index int64, entry ctile.Entry) error) error {
+	for start <= end {
+		batch, err := c.GetEntries(ctx, start, end)
+		if errors.Is(err, ErrPastTheEnd) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, entry := range batch.Entries {
+			err := fn(start+int64(i), entry)
+			if err != nil {
+				return err
+			}
+		}
+		if len(batch.Entries) == 0 || batch.Partial && start+int64(len(batch.Entries)) <= end {
+			return nil
+		}
+		start += int64(len(batch.Entries))
+	}
+	return nil
+}
+
+// TreeSize returns the tree size of the log's current STH.
+func (c *Client) TreeSize(ctx context.Context) (int64, error) {
+	url := c.logURL + "/ct/v1/get-sth"
+	_, body, err := c.get(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+	var sth struct {
+		TreeSize int64 `json:"tree_size"`
+	}
+	err = json.Unmarshal(body, &sth)
+	if err != nil {
+		return 0, fmt.Errorf("decoding response from %s: %w", url, err)
+	}
+	return sth.TreeSize, nil
+}
+
+// get requests url, with retries, and returns the response and its body.
+func (c *Client) get(ctx context.Context, url string) (*http.Response, []byte, error) {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.getOnce(ctx, url)
+		if err == nil {
+			return resp, body, nil
+		}
+		if attempt == c.maxRetries || !retryable(err) || ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("fetching %s: %w", url, err)
+		}
+
+		wait := delay
+		if resp != nil {
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > wait {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, fmt.Errorf("fetching %s: %w", url, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// getOnce requests url. For an unsuccessful status code, it returns the
+// response along with the error, for its headers.
+func (c *Client) getOnce(ctx context.Context, url string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.signingKey != nil {
+		ctile.SignRequest(req, c.signingKey, time.Now())
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, body, nil
+	case resp.StatusCode == http.StatusBadRequest && strings.HasSuffix(req.URL.Path, "/get-entries"):
+		// ctile, like Trillian, answers requests past the end of the log with
+		// a 400, and the Client doesn't make any other bad requests.
+		return resp, nil, fmt.Errorf("%w: %s", ErrPastTheEnd, strings.TrimSpace(string(body)))
+	default:
+		return resp, nil, StatusError{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+}
+
+// retryable returns true if err may be temporary.
+func retryable(err error) bool {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return !errors.Is(err, ErrPastTheEnd) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// newServer returns a ctile instance for a log of 10 entries, with tiles of
+// 4, and a counter of the requests it received.
+func newServer(t *testing.T, opts ...ctile.Option) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	backend := httptest.NewServer(fakelog.New(10, 4))
+	t.Cleanup(backend.Close)
+	handler, err := ctile.New(backend.URL, append([]ctile.Option{
+		ctile.WithTileSize(4),
+		ctile.WithS3(s3mem.New(), "bucket", "test/"),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func expectIndexes(t *testing.T, entries []ctile.Entry, first int64) {
+	t.Helper()
+	for i, entry := range entries {
+		index, err := fakelog.Index(entry.LeafInput)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != first+int64(i) {
+			t.Errorf("expected entry %d, got %d", first+int64(i), index)
+		}
+	}
+}
+
+func TestGetEntries(t *testing.T) {
+	server, _ := newServer(t)
+	c, err := New(server.URL, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The request is cut off at the end of the tile.
+	batch, err := c.GetEntries(context.Background(), 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Start != 1 || len(batch.Entries) != 3 || batch.Partial || batch.Source != "CT log" {
+		t.Errorf("expected 3 entries of a full tile from the CT log, got %d from %q, partial=%t", len(batch.Entries), batch.Source, batch.Partial)
+	}
+	expectIndexes(t, batch.Entries, 1)
+
+	batch, err = c.GetEntries(context.Background(), 9, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Entries) != 1 || !batch.Partial {
+		t.Errorf("expected 1 entry of a partial tile, got %d, partial=%t", len(batch.Entries), batch.Partial)
+	}
+
+	_, err = c.GetEntries(context.Background(), 10, 10)
+	if !errors.Is(err, ErrPastTheEnd) {
+		t.Errorf("expected ErrPastTheEnd, got %v", err)
+	}
+
+	treeSize, err := c.TreeSize(context.Background())
+	if err != nil || treeSize != 10 {
+		t.Errorf("expected tree size 10, got %d, %v", treeSize, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	server, requests := newServer(t)
+	c, err := New(server.URL, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []ctile.Entry
+	err = c.Scan(context.Background(), 2, 100, func(index int64, entry ctile.Entry) error {
+		if index != 2+int64(len(got)) {
+			t.Errorf("expected index %d, got %d", 2+len(got), index)
+		}
+		got = append(got, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 8 {
+		t.Errorf("expected entries 2 to 9, got %d entries", len(got))
+	}
+	expectIndexes(t, got, 2)
+	// One request per tile: 2-3, 4-7, and 8-9.
+	if requests.Load() != 3 {
+		t.Errorf("expected 3 requests, got %d", requests.Load())
+	}
+
+	stop := errors.New("stop")
+	err = c.Scan(context.Background(), 0, 100, func(index int64, entry ctile.Entry) error {
+		return stop
+	})
+	if err != stop {
+		t.Errorf("expected Scan to return fn's error, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	server, _ := newServer(t)
+	var failures atomic.Int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, server.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer flaky.Close()
+
+	c, err := New(flaky.URL, 4, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures.Store(2)
+	_, err = c.GetEntries(context.Background(), 0, 3)
+	if err != nil {
+		t.Errorf("expected success after 2 retries, got %s", err)
+	}
+
+	failures.Store(3)
+	_, err = c.GetEntries(context.Background(), 0, 3)
+	var statusErr StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 after running out of retries, got %v", err)
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	server, _ := newServer(t, ctile.WithRequestSigning(ctile.RequestSigning{Keys: [][]byte{[]byte("s3cret")}}))
+
+	c, err := New(server.URL, 4, WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetEntries(context.Background(), 0, 3)
+	var statusErr StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401 without the key, got %v", err)
+	}
+
+	c, err = New(server.URL, 4, WithSigningKey([]byte("s3cret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetEntries(context.Background(), 0, 3)
+	if err != nil {
+		t.Errorf("expected success with the key, got %s", err)
+	}
+}
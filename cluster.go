@@ -0,0 +1,167 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ring assigns each tile to one instance in a cluster of ctile instances
+// sharing an S3 cache, so each tile is fetched from the backend and written to
+// S3 by one instance, however many receive requests for it. It uses
+// rendezvous hashing, so adding or removing an instance only moves the tiles
+// it owns. A Ring may be shared by Handlers, and its peers may be changed
+// while they run.
+type Ring struct {
+	self string
+
+	// mu protects peers.
+	mu    sync.RWMutex
+	peers []string
+}
+
+// NewRing returns a Ring for the instance reachable by its peers at self, in a
+// cluster whose instances are reachable at peers. self is added to peers if
+// it's missing.
+func NewRing(self string, peers []string) (*Ring, error) {
+	if self == "" {
+		return nil, errors.New("cluster self URL must not be empty")
+	}
+	r := &Ring{self: self}
+	err := r.SetPeers(peers)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetPeers replaces the instances in the cluster. self is added if it's
+// missing.
+func (r *Ring) SetPeers(peers []string) error {
+	seen := map[string]bool{r.self: true}
+	sorted := []string{r.self}
+	for _, peer := range peers {
+		if peer == "" {
+			return errors.New("cluster peer URLs must not be empty")
+		}
+		if !seen[peer] {
+			seen[peer] = true
+			sorted = append(sorted, peer)
+		}
+	}
+	sort.Strings(sorted)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = sorted
+	return nil
+}
+
+// Peers returns the instances in the cluster, including self, sorted.
+func (r *Ring) Peers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.peers...)
+}
+
+// owner returns the URL of the instance that owns key: the one for which the
+// hash of its URL and key is highest.
+func (r *Ring) owner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var owner string
+	var highest uint64
+	for _, peer := range r.peers {
+		h := fnv.New64a()
+		h.Write([]byte(peer))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if sum := h.Sum64(); owner == "" || sum > highest {
+			owner, highest = peer, sum
+		}
+	}
+	return owner
+}
+
+// WithCluster makes the Handler one instance of the cluster described by
+// ring. A tile missing from S3 that's owned by another instance is requested
+// from that instance, which fetches and caches it, rather than from the
+// backend. path is where the log is served on every instance, e.g. "/2024h1",
+// or "" for the root. If the owner fails, the tile is fetched from the
+// backend directly.
+func WithCluster(ring *Ring, path string) Option {
+	return func(o *options) {
+		o.ring = ring
+		o.clusterPath = path
+	}
+}
+
+// WithReadThroughPeer makes the Handler request tiles missing from S3 from
+// another instance of ctile at peer, rather than from the backend, so an
+// instance that has the tile in flight, or will fetch it for others anyway,
+// fetches it once for both. path is where the log is served on the peer, e.g.
+// "/2024h1", or "" for the root. With WithCluster, the owner of a tile is
+// asked first, and the peer only for tiles this instance owns. If the peer
+// fails, the tile is fetched from the backend directly.
+func WithReadThroughPeer(peer, path string) Option {
+	return func(o *options) {
+		o.readThroughPeer = peer
+		o.clusterPath = path
+	}
+}
+
+// forwardedHeader marks requests forwarded to the owner of a tile, or to a
+// read-through peer, so they aren't forwarded again, e.g. when instances
+// disagree about membership or are each other's read-through peers.
+const forwardedHeader = "X-Ctile-Forwarded"
+
+type forwardedKey struct{}
+
+// isForwarded returns true if ctx belongs to a request forwarded by a peer.
+func isForwarded(ctx context.Context) bool {
+	forwarded, _ := ctx.Value(forwardedKey{}).(bool)
+	return forwarded
+}
+
+// peerFor returns the URL of the peer to request t from: the peer that owns
+// it, if there's a cluster, or else the read-through peer. It returns "" if
+// there's no such peer, or the request was forwarded to this instance.
+func (tch *Handler) peerFor(ctx context.Context, t tile) string {
+	if isForwarded(ctx) {
+		return ""
+	}
+	if tch.ring != nil {
+		bucket, prefix := tch.location(t)
+		owner := tch.ring.owner(bucket + "/" + prefix + t.key())
+		if owner != tch.ring.self {
+			return owner
+		}
+	}
+	return tch.readThroughPeer
+}
+
+// fetchFromPeer requests t from peer, and records metrics about the result.
+func (tch *Handler) fetchFromPeer(ctx context.Context, peer string, t tile) (*Entries, error) {
+	header := http.Header{}
+	header.Set(forwardedHeader, "1")
+	tileURL := t.url(peer + tch.clusterPath)
+	if rs := tch.requestSigning.Load(); len(rs.Keys) > 0 {
+		u, err := url.Parse(tileURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing peer URL: %w", err)
+		}
+		signHeader(header, rs.Keys[0], u, time.Now())
+	}
+	contents, err := getTile(ctx, tch.httpClient, tileURL, header, t, tch.maxBackendBodySize)
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "peer_get").Inc()
+		return nil, fmt.Errorf("error reading tile from peer %s: %w", peer, err)
+	}
+	return contents, nil
+}
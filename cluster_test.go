@@ -0,0 +1,182 @@
+package ctile
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestRingOwner(t *testing.T) {
+	ring, err := NewRing("a", []string{"b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := ring.Peers(); len(peers) != 3 {
+		t.Errorf("expected self to be added to peers, got %q", peers)
+	}
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprint(i)
+		owners[key] = ring.owner(key)
+		counts[owners[key]]++
+	}
+	for _, peer := range []string{"a", "b", "c"} {
+		if counts[peer] < 800 {
+			t.Errorf("expected tiles to be spread evenly, got %v", counts)
+		}
+	}
+
+	err = ring.SetPeers([]string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, owner := range owners {
+		if owner != "c" && ring.owner(key) != owner {
+			t.Fatalf("expected only tiles owned by the removed peer to move, but %s moved from %s to %s", key, owner, ring.owner(key))
+		}
+	}
+}
+
+func TestClusterFetchesOnce(t *testing.T) {
+	var mu sync.Mutex
+	fetches := make(map[string]int)
+	fake := fakelog.New(30, 3)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches[r.URL.RawQuery]++
+		mu.Unlock()
+		fake.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	// Instances need their own URLs to build the ring, so they're served
+	// through handlers that are set once the instances exist.
+	svc := s3mem.New()
+	var instances [2]*Handler
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			instances[i].ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+	}
+	for i := range instances {
+		ring, err := NewRing(servers[i].URL, []string{servers[0].URL, servers[1].URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances[i], err = New(backend.URL,
+			WithTileSize(3),
+			WithS3(svc, "bucket", "test/"),
+			WithCluster(ring, ""),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sources := make(map[string]int)
+	for start := 0; start < 30; start += 3 {
+		for _, instance := range instances {
+			url := fmt.Sprintf("/ct/v1/get-entries?start=%d&end=%d", start, start+2)
+			_, headers, err := getAndParseResp(t, instance, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources[headers.Get("X-Source")]++
+		}
+	}
+	for query, n := range fetches {
+		if n != 1 {
+			t.Errorf("expected each tile to be fetched from the backend once, but %s was fetched %d times", query, n)
+		}
+	}
+	if sources["peer"] == 0 {
+		t.Errorf("expected some tiles to be fetched through their owner, got sources %v", sources)
+	}
+}
+
+func TestReadThroughPeer(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(30, 3))
+	defer backend.Close()
+
+	peerHandler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewServer(http.StripPrefix("/2023", peerHandler))
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithReadThroughPeer(peer.URL, "/2023"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, headers, err := getAndParseResp(t, handler, "/ct/v1/get-entries?start=0&end=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("X-Source") != "peer" {
+		t.Errorf("expected tile from the read-through peer, got X-Source %q", headers.Get("X-Source"))
+	}
+
+	peer.Close()
+	_, headers, err = getAndParseResp(t, handler, "/ct/v1/get-entries?start=3&end=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("X-Source") != "CT log" {
+		t.Errorf("expected fallback to the backend when the peer is down, got X-Source %q", headers.Get("X-Source"))
+	}
+}
+
+func TestPeerTilesInMemoryCache(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	peerHandler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewServer(http.StripPrefix("/2023", peerHandler))
+	defer peer.Close()
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithReadThroughPeer(peer.URL, "/2023"),
+		WithMemoryCache(1<<20),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url, source string
+	}{
+		{"/ct/v1/get-entries?start=0&end=2", "peer"},
+		{"/ct/v1/get-entries?start=0&end=2", "memory"},
+		// Partial tiles aren't kept.
+		{"/ct/v1/get-entries?start=9&end=9", "peer"},
+		{"/ct/v1/get-entries?start=9&end=9", "peer"},
+	} {
+		_, headers, err := getAndParseResp(t, handler, tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if headers.Get("X-Source") != tc.source {
+			t.Errorf("%s: expected X-Source %q, got %q", tc.url, tc.source, headers.Get("X-Source"))
+		}
+	}
+}
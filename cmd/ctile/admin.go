@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// adminAPI serves operational endpoints for changing a running server.
+//
+//	GET  /features  lists the rollout of every enabled feature, by log name
+//	POST /features  sets a rollout; form values log, feature, and rollout
+//
+// The single log configured by flags has the empty name.
+type adminAPI struct {
+	// mu protects features, which changes as logs are added and removed.
+	mu       sync.RWMutex
+	features map[string]*ctile.FeatureFlags
+}
+
+func newAdminAPI() *adminAPI {
+	return &adminAPI{features: make(map[string]*ctile.FeatureFlags)}
+}
+
+// addLog makes the feature flags of the named log available.
+func (a *adminAPI) addLog(name string, flags *ctile.FeatureFlags) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.features[name] = flags
+}
+
+// removeLog forgets the named log.
+func (a *adminAPI) removeLog(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.features, name)
+}
+
+// logFeatures returns the feature flags of the named log.
+func (a *adminAPI) logFeatures(name string) (*ctile.FeatureFlags, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	flags, ok := a.features[name]
+	return flags, ok
+}
+
+func (a *adminAPI) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/features", a.handleFeatures)
+	return mux
+}
+
+func (a *adminAPI) handleFeatures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		snapshot := make(map[string]map[ctile.Feature]int)
+		a.mu.RLock()
+		for name, flags := range a.features {
+			snapshot[name] = flags.Snapshot()
+		}
+		a.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(snapshot)
+		if err != nil {
+			log.Printf("error writing admin response: %s\n", err)
+		}
+	case http.MethodPost:
+		logName := r.FormValue("log")
+		flags, ok := a.logFeatures(logName)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown log %q", logName), http.StatusNotFound)
+			return
+		}
+		feature := ctile.Feature(r.FormValue("feature"))
+		rollout, err := strconv.Atoi(r.FormValue("rollout"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid rollout: %s", err), http.StatusBadRequest)
+			return
+		}
+		err = flags.Set(feature, rollout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin API set rollout of feature %q for log %q to %d%%\n", feature, logName, rollout)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
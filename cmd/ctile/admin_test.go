@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile"
+)
+
+func TestAdminFeatures(t *testing.T) {
+	flags, err := ctile.NewFeatureFlags(map[ctile.Feature]int{"prefetch": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &adminAPI{features: map[string]*ctile.FeatureFlags{"2024h1": flags}}
+	handler := api.routes()
+
+	post := func(form url.Values) int {
+		req := httptest.NewRequest(http.MethodPost, "/features", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	code := post(url.Values{"log": {"2024h1"}, "feature": {"zstd"}, "rollout": {"25"}})
+	if code != http.StatusNoContent {
+		t.Errorf("expected status 204 setting a rollout, got %d", code)
+	}
+	if flags.Snapshot()["zstd"] != 25 {
+		t.Errorf("expected zstd rollout of 25, got %v", flags.Snapshot())
+	}
+	if code := post(url.Values{"log": {"2023"}, "feature": {"zstd"}, "rollout": {"25"}}); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown log, got %d", code)
+	}
+	if code := post(url.Values{"log": {"2024h1"}, "feature": {"zstd"}, "rollout": {"200"}}); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid rollout, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/features", nil))
+	expected := `{"2024h1":{"prefetch":10,"zstd":25}}`
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("expected %s, got %s", expected, w.Body.String())
+	}
+}
+
+func TestFeatureRolloutsFlag(t *testing.T) {
+	var f featureRollouts
+	err := f.Set("zstd=100,prefetch=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.String() != "prefetch=10,zstd=100" {
+		t.Errorf("unexpected String() %q", f.String())
+	}
+	if f.Set("prefetch") == nil || f.Set("prefetch=lots") == nil {
+		t.Error("expected errors for malformed rollouts, got none")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// secret is a flag.Value for sensitive strings. It prints as REDACTED so its
+// value doesn't leak into logs, e.g. via logEffectiveConfig.
+type secret string
+
+func (s *secret) String() string {
+	if s == nil || *s == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+func (s *secret) Set(v string) error {
+	*s = secret(v)
+	return nil
+}
+
+// listenerSecurity configures authentication and TLS for an operational
+// listener, such as the metrics listener. Requests must pass basic auth or
+// bearer token auth if either is configured; if both are, either is
+// accepted. With a client CA, connections must present a certificate signed
+// by it (mTLS).
+//
+// Secrets can be given directly, or as paths to files, which is compatible
+// with Kubernetes secret mounts and keeps them off the command line. Files,
+// including the TLS certificate, key, and client CA, are read by reload, at
+// startup and again whenever the server reloads.
+type listenerSecurity struct {
+	basicAuth       secret // "user:password"
+	basicAuthFile   string
+	bearerToken     secret
+	bearerTokenFile string
+
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	// mu protects current.
+	mu      sync.RWMutex
+	current listenerCredentials
+}
+
+// listenerCredentials are the credentials in effect for a listener, as loaded
+// by reload.
+type listenerCredentials struct {
+	basicAuth   string
+	bearerToken string
+	cert        *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// registerFlags binds the fields of s to flags in fs whose names start with
+// prefix, e.g. "metrics-".
+func (s *listenerSecurity) registerFlags(fs *flag.FlagSet, prefix, listener string) {
+	fs.Var(&s.basicAuth, prefix+"basic-auth", fmt.Sprintf("require HTTP basic auth on the %s listener, in the form user:password", listener))
+	fs.StringVar(&s.basicAuthFile, prefix+"basic-auth-file", "", fmt.Sprintf("file containing the value for -%sbasic-auth", prefix))
+	fs.Var(&s.bearerToken, prefix+"bearer-token", fmt.Sprintf("require this bearer token on the %s listener", listener))
+	fs.StringVar(&s.bearerTokenFile, prefix+"bearer-token-file", "", fmt.Sprintf("file containing the value for -%sbearer-token", prefix))
+	fs.StringVar(&s.tlsCert, prefix+"tls-cert", "", fmt.Sprintf("PEM certificate file for serving the %s listener over TLS", listener))
+	fs.StringVar(&s.tlsKey, prefix+"tls-key", "", fmt.Sprintf("PEM private key file for -%stls-cert", prefix))
+	fs.StringVar(&s.tlsClientCA, prefix+"tls-client-ca", "", fmt.Sprintf("PEM CA certificates file. if set, clients of the %s listener must present a certificate it signed", listener))
+}
+
+// validate returns every problem with s, naming flags with prefix. It also
+// loads the credentials, so files are checked too.
+func (s *listenerSecurity) validate(prefix string) []error {
+	var errs []error
+	if s.basicAuth != "" && s.basicAuthFile != "" {
+		errs = append(errs, fmt.Errorf("-%sbasic-auth and -%sbasic-auth-file are mutually exclusive", prefix, prefix))
+	}
+	if s.bearerToken != "" && s.bearerTokenFile != "" {
+		errs = append(errs, fmt.Errorf("-%sbearer-token and -%sbearer-token-file are mutually exclusive", prefix, prefix))
+	}
+	if (s.tlsCert == "") != (s.tlsKey == "") {
+		errs = append(errs, fmt.Errorf("-%stls-cert and -%stls-key must be set together", prefix, prefix))
+	}
+	if s.tlsClientCA != "" && s.tlsCert == "" {
+		errs = append(errs, fmt.Errorf("-%stls-client-ca requires -%stls-cert", prefix, prefix))
+	}
+	if len(errs) == 0 {
+		err := s.reload()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s listener: %w", strings.TrimSuffix(prefix, "-"), err))
+		}
+	}
+	return errs
+}
+
+// reload reads the secrets and TLS files, and puts them into effect. If any
+// can't be read, the credentials already in effect are kept.
+func (s *listenerSecurity) reload() error {
+	var creds listenerCredentials
+	var err error
+
+	creds.basicAuth, err = secretValue(s.basicAuth, s.basicAuthFile)
+	if err != nil {
+		return err
+	}
+	if creds.basicAuth != "" && !strings.Contains(creds.basicAuth, ":") {
+		return errors.New("basic auth must be in the form user:password")
+	}
+	creds.bearerToken, err = secretValue(s.bearerToken, s.bearerTokenFile)
+	if err != nil {
+		return err
+	}
+
+	if s.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.tlsCert, s.tlsKey)
+		if err != nil {
+			return fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		creds.cert = &cert
+	}
+	if s.tlsClientCA != "" {
+		pem, err := os.ReadFile(s.tlsClientCA)
+		if err != nil {
+			return fmt.Errorf("reading TLS client CA: %w", err)
+		}
+		creds.clientCAs = x509.NewCertPool()
+		if !creds.clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in TLS client CA file")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = creds
+	return nil
+}
+
+// credentials returns the credentials currently in effect.
+func (s *listenerSecurity) credentials() listenerCredentials {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// secretValue returns value if it's set, or else the contents of file with
+// surrounding whitespace removed, if it's set.
+func secretValue(value secret, file string) (string, error) {
+	if file == "" {
+		return string(value), nil
+	}
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading secret: %w", err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// tlsConfig returns the TLS config for the listener, or nil if it should
+// serve plain HTTP. The config uses the certificate and client CA in effect at
+// the time of each handshake, so reloads apply to new connections.
+func (s *listenerSecurity) tlsConfig() *tls.Config {
+	if s.tlsCert == "" {
+		return nil
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.credentials().cert, nil
+		},
+	}
+	if s.tlsClientCA != "" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := config.Clone()
+			clientConfig.GetConfigForClient = nil
+			clientConfig.ClientCAs = s.credentials().clientCAs
+			return clientConfig, nil
+		}
+	}
+	return config
+}
+
+// wrap returns next, requiring authentication if any is configured.
+func (s *listenerSecurity) wrap(next http.Handler) http.Handler {
+	if s.basicAuth == "" && s.basicAuthFile == "" && s.bearerToken == "" && s.bearerTokenFile == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds := s.credentials()
+		if creds.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if creds.basicAuth != "" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="ctile"`)
+		}
+		if creds.bearerToken != "" {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="ctile"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (c listenerCredentials) authorized(r *http.Request) bool {
+	if c.basicAuth != "" {
+		user, password, ok := r.BasicAuth()
+		if ok && constantTimeEqual(user+":"+password, c.basicAuth) {
+			return true
+		}
+	}
+	if c.bearerToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && constantTimeEqual(token, c.bearerToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizesDebug returns whether r's ctile.DebugHeader holds the bearer
+// token of the listener, so debugging requests is only open to those allowed
+// on it. With no bearer token, it returns false.
+func (s *listenerSecurity) authorizesDebug(r *http.Request) bool {
+	token := s.credentials().bearerToken
+	return token != "" && constantTimeEqual(r.Header.Get(ctile.DebugHeader), token)
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
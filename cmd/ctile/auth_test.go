@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile"
+)
+
+func TestListenerSecurityWrap(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	security := listenerSecurity{basicAuth: "prom:hunter2", bearerToken: "s3cret"}
+	err := security.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := security.wrap(ok)
+
+	testCases := []struct {
+		name     string
+		setup    func(r *http.Request)
+		expected int
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("prom", "hunter2") }, http.StatusOK},
+		{"wrong basic", func(r *http.Request) { r.SetBasicAuth("prom", "hunter3") }, http.StatusUnauthorized},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"wrong bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		tc.setup(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.expected {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.expected, w.Code)
+		}
+	}
+
+	var open listenerSecurity
+	w := httptest.NewRecorder()
+	open.wrap(ok).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected no auth to be required when unconfigured, got status %d", w.Code)
+	}
+}
+
+func TestListenerSecurityAuthorizesDebug(t *testing.T) {
+	security := listenerSecurity{bearerToken: "s3cret"}
+	err := security.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, expected := range map[string]bool{"s3cret": true, "nope": false, "": false} {
+		req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=0", nil)
+		req.Header.Set(ctile.DebugHeader, token)
+		if got := security.authorizesDebug(req); got != expected {
+			t.Errorf("%q: expected %t, got %t", token, expected, got)
+		}
+	}
+
+	var open listenerSecurity
+	req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=0", nil)
+	req.Header.Set(ctile.DebugHeader, "")
+	if open.authorizesDebug(req) {
+		t.Error("expected debugging to be disabled without a bearer token")
+	}
+}
+
+func TestListenerSecurityValidate(t *testing.T) {
+	security := listenerSecurity{basicAuth: "a:b", basicAuthFile: "auth", tlsCert: "cert.pem", tlsClientCA: "ca.pem"}
+	errs := security.validate("metrics-")
+	if len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %q", errs)
+	}
+
+	security = listenerSecurity{basicAuth: "nocolon"}
+	errs = security.validate("metrics-")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "user:password") {
+		t.Errorf("expected an error about the form of basic auth, got %q", errs)
+	}
+
+	s := secret("hunter2")
+	if s.String() != "REDACTED" {
+		t.Errorf("expected secret to print as REDACTED, got %q", s.String())
+	}
+}
+
+func TestListenerSecurityReload(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("first\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	security := listenerSecurity{bearerTokenFile: tokenFile}
+	errs := security.validate("admin-")
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %q", errs)
+	}
+	handler := security.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	statusWithToken := func(token string) int {
+		req := httptest.NewRequest("GET", "/features", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := statusWithToken("first"); code != http.StatusOK {
+		t.Errorf("expected token from file to be accepted, got status %d", code)
+	}
+
+	err = os.WriteFile(tokenFile, []byte("second\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := statusWithToken("second"); code != http.StatusUnauthorized {
+		t.Errorf("expected the rotated token to be rejected before reloading, got status %d", code)
+	}
+	err = security.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := statusWithToken("second"); code != http.StatusOK {
+		t.Errorf("expected the rotated token to be accepted after reloading, got status %d", code)
+	}
+
+	err = os.Remove(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if security.reload() == nil {
+		t.Error("expected error reloading a missing file, got none")
+	}
+	if code := statusWithToken("second"); code != http.StatusOK {
+		t.Errorf("expected a failed reload to keep the previous token, got status %d", code)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// backfillLease is the coordination object for one chunk of a backfill,
+// stored in S3 next to the tiles. A worker claims a chunk by writing a lease
+// with its name, and marks it done once every tile in the chunk is cached.
+// Leases that have expired, e.g. because their worker crashed, can be taken
+// over by another worker.
+type backfillLease struct {
+	Worker  string    `json:"worker"`
+	Expires time.Time `json:"expires"`
+	Done    bool      `json:"done"`
+}
+
+// backfiller caches every tile in a range of the log by requesting it through
+// a Handler. The range is split into chunks of chunkTiles tiles, and chunks
+// are claimed with leases, so backfillers on several hosts can share the work.
+//
+// S3 has no atomic create, so two workers that claim the same chunk at the
+// same moment may both fill it. After writing a lease, a worker waits for
+// `settle` and reads it back, which makes that unlikely; when it does happen,
+// it only costs duplicate work, since both write the same tiles.
+type backfiller struct {
+	svc      ctile.S3API
+	bucket   string
+	prefix   string
+	handler  http.Handler
+	tileSize int64
+
+	chunkTiles    int64
+	worker        string
+	leaseDuration time.Duration
+	settle        time.Duration
+	now           func() time.Time
+}
+
+// backfillStats counts the chunks a backfiller filled, and those it skipped
+// because they were done or leased by another worker.
+type backfillStats struct {
+	filled  int
+	done    int
+	claimed int
+}
+
+// runBackfill implements the `ctile backfill` subcommand, which fills the
+// cache with every complete tile in a range of the log ahead of time, so the
+// first clients to read it don't have to wait on the backend. Running it on
+// several hosts with the same flags splits the work between them.
+func runBackfill(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	logURL := fs.String("log-url", "", "CT log URL. e.g. https://oak.ct.letsencrypt.org/2023")
+	s3bucket := fs.String("s3-bucket", "", "s3 bucket to fill")
+	s3prefix := fs.String("s3-prefix", "", "prefix for s3 keys, as used by the server")
+	tileSize := fs.Int64("tile-size", 0, "tile size, as used by the server")
+	var shards shardMap
+	fs.Var(&shards, "s3-shards", "ranges of the log cached in other buckets or under other prefixes, as used by the server")
+	keyLayout := fs.String("s3-key-layout", string(ctile.KeyLayoutFlat), "how tile keys are laid out, as used by the server. 'hashed' spreads the backfill's writes over s3's partitions")
+	start := fs.Int64("start", 0, "backfill tiles containing entries at or after this index")
+	end := fs.Int64("end", -1, "backfill tiles containing entries at or before this index (inclusive, as in get-entries). -1 means up to the current tree size")
+	concurrency := fs.Int("concurrency", 4, "number of chunks to fill at once on this host")
+	chunkTiles := fs.Int64("chunk-tiles", 1000, "number of tiles in each unit of work claimed by a worker")
+	worker := fs.String("worker", "", "name of this worker in leases. defaults to the host name and process ID")
+	leaseDuration := fs.Duration("lease-duration", 10*time.Minute, "how long a chunk stays claimed without being renewed. a worker renews its lease after each tile once half of this has passed")
+	settle := fs.Duration("lease-settle", 2*time.Second, "how long to wait after claiming a chunk before checking that the claim held")
+	timeout := fs.Duration("timeout", 30*time.Second, "max time to spend fetching and caching each tile")
+	var awsOpts storageFlags
+	awsOpts.registerFlags(fs)
+	fs.Parse(args)
+
+	if *logURL == "" {
+		log.Fatal("missing required flag: -log-url")
+	}
+	if *s3bucket == "" {
+		log.Fatal("missing required flag: -s3-bucket")
+	}
+	if *s3prefix == "" {
+		log.Fatal("missing required flag: -s3-prefix")
+	}
+	if *tileSize <= 0 || *chunkTiles <= 0 || *concurrency <= 0 {
+		log.Fatal("-tile-size, -chunk-tiles and -concurrency must be positive")
+	}
+	if *start < 0 || *end < -1 {
+		log.Fatal("-start and -end must not be negative")
+	}
+	if *end != -1 && *end < *start {
+		log.Fatal("-end must be greater than or equal to -start")
+	}
+	if *leaseDuration <= 0 || *settle < 0 || *settle >= *leaseDuration/2 {
+		log.Fatal("-lease-duration must be positive, and -lease-settle less than half of it")
+	}
+	if errs := shards.validate(*tileSize); len(errs) > 0 {
+		log.Fatal(errors.Join(errs...))
+	}
+	layout, err := ctile.ParseKeyLayout(*keyLayout)
+	if err != nil {
+		log.Fatalf("-s3-key-layout: %s", err)
+	}
+	if *worker == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("getting host name for -worker: %s", err)
+		}
+		*worker = fmt.Sprintf("%s/%d", host, os.Getpid())
+	}
+
+	ctx := context.Background()
+	svc, err := newStorageService(ctx, awsOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler, err := ctile.New(*logURL,
+		ctile.WithTileSize(int(*tileSize)),
+		ctile.WithS3(svc, *s3bucket, *s3prefix),
+		ctile.WithShards(shards.shards()),
+		ctile.WithKeyLayout(layout),
+		ctile.WithTimeouts(ctile.Timeouts{FullRequest: *timeout}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	treeSize, err := getTreeSize(ctx, *logURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limit := treeSize
+	if *end != -1 && *end+1 < limit {
+		limit = *end + 1
+	}
+
+	b := &backfiller{
+		svc:           svc,
+		bucket:        *s3bucket,
+		prefix:        *s3prefix,
+		handler:       handler,
+		tileSize:      *tileSize,
+		chunkTiles:    *chunkTiles,
+		worker:        *worker,
+		leaseDuration: *leaseDuration,
+		settle:        *settle,
+		now:           time.Now,
+	}
+	stats, err := b.run(ctx, *start, limit, treeSize, *concurrency)
+	fmt.Fprintf(os.Stderr, "filled %d chunks (%d already done, %d claimed by other workers)\n", stats.filled, stats.done, stats.claimed)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run fills every complete tile overlapping [start, limit), where treeSize is
+// the size of the log, using `concurrency` goroutines. It stops at the first
+// error; chunks that were in progress are left leased, and will be picked up
+// by another worker once their leases expire.
+func (b *backfiller) run(ctx context.Context, start, limit, treeSize int64, concurrency int) (backfillStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunkSize := b.chunkTiles * b.tileSize
+	chunks := make(chan int64)
+	go func() {
+		defer close(chunks)
+		for chunk := start - start%chunkSize; chunk < limit; chunk += chunkSize {
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var stats backfillStats
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				filled, lease, err := b.fillChunk(ctx, chunk, start, limit, treeSize)
+				mu.Lock()
+				switch {
+				case err != nil:
+					errs = append(errs, err)
+					cancel()
+				case filled:
+					stats.filled++
+				case lease != nil && lease.Done:
+					stats.done++
+				default:
+					stats.claimed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return stats, errors.Join(errs...)
+}
+
+// fillChunk claims the chunk starting at `chunk` and caches the complete tiles
+// in it that overlap [start, limit). It returns whether it filled the chunk,
+// and if not, the lease that prevented it.
+func (b *backfiller) fillChunk(ctx context.Context, chunk, start, limit, treeSize int64) (bool, *backfillLease, error) {
+	lease, ok, err := b.claim(ctx, chunk)
+	if err != nil || !ok {
+		return false, lease, err
+	}
+
+	renewed := b.now()
+	chunkEnd := chunk + b.chunkTiles*b.tileSize
+	for tile := chunk; tile < chunkEnd && tile < limit; tile += b.tileSize {
+		if tile+b.tileSize <= start || tile+b.tileSize > treeSize {
+			continue
+		}
+		err := b.fillTile(ctx, tile)
+		if err != nil {
+			return false, nil, err
+		}
+		if b.now().Sub(renewed) > b.leaseDuration/2 {
+			renewed = b.now()
+			err = b.writeLease(ctx, chunk, backfillLease{Worker: b.worker, Expires: renewed.Add(b.leaseDuration)})
+			if err != nil {
+				return false, nil, err
+			}
+		}
+	}
+
+	// A chunk is only done once all of its tiles are cached, which needs both
+	// the log and the requested range to cover it. Otherwise the lease is
+	// released, so a later backfill can finish it.
+	done := chunk+b.tileSize > start && chunkEnd-b.tileSize < limit && chunkEnd <= treeSize
+	err = b.writeLease(ctx, chunk, backfillLease{Worker: b.worker, Done: done})
+	if err != nil {
+		return false, nil, err
+	}
+	return true, nil, nil
+}
+
+// claim takes the lease for the chunk starting at `chunk` unless it's done or
+// held by another worker, in which case it returns that lease.
+func (b *backfiller) claim(ctx context.Context, chunk int64) (*backfillLease, bool, error) {
+	lease, err := b.readLease(ctx, chunk)
+	if err != nil {
+		return nil, false, err
+	}
+	if lease != nil && (lease.Done || (lease.Worker != b.worker && lease.Expires.After(b.now()))) {
+		return lease, false, nil
+	}
+
+	err = b.writeLease(ctx, chunk, backfillLease{Worker: b.worker, Expires: b.now().Add(b.leaseDuration)})
+	if err != nil {
+		return nil, false, err
+	}
+	if b.settle > 0 {
+		select {
+		case <-time.After(b.settle):
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	lease, err = b.readLease(ctx, chunk)
+	if err != nil {
+		return nil, false, err
+	}
+	if lease == nil || lease.Worker != b.worker {
+		return lease, false, nil
+	}
+	return lease, true, nil
+}
+
+// leaseKey returns the S3 key of the lease for the chunk starting at `chunk`.
+func (b *backfiller) leaseKey(chunk int64) string {
+	return fmt.Sprintf("%sbackfill/tile_size=%d/chunk_tiles=%d/%d", b.prefix, b.tileSize, b.chunkTiles, chunk)
+}
+
+// readLease returns the lease for the chunk starting at `chunk`, or nil if
+// there is none.
+func (b *backfiller) readLease(ctx context.Context, chunk int64) (*backfillLease, error) {
+	key := b.leaseKey(chunk)
+	resp, err := b.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading lease %q: %w", key, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading lease %q: %w", key, err)
+	}
+	var lease backfillLease
+	err = json.Unmarshal(body, &lease)
+	if err != nil {
+		return nil, fmt.Errorf("parsing lease %q: %w", key, err)
+	}
+	return &lease, nil
+}
+
+// writeLease stores `lease` for the chunk starting at `chunk`.
+func (b *backfiller) writeLease(ctx context.Context, chunk int64, lease backfillLease) error {
+	key := b.leaseKey(chunk)
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	_, err = b.svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("writing lease %q: %w", key, err)
+	}
+	return nil
+}
+
+// fillTile requests the tile starting at `start` from the handler, which
+// serves it from S3 if it's already cached, or fetches and caches it.
+func (b *backfiller) fillTile(ctx context.Context, start int64) error {
+	url := fmt.Sprintf("/ct/v1/get-entries?start=%d&end=%d", start, start+b.tileSize-1)
+	req := httptest.NewRequest(http.MethodGet, url, nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	b.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("filling tile %d: status code %d: %s", start, rec.Code, bytes.TrimSpace(rec.Body.Bytes()))
+	}
+	return nil
+}
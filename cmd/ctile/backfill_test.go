@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func newTestBackfiller(t *testing.T, svc *s3mem.Client, logURL, worker string) *backfiller {
+	t.Helper()
+	handler, err := ctile.New(logURL,
+		ctile.WithTileSize(4),
+		ctile.WithS3(svc, "bucket", "prefix/"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &backfiller{
+		svc:           svc,
+		bucket:        "bucket",
+		prefix:        "prefix/",
+		handler:       handler,
+		tileSize:      4,
+		chunkTiles:    3,
+		worker:        worker,
+		leaseDuration: time.Minute,
+		now:           time.Now,
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	const treeSize = 42
+	srv := httptest.NewServer(fakelog.New(treeSize, 4))
+	defer srv.Close()
+	svc := s3mem.New()
+	ctx := context.Background()
+
+	// Two workers share the log; together they must cache every full tile.
+	var wg sync.WaitGroup
+	for _, worker := range []string{"a", "b"} {
+		b := newTestBackfiller(t, svc, srv.URL, worker)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.run(ctx, 0, treeSize, treeSize, 2)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	keys, err := ctile.NewTileKeys(srv.URL, ctile.WithTileSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts, err := listTileStarts(ctx, svc, "bucket", "prefix/", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(starts) != 10 {
+		t.Errorf("expected 10 cached tiles, got %v", starts)
+	}
+
+	b := newTestBackfiller(t, svc, srv.URL, "c")
+	for chunk, expected := range map[int64]bool{0: true, 12: true, 24: true, 36: false} {
+		lease, err := b.readLease(ctx, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease == nil || lease.Done != expected {
+			t.Errorf("chunk %d: expected done=%t, got %+v", chunk, expected, lease)
+		}
+	}
+
+	// Done chunks are skipped; the last one is filled again since the log
+	// may have grown into it.
+	stats, err := b.run(ctx, 0, treeSize, treeSize, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.filled != 1 || stats.done != 3 || stats.claimed != 0 {
+		t.Errorf("expected 1 filled and 3 done, got %+v", stats)
+	}
+}
+
+func TestBackfillLeases(t *testing.T) {
+	srv := httptest.NewServer(fakelog.New(12, 4))
+	defer srv.Close()
+	svc := s3mem.New()
+	ctx := context.Background()
+
+	now := time.Now()
+	b := newTestBackfiller(t, svc, srv.URL, "a")
+	b.now = func() time.Time { return now }
+	err := b.writeLease(ctx, 0, backfillLease{Worker: "b", Expires: now.Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := b.run(ctx, 0, 12, 12, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.claimed != 1 || stats.filled != 0 {
+		t.Errorf("expected chunk held by another worker to be skipped, got %+v", stats)
+	}
+
+	now = now.Add(2 * time.Second)
+	stats, err = b.run(ctx, 0, 12, 12, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.filled != 1 {
+		t.Errorf("expected expired lease to be taken over, got %+v", stats)
+	}
+	lease, err := b.readLease(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease == nil || lease.Worker != "a" || !lease.Done {
+		t.Errorf("expected chunk done by a, got %+v", lease)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchPattern generates the start offsets of get-entries requests for
+// `ctile bench`. It must be safe for concurrent use.
+type benchPattern interface {
+	next() int64
+}
+
+// sequentialPattern models crawlers walking the log from beginning to end,
+// each request starting where the previous one left off. When it reaches the
+// end of the log, it wraps around.
+type sequentialPattern struct {
+	pos      atomic.Int64
+	batch    int64
+	treeSize int64
+}
+
+func (s *sequentialPattern) next() int64 {
+	return (s.pos.Add(s.batch) - s.batch) % s.treeSize
+}
+
+// randomPattern models monitors fetching entries at random positions in the
+// log, optionally aligned down to a multiple of `align`.
+type randomPattern struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	align    int64
+	treeSize int64
+}
+
+func (r *randomPattern) next() int64 {
+	r.mu.Lock()
+	start := r.rand.Int63n(r.treeSize)
+	r.mu.Unlock()
+	if r.align > 1 {
+		start -= start % r.align
+	}
+	return start
+}
+
+// benchResults accumulates the outcomes of requests made by `ctile bench`.
+type benchResults struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	statuses  map[int]int
+	sources   map[string]int
+	errors    int
+}
+
+func (b *benchResults) record(latency time.Duration, status int, source string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.errors++
+		return
+	}
+	b.latencies = append(b.latencies, latency)
+	b.statuses[status]++
+	if source != "" {
+		b.sources[source]++
+	}
+}
+
+// percentile returns the p'th percentile (0-100) of the sorted durations,
+// using the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// report writes a summary of the results to w.
+func (b *benchResults) report(w io.Writer, elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sorted := append([]time.Duration(nil), b.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	total := len(sorted) + b.errors
+	fmt.Fprintf(w, "requests:   %d in %s (%.1f/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	fmt.Fprintf(w, "errors:     %d\n", b.errors)
+	fmt.Fprintf(w, "latency:    p50=%s p90=%s p99=%s max=%s\n",
+		percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), percentile(sorted, 100))
+
+	var codes []int
+	for code := range b.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "status %d: %d\n", code, b.statuses[code])
+	}
+
+	var sourced int
+	var sources []string
+	for source, n := range b.sources {
+		sourced += n
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		fmt.Fprintf(w, "source %q: %d (%.1f%%)\n", source, b.sources[source], 100*float64(b.sources[source])/float64(sourced))
+	}
+}
+
+// getTreeSize fetches the current tree size from the get-sth endpoint of the
+// given log (or ctile instance, which passes get-sth through).
+func getTreeSize(ctx context.Context, logURL string) (int64, error) {
+	url := logURL + "/ct/v1/get-sth"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching %s: status code %d", url, resp.StatusCode)
+	}
+	var sth struct {
+		TreeSize int64 `json:"tree_size"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sth)
+	if err != nil {
+		return 0, fmt.Errorf("reading body from %s: %w", url, err)
+	}
+	return sth.TreeSize, nil
+}
+
+// runBench implements the `ctile bench` subcommand, a load generator that
+// sends get-entries traffic to a ctile instance (or directly to a CT log) and
+// reports latency percentiles and cache hit rates, for capacity testing.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("url", "", "URL of the ctile instance or CT log to benchmark, e.g. http://localhost:7962")
+	pattern := fs.String("pattern", "sequential", "request pattern: 'sequential' (crawlers walking the log) or 'random' (monitors)")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run for")
+	concurrency := fs.Int("concurrency", 8, "number of concurrent clients")
+	batch := fs.Int64("batch", 256, "number of entries to request in each get-entries call")
+	align := fs.Int64("align", 0, "for the random pattern, round each start down to a multiple of this. 0 means unaligned")
+	treeSize := fs.Int64("tree-size", 0, "number of entries in the log. defaults to the tree size from get-sth")
+	seed := fs.Int64("seed", 1, "random seed for the random pattern")
+	fs.Parse(args)
+
+	if *target == "" {
+		log.Fatal("missing required flag: -url")
+	}
+	if *concurrency <= 0 || *batch <= 0 || *align < 0 {
+		log.Fatal("-concurrency and -batch must be positive, and -align must not be negative")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	if *treeSize == 0 {
+		size, err := getTreeSize(ctx, *target)
+		if err != nil {
+			log.Fatalf("getting tree size (use -tree-size to specify it): %s", err)
+		}
+		*treeSize = size
+	}
+	if *treeSize <= 0 {
+		log.Fatal("log is empty")
+	}
+
+	var p benchPattern
+	switch *pattern {
+	case "sequential":
+		p = &sequentialPattern{batch: *batch, treeSize: *treeSize}
+	case "random":
+		p = &randomPattern{rand: rand.New(rand.NewSource(*seed)), align: *align, treeSize: *treeSize}
+	default:
+		log.Fatalf("unknown -pattern %q", *pattern)
+	}
+
+	results := &benchResults{statuses: make(map[int]int), sources: make(map[string]int)}
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				start := p.next()
+				url := fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", *target, start, start+*batch-1)
+				latency, status, source, err := benchRequest(ctx, url)
+				if ctx.Err() != nil {
+					// Requests cut short by the end of the run don't count.
+					return
+				}
+				results.record(latency, status, source, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	results.report(os.Stdout, time.Since(begin))
+}
+
+// benchRequest makes a single request and returns its latency, status code,
+// and X-Source header.
+func benchRequest(ctx context.Context, url string) (time.Duration, int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	begin := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return time.Since(begin), resp.StatusCode, resp.Header.Get("X-Source"), nil
+}
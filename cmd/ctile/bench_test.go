@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	testCases := map[float64]time.Duration{
+		0:   1 * time.Millisecond,
+		50:  50 * time.Millisecond,
+		99:  99 * time.Millisecond,
+		100: 100 * time.Millisecond,
+	}
+	for p, expected := range testCases {
+		got := percentile(sorted, p)
+		if got != expected {
+			t.Errorf("p%g: expected %s, got %s", p, expected, got)
+		}
+	}
+
+	if percentile(nil, 50) != 0 {
+		t.Error("expected 0 for empty input")
+	}
+}
+
+func TestBenchPatterns(t *testing.T) {
+	seq := &sequentialPattern{batch: 4, treeSize: 10}
+	var got []int64
+	for i := 0; i < 4; i++ {
+		got = append(got, seq.next())
+	}
+	expected := []int64{0, 4, 8, 2}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected sequential starts %v, got %v", expected, got)
+		}
+	}
+
+	random := &randomPattern{rand: rand.New(rand.NewSource(1)), align: 3, treeSize: 100}
+	for i := 0; i < 100; i++ {
+		start := random.next()
+		if start < 0 || start >= 100 || start%3 != 0 {
+			t.Fatalf("expected aligned start in [0, 100), got %d", start)
+		}
+	}
+}
+
+func TestBenchReport(t *testing.T) {
+	results := &benchResults{statuses: make(map[int]int), sources: make(map[string]int)}
+	results.record(time.Millisecond, 200, "S3", nil)
+	results.record(2*time.Millisecond, 200, "S3", nil)
+	results.record(3*time.Millisecond, 200, "CT log", nil)
+	results.record(4*time.Millisecond, 400, "", nil)
+	results.record(0, 0, "", errors.New("oops"))
+
+	var buf bytes.Buffer
+	results.report(&buf, time.Second)
+	out := buf.String()
+	for _, expected := range []string{
+		"requests:   5",
+		"errors:     1",
+		"status 200: 3",
+		"status 400: 1",
+		`source "S3": 2 (66.7%)`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+}
@@ -0,0 +1,1655 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/redis"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// logConfig configures one served log. For a single log, it's set by flags.
+// In a -config file, each log has the same fields, named like the flags but
+// with underscores, e.g. log_url for -log-url.
+type logConfig struct {
+	// Name identifies the log in metrics and log messages, and is the path
+	// it's served under: /<name>/ct/v1/get-entries. It's empty for a single
+	// log configured by flags, which is served at the root.
+	Name     string `json:"name"`
+	LogURL   string `json:"log_url"`
+	TileSize int    `json:"tile_size"`
+	S3Bucket string `json:"s3_bucket"`
+	S3Prefix string `json:"s3_prefix"`
+
+	// S3Shards cache ranges of the log elsewhere than S3Bucket and S3Prefix.
+	S3Shards shardMap `json:"s3_shards"`
+
+	// FullRequestTimeout is the max allowed time the handler can read from S3 and return or read from S3, read from backend, write to S3, and return.
+	FullRequestTimeout duration `json:"full_request_timeout"`
+
+	// S3WriteTimeout is the max time to write a tile to S3, which continues
+	// past FullRequestTimeout and the client going away. Zero means
+	// FullRequestTimeout.
+	S3WriteTimeout duration `json:"s3_write_timeout"`
+
+	Mode string `json:"mode"`
+
+	// BackendTimeout, BackendMaxConcurrent, BackendRateLimit and BackendBurst
+	// protect the backend. Zero means no limit.
+	BackendTimeout       duration `json:"backend_timeout"`
+	BackendMaxConcurrent int      `json:"backend_max_concurrent"`
+	BackendRateLimit     float64  `json:"backend_rate_limit"`
+	BackendBurst         int      `json:"backend_burst"`
+
+	// BackendBalance and BackendProbeInterval configure how requests are
+	// spread over the replicas listed in LogURL.
+	BackendBalance       string   `json:"backend_balance"`
+	BackendProbeInterval duration `json:"backend_probe_interval"`
+
+	// BackendMaxBodySize limits the size of responses read from the backend.
+	BackendMaxBodySize int64 `json:"backend_max_body_size"`
+
+	// BackendType is the API served by the backend: "rfc6962", or
+	// "static-ct" for a tile-based log.
+	BackendType string `json:"backend_type"`
+
+	// StrictValidation checks that tiles from the backend are the range of
+	// the log they should be before caching them.
+	StrictValidation bool `json:"strict_validation"`
+
+	// BackendMaxConnections limits the connections to each backend host in
+	// the log's own connection pool. Zero means no limit.
+	BackendMaxConnections int `json:"backend_max_connections"`
+
+	// CircuitBreakerFailures is the number of consecutive backend failures
+	// after which requests to it are paused for CircuitBreakerCooldown. Zero
+	// disables the circuit breaker.
+	CircuitBreakerFailures int      `json:"circuit_breaker_failures"`
+	CircuitBreakerCooldown duration `json:"circuit_breaker_cooldown"`
+
+	// S3DegradeAfter is the number of consecutive S3 failures after which
+	// tiles are served from the backend without S3, until a probe every
+	// S3ProbeInterval finds it working. Zero means S3 failures fail requests.
+	S3DegradeAfter  int      `json:"s3_degrade_after"`
+	S3ProbeInterval duration `json:"s3_probe_interval"`
+
+	// MemoryCacheBytes is the size of the in-memory cache of recently served
+	// tiles in front of S3, or 0 to disable it.
+	MemoryCacheBytes int64 `json:"memory_cache_bytes"`
+
+	// AsyncS3Writes writes tiles fetched from the backend to S3 after
+	// responding, instead of before.
+	AsyncS3Writes bool `json:"async_s3_writes"`
+
+	// S3SecondaryBucket is a bucket, in -s3-secondary-region, to read tiles
+	// from when reading them from S3Bucket fails. With S3DualWrite, tiles are
+	// written to it as well.
+	S3SecondaryBucket string `json:"s3_secondary_bucket"`
+	S3DualWrite       bool   `json:"s3_dual_write"`
+
+	// S3ConditionalWrites writes tiles only if they aren't in S3 yet, so
+	// instances racing to cache a tile don't all upload it.
+	S3ConditionalWrites bool `json:"s3_conditional_writes"`
+
+	// S3Tagging tags tiles written to S3 with the log, ctile's version, and
+	// their tile size and range.
+	S3Tagging bool `json:"s3_tagging"`
+
+	// S3Serialization is how tiles written to S3 are serialized: "cbor" or
+	// "json". S3GzipLevel is their gzip level; zero means the default. With
+	// S3Uncompressed, they're written without gzip.
+	S3Serialization string `json:"s3_serialization"`
+	S3GzipLevel     int    `json:"s3_gzip_level"`
+	S3Uncompressed  bool   `json:"s3_uncompressed"`
+
+	// S3PrecompressedJSON also stores each tile as a gzipped JSON response,
+	// served as is to requests for the whole tile.
+	S3PrecompressedJSON bool `json:"s3_precompressed_json"`
+
+	// S3SuperTiles, if above 1, is the number of tiles stored in each S3
+	// object.
+	S3SuperTiles int `json:"s3_super_tiles"`
+
+	// S3KeyLayout is how the keys of tiles are laid out after S3Prefix:
+	// "flat" or "hashed".
+	S3KeyLayout string `json:"s3_key_layout"`
+
+	// S3KeyTemplate is the template for the keys of tiles after S3Prefix,
+	// and before any hash added by S3KeyLayout.
+	S3KeyTemplate string `json:"s3_key_template"`
+
+	// S3ChainPrefix, if set, is where the certificate chains in entries are
+	// stored, once each, so tiles only refer to them by hash. S3ChainBucket
+	// defaults to S3Bucket, and S3ChainCacheSize is the number of chains kept
+	// in memory.
+	S3ChainBucket    string `json:"s3_chain_bucket"`
+	S3ChainPrefix    string `json:"s3_chain_prefix"`
+	S3ChainCacheSize int    `json:"s3_chain_cache_size"`
+
+	// S3WriteQueueSize, S3WriteWorkers, S3WriteAttempts and S3WriteBackoff
+	// configure the queue of writes to S3 in the background, which also
+	// retries failed writes instead of failing their requests. A zero size
+	// disables it, unless AsyncS3Writes is set.
+	S3WriteQueueSize int      `json:"s3_write_queue_size"`
+	S3WriteWorkers   int      `json:"s3_write_workers"`
+	S3WriteAttempts  int      `json:"s3_write_attempts"`
+	S3WriteBackoff   duration `json:"s3_write_backoff"`
+
+	// MaxConcurrentRequests limits the requests for the log served at once.
+	// Zero means no limit.
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// ClientRateLimit and ClientBurst limit the requests from each client,
+	// identified by ClientHeader if set. Zero means no limit.
+	ClientRateLimit float64 `json:"client_rate_limit"`
+	ClientBurst     int     `json:"client_burst"`
+	ClientHeader    string  `json:"client_header"`
+
+	// PartialTileRetryDelay is how long to wait before fetching a partial
+	// tile a second time, if it's missing at most PartialTileRetryMaxMissing
+	// entries. Zero disables retries.
+	PartialTileRetryDelay      duration `json:"partial_tile_retry_delay"`
+	PartialTileRetryMaxMissing int      `json:"partial_tile_retry_max_missing"`
+
+	// S3CachePartialTiles caches partial tiles in S3 until they're complete.
+	S3CachePartialTiles bool `json:"s3_cache_partial_tiles"`
+
+	// S3TileIndex skips reading tiles from S3 that aren't known to be cached,
+	// once S3TileIndexPrime has listed the tiles already cached at startup.
+	S3TileIndex      bool `json:"s3_tile_index"`
+	S3TileIndexPrime bool `json:"s3_tile_index_prime"`
+
+	// CoalesceEndpoints lists, separated by commas, the endpoints other than
+	// get-entries whose simultaneous requests share one backend request, or
+	// is "none".
+	CoalesceEndpoints string `json:"coalesce_endpoints"`
+
+	// NegativeCacheTTL is how long markers recording the end of the log are
+	// trusted. Zero disables them.
+	NegativeCacheTTL duration `json:"negative_cache_ttl"`
+
+	// TailCacheTTL is how long the partial tile at the end of the log is
+	// served from memory. Zero disables it.
+	TailCacheTTL duration `json:"tail_cache_ttl"`
+
+	// STHCacheTTL is how long get-sth responses are served from memory, and
+	// STHCacheMaxStale how much longer they may be served while being
+	// refreshed. Zero disables them.
+	STHCacheTTL      duration `json:"sth_cache_ttl"`
+	STHCacheMaxStale duration `json:"sth_cache_max_stale"`
+
+	// RootsCacheTTL is how long get-roots responses are served from memory
+	// before being revalidated. Zero disables it.
+	RootsCacheTTL duration `json:"roots_cache_ttl"`
+
+	// CachedEntryAndProof serves get-entry-and-proof with entries from
+	// cached tiles, and only the audit path from the backend.
+	CachedEntryAndProof bool `json:"cached_entry_and_proof"`
+
+	// MaxRequestTiles is the most tiles a get-entries response is served
+	// from. Zero and 1 serve the first tile only.
+	MaxRequestTiles int `json:"max_request_tiles"`
+
+	// StrictAlignment rejects get-entries requests that don't start at a
+	// tile, or that continue past the tiles a response may be served from.
+	StrictAlignment bool `json:"strict_alignment"`
+
+	// MaxGetEntries is the most entries a get-entries request may ask for.
+	// Larger requests are rejected, or clamped with ClampGetEntries. Zero
+	// means no limit.
+	MaxGetEntries   int64 `json:"max_get_entries"`
+	ClampGetEntries bool  `json:"clamp_get_entries"`
+
+	// PrettyJSON indents get-entries JSON responses by two spaces. Otherwise
+	// only requests with ?pretty=1 get indented JSON.
+	PrettyJSON bool `json:"pretty_json"`
+
+	// Export serves /ctile/v1/export, which streams ranges of entries
+	// across tiles as newline-delimited JSON.
+	Export bool `json:"export"`
+
+	// ExportRateLimit is the max entries per second of each export. Zero
+	// means no limit.
+	ExportRateLimit float64 `json:"export_rate_limit"`
+
+	// TailPollInterval is how often the tree size is polled for clients of
+	// /ctile/v1/tail. Zero disables the endpoint.
+	TailPollInterval duration `json:"tail_poll_interval"`
+
+	// ReadaheadDepth is how many tiles are fetched in the background ahead of
+	// sequential scans. Zero disables it.
+	ReadaheadDepth int `json:"readahead_depth"`
+
+	// S3HedgeDelay is how long an S3 read may take before the tile is
+	// fetched from the backend too. Zero disables it.
+	S3HedgeDelay duration `json:"s3_hedge_delay"`
+
+	// StaticCTOrigin, if set, serves the static CT API, with checkpoints for
+	// that origin. StaticCTPublicKey is the log's public key, in base64 DER,
+	// as in log lists.
+	StaticCTOrigin    string `json:"static_ct_origin"`
+	StaticCTPublicKey string `json:"static_ct_public_key"`
+
+	// Features are the initial rollout percentages of experimental features,
+	// which can be changed at runtime through the admin API.
+	Features featureRollouts `json:"features"`
+
+	// mode, balance, backendType, serialization, keyLayout, keyTemplate and
+	// staticCTPublicKey are parsed from Mode, BackendBalance, BackendType,
+	// S3Serialization, S3KeyLayout, S3KeyTemplate and StaticCTPublicKey by
+	// validate.
+	mode              ctile.Mode
+	balance           ctile.Balance
+	backendType       ctile.BackendType
+	serialization     ctile.Serialization
+	keyLayout         ctile.KeyLayout
+	keyTemplate       ctile.KeyTemplate
+	staticCTPublicKey []byte
+
+	// set holds the names of the fields set in -config, so a log can set one
+	// to false or zero rather than inherit it.
+	set map[string]bool
+}
+
+// logURLs returns the URLs in LogURL, which may list replicas of the backend
+// separated by commas. The first is the log's own URL, which identifies it,
+// e.g. in the default S3 prefix, so adding replicas doesn't change where
+// tiles are cached. The rest are failed over to.
+func (l *logConfig) logURLs() []string {
+	urls := strings.Split(l.LogURL, ",")
+	for i := range urls {
+		urls[i] = strings.TrimSpace(urls[i])
+	}
+	return urls
+}
+
+// primaryLogURL returns the first of logURLs.
+func (l *logConfig) primaryLogURL() string {
+	return l.logURLs()[0]
+}
+
+// coalescedEndpoints returns the endpoints in CoalesceEndpoints.
+func (l *logConfig) coalescedEndpoints() []string {
+	if l.CoalesceEndpoints == "" || l.CoalesceEndpoints == "none" {
+		return nil
+	}
+	endpoints := strings.Split(l.CoalesceEndpoints, ",")
+	for i := range endpoints {
+		endpoints[i] = strings.TrimSpace(endpoints[i])
+	}
+	return endpoints
+}
+
+// usesS3 returns true if the log's mode reads or writes S3.
+func (l *logConfig) usesS3() bool {
+	return l.Mode != string(ctile.ModeProxyOnly)
+}
+
+// String describes the log's configuration for logEffectiveConfig.
+func (l *logConfig) String() string {
+	return fmt.Sprintf("-log-url=%s -tile-size=%d -s3-bucket=%s -s3-prefix=%s -s3-shards=%s -full-request-timeout=%s -s3-write-timeout=%s -mode=%s "+
+		"-backend-timeout=%s -backend-max-concurrent=%d -backend-rate-limit=%g -backend-burst=%d "+
+		"-backend-balance=%s -backend-probe-interval=%s -backend-max-body-size=%d -backend-type=%s -strict-validation=%t -backend-max-connections=%d -circuit-breaker-failures=%d -circuit-breaker-cooldown=%s "+
+		"-s3-degrade-after=%d -s3-probe-interval=%s -memory-cache-bytes=%d -s3-secondary-bucket=%s -s3-dual-write=%t -s3-conditional-writes=%t -s3-tagging=%t -s3-serialization=%s -s3-gzip-level=%d -s3-uncompressed=%t -s3-precompressed-json=%t -s3-super-tiles=%d -s3-key-layout=%s -s3-key-template=%s -s3-chain-bucket=%s -s3-chain-prefix=%s -s3-chain-cache-size=%d -async-s3-writes=%t -s3-write-queue-size=%d -s3-write-workers=%d -s3-write-attempts=%d -s3-write-backoff=%s -max-concurrent-requests=%d -client-rate-limit=%g -client-burst=%d -client-header=%s "+
+		"-partial-tile-retry-delay=%s -partial-tile-retry-max-missing=%d -s3-cache-partial-tiles=%t -s3-tile-index=%t -s3-tile-index-prime=%t -coalesce-endpoints=%s -negative-cache-ttl=%s -tail-cache-ttl=%s -sth-cache-ttl=%s -sth-cache-max-stale=%s -roots-cache-ttl=%s -cached-entry-and-proof=%t -max-request-tiles=%d -strict-alignment=%t -max-get-entries=%d -clamp-get-entries=%t -pretty-json=%t -export=%t -export-rate-limit=%g -tail-poll-interval=%s -readahead-depth=%d -s3-hedge-delay=%s -static-ct-origin=%s -static-ct-public-key=%s -features=%s",
+		l.LogURL, l.TileSize, l.S3Bucket, l.S3Prefix, &l.S3Shards, l.FullRequestTimeout, l.S3WriteTimeout, l.Mode,
+		l.BackendTimeout, l.BackendMaxConcurrent, l.BackendRateLimit, l.BackendBurst,
+		l.BackendBalance, l.BackendProbeInterval, l.BackendMaxBodySize, l.BackendType, l.StrictValidation, l.BackendMaxConnections, l.CircuitBreakerFailures, l.CircuitBreakerCooldown,
+		l.S3DegradeAfter, l.S3ProbeInterval, l.MemoryCacheBytes, l.S3SecondaryBucket, l.S3DualWrite, l.S3ConditionalWrites, l.S3Tagging, l.S3Serialization, l.S3GzipLevel, l.S3Uncompressed, l.S3PrecompressedJSON, l.S3SuperTiles, l.S3KeyLayout, l.S3KeyTemplate, l.S3ChainBucket, l.S3ChainPrefix, l.S3ChainCacheSize, l.AsyncS3Writes, l.S3WriteQueueSize, l.S3WriteWorkers, l.S3WriteAttempts, l.S3WriteBackoff, l.MaxConcurrentRequests, l.ClientRateLimit, l.ClientBurst, l.ClientHeader,
+		l.PartialTileRetryDelay, l.PartialTileRetryMaxMissing, l.S3CachePartialTiles, l.S3TileIndex, l.S3TileIndexPrime, l.CoalesceEndpoints, l.NegativeCacheTTL, l.TailCacheTTL, l.STHCacheTTL, l.STHCacheMaxStale, l.RootsCacheTTL, l.CachedEntryAndProof, l.MaxRequestTiles, l.StrictAlignment, l.MaxGetEntries, l.ClampGetEntries, l.PrettyJSON, l.Export, l.ExportRateLimit, l.TailPollInterval, l.ReadaheadDepth, l.S3HedgeDelay, l.StaticCTOrigin, l.StaticCTPublicKey, &l.Features)
+}
+
+// UnmarshalJSON parses a log's settings in -config, rejecting unknown fields
+// like the rest of the file, and records which fields are set.
+func (l *logConfig) UnmarshalJSON(b []byte) error {
+	type plain logConfig
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode((*plain)(l))
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		return err
+	}
+	l.set = make(map[string]bool)
+	for name := range fields {
+		// Like encoding/json, match names regardless of case.
+		l.set[strings.ToLower(name)] = true
+	}
+	return nil
+}
+
+// inherit sets each unset field of l to the value in defaults. A field is
+// unset if it's zero and wasn't set in -config; those set in defaults count as
+// set in l afterwards, so they aren't overridden by a later inherit.
+func (l *logConfig) inherit(defaults logConfig) {
+	if l.LogURL == "" && !l.set["log_url"] {
+		l.LogURL = defaults.LogURL
+	}
+	if l.TileSize == 0 && !l.set["tile_size"] {
+		l.TileSize = defaults.TileSize
+	}
+	if l.S3Bucket == "" && !l.set["s3_bucket"] {
+		l.S3Bucket = defaults.S3Bucket
+	}
+	if l.S3Prefix == "" && !l.set["s3_prefix"] {
+		l.S3Prefix = defaults.S3Prefix
+	}
+	if l.S3Shards == nil && !l.set["s3_shards"] {
+		l.S3Shards = defaults.S3Shards
+	}
+	if l.FullRequestTimeout.Duration == 0 && !l.set["full_request_timeout"] {
+		l.FullRequestTimeout = defaults.FullRequestTimeout
+	}
+	if l.Mode == "" && !l.set["mode"] {
+		l.Mode = defaults.Mode
+	}
+	if l.BackendTimeout.Duration == 0 && !l.set["backend_timeout"] {
+		l.BackendTimeout = defaults.BackendTimeout
+	}
+	if l.S3WriteTimeout.Duration == 0 && !l.set["s3_write_timeout"] {
+		l.S3WriteTimeout = defaults.S3WriteTimeout
+	}
+	if l.BackendMaxConcurrent == 0 && !l.set["backend_max_concurrent"] {
+		l.BackendMaxConcurrent = defaults.BackendMaxConcurrent
+	}
+	if l.BackendRateLimit == 0 && !l.set["backend_rate_limit"] {
+		l.BackendRateLimit = defaults.BackendRateLimit
+	}
+	if l.BackendBurst == 0 && !l.set["backend_burst"] {
+		l.BackendBurst = defaults.BackendBurst
+	}
+	if l.BackendBalance == "" && !l.set["backend_balance"] {
+		l.BackendBalance = defaults.BackendBalance
+	}
+	if l.BackendProbeInterval.Duration == 0 && !l.set["backend_probe_interval"] {
+		l.BackendProbeInterval = defaults.BackendProbeInterval
+	}
+	if l.BackendType == "" && !l.set["backend_type"] {
+		l.BackendType = defaults.BackendType
+	}
+	if l.BackendMaxBodySize == 0 && !l.set["backend_max_body_size"] {
+		l.BackendMaxBodySize = defaults.BackendMaxBodySize
+	}
+	if !l.StrictValidation && !l.set["strict_validation"] {
+		l.StrictValidation = defaults.StrictValidation
+	}
+	if l.BackendMaxConnections == 0 && !l.set["backend_max_connections"] {
+		l.BackendMaxConnections = defaults.BackendMaxConnections
+	}
+	if l.CircuitBreakerFailures == 0 && !l.set["circuit_breaker_failures"] {
+		l.CircuitBreakerFailures = defaults.CircuitBreakerFailures
+	}
+	if l.CircuitBreakerCooldown.Duration == 0 && !l.set["circuit_breaker_cooldown"] {
+		l.CircuitBreakerCooldown = defaults.CircuitBreakerCooldown
+	}
+	if l.S3DegradeAfter == 0 && !l.set["s3_degrade_after"] {
+		l.S3DegradeAfter = defaults.S3DegradeAfter
+	}
+	if l.S3ProbeInterval.Duration == 0 && !l.set["s3_probe_interval"] {
+		l.S3ProbeInterval = defaults.S3ProbeInterval
+	}
+	if l.MemoryCacheBytes == 0 && !l.set["memory_cache_bytes"] {
+		l.MemoryCacheBytes = defaults.MemoryCacheBytes
+	}
+	if l.S3SecondaryBucket == "" && !l.set["s3_secondary_bucket"] {
+		l.S3SecondaryBucket = defaults.S3SecondaryBucket
+	}
+	if !l.S3DualWrite && !l.set["s3_dual_write"] {
+		l.S3DualWrite = defaults.S3DualWrite
+	}
+	if !l.S3ConditionalWrites && !l.set["s3_conditional_writes"] {
+		l.S3ConditionalWrites = defaults.S3ConditionalWrites
+	}
+	if !l.S3Tagging && !l.set["s3_tagging"] {
+		l.S3Tagging = defaults.S3Tagging
+	}
+	if l.S3Serialization == "" && !l.set["s3_serialization"] {
+		l.S3Serialization = defaults.S3Serialization
+	}
+	if l.S3GzipLevel == 0 && !l.set["s3_gzip_level"] {
+		l.S3GzipLevel = defaults.S3GzipLevel
+	}
+	if !l.S3Uncompressed && !l.set["s3_uncompressed"] {
+		l.S3Uncompressed = defaults.S3Uncompressed
+	}
+	if !l.S3PrecompressedJSON && !l.set["s3_precompressed_json"] {
+		l.S3PrecompressedJSON = defaults.S3PrecompressedJSON
+	}
+	if l.S3SuperTiles == 0 && !l.set["s3_super_tiles"] {
+		l.S3SuperTiles = defaults.S3SuperTiles
+	}
+	if l.S3KeyLayout == "" && !l.set["s3_key_layout"] {
+		l.S3KeyLayout = defaults.S3KeyLayout
+	}
+	if l.S3KeyTemplate == "" && !l.set["s3_key_template"] {
+		l.S3KeyTemplate = defaults.S3KeyTemplate
+	}
+	if l.S3ChainBucket == "" && !l.set["s3_chain_bucket"] {
+		l.S3ChainBucket = defaults.S3ChainBucket
+	}
+	if l.S3ChainPrefix == "" && !l.set["s3_chain_prefix"] {
+		l.S3ChainPrefix = defaults.S3ChainPrefix
+	}
+	if l.S3ChainCacheSize == 0 && !l.set["s3_chain_cache_size"] {
+		l.S3ChainCacheSize = defaults.S3ChainCacheSize
+	}
+	if !l.AsyncS3Writes && !l.set["async_s3_writes"] {
+		l.AsyncS3Writes = defaults.AsyncS3Writes
+	}
+	if l.S3WriteQueueSize == 0 && !l.set["s3_write_queue_size"] {
+		l.S3WriteQueueSize = defaults.S3WriteQueueSize
+	}
+	if l.S3WriteWorkers == 0 && !l.set["s3_write_workers"] {
+		l.S3WriteWorkers = defaults.S3WriteWorkers
+	}
+	if l.S3WriteAttempts == 0 && !l.set["s3_write_attempts"] {
+		l.S3WriteAttempts = defaults.S3WriteAttempts
+	}
+	if l.S3WriteBackoff.Duration == 0 && !l.set["s3_write_backoff"] {
+		l.S3WriteBackoff = defaults.S3WriteBackoff
+	}
+	if l.MaxConcurrentRequests == 0 && !l.set["max_concurrent_requests"] {
+		l.MaxConcurrentRequests = defaults.MaxConcurrentRequests
+	}
+	if l.ClientRateLimit == 0 && !l.set["client_rate_limit"] {
+		l.ClientRateLimit = defaults.ClientRateLimit
+	}
+	if l.ClientBurst == 0 && !l.set["client_burst"] {
+		l.ClientBurst = defaults.ClientBurst
+	}
+	if l.ClientHeader == "" && !l.set["client_header"] {
+		l.ClientHeader = defaults.ClientHeader
+	}
+	if l.PartialTileRetryDelay.Duration == 0 && !l.set["partial_tile_retry_delay"] {
+		l.PartialTileRetryDelay = defaults.PartialTileRetryDelay
+	}
+	if l.PartialTileRetryMaxMissing == 0 && !l.set["partial_tile_retry_max_missing"] {
+		l.PartialTileRetryMaxMissing = defaults.PartialTileRetryMaxMissing
+	}
+	if !l.S3CachePartialTiles && !l.set["s3_cache_partial_tiles"] {
+		l.S3CachePartialTiles = defaults.S3CachePartialTiles
+	}
+	if !l.S3TileIndex && !l.set["s3_tile_index"] {
+		l.S3TileIndex = defaults.S3TileIndex
+	}
+	if !l.S3TileIndexPrime && !l.set["s3_tile_index_prime"] {
+		l.S3TileIndexPrime = defaults.S3TileIndexPrime
+	}
+	if l.CoalesceEndpoints == "" && !l.set["coalesce_endpoints"] {
+		l.CoalesceEndpoints = defaults.CoalesceEndpoints
+	}
+	if l.NegativeCacheTTL.Duration == 0 && !l.set["negative_cache_ttl"] {
+		l.NegativeCacheTTL = defaults.NegativeCacheTTL
+	}
+	if l.TailCacheTTL.Duration == 0 && !l.set["tail_cache_ttl"] {
+		l.TailCacheTTL = defaults.TailCacheTTL
+	}
+	if l.STHCacheTTL.Duration == 0 && !l.set["sth_cache_ttl"] {
+		l.STHCacheTTL = defaults.STHCacheTTL
+	}
+	if l.STHCacheMaxStale.Duration == 0 && !l.set["sth_cache_max_stale"] {
+		l.STHCacheMaxStale = defaults.STHCacheMaxStale
+	}
+	if l.RootsCacheTTL.Duration == 0 && !l.set["roots_cache_ttl"] {
+		l.RootsCacheTTL = defaults.RootsCacheTTL
+	}
+	if !l.CachedEntryAndProof && !l.set["cached_entry_and_proof"] {
+		l.CachedEntryAndProof = defaults.CachedEntryAndProof
+	}
+	if l.MaxRequestTiles == 0 && !l.set["max_request_tiles"] {
+		l.MaxRequestTiles = defaults.MaxRequestTiles
+	}
+	if !l.StrictAlignment && !l.set["strict_alignment"] {
+		l.StrictAlignment = defaults.StrictAlignment
+	}
+	if l.MaxGetEntries == 0 && !l.set["max_get_entries"] {
+		l.MaxGetEntries = defaults.MaxGetEntries
+	}
+	if !l.ClampGetEntries && !l.set["clamp_get_entries"] {
+		l.ClampGetEntries = defaults.ClampGetEntries
+	}
+	if !l.PrettyJSON && !l.set["pretty_json"] {
+		l.PrettyJSON = defaults.PrettyJSON
+	}
+	if !l.Export && !l.set["export"] {
+		l.Export = defaults.Export
+	}
+	if l.ExportRateLimit == 0 && !l.set["export_rate_limit"] {
+		l.ExportRateLimit = defaults.ExportRateLimit
+	}
+	if l.TailPollInterval.Duration == 0 && !l.set["tail_poll_interval"] {
+		l.TailPollInterval = defaults.TailPollInterval
+	}
+	if l.ReadaheadDepth == 0 && !l.set["readahead_depth"] {
+		l.ReadaheadDepth = defaults.ReadaheadDepth
+	}
+	if l.S3HedgeDelay.Duration == 0 && !l.set["s3_hedge_delay"] {
+		l.S3HedgeDelay = defaults.S3HedgeDelay
+	}
+	if l.StaticCTOrigin == "" && !l.set["static_ct_origin"] {
+		l.StaticCTOrigin = defaults.StaticCTOrigin
+	}
+	if l.StaticCTPublicKey == "" && !l.set["static_ct_public_key"] {
+		l.StaticCTPublicKey = defaults.StaticCTPublicKey
+	}
+	if l.Features == nil && !l.set["features"] {
+		l.Features = defaults.Features
+	}
+	for name := range defaults.set {
+		if l.set == nil {
+			l.set = make(map[string]bool)
+		}
+		l.set[name] = true
+	}
+}
+
+// validate returns every problem with the log's configuration. It also
+// parses Mode into mode and BackendBalance into balance.
+func (l *logConfig) validate(fakeBackend bool) []error {
+	var errs []error
+
+	if fakeBackend {
+		if l.LogURL != "" {
+			errs = append(errs, errors.New("-log-url and -fake-backend are mutually exclusive"))
+		}
+	} else if l.LogURL == "" {
+		errs = append(errs, errors.New("missing required flag: -log-url"))
+	} else {
+		seen := make(map[string]bool)
+		for _, u := range l.logURLs() {
+			if err := checkLogURL(u); err != nil {
+				errs = append(errs, fmt.Errorf("invalid -log-url %q: %w", u, err))
+			} else if seen[u] {
+				errs = append(errs, fmt.Errorf("-log-url lists %q more than once", u))
+			}
+			seen[u] = true
+		}
+	}
+
+	if l.TileSize == 0 {
+		errs = append(errs, errors.New("missing required flag: -tile-size"))
+	} else if l.TileSize < 0 {
+		errs = append(errs, errors.New("-tile-size must be positive"))
+	}
+
+	if l.FullRequestTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("-full-request-timeout must be positive"))
+	}
+	if l.BackendTimeout.Duration < 0 {
+		errs = append(errs, errors.New("-backend-timeout must not be negative"))
+	} else if l.BackendTimeout.Duration > l.FullRequestTimeout.Duration && l.FullRequestTimeout.Duration > 0 {
+		errs = append(errs, fmt.Errorf("-backend-timeout (%s) must not be longer than -full-request-timeout (%s)", l.BackendTimeout, l.FullRequestTimeout))
+	}
+	if l.S3WriteTimeout.Duration < 0 {
+		errs = append(errs, errors.New("-s3-write-timeout must not be negative"))
+	}
+	if l.S3DualWrite && l.S3SecondaryBucket == "" {
+		errs = append(errs, errors.New("-s3-dual-write requires -s3-secondary-bucket"))
+	}
+	serialization, err := ctile.ParseSerialization(l.S3Serialization)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-s3-serialization: %w", err))
+	}
+	l.serialization = serialization
+	if l.S3GzipLevel < 0 || l.S3GzipLevel > gzip.BestCompression {
+		errs = append(errs, fmt.Errorf("-s3-gzip-level must be between 0 and %d", gzip.BestCompression))
+	}
+	keyLayout, err := ctile.ParseKeyLayout(l.S3KeyLayout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-s3-key-layout: %w", err))
+	}
+	l.keyLayout = keyLayout
+	keyTemplate, err := ctile.ParseKeyTemplate(l.S3KeyTemplate)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-s3-key-template: %w", err))
+	}
+	l.keyTemplate = keyTemplate
+	if l.S3SuperTiles < 0 {
+		errs = append(errs, errors.New("-s3-super-tiles must not be negative"))
+	}
+	if l.S3ChainBucket != "" && l.S3ChainPrefix == "" {
+		errs = append(errs, errors.New("-s3-chain-bucket requires -s3-chain-prefix"))
+	}
+	if l.S3TileIndexPrime && !l.S3TileIndex {
+		errs = append(errs, errors.New("-s3-tile-index-prime requires -s3-tile-index"))
+	}
+	if l.S3ChainCacheSize < 0 {
+		errs = append(errs, errors.New("-s3-chain-cache-size must not be negative"))
+	}
+	if l.S3WriteQueueSize < 0 || l.S3WriteWorkers < 0 || l.S3WriteAttempts < 0 || l.S3WriteBackoff.Duration < 0 {
+		errs = append(errs, errors.New("-s3-write-queue-size, -s3-write-workers, -s3-write-attempts and -s3-write-backoff must not be negative"))
+	}
+	if l.BackendMaxConcurrent < 0 || l.BackendRateLimit < 0 || l.BackendBurst < 0 {
+		errs = append(errs, errors.New("-backend-max-concurrent, -backend-rate-limit and -backend-burst must not be negative"))
+	}
+
+	balance, err := ctile.ParseBalance(l.BackendBalance)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	l.balance = balance
+	backendType, err := ctile.ParseBackendType(l.BackendType)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-backend-type: %w", err))
+	} else if backendType == ctile.BackendStaticCT && l.StrictValidation {
+		errs = append(errs, errors.New("-strict-validation isn't available with -backend-type=static-ct"))
+	} else if backendType == ctile.BackendRFC9162 && (l.StrictValidation || l.StaticCTOrigin != "" || l.S3ChainPrefix != "" || l.S3PrecompressedJSON || l.Export || l.TailPollInterval.Duration != 0) {
+		errs = append(errs, errors.New("-strict-validation, -static-ct-origin, -s3-chain-prefix, -s3-precompressed-json, -export and -tail-poll-interval aren't available with -backend-type=rfc9162"))
+	}
+	l.backendType = backendType
+	if l.BackendProbeInterval.Duration < 0 {
+		errs = append(errs, errors.New("-backend-probe-interval must not be negative"))
+	}
+	if l.BackendMaxBodySize < 0 || l.BackendMaxConnections < 0 || l.CircuitBreakerFailures < 0 || l.MaxConcurrentRequests < 0 {
+		errs = append(errs, errors.New("-backend-max-body-size, -backend-max-connections, -circuit-breaker-failures and -max-concurrent-requests must not be negative"))
+	}
+	if l.CircuitBreakerCooldown.Duration < 0 {
+		errs = append(errs, errors.New("-circuit-breaker-cooldown must not be negative"))
+	}
+	if l.S3DegradeAfter < 0 || l.S3ProbeInterval.Duration < 0 {
+		errs = append(errs, errors.New("-s3-degrade-after and -s3-probe-interval must not be negative"))
+	}
+	if l.MemoryCacheBytes < 0 {
+		errs = append(errs, errors.New("-memory-cache-bytes must not be negative"))
+	}
+	if l.ClientRateLimit < 0 || l.ClientBurst < 0 {
+		errs = append(errs, errors.New("-client-rate-limit and -client-burst must not be negative"))
+	}
+	if l.PartialTileRetryDelay.Duration < 0 || l.PartialTileRetryMaxMissing < 0 {
+		errs = append(errs, errors.New("-partial-tile-retry-delay and -partial-tile-retry-max-missing must not be negative"))
+	}
+	for _, endpoint := range l.coalescedEndpoints() {
+		if endpoint == "" || endpoint == "get-entries" || strings.Contains(endpoint, "/") {
+			errs = append(errs, fmt.Errorf("-coalesce-endpoints: invalid endpoint %q: want the name of a CT API endpoint other than get-entries, like get-sth", endpoint))
+		}
+	}
+	if l.NegativeCacheTTL.Duration < 0 {
+		errs = append(errs, errors.New("-negative-cache-ttl must not be negative"))
+	}
+	if l.TailCacheTTL.Duration < 0 {
+		errs = append(errs, errors.New("-tail-cache-ttl must not be negative"))
+	}
+	if l.STHCacheTTL.Duration < 0 || l.STHCacheMaxStale.Duration < 0 {
+		errs = append(errs, errors.New("-sth-cache-ttl and -sth-cache-max-stale must not be negative"))
+	} else if l.STHCacheMaxStale.Duration != 0 && l.STHCacheTTL.Duration == 0 {
+		errs = append(errs, errors.New("-sth-cache-max-stale requires -sth-cache-ttl"))
+	}
+	if l.RootsCacheTTL.Duration < 0 {
+		errs = append(errs, errors.New("-roots-cache-ttl must not be negative"))
+	}
+	if l.MaxRequestTiles < 0 {
+		errs = append(errs, errors.New("-max-request-tiles must not be negative"))
+	}
+	if l.MaxGetEntries < 0 {
+		errs = append(errs, errors.New("-max-get-entries must not be negative"))
+	} else if l.ClampGetEntries && l.MaxGetEntries == 0 {
+		errs = append(errs, errors.New("-clamp-get-entries requires -max-get-entries"))
+	}
+	if l.ExportRateLimit < 0 {
+		errs = append(errs, errors.New("-export-rate-limit must not be negative"))
+	}
+	if l.TailPollInterval.Duration < 0 {
+		errs = append(errs, errors.New("-tail-poll-interval must not be negative"))
+	}
+	if l.ReadaheadDepth < 0 {
+		errs = append(errs, errors.New("-readahead-depth must not be negative"))
+	}
+	if l.S3HedgeDelay.Duration < 0 {
+		errs = append(errs, errors.New("-s3-hedge-delay must not be negative"))
+	}
+	if l.StaticCTOrigin != "" {
+		publicKey, err := base64.StdEncoding.DecodeString(l.StaticCTPublicKey)
+		if err == nil {
+			_, err = x509.ParsePKIXPublicKey(publicKey)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("-static-ct-public-key: %w", err))
+		}
+		l.staticCTPublicKey = publicKey
+	}
+
+	mode, err := ctile.ParseMode(l.Mode)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	l.mode = mode
+	if l.CachedEntryAndProof && (l.mode != ctile.ModeNormal || l.backendType != ctile.BackendRFC6962) {
+		errs = append(errs, errors.New("-cached-entry-and-proof requires -mode normal and -backend-type rfc6962"))
+	}
+
+	if l.usesS3() && l.S3Bucket == "" {
+		errs = append(errs, errors.New("missing required flag: -s3-bucket"))
+	}
+	// With -fake-backend, the log URL isn't known until the backend starts, so
+	// the prefix is only checked when it's expanded.
+	if l.usesS3() && !fakeBackend && checkLogURL(l.primaryLogURL()) == nil {
+		_, err := ctile.ExpandPrefix(l.S3Prefix, l.primaryLogURL(), l.TileSize)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -s3-prefix: %w", err))
+		}
+		for _, s := range l.S3Shards {
+			_, err := ctile.ExpandPrefix(s.S3Prefix, l.primaryLogURL(), l.TileSize)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid -s3-shards prefix: %w", err))
+			}
+		}
+	}
+	if l.usesS3() && l.TileSize > 0 {
+		errs = append(errs, l.S3Shards.validate(int64(l.TileSize))...)
+		for _, s := range l.S3Shards {
+			if l.S3SuperTiles > 1 && s.Start%(int64(l.TileSize)*int64(l.S3SuperTiles)) != 0 {
+				errs = append(errs, fmt.Errorf("-s3-shards start %d must be a multiple of -tile-size times -s3-super-tiles", s.Start))
+			}
+		}
+	}
+
+	_, err = ctile.NewFeatureFlags(l.Features)
+	if err == nil {
+		err = ctile.CheckFeatures(l.Features, ctile.KnownFeatures(responseEncoders))
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid -features: %w", err))
+	}
+
+	if l.Name != "" {
+		for i, err := range errs {
+			errs[i] = fmt.Errorf("log %q: %w", l.Name, err)
+		}
+	}
+	return errs
+}
+
+// duration is a time.Duration that is written as a string like "4s" in JSON.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("durations must be strings like \"4s\": %w", err)
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// featureRollouts maps features to rollout percentages. As a flag, it's
+// written like "readahead=10,zstd=100".
+type featureRollouts map[ctile.Feature]int
+
+func (f *featureRollouts) String() string {
+	if f == nil || len(*f) == 0 {
+		return ""
+	}
+	var parts []string
+	for feature, percent := range *f {
+		parts = append(parts, fmt.Sprintf("%s=%d", feature, percent))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f *featureRollouts) Set(s string) error {
+	rollouts := make(featureRollouts)
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		feature, percent, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("%q must be in the form feature=percent", part)
+		}
+		n, err := strconv.Atoi(percent)
+		if err != nil {
+			return fmt.Errorf("rollout for feature %q: %w", feature, err)
+		}
+		rollouts[ctile.Feature(feature)] = n
+	}
+	*f = rollouts
+	return nil
+}
+
+// shardMap lists ranges of a log cached in other buckets or under other
+// prefixes, in increasing order. As a flag, it's written like
+// "100000000=bucket-2/oak2023/,200000000=/oak2023-3/": each shard's start,
+// then its bucket, which may be empty to use -s3-bucket, and its prefix.
+type shardMap []shardConfig
+
+// shardConfig configures a ctile.Shard.
+type shardConfig struct {
+	Start    int64  `json:"start"`
+	S3Bucket string `json:"s3_bucket"`
+	S3Prefix string `json:"s3_prefix"`
+}
+
+func (m *shardMap) String() string {
+	if m == nil {
+		return ""
+	}
+	var parts []string
+	for _, s := range *m {
+		parts = append(parts, fmt.Sprintf("%d=%s/%s", s.Start, s.S3Bucket, s.S3Prefix))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *shardMap) Set(s string) error {
+	var shards shardMap
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		start, location, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("%q must be in the form start=bucket/prefix", part)
+		}
+		n, err := strconv.ParseInt(start, 10, 64)
+		if err != nil {
+			return fmt.Errorf("start of shard %q: %w", part, err)
+		}
+		bucket, prefix, ok := strings.Cut(location, "/")
+		if !ok {
+			return fmt.Errorf("%q must be in the form start=bucket/prefix", part)
+		}
+		shards = append(shards, shardConfig{Start: n, S3Bucket: bucket, S3Prefix: prefix})
+	}
+	*m = shards
+	return nil
+}
+
+// validate returns every problem with the shards for the given tile size.
+func (m shardMap) validate(tileSize int64) []error {
+	var errs []error
+	for i, s := range m {
+		if s.Start <= 0 || s.Start%tileSize != 0 {
+			errs = append(errs, fmt.Errorf("-s3-shards start %d must be a positive multiple of -tile-size", s.Start))
+		}
+		if i > 0 && s.Start <= m[i-1].Start {
+			errs = append(errs, fmt.Errorf("-s3-shards must be in increasing order of start, but %d follows %d", s.Start, m[i-1].Start))
+		}
+		if s.S3Prefix == "" {
+			errs = append(errs, fmt.Errorf("-s3-shards prefix for start %d must not be empty", s.Start))
+		}
+	}
+	return errs
+}
+
+// shards returns m as ctile.Shards.
+func (m shardMap) shards() []ctile.Shard {
+	var shards []ctile.Shard
+	for _, s := range m {
+		shards = append(shards, ctile.Shard{Start: s.Start, Bucket: s.S3Bucket, Prefix: s.S3Prefix})
+	}
+	return shards
+}
+
+// fileConfig is the format of the -config file, which is JSON.
+type fileConfig struct {
+	// Defaults apply to every log, taking precedence over flags.
+	Defaults logConfig `json:"defaults"`
+	// Logs are the logs to serve. Unset fields of each log take their values
+	// from Defaults, and then from the corresponding flags.
+	Logs []logConfig `json:"logs"`
+	// Profiles are named sets of overrides, such as for dev, staging, and
+	// prod, one of which can be selected with -profile.
+	Profiles map[string]profileConfig `json:"profiles"`
+}
+
+// profileConfig overrides the base settings of a fileConfig.
+type profileConfig struct {
+	// Defaults override the base Defaults.
+	Defaults logConfig `json:"defaults"`
+	// Logs override the settings of the base logs with the same names.
+	Logs map[string]logConfig `json:"logs"`
+}
+
+// loadConfigFile reads and parses a -config file.
+func loadConfigFile(path string) (*fileConfig, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading -config: %w", err)
+	}
+	var file fileConfig
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing -config %s: %w", path, err)
+	}
+	if len(file.Logs) == 0 {
+		return nil, fmt.Errorf("-config %s doesn't configure any logs", path)
+	}
+	return &file, nil
+}
+
+// resolve returns the logs configured by f with the named profile applied,
+// if any, and unset fields taken from flags. From highest precedence to
+// lowest, settings come from the profile's entry for a log, the log's base
+// entry, the profile's defaults, the base defaults, and flags.
+func (f *fileConfig) resolve(profileName string, flags logConfig) ([]logConfig, error) {
+	var profile profileConfig
+	if profileName != "" {
+		var ok bool
+		profile, ok = f.Profiles[profileName]
+		if !ok {
+			return nil, fmt.Errorf("-profile %q is not defined in -config", profileName)
+		}
+	}
+
+	defaults := profile.Defaults
+	defaults.inherit(f.Defaults)
+	defaults.inherit(flags)
+	if defaults.Name != "" {
+		return nil, errors.New("defaults in -config must not have a name")
+	}
+
+	var logs []logConfig
+	seen := make(map[string]bool)
+	for _, base := range f.Logs {
+		l := profile.Logs[base.Name]
+		l.Name = base.Name
+		l.inherit(base)
+		l.inherit(defaults)
+		logs = append(logs, l)
+		seen[base.Name] = true
+	}
+	for name := range profile.Logs {
+		if !seen[name] {
+			return nil, fmt.Errorf("-profile %q overrides log %q, which is not defined in -config", profileName, name)
+		}
+	}
+	return logs, nil
+}
+
+// validLogName matches log names, which must be usable as a path segment.
+var validLogName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// serveConfig holds the configuration for serving. Its fields are bound
+// directly to flags, so after resolveLogs it also describes the effective
+// configuration.
+type serveConfig struct {
+	// defaults holds the flags that configure a log. Without -config, it's
+	// the only log served; with -config, it provides defaults for each log.
+	defaults   logConfig
+	configFile string
+	profile    string
+
+	// configWatchInterval is how often to check the -config file for
+	// changes. Zero disables watching.
+	configWatchInterval time.Duration
+
+	// logs are the logs to serve, set by resolveLogs.
+	logs []logConfig
+
+	listenAddress  string
+	metricsAddress string
+
+	metricsSecurity listenerSecurity
+
+	adminAddress  string
+	adminSecurity listenerSecurity
+
+	// requestSigningKey and requestSigningKeyFile list the keys requests must
+	// be signed with. They're read into requestSigning by validate, and the
+	// file again on SIGHUP.
+	requestSigningKey     secret
+	requestSigningKeyFile string
+	requestSigning        ctile.RequestSigning
+
+	// encryptionKeyFile and encryptionKMSKeyFile hold the keys tiles are
+	// encrypted with. They're read into encryption by loadEncryption, at
+	// startup and on SIGHUP.
+	encryptionKeyFile    string
+	encryptionKMSKeyFile string
+	encryption           ctile.Encryption
+
+	storage storageFlags
+	// storageKind is "s3" for the storage selected by storage, or "memory".
+	storageKind        string
+	storageMemoryBytes byteSize
+	// s3SecondaryRegion is the region of the logs' -s3-secondary-bucket, if
+	// it differs from the primary's.
+	s3SecondaryRegion string
+
+	// diskCacheDir, if set, is a local directory to cache up to
+	// diskCacheBytes of tiles in, in front of s3.
+	diskCacheDir   string
+	diskCacheBytes byteSize
+
+	// redisAddr, if set, is a Redis server to share cached tiles with other
+	// instances through.
+	redisAddr         string
+	redisPassword     secret
+	redisPasswordFile string
+	redisTTL          time.Duration
+	redisMaxMemory    byteSize
+
+	// clusterSelf and clusterPeers configure tile ownership across
+	// instances. clusterPeers is parsed into clusterDiscovery by validate.
+	clusterSelf            string
+	clusterPeers           string
+	clusterRefreshInterval time.Duration
+	clusterDiscovery       peerDiscovery
+
+	// readThroughPeer is another instance to request tiles missing from s3
+	// from, before the backend.
+	readThroughPeer string
+
+	// s3EventsQueueURL, if set, is an SQS queue of S3 event notifications
+	// for the buckets tiles are cached in, to learn of changes made by other
+	// instances and tools through.
+	s3EventsQueueURL string
+
+	dryRun bool
+
+	// collapseKeyName is parsed into collapseKey by validate.
+	collapseKeyName string
+	collapseKey     ctile.CollapseKey
+
+	logOutput string
+	selftest  bool
+
+	memory memoryConfig
+
+	fakeS3                   bool
+	fakeBackend              bool
+	fakeBackendSize          int64
+	fakeBackendMaxGetEntries int64
+}
+
+// registerFlags binds the fields of c to flags in fs.
+func (c *serveConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.configFile, "config", "", "JSON file configuring multiple logs to serve from one process. log settings in flags become defaults for each log")
+	fs.StringVar(&c.profile, "profile", "", "name of a profile in the -config file, such as dev, staging, or prod, whose settings override the file's base settings")
+	fs.DurationVar(&c.configWatchInterval, "config-watch-interval", 0, "how often to check the -config file for changes, and apply those that don't require a restart. 0 disables watching; the file is still reloaded on SIGHUP")
+	fs.StringVar(&c.defaults.LogURL, "log-url", "", "CT log URL. e.g. https://oak.ct.letsencrypt.org/2023. may be a comma-separated list of replicas of the log's backend, which are failed over to in order")
+	fs.IntVar(&c.defaults.TileSize, "tile-size", 0, "tile size. Must match the value used by the backend")
+	fs.StringVar(&c.defaults.S3Bucket, "s3-bucket", "", "s3 bucket to use for caching")
+	fs.StringVar(&c.defaults.S3Prefix, "s3-prefix", "", "prefix for s3 keys. may be a template using {log_host}, {log_path}, and {tile_size}. defaults to value of -log-url")
+	fs.Var(&c.defaults.S3Shards, "s3-shards", "ranges of the log to cache in other buckets or under other prefixes, like '100000000=bucket-2/oak2023/,200000000=/oak2023-3/' where an empty bucket means -s3-bucket. prefixes may be templates like -s3-prefix")
+	fs.StringVar(&c.listenAddress, "listen-address", ":7962", "address to listen on")
+	fs.StringVar(&c.metricsAddress, "metrics-address", ":7963", "address to listen on for metrics")
+	c.metricsSecurity.registerFlags(fs, "metrics-", "metrics")
+	fs.StringVar(&c.adminAddress, "admin-address", "", "address to listen on for the admin API. disabled if empty")
+	c.adminSecurity.registerFlags(fs, "admin-", "admin")
+	fs.Var(&c.requestSigningKey, "request-signing-key", "require requests to be signed with HMAC-SHA256 using this shared secret, for instances reached across a trust boundary. a comma-separated list accepts each key, and signs requests to peers with the first")
+	fs.StringVar(&c.requestSigningKeyFile, "request-signing-key-file", "", "file containing the keys for -request-signing-key, one per line. read again on SIGHUP")
+	fs.DurationVar(&c.requestSigning.MaxSkew, "request-signing-max-skew", 5*time.Minute, "how far from the current time the timestamp of a signed request may be")
+	fs.StringVar(&c.encryptionKeyFile, "s3-encryption-key-file", "", "file containing AES-256 keys in hex, one per line, e.g. from 'openssl rand -hex 32'. if set, tiles are encrypted with the first before they're written to s3, and decrypted with whichever they were encrypted with. add a new key after the old one everywhere before moving it first")
+	fs.StringVar(&c.encryptionKMSKeyFile, "s3-encryption-kms-key-file", "", "like -s3-encryption-key-file, but each line is a data key encrypted with AWS KMS, in base64, e.g. the CiphertextBlob from 'aws kms generate-data-key --key-spec AES_256'. they're decrypted with KMS at startup, and again on SIGHUP")
+	c.storage.registerFlags(fs)
+	fs.StringVar(&c.storageKind, "storage", storageS3, "where to cache tiles: 's3', or Azure or a directory if -azure-blob-endpoint or -cache-dir is set, or 'memory' for a bounded in-process store that is lost on exit, for development without credentials")
+	c.storageMemoryBytes = 256 << 20
+	fs.StringVar(&c.diskCacheDir, "disk-cache-dir", "", "local directory, ideally on a fast disk, to keep recently served tiles in between memory and s3, shared by all logs and kept across restarts. disabled if empty. unlike -cache-dir, it's a bounded cache in front of s3 rather than a replacement for it")
+	fs.Var(&c.diskCacheBytes, "disk-cache-bytes", "max size of the tiles in -disk-cache-dir, e.g. 100GiB. the least recently used tiles are removed to make room")
+	fs.StringVar(&c.redisAddr, "redis-addr", "", "address of a Redis server, e.g. redis.internal:6379, to cache tiles in between memory and s3, shared by all instances using it. disabled if empty")
+	fs.Var(&c.redisPassword, "redis-password", "password for -redis-addr")
+	fs.StringVar(&c.redisPasswordFile, "redis-password-file", "", "file containing the -redis-password. read again on SIGHUP, for new connections")
+	fs.DurationVar(&c.redisTTL, "redis-ttl", 24*time.Hour, "how long tiles are kept in -redis-addr after they're added. 0 keeps them until redis evicts them")
+	fs.Var(&c.redisMaxMemory, "redis-max-memory", "if set, configure -redis-addr at startup to use at most this much memory, e.g. 4GiB, evicting the least recently used tiles beyond it. leave unset to manage the server's configuration separately")
+	fs.Var(&c.storageMemoryBytes, "storage-memory-bytes", "max size of the tiles held by -storage=memory, e.g. 1GiB. the least recently written tiles are dropped to make room")
+	fs.StringVar(&c.s3SecondaryRegion, "s3-secondary-region", "", "AWS region of -s3-secondary-bucket. defaults to the region of -s3-bucket")
+	fs.StringVar(&c.clusterSelf, "cluster-self", "", "URL at which the other instances in -cluster-peers reach this one, e.g. http://10.0.0.1:7962")
+	fs.StringVar(&c.clusterPeers, "cluster-peers", "", "instances sharing the cache: comma-separated URLs, dns+srv://<name> for SRV records, or dns://<host>:<port> for address records. each tile missing from s3 is fetched from the backend by only the instance that owns it, and through it by the others")
+	fs.StringVar(&c.readThroughPeer, "read-through-peer", "", "URL of another instance to request tiles missing from s3 from before the backend, e.g. http://10.0.0.2:7962. it may have them in flight, and otherwise fetches them once for both")
+	fs.StringVar(&c.s3EventsQueueURL, "s3-events-queue-url", "", "URL of an SQS queue receiving the s3 event notifications of the buckets tiles are cached in, directly or through SNS, e.g. https://sqs.us-east-1.amazonaws.com/123456789012/ctile-1. tiles written or deleted by other instances and tools, e.g. purge, are reported to the caches each log keeps in memory. messages are deleted once read, so each instance needs its own queue. disabled if empty")
+	fs.DurationVar(&c.clusterRefreshInterval, "cluster-refresh-interval", 30*time.Second, "how often to look up -cluster-peers again, if it uses DNS")
+	fs.DurationVar(&c.defaults.FullRequestTimeout.Duration, "full-request-timeout", 4*time.Second, "max time to spend in the HTTP handler")
+	fs.DurationVar(&c.defaults.BackendTimeout.Duration, "backend-timeout", 0, "max time for a single request to the backend. 0 means only -full-request-timeout applies")
+	fs.DurationVar(&c.defaults.S3WriteTimeout.Duration, "s3-write-timeout", 0, "max time to write a tile to s3. the write continues after -full-request-timeout or the client going away, so the tile is still cached. 0 means -full-request-timeout")
+	fs.IntVar(&c.defaults.BackendMaxConcurrent, "backend-max-concurrent", 0, "max requests to the backend in flight at once. 0 means no limit")
+	fs.Float64Var(&c.defaults.BackendRateLimit, "backend-rate-limit", 0, "max requests per second to the backend. 0 means no limit")
+	fs.IntVar(&c.defaults.BackendBurst, "backend-burst", 1, "requests that may be sent to the backend at once before -backend-rate-limit applies")
+	fs.StringVar(&c.defaults.BackendBalance, "backend-balance", string(ctile.BalanceFailover), "how to spread requests over the replicas in -log-url: 'failover' to use the first healthy one, 'round-robin', or 'least-outstanding'")
+	fs.DurationVar(&c.defaults.BackendProbeInterval.Duration, "backend-probe-interval", 0, "how often to check the health of each replica in -log-url with a get-sth request (v2 for -backend-type=rfc9162), or checkpoint for -backend-type=static-ct. 0 means health is only learned from traffic")
+	fs.StringVar(&c.defaults.BackendType, "backend-type", string(ctile.BackendRFC6962), "the API served by the backend: 'rfc6962', 'static-ct' for a tile-based log like Sunlight, whose data tiles are translated into get-entries responses, or 'rfc9162' for a CT v2 log, whose get-entries is served at /ct/v2/get-entries. for 'static-ct', -log-url is the log's monitoring prefix")
+	fs.Int64Var(&c.defaults.BackendMaxBodySize, "backend-max-body-size", ctile.DefaultMaxBackendBodySize, "max size in bytes of a response from the backend or a peer. larger responses are treated as backend failures. 0 means no limit")
+	fs.BoolVar(&c.defaults.StrictValidation, "strict-validation", false, "before caching a tile, check with the backend's get-sth and get-proof-by-hash that it holds the entries it should. tiles that fail are neither cached nor served")
+	fs.IntVar(&c.defaults.BackendMaxConnections, "backend-max-connections", 0, "max connections to each backend host. each log has its own connection pool. 0 means no limit")
+	fs.IntVar(&c.defaults.CircuitBreakerFailures, "circuit-breaker-failures", 0, "after this many consecutive failed requests to the backend, answer with 503 without contacting it for -circuit-breaker-cooldown. 0 disables the circuit breaker")
+	fs.DurationVar(&c.defaults.CircuitBreakerCooldown.Duration, "circuit-breaker-cooldown", 30*time.Second, "how long to pause requests to a failing backend before trying it again")
+	fs.IntVar(&c.defaults.S3DegradeAfter, "s3-degrade-after", 0, "after this many consecutive failed requests to s3, serve tiles from the backend without s3 until it recovers, instead of failing requests. requests failed by s3 before then are served from the backend too. 0 means s3 failures fail requests")
+	fs.DurationVar(&c.defaults.S3ProbeInterval.Duration, "s3-probe-interval", 10*time.Second, "how often to check whether s3 has recovered, while -s3-degrade-after is in effect")
+	fs.Int64Var(&c.defaults.MemoryCacheBytes, "memory-cache-bytes", 0, "if nonzero, size in bytes of an in-memory cache of recently served tiles in front of s3, so requests for hot tiles skip reading and decoding them. each log has its own. e.g. 33554432 for 32 MiB, a few dozen tiles of 256 entries")
+	fs.StringVar(&c.defaults.S3SecondaryBucket, "s3-secondary-bucket", "", "bucket, e.g. in another region, to read tiles from when reads from -s3-bucket fail or s3 is degraded. tiles have the same keys in it")
+	fs.BoolVar(&c.defaults.S3DualWrite, "s3-dual-write", false, "write tiles to -s3-secondary-bucket as well as -s3-bucket, instead of relying on replication to fill it")
+	fs.BoolVar(&c.defaults.S3ConditionalWrites, "s3-conditional-writes", false, "write tiles to s3 with If-None-Match, so when instances race to cache a tile, only the first uploads it. needs a store that supports conditional writes")
+	fs.BoolVar(&c.defaults.S3Tagging, "s3-tagging", false, "tag tiles written to s3 with ctile-log, the log's name or url, ctile-version, ctile-tile-size and ctile-range, for lifecycle rules and cost allocation. needs the s3:PutObjectTagging permission")
+	fs.StringVar(&c.defaults.S3Serialization, "s3-serialization", string(ctile.SerializationCBOR), "how tiles written to s3 are serialized: 'cbor', or 'json', as in get-entries responses, which is larger but readable with ordinary tools. tiles are read whichever way they were written")
+	fs.IntVar(&c.defaults.S3GzipLevel, "s3-gzip-level", 0, "gzip level of tiles written to s3, from 1, fastest, to 9, smallest. 0 means the default, 6. tiles are read whatever level they were written with")
+	fs.BoolVar(&c.defaults.S3Uncompressed, "s3-uncompressed", false, "write tiles to s3 without gzip, e.g. for debugging, or when the bucket is compressed at rest. gzipped and uncompressed tiles are both read")
+	fs.BoolVar(&c.defaults.S3PrecompressedJSON, "s3-precompressed-json", false, "also store each tile in s3 as a gzipped json response, with a .json.gz suffix, and send it as is to clients requesting the whole tile with gzip, skipping decoding and json encoding. doubles s3 writes and storage")
+	fs.IntVar(&c.defaults.S3SuperTiles, "s3-super-tiles", 0, "store this many consecutive tiles in each s3 object, fetching the rest from the backend when one is written, for fewer s3 requests. pair with -memory-cache-bytes to also save reads. tiles at the end of the log are stored on their own. 0 or 1 disables it")
+	fs.StringVar(&c.defaults.S3KeyLayout, "s3-key-layout", string(ctile.KeyLayoutFlat), "how tile keys are laid out after -s3-prefix: 'flat', like tile_size=256/1024.cbor.gz, or 'hashed', which puts a short hash of the tile's start in front, like 4f2a/tile_size=256/1024.cbor.gz, to spread writes over s3's partitions. 'hashed' also reads tiles at flat keys, for migrating")
+	fs.StringVar(&c.defaults.S3KeyTemplate, "s3-key-template", ctile.DefaultKeyTemplate, "template for tile keys after -s3-prefix, e.g. to match a layout shared with other tools, using {tile_size}, {start}, {end} (inclusive), {tile_index}, {log_host} and {log_path}. must use {start} or {tile_index}")
+	fs.StringVar(&c.defaults.S3ChainBucket, "s3-chain-bucket", "", "bucket for -s3-chain-prefix, if not -s3-bucket")
+	fs.StringVar(&c.defaults.S3ChainPrefix, "s3-chain-prefix", "", "if set, store the certificate chains in entries' extra_data once each under this prefix, keyed by their sha-256, and only their hashes in tiles. logs may share it. upgrade every instance before setting it, and never expire the chains. empty disables it")
+	fs.IntVar(&c.defaults.S3ChainCacheSize, "s3-chain-cache-size", ctile.DefaultChainCacheSize, "chains from -s3-chain-prefix kept in memory")
+	fs.BoolVar(&c.defaults.AsyncS3Writes, "async-s3-writes", false, "respond as soon as a tile is fetched from the backend, and write it to s3 in the background. a failed write is logged but doesn't fail the request")
+	fs.IntVar(&c.defaults.S3WriteQueueSize, "s3-write-queue-size", 0, "tiles that may wait to be written to s3 in the background, for -async-s3-writes or to retry a failed write instead of failing its request. when it's full, writes are dropped. 0 disables retries, and means 1000 with -async-s3-writes")
+	fs.IntVar(&c.defaults.S3WriteWorkers, "s3-write-workers", ctile.DefaultWriteQueue.Workers, "writes from the s3 write queue made at once")
+	fs.IntVar(&c.defaults.S3WriteAttempts, "s3-write-attempts", ctile.DefaultWriteQueue.Attempts, "max times each write from the s3 write queue is tried, including the first")
+	fs.DurationVar(&c.defaults.S3WriteBackoff.Duration, "s3-write-backoff", ctile.DefaultWriteQueue.Backoff, "wait before retrying a write from the s3 write queue, doubled after each retry")
+	fs.IntVar(&c.defaults.MaxConcurrentRequests, "max-concurrent-requests", 0, "max requests to serve at once, per log. requests over the limit get a 503. 0 means no limit")
+	fs.Float64Var(&c.defaults.ClientRateLimit, "client-rate-limit", 0, "max requests per second from each client, per log. requests over the limit get a 429. 0 means no limit")
+	fs.IntVar(&c.defaults.ClientBurst, "client-burst", 0, "max requests a client may send at once before -client-rate-limit applies. defaults to 1")
+	fs.StringVar(&c.defaults.ClientHeader, "client-header", "", "request header holding the client's address, set by a trusted proxy in front of CTile, e.g. X-Forwarded-For. the last address in it is used. by default, clients are identified by the address of their connection")
+	fs.DurationVar(&c.defaults.PartialTileRetryDelay.Duration, "partial-tile-retry-delay", 0, "if nonzero, when the backend returns a partial tile, wait this long and fetch it once more, so it can be cached if it's complete by then. e.g. 200ms")
+	fs.IntVar(&c.defaults.PartialTileRetryMaxMissing, "partial-tile-retry-max-missing", 0, "only retry partial tiles missing at most this many entries. 0 means any partial tile is retried")
+	fs.BoolVar(&c.defaults.S3CachePartialTiles, "s3-cache-partial-tiles", false, "also cache partial tiles in s3, under the tile's key with a .partial suffix, replacing them as they grow, so a slowly growing log's last tile is served from s3. requests past the end of the cached version go to the backend")
+	fs.BoolVar(&c.defaults.S3TileIndex, "s3-tile-index", false, "keep an index in memory of the tiles known to be cached in s3, and once -s3-tile-index-prime has listed them, fetch other tiles from the backend without reading s3 first. tiles cached by other instances after the listing are fetched from the backend once, unless -s3-events-queue-url reports them")
+	fs.BoolVar(&c.defaults.S3TileIndexPrime, "s3-tile-index-prime", false, "list the tiles cached in s3 at startup to fill -s3-tile-index, which skips no reads until then. s3 is read for every tile until the listing is done, or if it fails")
+	fs.StringVar(&c.defaults.CoalesceEndpoints, "coalesce-endpoints", strings.Join(ctile.DefaultCoalescedEndpoints, ","), "comma-separated endpoints other than get-entries, like get-sth, for which simultaneous requests share one request to the backend, or 'none'")
+	fs.DurationVar(&c.defaults.NegativeCacheTTL.Duration, "negative-cache-ttl", 0, "if nonzero, share the size of the log with other instances through markers in s3, and answer requests past the end from them for this long without contacting the backend. e.g. 5s")
+	fs.DurationVar(&c.defaults.TailCacheTTL.Duration, "tail-cache-ttl", 0, "if nonzero, serve the partial tile at the end of the log from memory for this long after fetching it, so monitors polling the end share one backend request. newer entries aren't served until it expires, so keep it to a few seconds, e.g. 2s")
+	fs.DurationVar(&c.defaults.STHCacheTTL.Duration, "sth-cache-ttl", 0, "if nonzero, serve get-sth from memory for this long after fetching it, so monitors polling it share one backend request, e.g. 10s")
+	fs.DurationVar(&c.defaults.STHCacheMaxStale.Duration, "sth-cache-max-stale", 0, "how much longer than -sth-cache-ttl an STH may be served while a new one is fetched in the background, including while the backend is down")
+	fs.DurationVar(&c.defaults.RootsCacheTTL.Duration, "roots-cache-ttl", 0, "if nonzero, serve get-roots from memory for this long after fetching it, then revalidate it with the backend, e.g. 1h")
+	fs.BoolVar(&c.defaults.CachedEntryAndProof, "cached-entry-and-proof", false, "serve get-entry-and-proof with the entry from its cached tile, and only the audit path from the backend's get-proof-by-hash")
+	fs.IntVar(&c.defaults.MaxRequestTiles, "max-request-tiles", 0, "serve get-entries requests that continue past the end of their tile with up to this many tiles, fetched concurrently, instead of cutting them short at the first tile's end. 0 and 1 serve one tile")
+	fs.BoolVar(&c.defaults.StrictAlignment, "strict-alignment", false, "reject get-entries requests that don't start at a tile, or that continue past the tiles a response may be served from (see -max-request-tiles), with a 400 naming the aligned range to request instead")
+	fs.Int64Var(&c.defaults.MaxGetEntries, "max-get-entries", 0, "reject get-entries requests for more than this many entries with a 400, or clamp them with -clamp-get-entries. 0 means no limit")
+	fs.BoolVar(&c.defaults.ClampGetEntries, "clamp-get-entries", false, "serve get-entries requests for more than -max-get-entries entries with the first -max-get-entries, like ctfe's max_get_entries, instead of rejecting them")
+	fs.BoolVar(&c.defaults.PrettyJSON, "pretty-json", false, "indent get-entries json responses by two spaces. otherwise they're compact, unless a request has ?pretty=1")
+	fs.BoolVar(&c.defaults.Export, "export", false, "serve /ctile/v1/export?start=&end=, which streams entries across tiles as newline-delimited json, reading tiles from the cache first")
+	fs.Float64Var(&c.defaults.ExportRateLimit, "export-rate-limit", 0, "max entries per second sent by each export, a tile at a time. 0 means no limit")
+	fs.DurationVar(&c.defaults.TailPollInterval.Duration, "tail-poll-interval", 0, "if nonzero, serve /ctile/v1/tail, which pushes new entries to clients as server-sent events, polling the backend's tree size this often while any are connected")
+	fs.IntVar(&c.defaults.ReadaheadDepth, "readahead-depth", 0, "when a tile is requested soon after the one before it, as by monitors walking the log, fetch and cache up to this many of the following tiles in the background. 0 disables it. experimental: only used for the share of requests set by -features readahead=N")
+	fs.DurationVar(&c.defaults.S3HedgeDelay.Duration, "s3-hedge-delay", 0, "if nonzero, when an S3 read takes longer than this, also fetch the tile from the backend and serve whichever answers first. each hedged read costs a backend request, so set it around a high percentile of S3 read latency, e.g. 200ms. experimental: only used for the share of requests set by -features hedging=N")
+	fs.StringVar(&c.defaults.StaticCTOrigin, "static-ct-origin", "", "if set, also serve the static CT API (c2sp.org/static-ct-api) for the log, with this origin, e.g. oak.ct.letsencrypt.org/2023. its checkpoints are signed with the backend's STH signatures, so -static-ct-public-key is required")
+	fs.StringVar(&c.defaults.StaticCTPublicKey, "static-ct-public-key", "", "the log's public key, in base64 DER, as in log lists. identifies checkpoint signatures for -static-ct-origin")
+	fs.Var(&c.defaults.Features, "features", "initial rollout percentages of experimental features, like 'readahead=10,zstd=100': readahead for -readahead-depth, hedging for -s3-hedge-delay, and zstd and br for compressing responses. can be changed at runtime with the admin API")
+	fs.StringVar(&c.defaults.Mode, "mode", string(ctile.ModeNormal), "serving mode: 'normal', 'cache-only' to serve exclusively from s3 without ever contacting the backend, or 'proxy-only' to never use s3")
+	fs.BoolVar(&c.dryRun, "dry-run", false, "serve requests as usual, but log tiles that would be written to s3 instead of writing them")
+	fs.StringVar(&c.collapseKeyName, "collapse-key", "log_host,tile_size,s3_location", "comma-separated parts of a tile request that must match for simultaneous requests to be collapsed into one fetch, across all logs: any of log_host, tile_size, and s3_location")
+	c.memory.registerFlags(fs)
+	fs.StringVar(&c.logOutput, "log-output", "stderr", "where to send logs: 'stderr', 'syslog', or 'journald'")
+	fs.BoolVar(&c.selftest, "selftest", false, "instead of serving, check S3, the backend, and one get-entries request, then exit with a report. exits non-zero on failure")
+	fs.BoolVar(&c.fakeS3, "fake-s3", false, "same as -storage=memory")
+	fs.BoolVar(&c.fakeBackend, "fake-backend", false, "instead of -log-url, use a deterministic in-process CT log as the backend. for development and demos")
+	fs.Int64Var(&c.fakeBackendSize, "fake-backend-size", 100000, "number of entries in the -fake-backend log")
+	fs.Int64Var(&c.fakeBackendMaxGetEntries, "fake-backend-max-getentries", 256, "max_getentries limit of the -fake-backend log")
+}
+
+// resolveLogs sets c.logs, from the -config file if there is one and from
+// flags otherwise, and fills in settings whose defaults depend on others.
+func (c *serveConfig) resolveLogs() error {
+	if c.fakeS3 {
+		c.storageKind = storageMemory
+		if c.defaults.S3Bucket == "" {
+			c.defaults.S3Bucket = "fake-s3"
+		}
+	}
+	if c.storageKind == storageMemory && c.defaults.S3Bucket == "" {
+		c.defaults.S3Bucket = "memory"
+	}
+	if c.storage.cacheDir != "" && c.defaults.S3Bucket == "" {
+		c.defaults.S3Bucket = "tiles"
+	}
+
+	if c.configFile == "" {
+		if c.profile != "" {
+			return errors.New("-profile requires -config")
+		}
+		if c.configWatchInterval != 0 {
+			return errors.New("-config-watch-interval requires -config")
+		}
+		c.logs = []logConfig{c.defaults}
+		l := &c.logs[0]
+		if l.S3Prefix == "" {
+			if c.fakeBackend {
+				l.S3Prefix = "fake-backend/"
+			} else {
+				l.S3Prefix = l.primaryLogURL()
+			}
+		}
+		return nil
+	}
+
+	if c.fakeBackend {
+		return errors.New("-fake-backend can't be used with -config")
+	}
+	var err error
+	c.logs, err = c.loadConfigLogs()
+	return err
+}
+
+// loadConfigLogs reads the logs configured by the -config file, with the
+// -profile and flag defaults applied. It's used both at startup and to reload
+// the file.
+func (c *serveConfig) loadConfigLogs() ([]logConfig, error) {
+	file, err := loadConfigFile(c.configFile)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := file.resolve(c.profile, c.defaults)
+	if err != nil {
+		return nil, err
+	}
+	for i := range logs {
+		if logs[i].S3Prefix == "" {
+			logs[i].S3Prefix = logs[i].primaryLogURL()
+		}
+	}
+	return logs, nil
+}
+
+// usesS3 returns true if any of the logs reads or writes S3.
+func (c *serveConfig) usesS3() bool {
+	for i := range c.logs {
+		if c.logs[i].usesS3() {
+			return true
+		}
+	}
+	return false
+}
+
+// maxFullRequestTimeout returns the longest full request timeout of any log.
+func (c *serveConfig) maxFullRequestTimeout() time.Duration {
+	var longest time.Duration
+	for _, l := range c.logs {
+		if l.FullRequestTimeout.Duration > longest {
+			longest = l.FullRequestTimeout.Duration
+		}
+	}
+	return longest
+}
+
+// validate checks the configuration, returning an error describing every
+// problem found rather than just the first. It should be called after
+// resolveLogs.
+func (c *serveConfig) validate() error {
+	var errs []error
+
+	if c.fakeBackend {
+		if c.fakeBackendSize < 0 {
+			errs = append(errs, errors.New("-fake-backend-size must not be negative"))
+		}
+		if c.fakeBackendMaxGetEntries <= 0 {
+			errs = append(errs, errors.New("-fake-backend-max-getentries must be positive"))
+		} else if c.defaults.TileSize > 0 && int64(c.defaults.TileSize) != c.fakeBackendMaxGetEntries {
+			errs = append(errs, fmt.Errorf("-tile-size (%d) must match -fake-backend-max-getentries (%d)", c.defaults.TileSize, c.fakeBackendMaxGetEntries))
+		}
+	}
+
+	errs = append(errs, c.validateLogs(c.logs)...)
+	errs = append(errs, c.memory.validate()...)
+
+	if (c.diskCacheDir == "") != (c.diskCacheBytes == 0) {
+		errs = append(errs, errors.New("-disk-cache-dir and -disk-cache-bytes must be set together"))
+	}
+	if c.redisTTL < 0 {
+		errs = append(errs, errors.New("-redis-ttl must not be negative"))
+	}
+	if c.redisAddr == "" && (c.redisPassword != "" || c.redisPasswordFile != "" || c.redisMaxMemory != 0) {
+		errs = append(errs, errors.New("-redis-password, -redis-password-file and -redis-max-memory require -redis-addr"))
+	}
+
+	if c.usesSecondaryS3() && (c.storageKind != storageS3 || c.storage.azureEndpoint != "" || c.storage.cacheDir != "") {
+		errs = append(errs, errors.New("-s3-secondary-bucket requires s3 storage"))
+	}
+	if c.s3SecondaryRegion != "" && !c.usesSecondaryS3() {
+		errs = append(errs, errors.New("-s3-secondary-region requires -s3-secondary-bucket"))
+	}
+	switch c.storageKind {
+	case storageS3:
+	case storageMemory:
+		if c.storageMemoryBytes <= 0 {
+			errs = append(errs, errors.New("-storage-memory-bytes must be positive"))
+		}
+		if c.storage.azureEndpoint != "" || c.storage.cacheDir != "" {
+			errs = append(errs, errors.New("-storage=memory can't be used with -azure-blob-endpoint or -cache-dir"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown -storage %q: want 's3' or 'memory'", c.storageKind))
+	}
+
+	if c.configWatchInterval < 0 {
+		errs = append(errs, errors.New("-config-watch-interval must not be negative"))
+	}
+
+	collapseKey, err := parseCollapseKey(c.collapseKeyName)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	c.collapseKey = collapseKey
+
+	if (c.clusterSelf == "") != (c.clusterPeers == "") {
+		errs = append(errs, errors.New("-cluster-self and -cluster-peers must be set together"))
+	} else if c.clusterSelf != "" {
+		if !c.usesS3() {
+			errs = append(errs, errors.New("-cluster-peers has no effect in proxy-only mode, which never writes to s3"))
+		}
+		if err := checkLogURL(c.clusterSelf); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -cluster-self: %w", err))
+		}
+		discovery, err := parsePeerDiscovery(c.clusterPeers)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -cluster-peers: %w", err))
+		}
+		c.clusterDiscovery = discovery
+		if c.clusterRefreshInterval <= 0 {
+			errs = append(errs, errors.New("-cluster-refresh-interval must be positive"))
+		}
+	}
+
+	if c.readThroughPeer != "" {
+		if err := checkLogURL(c.readThroughPeer); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -read-through-peer: %w", err))
+		}
+		if !c.usesS3() {
+			errs = append(errs, errors.New("-read-through-peer has no effect in proxy-only mode"))
+		}
+	}
+
+	if c.s3EventsQueueURL != "" {
+		if !c.usesS3() {
+			errs = append(errs, errors.New("-s3-events-queue-url has no effect in proxy-only mode, which never uses s3"))
+		}
+		if c.storageKind != storageS3 || c.storage.azureEndpoint != "" || c.storage.cacheDir != "" {
+			errs = append(errs, errors.New("-s3-events-queue-url requires s3 storage, not -storage=memory, -fake-s3, -azure-blob-endpoint or -cache-dir"))
+		}
+		if u, err := url.Parse(c.s3EventsQueueURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid -s3-events-queue-url %q: must be an http or https URL", c.s3EventsQueueURL))
+		}
+	}
+
+	if c.dryRun && !c.usesS3() {
+		errs = append(errs, errors.New("-dry-run has no effect in proxy-only mode, which never writes to s3"))
+	}
+
+	if _, _, err := net.SplitHostPort(c.listenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -listen-address: %w", err))
+	}
+	if _, _, err := net.SplitHostPort(c.metricsAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -metrics-address: %w", err))
+	}
+	if c.listenAddress == c.metricsAddress {
+		errs = append(errs, errors.New("-listen-address and -metrics-address must differ"))
+	}
+	errs = append(errs, c.metricsSecurity.validate("metrics-")...)
+	if c.adminAddress != "" {
+		if _, _, err := net.SplitHostPort(c.adminAddress); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -admin-address: %w", err))
+		}
+		if c.adminAddress == c.listenAddress || c.adminAddress == c.metricsAddress {
+			errs = append(errs, errors.New("-admin-address must differ from -listen-address and -metrics-address"))
+		}
+		errs = append(errs, c.adminSecurity.validate("admin-")...)
+	}
+
+	if c.requestSigningKey != "" && c.requestSigningKeyFile != "" {
+		errs = append(errs, errors.New("-request-signing-key and -request-signing-key-file are mutually exclusive"))
+	}
+	keys, err := c.loadRequestSigningKeys()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	c.requestSigning.Keys = keys
+	if c.requestSigning.MaxSkew <= 0 {
+		errs = append(errs, errors.New("-request-signing-max-skew must be positive"))
+	}
+	if c.encryptionKeyFile != "" && c.encryptionKMSKeyFile != "" {
+		errs = append(errs, errors.New("-s3-encryption-key-file and -s3-encryption-kms-key-file are mutually exclusive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// loadRequestSigningKeys returns the keys of -request-signing-key, or those
+// read from -request-signing-key-file.
+func (c *serveConfig) loadRequestSigningKeys() ([][]byte, error) {
+	value, err := secretValue(c.requestSigningKey, c.requestSigningKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("-request-signing-key-file: %w", err)
+	}
+	var keys [][]byte
+	for _, key := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys, nil
+}
+
+// signed returns handler, with each request signed with the first
+// -request-signing-key, for requests made in-process, e.g. by -selftest.
+func (c *serveConfig) signed(handler http.Handler) http.Handler {
+	if len(c.requestSigning.Keys) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctile.SignRequest(r, c.requestSigning.Keys[0], time.Now())
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// validateLogs returns every problem with logs, individually and together.
+// It's used both at startup and when the -config file is reloaded.
+func (c *serveConfig) validateLogs(logs []logConfig) []error {
+	var errs []error
+	names := make(map[string]bool)
+	caches := make(map[string]string)
+	for i := range logs {
+		l := &logs[i]
+		errs = append(errs, l.validate(c.fakeBackend)...)
+
+		if c.configFile != "" {
+			if !validLogName.MatchString(l.Name) {
+				errs = append(errs, fmt.Errorf("log name %q must be non-empty and contain only letters, digits, '.', '_' and '-'", l.Name))
+			} else if names[l.Name] {
+				errs = append(errs, fmt.Errorf("log name %q is used more than once", l.Name))
+			}
+			names[l.Name] = true
+		}
+
+		// Logs sharing a bucket must not share a prefix, or they would serve
+		// each other's tiles.
+		if l.usesS3() && !c.fakeBackend {
+			prefix, err := ctile.ExpandPrefix(l.S3Prefix, l.primaryLogURL(), l.TileSize)
+			if err == nil {
+				cache := l.S3Bucket + "/" + prefix
+				if other, ok := caches[cache]; ok {
+					errs = append(errs, fmt.Errorf("logs %q and %q use the same s3 bucket and prefix", other, l.Name))
+				}
+				caches[cache] = l.Name
+			}
+		}
+	}
+	return errs
+}
+
+// parseCollapseKey parses the -collapse-key flag. The log URL's path, the
+// mode, the backend type, and the tile's position are always part of the key;
+// each named part adds to it.
+func parseCollapseKey(s string) (ctile.CollapseKey, error) {
+	key := ctile.CollapseKey{ExcludeLogHost: true, ExcludeTileSize: true, ExcludeS3Location: true}
+	for _, part := range strings.Split(s, ",") {
+		switch strings.TrimSpace(part) {
+		case "log_host":
+			key.ExcludeLogHost = false
+		case "tile_size":
+			key.ExcludeTileSize = false
+		case "s3_location":
+			key.ExcludeS3Location = false
+		case "":
+		default:
+			return ctile.CollapseKey{}, fmt.Errorf("unknown -collapse-key part %q: must be log_host, tile_size, or s3_location", part)
+		}
+	}
+	return key, nil
+}
+
+// checkLogURL returns an error if logURL isn't an absolute http or https URL
+// usable as the base of CT API paths.
+func checkLogURL(logURL string) error {
+	u, err := url.Parse(logURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("must not have a query or fragment")
+	}
+	if strings.HasSuffix(u.Path, "/ct/v1") || strings.Contains(u.Path, "/ct/v1/") {
+		return errors.New("must be the base URL of the log, without /ct/v1")
+	}
+	return nil
+}
+
+// The values of -storage.
+const (
+	storageS3     = "s3"
+	storageMemory = "memory"
+)
+
+// newStorage returns the store for cached tiles selected by c, after checking
+// that the buckets used by its logs are reachable.
+func (c *serveConfig) newStorage(ctx context.Context) (ctile.S3API, error) {
+	if c.storageKind == storageMemory {
+		return s3mem.NewBounded(int64(c.storageMemoryBytes)), nil
+	}
+	svc, err := newStorageService(ctx, c.storage)
+	if err != nil {
+		return nil, err
+	}
+	return svc, checkBuckets(ctx, svc, c.logs)
+}
+
+// usesSecondaryS3 returns true if any log has an -s3-secondary-bucket.
+func (c *serveConfig) usesSecondaryS3() bool {
+	for _, l := range c.logs {
+		if l.S3SecondaryBucket != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newSecondaryStorage returns the S3 client for the logs'
+// -s3-secondary-bucket, or nil if none has one.
+func (c *serveConfig) newSecondaryStorage(ctx context.Context) (ctile.S3API, error) {
+	if !c.usesSecondaryS3() {
+		return nil, nil
+	}
+	storage := c.storage
+	if c.s3SecondaryRegion != "" {
+		storage.region = c.s3SecondaryRegion
+	}
+	return newStorageService(ctx, storage)
+}
+
+// newSharedCache returns the cache tier between memory and S3 selected by c,
+// or nil if there is none. With -redis-max-memory, it configures the Redis
+// server's memory limit and eviction policy; many managed services don't
+// allow that, so a failure is only a warning.
+func (c *serveConfig) newSharedCache(ctx context.Context) (ctile.SharedCache, error) {
+	if c.redisAddr == "" {
+		return nil, nil
+	}
+	password, err := secretValue(c.redisPassword, c.redisPasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("-redis-password-file: %w", err)
+	}
+	client := redis.New(c.redisAddr, password, c.redisTTL)
+	if c.redisMaxMemory != 0 {
+		err := client.ConfigSet(ctx, "maxmemory", strconv.FormatInt(int64(c.redisMaxMemory), 10))
+		if err == nil {
+			err = client.ConfigSet(ctx, "maxmemory-policy", "allkeys-lru")
+		}
+		if err != nil {
+			log.Printf("warning: configuring -redis-max-memory on %s: %s\n", c.redisAddr, err)
+		}
+	}
+	return client, nil
+}
+
+// checkBuckets checks every bucket used by logs with checkBucket, and returns
+// all the errors.
+func checkBuckets(ctx context.Context, svc ctile.S3API, logs []logConfig) error {
+	var errs []error
+	checked := make(map[string]bool)
+	for _, l := range logs {
+		if !l.usesS3() || l.S3Bucket == "" {
+			continue
+		}
+		if !checked[l.S3Bucket] {
+			checked[l.S3Bucket] = true
+			errs = append(errs, checkBucket(ctx, svc, l.S3Bucket, l.S3Prefix))
+		}
+		for _, s := range l.S3Shards {
+			if s.S3Bucket == "" || checked[s.S3Bucket] {
+				continue
+			}
+			checked[s.S3Bucket] = true
+			errs = append(errs, checkBucket(ctx, svc, s.S3Bucket, s.S3Prefix))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkBucket returns an error if the bucket can't be listed, for instance
+// because it doesn't exist or the credentials don't grant access to it.
+func checkBucket(ctx context.Context, svc ctile.S3API, bucket, prefix string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := svc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: 1,
+	})
+	if err != nil {
+		return fmt.Errorf("s3 bucket %q is not reachable: %w", bucket, err)
+	}
+	return nil
+}
+
+// logEffectiveConfig logs the value of every flag in fs, including defaults,
+// and the resolved configuration of each log, so the configuration a server
+// ran with can be audited from its logs.
+func logEffectiveConfig(logf func(format string, v ...any), fs *flag.FlagSet, c *serveConfig) {
+	var settings []string
+	fs.VisitAll(func(f *flag.Flag) {
+		settings = append(settings, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	logf("effective configuration: %s\n", strings.Join(settings, " "))
+	for i := range c.logs {
+		l := &c.logs[i]
+		if l.Name == "" {
+			logf("effective log configuration: %s\n", l)
+		} else {
+			logf("effective configuration for log %q: %s\n", l.Name, l)
+		}
+	}
+}
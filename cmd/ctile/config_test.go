@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestServeConfigValidate(t *testing.T) {
+	parse := func(t *testing.T, args ...string) *serveConfig {
+		t.Helper()
+		var cfg serveConfig
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg.registerFlags(fs)
+		err := fs.Parse(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cfg.resolveLogs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &cfg
+	}
+
+	cfg := parse(t, "-log-url", "https://example.com/2023", "-tile-size", "256", "-s3-bucket", "b")
+	err := cfg.validate()
+	if err != nil {
+		t.Errorf("expected valid config, got %s", err)
+	}
+	if cfg.logs[0].S3Prefix != "https://example.com/2023" {
+		t.Errorf("expected -s3-prefix to default to -log-url, got %q", cfg.logs[0].S3Prefix)
+	}
+	if cfg.logs[0].MemoryCacheBytes != 0 {
+		t.Errorf("expected -memory-cache-bytes to default to 0, got %d", cfg.logs[0].MemoryCacheBytes)
+	}
+
+	cfg = parse(t, "-log-url", "https://example.com/2023, https://replica.example.com/2023", "-tile-size", "256", "-s3-bucket", "b")
+	err = cfg.validate()
+	if err != nil {
+		t.Errorf("expected valid config with replicas, got %s", err)
+	}
+	if cfg.logs[0].S3Prefix != "https://example.com/2023" {
+		t.Errorf("expected -s3-prefix to default to the first -log-url, got %q", cfg.logs[0].S3Prefix)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	err = os.WriteFile(keyFile, []byte("new\nold\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = parse(t, "-log-url", "https://example.com/2023", "-tile-size", "256", "-s3-bucket", "b", "-request-signing-key-file", keyFile)
+	err = cfg.validate()
+	if err != nil {
+		t.Errorf("expected valid config with request signing keys, got %s", err)
+	}
+	if len(cfg.requestSigning.Keys) != 2 || string(cfg.requestSigning.Keys[0]) != "new" || string(cfg.requestSigning.Keys[1]) != "old" {
+		t.Errorf("expected request signing keys [new old], got %q", cfg.requestSigning.Keys)
+	}
+
+	cfg = parse(t, "-log-url", "https://example.com/2023,https://example.com/2023", "-tile-size", "256", "-s3-bucket", "b")
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected error about a repeated -log-url, got %v", err)
+	}
+
+	cfg = parse(t, "-log-url", "https://example.com/2023", "-tile-size", "256", "-s3-bucket", "b", "-s3-shards", "1024=/second/,2048=other/{log_path}/")
+	err = cfg.validate()
+	if err != nil {
+		t.Errorf("expected valid config with shards, got %s", err)
+	}
+	expectedShards := shardMap{{1024, "", "second/"}, {2048, "other", "{log_path}/"}}
+	if !reflect.DeepEqual(cfg.logs[0].S3Shards, expectedShards) {
+		t.Errorf("expected shards %+v, got %+v", expectedShards, cfg.logs[0].S3Shards)
+	}
+
+	cfg = parse(t, "-log-url", "https://example.com/2023", "-tile-size", "256", "-s3-bucket", "b", "-s3-super-tiles", "4", "-s3-shards", "1280=/second/")
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "-s3-shards start 1280 must be a multiple of -tile-size times -s3-super-tiles") {
+		t.Errorf("expected an error about a shard splitting a super-tile, got %v", err)
+	}
+
+	cfg = parse(t, "-log-url", "https://example.com/2023", "-tile-size", "256", "-s3-bucket", "b", "-s3-shards", "1000=b/x/,512=b/,1024=b/{bogus}")
+	err = cfg.validate()
+	for _, expected := range []string{
+		"start 1000 must be a positive multiple of -tile-size",
+		"increasing order",
+		"prefix for start 512 must not be empty",
+		"invalid -s3-shards prefix",
+	} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %q, got:\n%v", expected, err)
+		}
+	}
+
+	cfg = parse(t, "-log-url", "example.com/ct/v1", "-full-request-timeout", "0", "-s3-write-timeout", "-1s", "-s3-write-attempts", "-1", "-s3-serialization", "xml", "-s3-gzip-level", "10", "-s3-super-tiles", "-1", "-s3-key-layout", "sideways", "-s3-key-template", "{tile_size}.bin", "-s3-chain-bucket", "chains", "-s3-chain-cache-size", "-1", "-s3-tile-index-prime", "-s3-dual-write", "-mode", "bogus", "-backend-balance", "random", "-backend-type", "ctfe", "-max-concurrent-requests", "-1", "-client-rate-limit", "-1", "-circuit-breaker-cooldown", "-1s", "-coalesce-endpoints", "get-sth,get-entries", "-s3-degrade-after", "-1", "-memory-cache-bytes", "-1", "-tail-cache-ttl", "-1s", "-sth-cache-max-stale", "-1s", "-roots-cache-ttl", "-1s", "-cached-entry-and-proof", "-max-request-tiles", "-1", "-max-get-entries", "-1", "-export-rate-limit", "-1", "-tail-poll-interval", "-1s", "-readahead-depth", "-1", "-s3-hedge-delay", "-1s", "-static-ct-origin", "example.com/ct", "-static-ct-public-key", "bm90IGEga2V5", "-storage", "bogus", "-redis-ttl", "-1s", "-redis-max-memory", "1GiB", "-disk-cache-bytes", "1GiB", "-cluster-self", "http://10.0.0.1:7962", "-s3-events-queue-url", "sqs.us-east-1.amazonaws.com/123456789012/ctile", "-metrics-address", ":7962", "-s3-encryption-key-file", "keys", "-s3-encryption-kms-key-file", "kms-keys", "-features", "prefetch=10")
+	err = cfg.validate()
+	if err == nil {
+		t.Fatal("expected errors, got none")
+	}
+	for _, expected := range []string{
+		"invalid -log-url",
+		"missing required flag: -tile-size",
+		"-full-request-timeout must be positive",
+		"-s3-write-timeout must not be negative",
+		"-s3-write-attempts and -s3-write-backoff must not be negative",
+		`-s3-serialization: unknown serialization "xml"`,
+		"-s3-gzip-level must be between 0 and 9",
+		"-s3-super-tiles must not be negative",
+		`-s3-key-layout: unknown key layout "sideways"`,
+		"-s3-key-template: key template \"{tile_size}.bin\" must use {start} or {tile_index}",
+		"-s3-chain-bucket requires -s3-chain-prefix",
+		"-s3-chain-cache-size must not be negative",
+		"-s3-tile-index-prime requires -s3-tile-index",
+		"-s3-dual-write requires -s3-secondary-bucket",
+		"unknown mode",
+		"unknown balance policy",
+		`-backend-type: unknown backend type "ctfe"`,
+		"-max-concurrent-requests must not be negative",
+		"-circuit-breaker-cooldown must not be negative",
+		"-client-rate-limit and -client-burst must not be negative",
+		`invalid endpoint "get-entries"`,
+		"-s3-degrade-after and -s3-probe-interval must not be negative",
+		"-memory-cache-bytes must not be negative",
+		"-tail-cache-ttl must not be negative",
+		"-sth-cache-ttl and -sth-cache-max-stale must not be negative",
+		"-roots-cache-ttl must not be negative",
+		"-cached-entry-and-proof requires -mode normal and -backend-type rfc6962",
+		"-max-request-tiles must not be negative",
+		"-max-get-entries must not be negative",
+		"-export-rate-limit must not be negative",
+		"-tail-poll-interval must not be negative",
+		"-readahead-depth must not be negative",
+		"-s3-hedge-delay must not be negative",
+		`invalid -features: unknown feature "prefetch"`,
+		"-static-ct-public-key: ",
+		`unknown -storage "bogus"`,
+		"-redis-ttl must not be negative",
+		"-disk-cache-dir and -disk-cache-bytes must be set together",
+		"-redis-max-memory require -redis-addr",
+		"-cluster-self and -cluster-peers must be set together",
+		"invalid -s3-events-queue-url",
+		"-s3-encryption-key-file and -s3-encryption-kms-key-file are mutually exclusive",
+		"missing required flag: -s3-bucket",
+		"must differ",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %q, got:\n%s", expected, err)
+		}
+	}
+
+	cfg = parse(t, "-log-url", "https://example.com/2023", "-tile-size", "256", "-s3-bucket", "b", "-clamp-get-entries")
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "-clamp-get-entries requires -max-get-entries") {
+		t.Errorf("expected an error for -clamp-get-entries without -max-get-entries, got %v", err)
+	}
+
+	cfg = parse(t, "-fake-backend", "-fake-s3", "-tile-size", "100")
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "must match -fake-backend-max-getentries") {
+		t.Errorf("expected tile size mismatch error, got %v", err)
+	}
+	if cfg.logs[0].S3Bucket != "fake-s3" || cfg.logs[0].S3Prefix != "fake-backend/" {
+		t.Errorf("expected fake defaults for bucket and prefix, got %q and %q", cfg.logs[0].S3Bucket, cfg.logs[0].S3Prefix)
+	}
+
+	cfg = parse(t, "-log-url", "https://oak.ct.letsencrypt.org/2023", "-tile-size", "256", "-cache-dir", t.TempDir())
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.logs[0].S3Bucket != "tiles" {
+		t.Errorf("expected -cache-dir to default the bucket to tiles, got %q", cfg.logs[0].S3Bucket)
+	}
+	cfg = parse(t, "-log-url", "https://oak.ct.letsencrypt.org/2023", "-tile-size", "256", "-storage", "memory")
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.logs[0].S3Bucket != "memory" {
+		t.Errorf("expected -storage=memory to default the bucket to memory, got %q", cfg.logs[0].S3Bucket)
+	}
+	svc, err := cfg.newStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svc.(*s3mem.Client); !ok {
+		t.Errorf("expected an in-memory store, got %T", svc)
+	}
+
+	_, err = newStorageService(context.Background(), storageFlags{cacheDir: t.TempDir(), azureEndpoint: "https://account.blob.core.windows.net"})
+	if err == nil {
+		t.Errorf("expected an error for -cache-dir with -azure-blob-endpoint")
+	}
+}
+
+func TestS3Endpoint(t *testing.T) {
+	// Keep the SDK from finding real credentials or config.
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Host+r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var a storageFlags
+	a.registerFlags(fs)
+	err := fs.Parse([]string{"-s3-endpoint", server.URL, "-s3-region", "auto", "-s3-path-style"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := newStorageService(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("tiles"), Key: aws.String("k")})
+	if err == nil {
+		t.Fatal("expected an error from the fake server")
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	if len(paths) == 0 || paths[0] != host+"/tiles/k" {
+		t.Errorf("expected a path-style request to %s/tiles/k, got %v", host, paths)
+	}
+
+	for _, a := range []storageFlags{
+		{endpoint: "localhost:9000"},
+		{endpoint: "http://localhost:9000", cacheDir: t.TempDir()},
+	} {
+		_, err = newStorageService(context.Background(), a)
+		if err == nil {
+			t.Errorf("expected an error for %+v", a)
+		}
+	}
+}
+
+func TestServeConfigFile(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(configFile, []byte(`{
+		"logs": [
+			{"name": "2023", "log_url": "https://oak.ct.letsencrypt.org/2023"},
+			{"name": "2024h1", "log_url": "https://oak.ct.letsencrypt.org/2024h1", "full_request_timeout": "10s", "mode": "cache-only", "backend_max_concurrent": 2},
+			{"name": "2024h1", "log_url": "https://oak.ct.letsencrypt.org/2024h2", "s3_prefix": "{log_host}/2024h1/"},
+			{"name": "bad/name", "log_url": "https://oak.ct.letsencrypt.org/2025h1", "tile_size": -1}
+		]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err = fs.Parse([]string{"-config", configFile, "-tile-size", "256", "-s3-bucket", "b", "-s3-prefix", "{log_host}/{log_path}/", "-backend-rate-limit", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.resolveLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.logs) != 4 {
+		t.Fatalf("expected 4 logs, got %d", len(cfg.logs))
+	}
+	second := cfg.logs[1]
+	if second.TileSize != 256 || second.S3Bucket != "b" || second.FullRequestTimeout.Duration != 10*time.Second || second.Mode != "cache-only" {
+		t.Errorf("expected log to inherit unset fields from flags and keep its own, got %s", &second)
+	}
+	if second.BackendMaxConcurrent != 2 || second.BackendRateLimit != 5 || cfg.logs[0].BackendMaxConcurrent != 0 {
+		t.Errorf("expected per-log backend limits to override flags, got %s", &second)
+	}
+	if cfg.maxFullRequestTimeout() != 10*time.Second {
+		t.Errorf("expected max full request timeout of 10s, got %s", cfg.maxFullRequestTimeout())
+	}
+
+	err = cfg.validate()
+	if err == nil {
+		t.Fatal("expected errors, got none")
+	}
+	for _, expected := range []string{
+		`log name "2024h1" is used more than once`,
+		`logs "2024h1" and "2024h1" use the same s3 bucket and prefix`,
+		`log name "bad/name" must be`,
+		`log "bad/name": -tile-size must be positive`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %q, got:\n%s", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), `log "2023"`) {
+		t.Errorf("expected no errors for the valid log, got:\n%s", err)
+	}
+}
+
+func TestFileConfigResolve(t *testing.T) {
+	file := fileConfig{
+		Defaults: logConfig{S3Bucket: "base-bucket", TileSize: 256},
+		Logs: []logConfig{
+			{Name: "2023", LogURL: "https://oak.ct.letsencrypt.org/2023", S3Prefix: "oak/2023/"},
+			{Name: "2024", LogURL: "https://oak.ct.letsencrypt.org/2024", BackendMaxConcurrent: 10},
+		},
+		Profiles: map[string]profileConfig{
+			"staging": {
+				Defaults: logConfig{S3Bucket: "staging-bucket"},
+				Logs: map[string]logConfig{
+					"2024": {BackendMaxConcurrent: 2},
+				},
+			},
+			"typo": {
+				Logs: map[string]logConfig{"2025": {}},
+			},
+		},
+	}
+	flags := logConfig{Mode: "normal", S3Bucket: "flag-bucket"}
+
+	logs, err := file.resolve("", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs[0].S3Bucket != "base-bucket" || logs[0].Mode != "normal" || logs[1].BackendMaxConcurrent != 10 {
+		t.Errorf("unexpected logs without a profile: %s; %s", &logs[0], &logs[1])
+	}
+
+	logs, err = file.resolve("staging", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs[0].S3Bucket != "staging-bucket" || logs[0].S3Prefix != "oak/2023/" || logs[0].TileSize != 256 {
+		t.Errorf("expected the profile's defaults to override the base defaults only, got %s", &logs[0])
+	}
+	if logs[1].Name != "2024" || logs[1].BackendMaxConcurrent != 2 || logs[1].LogURL != "https://oak.ct.letsencrypt.org/2024" {
+		t.Errorf("expected the profile's log settings to override the base log, got %s", &logs[1])
+	}
+
+	_, err = file.resolve("prod", flags)
+	if err == nil {
+		t.Error("expected error for an undefined profile, got none")
+	}
+	_, err = file.resolve("typo", flags)
+	if err == nil {
+		t.Error("expected error for a profile overriding an undefined log, got none")
+	}
+}
+
+func TestServeConfigFileOverridesWithZero(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(configFile, []byte(`{
+		"defaults": {"strict_validation": false},
+		"logs": [
+			{"name": "on", "log_url": "https://oak.ct.letsencrypt.org/2023"},
+			{"name": "off", "log_url": "https://oak.ct.letsencrypt.org/2024", "s3_tile_index": false, "backend_rate_limit": 0, "tail_cache_ttl": "0s", "memory_cache_bytes": 0}
+		],
+		"profiles": {
+			"prod": {"logs": {"on": {"export": false}}}
+		}
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err = fs.Parse([]string{"-config", configFile, "-profile", "prod", "-tile-size", "256", "-s3-bucket", "b",
+		"-s3-tile-index", "-backend-rate-limit", "5", "-tail-cache-ttl", "2s", "-memory-cache-bytes", "1048576", "-strict-validation", "-export"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.resolveLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	on, off := cfg.logs[0], cfg.logs[1]
+	if !on.S3TileIndex || on.BackendRateLimit != 5 || on.TailCacheTTL.Duration != 2*time.Second || on.MemoryCacheBytes != 1<<20 {
+		t.Errorf("expected a log that doesn't set them to inherit flags, got %s", &on)
+	}
+	if off.S3TileIndex || off.BackendRateLimit != 0 || off.TailCacheTTL.Duration != 0 || off.MemoryCacheBytes != 0 {
+		t.Errorf("expected a log set to false or zero to override flags, got %s", &off)
+	}
+	if on.StrictValidation || off.StrictValidation {
+		t.Errorf("expected defaults set to false to override flags")
+	}
+	if on.Export || !off.Export {
+		t.Errorf("expected a profile's log set to false to override flags, and only for that log")
+	}
+
+	err = os.WriteFile(configFile, []byte(`{"logs": [{"name": "typo", "tile_sise": 256}]}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfigFile(configFile)
+	if err == nil || !strings.Contains(err.Error(), "tile_sise") {
+		t.Errorf("expected an error for an unknown field in a log, got %v", err)
+	}
+}
+
+// TestEveryLogFlagIsPerLog checks that each flag configuring a log can be set
+// in -config under the same name, with underscores, and that a log leaving it
+// out inherits the flag while a log setting it to zero keeps zero.
+func TestEveryLogFlagIsPerLog(t *testing.T) {
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+
+	defaults := reflect.ValueOf(&cfg.defaults).Elem()
+	fieldAt := make(map[uintptr]int)
+	for i := 0; i < defaults.NumField(); i++ {
+		if defaults.Type().Field(i).IsExported() {
+			fieldAt[defaults.Field(i).Addr().Pointer()] = i
+		}
+	}
+
+	// Set each flag that configures a log to something other than zero, and
+	// the corresponding field of a log to zero.
+	perLog := make(map[string]int)
+	zero := map[string]any{"name": "zero"}
+	fs.VisitAll(func(f *flag.Flag) {
+		i, ok := fieldAt[reflect.ValueOf(f.Value).Pointer()]
+		if !ok {
+			return
+		}
+		field := defaults.Type().Field(i)
+		name := strings.ReplaceAll(f.Name, "-", "_")
+		if tag := field.Tag.Get("json"); tag != name {
+			t.Errorf("-%s sets %s, which is %q in -config rather than %q", f.Name, field.Name, tag, name)
+			return
+		}
+		perLog[name] = i
+
+		var value string
+		switch defaults.Field(i).Addr().Interface().(type) {
+		case *bool:
+			value, zero[name] = "true", false
+		case *int, *int64, *float64:
+			value, zero[name] = "3", 0
+		case *string:
+			value, zero[name] = "x", ""
+		case *duration:
+			value, zero[name] = "3s", "0s"
+		case *shardMap:
+			value, zero[name] = "300=b/p/", []any{}
+		case *featureRollouts:
+			value, zero[name] = "readahead=10", map[string]any{}
+		default:
+			t.Fatalf("no test value for -%s of type %s", f.Name, field.Type)
+		}
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			t.Fatalf("setting -%s: %s", f.Name, err)
+		}
+	})
+	for i := 0; i < defaults.NumField(); i++ {
+		name := defaults.Type().Field(i).Tag.Get("json")
+		if _, ok := perLog[name]; !ok && name != "" && name != "name" {
+			t.Errorf("%q in -config has no flag of the same name", name)
+		}
+	}
+
+	contents, err := json.Marshal(map[string]any{"logs": []any{map[string]any{"name": "inherit"}, zero}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(configFile, contents, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := loadConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := file.resolve("", cfg.defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherited, zeroed := reflect.ValueOf(logs[0]), reflect.ValueOf(logs[1])
+	for name, i := range perLog {
+		if !reflect.DeepEqual(inherited.Field(i).Interface(), defaults.Field(i).Interface()) {
+			t.Errorf("expected a log without %q to inherit %v from its flag, got %v", name, defaults.Field(i), inherited.Field(i))
+		}
+		if v := zeroed.Field(i); !v.IsZero() && !((v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0) {
+			t.Errorf("expected a log setting %q to zero to keep it, got %v", name, v)
+		}
+	}
+}
+
+func TestParseCollapseKey(t *testing.T) {
+	key, err := parseCollapseKey("log_host,tile_size,s3_location")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != (ctile.CollapseKey{}) {
+		t.Errorf("expected the default -collapse-key to be the zero CollapseKey, got %+v", key)
+	}
+
+	key, err = parseCollapseKey("log_host,tile_size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != (ctile.CollapseKey{ExcludeS3Location: true}) {
+		t.Errorf("unexpected CollapseKey %+v", key)
+	}
+
+	key, err = parseCollapseKey("tile_size, s3_location")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != (ctile.CollapseKey{ExcludeLogHost: true}) {
+		t.Errorf("unexpected CollapseKey %+v", key)
+	}
+
+	_, err = parseCollapseKey("log_host,bogus")
+	if err == nil {
+		t.Error("expected error for unknown part, got none")
+	}
+}
+
+func TestCheckLogURL(t *testing.T) {
+	for _, good := range []string{"https://oak.ct.letsencrypt.org/2023", "http://127.0.0.1:1234"} {
+		if err := checkLogURL(good); err != nil {
+			t.Errorf("%q: expected success, got %s", good, err)
+		}
+	}
+	for _, bad := range []string{"oak.ct.letsencrypt.org/2023", "ftp://example.com", "https://example.com/2023/ct/v1/", "https://example.com/?a=b"} {
+		if err := checkLogURL(bad); err == nil {
+			t.Errorf("%q: expected error, got none", bad)
+		}
+	}
+}
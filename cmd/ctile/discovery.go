@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// peerDiscovery finds the URLs of the instances in a cluster.
+type peerDiscovery interface {
+	peers(ctx context.Context) ([]string, error)
+}
+
+// parsePeerDiscovery parses -cluster-peers, which is one of:
+//
+//   - a comma-separated list of URLs, which never changes
+//   - dns+srv://<name>, for the targets and ports of the SRV records of name
+//   - dns://<host>:<port>, for the addresses of host, e.g. a Kubernetes
+//     headless service, at port
+//
+// Peers found in DNS are reached over plain HTTP.
+func parsePeerDiscovery(s string) (peerDiscovery, error) {
+	if name, ok := strings.CutPrefix(s, "dns+srv://"); ok {
+		if name == "" {
+			return nil, errors.New("dns+srv:// requires a name to look up")
+		}
+		return srvPeers{name: name, lookupSRV: net.DefaultResolver.LookupSRV}, nil
+	}
+	if hostPort, ok := strings.CutPrefix(s, "dns://"); ok {
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("dns:// requires a host and port: %w", err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		return dnsPeers{host: host, port: port, lookupHost: net.DefaultResolver.LookupHost}, nil
+	}
+
+	var peers staticPeers
+	for _, u := range strings.Split(s, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if err := checkLogURL(u); err != nil {
+			return nil, fmt.Errorf("invalid cluster URL %q: %w", u, err)
+		}
+		peers = append(peers, u)
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("no cluster peers listed")
+	}
+	return peers, nil
+}
+
+// staticPeers is a fixed list of peer URLs.
+type staticPeers []string
+
+func (s staticPeers) peers(context.Context) ([]string, error) {
+	return s, nil
+}
+
+// srvPeers looks up peers in DNS SRV records.
+type srvPeers struct {
+	name      string
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+func (s srvPeers) peers(ctx context.Context) ([]string, error) {
+	_, records, err := s.lookupSRV(ctx, "", "", s.name)
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		peers = append(peers, (&url.URL{Scheme: "http", Host: net.JoinHostPort(host, strconv.Itoa(int(r.Port)))}).String())
+	}
+	return peers, nil
+}
+
+// dnsPeers looks up peers in DNS address records, all listening on the same
+// port.
+type dnsPeers struct {
+	host       string
+	port       string
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+func (d dnsPeers) peers(ctx context.Context) ([]string, error) {
+	addrs, err := d.lookupHost(ctx, d.host)
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	for _, addr := range addrs {
+		peers = append(peers, (&url.URL{Scheme: "http", Host: net.JoinHostPort(addr, d.port)}).String())
+	}
+	return peers, nil
+}
+
+// peerWatcher keeps a ring's peers up to date with discovery.
+type peerWatcher struct {
+	ring      *ctile.Ring
+	discovery peerDiscovery
+
+	peersMetric   prometheus.Gauge
+	changesMetric prometheus.Counter
+	errorsMetric  prometheus.Counter
+}
+
+func newPeerWatcher(ring *ctile.Ring, discovery peerDiscovery, registerer prometheus.Registerer) *peerWatcher {
+	w := &peerWatcher{
+		ring:      ring,
+		discovery: discovery,
+		peersMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ctile_cluster_peers",
+			Help: "number of instances in the cluster, including this one",
+		}),
+		changesMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ctile_cluster_membership_changes",
+			Help: "number of times peer discovery changed the instances in the cluster",
+		}),
+		errorsMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ctile_cluster_discovery_errors",
+			Help: "number of failed attempts to discover the instances in the cluster",
+		}),
+	}
+	registerer.MustRegister(w.peersMetric, w.changesMetric, w.errorsMetric)
+	w.peersMetric.Set(float64(len(ring.Peers())))
+	return w
+}
+
+// refresh discovers the peers and puts them into the ring. If discovery
+// fails or finds no peers, which is more likely a DNS problem than an empty
+// cluster, the ring keeps its peers.
+func (w *peerWatcher) refresh(ctx context.Context) error {
+	peers, err := w.discovery.peers(ctx)
+	if err == nil && len(peers) == 0 {
+		err = errors.New("no peers found")
+	}
+	if err != nil {
+		w.errorsMetric.Inc()
+		return fmt.Errorf("discovering cluster peers: %w", err)
+	}
+
+	before := w.ring.Peers()
+	err = w.ring.SetPeers(peers)
+	if err != nil {
+		w.errorsMetric.Inc()
+		return fmt.Errorf("discovering cluster peers: %w", err)
+	}
+	after := w.ring.Peers()
+	w.peersMetric.Set(float64(len(after)))
+
+	added, removed := diffPeers(before, after)
+	if len(added) > 0 || len(removed) > 0 {
+		w.changesMetric.Inc()
+		log.Printf("cluster membership changed: added %q, removed %q; %d instances\n", added, removed, len(after))
+	}
+	return nil
+}
+
+// watch refreshes the peers every interval.
+func (w *peerWatcher) watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := w.refresh(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("warning: %s\n", err)
+			}
+		}
+	}()
+}
+
+// diffPeers returns the peers in after but not before, and in before but not
+// after, each sorted.
+func diffPeers(before, after []string) (added, removed []string) {
+	inBefore := make(map[string]bool)
+	for _, p := range before {
+		inBefore[p] = true
+	}
+	inAfter := make(map[string]bool)
+	for _, p := range after {
+		inAfter[p] = true
+		if !inBefore[p] {
+			added = append(added, p)
+		}
+	}
+	for _, p := range before {
+		if !inAfter[p] {
+			removed = append(removed, p)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
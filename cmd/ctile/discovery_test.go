@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile"
+)
+
+func TestParsePeerDiscovery(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"http://10.0.0.1:7962, http://10.0.0.2:7962", ""},
+		{"dns+srv://_ctile._tcp.example.com", ""},
+		{"dns://ctile.default.svc.cluster.local:7962", ""},
+		{"dns://ctile.default.svc.cluster.local", "requires a host and port"},
+		{"dns+srv://", "requires a name"},
+		{"10.0.0.1:7962", "invalid cluster URL"},
+		{",", "no cluster peers"},
+	}
+	for _, tc := range testCases {
+		_, err := parsePeerDiscovery(tc.input)
+		if tc.expected == "" && err != nil {
+			t.Errorf("%q: expected no error, got %s", tc.input, err)
+		}
+		if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+			t.Errorf("%q: expected error mentioning %q, got %v", tc.input, tc.expected, err)
+		}
+	}
+}
+
+func TestPeerWatcher(t *testing.T) {
+	var records []*net.SRV
+	var lookupErr error
+	discovery := srvPeers{
+		name: "_ctile._tcp.example.com",
+		lookupSRV: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			return "", records, lookupErr
+		},
+	}
+	ring, err := ctile.NewRing("http://10.0.0.1:7962", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := newPeerWatcher(ring, discovery, prometheus.NewRegistry())
+
+	records = []*net.SRV{{Target: "10.0.0.1.", Port: 7962}, {Target: "10.0.0.2.", Port: 7962}}
+	err = watcher.refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := ring.Peers()
+	if len(peers) != 2 || peers[1] != "http://10.0.0.2:7962" {
+		t.Errorf("expected peers from SRV records, got %q", peers)
+	}
+
+	lookupErr = errors.New("SERVFAIL")
+	if watcher.refresh(context.Background()) == nil {
+		t.Error("expected error from a failed lookup, got none")
+	}
+	lookupErr = nil
+	records = nil
+	if watcher.refresh(context.Background()) == nil {
+		t.Error("expected error when no peers are found, got none")
+	}
+	if len(ring.Peers()) != 2 {
+		t.Errorf("expected failed discovery to keep the peers, got %q", ring.Peers())
+	}
+
+	added, removed := diffPeers([]string{"a", "b"}, []string{"b", "c"})
+	if len(added) != 1 || added[0] != "c" || len(removed) != 1 || removed[0] != "a" {
+		t.Errorf("expected c added and a removed, got %q and %q", added, removed)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// responseEncoders are the content codings responses are compressed with
+// besides gzip, in order of preference. Each is a feature, off until it's
+// rolled out with -features, e.g. zstd=100.
+var responseEncoders = []ctile.Encoder{
+	pooledEncoder("zstd", func() resettableWriter {
+		// Errors are only returned for invalid options.
+		zw, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return zw
+	}),
+	pooledEncoder("br", func() resettableWriter {
+		return brotli.NewWriterLevel(nil, brotli.BestSpeed)
+	}),
+}
+
+// resettableWriter is a ctile.EncoderWriter that can be reused to compress
+// into another writer.
+type resettableWriter interface {
+	ctile.EncoderWriter
+	Reset(w io.Writer)
+}
+
+// pooledEncoder returns the ctile.Encoder named name, whose writers, made by
+// newWriter, are kept in a pool, since they're costly to set up.
+func pooledEncoder(name string, newWriter func() resettableWriter) ctile.Encoder {
+	var writers sync.Pool
+	return ctile.Encoder{
+		Name: name,
+		NewWriter: func(w io.Writer) ctile.EncoderWriter {
+			zw, ok := writers.Get().(resettableWriter)
+			if !ok {
+				zw = newWriter()
+			}
+			zw.Reset(w)
+			return pooledWriter{zw, &writers}
+		},
+	}
+}
+
+// pooledWriter returns its resettableWriter to the pool when it's closed.
+type pooledWriter struct {
+	resettableWriter
+	pool *sync.Pool
+}
+
+func (w pooledWriter) Close() error {
+	err := w.resettableWriter.Close()
+	w.resettableWriter.Reset(nil)
+	w.pool.Put(w.resettableWriter)
+	return err
+}
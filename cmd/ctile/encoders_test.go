@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+)
+
+func TestResponseEncoders(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 4))
+	defer backend.Close()
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err := fs.Parse([]string{"-log-url", backend.URL, "-tile-size", "4", "-s3-bucket", "b", "-features", "zstd=100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.resolveLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestConfigReloader(t, &cfg)
+	features, _ := r.admin.logFeatures("")
+
+	expectEncoding := func(acceptEncoding, expected string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=3", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		r.router.ServeHTTP(w, req)
+		resp := w.Result()
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != expected {
+			t.Fatalf("Accept-Encoding %q: expected Content-Encoding %q, got %q", acceptEncoding, expected, encoding)
+		}
+		var body io.Reader
+		switch expected {
+		case "zstd":
+			zr, err := zstd.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			body = zr
+		case "br":
+			body = brotli.NewReader(resp.Body)
+		case "gzip":
+			body, err = gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		contents, err := io.ReadAll(body)
+		if err != nil || !strings.HasPrefix(string(contents), `{"entries":`) {
+			t.Errorf("Accept-Encoding %q: expected get-entries JSON, got %q (%v)", acceptEncoding, contents, err)
+		}
+	}
+
+	// zstd is rolled out, and preferred; br isn't, so it isn't offered.
+	expectEncoding("gzip, br, zstd", "zstd")
+	expectEncoding("br, gzip", "gzip")
+
+	err = features.Set("br", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEncoding("br, gzip", "br")
+	expectEncoding("br;q=0.5, gzip", "gzip")
+
+	err = features.Set("zstd", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEncoding("gzip, br, zstd", "br")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// loadEncryption reads the keys tiles are encrypted with from
+// -s3-encryption-key-file, or from -s3-encryption-kms-key-file, decrypting
+// them with KMS, into c.encryption. On error, c.encryption is unchanged.
+func (c *serveConfig) loadEncryption(ctx context.Context) error {
+	var keys [][]byte
+	switch {
+	case c.encryptionKeyFile != "":
+		lines, err := secretValue("", c.encryptionKeyFile)
+		if err != nil {
+			return fmt.Errorf("-s3-encryption-key-file: %w", err)
+		}
+		for i, line := range strings.Fields(lines) {
+			key, err := hex.DecodeString(line)
+			if err != nil || len(key) != 32 {
+				return fmt.Errorf("-s3-encryption-key-file: key %d isn't 32 bytes in hex", i+1)
+			}
+			keys = append(keys, key)
+		}
+	case c.encryptionKMSKeyFile != "":
+		blobs, err := secretValue("", c.encryptionKMSKeyFile)
+		if err != nil {
+			return fmt.Errorf("-s3-encryption-kms-key-file: %w", err)
+		}
+		awsConfig, err := loadAWSConfig(ctx, c.storage)
+		if err != nil {
+			return fmt.Errorf("-s3-encryption-kms-key-file: %w", err)
+		}
+		for i, line := range strings.Fields(blobs) {
+			blob, err := base64.StdEncoding.DecodeString(line)
+			if err != nil {
+				return fmt.Errorf("-s3-encryption-kms-key-file: key %d isn't base64: %w", i+1, err)
+			}
+			key, err := kmsDecrypt(ctx, awsConfig, fmt.Sprintf("https://kms.%s.amazonaws.com/", awsConfig.Region), blob)
+			if err != nil {
+				return fmt.Errorf("-s3-encryption-kms-key-file: key %d: %w", i+1, err)
+			}
+			if len(key) != 32 {
+				return fmt.Errorf("-s3-encryption-kms-key-file: key %d is %d bytes, not 32", i+1, len(key))
+			}
+			keys = append(keys, key)
+		}
+	}
+	c.encryption.Keys = keys
+	return nil
+}
+
+// kmsDecrypt decrypts blob, a data key encrypted with AWS KMS, with the KMS
+// Decrypt API at endpoint. It's called directly, rather than with the SDK's
+// KMS client, since it's the only KMS API used, at startup and on SIGHUP.
+func kmsDecrypt(ctx context.Context, cfg aws.Config, endpoint string, blob []byte) ([]byte, error) {
+	// []byte is marshaled in base64, as KMS expects blobs.
+	body, err := json.Marshal(struct{ CiphertextBlob []byte }{blob})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving AWS credentials: %w", err)
+	}
+	sum := sha256.Sum256(body)
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "kms", cfg.Region, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("signing KMS request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("KMS Decrypt: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("KMS Decrypt: reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS Decrypt: %s: %s", resp.Status, respBody)
+	}
+	var out struct{ Plaintext []byte }
+	err = json.Unmarshal(respBody, &out)
+	if err != nil {
+		return nil, fmt.Errorf("KMS Decrypt: parsing response: %w", err)
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestLoadEncryption(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	err := os.WriteFile(keyFile, []byte(strings.Repeat("aa", 32)+"\n"+strings.Repeat("bb", 32)+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := serveConfig{encryptionKeyFile: keyFile}
+	err = cfg.loadEncryption(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.encryption.Keys) != 2 || !bytes.Equal(cfg.encryption.Keys[0], bytes.Repeat([]byte{0xaa}, 32)) {
+		t.Errorf("expected keys 0xaa... and 0xbb..., got %x", cfg.encryption.Keys)
+	}
+
+	err = os.WriteFile(keyFile, []byte("aabb\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.loadEncryption(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "key 1 isn't 32 bytes in hex") {
+		t.Errorf("expected an error about a short key, got %v", err)
+	}
+}
+
+func TestKMSDecrypt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "TrentService.Decrypt" {
+			t.Errorf("expected X-Amz-Target TrentService.Decrypt, got %q", target)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/us-east-1/kms/aws4_request") {
+			t.Errorf("expected a SigV4 signature for KMS, got %q", auth)
+		}
+		var in struct{ CiphertextBlob []byte }
+		err := json.NewDecoder(r.Body).Decode(&in)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(in.CiphertextBlob) != "wrapped" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidCiphertextException"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(struct{ Plaintext []byte }{[]byte("plaintext")})
+	}))
+	defer server.Close()
+
+	cfg := aws.Config{Region: "us-east-1", Credentials: credentials.NewStaticCredentialsProvider("id", "secret", "")}
+	key, err := kmsDecrypt(context.Background(), cfg, server.URL, []byte("wrapped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "plaintext" {
+		t.Errorf("expected %q, got %q", "plaintext", key)
+	}
+
+	_, err = kmsDecrypt(context.Background(), cfg, server.URL, []byte("bogus"))
+	if err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Errorf("expected KMS's error, got %v", err)
+	}
+}
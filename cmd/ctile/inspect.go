@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// runInspect implements the `ctile inspect` subcommand, which downloads a
+// single cached tile, decodes it, and prints a summary of its contents. It's
+// meant for debugging "internal inconsistency" reports.
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	s3bucket := fs.String("s3-bucket", "", "s3 bucket containing the cache")
+	s3prefix := fs.String("s3-prefix", "", "prefix for s3 keys, as used by the server")
+	tileSize := fs.Int64("tile-size", 0, "tile size of the tile to inspect. needed with -index, and to recognize -key with -s3-key-template or -s3-super-tiles")
+	index := fs.Int64("index", -1, "inspect the tile containing this log index")
+	key := fs.String("key", "", "full s3 key of the tile to inspect, instead of -s3-prefix, -tile-size and -index")
+	printJSON := fs.Bool("json", false, "print the full tile contents as get-entries JSON instead of a summary")
+	var awsOpts storageFlags
+	awsOpts.registerFlags(fs)
+	var keyOpts keyFlags
+	keyOpts.registerFlags(fs)
+	fs.Parse(args)
+
+	if *s3bucket == "" {
+		log.Fatal("missing required flag: -s3-bucket")
+	}
+	if *key == "" && (*s3prefix == "" || *tileSize <= 0 || *index < 0) {
+		log.Fatal("either -key, or all of -s3-prefix, -tile-size and -index, must be provided")
+	}
+	if *tileSize < 0 {
+		log.Fatal("-tile-size must not be negative")
+	}
+	keys, err := keyOpts.tileKeys(*tileSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	svc, err := newStorageService(ctx, awsOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tiles ctile.TileObject
+	var contents *ctile.Entries
+	if *key == "" {
+		tiles, contents, err = findTile(ctx, svc, *s3bucket, *s3prefix, keys, *index)
+		*key = *s3prefix + tiles.Key
+	} else {
+		tiles = parseFullKey(keys, *key)
+		contents, err = ctile.GetTileObject(ctx, svc, *s3bucket, *key)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *printJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(contents)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// The key's own idea of where the tile starts lets us print absolute
+	// indices. If the key is in an unexpected format, fall back to offsets.
+	// A partial tile has fewer entries than the key says.
+	size := tiles.End - tiles.Start
+	if tiles.Partial {
+		size = 0
+	}
+	printTileSummary(os.Stdout, *key, size, tiles.Start, contents)
+}
+
+// findTile reads the object holding the tile containing index under prefix
+// in bucket, trying each of the keys a server looks for it at in turn, and
+// returns it along with its contents.
+func findTile(ctx context.Context, svc ctile.S3API, bucket, prefix string, keys *ctile.TileKeys, index int64) (ctile.TileObject, *ctile.Entries, error) {
+	lookup := keys.Lookup(index)
+	for _, tiles := range lookup {
+		contents, err := ctile.GetTileObject(ctx, svc, bucket, prefix+tiles.Key)
+		if errors.Is(err, ctile.ErrNoSuchKey) {
+			continue
+		}
+		return tiles, contents, err
+	}
+	var tried []string
+	for _, tiles := range lookup {
+		tried = append(tried, prefix+tiles.Key)
+	}
+	return ctile.TileObject{}, nil, fmt.Errorf("no tile containing index %d in bucket %q; looked for %s", index, bucket, strings.Join(tried, ", "))
+}
+
+// parseFullKey returns the object at key, which includes the unknown prefix,
+// if keys recognizes what follows the shortest possible prefix. Otherwise, it
+// returns the zero TileObject.
+func parseFullKey(keys *ctile.TileKeys, key string) ctile.TileObject {
+	for i := 0; i < len(key); i++ {
+		tiles, ok := keys.Parse(key[i:])
+		if ok {
+			return tiles
+		}
+	}
+	return ctile.TileObject{}
+}
+
+// printTileSummary writes a human-readable description of a tile to w: one
+// line per entry with its index, field sizes, and leaf timestamp, followed by
+// totals. If the tile size isn't known, size should be 0.
+func printTileSummary(w io.Writer, key string, size, start int64, contents *ctile.Entries) {
+	var leafBytes, extraBytes int
+	var minTime, maxTime time.Time
+	var badLeaves int
+	fmt.Fprintf(w, "%-12s %10s %10s  %s\n", "index", "leaf_input", "extra_data", "timestamp")
+	for i, e := range contents.Entries {
+		leafBytes += len(e.LeafInput)
+		extraBytes += len(e.ExtraData)
+		var timestamp string
+		ts, err := leafTimestamp(e.LeafInput)
+		if err != nil {
+			badLeaves++
+			timestamp = err.Error()
+		} else {
+			timestamp = ts.Format(time.RFC3339Nano)
+			if minTime.IsZero() || ts.Before(minTime) {
+				minTime = ts
+			}
+			if ts.After(maxTime) {
+				maxTime = ts
+			}
+		}
+		fmt.Fprintf(w, "%-12d %10d %10d  %s\n", start+int64(i), len(e.LeafInput), len(e.ExtraData), timestamp)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "key:              %s\n", key)
+	fmt.Fprintf(w, "entries:          %d\n", len(contents.Entries))
+	if size != 0 && int64(len(contents.Entries)) != size {
+		fmt.Fprintf(w, "WARNING:          expected %d entries based on the key\n", size)
+	}
+	fmt.Fprintf(w, "leaf_input bytes: %d\n", leafBytes)
+	fmt.Fprintf(w, "extra_data bytes: %d\n", extraBytes)
+	if !minTime.IsZero() {
+		fmt.Fprintf(w, "earliest leaf:    %s\n", minTime.Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "latest leaf:      %s\n", maxTime.Format(time.RFC3339Nano))
+	}
+	if badLeaves > 0 {
+		fmt.Fprintf(w, "unparseable:      %d leaves\n", badLeaves)
+	}
+}
+
+// leafTimestamp parses the timestamp out of a MerkleTreeLeaf.
+// https://datatracker.ietf.org/doc/html/rfc6962#section-3.4
+func leafTimestamp(leafInput []byte) (time.Time, error) {
+	// version (1 byte), leaf_type (1 byte), then a TimestampedEntry starting
+	// with an 8-byte timestamp in milliseconds.
+	if len(leafInput) < 10 {
+		return time.Time{}, errors.New("leaf_input too short")
+	}
+	if leafInput[0] != 0 {
+		return time.Time{}, fmt.Errorf("unknown leaf version %d", leafInput[0])
+	}
+	if leafInput[1] != 0 {
+		return time.Time{}, fmt.Errorf("unknown leaf type %d", leafInput[1])
+	}
+	ms := binary.BigEndian.Uint64(leafInput[2:10])
+	return time.UnixMilli(int64(ms)).UTC(), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestLeafTimestamp(t *testing.T) {
+	leaf := make([]byte, 12)
+	binary.BigEndian.PutUint64(leaf[2:], 1700000000123)
+	ts, err := leafTimestamp(leaf)
+	if err != nil {
+		t.Fatalf("expected success, got %s", err)
+	}
+	expected := time.UnixMilli(1700000000123).UTC()
+	if !ts.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, ts)
+	}
+
+	_, err = leafTimestamp(leaf[:9])
+	if err == nil {
+		t.Error("expected error for short leaf, got none")
+	}
+
+	leaf[0] = 1
+	_, err = leafTimestamp(leaf)
+	if err == nil {
+		t.Error("expected error for unknown version, got none")
+	}
+}
+
+func TestPrintTileSummary(t *testing.T) {
+	leaf := make([]byte, 12)
+	binary.BigEndian.PutUint64(leaf[2:], 1700000000123)
+	contents := &ctile.Entries{
+		Entries: []ctile.Entry{
+			{LeafInput: leaf, ExtraData: []byte("abc")},
+			{LeafInput: []byte("x"), ExtraData: []byte("abcd")},
+		},
+	}
+
+	var buf bytes.Buffer
+	printTileSummary(&buf, "test/tile_size=3/6.cbor.gz", 3, 6, contents)
+	out := buf.String()
+	for _, expected := range []string{
+		"entries:          2",
+		"expected 3 entries",
+		"leaf_input bytes: 13",
+		"extra_data bytes: 7",
+		"unparseable:      1 leaves",
+		"2023-11-14T22:13:20.123Z",
+		"\n7 ",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+// TestFindTile checks that inspect finds tiles in each layout the server
+// writes them in, by -index or by -key.
+func TestFindTile(t *testing.T) {
+	testCases := []struct {
+		name  string
+		keys  keyFlags
+		key   string
+		start int64
+		end   int64
+	}{
+		{"flat", keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate}, "tile_size=2/4.cbor.gz", 4, 6},
+		{"hashed", keyFlags{layout: "hashed", template: ctile.DefaultKeyTemplate}, "4b22/tile_size=2/4.cbor.gz", 4, 6},
+		{"hashed, not yet migrated", keyFlags{layout: "hashed", template: ctile.DefaultKeyTemplate}, "tile_size=2/4.cbor.gz", 4, 6},
+		{"template", keyFlags{logURL: "https://log.example/", layout: "flat", template: "{log_host}/{tile_index}.bin"}, "log.example/2.bin", 4, 6},
+		{"super-tiles", keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate, superTiles: 4}, "tile_size=2/x4/0.cbor.gz", 0, 8},
+		{"partial", keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate}, "tile_size=2/4.cbor.gz.partial", 4, 6},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc := s3mem.New()
+			contents := &ctile.Entries{Entries: []ctile.Entry{{LeafInput: []byte("leaf")}}}
+			err := ctile.PutTileObject(ctx, svc, "bucket", "p/"+tc.key, contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := tc.keys.tileKeys(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tiles, found, err := findTile(ctx, svc, "bucket", "p/", keys, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tiles.Key != tc.key || tiles.Start != tc.start || tiles.End != tc.end || len(found.Entries) != 1 {
+				t.Errorf("expected %q [%d, %d), got %+v with %d entries", tc.key, tc.start, tc.end, tiles, len(found.Entries))
+			}
+			if parsed := parseFullKey(keys, "p/"+tc.key); parsed != tiles {
+				t.Errorf("parseFullKey: expected %+v, got %+v", tiles, parsed)
+			}
+
+			_, _, err = findTile(ctx, svc, "bucket", "p/", keys, 9)
+			if err == nil || !strings.Contains(err.Error(), "no tile containing index 9") {
+				t.Errorf("expected an error for a missing tile, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// priority is a syslog message priority, as also used by journald.
+type priority int
+
+const (
+	priorityErr     priority = 3
+	priorityWarning priority = 4
+	priorityInfo    priority = 6
+)
+
+// messagePriority picks a priority for a log message. ctile logs with the
+// standard logger, which has no levels, so by convention messages starting
+// with "error" or "warning:" get those priorities, and everything else is
+// informational.
+func messagePriority(msg string) priority {
+	switch {
+	case strings.HasPrefix(msg, "error"):
+		return priorityErr
+	case strings.HasPrefix(msg, "warning:"):
+		return priorityWarning
+	default:
+		return priorityInfo
+	}
+}
+
+// priorityWriter is an io.Writer for the standard logger that sends each
+// message to a destination that understands priorities. If sending fails, the
+// message is written to stderr instead, so it isn't lost.
+type priorityWriter struct {
+	send func(p priority, msg string) error
+}
+
+func (w priorityWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+	err := w.send(messagePriority(msg), msg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s (failed to send to log output: %s)\n", msg, err)
+	}
+	return len(b), nil
+}
+
+// setLogOutput directs the standard logger to dest, which is one of "stderr",
+// "syslog" or "journald". Syslog and journald add their own timestamps, so
+// the logger's are turned off for them.
+func setLogOutput(dest string) error {
+	switch dest {
+	case "stderr":
+		return nil
+	case "syslog", "journald":
+		send, err := newPrioritySender(dest)
+		if err != nil {
+			return fmt.Errorf("setting -log-output to %s: %w", dest, err)
+		}
+		log.SetOutput(priorityWriter{send: send})
+		log.SetFlags(0)
+		return nil
+	default:
+		return fmt.Errorf("unknown -log-output %q: must be stderr, syslog, or journald", dest)
+	}
+}
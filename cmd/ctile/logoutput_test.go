@@ -0,0 +1,44 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestMessagePriority(t *testing.T) {
+	testCases := []struct {
+		msg      string
+		expected priority
+	}{
+		{"error: reading tile from s3: timeout", priorityErr},
+		{"error copying response body to client: EOF", priorityErr},
+		{"warning: -s3-prefix \"x\" doesn't end in a slash", priorityWarning},
+		{"effective configuration: -mode=normal", priorityInfo},
+	}
+	for _, tc := range testCases {
+		got := messagePriority(tc.msg)
+		if got != tc.expected {
+			t.Errorf("%q: expected priority %d, got %d", tc.msg, tc.expected, got)
+		}
+	}
+}
+
+func TestJournaldEntry(t *testing.T) {
+	got := journaldEntry(priorityWarning, "hello")
+	expected := "PRIORITY=4\nSYSLOG_IDENTIFIER=ctile\nMESSAGE=hello\n"
+	if string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	got = journaldEntry(priorityErr, "two\nlines")
+	var lengthPrefixed bytes.Buffer
+	lengthPrefixed.WriteString("MESSAGE\n")
+	binary.Write(&lengthPrefixed, binary.LittleEndian, uint64(9))
+	lengthPrefixed.WriteString("two\nlines\n")
+	if !bytes.HasSuffix(got, lengthPrefixed.Bytes()) {
+		t.Errorf("expected multi-line message to be length-prefixed, got %q", got)
+	}
+}
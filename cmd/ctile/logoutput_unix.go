@@ -0,0 +1,70 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+// journaldSocket is where journald listens for its native protocol.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// newPrioritySender connects to syslog or journald, and returns a function
+// that sends a message to it with a priority.
+func newPrioritySender(dest string) (func(priority, string) error, error) {
+	switch dest {
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "ctile")
+		if err != nil {
+			return nil, err
+		}
+		return func(p priority, msg string) error {
+			switch p {
+			case priorityErr:
+				return w.Err(msg)
+			case priorityWarning:
+				return w.Warning(msg)
+			default:
+				return w.Info(msg)
+			}
+		}, nil
+	case "journald":
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			return nil, err
+		}
+		return func(p priority, msg string) error {
+			_, err := conn.Write(journaldEntry(p, msg))
+			return err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown destination %q", dest)
+	}
+}
+
+// journaldEntry encodes a message in journald's native protocol. Fields are
+// written as KEY=value lines, except that values containing newlines use the
+// length-prefixed binary form.
+func journaldEntry(p priority, msg string) []byte {
+	var b bytes.Buffer
+	writeField := func(key, value string) {
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(&b, "%s=%s\n", key, value)
+			return
+		}
+		b.WriteString(key)
+		b.WriteByte('\n')
+		binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	writeField("PRIORITY", fmt.Sprint(int(p)))
+	writeField("SYSLOG_IDENTIFIER", "ctile")
+	writeField("MESSAGE", msg)
+	return b.Bytes()
+}
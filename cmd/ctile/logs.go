@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// expandPrefixes expands the templates in the S3 prefixes of l. The shards
+// are copied first, since l may share them with the configuration as loaded.
+func expandPrefixes(l *logConfig) error {
+	var err error
+	l.S3Prefix, err = ctile.ExpandPrefix(l.S3Prefix, l.primaryLogURL(), l.TileSize)
+	if err != nil {
+		return fmt.Errorf("invalid -s3-prefix: %w", err)
+	}
+	if !strings.HasSuffix(l.S3Prefix, "/") {
+		log.Printf("warning: -s3-prefix %q doesn't end in a slash, so keys will look like %q\n", l.S3Prefix, l.S3Prefix+ctile.TileKey(int64(l.TileSize), 0))
+	}
+	l.S3Shards = append(shardMap(nil), l.S3Shards...)
+	for i := range l.S3Shards {
+		l.S3Shards[i].S3Prefix, err = ctile.ExpandPrefix(l.S3Shards[i].S3Prefix, l.primaryLogURL(), l.TileSize)
+		if err != nil {
+			return fmt.Errorf("invalid -s3-shards: %w", err)
+		}
+	}
+	return nil
+}
+
+// logBuilder creates the handlers for served logs. Everything it holds is
+// shared between logs: the S3 clients, the disk and shared caches, request
+// collapsing, so logs with the same backend don't fetch the same tile twice at
+// once, the cluster, and the S3 event notifications. Each log gets its own
+// HTTP connection pool, circuit breaker, and limits, so a problem with one
+// log's backend or traffic doesn't spill over to the others.
+type logBuilder struct {
+	cfg           *serveConfig
+	svc           ctile.S3API
+	secondarySvc  ctile.S3API
+	diskCache     *ctile.DiskCache
+	sharedCache   ctile.SharedCache
+	registry      prometheus.Registerer
+	collapseGroup *ctile.CollapseGroup
+	s3Events      *ctile.S3Events
+	ring          *ctile.Ring
+}
+
+// servedLog is a log's handler, with what's needed to stop serving it.
+type servedLog struct {
+	handler    *ctile.Handler
+	features   *ctile.FeatureFlags
+	registerer *unregisterer
+	transport  *http.Transport
+}
+
+// close stops the log's background work, closes its idle connections, and
+// removes its metrics.
+func (s *servedLog) close() {
+	s.handler.Close()
+	s.transport.CloseIdleConnections()
+	s.registerer.unregisterAll()
+}
+
+// build returns a handler for l, whose prefixes must already be expanded.
+func (b *logBuilder) build(l logConfig) (*servedLog, error) {
+	features, err := ctile.NewFeatureFlags(l.Features)
+	if err != nil {
+		return nil, err
+	}
+	if l.ReadaheadDepth > 0 && l.Features[ctile.FeatureReadahead] == 0 {
+		log.Printf("warning: -readahead-depth is only used once the %q feature is rolled out, with -features or the admin API\n", ctile.FeatureReadahead)
+	}
+	if l.S3HedgeDelay.Duration > 0 && l.Features[ctile.FeatureS3Hedging] == 0 {
+		log.Printf("warning: -s3-hedge-delay is only used once the %q feature is rolled out, with -features or the admin API\n", ctile.FeatureS3Hedging)
+	}
+
+	registerer := b.registry
+	if l.Name != "" {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"log": l.Name}, b.registry)
+	}
+	tracked := &unregisterer{Registerer: registerer}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = l.BackendMaxConnections
+
+	writeQueue := ctile.WriteQueue{
+		Size:     l.S3WriteQueueSize,
+		Workers:  l.S3WriteWorkers,
+		Attempts: l.S3WriteAttempts,
+		Backoff:  l.S3WriteBackoff.Duration,
+	}
+	if l.AsyncS3Writes && writeQueue.Size == 0 {
+		writeQueue.Size = ctile.DefaultWriteQueue.Size
+	}
+
+	var secondary ctile.SecondaryS3
+	if l.S3SecondaryBucket != "" {
+		secondary = ctile.SecondaryS3{Service: b.secondarySvc, Bucket: l.S3SecondaryBucket, DualWrite: l.S3DualWrite}
+	}
+
+	var objectTags map[string]string
+	if l.S3Tagging {
+		objectTags = map[string]string{"ctile-log": l.Name, "ctile-version": version()}
+		if l.Name == "" {
+			objectTags["ctile-log"] = l.primaryLogURL()
+		}
+	}
+
+	logURLs := l.logURLs()
+	opts := []ctile.Option{
+		ctile.WithTileSize(l.TileSize),
+		ctile.WithS3(b.svc, l.S3Bucket, l.S3Prefix),
+		ctile.WithShards(l.S3Shards.shards()),
+		ctile.WithTimeouts(ctile.Timeouts{
+			FullRequest: l.FullRequestTimeout.Duration,
+			Backend:     l.BackendTimeout.Duration,
+			S3Write:     l.S3WriteTimeout.Duration,
+		}),
+		ctile.WithBackendLimits(ctile.BackendLimits{
+			MaxConcurrent:     l.BackendMaxConcurrent,
+			RequestsPerSecond: l.BackendRateLimit,
+			Burst:             l.BackendBurst,
+		}),
+		ctile.WithFailover(ctile.Failover{
+			Replicas:      logURLs[1:],
+			Balance:       l.balance,
+			ProbeInterval: l.BackendProbeInterval.Duration,
+		}),
+		ctile.WithHTTPClient(&http.Client{Transport: transport}),
+		ctile.WithMaxBackendBodySize(l.BackendMaxBodySize),
+		ctile.WithBackendType(l.backendType),
+		ctile.WithStrictValidation(l.StrictValidation),
+		ctile.WithCircuitBreaker(ctile.CircuitBreaker{
+			Failures: l.CircuitBreakerFailures,
+			Cooldown: l.CircuitBreakerCooldown.Duration,
+		}),
+		ctile.WithS3Degradation(ctile.S3Degradation{
+			Failures:      l.S3DegradeAfter,
+			ProbeInterval: l.S3ProbeInterval.Duration,
+		}),
+		ctile.WithMemoryCache(l.MemoryCacheBytes),
+		ctile.WithAsyncWrites(l.AsyncS3Writes),
+		ctile.WithConditionalWrites(l.S3ConditionalWrites),
+		ctile.WithObjectTags(objectTags),
+		ctile.WithSuperTiles(l.S3SuperTiles),
+		ctile.WithKeyLayout(l.keyLayout),
+		ctile.WithKeyTemplate(l.keyTemplate),
+		ctile.WithEncryption(b.cfg.encryption),
+		ctile.WithChainStore(ctile.ChainStore{
+			Bucket:    l.S3ChainBucket,
+			Prefix:    l.S3ChainPrefix,
+			CacheSize: l.S3ChainCacheSize,
+		}),
+		ctile.WithTileFormat(ctile.TileFormat{
+			Serialization: l.serialization,
+			GzipLevel:     l.S3GzipLevel,
+			Uncompressed:  l.S3Uncompressed,
+		}),
+		ctile.WithPrecompressedJSON(l.S3PrecompressedJSON),
+		ctile.WithSecondaryS3(secondary),
+		ctile.WithWriteQueue(writeQueue),
+		ctile.WithDiskCache(b.diskCache),
+		ctile.WithSharedCache(b.sharedCache),
+		ctile.WithMaxConcurrentRequests(l.MaxConcurrentRequests),
+		ctile.WithClientLimits(ctile.ClientLimits{
+			RequestsPerSecond: l.ClientRateLimit,
+			Burst:             l.ClientBurst,
+			Header:            l.ClientHeader,
+		}),
+		ctile.WithPartialTileRetry(ctile.PartialTileRetry{
+			Delay:      l.PartialTileRetryDelay.Duration,
+			MaxMissing: l.PartialTileRetryMaxMissing,
+		}),
+		ctile.WithPartialTileCaching(l.S3CachePartialTiles),
+		ctile.WithTileIndex(l.S3TileIndex),
+		ctile.WithTileIndexPriming(l.S3TileIndexPrime),
+		ctile.WithCoalescedEndpoints(l.coalescedEndpoints()...),
+		ctile.WithNegativeCache(l.NegativeCacheTTL.Duration),
+		ctile.WithTailCache(l.TailCacheTTL.Duration),
+		ctile.WithSTHCache(ctile.STHCache{
+			TTL:      l.STHCacheTTL.Duration,
+			MaxStale: l.STHCacheMaxStale.Duration,
+		}),
+		ctile.WithRootsCache(l.RootsCacheTTL.Duration),
+		ctile.WithCachedEntryAndProof(l.CachedEntryAndProof),
+		ctile.WithMaxRequestTiles(l.MaxRequestTiles),
+		ctile.WithStrictAlignment(l.StrictAlignment),
+		ctile.WithGetEntriesLimit(ctile.GetEntriesLimit{Max: l.MaxGetEntries, Clamp: l.ClampGetEntries}),
+		ctile.WithPrettyJSON(l.PrettyJSON),
+		ctile.WithExport(l.Export),
+		ctile.WithExportRateLimit(l.ExportRateLimit),
+		ctile.WithTailEndpoint(l.TailPollInterval.Duration),
+		ctile.WithReadahead(l.ReadaheadDepth),
+		ctile.WithS3Hedging(l.S3HedgeDelay.Duration),
+		ctile.WithStaticCTAPI(ctile.StaticCTAPI{
+			Origin:    l.StaticCTOrigin,
+			PublicKey: l.staticCTPublicKey,
+		}),
+		ctile.WithMode(l.mode),
+		ctile.WithDryRun(b.cfg.dryRun),
+		ctile.WithCollapseGroup(b.collapseGroup),
+		ctile.WithCollapseKey(b.cfg.collapseKey),
+		ctile.WithFeatureFlags(features),
+		ctile.WithS3Events(b.s3Events),
+		ctile.WithResponseEncoders(responseEncoders...),
+		ctile.WithDebug(b.cfg.adminSecurity.authorizesDebug),
+		ctile.WithRequestSigning(b.cfg.requestSigning),
+		ctile.WithMetrics(tracked),
+	}
+	path := ""
+	if l.Name != "" {
+		path = "/" + l.Name
+	}
+	if b.ring != nil {
+		opts = append(opts, ctile.WithCluster(b.ring, path))
+	}
+	if b.cfg.readThroughPeer != "" {
+		opts = append(opts, ctile.WithReadThroughPeer(b.cfg.readThroughPeer, path))
+	}
+	handler, err := ctile.New(logURLs[0], opts...)
+	if err != nil {
+		tracked.unregisterAll()
+		return nil, err
+	}
+	return &servedLog{handler: handler, features: features, registerer: tracked, transport: transport}, nil
+}
+
+// unregisterer is a prometheus.Registerer that remembers what was registered
+// through it, so a log's metrics can be removed along with the log, and the
+// log added again later.
+type unregisterer struct {
+	prometheus.Registerer
+
+	mu         sync.Mutex
+	collectors []prometheus.Collector
+}
+
+func (u *unregisterer) Register(c prometheus.Collector) error {
+	err := u.Registerer.Register(c)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.collectors = append(u.collectors, c)
+	return nil
+}
+
+func (u *unregisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		err := u.Register(c)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// unregisterAll unregisters everything registered so far.
+func (u *unregisterer) unregisterAll() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, c := range u.collectors {
+		u.Registerer.Unregister(c)
+	}
+	u.collectors = nil
+}
+
+// logRouter serves each log under /<name>/, or a log with an empty name at
+// the root. Logs can be added and removed while serving.
+type logRouter struct {
+	// mu protects logs. Requests are counted in a log's inflight while
+	// holding it, so once a log is removed, no new requests can start.
+	mu   sync.RWMutex
+	logs map[string]*routedLog
+}
+
+type routedLog struct {
+	handler  http.Handler
+	inflight sync.WaitGroup
+}
+
+func newLogRouter() *logRouter {
+	return &logRouter{logs: make(map[string]*routedLog)}
+}
+
+// add starts serving handler as the log with the given name.
+func (r *logRouter) add(name string, handler http.Handler) {
+	if name != "" {
+		handler = http.StripPrefix("/"+name, handler)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs[name] = &routedLog{handler: handler}
+}
+
+// remove stops routing new requests to the named log, and returns it, or nil
+// if there's no such log, so the requests already being served can be waited
+// for with drain.
+func (r *logRouter) remove(name string) *routedLog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.logs[name]
+	delete(r.logs, name)
+	return l
+}
+
+// drain waits for the requests l is serving to finish, for up to timeout. It
+// returns false if some were still being served. It's safe to call on a nil
+// *routedLog.
+func (l *routedLog) drain(timeout time.Duration) bool {
+	if l == nil {
+		return true
+	}
+	drained := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (r *logRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	l, ok := r.logs[""]
+	if !ok {
+		name, _, found := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		if found {
+			l, ok = r.logs[name]
+		}
+	}
+	if ok {
+		l.inflight.Add(1)
+	}
+	r.mu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	defer l.inflight.Done()
+	l.handler.ServeHTTP(w, req)
+}
+
+// version returns ctile's module version, for tagging objects, or "devel" for
+// a build from a working tree.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "devel"
+	}
+	return info.Main.Version
+}
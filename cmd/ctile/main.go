@@ -0,0 +1,428 @@
+// main is the entrypoint for the ctile binary.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/azblob"
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/fsstore"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "purge":
+			runPurge(os.Args[2:])
+			return
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "backfill":
+			runBackfill(os.Args[2:])
+			return
+		case "prefetch":
+			runPrefetch(os.Args[2:])
+			return
+		}
+	}
+
+	var cfg serveConfig
+	cfg.registerFlags(flag.CommandLine)
+	ctile.RegisterFaultFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	// Set up logging first, so configuration problems are reported there.
+	err := setLogOutput(cfg.logOutput)
+	err = errors.Join(err, cfg.resolveLogs())
+	err = errors.Join(err, cfg.validate())
+
+	// Check that the buckets are reachable even if there are other problems,
+	// so they can all be fixed in one go.
+	var svc, secondarySvc ctile.S3API
+	if cfg.usesS3() {
+		var s3Err error
+		svc, s3Err = cfg.newStorage(context.Background())
+		err = errors.Join(err, s3Err)
+		secondarySvc, s3Err = cfg.newSecondaryStorage(context.Background())
+		err = errors.Join(err, s3Err)
+	}
+	sharedCache, cacheErr := cfg.newSharedCache(context.Background())
+	err = errors.Join(err, cacheErr)
+	var sqsService *sqs.Client
+	if cfg.s3EventsQueueURL != "" {
+		var sqsErr error
+		sqsService, sqsErr = newSQSService(context.Background(), cfg.storage)
+		err = errors.Join(err, sqsErr)
+	}
+	err = errors.Join(err, cfg.loadEncryption(context.Background()))
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%s", err)
+	}
+
+	// Keep the logs as configured, before the changes below, so reloads of
+	// the -config file can be compared with them.
+	configuredLogs := append([]logConfig(nil), cfg.logs...)
+
+	if cfg.fakeBackend {
+		cfg.logs[0].LogURL = startFakeBackend(cfg.fakeBackendSize, cfg.fakeBackendMaxGetEntries)
+	}
+	for i := range cfg.logs {
+		l := &cfg.logs[i]
+		if !l.usesS3() {
+			continue
+		}
+		err = expandPrefixes(l)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	logEffectiveConfig(log.Printf, flag.CommandLine, &cfg)
+
+	// A selftest is often run next to a live server, e.g. as an init
+	// container, so it doesn't serve metrics to avoid conflicting ports.
+	var promRegistry prometheus.Registerer = prometheus.NewRegistry()
+	if !cfg.selftest {
+		promRegistry = newStatsRegistry(cfg.metricsAddress, &cfg.metricsSecurity)
+	}
+	cfg.memory.apply(promRegistry)
+
+	var diskCache *ctile.DiskCache
+	if cfg.diskCacheDir != "" {
+		diskCache, err = ctile.NewDiskCache(cfg.diskCacheDir, int64(cfg.diskCacheBytes), promRegistry)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	builder := &logBuilder{
+		cfg:           &cfg,
+		svc:           svc,
+		secondarySvc:  secondarySvc,
+		diskCache:     diskCache,
+		sharedCache:   sharedCache,
+		registry:      promRegistry,
+		collapseGroup: ctile.NewCollapseGroup(),
+	}
+	if sqsService != nil && !cfg.selftest {
+		builder.s3Events = ctile.NewS3Events()
+		newS3EventFollower(sqsService, cfg.s3EventsQueueURL, builder.s3Events, promRegistry).follow()
+	}
+	if cfg.clusterSelf != "" {
+		builder.ring, err = startCluster(cfg.clusterSelf, cfg.clusterDiscovery, cfg.clusterRefreshInterval, promRegistry)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	served := make(map[string]*servedLog, len(cfg.logs))
+	router := newLogRouter()
+	admin := newAdminAPI()
+	for _, l := range cfg.logs {
+		s, err := builder.build(l)
+		if err != nil {
+			log.Fatal(err)
+		}
+		served[l.Name] = s
+		router.add(l.Name, s.handler)
+		admin.addLog(l.Name, s.features)
+	}
+
+	if cfg.selftest {
+		ok := true
+		for i := range cfg.logs {
+			if cfg.logs[i].Name != "" {
+				fmt.Printf("log %q:\n", cfg.logs[i].Name)
+			}
+			ok = selftest(context.Background(), os.Stdout, &cfg.logs[i], cfg.dryRun, svc, cfg.signed(served[cfg.logs[i].Name].handler)) && ok
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	reloaders := []reloader{{"metrics listener credentials", cfg.metricsSecurity.reload}}
+	reloaders = append(reloaders, secretReloaders(&cfg, sharedCache, served)...)
+	if cfg.adminAddress != "" {
+		startOperationalServer("admin", cfg.adminAddress, &cfg.adminSecurity, admin.routes())
+		reloaders = append(reloaders, reloader{"admin listener credentials", cfg.adminSecurity.reload})
+	}
+	if cfg.configFile != "" {
+		configReloader := newConfigReloader(&cfg, configuredLogs, served, builder, router, admin)
+		r := reloader{"-config " + cfg.configFile, configReloader.reload}
+		reloaders = append(reloaders, r)
+		if cfg.configWatchInterval > 0 {
+			watchFile(cfg.configFile, cfg.configWatchInterval, r)
+		}
+	}
+	reloadOnSIGHUP(reloaders)
+
+	srv := http.Server{
+		Addr:              cfg.listenAddress,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      cfg.maxFullRequestTimeout() + 1*time.Second, // must be a bit larger than the max time spent in the HTTP handler
+		IdleTimeout:       5 * time.Minute,
+		ReadHeaderTimeout: 2 * time.Second,
+		Handler:           router,
+	}
+
+	log.Fatal(srv.ListenAndServe())
+}
+
+// startCluster returns a ring for the cluster, with peers found by discovery,
+// and keeps them up to date. If the peers can't be found at startup, the ring
+// starts with only self, so the instance can serve while discovery recovers.
+func startCluster(self string, discovery peerDiscovery, refreshInterval time.Duration, registerer prometheus.Registerer) (*ctile.Ring, error) {
+	ring, err := ctile.NewRing(self, nil)
+	if err != nil {
+		return nil, err
+	}
+	watcher := newPeerWatcher(ring, discovery, registerer)
+	ctx, cancel := context.WithTimeout(context.Background(), refreshInterval)
+	defer cancel()
+	err = watcher.refresh(ctx)
+	if err != nil {
+		log.Printf("warning: %s; starting with no peers\n", err)
+	}
+	if _, static := discovery.(staticPeers); !static {
+		watcher.watch(refreshInterval)
+	}
+	return ring, nil
+}
+
+// storageFlags select where tiles are stored: S3, with the AWS shared config
+// profile, region, and endpoint selected explicitly, rather than relying on
+// the environment, which differs between interactive shells and systemd units
+// and between SDK versions; or Azure Blob Storage, if an endpoint is set; or a
+// local directory.
+type storageFlags struct {
+	profile string
+	region  string
+
+	// endpoint and pathStyle are for S3-compatible stores, like MinIO, Ceph
+	// RGW, or Cloudflare R2.
+	endpoint  string
+	pathStyle bool
+
+	azureEndpoint     string
+	azureSASToken     secret
+	azureSASTokenFile string
+
+	cacheDir string
+}
+
+// registerFlags binds the fields of a to flags in fs.
+func (a *storageFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&a.profile, "aws-profile", "", "named profile from the AWS shared config files. defaults to $AWS_PROFILE, or the default profile")
+	fs.StringVar(&a.region, "aws-region", "", "AWS region of the s3 bucket. defaults to $AWS_REGION, or the profile's region")
+	fs.StringVar(&a.region, "s3-region", "", "alias for -aws-region")
+	fs.StringVar(&a.endpoint, "s3-endpoint", "", "URL of an s3-compatible store to use instead of AWS, e.g. http://localhost:9000 for MinIO")
+	fs.BoolVar(&a.pathStyle, "s3-path-style", false, "address buckets in the URL path, as in http://localhost:9000/bucket/key, rather than the host name. most s3-compatible stores need it")
+	fs.StringVar(&a.azureEndpoint, "azure-blob-endpoint", "", "store tiles in Azure Blob Storage instead of s3, in the storage account at this URL, e.g. https://account.blob.core.windows.net. s3 buckets name containers")
+	fs.Var(&a.azureSASToken, "azure-sas-token", "shared access signature for -azure-blob-endpoint, granting read, write, delete, and list access. defaults to $AZURE_STORAGE_SAS_TOKEN")
+	fs.StringVar(&a.azureSASTokenFile, "azure-sas-token-file", "", "file containing the -azure-sas-token")
+	fs.StringVar(&a.cacheDir, "cache-dir", "", "store tiles in files under this directory instead of s3, e.g. /var/cache/ctile. s3 buckets name subdirectories, and -s3-bucket defaults to 'tiles'")
+}
+
+// newStorageService returns a client for the storage selected by a. For S3,
+// it's configured from the default AWS config sources (environment, shared
+// config files, and instance metadata), with the profile, region, and
+// endpoint overridden by flags if set.
+func newStorageService(ctx context.Context, a storageFlags) (ctile.S3API, error) {
+	if a.cacheDir != "" && a.azureEndpoint != "" {
+		return nil, errors.New("-cache-dir and -azure-blob-endpoint can't be used together")
+	}
+	if (a.endpoint != "" || a.pathStyle) && (a.cacheDir != "" || a.azureEndpoint != "") {
+		return nil, errors.New("-s3-endpoint and -s3-path-style only apply to s3, not -cache-dir or -azure-blob-endpoint")
+	}
+	if a.endpoint != "" {
+		u, err := url.Parse(a.endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid -s3-endpoint %q: want an http or https URL", a.endpoint)
+		}
+	}
+	if a.cacheDir != "" {
+		return fsstore.New(a.cacheDir)
+	}
+	if a.azureEndpoint != "" {
+		sasToken, err := secretValue(a.azureSASToken, a.azureSASTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("-azure-sas-token-file: %w", err)
+		}
+		if sasToken == "" {
+			sasToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+		}
+		return azblob.New(a.azureEndpoint, sasToken, http.DefaultClient)
+	}
+
+	cfg, err := loadAWSConfig(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if a.endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(a.endpoint)
+		}
+		o.UsePathStyle = a.pathStyle
+	}), nil
+}
+
+// newSQSService returns an SQS client with the AWS profile and region of
+// newStorageService's S3 client, for -s3-events-queue-url. -s3-endpoint
+// doesn't apply to it.
+func newSQSService(ctx context.Context, a storageFlags) (*sqs.Client, error) {
+	cfg, err := loadAWSConfig(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	return sqs.NewFromConfig(cfg), nil
+}
+
+// loadAWSConfig loads the AWS config from the default sources, with the
+// profile and region selected by a.
+func loadAWSConfig(ctx context.Context, a storageFlags) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if a.profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(a.profile))
+	}
+	if a.region != "" {
+		opts = append(opts, config.WithRegion(a.region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("loading AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		return aws.Config{}, errors.New("no AWS region configured: set -aws-region or $AWS_REGION")
+	}
+	return cfg, nil
+}
+
+// keyFlags select how the keys of tiles are laid out, for the subcommands that
+// work on the cache directly. They must match the server's flags of the same
+// names, or those subcommands won't find its tiles.
+type keyFlags struct {
+	logURL     string
+	layout     string
+	template   string
+	superTiles int
+}
+
+// registerFlags binds the fields of k to flags in fs.
+func (k *keyFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&k.logURL, "log-url", "", "CT log URL, as used by the server. only needed if -s3-key-template uses {log_host} or {log_path}")
+	fs.StringVar(&k.layout, "s3-key-layout", string(ctile.KeyLayoutFlat), "how tile keys are laid out, as used by the server")
+	fs.StringVar(&k.template, "s3-key-template", ctile.DefaultKeyTemplate, "template for tile keys, as used by the server")
+	fs.IntVar(&k.superTiles, "s3-super-tiles", 0, "number of tiles in each s3 object, as used by the server")
+}
+
+// tileKeys returns the keys of tiles of tileSize laid out as selected by k, or
+// of tiles of any size if tileSize is 0, which needs the default
+// -s3-key-template and no -s3-super-tiles.
+func (k keyFlags) tileKeys(tileSize int64) (*ctile.TileKeys, error) {
+	layout, err := ctile.ParseKeyLayout(k.layout)
+	if err != nil {
+		return nil, fmt.Errorf("-s3-key-layout: %w", err)
+	}
+	template, err := ctile.ParseKeyTemplate(k.template)
+	if err != nil {
+		return nil, fmt.Errorf("-s3-key-template: %w", err)
+	}
+	if k.superTiles < 0 {
+		return nil, errors.New("-s3-super-tiles must not be negative")
+	}
+	if tileSize == 0 && (k.template != ctile.DefaultKeyTemplate || k.superTiles > 1) {
+		return nil, errors.New("-tile-size is required with -s3-key-template or -s3-super-tiles")
+	}
+	keys, err := ctile.NewTileKeys(k.logURL, ctile.WithTileSize(int(tileSize)), ctile.WithKeyLayout(layout),
+		ctile.WithKeyTemplate(template), ctile.WithSuperTiles(k.superTiles))
+	if err != nil {
+		return nil, fmt.Errorf("-s3-key-template: %w", err)
+	}
+	return keys, nil
+}
+
+// startFakeBackend serves a fakelog.Log on a random local port, and returns its
+// URL for use as the -log-url.
+func startFakeBackend(size, maxGetEntries int64) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("starting fake backend: %s", err)
+	}
+	server := http.Server{
+		ReadHeaderTimeout: 2 * time.Second,
+		Handler:           fakelog.New(size, maxGetEntries),
+	}
+	go func() {
+		err := server.Serve(listener)
+		log.Fatalf("fake backend stopped: %s", err)
+	}()
+	url := "http://" + listener.Addr().String()
+	log.Printf("serving fake backend with %d entries at %s\n", size, url)
+	return url
+}
+
+// newStatsRegistry returns a registry for Prometheus metrics, and serves it on
+// listenAddress, protected as configured by security.
+func newStatsRegistry(listenAddress string, security *listenerSecurity) prometheus.Registerer {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector())
+	registry.MustRegister(collectors.NewProcessCollector(
+		collectors.ProcessCollectorOpts{}))
+
+	startOperationalServer("metrics", listenAddress, security, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return registry
+}
+
+// startOperationalServer serves handler on listenAddress in the background,
+// protected as configured by security. It exits the process if the server
+// can't start. name identifies the server in log messages.
+func startOperationalServer(name, listenAddress string, security *listenerSecurity, handler http.Handler) {
+	tlsConfig := security.tlsConfig()
+	server := http.Server{
+		Addr:              listenAddress,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		IdleTimeout:       5 * time.Minute,
+		ReadHeaderTimeout: 2 * time.Second,
+		Handler:           security.wrap(handler),
+		TLSConfig:         tlsConfig,
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			log.Printf("error starting %s server on %s: %s\n", name, listenAddress, err)
+			os.Exit(1)
+		}
+	}()
+}
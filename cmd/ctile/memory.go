@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// byteSize is a flag.Value for a number of bytes, with an optional unit as in
+// $GOMEMLIMIT: B, KiB, MiB, GiB, or TiB.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	for _, u := range byteUnits {
+		if *b != 0 && int64(*b)%u.size == 0 {
+			return fmt.Sprintf("%d%s", int64(*b)/u.size, u.suffix)
+		}
+	}
+	return "0"
+}
+
+func (b *byteSize) Set(s string) error {
+	size := int64(1)
+	for _, u := range byteUnits {
+		if number, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, size = number, u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/size {
+		return fmt.Errorf("invalid size %q: want a number of bytes, optionally followed by KiB, MiB, GiB, or TiB", s)
+	}
+	*b = byteSize(n * size)
+	return nil
+}
+
+// memoryConfig tunes the Go runtime to bound the process's memory, e.g. to
+// stay within a container's limit.
+type memoryConfig struct {
+	limit     byteSize
+	gcPercent int
+	ballast   byteSize
+}
+
+// registerFlags binds the fields of m to flags in fs.
+func (m *memoryConfig) registerFlags(fs *flag.FlagSet) {
+	fs.Var(&m.limit, "memory-limit", "soft limit on the memory used by the Go runtime, like $GOMEMLIMIT, e.g. 1536MiB. the garbage collector runs more often to stay under it. 0 leaves $GOMEMLIMIT in effect")
+	fs.IntVar(&m.gcPercent, "gc-percent", 0, "heap growth, in percent of the live heap, that triggers a garbage collection, like $GOGC. negative disables collection until -memory-limit is reached. 0 leaves $GOGC in effect")
+	fs.Var(&m.ballast, "memory-ballast", "size of an allocation kept for the life of the process, e.g. 256MiB, which makes the garbage collector run less often under -gc-percent without using physical memory. it counts towards -memory-limit")
+}
+
+// validate returns every problem with m.
+func (m *memoryConfig) validate() []error {
+	var errs []error
+	if m.gcPercent < 0 && m.limit == 0 && os.Getenv("GOMEMLIMIT") == "" {
+		errs = append(errs, errors.New("a negative -gc-percent requires -memory-limit, or memory use is unbounded"))
+	}
+	if m.limit > 0 && m.ballast >= m.limit {
+		errs = append(errs, fmt.Errorf("-memory-ballast (%s) must be less than -memory-limit (%s)", &m.ballast, &m.limit))
+	}
+	return errs
+}
+
+// ballast keeps the allocation for -memory-ballast alive. It's never touched,
+// so the OS doesn't back it with physical memory.
+var ballast []byte
+
+// apply configures the runtime as set by m, and registers gauges of the
+// runtime's memory use against its limit.
+func (m *memoryConfig) apply(registerer prometheus.Registerer) {
+	if m.limit > 0 {
+		debug.SetMemoryLimit(int64(m.limit))
+	}
+	if m.gcPercent != 0 {
+		debug.SetGCPercent(m.gcPercent)
+	}
+	if m.ballast > 0 {
+		ballast = make([]byte, m.ballast)
+	}
+
+	registerer.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ctile_memory_limit_bytes",
+			Help: "soft limit on the memory used by the Go runtime, from -memory-limit or $GOMEMLIMIT. 0 if there is none",
+		}, func() float64 {
+			limit := debug.SetMemoryLimit(-1)
+			if limit == math.MaxInt64 {
+				return 0
+			}
+			return float64(limit)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ctile_memory_used_bytes",
+			Help: "memory used by the Go runtime, as counted against ctile_memory_limit_bytes",
+		}, memoryUsed),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ctile_memory_ballast_bytes",
+			Help: "size of the -memory-ballast allocation",
+		}, func() float64 {
+			return float64(len(ballast))
+		}),
+	)
+}
+
+// memoryUsed returns the memory mapped by the Go runtime, minus what it has
+// returned to the OS, which is what its memory limit applies to.
+func memoryUsed() float64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return float64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestByteSize(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected int64
+		str      string
+	}{
+		{"0", 0, "0"},
+		{"1000", 1000, "1000B"},
+		{"1000B", 1000, "1000B"},
+		{"2KiB", 2048, "2KiB"},
+		{"1536MiB", 1536 << 20, "1536MiB"},
+		{"1024MiB", 1 << 30, "1GiB"},
+		{"3TiB", 3 << 40, "3TiB"},
+	}
+	for _, tc := range testCases {
+		var b byteSize
+		err := b.Set(tc.in)
+		if err != nil {
+			t.Errorf("%q: %s", tc.in, err)
+			continue
+		}
+		if int64(b) != tc.expected {
+			t.Errorf("%q: expected %d, got %d", tc.in, tc.expected, b)
+		}
+		if b.String() != tc.str {
+			t.Errorf("%q: expected String() %q, got %q", tc.in, tc.str, b.String())
+		}
+	}
+
+	for _, bad := range []string{"", "-1", "1.5GiB", "1GB", "MiB", "99999999999TiB"} {
+		var b byteSize
+		if b.Set(bad) == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestMemoryConfigValidate(t *testing.T) {
+	t.Setenv("GOMEMLIMIT", "")
+	testCases := []struct {
+		cfg   memoryConfig
+		valid bool
+	}{
+		{memoryConfig{}, true},
+		{memoryConfig{limit: 1 << 30, gcPercent: -1, ballast: 256 << 20}, true},
+		{memoryConfig{gcPercent: -1}, false},
+		{memoryConfig{limit: 1 << 30, ballast: 1 << 30}, false},
+	}
+	for _, tc := range testCases {
+		errs := tc.cfg.validate()
+		if (len(errs) == 0) != tc.valid {
+			t.Errorf("%+v: expected valid=%t, got %v", tc.cfg, tc.valid, errs)
+		}
+	}
+}
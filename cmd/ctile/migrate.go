@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// migrationStep describes how to assemble one destination tile: where it
+// starts, and the starts of the source tiles that cover it, in order.
+type migrationStep struct {
+	dst  int64
+	srcs []int64
+}
+
+// planMigration returns a step for every tile of size `to` that can be
+// assembled entirely out of the source tiles of size `from` listed in `have`.
+// Destination tiles that would need a missing source tile are left out.
+//
+// This works for any pair of sizes, though in practice one will usually be a
+// multiple of the other, so tiles are simply split or merged.
+func planMigration(have []int64, from, to int64) []migrationStep {
+	if len(have) == 0 {
+		return nil
+	}
+	haveSet := make(map[int64]bool, len(have))
+	var limit int64
+	for _, start := range have {
+		haveSet[start] = true
+		if start+from > limit {
+			limit = start + from
+		}
+	}
+
+	var steps []migrationStep
+	for dst := int64(0); dst+to <= limit; dst += to {
+		var srcs []int64
+		complete := true
+		for src := dst - dst%from; src < dst+to; src += from {
+			if !haveSet[src] {
+				complete = false
+				break
+			}
+			srcs = append(srcs, src)
+		}
+		if complete {
+			steps = append(steps, migrationStep{dst: dst, srcs: srcs})
+		}
+	}
+	return steps
+}
+
+// assembleTile builds the destination tile described by `step` out of the
+// decoded source tiles, which must all be present in `sources`.
+func assembleTile(step migrationStep, from, to int64, sources map[int64]*ctile.Entries) (*ctile.Entries, error) {
+	result := &ctile.Entries{Entries: make([]ctile.Entry, 0, to)}
+	for _, src := range step.srcs {
+		source, ok := sources[src]
+		if !ok {
+			return nil, fmt.Errorf("internal inconsistency: source tile %d not loaded", src)
+		}
+		if int64(len(source.Entries)) != from {
+			return nil, fmt.Errorf("source tile %d has %d entries, expected %d", src, len(source.Entries), from)
+		}
+		lo := step.dst - src
+		if lo < 0 {
+			lo = 0
+		}
+		hi := step.dst + to - src
+		if hi > from {
+			hi = from
+		}
+		result.Entries = append(result.Entries, source.Entries[lo:hi]...)
+	}
+	if int64(len(result.Entries)) != to {
+		return nil, fmt.Errorf("internal inconsistency: assembled %d entries for tile %d, expected %d", len(result.Entries), step.dst, to)
+	}
+	return result, nil
+}
+
+// listTileStarts returns the sorted start offsets of all complete tiles cached
+// under `prefix` at the keys in `keys`, in any layout they may be read in.
+func listTileStarts(ctx context.Context, svc ctile.S3API, bucket, prefix string, keys *ctile.TileKeys) ([]int64, error) {
+	listPrefix := prefix + keys.ListPrefix()
+	seen := make(map[int64]bool)
+	var starts []int64
+	paginator := s3.NewListObjectsV2Paginator(svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(listPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing bucket %q with prefix %q: %w", bucket, listPrefix, err)
+		}
+		for _, obj := range page.Contents {
+			tiles, ok := keys.Parse(strings.TrimPrefix(aws.ToString(obj.Key), prefix))
+			if !ok || tiles.Partial || tiles.Precompressed || seen[tiles.Start] {
+				continue
+			}
+			// A tile in KeyLayoutHashed may be at its flat key too.
+			seen[tiles.Start] = true
+			starts = append(starts, tiles.Start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts, nil
+}
+
+// runMigrate implements the `ctile migrate` subcommand, which converts cached
+// tiles of one size into tiles of another size, so the server's -tile-size can
+// be changed without discarding the existing cache. Source tiles are left in
+// place; once the server is running with the new size, they can be removed
+// with `ctile purge`.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	s3bucket := fs.String("s3-bucket", "", "s3 bucket containing the cache")
+	s3prefix := fs.String("s3-prefix", "", "prefix for s3 keys of the source tiles, as used by the server")
+	destPrefix := fs.String("dest-s3-prefix", "", "prefix for s3 keys of the migrated tiles. defaults to value of -s3-prefix")
+	from := fs.Int64("from-tile-size", 0, "tile size of the existing cache")
+	to := fs.Int64("to-tile-size", 0, "tile size to migrate to")
+	dryRun := fs.Bool("dry-run", false, "print the keys that would be written without writing them")
+	var awsOpts storageFlags
+	awsOpts.registerFlags(fs)
+	var keyOpts keyFlags
+	keyOpts.registerFlags(fs)
+	fs.Parse(args)
+
+	if *s3bucket == "" {
+		log.Fatal("missing required flag: -s3-bucket")
+	}
+	if *s3prefix == "" {
+		log.Fatal("missing required flag: -s3-prefix")
+	}
+	if *from <= 0 || *to <= 0 {
+		log.Fatal("-from-tile-size and -to-tile-size must be positive")
+	}
+	if *destPrefix == "" {
+		*destPrefix = *s3prefix
+	}
+	if *from == *to && *destPrefix == *s3prefix {
+		log.Fatal("nothing to do: source and destination are the same")
+	}
+	srcKeys, dstKeys, err := migrationKeys(keyOpts, *s3prefix, *destPrefix, *from, *to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	svc, err := newStorageService(ctx, awsOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	written, skipped, err := migrate(ctx, svc, *s3bucket, *s3prefix, *destPrefix, srcKeys, dstKeys, *from, *to, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "dry run: would have written %d tiles (%d already existed)\n", written, skipped)
+	} else {
+		fmt.Fprintf(os.Stderr, "wrote %d tiles (%d already existed)\n", written, skipped)
+	}
+}
+
+// migrationKeys returns the keys of the source and destination tiles of a
+// migration, laid out as selected by k, or an error if it can't be done with
+// that layout.
+func migrationKeys(k keyFlags, srcPrefix, dstPrefix string, from, to int64) (*ctile.TileKeys, *ctile.TileKeys, error) {
+	if k.superTiles > 1 {
+		return nil, nil, errors.New("-s3-super-tiles isn't supported: migrate reads and writes tiles on their own")
+	}
+	srcKeys, err := k.tileKeys(from)
+	if err != nil {
+		return nil, nil, err
+	}
+	dstKeys, err := k.tileKeys(to)
+	if err != nil {
+		return nil, nil, err
+	}
+	if srcPrefix == dstPrefix && srcKeys.Key(0) == dstKeys.Key(0) {
+		return nil, nil, errors.New("-s3-key-template doesn't use {tile_size}, so tiles of both sizes would have the same keys: set -dest-s3-prefix")
+	}
+	return srcKeys, dstKeys, nil
+}
+
+// migrate copies the contents of all tiles of size `from` under `srcPrefix`,
+// at the keys in `srcKeys`, into tiles of size `to` under `dstPrefix`, at the
+// keys in `dstKeys`. Destination tiles that already exist are skipped. It
+// returns the number of tiles written and skipped.
+func migrate(ctx context.Context, svc ctile.S3API, bucket, srcPrefix, dstPrefix string, srcKeys, dstKeys *ctile.TileKeys, from, to int64, dryRun bool) (int, int, error) {
+	have, err := listTileStarts(ctx, svc, bucket, srcPrefix, srcKeys)
+	if err != nil {
+		return 0, 0, err
+	}
+	existing, err := listTileStarts(ctx, svc, bucket, dstPrefix, dstKeys)
+	if err != nil {
+		return 0, 0, err
+	}
+	existingSet := make(map[int64]bool, len(existing))
+	for _, start := range existing {
+		existingSet[start] = true
+	}
+
+	var written, skipped int
+	// Steps are in order, so we only need to hold on to the source tiles that
+	// overlap the current destination tile.
+	sources := make(map[int64]*ctile.Entries)
+	for _, step := range planMigration(have, from, to) {
+		if existingSet[step.dst] {
+			skipped++
+			continue
+		}
+		key := dstPrefix + dstKeys.Key(step.dst)
+		if dryRun {
+			fmt.Println(key)
+			written++
+			continue
+		}
+
+		for start := range sources {
+			if start+from <= step.dst {
+				delete(sources, start)
+			}
+		}
+		for _, src := range step.srcs {
+			if sources[src] != nil {
+				continue
+			}
+			contents, err := getSourceTile(ctx, svc, bucket, srcPrefix, srcKeys, src)
+			if err != nil {
+				return written, skipped, err
+			}
+			sources[src] = contents
+		}
+
+		contents, err := assembleTile(step, from, to, sources)
+		if err != nil {
+			return written, skipped, err
+		}
+		err = ctile.PutTileObject(ctx, svc, bucket, key, contents)
+		if err != nil {
+			return written, skipped, err
+		}
+		fmt.Println(key)
+		written++
+	}
+	return written, skipped, nil
+}
+
+// getSourceTile reads the complete tile starting at start under prefix, from
+// the first of the keys in `keys` it's at.
+func getSourceTile(ctx context.Context, svc ctile.S3API, bucket, prefix string, keys *ctile.TileKeys, start int64) (*ctile.Entries, error) {
+	var key string
+	for _, tiles := range keys.Lookup(start) {
+		if tiles.Partial {
+			continue
+		}
+		key = prefix + tiles.Key
+		contents, err := ctile.GetTileObject(ctx, svc, bucket, key)
+		if errors.Is(err, ctile.ErrNoSuchKey) {
+			continue
+		}
+		return contents, err
+	}
+	return nil, fmt.Errorf("source tile %q disappeared during migration", key)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestPlanMigration(t *testing.T) {
+	testCases := []struct {
+		name     string
+		have     []int64
+		from, to int64
+		expected []migrationStep
+	}{
+		{
+			name:     "empty",
+			have:     nil,
+			from:     4,
+			to:       2,
+			expected: nil,
+		},
+		{
+			name: "split",
+			have: []int64{0, 4},
+			from: 4,
+			to:   2,
+			expected: []migrationStep{
+				{0, []int64{0}},
+				{2, []int64{0}},
+				{4, []int64{4}},
+				{6, []int64{4}},
+			},
+		},
+		{
+			name: "merge with gap",
+			have: []int64{0, 2, 6, 8, 10},
+			from: 2,
+			to:   4,
+			expected: []migrationStep{
+				{0, []int64{0, 2}},
+				{8, []int64{8, 10}},
+			},
+		},
+		{
+			name: "unaligned sizes",
+			have: []int64{0, 3, 6},
+			from: 3,
+			to:   4,
+			expected: []migrationStep{
+				{0, []int64{0, 3}},
+				{4, []int64{3, 6}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got := planMigration(tc.have, tc.from, tc.to)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestAssembleTile(t *testing.T) {
+	makeEntries := func(start, n int) *ctile.Entries {
+		var e ctile.Entries
+		for i := start; i < start+n; i++ {
+			e.Entries = append(e.Entries, ctile.Entry{LeafInput: []byte{byte(i)}})
+		}
+		return &e
+	}
+	sources := map[int64]*ctile.Entries{
+		0: makeEntries(0, 3),
+		3: makeEntries(3, 3),
+	}
+
+	result, err := assembleTile(migrationStep{2, []int64{0, 3}}, 3, 2, sources)
+	if err != nil {
+		t.Fatalf("expected success, got %s", err)
+	}
+	if !reflect.DeepEqual(result, makeEntries(2, 2)) {
+		t.Errorf("expected entries 2 and 3, got %v", result)
+	}
+
+	_, err = assembleTile(migrationStep{4, []int64{3, 6}}, 3, 4, sources)
+	if err == nil {
+		t.Error("expected error for missing source tile, got none")
+	}
+}
+
+// TestMigrate checks that migrate reads and writes tiles in each layout the
+// server writes them in.
+func TestMigrate(t *testing.T) {
+	testCases := []struct {
+		name string
+		keys keyFlags
+		// stored are the keys of the source tiles starting at 0, 2 and 6.
+		stored   []string
+		migrated string
+	}{
+		{
+			name:     "flat",
+			keys:     keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate},
+			stored:   []string{"p/tile_size=2/0.cbor.gz", "p/tile_size=2/2.cbor.gz", "p/tile_size=2/6.cbor.gz"},
+			migrated: "p/tile_size=4/0.cbor.gz",
+		},
+		{
+			// Tiles not yet moved to their hashed keys are read too.
+			name:     "hashed",
+			keys:     keyFlags{layout: "hashed", template: ctile.DefaultKeyTemplate},
+			stored:   []string{"p/5fec/tile_size=2/0.cbor.gz", "p/tile_size=2/2.cbor.gz", "p/e7f6/tile_size=2/6.cbor.gz"},
+			migrated: "p/5fec/tile_size=4/0.cbor.gz",
+		},
+		{
+			name:     "template",
+			keys:     keyFlags{logURL: "https://log.example/", layout: "flat", template: "{log_host}/{tile_size}/{tile_index}.bin"},
+			stored:   []string{"p/log.example/2/0.bin", "p/log.example/2/1.bin", "p/log.example/2/3.bin"},
+			migrated: "p/log.example/4/0.bin",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc := s3mem.New()
+			for i, start := range []int64{0, 2, 6} {
+				contents := &ctile.Entries{Entries: []ctile.Entry{
+					{LeafInput: []byte{byte(start)}},
+					{LeafInput: []byte{byte(start + 1)}},
+				}}
+				err := ctile.PutTileObject(ctx, svc, "bucket", tc.stored[i], contents)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			srcKeys, dstKeys, err := migrationKeys(tc.keys, "p/", "p/", 2, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			written, skipped, err := migrate(ctx, svc, "bucket", "p/", "p/", srcKeys, dstKeys, 2, 4, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != 1 || skipped != 0 {
+				t.Errorf("expected 1 tile written and 0 skipped, got %d and %d", written, skipped)
+			}
+
+			contents, err := ctile.GetTileObject(ctx, svc, "bucket", tc.migrated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, e := range contents.Entries {
+				if e.LeafInput[0] != byte(i) {
+					t.Errorf("entry %d: expected leaf %d, got %d", i, i, e.LeafInput[0])
+				}
+			}
+
+			written, skipped, err = migrate(ctx, svc, "bucket", "p/", "p/", srcKeys, dstKeys, 2, 4, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != 0 || skipped != 1 {
+				t.Errorf("second run: expected 0 tiles written and 1 skipped, got %d and %d", written, skipped)
+			}
+		})
+	}
+}
+
+func TestMigrationKeys(t *testing.T) {
+	for _, tc := range []struct {
+		keys        keyFlags
+		dstPrefix   string
+		expectedErr string
+	}{
+		{keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate, superTiles: 4}, "p/", "-s3-super-tiles isn't supported"},
+		{keyFlags{layout: "flat", template: "{tile_index}.bin"}, "p/", "doesn't use {tile_size}"},
+		{keyFlags{layout: "flat", template: "{tile_index}.bin"}, "q/", ""},
+		{keyFlags{layout: "sideways", template: ctile.DefaultKeyTemplate}, "p/", "unknown key layout"},
+	} {
+		_, _, err := migrationKeys(tc.keys, "p/", tc.dstPrefix, 2, 4)
+		if tc.expectedErr == "" && err != nil {
+			t.Errorf("%+v: unexpected error %v", tc.keys, err)
+		}
+		if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+			t.Errorf("%+v: expected error mentioning %q, got %v", tc.keys, tc.expectedErr, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// prefetcher follows the STH of a log and caches each tile as soon as it's
+// complete, so clients reading the head of the log find it in S3.
+type prefetcher struct {
+	logURL      string
+	b           *backfiller
+	concurrency int
+
+	// position is the index up to which every complete tile is cached.
+	position       int64
+	positionMetric prometheus.Gauge
+}
+
+// runPrefetch implements the `ctile prefetch` subcommand, which warms the
+// cache without serving clients. It takes the same flags and -config as the
+// server, so it caches the tiles the server reads, and can be scaled and
+// scheduled separately from the servers, e.g. next to a fleet in cache-only
+// mode. Prefetchers on several hosts split the work with the same leases as
+// `ctile backfill`.
+func runPrefetch(args []string) {
+	fs := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	var cfg serveConfig
+	cfg.registerFlags(fs)
+	interval := fs.Duration("prefetch-interval", 30*time.Second, "how often to check each log for new entries")
+	start := fs.Int64("prefetch-start", -1, "cache the tiles at or after this index on the first check, e.g. 0 to backfill the whole log. -1 means only tiles completed after startup")
+	once := fs.Bool("prefetch-once", false, "check each log once, then exit. for running on a schedule")
+	concurrency := fs.Int("prefetch-concurrency", 4, "number of chunks to fill at once for each log")
+	chunkTiles := fs.Int64("prefetch-chunk-tiles", 1000, "number of tiles in each unit of work claimed by a worker. must match `ctile backfill -chunk-tiles` to share its leases")
+	worker := fs.String("prefetch-worker", "", "name of this worker in leases. defaults to the host name and process ID")
+	leaseDuration := fs.Duration("prefetch-lease-duration", 10*time.Minute, "how long a chunk stays claimed without being renewed")
+	settle := fs.Duration("prefetch-lease-settle", 2*time.Second, "how long to wait after claiming a chunk before checking that the claim held")
+	fs.Parse(args)
+
+	err := setLogOutput(cfg.logOutput)
+	err = errors.Join(err, cfg.resolveLogs())
+	err = errors.Join(err, cfg.validate())
+	if *interval <= 0 || *concurrency <= 0 || *chunkTiles <= 0 {
+		err = errors.Join(err, errors.New("-prefetch-interval, -prefetch-concurrency and -prefetch-chunk-tiles must be positive"))
+	}
+	if *start < -1 {
+		err = errors.Join(err, errors.New("-prefetch-start must not be negative"))
+	}
+	if *leaseDuration <= 0 || *settle < 0 || *settle >= *leaseDuration/2 {
+		err = errors.Join(err, errors.New("-prefetch-lease-duration must be positive, and -prefetch-lease-settle less than half of it"))
+	}
+	if *worker == "" {
+		host, hostErr := os.Hostname()
+		err = errors.Join(err, hostErr)
+		*worker = fmt.Sprintf("%s/%d", host, os.Getpid())
+	}
+	svc, s3Err := cfg.newStorage(context.Background())
+	err = errors.Join(err, s3Err)
+	secondarySvc, s3Err := cfg.newSecondaryStorage(context.Background())
+	err = errors.Join(err, s3Err)
+	sharedCache, cacheErr := cfg.newSharedCache(context.Background())
+	err = errors.Join(err, cacheErr)
+	err = errors.Join(err, cfg.loadEncryption(context.Background()))
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%s", err)
+	}
+
+	if cfg.fakeBackend {
+		cfg.logs[0].LogURL = startFakeBackend(cfg.fakeBackendSize, cfg.fakeBackendMaxGetEntries)
+	}
+	for i := range cfg.logs {
+		l := &cfg.logs[i]
+		if !l.usesS3() {
+			continue
+		}
+		err = expandPrefixes(l)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	logEffectiveConfig(log.Printf, fs, &cfg)
+
+	// Tiles are fetched from the backend directly: the point of prefetching
+	// is to take that work off the servers.
+	cfg.readThroughPeer = ""
+	// Requests are only made in-process, so there are none to sign.
+	cfg.requestSigning.Keys = nil
+	registry := newStatsRegistry(cfg.metricsAddress, &cfg.metricsSecurity)
+	cfg.memory.apply(registry)
+	builder := &logBuilder{
+		cfg:           &cfg,
+		svc:           svc,
+		secondarySvc:  secondarySvc,
+		sharedCache:   sharedCache,
+		registry:      registry,
+		collapseGroup: ctile.NewCollapseGroup(),
+	}
+
+	var prefetchers []*prefetcher
+	for _, l := range cfg.logs {
+		if !l.usesS3() {
+			log.Printf("not prefetching log %q, which is in proxy-only mode\n", l.Name)
+			continue
+		}
+		// Logs served in cache-only mode still need the backend to be
+		// prefetched.
+		l.mode = ctile.ModeNormal
+		s, err := builder.build(l)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p := &prefetcher{
+			logURL: l.primaryLogURL(),
+			b: &backfiller{
+				svc:           svc,
+				bucket:        l.S3Bucket,
+				prefix:        l.S3Prefix,
+				handler:       s.handler,
+				tileSize:      int64(l.TileSize),
+				chunkTiles:    *chunkTiles,
+				worker:        *worker,
+				leaseDuration: *leaseDuration,
+				settle:        *settle,
+				now:           time.Now,
+			},
+			concurrency: *concurrency,
+			position:    *start,
+			positionMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "ctile_prefetch_position",
+				Help: "index of the log up to which this prefetcher has cached every complete tile since it started",
+			}),
+		}
+		s.registerer.MustRegister(p.positionMetric)
+		prefetchers = append(prefetchers, p)
+	}
+	if len(prefetchers) == 0 {
+		log.Fatal("no logs to prefetch")
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for _, p := range prefetchers {
+		wg.Add(1)
+		go func(p *prefetcher) {
+			defer wg.Done()
+			for {
+				err := p.poll(context.Background())
+				if err != nil {
+					log.Printf("error: prefetching %s: %s\n", p.logURL, err)
+					failed.Store(true)
+				}
+				if *once {
+					return
+				}
+				time.Sleep(*interval)
+			}
+		}(p)
+	}
+	wg.Wait()
+	if failed.Load() {
+		os.Exit(1)
+	}
+}
+
+// poll caches the complete tiles between the position and the current tree
+// size. A negative position starts from the tile the tree size is in.
+//
+// The position only moves forward once every chunk before the tree size has
+// been filled, by this worker or another: a chunk claimed by another worker
+// may never be finished if that worker dies, so it's checked again on the next
+// poll, by which time its lease may have expired.
+func (p *prefetcher) poll(ctx context.Context) error {
+	treeSize, err := getTreeSize(ctx, p.logURL)
+	if err != nil {
+		return err
+	}
+	complete := treeSize - treeSize%p.b.tileSize
+	if p.position < 0 {
+		p.position = complete
+	}
+	if p.position >= complete {
+		return nil
+	}
+	stats, err := p.b.run(ctx, p.position, treeSize, treeSize, p.concurrency)
+	if err != nil {
+		return err
+	}
+	if stats.claimed == 0 {
+		p.position = complete
+		p.positionMetric.Set(float64(p.position))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// growingLog serves a fakelog.Log whose size can be changed between requests.
+type growingLog struct {
+	mu  sync.Mutex
+	log *fakelog.Log
+}
+
+func (g *growingLog) grow(size int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.log = fakelog.New(size, 4)
+}
+
+func (g *growingLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	l := g.log
+	g.mu.Unlock()
+	l.ServeHTTP(w, r)
+}
+
+func TestPrefetcher(t *testing.T) {
+	backend := &growingLog{}
+	backend.grow(10)
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+	svc := s3mem.New()
+	ctx := context.Background()
+
+	p := &prefetcher{
+		logURL:         srv.URL,
+		b:              newTestBackfiller(t, svc, srv.URL, "a"),
+		concurrency:    2,
+		position:       -1,
+		positionMetric: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+	}
+
+	keys, err := ctile.NewTileKeys(srv.URL, ctile.WithTileSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCached := func(expected ...int64) {
+		t.Helper()
+		starts, err := listTileStarts(ctx, svc, "bucket", "prefix/", keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) == 0 {
+			expected = nil
+		}
+		if !reflect.DeepEqual(starts, expected) {
+			t.Errorf("expected tiles %v cached, got %v", expected, starts)
+		}
+	}
+
+	// The first poll only notes where the log ends.
+	err = p.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.position != 8 {
+		t.Errorf("expected position 8, got %d", p.position)
+	}
+	expectCached()
+
+	// Tiles are cached once they're complete, including the one that was
+	// partial at startup.
+	backend.grow(22)
+	err = p.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.position != 20 {
+		t.Errorf("expected position 20, got %d", p.position)
+	}
+	expectCached(8, 12, 16)
+
+	// A chunk leased by another worker holds the position back, so it's
+	// checked again if the other worker dies.
+	err = p.b.writeLease(ctx, 24, backfillLease{Worker: "b", Expires: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.grow(30)
+	err = p.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.position != 20 {
+		t.Errorf("expected position to stay at 20, got %d", p.position)
+	}
+	expectCached(8, 12, 16, 20)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// purgeFilter selects which cached tiles `ctile purge` deletes.
+//
+// `start` and `end` describe the half-open interval [start, end) of log entries
+// to purge; any tile overlapping that interval matches. An `end` of -1 means
+// the interval is unbounded.
+type purgeFilter struct {
+	start int64
+	end   int64
+}
+
+// matches returns true if the object holding the entries in [start, end)
+// should be purged.
+func (f purgeFilter) matches(start, end int64) bool {
+	if end <= f.start {
+		return false
+	}
+	if f.end != -1 && start >= f.end {
+		return false
+	}
+	return true
+}
+
+// maxDeleteObjects is the maximum number of keys S3 accepts in a single
+// DeleteObjects call.
+const maxDeleteObjects = 1000
+
+// runPurge implements the `ctile purge` subcommand, which deletes cached tiles
+// from S3. It's meant for recovering from incidents where bad tiles were cached.
+func runPurge(args []string) {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	s3bucket := fs.String("s3-bucket", "", "s3 bucket containing the cache")
+	s3prefix := fs.String("s3-prefix", "", "prefix for s3 keys, as used by the server")
+	tileSize := fs.Int64("tile-size", 0, "only purge tiles of this size. 0 means tiles of any size, which needs the default -s3-key-template and no -s3-super-tiles")
+	start := fs.Int64("start", 0, "purge tiles containing entries at or after this index")
+	end := fs.Int64("end", -1, "purge tiles containing entries at or before this index (inclusive, as in get-entries). -1 means no limit")
+	dryRun := fs.Bool("dry-run", false, "print the keys that would be deleted without deleting them")
+	var awsOpts storageFlags
+	awsOpts.registerFlags(fs)
+	var keyOpts keyFlags
+	keyOpts.registerFlags(fs)
+	fs.Parse(args)
+
+	if *s3bucket == "" {
+		log.Fatal("missing required flag: -s3-bucket")
+	}
+	if *s3prefix == "" {
+		log.Fatal("missing required flag: -s3-prefix")
+	}
+	if *tileSize < 0 || *start < 0 || *end < -1 {
+		log.Fatal("-tile-size, -start and -end must not be negative")
+	}
+	if *end != -1 && *end < *start {
+		log.Fatal("-end must be greater than or equal to -start")
+	}
+
+	keys, err := keyOpts.tileKeys(*tileSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter := purgeFilter{start: *start, end: *end}
+	if filter.end != -1 {
+		// Convert to a half-open interval, as elsewhere.
+		filter.end++
+	}
+
+	ctx := context.Background()
+	svc, err := newStorageService(ctx, awsOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := purge(ctx, svc, *s3bucket, *s3prefix, keys, filter, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "dry run: would have deleted %d tiles\n", n)
+	} else {
+		fmt.Fprintf(os.Stderr, "deleted %d tiles\n", n)
+	}
+}
+
+// purge deletes all objects holding tiles under `prefix` in `bucket`, at the
+// keys in `keys`, that match `filter`, and returns the number of matching
+// tiles. A super-tile is deleted if any of its tiles match. Each matching key
+// is printed to stdout. If dryRun is true, nothing is deleted.
+func purge(ctx context.Context, svc ctile.S3API, bucket, prefix string, keys *ctile.TileKeys, filter purgeFilter, dryRun bool) (int, error) {
+	listPrefix := prefix + keys.ListPrefix()
+
+	var count int
+	var batch []types.ObjectIdentifier
+	flush := func() error {
+		if len(batch) == 0 || dryRun {
+			batch = nil
+			return nil
+		}
+		resp, err := svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: true},
+		})
+		batch = nil
+		if err != nil {
+			return fmt.Errorf("deleting from bucket %q: %w", bucket, err)
+		}
+		if len(resp.Errors) > 0 {
+			e := resp.Errors[0]
+			return fmt.Errorf("deleting %q from bucket %q: %s (and %d other errors)",
+				aws.ToString(e.Key), bucket, aws.ToString(e.Message), len(resp.Errors)-1)
+		}
+		return nil
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(listPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return count, fmt.Errorf("listing bucket %q with prefix %q: %w", bucket, listPrefix, err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			tiles, ok := keys.Parse(strings.TrimPrefix(key, prefix))
+			if !ok {
+				// Not one of ours; leave it alone.
+				continue
+			}
+			if !filter.matches(tiles.Start, tiles.End) {
+				continue
+			}
+			fmt.Println(key)
+			// A tile's partial version, from -s3-cache-partial-tiles, and its
+			// precompressed JSON, from -s3-precompressed-json, go with it,
+			// but aren't counted as tiles.
+			if !tiles.Partial && !tiles.Precompressed {
+				count += tiles.Tiles
+			}
+			batch = append(batch, types.ObjectIdentifier{Key: obj.Key})
+			if len(batch) == maxDeleteObjects {
+				err = flush()
+				if err != nil {
+					return count, err
+				}
+			}
+		}
+	}
+	return count, flush()
+}
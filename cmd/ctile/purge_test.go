@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestPurgeFilter(t *testing.T) {
+	testCases := []struct {
+		filter     purgeFilter
+		start, end int64
+		expected   bool
+	}{
+		{purgeFilter{0, -1}, 0, 256, true},
+		{purgeFilter{0, -1}, 1000, 1100, true},
+		{purgeFilter{300, -1}, 0, 256, false},
+		{purgeFilter{300, -1}, 256, 512, true},
+		{purgeFilter{256, -1}, 0, 256, false},
+		{purgeFilter{0, 512}, 256, 512, true},
+		{purgeFilter{0, 512}, 512, 768, false},
+		{purgeFilter{300, 301}, 256, 512, true},
+		{purgeFilter{300, 301}, 0, 1024, true},
+	}
+	for _, tc := range testCases {
+		got := tc.filter.matches(tc.start, tc.end)
+		if got != tc.expected {
+			t.Errorf("%+v.matches(%d, %d): expected %t, got %t", tc.filter, tc.start, tc.end, tc.expected, got)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	svc := s3mem.New()
+	keys := []string{
+		"prefix/tile_size=2/0.cbor.gz",
+		"prefix/tile_size=2/2.cbor.gz",
+		"prefix/tile_size=2/2.cbor.gz.json.gz",
+		"prefix/tile_size=2/4.cbor.gz",
+		"prefix/tile_size=4/0.cbor.gz",
+		"prefix/unrelated",
+	}
+	for _, key := range keys {
+		_, err := svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remaining := func() int {
+		resp, err := svc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(resp.Contents)
+	}
+
+	tileKeys, err := keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate}.tileKeys(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := purgeFilter{start: 3, end: 4}
+	n, err := purge(ctx, svc, "bucket", "prefix/", tileKeys, filter, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || remaining() != 6 {
+		t.Errorf("dry run: expected 2 matches and nothing deleted, got %d matches and %d remaining", n, remaining())
+	}
+
+	n, err = purge(ctx, svc, "bucket", "prefix/", tileKeys, filter, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || remaining() != 3 {
+		t.Errorf("expected 2 tiles deleted, got %d deleted and %d remaining", n, remaining())
+	}
+}
+
+// TestPurgeKeyLayouts checks that purge finds tiles in each layout the server
+// writes them in, and leaves other tiles alone.
+func TestPurgeKeyLayouts(t *testing.T) {
+	testCases := []struct {
+		name      string
+		keys      keyFlags
+		stored    []string
+		remaining []string
+	}{
+		{
+			name: "flat",
+			keys: keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate},
+			stored: []string{
+				"p/tile_size=2/0.cbor.gz",
+				"p/tile_size=2/2.cbor.gz",
+				"p/tile_size=2/4.cbor.gz.partial",
+				"p/tile_size=4/0.cbor.gz",
+			},
+			remaining: []string{
+				"p/tile_size=2/0.cbor.gz",
+				"p/tile_size=4/0.cbor.gz",
+			},
+		},
+		{
+			name: "hashed",
+			keys: keyFlags{layout: "hashed", template: ctile.DefaultKeyTemplate},
+			stored: []string{
+				"p/5fec/tile_size=2/0.cbor.gz",
+				"p/0000/tile_size=2/2.cbor.gz",
+				"p/d473/tile_size=2/2.cbor.gz",
+				"p/d473/tile_size=2/2.cbor.gz.json.gz",
+				"p/tile_size=2/4.cbor.gz",
+			},
+			remaining: []string{
+				"p/5fec/tile_size=2/0.cbor.gz",
+				"p/0000/tile_size=2/2.cbor.gz",
+			},
+		},
+		{
+			name: "template",
+			keys: keyFlags{logURL: "https://log.example/", layout: "flat", template: "{log_host}/{tile_index}.bin"},
+			stored: []string{
+				"p/log.example/0.bin",
+				"p/log.example/1.bin",
+				"p/log.example/2.bin.partial",
+				"p/other.example/1.bin",
+				"p/tile_size=2/2.cbor.gz",
+			},
+			remaining: []string{
+				"p/log.example/0.bin",
+				"p/other.example/1.bin",
+				"p/tile_size=2/2.cbor.gz",
+			},
+		},
+		{
+			name: "super-tiles",
+			keys: keyFlags{layout: "flat", template: ctile.DefaultKeyTemplate, superTiles: 2},
+			stored: []string{
+				"p/tile_size=2/x2/0.cbor.gz",
+				"p/tile_size=2/x2/4.cbor.gz",
+				"p/tile_size=2/x3/0.cbor.gz",
+				"p/tile_size=2/0.cbor.gz",
+				"p/tile_size=2/8.cbor.gz",
+			},
+			remaining: []string{
+				"p/tile_size=2/0.cbor.gz",
+				"p/tile_size=2/x3/0.cbor.gz",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc := s3mem.New()
+			for _, key := range tc.stored {
+				_, err := svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			tileKeys, err := tc.keys.tileKeys(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = purge(ctx, svc, "bucket", "p/", tileKeys, purgeFilter{start: 2, end: -1}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := svc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var remaining []string
+			for _, obj := range resp.Contents {
+				remaining = append(remaining, aws.ToString(obj.Key))
+			}
+			sort.Strings(remaining)
+			sort.Strings(tc.remaining)
+			if strings.Join(remaining, " ") != strings.Join(tc.remaining, " ") {
+				t.Errorf("expected %q to remain, got %q", tc.remaining, remaining)
+			}
+		})
+	}
+
+	_, err := keyFlags{layout: "flat", template: "{tile_index}.bin"}.tileKeys(0)
+	if err == nil {
+		t.Error("expected an error for -s3-key-template without -tile-size")
+	}
+}
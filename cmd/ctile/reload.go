@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/redis"
+)
+
+// reloader reloads one part of the configuration, such as the credentials of
+// a listener.
+type reloader struct {
+	name   string
+	reload func() error
+}
+
+// reloadOnSIGHUP runs each reloader whenever the process receives SIGHUP, for
+// instance after a mounted secret has been rotated. A reloader that fails
+// keeps its previous configuration.
+func reloadOnSIGHUP(reloaders []reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			for _, r := range reloaders {
+				runReloader(r)
+			}
+		}
+	}()
+}
+
+// reloadMu serializes reloads, which may run on SIGHUP and from watchFile at
+// once, since they share the configuration and the served logs.
+var reloadMu sync.Mutex
+
+func runReloader(r reloader) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	err := r.reload()
+	if err != nil {
+		log.Printf("error reloading %s, keeping the previous configuration: %s\n", r.name, err)
+		return
+	}
+	log.Printf("reloaded %s\n", r.name)
+}
+
+// watchFile runs r whenever the contents of path change, checking every
+// interval. Comparing contents rather than modification times also catches
+// the symlink swaps Kubernetes uses to update mounted ConfigMaps.
+func watchFile(path string, interval time.Duration, r reloader) {
+	last, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("warning: reading %s to watch it: %s\n", path, err)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("warning: reading %s to watch it: %s\n", path, err)
+				continue
+			}
+			if bytes.Equal(contents, last) {
+				continue
+			}
+			last = contents
+			runReloader(r)
+		}
+	}()
+}
+
+// secretReloaders returns the reloaders of the secrets read from files that
+// aren't part of a listener's credentials: the -redis-password-file of
+// sharedCache, and the -request-signing-key-file and encryption keys of the
+// logs in served, which are also used for logs added to -config later.
+func secretReloaders(cfg *serveConfig, sharedCache ctile.SharedCache, served map[string]*servedLog) []reloader {
+	var reloaders []reloader
+	if client, ok := sharedCache.(*redis.Client); ok && cfg.redisPasswordFile != "" {
+		reloaders = append(reloaders, reloader{"-redis-password-file", func() error {
+			password, err := secretValue("", cfg.redisPasswordFile)
+			if err != nil {
+				return err
+			}
+			client.SetPassword(password)
+			return nil
+		}})
+	}
+	if cfg.requestSigningKeyFile != "" {
+		reloaders = append(reloaders, reloader{"-request-signing-key-file", func() error {
+			keys, err := cfg.loadRequestSigningKeys()
+			if err != nil {
+				return err
+			}
+			for name, s := range served {
+				err := s.handler.SetRequestSigningKeys(keys)
+				if err != nil {
+					return fmt.Errorf("log %q: %w", name, err)
+				}
+			}
+			cfg.requestSigning.Keys = keys
+			return nil
+		}})
+	}
+	if cfg.encryptionKeyFile != "" || cfg.encryptionKMSKeyFile != "" {
+		flagName := "-s3-encryption-key-file"
+		if cfg.encryptionKMSKeyFile != "" {
+			flagName = "-s3-encryption-kms-key-file"
+		}
+		reloaders = append(reloaders, reloader{flagName, func() error {
+			previous := cfg.encryption
+			err := cfg.loadEncryption(context.Background())
+			if err != nil {
+				return err
+			}
+			if len(cfg.encryption.Keys) == 0 {
+				cfg.encryption = previous
+				return errors.New("no keys, which would stop encrypting tiles")
+			}
+			for name, s := range served {
+				err := s.handler.SetEncryptionKeys(cfg.encryption.Keys)
+				if err != nil {
+					return fmt.Errorf("log %q: %w", name, err)
+				}
+			}
+			return nil
+		}})
+	}
+	return reloaders
+}
+
+// configReloader applies changes to the -config file to a running server.
+// Logs added to the file start being served, and logs removed from it stop
+// being served once the requests in flight for them finish. Feature rollouts
+// of other logs are updated; other changes to their settings are logged as
+// warnings and take effect at the next restart.
+type configReloader struct {
+	cfg     *serveConfig
+	builder *logBuilder
+	router  *logRouter
+	admin   *adminAPI
+
+	// mu protects logs, which are the logs as last loaded from the file, and
+	// served, which are the handlers of the logs being served, by name.
+	mu     sync.Mutex
+	logs   []logConfig
+	served map[string]*servedLog
+}
+
+// newConfigReloader returns a configReloader for a server that started with
+// logs, served by the handlers in served through router. Logs added later
+// are built by builder.
+func newConfigReloader(cfg *serveConfig, logs []logConfig, served map[string]*servedLog, builder *logBuilder, router *logRouter, admin *adminAPI) *configReloader {
+	return &configReloader{
+		cfg:     cfg,
+		builder: builder,
+		router:  router,
+		admin:   admin,
+		logs:    logs,
+		served:  served,
+	}
+}
+
+// reload reads the -config file again. If it's valid, added logs are started,
+// and removed logs are drained and stopped: their streaming responses are
+// ended, and their other requests in flight get up to the longest
+// -full-request-timeout to finish. The feature rollouts of each log whose
+// features changed in the file are replaced by the file's, so rollouts set
+// through the admin API are kept until the file changes them.
+func (r *configReloader) reload() error {
+	logs, err := r.cfg.loadConfigLogs()
+	if err != nil {
+		return err
+	}
+	errs := r.cfg.validateLogs(logs)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// Removed logs are drained without holding mu, since that can take as
+	// long as a request.
+	removed, err := r.apply(logs)
+	for _, l := range removed {
+		if !l.routed.drain(r.cfg.maxFullRequestTimeout()) {
+			log.Printf("warning: log %q still has requests in flight, which are cut off\n", l.name)
+		}
+		l.served.close()
+		log.Printf("stopped serving log %q, which was removed from -config\n", l.name)
+	}
+	return err
+}
+
+// removedLog is a log removed from -config, which is no longer routed to,
+// but may still be serving requests.
+type removedLog struct {
+	name   string
+	routed *routedLog
+	served *servedLog
+}
+
+// apply updates the logs served to logs, except that removed logs are only
+// no longer routed to, and returned to be drained and stopped.
+func (r *configReloader) apply(logs []logConfig) ([]removedLog, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := make(map[string]logConfig)
+	for _, l := range r.logs {
+		if r.served[l.Name] != nil {
+			previous[l.Name] = l
+		}
+	}
+	var added []logConfig
+	for _, l := range logs {
+		before, ok := previous[l.Name]
+		if !ok {
+			added = append(added, l)
+			continue
+		}
+		delete(previous, l.Name)
+
+		if before.Features.String() != l.Features.String() {
+			err := applyRollouts(r.served[l.Name].features, l.Features)
+			if err != nil {
+				return nil, fmt.Errorf("log %q: %w", l.Name, err)
+			}
+			log.Printf("set feature rollouts of log %q to %s\n", l.Name, &l.Features)
+		}
+		before.Features = l.Features
+		if !reflect.DeepEqual(before, l) {
+			log.Printf("warning: settings of log %q other than features changed in -config, and will take effect after a restart\n", l.Name)
+		}
+	}
+
+	var removed []removedLog
+	for name := range previous {
+		s := r.served[name]
+		s.handler.EndStreams()
+		removed = append(removed, removedLog{name: name, routed: r.router.remove(name), served: s})
+		r.admin.removeLog(name)
+		delete(r.served, name)
+	}
+	var errs []error
+	for _, l := range added {
+		err := r.add(l)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("adding log %q: %w", l.Name, err))
+			continue
+		}
+		log.Printf("started serving log %q, which was added to -config\n", l.Name)
+	}
+	r.logs = logs
+	return removed, errors.Join(errs...)
+}
+
+// add starts serving l.
+func (r *configReloader) add(l logConfig) error {
+	if l.usesS3() {
+		err := expandPrefixes(&l)
+		if err != nil {
+			return err
+		}
+	}
+	if l.FullRequestTimeout.Duration > r.cfg.maxFullRequestTimeout() {
+		log.Printf("warning: -full-request-timeout of log %q is longer than that of any log at startup, so responses may be cut off until a restart\n", l.Name)
+	}
+	s, err := r.builder.build(l)
+	if err != nil {
+		return err
+	}
+	r.served[l.Name] = s
+	r.admin.addLog(l.Name, s.features)
+	r.router.add(l.Name, s.handler)
+	return nil
+}
+
+// applyRollouts replaces the rollouts of flags with rollouts.
+func applyRollouts(flags *ctile.FeatureFlags, rollouts featureRollouts) error {
+	var features []ctile.Feature
+	for feature := range flags.Snapshot() {
+		if _, ok := rollouts[feature]; !ok {
+			features = append(features, feature)
+		}
+	}
+	for feature := range rollouts {
+		features = append(features, feature)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+	for _, feature := range features {
+		err := flags.Set(feature, rollouts[feature])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestConfigReloader(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(contents string) {
+		err := os.WriteFile(configFile, []byte(contents), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"logs": [{"name": "2023", "log_url": "https://oak.ct.letsencrypt.org/2023", "features": {"readahead": 10}}]}`)
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err := fs.Parse([]string{"-config", configFile, "-tile-size", "256", "-s3-bucket", "b", "-config-watch-interval", "10s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.resolveLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestConfigReloader(t, &cfg)
+	features := r.served["2023"].features
+
+	// A rollout set through the admin API is kept while the file's features
+	// don't change.
+	err = features.Set("hedging", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(`{"logs": [{"name": "2023", "log_url": "https://oak.ct.letsencrypt.org/2023", "features": {"readahead": 10}, "mode": "cache-only"}]}`)
+	err = r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features.Snapshot()["hedging"] != 50 {
+		t.Errorf("expected admin API rollout to be kept, got %v", features.Snapshot())
+	}
+
+	writeConfig(`{"logs": [{"name": "2023", "log_url": "https://oak.ct.letsencrypt.org/2023", "features": {"readahead": 100, "zstd": 5}}]}`)
+	err = r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := features.Snapshot()
+	if len(snapshot) != 2 || snapshot["readahead"] != 100 || snapshot["zstd"] != 5 {
+		t.Errorf("expected rollouts from the file, got %v", snapshot)
+	}
+
+	writeConfig(`{"logs": [{"name": "2023", "log_url": "https://oak.ct.letsencrypt.org/2023", "features": {"readahead": 101}}]}`)
+	err = r.reload()
+	if err == nil {
+		t.Error("expected error reloading an invalid rollout, got none")
+	}
+	if features.Snapshot()["readahead"] != 100 {
+		t.Errorf("expected an invalid file to leave rollouts unchanged, got %v", features.Snapshot())
+	}
+}
+
+// newTestConfigReloader starts serving the logs in cfg, as main does, and
+// returns a configReloader for them.
+func newTestConfigReloader(t *testing.T, cfg *serveConfig) *configReloader {
+	t.Helper()
+	builder := &logBuilder{
+		cfg:           cfg,
+		svc:           s3mem.New(),
+		registry:      prometheus.NewRegistry(),
+		collapseGroup: ctile.NewCollapseGroup(),
+	}
+	served := make(map[string]*servedLog)
+	router := newLogRouter()
+	admin := newAdminAPI()
+	for _, l := range cfg.logs {
+		s, err := builder.build(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[l.Name] = s
+		router.add(l.Name, s.handler)
+		admin.addLog(l.Name, s.features)
+	}
+	return newConfigReloader(cfg, cfg.logs, served, builder, router, admin)
+}
+
+func TestConfigReloaderAddsAndRemovesLogs(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 4))
+	defer backend.Close()
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(names ...string) {
+		var logs []string
+		for _, name := range names {
+			logs = append(logs, fmt.Sprintf(`{"name": %q, "s3_prefix": %q}`, name, name+"/"))
+		}
+		err := os.WriteFile(configFile, []byte(`{"logs": [`+strings.Join(logs, ",")+`]}`), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("2023")
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err := fs.Parse([]string{"-config", configFile, "-log-url", backend.URL, "-tile-size", "4", "-s3-bucket", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.resolveLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestConfigReloader(t, &cfg)
+
+	expectServed := func(name string, expected bool) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+name+"/ct/v1/get-entries?start=0&end=3", nil))
+		if served := w.Code == http.StatusOK; served != expected {
+			t.Errorf("log %q: expected served=%t, got status %d", name, expected, w.Code)
+		}
+		if _, ok := r.admin.logFeatures(name); ok != expected {
+			t.Errorf("log %q: expected in admin API=%t, got %t", name, expected, ok)
+		}
+	}
+
+	writeConfig("2023", "2024")
+	err = r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectServed("2023", true)
+	expectServed("2024", true)
+
+	writeConfig("2024")
+	err = r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectServed("2023", false)
+	expectServed("2024", true)
+
+	// Adding a log back registers its metrics again.
+	writeConfig("2023", "2024")
+	err = r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectServed("2023", true)
+}
+
+func TestLogRouterDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := newLogRouter()
+	router.add("2023", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	go router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/2023/ct/v1/get-sth", nil))
+	<-started
+
+	l := router.remove("2023")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/2023/ct/v1/get-sth", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected removed log to be not found, got %d", w.Code)
+	}
+
+	if l.drain(10 * time.Millisecond) {
+		t.Error("expected drain to time out with a request in flight")
+	}
+	close(release)
+	if !l.drain(time.Minute) {
+		t.Error("expected drain to finish once the request in flight did")
+	}
+	if !router.remove("2023").drain(time.Minute) {
+		t.Error("expected nothing to drain for an unknown log")
+	}
+}
+
+func TestConfigReloaderEndsStreams(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 4))
+	defer backend.Close()
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(names ...string) {
+		var logs []string
+		for _, name := range names {
+			logs = append(logs, fmt.Sprintf(`{"name": %q, "s3_prefix": %q}`, name, name+"/"))
+		}
+		err := os.WriteFile(configFile, []byte(`{"logs": [`+strings.Join(logs, ",")+`]}`), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("2023", "2024")
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err := fs.Parse([]string{"-config", configFile, "-log-url", backend.URL, "-tile-size", "4", "-s3-bucket", "b", "-tail-poll-interval", "10ms", "-full-request-timeout", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.resolveLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestConfigReloader(t, &cfg)
+	server := httptest.NewServer(r.router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/2023/ctile/v1/tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 for the tail, got %d", resp.StatusCode)
+	}
+
+	// Removing the log ends the stream, rather than waiting for the client
+	// to go away or for -full-request-timeout.
+	writeConfig("2024")
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- r.reload()
+	}()
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected removing a log to end its streams")
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+}
+
+func TestConfigWatchIntervalRequiresConfig(t *testing.T) {
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err := fs.Parse([]string{"-log-url", "https://oak.ct.letsencrypt.org/2023", "-config-watch-interval", "10s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.resolveLogs() == nil {
+		t.Error("expected error using -config-watch-interval without -config, got none")
+	}
+}
+
+func TestSecretReloaders(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 4))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "signing-keys")
+	encryptionKeyFile := filepath.Join(dir, "encryption-keys")
+	writeFile := func(path, contents string) {
+		err := os.WriteFile(path, []byte(contents), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(keyFile, "old\n")
+	writeFile(encryptionKeyFile, strings.Repeat("aa", 32)+"\n")
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	err := fs.Parse([]string{"-log-url", backend.URL, "-tile-size", "4", "-s3-bucket", "b", "-request-signing-key-file", keyFile, "-s3-encryption-key-file", encryptionKeyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.resolveLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = errors.Join(cfg.validate(), cfg.loadEncryption(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestConfigReloader(t, &cfg)
+	reloaders := secretReloaders(&cfg, nil, r.served)
+	if len(reloaders) != 2 {
+		t.Fatalf("expected reloaders for the signing and encryption keys, got %d", len(reloaders))
+	}
+	reloadAll := func() error {
+		var errs []error
+		for _, reloader := range reloaders {
+			errs = append(errs, reloader.reload())
+		}
+		return errors.Join(errs...)
+	}
+
+	expectStatus := func(key string, expected int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/ct/v1/get-entries?start=0&end=3", nil)
+		ctile.SignRequest(req, []byte(key), time.Now())
+		w := httptest.NewRecorder()
+		r.router.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("expected status %d for a request signed with %q, got %d", expected, key, w.Code)
+		}
+	}
+	expectStatus("old", http.StatusOK)
+
+	writeFile(keyFile, "new\nold\n")
+	writeFile(encryptionKeyFile, strings.Repeat("bb", 32)+"\n"+strings.Repeat("aa", 32)+"\n")
+	err = reloadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("new", http.StatusOK)
+	expectStatus("old", http.StatusOK)
+	if len(cfg.encryption.Keys) != 2 {
+		t.Errorf("expected 2 encryption keys after reloading, got %d", len(cfg.encryption.Keys))
+	}
+
+	// Removed keys stop being accepted, and invalid files keep the previous
+	// keys.
+	writeFile(keyFile, "new\n")
+	writeFile(encryptionKeyFile, "")
+	err = reloadAll()
+	if err == nil || !strings.Contains(err.Error(), "no keys") {
+		t.Errorf("expected an error for an empty encryption key file, got %v", err)
+	}
+	expectStatus("old", http.StatusUnauthorized)
+	if len(cfg.encryption.Keys) != 2 {
+		t.Errorf("expected the previous encryption keys to be kept, got %d", len(cfg.encryption.Keys))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// s3EventRetryDelay is how long the queue of -s3-events-queue-url is left
+// alone after a failed request.
+const s3EventRetryDelay = 5 * time.Second
+
+// s3EventWait is how long each request to -s3-events-queue-url waits for
+// messages to arrive: the longest SQS allows.
+const s3EventWait = 20
+
+// s3EventBatch is the most messages received, and deleted, at once: the most
+// SQS allows.
+const s3EventBatch = 10
+
+// sqsAPI is the part of *sqs.Client s3EventFollower uses.
+type sqsAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+}
+
+// s3EventFollower reports the S3 event notifications in a queue to the logs'
+// ctile.S3Events.
+type s3EventFollower struct {
+	sqs      sqsAPI
+	queueURL string
+	events   *ctile.S3Events
+
+	eventsMetric *prometheus.CounterVec
+	errorsMetric prometheus.Counter
+}
+
+func newS3EventFollower(sqsService sqsAPI, queueURL string, events *ctile.S3Events, registerer prometheus.Registerer) *s3EventFollower {
+	f := &s3EventFollower{
+		sqs:      sqsService,
+		queueURL: queueURL,
+		events:   events,
+		eventsMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_s3_events",
+			Help: "S3 event notifications received from -s3-events-queue-url, by type: created, removed, ignored, or invalid",
+		}, []string{"type"}),
+		errorsMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ctile_s3_event_queue_errors",
+			Help: "number of failed requests to -s3-events-queue-url",
+		}),
+	}
+	registerer.MustRegister(f.eventsMetric, f.errorsMetric)
+	return f
+}
+
+// follow polls the queue in the background for as long as the process runs.
+func (f *s3EventFollower) follow() {
+	go func() {
+		for {
+			err := f.poll(context.Background())
+			if err != nil {
+				f.errorsMetric.Inc()
+				log.Printf("warning: reading S3 event notifications: %s\n", err)
+				time.Sleep(s3EventRetryDelay)
+			}
+		}
+	}()
+}
+
+// poll waits for a batch of messages in the queue, reports the events in them,
+// and deletes them. Messages that aren't S3 event notifications are deleted
+// too, since they'd never be understood.
+func (f *s3EventFollower) poll(ctx context.Context) error {
+	out, err := f.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(f.queueURL),
+		MaxNumberOfMessages: s3EventBatch,
+		WaitTimeSeconds:     s3EventWait,
+	})
+	if err != nil {
+		return fmt.Errorf("receiving messages: %w", err)
+	}
+	if len(out.Messages) == 0 {
+		return nil
+	}
+	var entries []types.DeleteMessageBatchRequestEntry
+	for i, m := range out.Messages {
+		entries = append(entries, types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(fmt.Sprint(i)),
+			ReceiptHandle: m.ReceiptHandle,
+		})
+		events, err := parseS3Events(aws.ToString(m.Body))
+		if err != nil {
+			f.eventsMetric.WithLabelValues("invalid").Inc()
+			log.Printf("warning: ignoring message %s from -s3-events-queue-url: %s\n", aws.ToString(m.MessageId), err)
+			continue
+		}
+		for _, e := range events {
+			switch e.kind {
+			case s3ObjectCreated:
+				f.events.Created(e.bucket, e.key)
+			case s3ObjectRemoved:
+				f.events.Removed(e.bucket, e.key)
+			}
+			f.eventsMetric.WithLabelValues(string(e.kind)).Inc()
+		}
+	}
+	deleted, err := f.sqs.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(f.queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		return fmt.Errorf("deleting messages: %w", err)
+	}
+	if len(deleted.Failed) > 0 {
+		failed := deleted.Failed[0]
+		return fmt.Errorf("deleting %d of %d messages failed, first with %s: %s",
+			len(deleted.Failed), len(entries), aws.ToString(failed.Code), aws.ToString(failed.Message))
+	}
+	return nil
+}
+
+// s3EventKind is what happened to an object, as far as the cache goes.
+type s3EventKind string
+
+const (
+	s3ObjectCreated s3EventKind = "created"
+	s3ObjectRemoved s3EventKind = "removed"
+	s3ObjectIgnored s3EventKind = "ignored"
+)
+
+// s3Event is a change to an object in S3.
+type s3Event struct {
+	kind   s3EventKind
+	bucket string
+	key    string
+}
+
+// parseS3Events returns the events in body, an S3 event notification as S3
+// sends it to SQS, either directly or through SNS. The test event S3 sends
+// when notifications are set up has none.
+func parseS3Events(body string) ([]s3Event, error) {
+	var envelope struct {
+		Type    string
+		Message string
+	}
+	err := json.Unmarshal([]byte(body), &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("decoding S3 event notification: %w", err)
+	}
+	if envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	var notification struct {
+		Event   string
+		Records []struct {
+			EventName string `json:"eventName"`
+			S3        struct {
+				Bucket struct {
+					Name string `json:"name"`
+				} `json:"bucket"`
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		}
+	}
+	err = json.Unmarshal([]byte(body), &notification)
+	if err != nil {
+		return nil, fmt.Errorf("decoding S3 event notification: %w", err)
+	}
+	if notification.Event == "s3:TestEvent" {
+		return nil, nil
+	}
+	if notification.Records == nil {
+		return nil, fmt.Errorf("not an S3 event notification: %.100s", body)
+	}
+	var events []s3Event
+	for _, r := range notification.Records {
+		// Keys are URL-encoded, with spaces as "+".
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %q in S3 event notification: %w", r.S3.Object.Key, err)
+		}
+		kind := s3ObjectIgnored
+		switch {
+		case strings.HasPrefix(r.EventName, "ObjectCreated:"):
+			kind = s3ObjectCreated
+		case strings.HasPrefix(r.EventName, "ObjectRemoved:"), strings.HasPrefix(r.EventName, "LifecycleExpiration:"):
+			kind = s3ObjectRemoved
+		}
+		events = append(events, s3Event{kind, r.S3.Bucket.Name, key})
+	}
+	return events, nil
+}
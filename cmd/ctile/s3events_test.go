@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile"
+)
+
+func TestParseS3Events(t *testing.T) {
+	testCases := []struct {
+		name     string
+		body     string
+		expected []s3Event
+		invalid  bool
+	}{
+		{
+			name: "direct",
+			body: `{"Records":[
+				{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"tiles"},"object":{"key":"oak%2F2024%2Ftile_size%3D256%2F512.cbor.gz","size":1024}}},
+				{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"tiles"},"object":{"key":"with+space/0.cbor.gz"}}},
+				{"eventName":"LifecycleExpiration:Delete","s3":{"bucket":{"name":"tiles"},"object":{"key":"expired"}}},
+				{"eventName":"ObjectRestore:Completed","s3":{"bucket":{"name":"tiles"},"object":{"key":"restored"}}}
+			]}`,
+			expected: []s3Event{
+				{s3ObjectCreated, "tiles", "oak/2024/tile_size=256/512.cbor.gz"},
+				{s3ObjectRemoved, "tiles", "with space/0.cbor.gz"},
+				{s3ObjectRemoved, "tiles", "expired"},
+				{s3ObjectIgnored, "tiles", "restored"},
+			},
+		},
+		{
+			name: "SNS",
+			body: `{"Type":"Notification","MessageId":"1","Message":"{\"Records\":[{\"eventName\":\"ObjectCreated:CompleteMultipartUpload\",\"s3\":{\"bucket\":{\"name\":\"tiles\"},\"object\":{\"key\":\"a\"}}}]}"}`,
+			expected: []s3Event{
+				{s3ObjectCreated, "tiles", "a"},
+			},
+		},
+		{
+			name: "test event",
+			body: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"tiles"}`,
+		},
+		{
+			name:    "not JSON",
+			body:    `hello`,
+			invalid: true,
+		},
+		{
+			name:    "not a notification",
+			body:    `{"hello":"world"}`,
+			invalid: true,
+		},
+		{
+			name:    "bad key",
+			body:    `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"tiles"},"object":{"key":"%zz"}}}]}`,
+			invalid: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := parseS3Events(tc.body)
+			if tc.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", events)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(events, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, events)
+			}
+		})
+	}
+}
+
+// fakeSQS is an sqsAPI holding one batch of messages for one queue.
+type fakeSQS struct {
+	queueURL string
+	messages []types.Message
+	deleted  []string
+}
+
+func (f *fakeSQS) ReceiveMessage(_ context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if aws.ToString(in.QueueUrl) != f.queueURL {
+		return nil, &types.QueueDoesNotExist{}
+	}
+	return &sqs.ReceiveMessageOutput{Messages: f.messages}, nil
+}
+
+func (f *fakeSQS) DeleteMessageBatch(_ context.Context, in *sqs.DeleteMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	if aws.ToString(in.QueueUrl) != f.queueURL {
+		return nil, &types.QueueDoesNotExist{}
+	}
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		if aws.ToString(entry.ReceiptHandle) == "expired" {
+			out.Failed = append(out.Failed, types.BatchResultErrorEntry{
+				Id:      entry.Id,
+				Code:    aws.String("ReceiptHandleIsInvalid"),
+				Message: aws.String("expired"),
+			})
+			continue
+		}
+		f.deleted = append(f.deleted, aws.ToString(entry.ReceiptHandle))
+	}
+	return out, nil
+}
+
+func TestS3EventFollower(t *testing.T) {
+	const queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/ctile"
+	fake := &fakeSQS{queueURL: queueURL, messages: []types.Message{
+		{MessageId: aws.String("1"), ReceiptHandle: aws.String("a"), Body: aws.String(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"tiles"},"object":{"key":"a"}}},{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"tiles"},"object":{"key":"b"}}}]}`)},
+		{MessageId: aws.String("2"), ReceiptHandle: aws.String("b"), Body: aws.String(`garbage`)},
+		{MessageId: aws.String("3"), ReceiptHandle: aws.String("c"), Body: aws.String(`{"Event":"s3:TestEvent"}`)},
+	}}
+	f := newS3EventFollower(fake, queueURL, ctile.NewS3Events(), prometheus.NewRegistry())
+	err := f.poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kind, expected := range map[string]float64{"created": 1, "removed": 1, "ignored": 0, "invalid": 1} {
+		if count := testutil.ToFloat64(f.eventsMetric.WithLabelValues(kind)); count != expected {
+			t.Errorf("expected %g %s events, got %g", expected, kind, count)
+		}
+	}
+	// Every message is deleted, including those that can't be understood.
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(fake.deleted, expected) {
+		t.Errorf("expected messages %q to be deleted, got %q", expected, fake.deleted)
+	}
+
+	// Messages that couldn't be deleted are reported, to be handled again.
+	fake.messages = []types.Message{{MessageId: aws.String("4"), ReceiptHandle: aws.String("expired"), Body: aws.String(`{"Event":"s3:TestEvent"}`)}}
+	err = f.poll(context.Background())
+	if err == nil {
+		t.Errorf("expected an error for a message that couldn't be deleted")
+	}
+
+	f = newS3EventFollower(fake, queueURL+"-other", ctile.NewS3Events(), prometheus.NewRegistry())
+	err = f.poll(context.Background())
+	if err == nil {
+		t.Errorf("expected an error for a missing queue")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// selftestStep is one check performed by -selftest.
+type selftestStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// selftest performs a round trip through every dependency of the server: S3
+// (put, get, and delete of a probe object), each replica of the backend
+// (get-sth, or checkpoint for a static CT backend), and the handler itself (one get-entries request). It writes a
+// report to w and returns true if every step passed.
+//
+// Steps that don't apply to the configured mode are skipped: S3 in
+// proxy-only mode, the backend in cache-only mode, and S3 writes in dry-run
+// mode.
+func selftest(ctx context.Context, w io.Writer, cfg *logConfig, dryRun bool, svc ctile.S3API, handler http.Handler) bool {
+	probeKey := fmt.Sprintf("%sctile-selftest/%d", cfg.S3Prefix, time.Now().UnixNano())
+	probeBody := []byte("ctile selftest probe\n")
+
+	var steps []selftestStep
+	if svc != nil && cfg.usesS3() && !dryRun {
+		steps = append(steps,
+			selftestStep{"s3 put", func(ctx context.Context) error {
+				_, err := svc.PutObject(ctx, &s3.PutObjectInput{
+					Bucket: aws.String(cfg.S3Bucket),
+					Key:    aws.String(probeKey),
+					Body:   bytes.NewReader(probeBody),
+				})
+				return err
+			}},
+			selftestStep{"s3 get", func(ctx context.Context) error {
+				resp, err := svc.GetObject(ctx, &s3.GetObjectInput{
+					Bucket: aws.String(cfg.S3Bucket),
+					Key:    aws.String(probeKey),
+				})
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(body, probeBody) {
+					return fmt.Errorf("probe object came back as %q, expected %q", body, probeBody)
+				}
+				return nil
+			}},
+			selftestStep{"s3 delete", func(ctx context.Context) error {
+				resp, err := svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+					Bucket: aws.String(cfg.S3Bucket),
+					Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String(probeKey)}}},
+				})
+				if err != nil {
+					return err
+				}
+				if len(resp.Errors) > 0 {
+					return fmt.Errorf("deleting %s: %s", probeKey, aws.ToString(resp.Errors[0].Message))
+				}
+				return nil
+			}},
+		)
+	}
+	if cfg.mode != ctile.ModeCacheOnly {
+		logURLs := cfg.logURLs()
+		for _, logURL := range logURLs {
+			logURL := logURL
+			name := "backend get-sth"
+			check := func(ctx context.Context) error {
+				_, err := getTreeSize(ctx, logURL)
+				return err
+			}
+			switch cfg.backendType {
+			case ctile.BackendStaticCT:
+				name = "backend checkpoint"
+				check = func(ctx context.Context) error {
+					return getOK(ctx, logURL+"/checkpoint")
+				}
+			case ctile.BackendRFC9162:
+				name = "backend v2 get-sth"
+				check = func(ctx context.Context) error {
+					return getOK(ctx, logURL+"/ct/v2/get-sth")
+				}
+			}
+			if len(logURLs) > 1 {
+				name += " " + logURL
+			}
+			steps = append(steps, selftestStep{name, check})
+		}
+	}
+	steps = append(steps, selftestStep{"get-entries", func(ctx context.Context) error {
+		path := "/ct/v1/get-entries?start=0&end=0"
+		if cfg.backendType == ctile.BackendRFC9162 {
+			path = "/ct/v2/get-entries?start=0&end=0"
+		}
+		req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("status code %d: %s", rec.Code, bytes.TrimSpace(rec.Body.Bytes()))
+		}
+		var entries ctile.Entries
+		err := json.Unmarshal(rec.Body.Bytes(), &entries)
+		if err != nil {
+			return fmt.Errorf("parsing response: %w", err)
+		}
+		if len(entries.Entries) != 1 {
+			return fmt.Errorf("expected 1 entry, got %d", len(entries.Entries))
+		}
+		return nil
+	}})
+
+	ok := true
+	for _, step := range steps {
+		stepCtx, cancel := context.WithTimeout(ctx, cfg.FullRequestTimeout.Duration)
+		begin := time.Now()
+		err := step.run(stepCtx)
+		took := time.Since(begin).Round(time.Millisecond)
+		cancel()
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "FAIL %s (%s): %s\n", step.name, took, err)
+			continue
+		}
+		fmt.Fprintf(w, "PASS %s (%s)\n", step.name, took)
+	}
+	if !ok {
+		fmt.Fprintln(w, "selftest failed")
+		return false
+	}
+	fmt.Fprintln(w, "selftest passed")
+	return true
+}
+
+// getOK fetches url, returning an error unless it succeeds.
+func getOK(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: status code %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile"
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestSelftest(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 5))
+	defer backend.Close()
+
+	svc := s3mem.New()
+	cfg := &logConfig{
+		LogURL:             backend.URL,
+		TileSize:           5,
+		S3Bucket:           "bucket",
+		S3Prefix:           "test/",
+		FullRequestTimeout: duration{5 * time.Second},
+		Mode:               string(ctile.ModeNormal),
+		mode:               ctile.ModeNormal,
+	}
+	handler, err := ctile.New(cfg.LogURL, ctile.WithTileSize(cfg.TileSize), ctile.WithS3(svc, cfg.S3Bucket, cfg.S3Prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report bytes.Buffer
+	if !selftest(context.Background(), &report, cfg, false, svc, handler) {
+		t.Fatalf("expected selftest to pass, got report:\n%s", report.String())
+	}
+	for _, step := range []string{"PASS s3 put", "PASS s3 get", "PASS s3 delete", "PASS backend get-sth", "PASS get-entries"} {
+		if !strings.Contains(report.String(), step) {
+			t.Errorf("expected report to contain %q, got:\n%s", step, report.String())
+		}
+	}
+	listing, err := svc.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Contents) != 1 || aws.ToString(listing.Contents[0].Key) != "test/tile_size=5/0.cbor.gz" {
+		t.Errorf("expected only the tile fetched by get-entries to remain in S3, got %d objects", len(listing.Contents))
+	}
+
+	backend.Close()
+	report.Reset()
+	if selftest(context.Background(), &report, cfg, false, nil, handler) {
+		t.Fatalf("expected selftest to fail with the backend down, got report:\n%s", report.String())
+	}
+	if !strings.Contains(report.String(), "FAIL backend get-sth") || strings.Contains(report.String(), "s3 put") {
+		t.Errorf("expected only the backend to fail and S3 to be skipped, got report:\n%s", report.String())
+	}
+}
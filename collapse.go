@@ -0,0 +1,89 @@
+package ctile
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CollapseGroup collapses simultaneous requests for the same tile into one
+// fetch. Each Handler has its own by default; Handlers given the same
+// CollapseGroup with WithCollapseGroup also collapse requests across each
+// other, according to their CollapseKey.
+type CollapseGroup struct {
+	group singleflight.Group
+}
+
+// NewCollapseGroup returns a CollapseGroup to share between Handlers.
+func NewCollapseGroup() *CollapseGroup {
+	return &CollapseGroup{}
+}
+
+// WithCollapseGroup makes the Handler collapse requests in group, which may be
+// shared with other Handlers.
+func WithCollapseGroup(group *CollapseGroup) Option {
+	return func(o *options) {
+		o.collapseGroup = group
+	}
+}
+
+// CollapseKey selects what distinguishes requests for a tile when collapsing
+// them. The zero value keys on the full log URL, the Mode and BackendType, the
+// S3 bucket and prefix, where the tile is stored under them and in what
+// TileFormat, the tile size, and the tile's position. That keeps Handlers
+// sharing a CollapseGroup that fetch or store tiles differently apart, but not
+// all settings are in the key: Handlers sharing a CollapseGroup must also
+// agree on encryption, validation, and the objects written besides tiles,
+// such as chains and precompressed JSON, since only the Handler whose fetch is
+// shared applies its own.
+type CollapseKey struct {
+	// ExcludeLogHost leaves the scheme and host of the log URL out of the key,
+	// so the same log reached through several hostnames collapses together.
+	ExcludeLogHost bool
+	// ExcludeTileSize leaves the tile size out of the key. This is only safe
+	// if every Handler sharing the CollapseGroup uses the same tile size.
+	ExcludeTileSize bool
+	// ExcludeS3Location leaves the S3 bucket and prefix, the tile's key under
+	// them, and the TileFormat out of the key. This is only safe if every
+	// Handler sharing the CollapseGroup caches the log in the same place and
+	// the same way, since only the Handler whose fetch is shared writes the
+	// tile to S3.
+	ExcludeS3Location bool
+}
+
+// WithCollapseKey sets how requests are matched for collapsing.
+func WithCollapseKey(key CollapseKey) Option {
+	return func(o *options) {
+		o.collapseKey = key
+	}
+}
+
+// collapseKey returns the key to collapse requests for t under.
+func (tch *Handler) collapseKey(t tile) string {
+	var b strings.Builder
+	logURL := t.logURL
+	if tch.collapseKeyConfig.ExcludeLogHost {
+		u, err := url.Parse(logURL)
+		if err == nil {
+			logURL = u.Path
+		}
+	}
+	fmt.Fprintf(&b, "logURL-%s-mode-%s-backend-%s", logURL, tch.mode, tch.backendType)
+	if !tch.collapseKeyConfig.ExcludeS3Location {
+		bucket, prefix := tch.location(t)
+		fmt.Fprintf(&b, "-s3-%s/%s%s", bucket, prefix, tch.objectKey(t, tch.tileKey(t)))
+		if tch.superTiles > 1 {
+			fmt.Fprintf(&b, "-x%d", tch.superTiles)
+		}
+		f := tch.tileFormat
+		fmt.Fprintf(&b, "-format-%s-%d-%t", f.Serialization, f.GzipLevel, f.Uncompressed)
+	}
+	if tch.collapseKeyConfig.ExcludeTileSize {
+		fmt.Fprintf(&b, "-tile-%d", t.start)
+	} else {
+		fmt.Fprintf(&b, "-tile-%d-%d", t.start, t.end)
+	}
+	return b.String()
+}
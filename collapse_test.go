@@ -0,0 +1,229 @@
+package ctile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestCollapseKey(t *testing.T) {
+	tile := makeTile(512, 256, "https://oak.ct.letsencrypt.org/2023")
+	testCases := []struct {
+		key      CollapseKey
+		expected string
+	}{
+		{CollapseKey{}, "logURL-https://oak.ct.letsencrypt.org/2023-mode-normal-backend-rfc6962-s3-bucket/prefix/tile_size=256/512.cbor.gz-format-cbor-0-false-tile-512-768"},
+		{CollapseKey{ExcludeLogHost: true, ExcludeS3Location: true}, "logURL-/2023-mode-normal-backend-rfc6962-tile-512-768"},
+		{CollapseKey{ExcludeTileSize: true, ExcludeS3Location: true}, "logURL-https://oak.ct.letsencrypt.org/2023-mode-normal-backend-rfc6962-tile-512"},
+		{CollapseKey{ExcludeS3Location: true}, "logURL-https://oak.ct.letsencrypt.org/2023-mode-normal-backend-rfc6962-tile-512-768"},
+	}
+	for _, tc := range testCases {
+		tch := &Handler{s3Bucket: "bucket", s3Prefix: "prefix/", mode: ModeNormal, backendType: BackendRFC6962, tileFormat: TileFormat{Serialization: SerializationCBOR}, collapseKeyConfig: tc.key}
+		got := tch.collapseKey(tile)
+		if got != tc.expected {
+			t.Errorf("%+v: expected %q, got %q", tc.key, tc.expected, got)
+		}
+	}
+
+	// Handlers that fetch or store tiles differently don't collapse together.
+	newHandler := func() *Handler {
+		return &Handler{s3Bucket: "bucket", s3Prefix: "prefix/", mode: ModeNormal, backendType: BackendRFC6962, tileFormat: TileFormat{Serialization: SerializationCBOR}}
+	}
+	base := newHandler()
+	for name, modify := range map[string]func(*Handler){
+		"mode":          func(h *Handler) { h.mode = ModeCacheOnly },
+		"backend type":  func(h *Handler) { h.backendType = BackendStaticCT },
+		"key layout":    func(h *Handler) { h.keyLayout = KeyLayoutHashed },
+		"super-tiles":   func(h *Handler) { h.superTiles = 4 },
+		"serialization": func(h *Handler) { h.tileFormat.Serialization = SerializationJSON },
+		"compression":   func(h *Handler) { h.tileFormat.Uncompressed = true },
+	} {
+		other := newHandler()
+		modify(other)
+		if base.collapseKey(tile) == other.collapseKey(tile) {
+			t.Errorf("expected Handlers with a different %s to have different keys", name)
+		}
+	}
+}
+
+func TestCoalescedEndpoints(t *testing.T) {
+	const clients = 5
+	testCases := []struct {
+		name             string
+		opts             []Option
+		path             string
+		expectedRequests int64
+	}{
+		{"get-sth", nil, "/ct/v1/get-sth", 1},
+		{"different queries", []Option{WithCoalescedEndpoints("get-sth-consistency")}, "/ct/v1/get-sth-consistency?first=%d&second=10", clients},
+		{"not coalesced", nil, "/ct/v1/get-proof-by-hash", clients},
+		{"disabled", []Option{WithCoalescedEndpoints()}, "/ct/v1/get-sth", clients},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int64
+			arrived := make(chan struct{}, clients)
+			release := make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				arrived <- struct{}{}
+				<-release
+				if strings.Contains(tc.path, "?") && r.URL.RawQuery == "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = io.WriteString(w, `{"tree_size":3}`)
+			}))
+			defer backend.Close()
+
+			handler, err := New(backend.URL, append([]Option{
+				WithTileSize(3),
+				WithS3(s3mem.New(), "bucket", "test/"),
+			}, tc.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			waiting := make(chan struct{}, clients)
+			handler.passthroughWaiting = func() { waiting <- struct{}{} }
+
+			var wg sync.WaitGroup
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					path := tc.path
+					if strings.Contains(path, "%d") {
+						path = fmt.Sprintf(path, i)
+					}
+					resp := getResp(handler, path)
+					defer resp.Body.Close()
+					body, _ := io.ReadAll(resp.Body)
+					if resp.StatusCode != http.StatusOK || string(body) != `{"tree_size":3}` {
+						t.Errorf("expected the backend's response, got %d %q", resp.StatusCode, body)
+					}
+					if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+						t.Errorf("expected the backend's Content-Type, got %q", contentType)
+					}
+				}(i)
+			}
+			for i := int64(0); i < tc.expectedRequests; i++ {
+				<-arrived
+			}
+			if tc.expectedRequests < clients {
+				// Wait for the other requests to join the first.
+				for i := 0; i < clients; i++ {
+					<-waiting
+				}
+			}
+			close(release)
+			wg.Wait()
+
+			if requests.Load() != tc.expectedRequests {
+				t.Errorf("expected %d requests to the backend, got %d", tc.expectedRequests, requests.Load())
+			}
+		})
+	}
+}
+
+func TestCoalescedEndpointsFirstClientGone(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		_, _ = io.WriteString(w, `{"tree_size":3}`)
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan struct{}, 2)
+	handler.passthroughWaiting = func() { waiting <- struct{}{} }
+
+	// The first client starts the shared fetch, then goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		req := httptest.NewRequest("GET", "/ct/v1/get-sth", nil).WithContext(ctx)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-arrived
+	<-waiting
+
+	secondDone := make(chan *http.Response)
+	go func() {
+		secondDone <- getResp(handler, "/ct/v1/get-sth")
+	}()
+	<-waiting
+	// The first request returns once its client goes away, while the fetch
+	// is still in flight.
+	cancel()
+	<-firstDone
+	close(release)
+
+	resp := <-secondDone
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"tree_size":3}` {
+		t.Errorf("expected the backend's response, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestCollapseGroupSeparatesS3Locations(t *testing.T) {
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	fake := fakelog.New(10, 3)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		fake.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	s3Service := s3mem.New()
+	group := NewCollapseGroup()
+	var handlers []*Handler
+	for _, prefix := range []string{"a/", "b/"} {
+		handler, err := New(backend.URL, WithTileSize(3), WithS3(s3Service, "bucket", prefix), WithCollapseGroup(group))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handlers = append(handlers, handler)
+	}
+
+	var wg sync.WaitGroup
+	for _, handler := range handlers {
+		wg.Add(1)
+		go func(handler *Handler) {
+			defer wg.Done()
+			resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status 200, got %d", resp.StatusCode)
+			}
+		}(handler)
+	}
+	// Each location fetches the tile for itself.
+	<-arrived
+	<-arrived
+	close(release)
+	wg.Wait()
+
+	for _, prefix := range []string{"a/", "b/"} {
+		_, err := GetTileObject(context.Background(), s3Service, "bucket", prefix+TileKey(3, 0))
+		if err != nil {
+			t.Errorf("expected the tile to be cached under %q: %s", prefix, err)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package ctile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// compressionMinSize is the size below which responses aren't compressed,
+// since they'd gain too little.
+const compressionMinSize = 100
+
+// An Encoder is a content coding responses can be compressed with, such as
+// br or zstd, whose implementations aren't in the standard library.
+type Encoder struct {
+	// Name is the content coding, as in Accept-Encoding, e.g. "zstd".
+	Name string
+	// NewWriter returns a writer that compresses what's written to it into
+	// w. Close must write the rest of the compressed stream, but not close w.
+	NewWriter func(w io.Writer) EncoderWriter
+}
+
+// EncoderWriter compresses a response for an Encoder.
+type EncoderWriter interface {
+	io.WriteCloser
+	// Flush writes what's been compressed so far, for streaming responses.
+	Flush() error
+}
+
+// WithResponseEncoders adds content codings that responses can be compressed
+// with, besides gzip. Each response is compressed with the coding the client
+// prefers, by the q-values in its Accept-Encoding, and among those it likes
+// equally, the first of encoders, then gzip. For instance, with Encoders for
+// zstd and br, a client that accepts "gzip, br, zstd" gets zstd. Calling it
+// more than once replaces earlier encoders.
+//
+// Each encoder is only offered to requests for which the Feature named after
+// it, e.g. "zstd", is enabled by WithFeatureFlags, so new codings can be
+// rolled out gradually. Other requests get the next coding they accept.
+func WithResponseEncoders(encoders ...Encoder) Option {
+	return func(o *options) {
+		o.responseEncoders = encoders
+	}
+}
+
+// gzipEncoder is the built-in gzip coding, with writers kept in a pool.
+var gzipEncoder = func() Encoder {
+	var writers sync.Pool
+	return Encoder{
+		Name: "gzip",
+		NewWriter: func(w io.Writer) EncoderWriter {
+			gz, ok := writers.Get().(*gzip.Writer)
+			if !ok {
+				gz, _ = gzip.NewWriterLevel(nil, gzip.BestSpeed)
+			}
+			gz.Reset(w)
+			return pooledGzipWriter{gz, &writers}
+		},
+	}
+}()
+
+// pooledGzipWriter returns its gzip.Writer to the pool when it's closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.Writer.Reset(nil)
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// compressor compresses the responses of a Handler for clients that accept
+// one of its encoders, unless they're already encoded, like precompressed
+// JSON.
+//
+// ctile_compressed_responses counts compressed responses,
+// ctile_compression_seconds the time spent compressing them, and
+// ctile_compression_saved_bytes the difference between their sizes before and
+// after, all by content coding.
+type compressor struct {
+	encoders []Encoder     // In order of preference, ending with gzipEncoder.
+	features *FeatureFlags // Gates every encoder but gzipEncoder. May be nil.
+
+	responses  *prometheus.CounterVec
+	seconds    *prometheus.CounterVec
+	savedBytes *prometheus.CounterVec
+}
+
+func newCompressor(encoders []Encoder, features *FeatureFlags, promRegisterer prometheus.Registerer) (*compressor, error) {
+	c := &compressor{
+		features: features,
+		responses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ctile_compressed_responses",
+				Help: "Responses compressed for the client, by content coding",
+			},
+			[]string{"encoding"}),
+		seconds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ctile_compression_seconds",
+				Help: "Time spent compressing responses, by content coding",
+			},
+			[]string{"encoding"}),
+		savedBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ctile_compression_saved_bytes",
+				Help: "Bytes of responses saved by compressing them, by content coding",
+			},
+			[]string{"encoding"}),
+	}
+	seen := map[string]bool{"gzip": true, "identity": true, "*": true}
+	for _, e := range encoders {
+		name := strings.ToLower(e.Name)
+		if name == "" || e.NewWriter == nil {
+			return nil, errors.New("response encoders must have a name and NewWriter")
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("response encoder %q is built in or given twice", e.Name)
+		}
+		if !validFeature.MatchString(name) {
+			return nil, fmt.Errorf("response encoder %q can't be rolled out as a feature", e.Name)
+		}
+		seen[name] = true
+		c.encoders = append(c.encoders, Encoder{name, e.NewWriter})
+	}
+	c.encoders = append(c.encoders, gzipEncoder)
+	promRegisterer.MustRegister(c.responses, c.seconds, c.savedBytes)
+	return c, nil
+}
+
+// negotiate returns the encoder to compress the response to r with, or nil
+// if r doesn't accept any that's enabled for it.
+func (c *compressor) negotiate(r *http.Request) *Encoder {
+	accepted := make(map[string]float64)
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			weight, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				weight = 0
+			}
+		}
+		accepted[name] = weight
+	}
+	var best *Encoder
+	var bestWeight float64
+	for i, e := range c.encoders {
+		weight, ok := accepted[e.Name]
+		if !ok {
+			weight = accepted["*"]
+		}
+		if weight <= bestWeight {
+			continue
+		}
+		if e.Name != gzipEncoder.Name && !c.features.enabled(Feature(e.Name)) {
+			continue
+		}
+		best, bestWeight = &c.encoders[i], weight
+	}
+	return best
+}
+
+// wrap returns h, with its responses compressed.
+func (c *compressor) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoder := c.negotiate(r)
+		if encoder == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+			r = r.Clone(r.Context())
+			r.Header.Del("If-None-Match")
+			if decoded := decodeIfNoneMatch(ifNoneMatch, encoder.Name); decoded != "" {
+				r.Header.Set("If-None-Match", decoded)
+			}
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c, encoder: encoder}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the start of a response until it knows whether to
+// compress it: if it's at least compressionMinSize bytes, and not already
+// encoded.
+type compressWriter struct {
+	http.ResponseWriter
+	c       *compressor
+	encoder *Encoder
+
+	status  int    // The status code of the response, once it's written.
+	started bool   // Whether the status code has been sent to the client.
+	buf     []byte // The start of the body, until started.
+
+	zw      EncoderWriter // Nil unless the response is compressed.
+	in, out int64         // The sizes of a compressed response before and after.
+	elapsed time.Duration
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	if cw.Header().Get("Content-Encoding") != "" {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.started {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < compressionMinSize {
+			return len(b), nil
+		}
+		return len(b), cw.start(true)
+	}
+	if cw.zw == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.compress(b)
+}
+
+// start sends the status code, and the body so far, compressed if compress
+// is true.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// Sniffed from the uncompressed body, as net/http would.
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if etag := header.Get("ETag"); etag != "" && (compress || cw.status == http.StatusNotModified) {
+		header.Set("ETag", encodedETag(etag, cw.encoder.Name))
+	}
+	if compress {
+		header.Set("Content-Encoding", cw.encoder.Name)
+		header.Del("Content-Length")
+		cw.zw = cw.encoder.NewWriter(countingWriter{cw.ResponseWriter, &cw.out})
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.zw != nil {
+		_, err = cw.compress(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// compress writes b to the client through cw.zw.
+func (cw *compressWriter) compress(b []byte) (int, error) {
+	begin := time.Now()
+	n, err := cw.zw.Write(b)
+	cw.elapsed += time.Since(begin)
+	cw.in += int64(n)
+	return n, err
+}
+
+// Flush sends what's been written so far to the client, compressed if it
+// had reached compressionMinSize.
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.started {
+		_ = cw.start(len(cw.buf) >= compressionMinSize)
+	}
+	if cw.zw != nil {
+		begin := time.Now()
+		_ = cw.zw.Flush()
+		cw.elapsed += time.Since(begin)
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the ResponseWriter cw wraps, for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the response, and counts it if it was compressed.
+func (cw *compressWriter) close() {
+	if cw.status == 0 {
+		return
+	}
+	if !cw.started {
+		err := cw.start(false)
+		if err != nil {
+			log.Printf("error copying response body to client: %s\n", err)
+		}
+		return
+	}
+	if cw.zw == nil {
+		return
+	}
+	begin := time.Now()
+	err := cw.zw.Close()
+	cw.elapsed += time.Since(begin)
+	if err != nil {
+		log.Printf("error copying response body to client: %s\n", err)
+	}
+	name := cw.encoder.Name
+	cw.c.responses.WithLabelValues(name).Inc()
+	cw.c.seconds.WithLabelValues(name).Add(cw.elapsed.Seconds())
+	if saved := cw.in - cw.out; saved > 0 {
+		cw.c.savedBytes.WithLabelValues(name).Add(float64(saved))
+	}
+}
+
+// countingWriter adds the number of bytes written to w to n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,172 @@
+package ctile
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestCompression(t *testing.T) {
+	log := fakelog.New(10, 10)
+	roots := `{"certificates":["` + strings.Repeat("root", 100) + `"]}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ct/v1/get-roots" {
+			io.WriteString(w, roots)
+			return
+		}
+		log.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		url            string
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"/ct/v1/get-entries?start=0&end=4", "gzip", true},
+		{"/ct/v1/get-entries?start=0&end=4", "deflate, gzip;q=0.5", true},
+		{"/ct/v1/get-entries?start=0&end=4", "", false},
+		{"/ct/v1/get-entries?start=0&end=4", "gzip;q=0", false},
+		// Passed through.
+		{"/ct/v1/get-roots", "gzip", true},
+		// Too small to be worth it.
+		{"/ct/v1/get-entries?start=0", "gzip", false},
+	} {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+		if vary := resp.Header.Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("%s (Accept-Encoding %q): expected Vary: Accept-Encoding, got %q", test.url, test.acceptEncoding, vary)
+		}
+		gzipped := resp.Header.Get("Content-Encoding") == "gzip"
+		if gzipped != test.gzipped {
+			t.Errorf("%s (Accept-Encoding %q): expected gzipped %t, got %t", test.url, test.acceptEncoding, test.gzipped, gzipped)
+			continue
+		}
+		body := resp.Body
+		if gzipped {
+			body, err = gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		contents, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: reading body: %s", test.url, err)
+		}
+		if test.url == "/ct/v1/get-roots" && string(contents) != roots {
+			t.Errorf("%s: expected the backend's body, got %q", test.url, contents)
+		}
+		if ct := resp.Header.Get("Content-Type"); gzipped && !strings.HasPrefix(ct, "application/json") && !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%s: expected the Content-Type of the uncompressed body, got %q", test.url, ct)
+		}
+	}
+
+	if n := testutil.ToFloat64(handler.compressor.responses.WithLabelValues("gzip")); n != 3 {
+		t.Errorf("expected 3 compressed responses, got %g", n)
+	}
+	if saved := testutil.ToFloat64(handler.compressor.savedBytes.WithLabelValues("gzip")); saved < float64(len(roots))/2 {
+		t.Errorf("expected at least %d bytes saved, got %g", len(roots)/2, saved)
+	}
+}
+
+// deflateEncoder stands in for encoders like br and zstd.
+var deflateEncoder = Encoder{
+	Name: "deflate",
+	NewWriter: func(w io.Writer) EncoderWriter {
+		zw, _ := zlib.NewWriterLevel(w, zlib.BestSpeed)
+		return zw
+	},
+}
+
+func TestResponseEncoders(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 10))
+	defer backend.Close()
+	flags := rolledOut(t, 100, "deflate")
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"),
+		WithResponseEncoders(deflateEncoder), WithFeatureFlags(flags))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		// The server's preference breaks ties.
+		{"gzip, deflate", "deflate"},
+		{"*", "deflate"},
+		{"deflate;q=0.5, gzip", "gzip"},
+		{"*, deflate;q=0", "gzip"},
+		{"br", ""},
+	} {
+		req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=4", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != test.expected {
+			t.Errorf("Accept-Encoding %q: expected Content-Encoding %q, got %q", test.acceptEncoding, test.expected, encoding)
+			continue
+		}
+		var body io.Reader = resp.Body
+		switch test.expected {
+		case "deflate":
+			body, err = zlib.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case "gzip":
+			body, err = gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		contents, err := io.ReadAll(body)
+		if err != nil || !strings.HasPrefix(string(contents), `{`) {
+			t.Errorf("Accept-Encoding %q: expected a JSON body, got %q (%v)", test.acceptEncoding, contents, err)
+		}
+	}
+	if n := testutil.ToFloat64(handler.compressor.responses.WithLabelValues("deflate")); n != 2 {
+		t.Errorf("expected 2 responses compressed with deflate, got %g", n)
+	}
+
+	// Rolled out to no requests, the encoder isn't offered.
+	err = flags.Set("deflate", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=4", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if encoding := w.Result().Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("expected gzip with deflate rolled out to no requests, got %q", encoding)
+	}
+
+	for _, encoder := range []Encoder{{Name: "gzip", NewWriter: deflateEncoder.NewWriter}, {Name: "br"}} {
+		_, err = New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"),
+			WithResponseEncoders(encoder))
+		if err == nil {
+			t.Errorf("expected an error for encoder %q", encoder.Name)
+		}
+	}
+}
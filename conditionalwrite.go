@@ -0,0 +1,40 @@
+package ctile
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// WithConditionalWrites, if conditional is true, makes the Handler write
+// tiles to S3 with If-None-Match: *, so when several instances fetch the
+// same tile at once, only the first write stores it, and the others are
+// answered with 412 Precondition Failed instead of uploading it again. Those
+// are counted in ctile_s3_writes_suppressed, and treated as successful, since
+// the tile is cached either way. It needs S3 or a compatible store that
+// supports conditional writes; Azure, the local directory, and memory stores
+// ignore it and always write.
+func WithConditionalWrites(conditional bool) Option {
+	return func(o *options) {
+		o.conditionalWrites = conditional
+	}
+}
+
+// ifNoneMatch makes a PutObject request fail if the object already exists.
+func ifNoneMatch(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("If-None-Match", "*"))
+}
+
+// alreadyWritten returns true if err is a conditional write's response that
+// the object exists: 412 Precondition Failed, or 409 Conflict if another
+// conditional write of it is in progress.
+func alreadyWritten(err error) bool {
+	var statusErr interface{ HTTPStatusCode() int }
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	code := statusErr.HTTPStatusCode()
+	return code == http.StatusPreconditionFailed || code == http.StatusConflict
+}
@@ -0,0 +1,84 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// statusError is an S3 error response with an HTTP status code.
+type statusError int
+
+func (e statusError) Error() string       { return http.StatusText(int(e)) }
+func (e statusError) HTTPStatusCode() int { return int(e) }
+
+// conditionalS3 is an in-memory S3 that, like S3, fails conditional writes of
+// objects that exist with 412 Precondition Failed.
+type conditionalS3 struct {
+	*s3mem.Client
+}
+
+func (c conditionalS3) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var o s3.Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.APIOptions) > 0 {
+		_, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: in.Bucket, Key: in.Key})
+		if err == nil {
+			return nil, statusError(http.StatusPreconditionFailed)
+		}
+	}
+	return c.Client.PutObject(ctx, in, opts...)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	svc := conditionalS3{s3mem.New()}
+
+	// Two instances race for the same tile: both miss S3, but only the
+	// first write goes through.
+	newHandler := func() *Handler {
+		handler, err := New(backend.URL,
+			WithTileSize(3),
+			WithS3(svc, "bucket", "test/"),
+			WithConditionalWrites(true),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	first, second := newHandler(), newHandler()
+	tile := makeTile(0, 3, backend.URL)
+	entries, _, err := first.fetchFromBackend(context.Background(), tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, handler := range []*Handler{first, second} {
+		err = handler.writeToS3(context.Background(), tile, entries)
+		if err != nil {
+			t.Fatalf("expected the write to succeed, got %v", err)
+		}
+	}
+	if n := testutil.ToFloat64(first.writesSuppressed); n != 0 {
+		t.Errorf("expected the first write not to be suppressed, got %g", n)
+	}
+	if n := testutil.ToFloat64(second.writesSuppressed); n != 1 {
+		t.Errorf("expected the second write to be suppressed, got %g", n)
+	}
+
+	// Other errors still fail.
+	if alreadyWritten(errors.New("S3 is down")) || !alreadyWritten(statusError(http.StatusConflict)) {
+		t.Errorf("expected only 409 and 412 to mean the tile was already written")
+	}
+}
@@ -0,0 +1,2080 @@
+// Package ctile implements a caching proxy for the get-entries endpoint of a CT
+// log, which stores fixed-size tiles of entries in S3. The Handler it provides
+// can be run standalone with cmd/ctile, or embedded in another HTTP server.
+package ctile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+// parseQueryParams returns the start and end values, or an error.
+//
+// The end value it returns is one greater than in the request,
+// because CT uses closed intervals while we use half-open intervals
+// internally for simpler math.
+func parseQueryParams(values url.Values) (int64, int64, error) {
+	start := values.Get("start")
+	end := values.Get("end")
+	if start == "" {
+		return 0, 0, errors.New("missing start parameter")
+	}
+	if end == "" {
+		return 0, 0, errors.New("missing end parameter")
+	}
+	startInt, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || startInt < 0 {
+		return 0, 0, fmt.Errorf("invalid start parameter: %w", err)
+	}
+	endInt, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || endInt < 0 {
+		return 0, 0, fmt.Errorf("invalid end parameter: %w", err)
+	}
+	if endInt < startInt {
+		return 0, 0, errors.New("end must be greater than or equal to start")
+	}
+	return startInt, endInt + 1, nil
+}
+
+// tile represents important info about a tile: where it starts, where it ends, its size,
+// what CT backend URL it exists on (or is anticipated to exist on), and what s3 prefix
+// it should be stored/retrieved under.
+//
+// `start` is inclusive, and `end` is exclusive, unlike in the CT protocol.
+// In other words, they represent the half-open interval [start, end).
+type tile struct {
+	start  int64
+	end    int64
+	size   int64
+	logURL string
+}
+
+// makeTile returns a tile of size `size` that contains the given `start` position.
+// The resulting tile's `start` will be equal to or less than the requested `start`.
+func makeTile(start, size int64, logURL string) tile {
+	tileOffset := start % size
+	tileStart := start - tileOffset
+	return tile{
+		start:  tileStart,
+		end:    tileStart + size,
+		size:   size,
+		logURL: logURL,
+	}
+}
+
+// key returns the S3 key for the tile.
+func (t tile) key() string {
+	return fmt.Sprintf("tile_size=%d/%d.cbor.gz", t.size, t.start)
+}
+
+// TileKey returns the S3 key, not including any prefix, for the tile of the
+// given size that contains the entry at index.
+func TileKey(size, index int64) string {
+	return makeTile(index, size, "").key()
+}
+
+// ParseTileKey is the inverse of TileKey: given an S3 key with the prefix
+// already removed, in either KeyLayout, it returns the tile size and start
+// offset encoded in it.
+func ParseTileKey(key string) (size int64, start int64, err error) {
+	hash, flatKey, hashed := strings.Cut(key, "/")
+	if hashed && len(hash) == keyHashLen {
+		size, start, err = ParseTileKey(flatKey)
+		if err == nil && hash != keyHash(start) {
+			return 0, 0, fmt.Errorf("key %q: hash doesn't match tile start %d", key, start)
+		}
+		return size, start, err
+	}
+	rest, ok := strings.CutPrefix(key, "tile_size=")
+	if !ok {
+		return 0, 0, fmt.Errorf("key %q: missing tile_size= component", key)
+	}
+	sizeStr, rest, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("key %q: missing / after tile size", key)
+	}
+	startStr, ok := strings.CutSuffix(rest, ".cbor.gz")
+	if !ok {
+		return 0, 0, fmt.Errorf("key %q: missing .cbor.gz suffix", key)
+	}
+	size, err = strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, 0, fmt.Errorf("key %q: invalid tile size %q", key, sizeStr)
+	}
+	start, err = strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start%size != 0 {
+		return 0, 0, fmt.Errorf("key %q: invalid tile start %q", key, startStr)
+	}
+	return size, start, nil
+}
+
+// url returns the URL to fetch the tile from the backend at backendURL.
+func (t tile) url(backendURL string) string {
+	// Use end-1 because our internal representation uses half-open intervals, while the
+	// CT protocol uses closed intervals. https://datatracker.ietf.org/doc/html/rfc6962#section-4.6
+	return fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", backendURL, t.start, t.end-1)
+}
+
+// Entries corresponds to the JSON response to the CT get-entries endpoint.
+// https://datatracker.ietf.org/doc/html/rfc6962#section-4.6
+//
+// It is marshaled and unmarshaled to/from JSON and CBOR.
+//
+// This type must not be mutated, because pointers to the same value may be in use
+// across multiple goroutines.
+type Entries struct {
+	Entries []Entry `json:"entries"`
+}
+
+type pastTheEndError struct{}
+
+func (p pastTheEndError) Error() string {
+	return "requested range is past the end of the log"
+}
+
+// trimForDisplay takes a set of entries corresponding to `tile`, and returns a new
+// object suitable for a request for entries in the range [start, end).
+//
+// This does not mutate the original object. It is suitable for calling when the set
+// of entries represents a partial tile.
+func (e *Entries) trimForDisplay(start, end int64, tile tile) (*Entries, error) {
+	if start < tile.start || start >= tile.end || end <= start || len(e.Entries) > int(tile.size) {
+		return nil, fmt.Errorf("internal inconsistency: start = %d, end = %d, tile = %v, len(e.Entries) = %d", start, end, tile, len(e.Entries))
+	}
+
+	// Truncate to match the request
+	prefixToRemove := start - tile.start
+	if prefixToRemove >= int64(len(e.Entries)) {
+		// In this case, the requested range is entirely outside the current log,
+		// but the _tile_'s beginning was inside the log. For instance, a log with
+		// size 1000 and max_getentries of 256, where ctile is handling a request
+		// for start=1001&end=1001; the tile starts at offset 768, but is partial so
+		// it doesn't include the requested range.
+		//
+		// When Trillian gets a request that is past the end of the log, it returns
+		// 400 (for better or worse), so we emulate that here.
+		return nil, pastTheEndError{}
+	}
+
+	requestedLen := end - start
+	if prefixToRemove+requestedLen > int64(len(e.Entries)) {
+		requestedLen = int64(len(e.Entries)) - prefixToRemove
+	}
+	return &Entries{
+		Entries: e.Entries[prefixToRemove : prefixToRemove+requestedLen],
+	}, nil
+}
+
+// Entry corresponds to a single entry in the CT get-entries endpoint.
+//
+// Note: the JSON fields are base64. For fields of type `[]byte`, Go's encoding/json
+// automagically decodes base64.
+//
+// This type must not be mutated, because pointers to the same value may be in use
+// across multiple goroutines.
+type Entry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// statusCodeError indicates the backend returned a non-200 status code, and contains
+// the response body. This allows passing through that status code and body to the requester.
+type statusCodeError struct {
+	statusCode int
+	body       []byte
+}
+
+func (s statusCodeError) Error() string {
+	return fmt.Sprintf("backend responded with status code %d and body:\n%s", s.statusCode, string(s.body))
+}
+
+// faultTarget identifies a dependency that faults can be injected into. See
+// chaos.go.
+type faultTarget string
+
+const (
+	faultTargetS3      faultTarget = "s3"
+	faultTargetBackend faultTarget = "backend"
+)
+
+// injectedFault is the error returned by injectFault.
+type injectedFault struct {
+	target faultTarget
+}
+
+func (i injectedFault) Error() string {
+	return fmt.Sprintf("injected fault in %s call", i.target)
+}
+
+// getTileFromBackend fetches a tile of entries from the backend at
+// backendURL, reading at most maxBodySize bytes of response if it's nonzero.
+//
+// If the backend returns a non-200 status code, it returns a statusCodeError,
+// so the caller can handle that case specially by propagating the backend's
+// status code (for instance, 400 or 404). If the response is too large, it
+// returns an error wrapping errBodyTooLarge.
+func getTileFromBackend(ctx context.Context, client *http.Client, backendURL string, t tile, maxBodySize int64) (*Entries, error) {
+	err := injectFault(ctx, faultTargetBackend)
+	if err != nil {
+		return nil, err
+	}
+	return getTile(ctx, client, t.url(backendURL), nil, t, maxBodySize)
+}
+
+// errBodyTooLarge is returned when a response is larger than allowed by
+// WithMaxBackendBodySize.
+var errBodyTooLarge = errors.New("response body too large")
+
+// limitBody makes reads from resp's body fail once they go past maxBodySize
+// bytes, if it's nonzero.
+func limitBody(resp *http.Response, maxBodySize int64) {
+	if maxBodySize > 0 {
+		resp.Body = http.MaxBytesReader(nil, resp.Body, maxBodySize)
+	}
+}
+
+// readBodyError returns err, read from url, as errBodyTooLarge if it's due to
+// limitBody.
+func readBodyError(url string, err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return fmt.Errorf("reading body from %s: %w: more than %d bytes", url, errBodyTooLarge, maxBytesErr.Limit)
+	}
+	return fmt.Errorf("reading body from %s: %w", url, err)
+}
+
+// getTile fetches a tile of entries from url, sending any extra header, with
+// the same error handling as getTileFromBackend.
+func getTile(ctx context.Context, client *http.Client, url string, header http.Header, t tile, maxBodySize int64) (*Entries, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create backend Request object: %w", err)
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	limitBody(resp, maxBodySize)
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, readBodyError(url, err)
+		}
+		return nil, statusCodeError{resp.StatusCode, body}
+	}
+
+	var entries Entries
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, readBodyError(url, err)
+	}
+
+	if len(entries.Entries) > int(t.size) || len(entries.Entries) == 0 {
+		return nil, fmt.Errorf("expected %d entries, got %d", t.size, len(entries.Entries))
+	}
+
+	return &entries, nil
+}
+
+// writeToS3 stores the entries corresponding to the given tile in s3.
+func (tch *Handler) writeToS3(ctx context.Context, t tile, e *Entries) error {
+	if len(e.Entries) != int(t.size) || t.end != t.start+t.size {
+		return fmt.Errorf("internal inconsistency: len(entries) == %d; tile = %v", len(e.Entries), t)
+	}
+
+	err := injectFault(ctx, faultTargetS3)
+	if err != nil {
+		return err
+	}
+
+	bucket, prefix := tch.location(t)
+	key := prefix + tch.objectKey(t, tch.tileKey(t))
+	requested, requestedEntries := t, e
+	if tch.superTiles > 1 {
+		if st, contents, ok := tch.gatherSuperTile(ctx, t, e); ok {
+			t, e = st, contents
+			key = prefix + tch.objectKey(st, tch.superTileKey(st))
+		}
+	}
+	body, metadata, err := tch.encodeObject(ctx, key, e)
+	if err != nil {
+		return err
+	}
+	if tch.dryRun {
+		log.Printf("dry run: not writing %d bytes to bucket %q with key %q\n", len(body), bucket, key)
+		return nil
+	}
+
+	if tch.secondaryS3.DualWrite {
+		secondaryDone := make(chan struct{})
+		go func() {
+			defer close(secondaryDone)
+			tch.putToSecondary(ctx, t, key, body, metadata)
+		}()
+		defer func() { <-secondaryDone }()
+	}
+	err = tch.putTile(ctx, tch.s3Service, bucket, key, t, body, metadata)
+	if err == nil && cachedPartialLength(ctx) > 0 {
+		tch.removePartialFromS3(ctx, requested)
+	}
+	if err == nil && tch.precompressedJSON {
+		tch.writePrecompressed(ctx, requested, requestedEntries)
+	}
+	return err
+}
+
+// encodeObject returns the body and metadata of the object at key holding e:
+// encoded as set by WithTileFormat, with its chains in the chain store, if
+// WithChainStore is set, and encrypted, if WithEncryption is.
+func (tch *Handler) encodeObject(ctx context.Context, key string, e *Entries) ([]byte, map[string]string, error) {
+	version := 1
+	if tch.chains != nil && !tch.dryRun {
+		deduped, ok, err := tch.chains.dedup(ctx, e)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			e, version = deduped, 2
+		}
+	}
+	body, err := tch.tileFormat.Encode(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	var encryptionKeyID string
+	if encryptor := tch.encryptor.Load(); encryptor != nil {
+		body, encryptionKeyID, err = encryptor.seal(key, body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	metadata := tileMetadata(body, version)
+	if encryptionKeyID != "" {
+		metadata[encryptionMetadataKey] = encryptionKeyID
+	}
+	return body, metadata, nil
+}
+
+// putTile stores an encoded tile in bucket under key, with the given metadata
+// and the Handler's tags, and, if WithConditionalWrites is set, only if it
+// isn't already there.
+func (tch *Handler) putTile(ctx context.Context, svc S3API, bucket, key string, t tile, body []byte, metadata map[string]string) error {
+	if !tch.conditionalWrites {
+		return putTileObject(ctx, svc, bucket, key, body, metadata, tch.objectTagging(t))
+	}
+	err := putTileObject(ctx, svc, bucket, key, body, metadata, tch.objectTagging(t), ifNoneMatch)
+	if alreadyWritten(err) {
+		tch.writesSuppressed.Inc()
+		return nil
+	}
+	return err
+}
+
+// writeQueued makes an attempt at a write from the writeQueue, for the
+// request whose context is ctx, which may already be done.
+func (tch *Handler) writeQueued(ctx context.Context, t tile, e *Entries) error {
+	ctx, cancel := tch.s3WriteContext(ctx)
+	defer cancel()
+
+	beginS3Put := time.Now()
+	err := tch.writeToS3(ctx, t, e)
+	tch.backendLatencyMetric.WithLabelValues("s3_put").Observe(time.Since(beginS3Put).Seconds())
+	tch.s3Health.done(ctx, err)
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "s3_put").Inc()
+		log.Printf("warning: writing tile %d-%d to S3 in the background: %s\n", t.start, t.end-1, err)
+		return err
+	}
+	if !tch.dryRun {
+		tch.tileIndex.add(t)
+		tch.hooks.tileCached(ctx, t)
+	}
+	return nil
+}
+
+// s3WriteContext returns a context for writing a tile to S3 for the request
+// whose context is ctx. It keeps ctx's values, but not its deadline or
+// cancellation: it's bounded by the S3 write timeout instead, so the tile is
+// cached even if the client goes away.
+func (tch *Handler) s3WriteContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, tch.s3WriteTimeout)
+}
+
+// detachedContext has the values of its parent, but is never canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (d detachedContext) Value(key any) any         { return d.parent.Value(key) }
+
+// PutTileObject encodes the entries with EncodeTile and stores them in s3
+// under the given key.
+func PutTileObject(ctx context.Context, svc S3API, bucket, key string, e *Entries) error {
+	body, err := EncodeTile(e)
+	if err != nil {
+		return err
+	}
+	return putTileObject(ctx, svc, bucket, key, body, tileMetadata(body, 1), "")
+}
+
+// tileMetadata returns the metadata of an object with the given body, holding
+// a tile encoded in the given format version.
+func tileMetadata(body []byte, version int) map[string]string {
+	return map[string]string{
+		checksumMetadataKey: tileChecksum(body),
+		formatMetadataKey:   strconv.Itoa(version),
+	}
+}
+
+// putTileObject stores an encoded tile in s3 under the given key, with the
+// given metadata, from tileMetadata, tagging the object with tagging, encoded
+// as URL query parameters, unless it's empty, and passing optFns to PutObject.
+func putTileObject(ctx context.Context, svc S3API, bucket, key string, body []byte, metadata map[string]string, tagging string, optFns ...func(*s3.Options)) error {
+	in := &s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(body),
+		Metadata: metadata,
+	}
+	if tagging != "" {
+		in.Tagging = aws.String(tagging)
+	}
+	_, err := svc.PutObject(ctx, in, optFns...)
+	if err != nil {
+		return fmt.Errorf("putting in bucket %q with key %q: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// noSuchKey indicates the requested key does not exist.
+type noSuchKey struct{}
+
+func (noSuchKey) Error() string {
+	return "no such key"
+}
+
+// ErrNoSuchKey is returned by GetTileObject when the requested key doesn't exist.
+var ErrNoSuchKey error = noSuchKey{}
+
+// getFromS3 retrieves the entries corresponding to the given tile from s3.
+// If the tile isn't already stored in s3, it returns a noSuchKey error.
+func (tch *Handler) getFromS3(ctx context.Context, t tile) (*Entries, error) {
+	err := injectFault(ctx, faultTargetS3)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, prefix := tch.location(t)
+	if tch.superTiles > 1 {
+		entries, err := tch.getFromSuperTile(ctx, tch.s3Service, bucket, prefix, t)
+		if !errors.Is(err, noSuchKey{}) {
+			return entries, err
+		}
+	}
+	entries, err := tch.getTileObject(ctx, tch.s3Service, bucket, prefix, t, tch.tileKey(t))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries.Entries) != int(t.size) || t.end != t.start+t.size {
+		return nil, fmt.Errorf("internal inconsistency: len(entries) == %d; tile = %v", len(entries.Entries), t)
+	}
+
+	return entries, nil
+}
+
+// getTileObject reads tile t, or a super-tile, whose key in the flat layout is
+// flatKey, from bucket and prefix in svc, at each of its keys in turn. Objects
+// that don't match their checksum, or can't be decoded, are handled by
+// dropCorrupt.
+func (tch *Handler) getTileObject(ctx context.Context, svc S3API, bucket, prefix string, t tile, flatKey string) (*Entries, error) {
+	var err error
+	for _, key := range tch.objectKeys(t, flatKey) {
+		var body []byte
+		var metadata map[string]string
+		body, metadata, err = getObject(ctx, svc, bucket, prefix+key)
+		err = tch.dropCorrupt(ctx, svc, t, bucket, prefix+key, err)
+		if err == nil {
+			body, err = tch.encryptor.Load().open(bucket, prefix+key, body, metadata)
+		}
+		if errors.Is(err, noSuchKey{}) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entries *Entries
+		entries, err = decodeTileObject(ctx, body, metadata, tch.chains)
+		err = tch.dropCorrupt(ctx, svc, t, bucket, prefix+key, err)
+		if errors.Is(err, noSuchKey{}) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading body from bucket %q with key %q: %w", bucket, prefix+key, err)
+		}
+		return entries, nil
+	}
+	return nil, err
+}
+
+// GetTileObject retrieves the object with the given key from s3 and decodes it
+// with DecodeTile. If the key doesn't exist, it returns ErrNoSuchKey; if the
+// object doesn't match its checksum, ErrChecksumMismatch; and if it's in a
+// format version this version of ctile can't read, ErrUnsupportedFormat.
+func GetTileObject(ctx context.Context, svc S3API, bucket, key string) (*Entries, error) {
+	body, metadata, err := getObject(ctx, svc, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	body, err = (*encryptor)(nil).open(bucket, key, body, metadata)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodeTileObject(ctx, body, metadata, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading body from bucket %q with key %q: %w", bucket, key, err)
+	}
+	return entries, nil
+}
+
+// getObject returns the body and metadata of the object with the given key,
+// after checking its checksum.
+func getObject(ctx context.Context, svc S3API, bucket, key string) ([]byte, map[string]string, error) {
+	resp, err := svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, nil, noSuchKey{}
+		}
+		return nil, nil, fmt.Errorf("getting from bucket %q with key %q: %w", bucket, key, err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading body from bucket %q with key %q: %w", bucket, key, err)
+	}
+	err = verifyChecksum(bucket, key, body, resp.Metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Metadata, nil
+}
+
+// EncodeTile encodes entries in the default format stored in s3: gzipped CBOR.
+func EncodeTile(e *Entries) ([]byte, error) {
+	return TileFormat{}.Encode(e)
+}
+
+// DecodeTile decodes a tile in any TileFormat: CBOR or JSON, gzipped or not.
+func DecodeTile(r io.Reader) (*Entries, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err == nil && bytes.Equal(magic, gzipMagic) {
+		gzipReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("making gzipReader: %w", err)
+		}
+		br = bufio.NewReader(gzipReader)
+	}
+	var entries Entries
+	first, err := br.Peek(1)
+	if err == nil && first[0] == '{' {
+		err = json.NewDecoder(br).Decode(&entries)
+	} else {
+		err = cbor.NewDecoder(br).Decode(&entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entries, nil
+}
+
+// Handler is the main HTTP handler that serves CT tiles it fetches
+// from a backend server and from the cache tiles it maintains in S3.
+// Use New to create one.
+type Handler struct {
+	logURL   string // The string form of the HTTP host and path prefix to add incoming request paths to in order to fetch tiles from the backing CT log. Must not be empty.
+	tileSize int    // The CT tile size used here and in the backing CT log. Must be the same as the backing CT log's value and must not be zero.
+
+	s3Service S3API   // The S3 service to use for caching tiles. Must not be nil, except in proxy-only mode.
+	s3Prefix  string  // The prefix to add to the path when caching tiles in S3. Must not be empty, except in proxy-only mode.
+	s3Bucket  string  // The S3 bucket to use for caching tiles. Must not be empty, except in proxy-only mode.
+	shards    []Shard // Ranges of the log cached elsewhere than s3Bucket and s3Prefix, in order. See location.
+
+	cacheGroup        *singleflight.Group // The singleflight.Group to use for deduplicating simultaneous requests (a.k.a. "request collapsing") for tiles. Must not be nil.
+	collapseKeyConfig CollapseKey         // What distinguishes requests in cacheGroup.
+
+	requestsMetric       *prometheus.CounterVec
+	partialTiles         prometheus.Counter
+	writesSuppressed     prometheus.Counter
+	checksumMismatches   prometheus.Counter
+	undecodableTiles     prometheus.Counter
+	invalidTiles         *prometheus.CounterVec
+	partialTileRetries   *prometheus.CounterVec
+	singleFlightShared   prometheus.Counter
+	latencyMetric        prometheus.Histogram
+	backendLatencyMetric *prometheus.HistogramVec
+	s3EventTiles         *prometheus.CounterVec
+
+	fullRequestTimeout time.Duration
+	backendTimeout     time.Duration   // If nonzero, the max time for a single request to the backend.
+	s3WriteTimeout     time.Duration   // The max time for writing a tile to S3, regardless of the request's deadline.
+	backendLimiter     *backendLimiter // Limits concurrency and rate of requests to the backend. Must not be nil.
+	backends           *backendSet     // The replicas of the backend, starting with logURL. Must not be nil.
+	breaker            *circuitBreaker // Pauses requests to the backend while it keeps failing. Nil if disabled.
+	s3Health           *s3Health       // Bypasses S3 while it keeps failing. Nil if S3 failures fail requests.
+	memoryCache        *memoryCache    // Holds recently served tiles in front of S3. Nil if disabled.
+	tailCache          *tailCache      // Holds the partial tile at the end of the log for a short time. Nil if disabled.
+	partialTileCaching bool            // If true, partial tiles are cached in S3 too, until they're complete.
+	tileIndex          *tileIndex      // The tiles known to be cached in S3. Nil if disabled.
+	precompressedJSON  bool            // If true, complete tiles are also stored as gzipped JSON responses.
+	readahead          *readahead      // Detects sequential scans to fetch the following tiles. Nil if disabled.
+	hedge              *hedge          // Races slow S3 reads with backend fetches. Nil if disabled.
+	staticCT           *staticCT       // Serves the static CT API. Nil if disabled.
+	backendType        BackendType     // The API served by the backend.
+	issuers            *issuerCache    // Issuers fetched from a BackendStaticCT backend. Nil otherwise.
+	sthCache           *sthCache       // Serves get-sth from memory. Nil if disabled.
+	rootsCache         *rootsCache     // Serves get-roots from memory. Nil if disabled.
+	entryAndProof      bool            // If true, get-entry-and-proof is served with entries from tiles.
+	maxRequestTiles    int             // The most tiles a get-entries response may be served from.
+	prettyJSON         bool            // If true, get-entries JSON is always indented.
+	export             bool            // If true, bulk exports are served.
+	exportRate         float64         // If nonzero, the max entries per second of each export.
+	follower           *tailFollower   // Polls the tree size for /ctile/v1/tail. Nil if disabled.
+	strictAlignment    bool            // If true, get-entries requests must be aligned to tiles.
+	getEntriesLimit    GetEntriesLimit // Limits the range of get-entries requests.
+	diskCache          *DiskCache      // The cache tier between memoryCache and sharedCache. Nil if disabled.
+	sharedCache        SharedCache     // The cache tier between diskCache and S3. Nil if disabled.
+	httpClient         *http.Client    // The client for requests to the backend and peers. Must not be nil.
+	maxBackendBodySize int64           // If nonzero, the max size of responses read from the backend and peers.
+	strictValidation   bool            // If true, tiles are checked with validateTile before they're cached.
+	requestSlots       chan struct{}   // Holds a value for each request being served, if their number is limited.
+	clientLimiter      *clientLimiter  // Limits the rate of requests from each client. Nil if disabled.
+
+	streams    context.Context    // Done once EndStreams is called, which ends streaming responses.
+	endStreams context.CancelFunc // Cancels streams.
+
+	negativeCacheTTL time.Duration    // If nonzero, how long past the end markers in S3 are trusted.
+	partialTileRetry PartialTileRetry // When to fetch a partial tile from the backend a second time.
+
+	coalescedEndpoints map[string]bool    // Endpoints, by name, whose simultaneous requests share one backend request.
+	passthroughGroup   singleflight.Group // Collapses requests for coalescedEndpoints, keyed by path and query.
+	passthroughShared  prometheus.Counter
+	passthroughWaiting func() // If set, called by each request waiting for a request shared through passthroughGroup, for tests.
+
+	debugAuthorize func(*http.Request) bool       // Which requests may ask for a breakdown with DebugHeader. Nil if none may.
+	requestSigning atomic.Pointer[RequestSigning] // The keys requests must be signed with, if any. Replaced by SetRequestSigningKeys.
+
+	ring            *Ring  // The cluster this Handler is part of. May be nil.
+	readThroughPeer string // If set, the instance to request tiles missing from S3 from.
+	clusterPath     string // Where the log is served on each instance in ring, and on readThroughPeer.
+
+	mode   Mode // Where tiles may be fetched from. Must not be empty.
+	dryRun bool // If true, tiles are never written to S3; instead, what would have been written is logged.
+
+	tileFormat        TileFormat                // How tiles are encoded when they're written to S3.
+	superTiles        int                       // If above 1, the number of tiles stored in each S3 object.
+	keyLayout         KeyLayout                 // How the keys of tiles are laid out in S3. Empty means KeyLayoutFlat.
+	keyTemplate       KeyTemplate               // The keys of tiles in S3, with the log's variables resolved. Zero means DefaultKeyTemplate.
+	chains            *chainStore               // Where the chains in entries' extra_data are stored apart from tiles. Nil if they aren't.
+	encryptor         atomic.Pointer[encryptor] // Encrypts tiles written to S3, and decrypts them. Nil if they aren't encrypted. Replaced by SetEncryptionKeys.
+	conditionalWrites bool                      // If true, tiles are written to S3 only if they aren't already there.
+	secondaryS3       SecondaryS3               // The bucket to fall back to when the primary fails. Disabled if its Service is nil.
+	objectTags        map[string]string         // If non-nil, the tags of each tile written to S3, besides its size and range.
+	asyncWrites       bool                      // If true, tiles are written to S3 after the response, by writeQueue.
+	writeQueue        *writeQueue               // Writes tiles to S3 in the background, and retries failed writes. Nil if disabled.
+
+	hooks    Hooks
+	features *FeatureFlags // Rollouts of experimental behaviors. May be nil, meaning all are disabled.
+	s3Events *S3Events     // Reports changes to objects in S3 made by others. Nil if disabled.
+
+	// handler is serveHTTPInner wrapped in compressor and any middleware.
+	handler    http.Handler
+	compressor *compressor
+}
+
+// New returns a Handler that serves get-entries requests for the CT log at
+// logURL, caching tiles as configured by opts. Requests for other endpoints
+// are passed through to the log. WithTileSize and, except in ModeProxyOnly,
+// WithS3 are required.
+func New(logURL string, opts ...Option) (*Handler, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if logURL == "" {
+		return nil, errors.New("logURL must not be empty")
+	}
+	if o.tileSize <= 0 {
+		return nil, errors.New("tile size must be positive")
+	}
+	if o.mode == "" {
+		return nil, errors.New("mode must not be empty")
+	}
+	if o.mode != ModeProxyOnly {
+		if o.s3Service == nil {
+			return nil, errors.New("S3 service must not be nil")
+		}
+		if o.s3Prefix == "" {
+			return nil, errors.New("S3 prefix must not be empty")
+		}
+		if o.s3Bucket == "" {
+			return nil, errors.New("S3 bucket must not be empty")
+		}
+		err := validateShards(o.shards, o.tileSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range o.shards {
+			if o.superTiles > 1 && s.Start%(int64(o.tileSize)*int64(o.superTiles)) != 0 {
+				return nil, fmt.Errorf("shard start %d must be a multiple of the super-tile size %d", s.Start, o.tileSize*o.superTiles)
+			}
+		}
+	}
+	if o.timeouts.FullRequest <= 0 {
+		return nil, errors.New("full request timeout must be positive")
+	}
+	if o.timeouts.Backend < 0 {
+		return nil, errors.New("backend timeout must not be negative")
+	}
+	if o.timeouts.S3Write < 0 {
+		return nil, errors.New("S3 write timeout must not be negative")
+	}
+	if o.timeouts.S3Write == 0 {
+		o.timeouts.S3Write = o.timeouts.FullRequest
+	}
+	if o.secondaryS3.Service != nil && o.secondaryS3.Bucket == "" {
+		return nil, errors.New("secondary S3 bucket must not be empty")
+	}
+	err := o.tileFormat.validate()
+	if err != nil {
+		return nil, err
+	}
+	if o.keyLayout != "" {
+		_, err = ParseKeyLayout(string(o.keyLayout))
+		if err != nil {
+			return nil, err
+		}
+	}
+	keyTemplate, err := o.keyTemplate.resolve(logURL)
+	if err != nil {
+		return nil, err
+	}
+	if o.chainStore.CacheSize < 0 {
+		return nil, errors.New("chain store cache size must not be negative")
+	}
+	encryptor, err := newEncryptor(o.encryption)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.objectTags) > maxObjectTags-2 {
+		return nil, fmt.Errorf("at most %d object tags may be set", maxObjectTags-2)
+	}
+	if o.writeQueue.Size < 0 || o.writeQueue.Workers < 0 || o.writeQueue.Attempts < 0 || o.writeQueue.Backoff < 0 {
+		return nil, errors.New("write queue settings must not be negative")
+	}
+	if o.asyncWrites && o.writeQueue.Size == 0 {
+		o.writeQueue = DefaultWriteQueue
+	}
+	if o.backendLimits.MaxConcurrent < 0 || o.backendLimits.RequestsPerSecond < 0 || o.backendLimits.Burst < 0 {
+		return nil, errors.New("backend limits must not be negative")
+	}
+	for _, replica := range o.failover.Replicas {
+		if replica == "" {
+			return nil, errors.New("backend replica URLs must not be empty")
+		}
+	}
+	if o.failover.Cooldown < 0 || o.failover.ProbeInterval < 0 {
+		return nil, errors.New("failover cooldown and probe interval must not be negative")
+	}
+	if o.failover.Balance != "" {
+		_, err := ParseBalance(string(o.failover.Balance))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.negativeCacheTTL < 0 {
+		return nil, errors.New("negative cache TTL must not be negative")
+	}
+	if o.sthCache.TTL < 0 || o.sthCache.MaxStale < 0 {
+		return nil, errors.New("STH cache TTL and max staleness must not be negative")
+	}
+	if o.sthCache.MaxStale != 0 && o.sthCache.TTL == 0 {
+		return nil, errors.New("STH cache max staleness requires a TTL")
+	}
+	if o.cachedEntryAndProof && (o.mode != ModeNormal || o.backendType == BackendStaticCT) {
+		return nil, errors.New("cached get-entry-and-proof is only available in normal mode with an RFC 6962 backend")
+	}
+	if o.rootsCacheTTL < 0 {
+		return nil, errors.New("roots cache TTL must not be negative")
+	}
+	if o.maxRequestTiles < 0 {
+		return nil, errors.New("max request tiles must not be negative")
+	}
+	if o.exportRate < 0 {
+		return nil, errors.New("export rate limit must not be negative")
+	}
+	if o.tailPollInterval < 0 {
+		return nil, errors.New("tail poll interval must not be negative")
+	}
+	if o.getEntriesLimit.Max < 0 {
+		return nil, errors.New("get-entries limit must not be negative")
+	}
+	if o.tailCacheTTL < 0 {
+		return nil, errors.New("tail cache TTL must not be negative")
+	}
+	if o.readaheadDepth < 0 {
+		return nil, errors.New("readahead depth must not be negative")
+	}
+	if o.s3HedgeDelay < 0 {
+		return nil, errors.New("S3 hedging delay must not be negative")
+	}
+	if o.staticCTAPI.Origin != "" && o.mode == ModeProxyOnly {
+		return nil, errors.New("the static CT API isn't available in proxy-only mode")
+	}
+	staticCT, err := newStaticCT(o.staticCTAPI)
+	if err != nil {
+		return nil, err
+	}
+	if o.backendType == "" {
+		o.backendType = BackendRFC6962
+	}
+	_, err = ParseBackendType(string(o.backendType))
+	if err != nil {
+		return nil, err
+	}
+	if o.backendType == BackendStaticCT && o.strictValidation {
+		return nil, errors.New("strict validation isn't available with a static CT backend")
+	}
+	if o.backendType == BackendRFC9162 {
+		err = checkRFC9162Options(o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.circuitBreaker.Failures < 0 || o.circuitBreaker.Cooldown < 0 {
+		return nil, errors.New("circuit breaker failures and cooldown must not be negative")
+	}
+	if o.maxConcurrentRequests < 0 {
+		return nil, errors.New("max concurrent requests must not be negative")
+	}
+	if o.memoryCacheBytes < 0 {
+		return nil, errors.New("memory cache size must not be negative")
+	}
+	if o.clientLimits.RequestsPerSecond < 0 || o.clientLimits.Burst < 0 {
+		return nil, errors.New("client limits must not be negative")
+	}
+	if o.httpClient == nil {
+		return nil, errors.New("HTTP client must not be nil")
+	}
+	if o.maxBackendBodySize < 0 {
+		return nil, errors.New("max backend body size must not be negative")
+	}
+	if o.s3Degradation.Failures < 0 || o.s3Degradation.ProbeInterval < 0 {
+		return nil, errors.New("S3 degradation failures and probe interval must not be negative")
+	}
+	if o.requestSigning.MaxSkew < 0 {
+		return nil, errors.New("request signing max skew must not be negative")
+	}
+	for _, key := range o.requestSigning.Keys {
+		if len(key) == 0 {
+			return nil, errors.New("request signing keys must not be empty")
+		}
+	}
+	if o.partialTileRetry.Delay < 0 || o.partialTileRetry.MaxMissing < 0 {
+		return nil, errors.New("partial tile retry delay and max missing entries must not be negative")
+	}
+	if o.promRegisterer == nil {
+		return nil, errors.New("metrics registerer must not be nil")
+	}
+	promRegisterer := o.promRegisterer
+	if o.collapseGroup == nil {
+		o.collapseGroup = NewCollapseGroup()
+	}
+
+	requestsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctile_requests",
+			Help: "total number of requests, by result and source",
+		},
+		[]string{"result", "source"},
+	)
+	promRegisterer.MustRegister(requestsMetric)
+
+	partialTiles := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ctile_partial_tiles",
+			Help: "number of requests not cached due to partial tile returned from CT log",
+		})
+	promRegisterer.MustRegister(partialTiles)
+
+	writesSuppressed := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ctile_s3_writes_suppressed",
+			Help: "number of conditional writes of tiles to S3 that found the tile already written",
+		})
+	promRegisterer.MustRegister(writesSuppressed)
+
+	checksumMismatches := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ctile_checksum_mismatches",
+			Help: "number of tiles read from S3 that didn't match their checksum",
+		})
+	promRegisterer.MustRegister(checksumMismatches)
+
+	undecodableTiles := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ctile_undecodable_tiles",
+			Help: "number of tiles read from S3 that couldn't be decoded",
+		})
+	promRegisterer.MustRegister(undecodableTiles)
+
+	invalidTiles := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctile_invalid_tiles",
+			Help: "number of tiles from the CT log that failed strict validation, by the check that failed",
+		},
+		[]string{"reason"})
+	promRegisterer.MustRegister(invalidTiles)
+
+	partialTileRetries := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctile_partial_tile_retries",
+			Help: "number of partial tiles fetched from the CT log again after a delay, by whether they were complete the second time",
+		},
+		[]string{"result"})
+	promRegisterer.MustRegister(partialTileRetries)
+
+	singleFlightShared := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ctile_single_flight_shared",
+			Help: "number of inbound requests coalesced into a single set of backend requests",
+		})
+	promRegisterer.MustRegister(singleFlightShared)
+
+	passthroughShared := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ctile_passthrough_shared",
+			Help: "number of inbound requests for endpoints other than get-entries that shared a backend request",
+		})
+	promRegisterer.MustRegister(passthroughShared)
+
+	latencyMetric := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ctile_response_latency_seconds",
+			Help:    "overall latency of responses, including all backend requests",
+			Buckets: prometheus.DefBuckets,
+		})
+	promRegisterer.MustRegister(latencyMetric)
+
+	backendLatencyMetric := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ctile_backend_latency_seconds",
+			Help:    "latency of each backend request",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"backend"})
+	promRegisterer.MustRegister(backendLatencyMetric)
+
+	tch := Handler{
+		logURL:               logURL,
+		tileSize:             o.tileSize,
+		s3Service:            o.s3Service,
+		s3Prefix:             o.s3Prefix,
+		s3Bucket:             o.s3Bucket,
+		shards:               o.shards,
+		cacheGroup:           &o.collapseGroup.group,
+		collapseKeyConfig:    o.collapseKey,
+		requestsMetric:       requestsMetric,
+		partialTiles:         partialTiles,
+		writesSuppressed:     writesSuppressed,
+		checksumMismatches:   checksumMismatches,
+		undecodableTiles:     undecodableTiles,
+		invalidTiles:         invalidTiles,
+		partialTileRetries:   partialTileRetries,
+		singleFlightShared:   singleFlightShared,
+		passthroughShared:    passthroughShared,
+		fullRequestTimeout:   o.timeouts.FullRequest,
+		backendTimeout:       o.timeouts.Backend,
+		s3WriteTimeout:       o.timeouts.S3Write,
+		backendLimiter:       newBackendLimiter(o.backendLimits),
+		backends:             newBackendSet(logURL, o.failover, o.httpClient, probePath(o.backendType), promRegisterer),
+		breaker:              newCircuitBreaker(o.circuitBreaker, promRegisterer),
+		httpClient:           o.httpClient,
+		maxBackendBodySize:   o.maxBackendBodySize,
+		strictValidation:     o.strictValidation,
+		partialTileRetry:     o.partialTileRetry,
+		negativeCacheTTL:     o.negativeCacheTTL,
+		ring:                 o.ring,
+		readThroughPeer:      o.readThroughPeer,
+		clusterPath:          o.clusterPath,
+		mode:                 o.mode,
+		dryRun:               o.dryRun,
+		asyncWrites:          o.asyncWrites,
+		objectTags:           o.objectTags,
+		secondaryS3:          o.secondaryS3,
+		conditionalWrites:    o.conditionalWrites,
+		tileFormat:           o.tileFormat,
+		superTiles:           o.superTiles,
+		keyLayout:            o.keyLayout,
+		keyTemplate:          keyTemplate,
+		partialTileCaching:   o.partialTileCaching,
+		precompressedJSON:    o.precompressedJSON,
+		latencyMetric:        latencyMetric,
+		backendLatencyMetric: backendLatencyMetric,
+		hooks:                o.hooks,
+		features:             o.featureFlags,
+		debugAuthorize:       o.debugAuthorize,
+		sharedCache:          o.sharedCache,
+		staticCT:             staticCT,
+		backendType:          o.backendType,
+		sthCache:             newSTHCache(o.sthCache, o.timeouts.FullRequest, promRegisterer),
+		rootsCache:           newRootsCache(o.rootsCacheTTL, promRegisterer),
+		entryAndProof:        o.cachedEntryAndProof,
+		maxRequestTiles:      o.maxRequestTiles,
+		prettyJSON:           o.prettyJSON,
+		export:               o.export,
+		exportRate:           o.exportRate,
+		strictAlignment:      o.strictAlignment,
+		getEntriesLimit:      o.getEntriesLimit,
+	}
+
+	tch.encryptor.Store(encryptor)
+	tch.requestSigning.Store(&o.requestSigning)
+
+	if o.backendType == BackendStaticCT {
+		tch.issuers = &issuerCache{}
+	}
+
+	tch.coalescedEndpoints = make(map[string]bool)
+	for _, endpoint := range o.coalescedEndpoints {
+		tch.coalescedEndpoints[endpoint] = true
+	}
+
+	if o.mode == ModeNormal {
+		tch.s3Health = newS3Health(o.s3Degradation, tch.probeS3, promRegisterer)
+		tch.tileIndex = newTileIndex(o.tileIndex, promRegisterer)
+		tch.hedge = newHedge(o.s3HedgeDelay, promRegisterer)
+	}
+	if o.mode != ModeProxyOnly {
+		tch.memoryCache = newMemoryCache(o.memoryCacheBytes, promRegisterer)
+		tch.tailCache = newTailCache(o.tailCacheTTL, promRegisterer)
+		tch.readahead = newReadahead(o.readaheadDepth, promRegisterer)
+		tch.diskCache = o.diskCache
+		tch.chains = newChainStore(o.chainStore, o.s3Service, o.s3Bucket)
+		tch.writeQueue = newWriteQueue(o.writeQueue, tch.writeQueued, promRegisterer)
+	}
+	if o.maxConcurrentRequests > 0 {
+		tch.requestSlots = make(chan struct{}, o.maxConcurrentRequests)
+	}
+	tch.clientLimiter = newClientLimiter(o.clientLimits)
+	tch.streams, tch.endStreams = context.WithCancel(context.Background())
+	tch.follower = newTailFollower(o.tailPollInterval, tch.fullRequestTimeout, tch.getTreeSize, promRegisterer)
+
+	if o.mode != ModeProxyOnly && o.s3Events != nil {
+		tch.s3Events = o.s3Events
+		tch.s3EventTiles = newS3EventTiles(promRegisterer)
+	}
+
+	tch.compressor, err = newCompressor(o.responseEncoders, o.featureFlags, promRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	err = o.featureFlags.register(KnownFeatures(o.responseEncoders))
+	if err != nil {
+		return nil, fmt.Errorf("feature flags: %w", err)
+	}
+	tch.handler = tch.compressor.wrap(http.HandlerFunc(tch.serveHTTPInner))
+	for i := len(o.middleware) - 1; i >= 0; i-- {
+		tch.handler = o.middleware[i](tch.handler)
+	}
+
+	tch.s3Events.register(&tch)
+	if o.tileIndexPriming {
+		tch.startPriming()
+	}
+	return &tch, nil
+}
+
+func (tch *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tch.handler.ServeHTTP(w, r)
+}
+
+// EndStreams ends the streaming responses being served, to tail requests of
+// WithTailEndpoint and to exports of WithExport, and those started later, as
+// their clients may keep them open indefinitely. It's meant for draining the
+// Handler before Close, since other requests finish on their own.
+func (tch *Handler) EndStreams() {
+	tch.endStreams()
+}
+
+// streamContext returns a context for a streaming response to a request with
+// ctx, which is also canceled by EndStreams, and its cancel function.
+func (tch *Handler) streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(tch.streams, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Close stops the Handler's background work, such as health probes of the
+// backend, and following WithS3Events, and waits for the tiles queued to be
+// written to S3 in the background. Writes waiting to be retried are dropped.
+// Requests already being served are unaffected, but the Handler should not be
+// used for new ones.
+func (tch *Handler) Close() {
+	tch.backends.close()
+	tch.s3Health.close()
+	tch.tileIndex.close()
+	tch.writeQueue.close()
+	tch.s3Events.unregister(tch)
+}
+
+func (tch *Handler) serveHTTPInner(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	defer func() {
+		tch.latencyMetric.Observe(time.Since(begin).Seconds())
+	}()
+
+	if rs := tch.requestSigning.Load(); len(rs.Keys) > 0 {
+		err := rs.checkSignature(r, begin)
+		if err != nil {
+			tch.requestsMetric.WithLabelValues("unauthorized", "signature").Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, err)
+			return
+		}
+	}
+	w, r = tch.startDebug(w, r)
+
+	if r.Header.Get(forwardedHeader) == "" {
+		ok, wait := tch.clientLimiter.allow(r)
+		if !ok {
+			tch.requestsMetric.WithLabelValues("limited", "client").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintln(w, "too many requests from this client; try again later")
+			return
+		}
+	}
+
+	if tch.requestSlots != nil {
+		select {
+		case tch.requestSlots <- struct{}{}:
+			defer func() { <-tch.requestSlots }()
+		default:
+			tch.requestsMetric.WithLabelValues("limited", "requests").Inc()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "too many requests in progress; try again later")
+			return
+		}
+	}
+
+	if tch.staticCT != nil {
+		if req, ok := parseStaticCTPath(r.URL.Path); ok {
+			tch.serveStaticCT(w, r, req)
+			return
+		}
+	}
+
+	if tch.isExportPath(r.URL.Path) {
+		tch.serveExport(w, r)
+		return
+	}
+	if tch.isTailPath(r.URL.Path) {
+		tch.serveTail(w, r)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, tch.getEntriesSuffix()) {
+		if tch.mode == ModeCacheOnly {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "only get-entries is available: the backend is disabled in cache-only mode")
+			return
+		}
+		p := passthroughHandler{backends: tch.backends, breaker: tch.breaker, maxBodySize: tch.maxBackendBodySize}
+		if tch.sthCache != nil && isSTHPath(r.URL.Path) {
+			tch.sthCache.serve(w, r, p)
+			return
+		}
+		if tch.rootsCache != nil && isRootsPath(r.URL.Path) {
+			tch.rootsCache.serve(w, r, p)
+			return
+		}
+		if tch.entryAndProof && isEntryAndProofPath(r.URL.Path) {
+			tch.serveEntryAndProof(w, r, p)
+			return
+		}
+		if tch.coalesces(r.URL.Path) {
+			p.group, p.shared, p.waiting = &tch.passthroughGroup, tch.passthroughShared, tch.passthroughWaiting
+			p.timeout = tch.backendTimeout
+			if p.timeout == 0 {
+				p.timeout = tch.fullRequestTimeout
+			}
+		}
+		p.ServeHTTP(w, r)
+		return
+	}
+	start, end, err := parseQueryParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	verbose, err := parseVerbose(r.URL.Query())
+	if err == nil && verbose && tch.backendType == BackendRFC9162 {
+		err = errVerboseV2
+	}
+	var pretty bool
+	if err == nil {
+		pretty, err = parsePretty(r.URL.Query())
+		pretty = pretty || tch.prettyJSON
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	end, err = tch.limitRange(start, end)
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("bad_request", "range_too_large").Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	var unaligned unalignedError
+	if errors.As(tch.checkAlignment(start, end), &unaligned) {
+		tch.requestsMetric.WithLabelValues("bad_request", "unaligned").Inc()
+		w.Header().Set(alignedRangeHeader, unaligned.query())
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, unaligned)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tch.fullRequestTimeout)
+	defer cancel()
+	if r.Header.Get(forwardedHeader) != "" {
+		ctx = context.WithValue(ctx, forwardedKey{}, true)
+	}
+
+	tile := makeTile(start, int64(tch.tileSize), tch.logURL)
+	debugFrom(ctx).setTile(tile)
+
+	// The response is JSON, unless the client asks for CBOR.
+	w.Header().Add("Vary", "Accept")
+	contentType := "application/json"
+	if acceptsCBOR(r) {
+		contentType = cborContentType
+	}
+
+	if !verbose && contentType != cborContentType && pretty == tch.prettyJSON && !tch.spans(tile, end) && tch.servePrecompressed(ctx, w, r, tile, start, end) {
+		tch.readAhead(tile)
+		return
+	}
+
+	contents, source, err := tch.getTileFrom(ctx, tile, start)
+	var marker pastTheEndMarker
+	if errors.As(err, &marker) {
+		tch.requestsMetric.WithLabelValues("bad_request", "past_the_end_marker").Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if err != nil {
+		writeTileError(w, err)
+		return
+	}
+
+	tileEntries := len(contents.Entries)
+	spanned := tile
+	if !tch.isPartialTile(contents) && tch.spans(tile, end) {
+		contents, spanned = tch.appendFollowingTiles(ctx, tile, contents, end)
+	}
+
+	partial := int64(len(contents.Entries)) < spanned.size
+	if partial {
+		w.Header().Set("X-Partial-Tile", "true")
+	} else {
+		tch.readAhead(makeTile(spanned.end-1, int64(tch.tileSize), tch.logURL))
+	}
+
+	w.Header().Set("X-Source", string(source))
+
+	contents, err = contents.trimForDisplay(start, end, spanned)
+	if err != nil {
+		if errors.As(err, &pastTheEndError{}) {
+			tch.requestsMetric.WithLabelValues("bad_request", "past_the_end_partial_tile").Inc()
+		} else {
+			tch.requestsMetric.WithLabelValues("error", "internal_inconsistency").Inc()
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	result := "success"
+	if !partial && !verbose {
+		etag := tch.entriesETag(start, start+int64(len(contents.Entries)), contentType, pretty && contentType != cborContentType)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r, etag) {
+			result = "not_modified"
+		}
+	}
+
+	switch source {
+	case sourceS3:
+		tch.requestsMetric.WithLabelValues(result, "s3_get").Inc()
+	case sourceMemory:
+		tch.requestsMetric.WithLabelValues(result, "memory_get").Inc()
+	case sourceDisk:
+		tch.requestsMetric.WithLabelValues(result, "disk_get").Inc()
+	case sourceShared:
+		tch.requestsMetric.WithLabelValues(result, "shared_cache_get").Inc()
+	case sourceSecondary:
+		tch.requestsMetric.WithLabelValues(result, "secondary_s3_get").Inc()
+	case sourcePeer:
+		tch.requestsMetric.WithLabelValues(result, "peer_get").Inc()
+	default:
+		tch.requestsMetric.WithLabelValues(result, "ct_log_get").Inc()
+	}
+	if result == "not_modified" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var v2 v2Entries
+	if tch.backendType == BackendRFC9162 {
+		v2, err = toV2(contents)
+		if err != nil {
+			tch.requestsMetric.WithLabelValues("error", "internal_inconsistency").Inc()
+			writeTileError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("X-Response-Len", fmt.Sprintf("%d", len(contents.Entries)))
+	w.Header().Set("Content-Type", contentType)
+
+	err = writeEntriesResponse(w, func(w io.Writer) error {
+		switch {
+		case contentType == cborContentType && tch.backendType == BackendRFC9162:
+			return cbor.NewEncoder(w).Encode(v2)
+		case contentType == cborContentType && verbose:
+			return cbor.NewEncoder(w).Encode(makeVerbose(contents, start, tile, tileEntries, source))
+		case contentType == cborContentType:
+			return cbor.NewEncoder(w).Encode(contents)
+		case tch.backendType == BackendRFC9162:
+			return writeEntriesJSON(w, pretty, v2.Entries)
+		case verbose:
+			v := makeVerbose(contents, start, tile, tileEntries, source)
+			return writeEntriesJSON(w, pretty, v.Entries, jsonField{"ctile_tile", v.Tile})
+		default:
+			return writeEntriesJSON(w, pretty, contents.Entries)
+		}
+	})
+	if err != nil {
+		log.Printf("error writing get-entries response: %s\n", err)
+	}
+}
+
+// writeTileError writes the response for err, an error getting a tile other
+// than a pastTheEndMarker.
+func writeTileError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var statusCodeErr statusCodeError
+	if errors.As(err, &statusCodeErr) {
+		status = statusCodeErr.statusCode
+	} else if errors.Is(err, noSuchKey{}) {
+		status = http.StatusNotFound
+	} else if errors.Is(err, errBackendLimited) || errors.Is(err, errCircuitOpen) {
+		status = http.StatusServiceUnavailable
+	} else if errors.As(err, &invalidTileError{}) {
+		status = http.StatusBadGateway
+	}
+	// Send errors to our stdout as well as to the user. Requests rejected by
+	// backend limits or the circuit breaker are counted in metrics instead,
+	// since they're expected under load or during an outage.
+	if status != http.StatusBadRequest && status != http.StatusNotFound && !errors.Is(err, errBackendLimited) && !errors.Is(err, errCircuitOpen) {
+		log.Printf("error: %s\n", err)
+	}
+	w.WriteHeader(status)
+	fmt.Fprintln(w, err)
+}
+
+// getTileFrom returns tile like getAndCacheTile, for a request for entries
+// from start. A partial tile that ends before start is looked for elsewhere,
+// and a pastTheEndMarker is only returned if start is past the end it marks.
+func (tch *Handler) getTileFrom(ctx context.Context, tile tile, start int64) (*Entries, tileSource, error) {
+	contents, source, err := tch.getAndCacheTile(ctx, tile)
+	// A partial tile cached in S3 may be behind the log. If it doesn't reach
+	// start, look for the tile elsewhere.
+	if err == nil && source == sourceS3 && tch.isPartialTile(contents) && start >= tile.start+int64(len(contents.Entries)) {
+		ctx = context.WithValue(ctx, cachedPartialKey{}, len(contents.Entries))
+		contents, source, err = tch.getAndCacheTile(ctx, tile)
+	}
+	var marker pastTheEndMarker
+	if errors.As(err, &marker) && start < marker.TreeSize {
+		// The marker doesn't cover the earlier entries of a partial tile.
+		contents, source, err = tch.getAndCacheTile(context.WithValue(ctx, ignoreMarkersKey{}, true), tile)
+	}
+	return contents, source, err
+}
+
+// tileSource is a helper enum to indicate to the user whether the tile returned
+// to them was found in S3, in the Handler's memory cache, the DiskCache, or the
+// SharedCache, in the SecondaryS3 bucket, in the CT log, or at the peer that
+// owns it.
+type tileSource string
+
+const (
+	sourceCTLog     tileSource = "CT log"
+	sourceS3        tileSource = "S3"
+	sourceMemory    tileSource = "memory"
+	sourceDisk      tileSource = "disk"
+	sourceShared    tileSource = "shared cache"
+	sourceSecondary tileSource = "secondary S3"
+	sourcePeer      tileSource = "peer"
+)
+
+// Mode selects where the Handler may get tiles from.
+type Mode string
+
+const (
+	// ModeNormal serves tiles from S3, falling back to the backend and caching
+	// the result.
+	ModeNormal Mode = "normal"
+	// ModeCacheOnly serves tiles exclusively from S3 and never contacts the
+	// backend, for serving a frozen log whose backend has been decommissioned.
+	// Uncached tiles get a 404, and all other endpoints get a 503.
+	ModeCacheOnly Mode = "cache-only"
+	// ModeProxyOnly never touches S3, serving every tile from the backend. It
+	// still aligns, validates, and trims requests as usual.
+	ModeProxyOnly Mode = "proxy-only"
+)
+
+// ParseMode returns the Mode with the given name, or an error.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeNormal, ModeCacheOnly, ModeProxyOnly:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", s)
+	}
+}
+
+// getAndCacheTile fetches the requested tile from S3 if it exists there, or, if
+// it doesn't exist in S3, from the backing CT log and then caches it in S3.
+// Under the hood, it collapses requests for the same tile into one single
+// request. It should be preferred over getAndCacheTileUncollapsed.
+func (tch *Handler) getAndCacheTile(ctx context.Context, tile tile) (*Entries, tileSource, error) {
+	dedupKey := tch.collapseKey(tile)
+	if ignoresMarkers(ctx) {
+		dedupKey += "-ignoring-markers"
+	}
+	if cachedPartialLength(ctx) > 0 {
+		dedupKey += "-past-cached-partial"
+	}
+
+	type entriesAndSource struct {
+		entries *Entries
+		source  tileSource
+	}
+
+	innerContents, err, shared := singleflightDo(tch.cacheGroup, dedupKey, func() (entriesAndSource, error) {
+		contents, source, err := tch.getAndCacheTileUncollapsed(ctx, tile)
+		return entriesAndSource{contents, source}, err
+	})
+
+	if shared {
+		tch.singleFlightShared.Inc()
+	}
+	debugFrom(ctx).setResult(innerContents.source, shared)
+
+	// The value from our singleflightDo closure is always non-nil, so we don't
+	// need an err != nil check here.
+	return innerContents.entries, innerContents.source, err
+}
+
+// getAndCacheTileUncollapsed is the core of getAndCacheTile (and is used by it)
+// without the request collapsing. Use getAndCacheTile instead of this method.
+func (tch *Handler) getAndCacheTileUncollapsed(ctx context.Context, tile tile) (*Entries, tileSource, error) {
+	debug := debugFrom(ctx)
+	if tch.mode == ModeProxyOnly {
+		debug.step("s3_get", time.Time{}, "skipped in proxy-only mode")
+		return tch.fetchFromBackend(ctx, tile)
+	}
+	cacheKey := tch.cacheKey(tile)
+	if contents := tch.memoryCache.get(cacheKey); contents != nil {
+		debug.step("memory_get", time.Time{}, "hit")
+		tch.hooks.cacheHit(ctx, tile)
+		return contents, sourceMemory, nil
+	}
+	if contents := tch.tailCache.get(tile); contents != nil {
+		debug.step("tail_get", time.Time{}, fmt.Sprintf("hit: partial tile of %d entries", len(contents.Entries)))
+		return contents, sourceMemory, nil
+	}
+	if contents := tch.diskCache.get(cacheKey); contents != nil && len(contents.Entries) == int(tile.size) {
+		debug.step("disk_get", time.Time{}, "hit")
+		tch.hooks.cacheHit(ctx, tile)
+		tch.memoryCache.add(cacheKey, contents)
+		return contents, sourceDisk, nil
+	}
+	if contents := tch.getFromSharedCache(ctx, tile, cacheKey); contents != nil {
+		tch.hooks.cacheHit(ctx, tile)
+		tch.addToLocalCaches(cacheKey, contents)
+		return contents, sourceShared, nil
+	}
+	if tch.s3Health.degraded() {
+		debug.step("s3_get", time.Time{}, "skipped: S3 is degraded")
+		if contents, err := tch.getFromSecondary(ctx, tile); err == nil {
+			tch.hooks.cacheHit(ctx, tile)
+			tch.addToLocalCaches(cacheKey, contents)
+			tch.addToSharedCache(ctx, tile, cacheKey, contents)
+			return contents, sourceSecondary, nil
+		}
+		return tch.fetchFromBackend(ctx, tile)
+	}
+
+	beginS3Get := time.Now()
+	var contents *Entries
+	var err error
+	var bypassS3 bool
+	// If the S3 read is hedged, the backend fetch already in flight stands in
+	// for fetchFromBackend below.
+	var hedged *backendFetch
+	defer func() { hedged.stop() }()
+	fetchFromBackend := func() (*Entries, tileSource, error) {
+		if hedged != nil {
+			return hedged.wait()
+		}
+		return tch.fetchFromBackend(ctx, tile)
+	}
+	indexed := tch.tileIndex.mayBeCached(tile)
+	if indexed {
+		contents, hedged, err = tch.getFromS3Hedged(ctx, tile)
+		// A read canceled because the backend answered first says nothing
+		// about S3.
+		if !errors.Is(err, errBackendFirst) {
+			tch.backendLatencyMetric.WithLabelValues("s3_get").Observe(time.Since(beginS3Get).Seconds())
+			bypassS3 = tch.s3Health.done(ctx, err)
+		}
+	} else {
+		err = noSuchKey{}
+	}
+
+	if err == nil {
+		debug.step("s3_get", beginS3Get, "hit")
+		tch.hooks.cacheHit(ctx, tile)
+		tch.tileIndex.add(tile)
+		tch.addToLocalCaches(cacheKey, contents)
+		tch.addToSharedCache(ctx, tile, cacheKey, contents)
+		return contents, sourceS3, nil
+	}
+
+	// A tile written by a newer version of ctile, during a rollout, is
+	// served from the backend, but not overwritten.
+	if errors.Is(err, ErrUnsupportedFormat) && tch.mode != ModeCacheOnly {
+		debug.step("s3_get", beginS3Get, err.Error())
+		tch.requestsMetric.WithLabelValues("unsupported_format", "s3_get").Inc()
+		return fetchFromBackend()
+	}
+
+	// So is one encrypted with a key this instance doesn't have, e.g. while
+	// keys are rotated.
+	if errors.Is(err, ErrKeyMismatch) && tch.mode != ModeCacheOnly {
+		debug.step("s3_get", beginS3Get, err.Error())
+		tch.requestsMetric.WithLabelValues("key_mismatch", "s3_get").Inc()
+		return fetchFromBackend()
+	}
+
+	if !errors.Is(err, noSuchKey{}) {
+		debug.step("s3_get", beginS3Get, err.Error())
+		tch.requestsMetric.WithLabelValues("error", "s3_get").Inc()
+		// If the secondary bucket doesn't have the tile either, carry on as
+		// without it.
+		if contents, err := tch.getFromSecondary(ctx, tile); err == nil {
+			tch.hooks.cacheHit(ctx, tile)
+			tch.addToLocalCaches(cacheKey, contents)
+			tch.addToSharedCache(ctx, tile, cacheKey, contents)
+			return contents, sourceSecondary, nil
+		}
+		if bypassS3 {
+			log.Printf("warning: fetching tile %d-%d from the backend, without caching it: error reading tile from s3: %s\n", tile.start, tile.end-1, err)
+			return fetchFromBackend()
+		}
+		return nil, sourceS3, fmt.Errorf("error reading tile from s3: %w", err)
+	}
+
+	if errors.Is(err, errBackendFirst) {
+		debug.step("s3_get", beginS3Get, "canceled: "+err.Error())
+	} else if indexed {
+		debug.step("s3_get", beginS3Get, "miss")
+		tch.tileIndex.remove(tile)
+	} else {
+		debug.step("s3_get", time.Time{}, "skipped: not in the tile index")
+	}
+	tch.hooks.cacheMiss(ctx, tile)
+
+	if tch.partialTileCaching && cachedPartialLength(ctx) == 0 && hedged == nil {
+		beginPartialGet := time.Now()
+		partial, err := tch.getPartialFromS3(ctx, tile)
+		debug.step("s3_partial_get", beginPartialGet, debugResult(partial, err))
+		if err == nil {
+			return partial, sourceS3, nil
+		}
+		if !errors.Is(err, noSuchKey{}) {
+			tch.requestsMetric.WithLabelValues("error", "s3_partial_get").Inc()
+			log.Printf("warning: reading the partial version of tile %d-%d from S3: %s\n", tile.start, tile.end-1, err)
+		}
+	}
+
+	if tch.mode == ModeCacheOnly {
+		tch.requestsMetric.WithLabelValues("not_found", "s3_get").Inc()
+		return nil, sourceS3, fmt.Errorf("tile is not cached, and the backend is disabled in cache-only mode: %w", err)
+	}
+
+	// The marker saves a request to the backend, which a hedged read has
+	// already made.
+	if hedged == nil {
+		err = tch.readMarker(ctx, tile)
+		if err != nil {
+			return nil, sourceS3, err
+		}
+	}
+
+	// The owner of the tile, or the read-through peer, fetches and caches it.
+	// If it's unavailable, fall back to fetching the tile here, but pass on
+	// errors about the request.
+	if peer := tch.peerFor(ctx, tile); peer != "" {
+		beginPeerGet := time.Now()
+		contents, err := tch.fetchFromPeer(ctx, peer, tile)
+		debug.step("peer_get", beginPeerGet, fmt.Sprintf("%s: %s", peer, debugResult(contents, err)))
+		if err == nil && !tch.isPartialTile(contents) {
+			// Like groupcache's hot cache, keep complete tiles owned
+			// elsewhere locally, so hot ones don't take a request to the
+			// owner each time.
+			tch.addToLocalCaches(cacheKey, contents)
+		}
+		if err == nil || !isBackendFailure(err) {
+			return contents, sourcePeer, err
+		}
+		log.Printf("warning: %s; fetching from the backend instead\n", err)
+	}
+
+	contents, source, err := fetchFromBackend()
+	if err != nil {
+		var statusCodeErr statusCodeError
+		if errors.As(err, &statusCodeErr) && statusCodeErr.statusCode == http.StatusBadRequest {
+			tch.writeMarker(ctx, tile, tile.start)
+		}
+		return nil, source, err
+	}
+
+	if tch.isPartialTile(contents) {
+		contents = tch.retryPartialTile(ctx, tile, contents)
+	}
+
+	// If we got a partial tile, assume we are at the end of the log and the last
+	// tile isn't filled up yet. In that case, don't write to S3, but still return
+	// results to the user.
+	if tch.isPartialTile(contents) {
+		debug.step("s3_put", time.Time{}, fmt.Sprintf("skipped: partial tile of %d entries", len(contents.Entries)))
+		tch.partialTiles.Inc()
+		tch.writeMarker(ctx, tile, tile.start+int64(len(contents.Entries)))
+		tch.tailCache.add(tile, contents)
+		if tch.partialTileCaching && len(contents.Entries) > cachedPartialLength(ctx) {
+			beginPartialPut := time.Now()
+			writeCtx, cancel := tch.s3WriteContext(ctx)
+			err := tch.writePartialToS3(writeCtx, tile, contents)
+			cancel()
+			debug.step("s3_partial_put", beginPartialPut, debugResult(nil, err))
+			if err != nil {
+				tch.requestsMetric.WithLabelValues("error", "s3_partial_put").Inc()
+				log.Printf("warning: writing partial tile %d-%d to S3: %s\n", tile.start, tile.end-1, err)
+			}
+		}
+		return contents, sourceCTLog, nil
+	}
+
+	if tch.strictValidation {
+		beginValidate := time.Now()
+		err = tch.validateTile(ctx, tile, contents)
+		debug.step("validate", beginValidate, debugResult(nil, err))
+		var invalid invalidTileError
+		if errors.As(err, &invalid) {
+			tch.invalidTiles.WithLabelValues(invalid.reason).Inc()
+			return nil, sourceCTLog, err
+		}
+		if err != nil {
+			log.Printf("warning: not caching tile %d-%d, which couldn't be validated: %s\n", tile.start, tile.end-1, err)
+			return contents, sourceCTLog, nil
+		}
+	}
+
+	if tch.asyncWrites {
+		debug.step("s3_put", time.Time{}, "in the background")
+		tch.addToLocalCaches(cacheKey, contents)
+		tch.addToSharedCache(ctx, tile, cacheKey, contents)
+		tch.writeQueue.add(ctx, tile, contents, 0)
+		return contents, sourceCTLog, nil
+	}
+
+	beginS3Put := time.Now()
+	writeCtx, cancel := tch.s3WriteContext(ctx)
+	err = tch.writeToS3(writeCtx, tile, contents)
+	bypassS3 = tch.s3Health.done(writeCtx, err)
+	cancel()
+	tch.backendLatencyMetric.WithLabelValues("s3_put").Observe(time.Since(beginS3Put).Seconds())
+	debug.step("s3_put", beginS3Put, debugResult(nil, err))
+
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "s3_put").Inc()
+		if tch.writeQueue != nil {
+			log.Printf("warning: serving tile %d-%d and retrying the write in the background: error writing tile to S3: %s\n", tile.start, tile.end-1, err)
+			tch.addToLocalCaches(cacheKey, contents)
+			tch.addToSharedCache(ctx, tile, cacheKey, contents)
+			tch.writeQueue.add(ctx, tile, contents, 1)
+			return contents, sourceCTLog, nil
+		}
+		if bypassS3 {
+			log.Printf("warning: serving tile %d-%d without caching it: error writing tile to S3: %s\n", tile.start, tile.end-1, err)
+			return contents, sourceCTLog, nil
+		}
+		return nil, sourceCTLog, fmt.Errorf("error writing tile to S3: %w", err)
+	}
+	if !tch.dryRun {
+		tch.tileIndex.add(tile)
+		tch.hooks.tileCached(ctx, tile)
+	}
+	tch.addToLocalCaches(cacheKey, contents)
+	tch.addToSharedCache(ctx, tile, cacheKey, contents)
+
+	return contents, sourceCTLog, nil
+}
+
+// fetchFromBackend fetches a tile using getTileFromBackend, failing over
+// between replicas of the backend, and records metrics about the result.
+func (tch *Handler) fetchFromBackend(ctx context.Context, tile tile) (*Entries, tileSource, error) {
+	debug := debugFrom(ctx)
+	beginAcquire := time.Now()
+	release, err := tch.backendLimiter.acquire(ctx)
+	if err != nil {
+		debug.step("backend_limiter", beginAcquire, err.Error())
+		tch.requestsMetric.WithLabelValues("limited", "ct_log_get").Inc()
+		return nil, sourceCTLog, err
+	}
+	defer release()
+
+	err = tch.breaker.allow()
+	if err != nil {
+		debug.step("circuit_breaker", time.Time{}, err.Error())
+		tch.requestsMetric.WithLabelValues("circuit_open", "ct_log_get").Inc()
+		return nil, sourceCTLog, err
+	}
+
+	onFailover := func() {
+		tch.requestsMetric.WithLabelValues("failover", "ct_log_get").Inc()
+	}
+	contents, err := tryBackends(ctx, tch.backends, onFailover, func(b *backend) (*Entries, error) {
+		ctx := ctx
+		if tch.backendTimeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tch.backendTimeout)
+			defer cancel()
+		}
+
+		beginCTLogGet := time.Now()
+		var contents *Entries
+		var err error
+		switch tch.backendType {
+		case BackendStaticCT:
+			contents, err = tch.getTileFromStaticCT(ctx, b.url, tile)
+		case BackendRFC9162:
+			contents, err = tch.getTileFromRFC9162(ctx, b.url, tile)
+		default:
+			contents, err = getTileFromBackend(ctx, tch.httpClient, b.url, tile, tch.maxBackendBodySize)
+		}
+		tch.backendLatencyMetric.WithLabelValues("ct_log_get").Observe(time.Since(beginCTLogGet).Seconds())
+		debug.step("ct_log_get", beginCTLogGet, fmt.Sprintf("%s: %s", b.url, debugResult(contents, err)))
+		return contents, err
+	})
+	tch.breaker.done(ctx, err)
+
+	if err != nil {
+		var statusCodeErr statusCodeError
+		// Requests for tiles past the end of the log will get a 400 from CTFE, so report those
+		// separately.
+		if errors.As(err, &statusCodeErr) && statusCodeErr.statusCode == http.StatusBadRequest {
+			tch.requestsMetric.WithLabelValues("bad_request", "ct_log_get").Inc()
+		} else if errors.Is(err, errBodyTooLarge) {
+			tch.requestsMetric.WithLabelValues("too_large", "ct_log_get").Inc()
+		} else {
+			tch.requestsMetric.WithLabelValues("error", "ct_log_get").Inc()
+		}
+		tch.hooks.backendError(ctx, tile, err)
+		return nil, sourceCTLog, fmt.Errorf("error reading tile from backend: %w", err)
+	}
+
+	return contents, sourceCTLog, nil
+}
+
+// isPartialTile returns true if there are fewer items in the tile than were
+// requested by the Handler.
+func (tch *Handler) isPartialTile(contents *Entries) bool {
+	return len(contents.Entries) < tch.tileSize
+}
+
+// singleflightDo is a wrapper around singleflight.Group.Do that, instead of
+// returning an interface{}, returns the exact type of the first return type of
+// the function fn. (singleflight was built before generics)
+func singleflightDo[V any](group *singleflight.Group, key string, fn func() (V, error)) (V, error, bool) {
+	out, err, shared := group.Do(key, func() (interface{}, error) {
+		return fn()
+	})
+	return out.(V), err, shared
+}
+
+// coalesces returns whether requests for path are collapsed, i.e. whether
+// it's one of the coalesced endpoints of version 1 or 2 of the CT API.
+func (tch *Handler) coalesces(path string) bool {
+	i := strings.LastIndex(path, "/ct/v1/")
+	if j := strings.LastIndex(path, "/ct/v2/"); j > i {
+		i = j
+	}
+	return i >= 0 && tch.coalescedEndpoints[path[i+len("/ct/v1/"):]]
+}
+
+// passthroughHandler is an HTTP handler that passes through GET requests to the CT log,
+// failing over between replicas of the backend.
+type passthroughHandler struct {
+	backends    *backendSet
+	breaker     *circuitBreaker
+	maxBodySize int64
+
+	// If group is set, simultaneous requests for the same path and query
+	// share one request to the backend, bounded by timeout rather than by
+	// any one request, and shared counts the requests that did. If waiting
+	// is set, it's called once a request is waiting for the shared request.
+	group   *singleflight.Group
+	shared  prometheus.Counter
+	timeout time.Duration
+	waiting func()
+}
+
+// hopByHopHeaders are the headers of a response that apply to its connection
+// only, so they aren't passed through from the backend.
+var hopByHopHeaders = map[string]bool{
+	"Connection":         true,
+	"Keep-Alive":         true,
+	"Proxy-Authenticate": true,
+	"Proxy-Connection":   true,
+	"Te":                 true,
+	"Trailer":            true,
+	"Transfer-Encoding":  true,
+	"Upgrade":            true,
+}
+
+// copyHeader sets the headers of a backend response, from, other than
+// hop-by-hop ones, in to, the headers of the response to the client. The
+// values are copied, since from may be shared by coalesced requests.
+func copyHeader(to, from http.Header) {
+	for name, values := range from {
+		if !hopByHopHeaders[name] {
+			to[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// passthroughResponse is a response from the backend read into memory, so it
+// can be shared by coalesced requests.
+type passthroughResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+func (p passthroughHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "only GET is supported")
+		return
+	}
+	err := p.breaker.allow()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	debug := debugFrom(r.Context())
+	begin := time.Now()
+	target := r.URL.RequestURI()
+	if p.group != nil {
+		results := p.group.DoChan(target, func() (interface{}, error) {
+			// The fetch is shared, so the client that started it going away
+			// mustn't fail the others.
+			ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, p.timeout)
+			defer cancel()
+			return p.fetchBody(ctx, target, nil)
+		})
+		if p.waiting != nil {
+			p.waiting()
+		}
+		var result singleflight.Result
+		select {
+		case result = <-results:
+		case <-r.Context().Done():
+			// The shared fetch carries on for the other requests.
+			debug.step("passthrough", begin, r.Context().Err().Error())
+			writePassthroughError(w, r.Context().Err())
+			return
+		}
+		resp, _ := result.Val.(*passthroughResponse)
+		err, shared := result.Err, result.Shared
+		if shared {
+			p.shared.Inc()
+		}
+		debug.setResult("", shared)
+		debug.step("passthrough", begin, passthroughDebugResult(resp, err))
+		if writePassthroughError(w, err) {
+			return
+		}
+		copyHeader(w.Header(), resp.header)
+		w.WriteHeader(resp.statusCode)
+		_, err = w.Write(resp.body)
+		if err != nil {
+			log.Printf("error copying response body to client: %s\n", err)
+		}
+		return
+	}
+
+	resp, err := p.fetch(r.Context(), target, nil)
+	if err != nil {
+		debug.step("passthrough", begin, err.Error())
+	} else {
+		debug.step("passthrough", begin, resp.Status)
+	}
+	if writePassthroughError(w, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		log.Printf("error copying response body to client: %s\n", err)
+	}
+}
+
+// fetch requests path, which may include a query, from the backend, sending
+// any extra header, failing over between replicas, and reports the result to
+// the circuit breaker.
+func (p passthroughHandler) fetch(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	resp, err := tryBackends(ctx, p.backends, func() {}, func(b *backend) (*http.Response, error) {
+		url := fmt.Sprintf("%s%s", b.url, path)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := p.backends.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %w", url, err)
+		}
+		// Read the body of server errors, so the response can be discarded
+		// if another replica is tried.
+		if isBackendFailure(statusCodeError{statusCode: resp.StatusCode}) {
+			defer resp.Body.Close()
+			limitBody(resp, p.maxBodySize)
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return nil, readBodyError(url, err)
+			}
+			return nil, statusCodeError{resp.StatusCode, body}
+		}
+		return resp, nil
+	})
+	p.breaker.done(ctx, err)
+	return resp, err
+}
+
+// fetchBody is like fetch, but reads the response into memory.
+func (p passthroughHandler) fetchBody(ctx context.Context, path string, header http.Header) (*passthroughResponse, error) {
+	resp, err := p.fetch(ctx, path, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	limitBody(resp, p.maxBodySize)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, readBodyError(resp.Request.URL.String(), err)
+	}
+	return &passthroughResponse{resp.StatusCode, resp.Header, body}, nil
+}
+
+// writePassthroughError writes the response for an error from fetch, if err
+// isn't nil, and returns whether it did.
+func writePassthroughError(w http.ResponseWriter, err error) bool {
+	var statusCodeErr statusCodeError
+	if errors.As(err, &statusCodeErr) {
+		w.WriteHeader(statusCodeErr.statusCode)
+		_, _ = w.Write(statusCodeErr.body)
+		return true
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s\n", err)
+		return true
+	}
+	return false
+}
+
+// S3API is the subset of the S3 client's methods that ctile uses. It's
+// implemented by *s3.Client.
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	s3.ListObjectsV2APIClient
+}
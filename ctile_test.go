@@ -0,0 +1,166 @@
+package ctile
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestTrimForDisplay(t *testing.T) {
+	entries := &Entries{
+		Entries: []Entry{
+			{},
+			{},
+			{},
+		},
+	}
+	_, err := entries.trimForDisplay(1, 2, tile{start: 10, end: 20, size: 10, logURL: "http://example.com"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "internal inconsistency") {
+		t.Errorf("expected internal inconsistency error, got %s", err)
+	}
+
+	_, err = entries.trimForDisplay(999, 1000, tile{start: 10, end: 20, size: 10, logURL: "http://example.com"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "internal inconsistency") {
+		t.Errorf("expected internal inconsistency error, got %s", err)
+	}
+
+	_, err = entries.trimForDisplay(1000, 1000, tile{start: 10, end: 20, size: 10, logURL: "http://example.com"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "internal inconsistency") {
+		t.Errorf("expected internal inconsistency error, got %s", err)
+	}
+
+	_, err = entries.trimForDisplay(10, 20, tile{start: 10, end: 12, size: 2, logURL: "http://example.com"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "internal inconsistency") {
+		t.Errorf("expected internal inconsistency error, got %s", err)
+	}
+
+	_, err = entries.trimForDisplay(15, 20, tile{start: 10, end: 20, size: 10, logURL: "http://example.com"})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "past the end of the log") {
+		t.Errorf("expected 'past the end of the log' error, got %s", err)
+	}
+
+	e, err := entries.trimForDisplay(10, 20, tile{start: 10, end: 20, size: 10, logURL: "http://example.com"})
+	if err != nil {
+		t.Fatalf("expected success, got %s", err)
+	}
+	if len(e.Entries) != 3 {
+		t.Errorf("expected 3 entries got %d", len(entries.Entries))
+	}
+
+	e, err = entries.trimForDisplay(11, 12, tile{start: 10, end: 20, size: 10, logURL: "http://example.com"})
+	if err != nil {
+		t.Fatalf("expected success, got %s", err)
+	}
+	if len(e.Entries) != 1 {
+		t.Errorf("expected 1 entry got %d", len(entries.Entries))
+	}
+
+	e, err = entries.trimForDisplay(12, 20, tile{start: 10, end: 20, size: 10, logURL: "http://example.com"})
+	if err != nil {
+		t.Fatalf("expected success, got %s", err)
+	}
+	if len(e.Entries) != 1 {
+		t.Errorf("expected 1 entry got %d", len(entries.Entries))
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, name := range []string{"normal", "cache-only", "proxy-only"} {
+		mode, err := ParseMode(name)
+		if err != nil {
+			t.Errorf("%q: expected success, got %s", name, err)
+		}
+		if string(mode) != name {
+			t.Errorf("expected %q, got %q", name, mode)
+		}
+	}
+
+	_, err := ParseMode("bogus")
+	if err == nil {
+		t.Error("expected error for unknown mode, got none")
+	}
+}
+
+func TestParseTileKey(t *testing.T) {
+	size, start, err := ParseTileKey(TileKey(256, 1000))
+	if err != nil {
+		t.Fatalf("expected success, got %s", err)
+	}
+	if size != 256 || start != 768 {
+		t.Errorf("expected size 256 and start 768, got %d and %d", size, start)
+	}
+	size, start, err = ParseTileKey(keyHash(768) + "/" + TileKey(256, 1000))
+	if err != nil || size != 256 || start != 768 {
+		t.Errorf("expected size 256 and start 768 from a hashed key, got %d, %d and %v", size, start, err)
+	}
+
+	invalid := []string{
+		"",
+		"tile_size=256",
+		"tile_size=256/768",
+		"tile_size=256/768.json",
+		"tile_size=0/0.cbor.gz",
+		"tile_size=256/-256.cbor.gz",
+		"tile_size=256/100.cbor.gz",
+		"tile_size=abc/0.cbor.gz",
+		"other/tile_size=256/0.cbor.gz",
+		"0000/tile_size=256/0.cbor.gz",
+	}
+	for _, key := range invalid {
+		_, _, err := ParseTileKey(key)
+		if err == nil {
+			t.Errorf("%q: expected error, got none", key)
+		}
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    []Option
+		wantErr string
+	}{
+		{"minimal", []Option{WithTileSize(256), WithS3(s3mem.New(), "bucket", "prefix")}, ""},
+		{"proxy-only without S3", []Option{WithTileSize(256), WithMode(ModeProxyOnly)}, ""},
+		{"no tile size", []Option{WithS3(s3mem.New(), "bucket", "prefix")}, "tile size"},
+		{"no S3", []Option{WithTileSize(256)}, "S3 service"},
+		{"no bucket", []Option{WithTileSize(256), WithS3(s3mem.New(), "", "prefix")}, "S3 bucket"},
+		{"zero timeout", []Option{WithTileSize(256), WithMode(ModeProxyOnly), WithTimeouts(Timeouts{})}, "timeout"},
+		{"nil metrics", []Option{WithTileSize(256), WithMode(ModeProxyOnly), WithMetrics(nil)}, "metrics"},
+		{"negative max body size", []Option{WithTileSize(256), WithMode(ModeProxyOnly), WithMaxBackendBodySize(-1)}, "body size"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, err := New("http://example.com", tc.opts...)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected success, got %s", err)
+				}
+				if handler.fullRequestTimeout != 4*time.Second {
+					t.Errorf("expected default full request timeout of 4s, got %s", handler.fullRequestTimeout)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package ctile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DebugHeader is the request header that asks for a breakdown of how the
+// request was served. See WithDebug.
+const DebugHeader = "X-CTile-Debug"
+
+// WithDebug lets requests with DebugHeader ask for a breakdown of how they
+// were served, for debugging reports about individual requests without
+// searching the logs. authorize decides which requests may, e.g. by checking
+// the header's value against a secret token; debug output reveals the
+// backend's URLs and the Handler's internals, so it mustn't be open to
+// everyone.
+//
+// The breakdown is returned as JSON in the DebugHeader response header. It
+// lists the tile the request mapped to, where its contents came from, whether
+// the request shared another's work through request collapsing, and each
+// step taken, such as S3 reads and writes and backend requests, with its
+// result and duration. A request that shared another's work lists only its
+// own steps, since the work was done on behalf of the other request.
+func WithDebug(authorize func(r *http.Request) bool) Option {
+	return func(o *options) {
+		o.debugAuthorize = authorize
+	}
+}
+
+// requestDebug collects the breakdown of a request for WithDebug. Its
+// methods may be called on a nil *requestDebug, and then do nothing, so the
+// request path doesn't need to check whether debugging is on.
+type requestDebug struct {
+	begin time.Time
+
+	// mu protects the fields below, which may be set by the goroutines of
+	// concurrent backend requests.
+	mu     sync.Mutex
+	Tile   *TileInfo   `json:"tile,omitempty"`
+	Source tileSource  `json:"source,omitempty"`
+	Shared bool        `json:"shared"`
+	Steps  []debugStep `json:"steps"`
+	// DurationMS is the time from the start of the request to its response.
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// debugStep is a step taken to serve a request.
+type debugStep struct {
+	Step       string  `json:"step"`
+	Result     string  `json:"result"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+}
+
+type debugKey struct{}
+
+// debugFrom returns the requestDebug of the request ctx is for, or nil if the
+// request didn't ask for debugging.
+func debugFrom(ctx context.Context) *requestDebug {
+	d, _ := ctx.Value(debugKey{}).(*requestDebug)
+	return d
+}
+
+// step records a step that started at begin and had the given result. A zero
+// begin records a decision, which takes no time.
+func (d *requestDebug) step(name string, begin time.Time, result string) {
+	if d == nil {
+		return
+	}
+	s := debugStep{Step: name, Result: result}
+	if !begin.IsZero() {
+		s.DurationMS = milliseconds(time.Since(begin))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Steps = append(d.Steps, s)
+}
+
+// setTile records the tile the request maps to.
+func (d *requestDebug) setTile(t tile) {
+	if d == nil {
+		return
+	}
+	info := t.info()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Tile = &info
+}
+
+// setResult records where the tile came from, and whether the work was shared
+// with another request.
+func (d *requestDebug) setResult(source tileSource, shared bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Source = source
+	d.Shared = d.Shared || shared
+}
+
+// marshal returns the breakdown as JSON.
+func (d *requestDebug) marshal() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.DurationMS = milliseconds(time.Since(d.begin))
+	out, err := json.Marshal(d)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// debugResponseWriter adds the breakdown in its requestDebug to the response
+// headers, however the response is written.
+type debugResponseWriter struct {
+	http.ResponseWriter
+	debug       *requestDebug
+	wroteHeader bool
+}
+
+func (w *debugResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(DebugHeader, w.debug.marshal())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *debugResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the ResponseWriter w wraps, for http.ResponseController.
+func (w *debugResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// startDebug returns w and r set up to collect a breakdown of the request, if
+// it asks for one and is authorized to.
+func (tch *Handler) startDebug(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if tch.debugAuthorize == nil || r.Header.Get(DebugHeader) == "" || !tch.debugAuthorize(r) {
+		return w, r
+	}
+	d := &requestDebug{begin: time.Now(), Steps: []debugStep{}}
+	return &debugResponseWriter{ResponseWriter: w, debug: d}, r.WithContext(context.WithValue(r.Context(), debugKey{}, d))
+}
+
+// debugResult describes the result of a step that got contents or failed with
+// err.
+func debugResult(contents *Entries, err error) string {
+	switch {
+	case err != nil:
+		return err.Error()
+	case contents != nil:
+		return fmt.Sprintf("%d entries", len(contents.Entries))
+	default:
+		return "ok"
+	}
+}
+
+// passthroughDebugResult describes the result of a coalesced passthrough
+// request.
+func passthroughDebugResult(resp *passthroughResponse, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d %s", resp.statusCode, http.StatusText(resp.statusCode))
+}
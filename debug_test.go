@@ -0,0 +1,88 @@
+package ctile
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestDebug(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithDebug(func(r *http.Request) bool {
+			return r.Header.Get(DebugHeader) == "secret"
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	debug := func(token, url string) *requestDebug {
+		t.Helper()
+		req := httptest.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set(DebugHeader, token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		header := w.Result().Header.Get(DebugHeader)
+		if header == "" {
+			return nil
+		}
+		var d requestDebug
+		err := json.Unmarshal([]byte(header), &d)
+		if err != nil {
+			t.Fatalf("parsing %s: %s", DebugHeader, err)
+		}
+		return &d
+	}
+	steps := func(d *requestDebug) string {
+		var names []string
+		for _, s := range d.Steps {
+			names = append(names, s.Step+"="+s.Result)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if d := debug("", "/ct/v1/get-entries?start=3&end=4"); d != nil {
+		t.Errorf("expected no breakdown without %s, got %+v", DebugHeader, d)
+	}
+	if d := debug("wrong", "/ct/v1/get-entries?start=3&end=4"); d != nil {
+		t.Errorf("expected no breakdown with the wrong token, got %+v", d)
+	}
+
+	// The tile was cached by the first requests.
+	d := debug("secret", "/ct/v1/get-entries?start=3&end=4")
+	if d == nil {
+		t.Fatal("expected a breakdown")
+	}
+	if d.Tile == nil || d.Tile.Start != 3 || d.Tile.End != 6 || d.Source != sourceS3 {
+		t.Errorf("expected tile 3-6 from S3, got %+v from %q", d.Tile, d.Source)
+	}
+	if got := steps(d); got != "s3_get=hit" {
+		t.Errorf("expected an S3 hit, got steps %s", got)
+	}
+
+	d = debug("secret", "/ct/v1/get-entries?start=9&end=9")
+	expected := "s3_get=miss,ct_log_get=" + backend.URL + ": 1 entries,s3_put=skipped: partial tile of 1 entries"
+	if got := steps(d); got != expected {
+		t.Errorf("expected steps %s, got %s", expected, got)
+	}
+	if d.Source != sourceCTLog {
+		t.Errorf("expected source %q, got %q", sourceCTLog, d.Source)
+	}
+
+	d = debug("secret", "/ct/v1/get-sth")
+	if got := steps(d); got != "passthrough=200 OK" {
+		t.Errorf("expected a passthrough step, got %s", got)
+	}
+}
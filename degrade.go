@@ -0,0 +1,155 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// S3Degradation configures what a Handler in ModeNormal does when S3 keeps
+// failing. By default, requests fail when their tile can't be read from or
+// written to S3, so an S3 outage takes down get-entries with it. With
+// Failures set, the Handler instead serves through S3 failures from the
+// backend, and after Failures consecutive ones, degrades to serving like
+// ModeProxyOnly, without touching S3, until a probe finds S3 working again.
+// ctile_s3_degraded is 1 while it's degraded, for alerting, since every
+// request then reaches the backend.
+type S3Degradation struct {
+	// Failures is the number of consecutive failed S3 requests that degrade
+	// the Handler. Zero means requests fail instead.
+	Failures int
+	// ProbeInterval is how often S3 is probed while degraded. Defaults to
+	// 10 seconds.
+	ProbeInterval time.Duration
+}
+
+// WithS3Degradation sets how to keep serving while S3 fails.
+func WithS3Degradation(d S3Degradation) Option {
+	return func(o *options) {
+		o.s3Degradation = d
+	}
+}
+
+const defaultS3ProbeInterval = 10 * time.Second
+
+// s3Health enforces S3Degradation. A nil *s3Health is never degraded, and
+// means S3 failures fail requests.
+type s3Health struct {
+	failures int
+	interval time.Duration
+	probe    func(ctx context.Context) error
+
+	degradedMetric prometheus.Gauge
+
+	// stop is closed by close, to end probes.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// mu protects the fields below.
+	mu          sync.Mutex
+	consecutive int
+	isDegraded  bool
+}
+
+func newS3Health(d S3Degradation, probe func(ctx context.Context) error, promRegisterer prometheus.Registerer) *s3Health {
+	if d.Failures == 0 {
+		return nil
+	}
+	h := &s3Health{
+		failures: d.Failures,
+		interval: d.ProbeInterval,
+		probe:    probe,
+		degradedMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ctile_s3_degraded",
+			Help: "1 if S3 keeps failing, so tiles are served from the backend without touching S3, and 0 otherwise",
+		}),
+		stop: make(chan struct{}),
+	}
+	if h.interval == 0 {
+		h.interval = defaultS3ProbeInterval
+	}
+	promRegisterer.MustRegister(h.degradedMetric)
+	return h
+}
+
+// degraded returns true if S3 must not be used.
+func (h *s3Health) degraded() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.isDegraded
+}
+
+// done records the outcome of an S3 request made with ctx. A missing key, or
+// an object S3 returned but ctile can't use, counts as a success, and as in circuitBreaker.done, a cancellation isn't
+// held against S3. It returns true if the request should go on without S3
+// despite err.
+func (h *s3Health) done(ctx context.Context, err error) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil || errors.Is(err, noSuchKey{}) || errors.Is(err, ErrUnsupportedFormat) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrKeyMismatch) {
+		h.consecutive = 0
+		return false
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	h.consecutive++
+	if h.consecutive >= h.failures && !h.isDegraded {
+		log.Printf("warning: S3 failed %d times in a row, serving from the backend without it until it recovers: %s\n", h.consecutive, err)
+		h.isDegraded = true
+		h.degradedMetric.Set(1)
+		go h.probeUntilHealthy()
+	}
+	return true
+}
+
+// probeUntilHealthy probes S3 each interval until a probe succeeds, and
+// then ends the degradation.
+func (h *s3Health) probeUntilHealthy() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+		err := h.probe(ctx)
+		cancel()
+		if err != nil && !errors.Is(err, noSuchKey{}) {
+			continue
+		}
+		h.mu.Lock()
+		h.consecutive = 0
+		h.isDegraded = false
+		h.degradedMetric.Set(0)
+		h.mu.Unlock()
+		log.Printf("S3 recovered, caching tiles again\n")
+		return
+	}
+}
+
+// close stops probes.
+func (h *s3Health) close() {
+	if h == nil {
+		return
+	}
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+// probeS3 reads a key that's never written, to check that S3 is reachable.
+func (tch *Handler) probeS3(ctx context.Context) error {
+	_, err := GetTileObject(ctx, tch.s3Service, tch.s3Bucket, tch.s3Prefix+"health-probe")
+	return err
+}
@@ -0,0 +1,108 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// flakyS3 is an in-memory S3 that fails every request while failing is set.
+// It counts requests other than probes.
+type flakyS3 struct {
+	*s3mem.Client
+	failing  atomic.Bool
+	requests atomic.Int64
+}
+
+func (f *flakyS3) GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if !strings.HasSuffix(*in.Key, "health-probe") {
+		f.requests.Add(1)
+	}
+	if f.failing.Load() {
+		return nil, errors.New("S3 is down")
+	}
+	return f.Client.GetObject(ctx, in, opts...)
+}
+
+func (f *flakyS3) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.requests.Add(1)
+	if f.failing.Load() {
+		return nil, errors.New("S3 is down")
+	}
+	return f.Client.PutObject(ctx, in, opts...)
+}
+
+func TestS3Degradation(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(20, 3))
+	defer backend.Close()
+
+	expectStatus := func(handler *Handler, url string, expected int) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s: expected status %d, got %d", url, expected, resp.StatusCode)
+		}
+	}
+
+	// By default, S3 failures fail requests.
+	svc := &flakyS3{Client: s3mem.New()}
+	svc.failing.Store(true)
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(handler, "/ct/v1/get-entries?start=0&end=2", http.StatusInternalServerError)
+
+	svc = &flakyS3{Client: s3mem.New()}
+	svc.failing.Store(true)
+	handler, err = New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithS3Degradation(S3Degradation{Failures: 2, ProbeInterval: 10 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	// Each failure is served through, and the second degrades the handler.
+	expectStatus(handler, "/ct/v1/get-entries?start=0&end=2", http.StatusOK)
+	if handler.s3Health.degraded() {
+		t.Fatal("expected one failure not to degrade the handler")
+	}
+	expectStatus(handler, "/ct/v1/get-entries?start=3&end=5", http.StatusOK)
+	if !handler.s3Health.degraded() {
+		t.Fatal("expected two failures to degrade the handler")
+	}
+
+	// While degraded, S3 isn't touched, except by probes.
+	svc.requests.Store(0)
+	expectStatus(handler, "/ct/v1/get-entries?start=6&end=8", http.StatusOK)
+	if svc.requests.Load() != 0 {
+		t.Errorf("expected no requests to S3 while degraded, got %d", svc.requests.Load())
+	}
+
+	// Once a probe succeeds, tiles are cached again.
+	svc.failing.Store(false)
+	for deadline := time.Now().Add(5 * time.Second); handler.s3Health.degraded(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a probe to end the degradation")
+		}
+	}
+	expectStatus(handler, "/ct/v1/get-entries?start=6&end=8", http.StatusOK)
+	_, err = GetTileObject(context.Background(), svc, "bucket", "test/"+TileKey(3, 6))
+	if err != nil {
+		t.Errorf("expected the tile to be cached after recovery, got %s", err)
+	}
+}
@@ -0,0 +1,254 @@
+package ctile
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DiskCache is an LRU cache of tiles in a local directory, such as on an NVMe
+// drive, between the Handler's memory cache and S3. For a busy log, it can
+// absorb most reads that miss the memory cache, which cuts S3 requests, and
+// it survives restarts. Only complete tiles are kept. It may be shared by the
+// Handlers of several logs. Use NewDiskCache to create one, and pass it to
+// WithDiskCache.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	requests *prometheus.CounterVec
+	bytes    prometheus.Gauge
+
+	// mu protects the fields below.
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // Of *diskCacheFile, most recently used first.
+	files map[string]*list.Element
+}
+
+type diskCacheFile struct {
+	name string
+	size int64
+}
+
+// diskCacheTemp is the suffix of files being written.
+const diskCacheTemp = ".tmp"
+
+// NewDiskCache returns a DiskCache holding up to maxBytes of tiles in dir,
+// which is created if it doesn't exist. Tiles already in dir, from before a
+// restart, are kept, in the order they were last used. The metrics
+// ctile_disk_cache_requests, counting hits and misses, and
+// ctile_disk_cache_bytes, the size of the tiles held, are registered with
+// promRegisterer.
+func NewDiskCache(dir string, maxBytes int64, promRegisterer prometheus.Registerer) (*DiskCache, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("disk cache size must be positive")
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating disk cache directory: %w", err)
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_disk_cache_requests",
+			Help: "lookups of tiles in the on-disk cache, by result: hit or miss",
+		}, []string{"result"}),
+		bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ctile_disk_cache_bytes",
+			Help: "size of the tiles held in the on-disk cache",
+		}),
+		lru:   list.New(),
+		files: make(map[string]*list.Element),
+	}
+	err = c.load()
+	if err != nil {
+		return nil, err
+	}
+	promRegisterer.MustRegister(c.requests, c.bytes)
+	return c, nil
+}
+
+// load adds the files in the directory to the cache, oldest first, removing
+// leftovers of interrupted writes and files beyond the size limit.
+func (c *DiskCache) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("reading disk cache directory: %w", err)
+	}
+	type file struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), diskCacheTemp) {
+			os.Remove(filepath.Join(c.dir, entry.Name()))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.Size() > c.maxBytes {
+			os.Remove(filepath.Join(c.dir, entry.Name()))
+			continue
+		}
+		files = append(files, file{entry.Name(), info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var evicted []string
+	for _, f := range files {
+		evicted = append(evicted, c.insert(f.name, f.size)...)
+	}
+	c.removeFiles(evicted)
+	return nil
+}
+
+// WithDiskCache sets an on-disk cache tier between the memory cache and S3.
+// Tiles found in the tiers below it, or fetched from the backend, are added to
+// it.
+func WithDiskCache(cache *DiskCache) Option {
+	return func(o *options) {
+		o.diskCache = cache
+	}
+}
+
+// diskCacheFileName returns the name of the file for the tile at key.
+func diskCacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the tile at key, or nil if it isn't cached or can't be read.
+func (c *DiskCache) get(key string) *Entries {
+	if c == nil {
+		return nil
+	}
+	name := diskCacheFileName(key)
+	c.mu.Lock()
+	elem, ok := c.files[name]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.requests.WithLabelValues("miss").Inc()
+		return nil
+	}
+
+	path := filepath.Join(c.dir, name)
+	body, err := os.ReadFile(path)
+	var contents *Entries
+	if err == nil {
+		contents, err = DecodeTile(bytes.NewReader(body))
+	}
+	if err != nil {
+		// The file was evicted in the meantime, or is corrupt.
+		c.mu.Lock()
+		if elem, ok := c.files[name]; ok {
+			c.remove(elem)
+			c.bytes.Set(float64(c.size))
+		}
+		c.mu.Unlock()
+		if !errors.Is(err, os.ErrNotExist) {
+			os.Remove(path)
+		}
+		c.requests.WithLabelValues("miss").Inc()
+		return nil
+	}
+	c.requests.WithLabelValues("hit").Inc()
+	// Record the use, so the order survives restarts.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return contents
+}
+
+// add caches the tile at key, unless it's already cached or larger than the
+// whole cache. Failures to write are ignored, since the tile can be read from
+// the tiers below.
+func (c *DiskCache) add(key string, contents *Entries) {
+	if c == nil {
+		return
+	}
+	name := diskCacheFileName(key)
+	c.mu.Lock()
+	_, ok := c.files[name]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+	body, err := EncodeTile(contents)
+	if err != nil || int64(len(body)) > c.maxBytes {
+		return
+	}
+	f, err := os.CreateTemp(c.dir, "*"+diskCacheTemp)
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err != nil || closeErr != nil {
+		return
+	}
+	err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	evicted := c.insert(name, int64(len(body)))
+	c.mu.Unlock()
+	c.removeFiles(evicted)
+}
+
+// insert adds a file to the front of the LRU list, if it isn't already in
+// it, and evicts the least recently used files until the cache fits. It
+// returns the names of the evicted files, for removeFiles. c.mu must be held,
+// except during load.
+func (c *DiskCache) insert(name string, size int64) []string {
+	if _, ok := c.files[name]; ok {
+		return nil
+	}
+	var evicted []string
+	for c.size+size > c.maxBytes && c.lru.Len() > 0 {
+		evicted = append(evicted, c.remove(c.lru.Back()))
+	}
+	c.files[name] = c.lru.PushFront(&diskCacheFile{name, size})
+	c.size += size
+	c.bytes.Set(float64(c.size))
+	return evicted
+}
+
+// remove drops elem from the cache, and returns its file's name. c.mu must be
+// held.
+func (c *DiskCache) remove(elem *list.Element) string {
+	f := c.lru.Remove(elem).(*diskCacheFile)
+	delete(c.files, f.name)
+	c.size -= f.size
+	return f.name
+}
+
+// removeFiles deletes evicted files.
+func (c *DiskCache) removeFiles(names []string) {
+	for _, name := range names {
+		os.Remove(filepath.Join(c.dir, name))
+	}
+}
@@ -0,0 +1,105 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestDiskCache(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	dir := t.TempDir()
+	newHandler := func() *Handler {
+		cache, err := NewDiskCache(dir, 1<<20, prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler, err := New(backend.URL,
+			WithTileSize(3),
+			WithS3(s3mem.New(), "bucket", "test/"),
+			WithDiskCache(cache),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	expectSource := func(handler *Handler, url, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("expected X-Source %q, got %q", expected, source)
+		}
+	}
+
+	handler := newHandler()
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "CT log")
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "disk")
+	expectAndResetMetric(t, handler.diskCache.requests, 1, "hit")
+	expectSource(handler, "/ct/v1/get-entries?start=9&end=9", "CT log")
+	expectSource(handler, "/ct/v1/get-entries?start=9&end=9", "CT log")
+
+	// The cache survives a restart, even with a different S3.
+	handler = newHandler()
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "disk")
+
+	// A corrupt file is a miss, and is removed.
+	name := diskCacheFileName(handler.cacheKey(makeTile(0, 3, "")))
+	err := os.WriteFile(dir+"/"+name, []byte("garbage"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "CT log")
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "disk")
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	tile := func(i int64) *Entries {
+		return entriesFor(i, i+1)
+	}
+	body, err := EncodeTile(tile(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for two tiles, but not three.
+	c, err := NewDiskCache(dir, int64(len(body))*5/2, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.add("a", tile(0))
+	c.add("b", tile(0))
+	// Using a makes b the least recently used.
+	c.get("a")
+	c.add("c", tile(0))
+	if c.get("a") == nil || c.get("b") != nil || c.get("c") == nil {
+		t.Errorf("expected b to be dropped to make room for c")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 files, got %d", len(entries))
+	}
+
+	// A smaller limit after a restart drops the least recently used tiles.
+	c, err = NewDiskCache(dir, int64(len(body)), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.get("a") != nil || c.get("c") == nil {
+		t.Errorf("expected only the most recently used tile to be kept")
+	}
+}
@@ -0,0 +1,174 @@
+package ctile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// encryptionMetadataKey is the object metadata that holds the ID of the key a
+// tile was encrypted with. Objects without it aren't encrypted.
+const encryptionMetadataKey = "ctile-encryption-key"
+
+// Encryption configures encrypting tiles before they're written to S3, for
+// buckets that are shared with, or operated by, a third party.
+type Encryption struct {
+	// Keys are AES-256 keys, of 32 bytes each. Tiles are encrypted with
+	// AES-GCM using the first, and decrypted with whichever they were
+	// encrypted with. Keys are rotated by adding the new key after the old
+	// one on every instance, then moving it first. No keys disables
+	// encryption.
+	Keys [][]byte
+}
+
+// WithEncryption encrypts tiles before writing them to S3, as configured by
+// e, and decrypts them when they're read. Each tile is bound to its key in
+// S3, so tiles can't be swapped for each other unnoticed. Unencrypted tiles,
+// e.g. written before encryption was enabled, are treated as missing, so
+// they're fetched from the backend and written again, encrypted. Tiles
+// encrypted with a key the Handler doesn't have are served from the backend,
+// but not overwritten, and counted in ctile_requests with the result
+// "key_mismatch".
+//
+// Chains in a ChainStore aren't encrypted, but tiles hold their hashes, which
+// are checked when they're read.
+func WithEncryption(e Encryption) Option {
+	return func(o *options) {
+		o.encryption = e
+	}
+}
+
+// SetEncryptionKeys replaces the Keys of the Handler's Encryption, e.g. when a
+// new key is added or moved first, without restarting it. Tiles being written
+// or read already use the previous keys. No keys stops encrypting tiles.
+func (tch *Handler) SetEncryptionKeys(keys [][]byte) error {
+	encryptor, err := newEncryptor(Encryption{Keys: keys})
+	if err != nil {
+		return err
+	}
+	tch.encryptor.Store(encryptor)
+	return nil
+}
+
+// keyMismatch indicates that an object was encrypted with a key the reader
+// doesn't have.
+type keyMismatch struct {
+	bucket, key string
+	keyID       string   // The ID of the key the object was encrypted with.
+	haveIDs     []string // The IDs of the keys the reader has.
+}
+
+func (k keyMismatch) Error() string {
+	if len(k.haveIDs) == 0 {
+		return fmt.Sprintf("tile in bucket %q with key %q is encrypted with key %s, but no encryption keys are configured", k.bucket, k.key, k.keyID)
+	}
+	return fmt.Sprintf("tile in bucket %q with key %q is encrypted with key %s, but the configured encryption keys are %s", k.bucket, k.key, k.keyID, strings.Join(k.haveIDs, ", "))
+}
+
+// ErrKeyMismatch is returned when a tile is encrypted with a key the reader
+// doesn't have, including by GetTileObject, which has none.
+var ErrKeyMismatch error = keyMismatch{}
+
+// Is makes any keyMismatch match ErrKeyMismatch.
+func (keyMismatch) Is(target error) bool {
+	_, ok := target.(keyMismatch)
+	return ok
+}
+
+// keyID returns the ID of an encryption key, which is stored with the tiles
+// encrypted with it: the start of its SHA-256, in hex.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// encryptor encrypts and decrypts tiles. A nil *encryptor reads unencrypted
+// tiles only.
+type encryptor struct {
+	writeID string                 // The ID of the key tiles are encrypted with.
+	aeads   map[string]cipher.AEAD // By key ID.
+}
+
+func newEncryptor(e Encryption) (*encryptor, error) {
+	if len(e.Keys) == 0 {
+		return nil, nil
+	}
+	c := &encryptor{aeads: make(map[string]cipher.AEAD)}
+	for i, key := range e.Keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %d is %d bytes, not 32", i, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		if i == 0 {
+			c.writeID = id
+		}
+		c.aeads[id] = aead
+	}
+	return c, nil
+}
+
+// seal encrypts the body of the object to be written with the given key,
+// which is authenticated with it, and returns it with the ID of the key used.
+func (c *encryptor) seal(key string, body []byte) ([]byte, string, error) {
+	aead := c.aeads[c.writeID]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, "", fmt.Errorf("generating nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, body, []byte(key)), c.writeID, nil
+}
+
+// open returns the decrypted body of the object with the given bucket, key
+// and metadata. Unencrypted objects are returned as they are if c is nil, and
+// otherwise are reported as missing, with an error matching noSuchKey.
+func (c *encryptor) open(bucket, key string, body []byte, metadata map[string]string) ([]byte, error) {
+	id, ok := metadata[encryptionMetadataKey]
+	if !ok {
+		if c == nil {
+			return body, nil
+		}
+		return nil, fmt.Errorf("tile in bucket %q with key %q isn't encrypted: %w", bucket, key, noSuchKey{})
+	}
+	var aead cipher.AEAD
+	if c != nil {
+		aead = c.aeads[id]
+	}
+	if aead == nil {
+		return nil, keyMismatch{bucket: bucket, key: key, keyID: id, haveIDs: c.keyIDs()}
+	}
+	if len(body) < aead.NonceSize() {
+		return nil, fmt.Errorf("decrypting tile in bucket %q with key %q: too short", bucket, key)
+	}
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting tile in bucket %q with key %q: %w", bucket, key, err)
+	}
+	return plaintext, nil
+}
+
+// keyIDs returns the IDs of c's keys, sorted.
+func (c *encryptor) keyIDs() []string {
+	if c == nil {
+		return nil
+	}
+	var ids []string
+	for id := range c.aeads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,108 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestEncryption(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	ctx := context.Background()
+	svc := s3mem.New()
+	keyA, keyB := bytes.Repeat([]byte{'a'}, 32), bytes.Repeat([]byte{'b'}, 32)
+
+	newHandler := func(keys ...[]byte) *Handler {
+		t.Helper()
+		handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithEncryption(Encryption{Keys: keys}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	expectSource := func(handler *Handler, expected string) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("expected X-Source %q, got %q", expected, source)
+		}
+	}
+	key := "test/" + TileKey(3, 0)
+	getObject := func(key string) ([]byte, map[string]string) {
+		t.Helper()
+		obj, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer obj.Body.Close()
+		body, err := io.ReadAll(obj.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body, obj.Metadata
+	}
+
+	// Unencrypted tiles are replaced with encrypted ones.
+	expectSource(newHandler(), "CT log")
+	expectSource(newHandler(keyA), "CT log")
+	if _, metadata := getObject(key); metadata[encryptionMetadataKey] != keyID(keyA) {
+		t.Errorf("expected the tile to be encrypted with key %s, got metadata %v", keyID(keyA), metadata)
+	}
+	expectSource(newHandler(keyA), "S3")
+	_, err := GetTileObject(ctx, svc, "bucket", key)
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+
+	// Any configured key decrypts.
+	expectSource(newHandler(keyB, keyA), "S3")
+
+	// Tiles encrypted with another key are served from the backend, and left
+	// alone.
+	handler := newHandler(keyB)
+	expectSource(handler, "CT log")
+	expectAndResetMetric(t, handler.requestsMetric, 1, "key_mismatch", "s3_get")
+	if _, metadata := getObject(key); metadata[encryptionMetadataKey] != keyID(keyA) {
+		t.Errorf("expected the tile to still be encrypted with key %s, got metadata %v", keyID(keyA), metadata)
+	}
+
+	// Tiles are bound to their keys.
+	body, metadata := getObject(key)
+	handler = newHandler(keyA)
+	_, err = handler.encryptor.Load().open("bucket", "test/"+TileKey(3, 3), body, metadata)
+	if err == nil || !strings.Contains(err.Error(), "message authentication failed") {
+		t.Errorf("expected decrypting a tile at another key to fail, got %v", err)
+	}
+
+	_, err = New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithEncryption(Encryption{Keys: [][]byte{keyA[:16]}}))
+	if err == nil {
+		t.Errorf("expected an error for a 16-byte key")
+	}
+
+	// Replaced keys take effect without a new Handler.
+	handler = newHandler(keyB)
+	err = handler.SetEncryptionKeys([][]byte{keyB, keyA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, "S3")
+	if handler.SetEncryptionKeys([][]byte{keyA[:16]}) == nil {
+		t.Errorf("expected an error for a 16-byte key")
+	}
+}
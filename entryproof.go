@@ -0,0 +1,145 @@
+package ctile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// WithCachedEntryAndProof serves get-entry-and-proof with the entry from the
+// tile that holds it, fetched and cached as for get-entries, so only the
+// audit path is requested from the backend, with get-proof-by-hash. That
+// spares the backend reading the entry, which is what makes
+// get-entry-and-proof expensive on Trillian. If the proof the backend returns
+// is for another entry with the same leaf hash, the request is passed through
+// instead. Only available in ModeNormal, and not with a BackendStaticCT
+// backend, which doesn't serve get-proof-by-hash.
+func WithCachedEntryAndProof(enabled bool) Option {
+	return func(o *options) {
+		o.cachedEntryAndProof = enabled
+	}
+}
+
+// isEntryAndProofPath returns whether path is for the get-entry-and-proof
+// endpoint.
+func isEntryAndProofPath(path string) bool {
+	return strings.HasSuffix(path, "/ct/v1/get-entry-and-proof")
+}
+
+// parseEntryAndProofParams parses the leaf_index and tree_size of a
+// get-entry-and-proof request.
+func parseEntryAndProofParams(values url.Values) (leafIndex, treeSize int64, err error) {
+	leafIndex, err = strconv.ParseInt(values.Get("leaf_index"), 10, 64)
+	if err != nil || leafIndex < 0 {
+		return 0, 0, fmt.Errorf("invalid leaf_index parameter %q", values.Get("leaf_index"))
+	}
+	treeSize, err = strconv.ParseInt(values.Get("tree_size"), 10, 64)
+	if err != nil || treeSize < 0 {
+		return 0, 0, fmt.Errorf("invalid tree_size parameter %q", values.Get("tree_size"))
+	}
+	if leafIndex >= treeSize {
+		return 0, 0, errors.New("leaf_index must be less than tree_size")
+	}
+	return leafIndex, treeSize, nil
+}
+
+// serveEntryAndProof serves the get-entry-and-proof request r with the entry
+// from its tile and the audit path from p, the backend.
+func (tch *Handler) serveEntryAndProof(w http.ResponseWriter, r *http.Request, p passthroughHandler) {
+	if r.Method != "GET" {
+		p.ServeHTTP(w, r)
+		return
+	}
+	leafIndex, treeSize, err := parseEntryAndProofParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tch.fullRequestTimeout)
+	defer cancel()
+	tile := makeTile(leafIndex, int64(tch.tileSize), tch.logURL)
+	debugFrom(ctx).setTile(tile)
+	contents, source, err := tch.getTileFrom(ctx, tile, leafIndex)
+	var marker pastTheEndMarker
+	if errors.As(err, &marker) {
+		tch.requestsMetric.WithLabelValues("bad_request", "past_the_end_marker").Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if err != nil {
+		writeTileError(w, err)
+		return
+	}
+	i := leafIndex - tile.start
+	if i >= int64(len(contents.Entries)) {
+		tch.requestsMetric.WithLabelValues("bad_request", "past_the_end_partial_tile").Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "leaf_index %d is past the end of the log\n", leafIndex)
+		return
+	}
+	entry := contents.Entries[i]
+
+	leafHash := sha256.Sum256(append([]byte{0}, entry.LeafInput...))
+	proofPath := fmt.Sprintf("%sget-proof-by-hash?hash=%s&tree_size=%d",
+		strings.TrimSuffix(r.URL.Path, "get-entry-and-proof"),
+		url.QueryEscape(base64.StdEncoding.EncodeToString(leafHash[:])), treeSize)
+	err = p.breaker.allow()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	resp, err := p.fetchBody(ctx, proofPath, nil)
+	if writePassthroughError(w, err) {
+		return
+	}
+	if resp.statusCode != http.StatusOK {
+		w.WriteHeader(resp.statusCode)
+		_, _ = w.Write(resp.body)
+		return
+	}
+	var proof struct {
+		LeafIndex int64    `json:"leaf_index"`
+		AuditPath [][]byte `json:"audit_path"`
+	}
+	err = json.Unmarshal(resp.body, &proof)
+	if err != nil {
+		log.Printf("error: parsing get-proof-by-hash response: %s\n", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "parsing get-proof-by-hash response: %s\n", err)
+		return
+	}
+	if proof.LeafIndex != leafIndex {
+		// The log has an earlier entry with the same leaf hash.
+		tch.requestsMetric.WithLabelValues("duplicate_leaf", "entry_and_proof").Inc()
+		p.ServeHTTP(w, r)
+		return
+	}
+	tch.requestsMetric.WithLabelValues("success", "entry_and_proof").Inc()
+	if proof.AuditPath == nil {
+		proof.AuditPath = [][]byte{}
+	}
+
+	w.Header().Set("X-Source", string(source))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(struct {
+		LeafInput []byte   `json:"leaf_input"`
+		ExtraData []byte   `json:"extra_data"`
+		AuditPath [][]byte `json:"audit_path"`
+	}{entry.LeafInput, entry.ExtraData, proof.AuditPath})
+	if err != nil {
+		log.Printf("error writing get-entry-and-proof response: %s\n", err)
+	}
+}
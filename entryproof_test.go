@@ -0,0 +1,153 @@
+package ctile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// rootFromInclusionProof computes the root hash of a tree of treeSize
+// entries from the leaf hash of the entry at index and its audit path, as in
+// RFC 9162, section 2.1.3.2.
+func rootFromInclusionProof(index, treeSize int64, leafHash []byte, auditPath [][]byte) []byte {
+	hash := func(left, right []byte) []byte {
+		h := sha256.Sum256(append(append([]byte{1}, left...), right...))
+		return h[:]
+	}
+	fn, sn, r := index, treeSize-1, leafHash
+	for _, p := range auditPath {
+		if sn == 0 {
+			return nil
+		}
+		if fn&1 == 1 || fn == sn {
+			r = hash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return nil
+	}
+	return r
+}
+
+func TestCachedEntryAndProof(t *testing.T) {
+	log := fakelog.New(10, 3)
+	// The backend's own get-entry-and-proof, which fakelog doesn't have,
+	// answers with its name, to tell when requests are passed through.
+	var duplicate bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/ct/v1/get-entry-and-proof":
+			fmt.Fprint(w, "passed through")
+		case r.URL.Path == "/ct/v1/get-proof-by-hash" && duplicate:
+			fmt.Fprint(w, `{"leaf_index":0,"audit_path":[]}`)
+		default:
+			log.ServeHTTP(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithCachedEntryAndProof(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	resp, err := http.Get(backend.URL + "/ct/v1/get-sth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sth struct {
+		RootHash []byte `json:"sha256_root_hash"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sth)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		leafIndex int64
+		source    string
+	}{
+		{4, "CT log"},
+		// From the same tile, now cached.
+		{5, "S3"},
+		{9, "CT log"},
+	} {
+		url := fmt.Sprintf("/ct/v1/get-entry-and-proof?leaf_index=%d&tree_size=10", test.leafIndex)
+		w := get(url)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", url, w.Code, w.Body)
+		}
+		if source := w.Header().Get("X-Source"); source != test.source {
+			t.Errorf("%s: expected X-Source %q, got %q", url, test.source, source)
+		}
+		var got struct {
+			LeafInput []byte   `json:"leaf_input"`
+			ExtraData []byte   `json:"extra_data"`
+			AuditPath [][]byte `json:"audit_path"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.LeafInput, fakelog.LeafInput(test.leafIndex)) || !bytes.Equal(got.ExtraData, fakelog.ExtraData(test.leafIndex)) {
+			t.Errorf("%s: expected entry %d", url, test.leafIndex)
+		}
+		leafHash := sha256.Sum256(append([]byte{0}, got.LeafInput...))
+		root := rootFromInclusionProof(test.leafIndex, 10, leafHash[:], got.AuditPath)
+		if !bytes.Equal(root, sth.RootHash) {
+			t.Errorf("%s: expected an audit path to the root hash %x, got one to %x", url, sth.RootHash, root)
+		}
+	}
+
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{"/ct/v1/get-entry-and-proof?leaf_index=10&tree_size=10", http.StatusBadRequest},
+		{"/ct/v1/get-entry-and-proof?leaf_index=-1&tree_size=10", http.StatusBadRequest},
+		{"/ct/v1/get-entry-and-proof?tree_size=10", http.StatusBadRequest},
+		// The backend's error for a tree size past its STH.
+		{"/ct/v1/get-entry-and-proof?leaf_index=1&tree_size=11", http.StatusBadRequest},
+		// Past the end of the log.
+		{"/ct/v1/get-entry-and-proof?leaf_index=10&tree_size=20", http.StatusBadRequest},
+	} {
+		w := get(test.url)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.url, test.status, w.Code, w.Body)
+		}
+	}
+
+	// A proof for an earlier entry with the same leaf hash isn't used.
+	duplicate = true
+	w := get("/ct/v1/get-entry-and-proof?leaf_index=4&tree_size=10")
+	if !strings.Contains(w.Body.String(), "passed through") {
+		t.Errorf("expected a request with a duplicate leaf hash to be passed through, got %d: %s", w.Code, w.Body)
+	}
+
+	_, err = New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithMode(ModeCacheOnly), WithCachedEntryAndProof(true))
+	if err == nil {
+		t.Errorf("expected an error in cache-only mode")
+	}
+}
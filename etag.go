@@ -0,0 +1,60 @@
+package ctile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// entriesETag returns the strong ETag of the get-entries response of
+// contentType holding the entries from start to end, exclusive, and indented
+// if pretty is true. Only responses served from complete tiles have one,
+// since those never change; and not verbose ones, which say where the tile
+// came from.
+func (tch *Handler) entriesETag(start, end int64, contentType string, pretty bool) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%d\n%d\n%s\n%t", tch.logURL, tch.getEntriesSuffix(), start, end, contentType, pretty)))
+	return `"` + hex.EncodeToString(h[:16]) + `"`
+}
+
+// etagMatches returns whether the If-None-Match header of r holds etag. As
+// for any If-None-Match, weak tags match too.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// encodedETag returns the ETag of a response compressed with encoding, whose
+// ETag uncompressed is etag, so the two never share a strong ETag. Weak ETags
+// are unchanged.
+func encodedETag(etag, encoding string) string {
+	if strings.HasPrefix(etag, "W/") || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// decodeIfNoneMatch returns the If-None-Match header value of a request
+// whose response is compressed with encoding, with the tags of such responses
+// turned back into those of the uncompressed responses, for handlers that
+// don't know about compression. Other tags are dropped, since they're for
+// another encoding.
+func decodeIfNoneMatch(value, encoding string) string {
+	suffix := "-" + encoding + `"`
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			tags = append(tags, tag)
+		} else if strings.HasSuffix(tag, suffix) {
+			tags = append(tags, strings.TrimSuffix(tag, suffix)+`"`)
+		}
+	}
+	return strings.Join(tags, ", ")
+}
@@ -0,0 +1,75 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestETag(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(8, 10))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url, acceptEncoding, ifNoneMatch string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", url, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	const url = "/ct/v1/get-entries?start=0&end=4"
+	gzipped := get(url, "gzip", "").Header.Get("ETag")
+	plain := get(url, "", "").Header.Get("ETag")
+	if !strings.HasPrefix(plain, `"`) || gzipped != strings.TrimSuffix(plain, `"`)+`-gzip"` {
+		t.Fatalf("expected a strong ETag, and another for the gzipped response, got %q and %q", plain, gzipped)
+	}
+	if other := get("/ct/v1/get-entries?start=1&end=4", "", "").Header.Get("ETag"); other == "" || other == plain {
+		t.Errorf("expected another ETag for another range, got %q", other)
+	}
+
+	for _, test := range []struct {
+		acceptEncoding, ifNoneMatch string
+		status                      int
+		etag                        string
+	}{
+		{"gzip", gzipped, http.StatusNotModified, gzipped},
+		{"", plain, http.StatusNotModified, plain},
+		{"", `"other", W/` + plain, http.StatusNotModified, plain},
+		// The uncompressed response's ETag doesn't match the gzipped one.
+		{"gzip", plain, http.StatusOK, gzipped},
+		{"", `"other"`, http.StatusOK, plain},
+	} {
+		resp := get(url, test.acceptEncoding, test.ifNoneMatch)
+		if resp.StatusCode != test.status || resp.Header.Get("ETag") != test.etag {
+			t.Errorf("Accept-Encoding %q, If-None-Match %q: expected status %d with ETag %q, got %d with %q",
+				test.acceptEncoding, test.ifNoneMatch, test.status, test.etag, resp.StatusCode, resp.Header.Get("ETag"))
+		}
+		if resp.StatusCode == http.StatusNotModified && resp.ContentLength > 0 {
+			t.Errorf("expected no body with status 304")
+		}
+	}
+
+	// Responses that may change have none.
+	for _, url := range []string{
+		"/ct/v1/get-entries?start=5&end=9",
+		"/ct/v1/get-entries?start=0&end=4&verbose=true",
+	} {
+		if etag := get(url, "", "").Header.Get("ETag"); etag != "" {
+			t.Errorf("%s: expected no ETag, got %q", url, etag)
+		}
+	}
+}
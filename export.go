@@ -0,0 +1,183 @@
+package ctile
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportSuffix is the path suffix of bulk export requests, which are served
+// next to the log's CT API.
+const exportSuffix = "/ctile/v1/export"
+
+// exportContentType is the media type of export responses: newline-delimited
+// JSON.
+const exportContentType = "application/x-ndjson"
+
+// WithExportRateLimit limits each export to entriesPerSecond entries a
+// second, sent a tile at a time, so one mirror can't take all of the
+// Handler's bandwidth or S3 reads. Tiles are only fetched a little ahead of
+// the ones being sent. Zero means no limit.
+func WithExportRateLimit(entriesPerSecond float64) Option {
+	return func(o *options) {
+		o.exportRate = entriesPerSecond
+	}
+}
+
+// WithExport serves GET <log>/ctile/v1/export?start=&end=, which streams the
+// entries from start to end, inclusive, as newline-delimited JSON, one
+// {"leaf_input", "extra_data", "ctile_index"} object per line, across as many
+// tiles as the range covers. Tiles are read as for get-entries, from the
+// caches first, and fetched from the backend and cached if they're missing.
+//
+// The response stops early, and cleanly, at the end of the log, so clients
+// should check the index of the last line they got. A response cut short by
+// an error is aborted instead, so clients see it fail. Exports are counted in
+// ctile_requests{source="export"}.
+func WithExport(enabled bool) Option {
+	return func(o *options) {
+		o.export = enabled
+	}
+}
+
+// isExportPath returns true if path is that of an export request.
+func (tch *Handler) isExportPath(path string) bool {
+	return tch.export && strings.HasSuffix(path, exportSuffix)
+}
+
+// exportPrefetch is how many tiles an export fetches ahead of the one it's
+// sending. Fetching waits for the client to take the tiles before, so a slow
+// client doesn't make the export hold many tiles in memory.
+const exportPrefetch = 2
+
+// exportTile is a tile fetched for an export.
+type exportTile struct {
+	tile     tile
+	contents *Entries
+	err      error
+}
+
+// fetchExportTiles sends the tiles from the one holding start up to the one
+// holding end - 1 on the returned channel, until one is partial or fails, or
+// ctx is done.
+func (tch *Handler) fetchExportTiles(ctx context.Context, start, end int64) <-chan exportTile {
+	tiles := make(chan exportTile, exportPrefetch-1)
+	go func() {
+		defer close(tiles)
+		for next := start; next < end; {
+			t := makeTile(next, int64(tch.tileSize), tch.logURL)
+			tileCtx, cancel := context.WithTimeout(ctx, tch.fullRequestTimeout)
+			contents, _, err := tch.getTileFrom(tileCtx, t, next)
+			cancel()
+			select {
+			case tiles <- exportTile{t, contents, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil || tch.isPartialTile(contents) {
+				return
+			}
+			tch.readAhead(t)
+			next = t.end
+		}
+	}()
+	return tiles
+}
+
+// serveExport answers an export request.
+func (tch *Handler) serveExport(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseQueryParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	ctx, cancel := tch.streamContext(r.Context())
+	defer cancel()
+	var limit *tokenBucket
+	if tch.exportRate > 0 {
+		// Each export has its own budget, which allows a tile at once.
+		limit = newTokenBucket(tch.exportRate, tch.tileSize)
+	}
+
+	w.Header().Set("Content-Type", exportContentType)
+	body := &responseBody{ResponseWriter: w}
+	bw := bufio.NewWriterSize(body, streamBufferSize)
+	encoder := json.NewEncoder(bw)
+	controller := http.NewResponseController(w)
+	next := start
+	for exported := range tch.fetchExportTiles(ctx, start, end) {
+		t, contents, err := exported.tile, exported.contents, exported.err
+		var marker pastTheEndMarker
+		var statusCodeErr statusCodeError
+		pastTheEnd := errors.As(err, &marker) || errors.As(err, &statusCodeErr) && statusCodeErr.statusCode == http.StatusBadRequest ||
+			err == nil && next-t.start >= int64(len(contents.Entries))
+		if pastTheEnd && next > start {
+			// The previous tile was the last.
+			break
+		}
+		if pastTheEnd {
+			tch.requestsMetric.WithLabelValues("bad_request", "export").Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, pastTheEndError{})
+			return
+		}
+		if err != nil {
+			tch.requestsMetric.WithLabelValues("error", "export").Inc()
+			if next == start {
+				writeTileError(w, err)
+				return
+			}
+			log.Printf("warning: aborting the export of %d-%d at %d: %s\n", start, end-1, next, err)
+			// Send the entries so far, so the client can resume after them.
+			_ = bw.Flush()
+			_ = controller.Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		entries := contents.Entries[next-t.start:]
+		if int64(len(entries)) > end-next {
+			entries = entries[:end-next]
+		}
+		if limit != nil {
+			// Send what's ready before waiting.
+			if bw.Buffered() > 0 {
+				_ = bw.Flush()
+				_ = controller.Flush()
+			}
+			err = limit.waitN(ctx, len(entries))
+			if err != nil {
+				// The client went away.
+				return
+			}
+		}
+		// Each tile gets as long as a get-entries request to be sent, however
+		// long the export takes. Servers and middleware that don't support
+		// deadlines keep their own.
+		_ = controller.SetWriteDeadline(time.Now().Add(tch.fullRequestTimeout + time.Second))
+		for _, e := range entries {
+			err = encoder.Encode(verboseEntry{Entry: e, Index: next})
+			if err != nil {
+				// The client went away.
+				return
+			}
+			next++
+		}
+	}
+	if ctx.Err() != nil {
+		// EndStreams was called. Send the entries so far, and abort, so the
+		// client can tell the export is incomplete and resume after them.
+		_ = bw.Flush()
+		_ = controller.Flush()
+		panic(http.ErrAbortHandler)
+	}
+	tch.requestsMetric.WithLabelValues("success", "export").Inc()
+	_ = bw.Flush()
+}
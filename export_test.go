@@ -0,0 +1,147 @@
+package ctile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestExport(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(23, 5))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"), WithExport(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/ctile/v1/export?"+query, nil))
+		return w
+	}
+
+	for _, tc := range []struct {
+		query      string
+		start, end int64
+	}{
+		{"start=3&end=17", 3, 17},
+		{"start=5&end=5", 5, 5},
+		// The export stops at the end of the log.
+		{"start=12&end=100", 12, 22},
+		{"start=20&end=100", 20, 22},
+	} {
+		w := export(tc.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", tc.query, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != exportContentType {
+			t.Errorf("%s: expected Content-Type %s, got %q", tc.query, exportContentType, ct)
+		}
+		scanner := bufio.NewScanner(w.Body)
+		next := tc.start
+		for scanner.Scan() {
+			var entry verboseEntry
+			err := json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				t.Fatalf("%s: line %q: %s", tc.query, scanner.Text(), err)
+			}
+			if entry.Index != next || !bytes.Equal(entry.LeafInput, fakelog.LeafInput(next)) || !bytes.Equal(entry.ExtraData, fakelog.ExtraData(next)) {
+				t.Fatalf("%s: expected entry %d, got index %d", tc.query, next, entry.Index)
+			}
+			next++
+		}
+		if next != tc.end+1 {
+			t.Errorf("%s: expected entries %d-%d, got up to %d", tc.query, tc.start, tc.end, next-1)
+		}
+	}
+	if got := testutil.ToFloat64(handler.requestsMetric.WithLabelValues("success", "export")); got != 4 {
+		t.Errorf("expected 4 successful exports, got %g", got)
+	}
+
+	for _, query := range []string{"start=23&end=30", "start=40&end=50", "start=5&end=3", "start=5"} {
+		if w := export(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d: %s", query, w.Code, w.Body)
+		}
+	}
+}
+
+func TestExportDisabled(t *testing.T) {
+	handler, err := New("http://example.com", WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"), WithMode(ModeCacheOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ctile/v1/export?start=0&end=4", nil))
+	if w.Code == http.StatusOK {
+		t.Errorf("expected the export to be refused, got status 200: %s", w.Body)
+	}
+}
+
+func TestExportRateLimit(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(23, 5))
+	defer backend.Close()
+	_, err := New(backend.URL, WithExport(true), WithExportRateLimit(-1))
+	if err == nil {
+		t.Error("expected an error for a negative export rate limit")
+	}
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"), WithExport(true), WithExportRateLimit(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first tile is sent at once, and the next two take a quarter of a
+	// second each.
+	begin := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ctile/v1/export?start=0&end=14", nil))
+	elapsed := time.Since(begin)
+	if lines := bytes.Count(w.Body.Bytes(), []byte("\n")); lines != 15 {
+		t.Errorf("expected 15 entries, got %d", lines)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("expected the export to take at least 400ms, took %s", elapsed)
+	}
+}
+
+func TestExportAborted(t *testing.T) {
+	fakeLog := fakelog.New(23, 5)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("start") == "10" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fakeLog.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"), WithExport(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/ctile/v1/export?start=0&end=22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("expected the response to be cut short, got it whole: %s", body)
+	}
+	if lines := bytes.Count(body, []byte("\n")); lines != 10 {
+		t.Errorf("expected the 10 entries before the failed tile, got %d", lines)
+	}
+}
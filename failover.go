@@ -0,0 +1,316 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Failover configures replicas of a log's backend, and how requests are
+// spread over them.
+type Failover struct {
+	// Replicas are the URLs of other backends serving the same log, in order
+	// of preference. The log's URL is always preferred to them.
+	Replicas []string
+	// Cooldown is how long a backend that failed is tried only after the
+	// healthy ones. Defaults to 30 seconds.
+	Cooldown time.Duration
+	// Balance selects which healthy backend gets each request. Defaults to
+	// BalanceFailover.
+	Balance Balance
+	// ProbeInterval, if nonzero, is how often each backend's get-sth endpoint,
+	// or checkpoint for a BackendStaticCT backend, is requested to check its health, so failed backends are detected, and
+	// recovered ones put back into use, without waiting for traffic. Probes
+	// run for the life of the process.
+	ProbeInterval time.Duration
+}
+
+// Balance is a policy for choosing between healthy backends.
+type Balance string
+
+const (
+	// BalanceFailover sends every request to the first healthy backend, in
+	// order of preference.
+	BalanceFailover Balance = "failover"
+	// BalanceRoundRobin sends requests to each healthy backend in turn.
+	BalanceRoundRobin Balance = "round-robin"
+	// BalanceLeastOutstanding sends each request to the healthy backend with
+	// the fewest requests in flight, preferring earlier backends on ties.
+	BalanceLeastOutstanding Balance = "least-outstanding"
+)
+
+// ParseBalance returns the Balance with the given name, or an error.
+func ParseBalance(s string) (Balance, error) {
+	switch balance := Balance(s); balance {
+	case BalanceFailover, BalanceRoundRobin, BalanceLeastOutstanding:
+		return balance, nil
+	default:
+		return "", fmt.Errorf("unknown balance policy %q", s)
+	}
+}
+
+// WithFailover adds replicas of the backend. When a request to a backend
+// fails with a network error, a timeout, or a 5xx or 429 status code, the
+// request is retried on the next backend, within the same deadline.
+func WithFailover(f Failover) Option {
+	return func(o *options) {
+		o.failover = f
+	}
+}
+
+const defaultFailoverCooldown = 30 * time.Second
+
+// backendSet tracks the health and load of the replicas of a log's backend.
+type backendSet struct {
+	backends []*backend
+	cooldown time.Duration
+	balance  Balance
+	client   *http.Client
+
+	// probePath is requested from each backend by health probes.
+	probePath string
+
+	// next is the number of requests balanced round robin so far.
+	next atomic.Uint64
+
+	requestsMetric *prometheus.CounterVec
+	latencyMetric  *prometheus.HistogramVec
+	healthyMetric  *prometheus.GaugeVec
+
+	// stop is closed by close, to end health probes.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// backend is one replica of a log's backend.
+type backend struct {
+	url string
+
+	// outstanding is the number of requests in flight to the backend.
+	outstanding atomic.Int64
+
+	// mu protects unhealthyUntil, which is zero while the backend is
+	// healthy.
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+}
+
+func newBackendSet(logURL string, f Failover, client *http.Client, probePath string, promRegisterer prometheus.Registerer) *backendSet {
+	set := &backendSet{
+		cooldown:  f.Cooldown,
+		balance:   f.Balance,
+		client:    client,
+		probePath: probePath,
+		requestsMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ctile_backend_replica_requests",
+				Help: "total number of requests to each replica of the backend, by result",
+			},
+			[]string{"replica", "result"}),
+		latencyMetric: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "ctile_backend_replica_latency_seconds",
+				Help:    "latency of requests to each replica of the backend",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"replica"}),
+		healthyMetric: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "ctile_backend_replica_healthy",
+				Help: "whether each replica of the backend is healthy (1) or being avoided after a failure (0)",
+			},
+			[]string{"replica"}),
+	}
+	promRegisterer.MustRegister(set.requestsMetric, set.latencyMetric, set.healthyMetric)
+	set.stop = make(chan struct{})
+	if set.cooldown == 0 {
+		set.cooldown = defaultFailoverCooldown
+	}
+	if set.balance == "" {
+		set.balance = BalanceFailover
+	}
+	for _, url := range append([]string{logURL}, f.Replicas...) {
+		set.backends = append(set.backends, &backend{url: url})
+		set.healthyMetric.WithLabelValues(url).Set(1)
+	}
+	if f.ProbeInterval > 0 {
+		go set.probe(f.ProbeInterval)
+	}
+	return set
+}
+
+// candidates returns the backends in the order they should be tried: the
+// healthy ones, ordered by the balance policy, then the rest, in order of
+// preference, in case they've recovered.
+func (s *backendSet) candidates() []*backend {
+	now := time.Now()
+	var healthy, unhealthy []*backend
+	for _, b := range s.backends {
+		b.mu.Lock()
+		ok := now.After(b.unhealthyUntil)
+		b.mu.Unlock()
+		if ok {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+
+	switch s.balance {
+	case BalanceRoundRobin:
+		if len(healthy) > 1 {
+			first := int(s.next.Add(1) % uint64(len(healthy)))
+			healthy = append(healthy[first:], healthy[:first]...)
+		}
+	case BalanceLeastOutstanding:
+		outstanding := make(map[*backend]int64, len(healthy))
+		for _, b := range healthy {
+			outstanding[b] = b.outstanding.Load()
+		}
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return outstanding[healthy[i]] < outstanding[healthy[j]]
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+// markFailed records that b failed with err, so it's avoided for the
+// cooldown.
+func (s *backendSet) markFailed(b *backend, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.unhealthyUntil.IsZero() && len(s.backends) > 1 {
+		log.Printf("warning: backend %s failed, so it will be tried last for %s: %s\n", b.url, s.cooldown, err)
+	}
+	b.unhealthyUntil = time.Now().Add(s.cooldown)
+	s.healthyMetric.WithLabelValues(b.url).Set(0)
+}
+
+// markHealthy records that b responded.
+func (s *backendSet) markHealthy(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.unhealthyUntil.IsZero() && len(s.backends) > 1 {
+		log.Printf("backend %s recovered\n", b.url)
+	}
+	b.unhealthyUntil = time.Time{}
+	s.healthyMetric.WithLabelValues(b.url).Set(1)
+}
+
+// probe checks the health of every backend each interval, until close.
+func (s *backendSet) probe(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		for _, b := range s.backends {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := probeBackend(ctx, s.client, b.url+s.probePath)
+			cancel()
+			if err != nil {
+				s.markFailed(b, fmt.Errorf("health probe: %w", err))
+			} else {
+				s.markHealthy(b)
+			}
+		}
+	}
+}
+
+// close stops health probes.
+func (s *backendSet) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// probePath returns the path requested by health probes of backends serving
+// backendType.
+func probePath(backendType BackendType) string {
+	switch backendType {
+	case BackendStaticCT:
+		return "/checkpoint"
+	case BackendRFC9162:
+		return "/ct/v2/get-sth"
+	default:
+		return "/ct/v1/get-sth"
+	}
+}
+
+// probeBackend requests url from a backend, returning an error unless it
+// succeeds.
+func probeBackend(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status code %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// isBackendFailure returns true if err means the backend itself failed, so
+// another replica might succeed. Other 4xx responses are about the request,
+// so every replica would give the same answer.
+func isBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var statusCodeErr statusCodeError
+	if errors.As(err, &statusCodeErr) {
+		return statusCodeErr.statusCode >= 500 || statusCodeErr.statusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// tryBackends calls fetch on each candidate backend in turn until one doesn't
+// fail, or ctx is done, and returns the result of the last call. It updates
+// the health and metrics of each backend called. A cancellation isn't held
+// against the backend, but running out of time is.
+func tryBackends[V any](ctx context.Context, s *backendSet, onFailover func(), fetch func(*backend) (V, error)) (V, error) {
+	var result V
+	var err error
+	for i, b := range s.candidates() {
+		if i > 0 {
+			if ctx.Err() != nil {
+				break
+			}
+			onFailover()
+		}
+
+		b.outstanding.Add(1)
+		begin := time.Now()
+		result, err = fetch(b)
+		s.latencyMetric.WithLabelValues(b.url).Observe(time.Since(begin).Seconds())
+		b.outstanding.Add(-1)
+
+		if !isBackendFailure(err) {
+			s.requestsMetric.WithLabelValues(b.url, "ok").Inc()
+			s.markHealthy(b)
+			break
+		}
+		s.requestsMetric.WithLabelValues(b.url, "error").Inc()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			break
+		}
+		s.markFailed(b, err)
+	}
+	return result, err
+}
@@ -0,0 +1,156 @@
+package ctile
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestFailover(t *testing.T) {
+	var brokenRequests atomic.Int64
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenRequests.Add(1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	replica := httptest.NewServer(fakelog.New(11, 3))
+	defer replica.Close()
+
+	handler, err := New(broken.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test"),
+		WithFailover(Failover{Replicas: []string{replica.URL}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = getAndParseResp(t, handler, "/ct/v1/get-entries?start=0&end=2")
+	if err != nil {
+		t.Fatalf("expected failover to the replica, got %s", err)
+	}
+	if brokenRequests.Load() != 1 {
+		t.Errorf("expected 1 request to the broken backend, got %d", brokenRequests.Load())
+	}
+
+	// The broken backend is now tried last, so requests go straight to the
+	// replica.
+	_, _, err = getAndParseResp(t, handler, "/ct/v1/get-entries?start=3&end=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getResp(handler, "/ct/v1/get-sth")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected passthrough to fail over, got status %d", resp.StatusCode)
+	}
+	if brokenRequests.Load() != 1 {
+		t.Errorf("expected the broken backend to be avoided, got %d requests to it", brokenRequests.Load())
+	}
+
+	// A request past the end of the log is the request's fault, so it's
+	// not retried.
+	resp = getResp(handler, "/ct/v1/get-entries?start=99&end=100")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 past the end of the log, got %d", resp.StatusCode)
+	}
+}
+
+func TestFailoverAllBroken(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	handler, err := New(broken.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test"),
+		WithFailover(Failover{Replicas: []string{broken.URL + "/"}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := getResp(handler, "/ct/v1/get-sth")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the last backend's status to be passed through, got %d", resp.StatusCode)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	newSet := func(balance Balance) *backendSet {
+		return newBackendSet("a", Failover{Replicas: []string{"b", "c"}, Balance: balance}, http.DefaultClient, "/ct/v1/get-sth", prometheus.NewRegistry())
+	}
+	first := func(s *backendSet) string {
+		return s.candidates()[0].url
+	}
+
+	s := newSet(BalanceFailover)
+	s.markFailed(s.backends[0], errors.New("down"))
+	candidates := s.candidates()
+	if candidates[0].url != "b" || candidates[2].url != "a" {
+		t.Errorf("expected the failed backend to be tried last, got %s, %s, %s", candidates[0].url, candidates[1].url, candidates[2].url)
+	}
+
+	s = newSet(BalanceRoundRobin)
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[first(s)]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 || seen["c"] != 2 {
+		t.Errorf("expected round robin to use each backend equally, got %v", seen)
+	}
+
+	s = newSet(BalanceLeastOutstanding)
+	s.backends[0].outstanding.Add(2)
+	s.backends[1].outstanding.Add(1)
+	if first(s) != "c" {
+		t.Errorf("expected the backend with the fewest requests in flight first, got %s", first(s))
+	}
+	s.backends[2].outstanding.Add(1)
+	if first(s) != "b" {
+		t.Errorf("expected ties to go to the earlier backend, got %s", first(s))
+	}
+
+	_, err := ParseBalance("random")
+	if err == nil {
+		t.Error("expected error parsing an unknown balance policy, got none")
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer replica.Close()
+
+	s := newBackendSet(server.URL, Failover{Replicas: []string{replica.URL}, ProbeInterval: 5 * time.Millisecond}, http.DefaultClient, "/ct/v1/get-sth", prometheus.NewRegistry())
+	waitFor := func(url string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.candidates()[0].url != url {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected probes to put %s first", url)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(replica.URL)
+	healthy.Store(true)
+	waitFor(server.URL)
+}
@@ -0,0 +1,173 @@
+package ctile
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Feature names an experimental behavior that can be turned on gradually at
+// runtime, with FeatureFlags.
+type Feature string
+
+// The features a Handler consults. Each Encoder given to WithResponseEncoders
+// is a feature too, named after its content coding, e.g. "zstd".
+const (
+	// FeatureReadahead gates reading ahead of sequential scans, configured
+	// with WithReadahead.
+	FeatureReadahead Feature = "readahead"
+	// FeatureS3Hedging gates racing slow S3 reads with the backend,
+	// configured with WithS3Hedging.
+	FeatureS3Hedging Feature = "hedging"
+)
+
+// validFeature matches feature names.
+var validFeature = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// KnownFeatures returns the features a Handler given encoders with
+// WithResponseEncoders consults.
+func KnownFeatures(encoders []Encoder) []Feature {
+	known := []Feature{FeatureReadahead, FeatureS3Hedging}
+	for _, e := range encoders {
+		known = append(known, Feature(strings.ToLower(e.Name)))
+	}
+	return known
+}
+
+// CheckFeatures returns an error if rollout sets a feature that isn't one of
+// known, since it would never be consulted.
+func CheckFeatures(rollout map[Feature]int, known []Feature) error {
+	names := make(map[Feature]bool, len(known))
+	for _, feature := range known {
+		names[feature] = true
+	}
+	for feature := range rollout {
+		if !names[feature] {
+			return unknownFeature(feature, names)
+		}
+	}
+	return nil
+}
+
+// unknownFeature returns the error for setting feature, which isn't among
+// known.
+func unknownFeature(feature Feature, known map[Feature]bool) error {
+	var names []string
+	for name := range known {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown feature %q: must be one of %s", feature, strings.Join(names, ", "))
+}
+
+// FeatureFlags holds the rollout percentage of each Feature for a Handler: the
+// percentage of requests for which the feature is enabled. Features that
+// aren't set are disabled. It is safe for concurrent use, so rollouts can be
+// changed while the Handler is serving.
+//
+// Once given to a Handler with WithFeatureFlags, only the features that
+// Handlers consult can be set.
+type FeatureFlags struct {
+	// mu protects rollout and known.
+	mu      sync.RWMutex
+	rollout map[Feature]int
+	// known is the features consulted by the Handlers using the FeatureFlags,
+	// or nil if there are none yet.
+	known map[Feature]bool
+}
+
+// NewFeatureFlags returns FeatureFlags with the given initial rollout
+// percentages.
+func NewFeatureFlags(rollout map[Feature]int) (*FeatureFlags, error) {
+	f := &FeatureFlags{rollout: make(map[Feature]int)}
+	for feature, percent := range rollout {
+		err := f.Set(feature, percent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// WithFeatureFlags sets the FeatureFlags consulted by the Handler. By default,
+// all features are disabled. New fails if flags set a feature the Handler
+// doesn't consult, as listed by KnownFeatures.
+func WithFeatureFlags(flags *FeatureFlags) Option {
+	return func(o *options) {
+		o.featureFlags = flags
+	}
+}
+
+// Set sets the percentage of requests for which feature is enabled, from 0 to
+// 100. Once the FeatureFlags are used by a Handler, feature must be one it
+// consults.
+func (f *FeatureFlags) Set(feature Feature, percent int) error {
+	if !validFeature.MatchString(string(feature)) {
+		return fmt.Errorf("invalid feature name %q", feature)
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("rollout for feature %q must be between 0 and 100, got %d", feature, percent)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.known != nil && !f.known[feature] {
+		return unknownFeature(feature, f.known)
+	}
+	if percent == 0 {
+		delete(f.rollout, feature)
+	} else {
+		f.rollout[feature] = percent
+	}
+	return nil
+}
+
+// Snapshot returns the rollout percentage of every feature that is at least
+// partly enabled.
+func (f *FeatureFlags) Snapshot() map[Feature]int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	snapshot := make(map[Feature]int, len(f.rollout))
+	for feature, percent := range f.rollout {
+		snapshot[feature] = percent
+	}
+	return snapshot
+}
+
+// register adds known to the features that can be set, returning an error if
+// a feature that's already set isn't known. It's safe to call on a nil
+// *FeatureFlags.
+func (f *FeatureFlags) register(known []Feature) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.known == nil {
+		f.known = make(map[Feature]bool, len(known))
+	}
+	for _, feature := range known {
+		f.known[feature] = true
+	}
+	for feature := range f.rollout {
+		if !f.known[feature] {
+			return unknownFeature(feature, f.known)
+		}
+	}
+	return nil
+}
+
+// enabled decides whether feature is enabled for one request, according to its
+// rollout percentage. It's safe to call on a nil *FeatureFlags, for which all
+// features are disabled.
+func (f *FeatureFlags) enabled(feature Feature) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	percent := f.rollout[feature]
+	f.mu.RUnlock()
+	return percent >= 100 || (percent > 0 && rand.Intn(100) < percent)
+}
@@ -0,0 +1,91 @@
+package ctile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	var unset *FeatureFlags
+	if unset.enabled("prefetch") {
+		t.Error("expected features to be disabled with nil FeatureFlags")
+	}
+
+	flags, err := NewFeatureFlags(map[Feature]int{"prefetch": 100, "zstd": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flags.enabled("prefetch") {
+		t.Error("expected feature at 100% to be enabled")
+	}
+	if flags.enabled("zstd") || flags.enabled("hedging") {
+		t.Error("expected features at 0% or unset to be disabled")
+	}
+	if len(flags.Snapshot()) != 1 {
+		t.Errorf("expected only enabled features in snapshot, got %v", flags.Snapshot())
+	}
+
+	err = flags.Set("hedging", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		if flags.enabled("hedging") {
+			enabled++
+		}
+	}
+	if enabled < 350 || enabled > 650 {
+		t.Errorf("expected a feature at 50%% to be enabled for about half of 1000 requests, got %d", enabled)
+	}
+
+	for _, tc := range []struct {
+		feature Feature
+		percent int
+	}{{"prefetch", 101}, {"prefetch", -1}, {"Bad Name", 10}} {
+		if flags.Set(tc.feature, tc.percent) == nil {
+			t.Errorf("expected error setting %q to %d, got none", tc.feature, tc.percent)
+		}
+	}
+}
+
+func TestFeatureFlagsKnown(t *testing.T) {
+	flags, err := NewFeatureFlags(map[Feature]int{"prefetch": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = New("https://example.com", WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithFeatureFlags(flags))
+	if err == nil || !strings.Contains(err.Error(), `unknown feature "prefetch"`) {
+		t.Errorf("expected an error for rolling out an unknown feature, got %v", err)
+	}
+
+	flags = rolledOut(t, 10, FeatureReadahead)
+	_, err = New("https://example.com", WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithFeatureFlags(flags),
+		WithResponseEncoders(deflateEncoder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.Set("deflate", 50) != nil || flags.Set(FeatureS3Hedging, 50) != nil {
+		t.Errorf("expected to set rollouts of features the Handler consults, got %v", flags.Snapshot())
+	}
+	if flags.Set("br", 50) == nil {
+		t.Error("expected an error setting the rollout of a feature the Handler doesn't consult")
+	}
+}
+
+// rolledOut returns FeatureFlags with features enabled for percent of
+// requests.
+func rolledOut(t *testing.T, percent int, features ...Feature) *FeatureFlags {
+	t.Helper()
+	rollout := make(map[Feature]int)
+	for _, feature := range features {
+		rollout[feature] = percent
+	}
+	flags, err := NewFeatureFlags(rollout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
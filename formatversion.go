@@ -0,0 +1,87 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// formatMetadataKey is the object metadata that holds the version of the
+// layout a tile was written in. Objects written before it was introduced
+// don't have it, and are version 1.
+const formatMetadataKey = "ctile-format"
+
+// The versions of the layout of tiles are:
+//
+//   - 1: the entries, encoded as set by WithTileFormat
+//   - 2: the same, but with the chain in each entry's extra_data replaced by
+//     its hash in the chain store, as written by WithChainStore
+const (
+	// tileFormatVersion is the newest version of the layout of tiles. Bump it
+	// with any change to the layout that older versions of ctile can't read,
+	// and keep reading the previous version in decodeTileObject until every
+	// instance has been upgraded.
+	tileFormatVersion = 2
+	// oldestTileFormatVersion is the oldest version decodeTileObject reads.
+	oldestTileFormatVersion = 1
+)
+
+// unsupportedFormat indicates that an object was written in a layout this
+// version of ctile can't read: by a newer version, during a rollout, or by
+// one so old its layout is no longer supported.
+type unsupportedFormat struct {
+	version string
+	reason  string // Why it can't be read, if this version of ctile supports it.
+}
+
+func (u unsupportedFormat) Error() string {
+	if u.reason != "" {
+		return fmt.Sprintf("tile is in format version %s, %s", u.version, u.reason)
+	}
+	return fmt.Sprintf("tile is in format version %s; this version of ctile reads versions %d to %d", u.version, oldestTileFormatVersion, tileFormatVersion)
+}
+
+// ErrUnsupportedFormat is returned by GetTileObject when an object was written
+// in a format version this version of ctile can't read.
+var ErrUnsupportedFormat error = unsupportedFormat{}
+
+// Is makes any unsupportedFormat match ErrUnsupportedFormat.
+func (unsupportedFormat) Is(target error) bool {
+	_, ok := target.(unsupportedFormat)
+	return ok
+}
+
+// decodeTileObject decodes the body of an object with the given metadata, in
+// whichever format version it was written. Tiles with deduplicated chains
+// can only be read with the chain store they were written with; chains may be
+// nil otherwise.
+func decodeTileObject(ctx context.Context, body []byte, metadata map[string]string, chains *chainStore) (*Entries, error) {
+	version := 1
+	if v, ok := metadata[formatMetadataKey]; ok {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, unsupportedFormat{version: v}
+		}
+	}
+	switch version {
+	case 1:
+		entries, err := DecodeTile(bytes.NewReader(body))
+		if err != nil {
+			return nil, undecodableTile{err}
+		}
+		return entries, nil
+	case 2:
+		if chains == nil {
+			return nil, unsupportedFormat{version: "2", reason: "which needs a chain store to read"}
+		}
+		entries, err := DecodeTile(bytes.NewReader(body))
+		if err != nil {
+			return nil, undecodableTile{err}
+		}
+		return chains.restore(ctx, entries)
+	default:
+		return nil, unsupportedFormat{version: strconv.Itoa(version)}
+	}
+}
@@ -0,0 +1,83 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestFormatVersions(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	ctx := context.Background()
+	svc := s3mem.New()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource := func(expectedStatus int, expectedSource string) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d, got %d", expectedStatus, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); expectedSource != "" && source != expectedSource {
+			t.Errorf("expected X-Source %q, got %q", expectedSource, source)
+		}
+	}
+	key := "test/" + TileKey(3, 0)
+	expectVersion := func(expected string) {
+		t.Helper()
+		obj, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version := obj.Metadata[formatMetadataKey]; version != expected {
+			t.Errorf("expected format version %q, got %q", expected, version)
+		}
+	}
+
+	expectSource(http.StatusOK, "CT log")
+	expectVersion("1")
+
+	// Tiles from a newer version are served from the backend, and left
+	// alone.
+	body, err := EncodeTile(&Entries{Entries: make([]Entry, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String("bucket"),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(body),
+		Metadata: map[string]string{formatMetadataKey: "3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetTileObject(ctx, svc, "bucket", key)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+	expectSource(http.StatusOK, "CT log")
+	expectAndResetMetric(t, handler.requestsMetric, 1, "unsupported_format", "s3_get")
+	expectVersion("3")
+
+	// Tiles written before versioning are version 1.
+	_, err = svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key), Body: bytes.NewReader(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(http.StatusOK, "S3")
+}
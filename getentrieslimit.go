@@ -0,0 +1,41 @@
+package ctile
+
+import (
+	"fmt"
+)
+
+// GetEntriesLimit configures WithGetEntriesLimit.
+type GetEntriesLimit struct {
+	// Max is the most entries a get-entries request may ask for: end - start
+	// + 1. Zero means no limit.
+	Max int64
+	// Clamp serves requests for more than Max entries with the first Max,
+	// like CTFE's max_get_entries, instead of rejecting them.
+	Clamp bool
+}
+
+// WithGetEntriesLimit limits the range of get-entries requests. Requests for
+// more than l.Max entries get a 400, or with l.Clamp, a response with the
+// first l.Max, as if they'd asked for those. Either way, clients can tell
+// how many they'll get, rather than getting one tile's worth of a huge range
+// without explanation. Rejected requests are counted in
+// ctile_requests{result="bad_request",source="range_too_large"}.
+func WithGetEntriesLimit(l GetEntriesLimit) Option {
+	return func(o *options) {
+		o.getEntriesLimit = l
+	}
+}
+
+// limitRange returns end, exclusive, of a get-entries request for the entries
+// from start to end, limited by WithGetEntriesLimit, or an error if the
+// request must be rejected.
+func (tch *Handler) limitRange(start, end int64) (int64, error) {
+	limit := tch.getEntriesLimit.Max
+	if limit == 0 || end-start <= limit {
+		return end, nil
+	}
+	if tch.getEntriesLimit.Clamp {
+		return start + limit, nil
+	}
+	return 0, fmt.Errorf("requested range %d-%d is larger than the maximum of %d entries", start, end-1, limit)
+}
@@ -0,0 +1,53 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestGetEntriesLimit(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(20, 20))
+	defer backend.Close()
+	_, err := New(backend.URL, WithGetEntriesLimit(GetEntriesLimit{Max: -1}))
+	if err == nil {
+		t.Error("expected an error for a negative get-entries limit")
+	}
+
+	handler, err := New(backend.URL, WithTileSize(10), WithS3(s3mem.New(), "bucket", "test/"), WithGetEntriesLimit(GetEntriesLimit{Max: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := getAndParseResp(t, handler, "/ct/v1/get-entries?start=2&end=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Entries) != 4 {
+		t.Errorf("expected 4 entries, got %d", len(entries.Entries))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ct/v1/get-entries?start=2&end=6", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for 5 entries, got %d: %s", w.Code, w.Body)
+	}
+	if got := testutil.ToFloat64(handler.requestsMetric.WithLabelValues("bad_request", "range_too_large")); got != 1 {
+		t.Errorf("expected 1 request rejected as too large, got %g", got)
+	}
+
+	handler, err = New(backend.URL, WithTileSize(10), WithS3(s3mem.New(), "bucket", "test/"), WithGetEntriesLimit(GetEntriesLimit{Max: 4, Clamp: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err = getAndParseResp(t, handler, "/ct/v1/get-entries?start=2&end=9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Entries) != 4 {
+		t.Errorf("expected the range to be clamped to 4 entries, got %d", len(entries.Entries))
+	}
+}
@@ -1,14 +1,17 @@
 module github.com/letsencrypt/ctile
 
-go 1.20
+go 1.22
 
 require (
-	github.com/NYTimes/gziphandler v1.1.1
+	github.com/andybalholm/brotli v1.1.1
 	github.com/aws/aws-sdk-go-v2 v1.21.0
 	github.com/aws/aws-sdk-go-v2/config v1.18.37
 	github.com/aws/aws-sdk-go-v2/credentials v1.13.35
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.38.5
+	github.com/aws/aws-sdk-go-v2/service/sqs v1.0.0
+	github.com/aws/smithy-go v1.14.2
 	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/klauspost/compress v1.18.0
 	github.com/prometheus/client_golang v1.16.0
 	golang.org/x/sync v0.3.0
 )
@@ -27,7 +30,6 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/sso v1.13.5 // indirect
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.15.5 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.21.5 // indirect
-	github.com/aws/smithy-go v1.14.2 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,154 @@
+package ctile
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errBackendFirst is returned by getFromS3Hedged when the backend answered
+// before S3. It matches noSuchKey, so the tile is handled like one that isn't
+// cached: it's validated and written to S3 as usual. With conditional writes,
+// that's cheap for tiles that were there all along.
+var errBackendFirst = fmt.Errorf("the backend answered first: %w", noSuchKey{})
+
+// WithS3Hedging fetches a tile from the backend too when S3 hasn't answered
+// within delay, and uses whichever answers first, to cut the tail latency of
+// slow S3 reads. A tile from the backend is still written to S3. If S3 answers
+// first, the backend request is canceled, and if it's a miss, the tile is
+// taken from the backend request already in flight. Answers from the backend
+// that can't be served in place of S3's, such as errors and partial tiles,
+// wait for S3.
+//
+// Each hedged request costs a backend request, so delay should be around a
+// high percentile of S3 read latency, which ctile_backend_latency_seconds
+// {backend="s3_get"} shows. Zero disables it, and it's only used in
+// ModeNormal, for tiles that aren't fetched through a peer. It's
+// experimental, so it's only used for requests for which FeatureS3Hedging is
+// enabled by WithFeatureFlags.
+//
+// ctile_s3_hedged_requests counts hedged requests by which answered first:
+// "s3" or "backend".
+func WithS3Hedging(delay time.Duration) Option {
+	return func(o *options) {
+		o.s3HedgeDelay = delay
+	}
+}
+
+// hedge races S3 reads with backend fetches. A nil *hedge never does.
+type hedge struct {
+	delay time.Duration
+	first *prometheus.CounterVec
+}
+
+func newHedge(delay time.Duration, promRegisterer prometheus.Registerer) *hedge {
+	if delay == 0 {
+		return nil
+	}
+	h := &hedge{
+		delay: delay,
+		first: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_s3_hedged_requests",
+			Help: "S3 reads raced with a backend fetch after a delay, by which answered first: s3 or backend",
+		}, []string{"first"}),
+	}
+	promRegisterer.MustRegister(h.first)
+	return h
+}
+
+// backendFetch is a fetchFromBackend running in the background.
+type backendFetch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Set before done is closed.
+	contents *Entries
+	source   tileSource
+	err      error
+}
+
+// wait returns the result of f.
+func (f *backendFetch) wait() (*Entries, tileSource, error) {
+	<-f.done
+	return f.contents, f.source, f.err
+}
+
+// stop cancels f if it's still running. It's a no-op on a nil *backendFetch.
+func (f *backendFetch) stop() {
+	if f != nil {
+		f.cancel()
+	}
+}
+
+type s3Result struct {
+	contents *Entries
+	err      error
+}
+
+// getFromS3Hedged is getFromS3, but if S3 hasn't answered after the hedging
+// delay, it fetches t from the backend too. If the backend answers first with
+// a complete tile, it returns errBackendFirst. Unless S3 answered first with
+// the tile, it also returns the backend fetch if there is one, which is
+// canceled when ctx is done, or when stopped.
+func (tch *Handler) getFromS3Hedged(ctx context.Context, t tile) (*Entries, *backendFetch, error) {
+	if tch.hedge == nil || tch.peerFor(ctx, t) != "" || !tch.features.enabled(FeatureS3Hedging) {
+		contents, err := tch.getFromS3(ctx, t)
+		return contents, nil, err
+	}
+
+	s3Ctx, cancelS3 := context.WithCancel(ctx)
+	s3Done := make(chan s3Result, 1)
+	go func() {
+		contents, err := tch.getFromS3(s3Ctx, t)
+		s3Done <- s3Result{contents, err}
+	}()
+
+	timer := time.NewTimer(tch.hedge.delay)
+	defer timer.Stop()
+	select {
+	case result := <-s3Done:
+		cancelS3()
+		return result.contents, nil, result.err
+	case <-timer.C:
+	}
+
+	debug := debugFrom(ctx)
+	beginHedge := time.Now()
+	backendCtx, cancelBackend := context.WithCancel(ctx)
+	fetch := &backendFetch{cancel: cancelBackend, done: make(chan struct{})}
+	go func() {
+		fetch.contents, fetch.source, fetch.err = tch.fetchFromBackend(backendCtx, t)
+		close(fetch.done)
+	}()
+
+	select {
+	case result := <-s3Done:
+		cancelS3()
+		tch.hedge.first.WithLabelValues("s3").Inc()
+		debug.step("hedge", beginHedge, "S3 answered first")
+		if result.err == nil {
+			fetch.stop()
+			return result.contents, nil, nil
+		}
+		return nil, fetch, result.err
+	case <-fetch.done:
+	}
+
+	if fetch.err == nil && !tch.isPartialTile(fetch.contents) {
+		cancelS3()
+		tch.hedge.first.WithLabelValues("backend").Inc()
+		debug.step("hedge", beginHedge, "the backend answered first")
+		return nil, fetch, errBackendFirst
+	}
+	// The backend's answer can't stand in for S3's, so wait for it.
+	tch.hedge.first.WithLabelValues("backend").Inc()
+	debug.step("hedge", beginHedge, "the backend answered first, with "+debugResult(fetch.contents, fetch.err))
+	result := <-s3Done
+	cancelS3()
+	if result.err == nil {
+		return result.contents, nil, nil
+	}
+	return nil, fetch, result.err
+}
@@ -0,0 +1,132 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// slowS3 delays reads by delay, or until they're canceled.
+type slowS3 struct {
+	*s3mem.Client
+	delay atomic.Int64
+}
+
+func (s *slowS3) GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	select {
+	case <-time.After(time.Duration(s.delay.Load())):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.Client.GetObject(ctx, in, opts...)
+}
+
+func TestS3Hedging(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	svc := &slowS3{Client: s3mem.New()}
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithS3Hedging(20*time.Millisecond),
+		WithS3Degradation(S3Degradation{Failures: 1}), WithFeatureFlags(rolledOut(t, 100, FeatureS3Hedging)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource := func(url string, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expected, source)
+		}
+	}
+	first := func(which string) float64 {
+		return testutil.ToFloat64(handler.hedge.first.WithLabelValues(which))
+	}
+
+	// S3 answering within the delay isn't hedged.
+	expectSource("/ct/v1/get-entries?start=0&end=2", "CT log")
+	expectSource("/ct/v1/get-entries?start=0&end=2", "S3")
+	if first("s3") != 0 || first("backend") != 0 {
+		t.Errorf("expected no hedged requests, got %g and %g", first("s3"), first("backend"))
+	}
+
+	// A slow S3 is raced with the backend, which answers first, and whose
+	// tile is still cached.
+	svc.delay.Store(int64(time.Minute))
+	expectSource("/ct/v1/get-entries?start=3&end=5", "CT log")
+	if first("backend") != 1 {
+		t.Errorf("expected the backend to answer first, got %g", first("backend"))
+	}
+	if handler.s3Health.degraded() {
+		t.Errorf("expected reads canceled for the backend not to count as S3 failures")
+	}
+	svc.delay.Store(0)
+	expectSource("/ct/v1/get-entries?start=3&end=5", "S3")
+
+	// A miss from S3 after the delay uses the backend fetch in flight.
+	svc.delay.Store(int64(40 * time.Millisecond))
+	expectSource("/ct/v1/get-entries?start=6&end=8", "CT log")
+	if total := first("s3") + first("backend"); total != 2 {
+		t.Errorf("expected 2 hedged requests, got %g", total)
+	}
+
+	_, err = New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithS3Hedging(-time.Second))
+	if err == nil {
+		t.Errorf("expected an error for a negative delay")
+	}
+}
+
+func TestS3HedgingRollout(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	svc := &slowS3{Client: s3mem.New()}
+	flags := rolledOut(t, 0, FeatureS3Hedging)
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithS3Hedging(20*time.Millisecond),
+		WithFeatureFlags(flags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource := func(expected string) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+		resp.Body.Close()
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("expected X-Source %q, got %q", expected, source)
+		}
+	}
+	hedged := func() float64 {
+		return testutil.ToFloat64(handler.hedge.first.WithLabelValues("s3")) +
+			testutil.ToFloat64(handler.hedge.first.WithLabelValues("backend"))
+	}
+	expectSource("CT log")
+
+	// Rolled out to no requests, slow reads wait for S3.
+	svc.delay.Store(int64(200 * time.Millisecond))
+	expectSource("S3")
+	if n := hedged(); n != 0 {
+		t.Errorf("expected no hedged requests with a rollout of 0, got %g", n)
+	}
+
+	// Rolled out to every request, the backend answers first.
+	err = flags.Set(FeatureS3Hedging, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource("CT log")
+	if n := hedged(); n != 1 {
+		t.Errorf("expected 1 hedged request with a rollout of 100, got %g", n)
+	}
+}
@@ -0,0 +1,80 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+)
+
+// TileInfo describes a tile passed to Hooks.
+type TileInfo struct {
+	// LogURL is the base URL of the CT log the tile belongs to.
+	LogURL string
+	// Size is the tile size the Handler is configured with.
+	Size int64
+	// Start is the index of the first entry in the tile.
+	Start int64
+	// End is one past the index of the last entry in the tile.
+	End int64
+}
+
+func (t tile) info() TileInfo {
+	return TileInfo{LogURL: t.logURL, Size: t.size, Start: t.start, End: t.end}
+}
+
+// Hooks are called by a Handler at points in the life of a tile, so embedders
+// can add their own metrics or logging. Any of them may be nil. Hooks are
+// called synchronously from the request path, so they should be fast, and
+// they must be safe for concurrent use.
+type Hooks struct {
+	// OnCacheHit is called when a tile is found in S3.
+	OnCacheHit func(ctx context.Context, t TileInfo)
+	// OnCacheMiss is called when a tile is not found in S3.
+	OnCacheMiss func(ctx context.Context, t TileInfo)
+	// OnTileCached is called after a tile fetched from the backend has been
+	// written to S3. It is not called for partial tiles, or in dry-run mode.
+	OnTileCached func(ctx context.Context, t TileInfo)
+	// OnBackendError is called when fetching a tile from the backend fails.
+	OnBackendError func(ctx context.Context, t TileInfo, err error)
+}
+
+// WithHooks sets the Hooks called by the Handler. Calling it more than once
+// replaces earlier Hooks.
+func WithHooks(hooks Hooks) Option {
+	return func(o *options) {
+		o.hooks = hooks
+	}
+}
+
+// WithMiddleware wraps the Handler's serving path in mw. Middleware sees every
+// request, including ones passed through to the backend, before compression
+// is applied to the response. When given more than once, the first middleware
+// is the outermost.
+func WithMiddleware(mw func(http.Handler) http.Handler) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, mw)
+	}
+}
+
+func (h Hooks) cacheHit(ctx context.Context, t tile) {
+	if h.OnCacheHit != nil {
+		h.OnCacheHit(ctx, t.info())
+	}
+}
+
+func (h Hooks) cacheMiss(ctx context.Context, t tile) {
+	if h.OnCacheMiss != nil {
+		h.OnCacheMiss(ctx, t.info())
+	}
+}
+
+func (h Hooks) tileCached(ctx context.Context, t tile) {
+	if h.OnTileCached != nil {
+		h.OnTileCached(ctx, t.info())
+	}
+}
+
+func (h Hooks) backendError(ctx context.Context, t tile, err error) {
+	if h.OnBackendError != nil {
+		h.OnBackendError(ctx, t.info(), err)
+	}
+}
@@ -0,0 +1,76 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestHooksAndMiddleware(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(11, 3))
+	defer backend.Close()
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	var order []string
+	tagger := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test"),
+		WithHooks(Hooks{
+			OnCacheHit:   func(_ context.Context, t TileInfo) { record("hit") },
+			OnCacheMiss:  func(_ context.Context, t TileInfo) { record("miss") },
+			OnTileCached: func(_ context.Context, t TileInfo) { record("cached") },
+			OnBackendError: func(_ context.Context, t TileInfo, err error) {
+				record("backend error")
+			},
+		}),
+		WithMiddleware(tagger("outer")),
+		WithMiddleware(tagger("inner")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{
+		"/ct/v1/get-entries?start=0&end=2",
+		"/ct/v1/get-entries?start=0&end=2",
+		"/ct/v1/get-entries?start=99&end=100",
+	} {
+		resp := getResp(handler, url)
+		resp.Body.Close()
+	}
+
+	expected := []string{"miss", "cached", "hit", "miss", "backend error"}
+	if len(events) != len(expected) {
+		t.Fatalf("expected events %q, got %q", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected events %q, got %q", expected, events)
+		}
+	}
+
+	if len(order) != 6 || order[0] != "outer" || order[1] != "inner" {
+		t.Errorf("expected middleware to run outer then inner on every request, got %q", order)
+	}
+}
@@ -1,19 +1,18 @@
-package main
+package ctile
 
 import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"os/exec"
 	"reflect"
-	"strconv"
 	"strings"
 	"syscall"
 	"testing"
@@ -25,10 +24,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
 )
 
 const containerName string = "ctile_integration_test_minio"
-const testLogSaysPastTheEnd string = "oh no! we fell off the end of the log!"
 
 func startContainer(t *testing.T) {
 	_, err := exec.Command("podman", "run", "--rm", "--detach", "-p", "19085:9000", "--name", containerName, "quay.io/minio/minio", "server", "/data").Output()
@@ -64,60 +65,12 @@ func cleanupContainer() {
 	_, _ = exec.Command("podman", "rm", containerName).Output()
 }
 
-func TestIntegration(t *testing.T) {
+// minioS3Service starts MinIO in a container and returns an S3 client for it,
+// with a bucket named "bucket" already created.
+func minioS3Service(t *testing.T) *s3.Client {
 	cleanupContainer() // Clean up old containers and names just in case.
 	startContainer(t)
-	defer cleanupContainer()
-
-	// A test CT server that responds to get-entries requests with appropriately JSON-formatted
-	// data, where base64-decoding the LeafInput and ExtraData fields yields a binary encoding
-	// of the position of the given element.
-	//
-	// This acts like a CT log with a max_getentries limit of 3 and 10 elements in total.
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/ct/v1/get-entries" {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		startInt, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
-		endInt, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
-		var entries entries
-
-		// Behave as if the CT server has a max_get_entries limit of 3.
-		// The +1 and -1 are because CT uses closed intervals.
-		if endInt-startInt+1 > 3 {
-			endInt = startInt + 3 - 1
-		}
-
-		// Behave as if the CT server has a total of 10 entries
-		if startInt > 10 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(testLogSaysPastTheEnd))
-			return
-		}
-
-		if endInt > 10 {
-			endInt = 10
-		}
-
-		for i := startInt; i <= endInt; i++ {
-			// Put fake data in leafInput and extraData. Normally these would contain
-			// certificates, but instead we encode the offset within the log, which
-			// allows us to check later that we got the correct log offsets.
-			leafInput := make([]byte, 8)
-			binary.PutVarint(leafInput, i)
-			extraData := make([]byte, 8)
-			binary.PutVarint(extraData, i)
-			entries.Entries = append(entries.Entries, entry{
-				LeafInput: leafInput,
-				ExtraData: extraData,
-			})
-		}
-
-		encoder := json.NewEncoder(w)
-		encoder.Encode(entries)
-	}))
-	defer server.Close()
+	t.Cleanup(cleanupContainer)
 
 	const defaultRegion = "fakeRegion"
 	hostAddress := "http://localhost:19085"
@@ -147,6 +100,21 @@ func TestIntegration(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	return s3Service
+}
+
+// TestIntegration runs against an in-memory S3 fake by default. Set
+// CTILE_TEST_MINIO=1 to run it against MinIO in podman instead.
+func TestIntegration(t *testing.T) {
+	var s3Service S3API = s3mem.New()
+	if os.Getenv("CTILE_TEST_MINIO") != "" {
+		s3Service = minioS3Service(t)
+	}
+
+	// A test CT server that acts like a CT log with a max_getentries limit of 3 and
+	// 11 elements in total.
+	server := httptest.NewServer(fakelog.New(11, 3))
+	defer server.Close()
 
 	ctile := makeTCH(t, server.URL, s3Service)
 
@@ -187,7 +155,7 @@ func TestIntegration(t *testing.T) {
 		t.Errorf("expected 2 entries got %d", len(twoEntriesA.Entries))
 	}
 
-	n, err := binary.ReadVarint(bytes.NewReader(twoEntriesA.Entries[0].LeafInput))
+	n, err := fakelog.Index(twoEntriesA.Entries[0].LeafInput)
 	if err != nil {
 		t.Error(err)
 	}
@@ -196,7 +164,7 @@ func TestIntegration(t *testing.T) {
 		t.Errorf("expected first leafinput in response to be 3rd in log overall got %d", n)
 	}
 
-	n, err = binary.ReadVarint(bytes.NewReader(twoEntriesA.Entries[1].LeafInput))
+	n, err = fakelog.Index(twoEntriesA.Entries[1].LeafInput)
 	if err != nil {
 		t.Error(err)
 	}
@@ -281,8 +249,8 @@ func TestIntegration(t *testing.T) {
 		t.Fatal(err)
 	}
 	body, _ := io.ReadAll(gzReader)
-	if !strings.Contains(string(body), testLogSaysPastTheEnd) {
-		t.Errorf("expected response to contain %q got %q", testLogSaysPastTheEnd, body)
+	if !strings.Contains(string(body), fakelog.PastTheEnd) {
+		t.Errorf("expected response to contain %q got %q", fakelog.PastTheEnd, body)
 	}
 	expectAndResetMetric(t, ctile.requestsMetric, 1, "bad_request", "ct_log_get")
 
@@ -311,9 +279,48 @@ func TestIntegration(t *testing.T) {
 		t.Errorf("expected 500 got %d", resp.StatusCode)
 	}
 	expectAndResetMetric(t, erroringCTile.requestsMetric, 1, "error", "ct_log_get")
+
+	// In cache-only mode, cached tiles are served even though the backend is down,
+	// but uncached tiles and other endpoints are not.
+	cacheOnlyCTile, err := New(errorCTLog.URL, WithTileSize(3), WithS3(s3Service, "bucket", "test"), WithMode(ModeCacheOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, headers, err = getAndParseResp(t, cacheOnlyCTile, "/ct/v1/get-entries?start=3&end=4")
+	if err != nil {
+		t.Error(err)
+	}
+	expectHeader(t, headers, "X-Source", "S3")
+	expectAndResetMetric(t, cacheOnlyCTile.requestsMetric, 1, "success", "s3_get")
+
+	resp = getResp(cacheOnlyCTile, "/ct/v1/get-entries?start=6&end=7")
+	if resp.StatusCode != 404 {
+		t.Errorf("expected 404 got %d", resp.StatusCode)
+	}
+	expectAndResetMetric(t, cacheOnlyCTile.requestsMetric, 1, "not_found", "s3_get")
+
+	resp = getResp(cacheOnlyCTile, "/ct/v1/get-sth")
+	if resp.StatusCode != 503 {
+		t.Errorf("expected 503 got %d", resp.StatusCode)
+	}
+
+	// In proxy-only mode, S3 is never used, so even cached tiles come from the backend.
+	proxyOnlyCTile, err := New(server.URL, WithTileSize(3), WithMode(ModeProxyOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneEntry, headers, err = getAndParseResp(t, proxyOnlyCTile, "/ct/v1/get-entries?start=3&end=3")
+	if err != nil {
+		t.Error(err)
+	}
+	expectHeader(t, headers, "X-Source", "CT log")
+	expectAndResetMetric(t, proxyOnlyCTile.requestsMetric, 1, "success", "ct_log_get")
+	if len(oneEntry.Entries) != 1 {
+		t.Errorf("expected 1 entry got %d", len(oneEntry.Entries))
+	}
 }
 
-func getResp(ctile *tileCachingHandler, url string) *http.Response {
+func getResp(ctile *Handler, url string) *http.Response {
 	req := httptest.NewRequest("GET", url, nil)
 	req.Header.Set("Accept-Encoding", "gzip")
 	w := httptest.NewRecorder()
@@ -323,27 +330,31 @@ func getResp(ctile *tileCachingHandler, url string) *http.Response {
 	return w.Result()
 }
 
-func getAndParseResp(t *testing.T, ctile *tileCachingHandler, url string) (entries, http.Header, error) {
+func getAndParseResp(t *testing.T, ctile *Handler, url string) (Entries, http.Header, error) {
 	t.Helper()
 	resp := getResp(ctile, url)
 	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
 		t.Fatalf("%q: expected status code 200 got %d with body: %q", url, resp.StatusCode, body)
 	}
-	if resp.Header.Get("Content-Encoding") != "gzip" {
-		t.Fatalf("expected Content-Encoding: gzip, got %q", resp.Header.Get("Content-Encoding"))
-	}
-	gzipReader, err := gzip.NewReader(bytes.NewReader(body))
-	if err != nil {
-		t.Fatal(err)
-	}
-	jsonBytes, err := io.ReadAll(gzipReader)
-	if err != nil {
-		t.Fatal(err)
+	jsonBytes := body
+	// Responses too small to gain from compression are sent as they are.
+	if resp.Header.Get("Content-Encoding") != "" || len(body) >= compressionMinSize {
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("expected Content-Encoding: gzip, got %q", resp.Header.Get("Content-Encoding"))
+		}
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonBytes, err = io.ReadAll(gzipReader)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	var entries entries
-	err = json.Unmarshal(jsonBytes, &entries)
+	var entries Entries
+	err := json.Unmarshal(jsonBytes, &entries)
 	return entries, resp.Header, err
 }
 
@@ -362,8 +373,13 @@ func expectAndResetMetric(t *testing.T, metric *prometheus.CounterVec, expected
 	metric.Reset()
 }
 
-func makeTCH(t *testing.T, url string, s3Service *s3.Client) *tileCachingHandler {
-	tch, err := newTileCachingHandler(url, 3, s3Service, "test", "bucket", 10*time.Second, prometheus.NewRegistry())
+func makeTCH(t *testing.T, url string, s3Service S3API) *Handler {
+	tch, err := New(url,
+		WithTileSize(3),
+		WithS3(s3Service, "bucket", "test"),
+		WithTimeouts(Timeouts{FullRequest: 10 * time.Second}),
+		WithMetrics(prometheus.NewRegistry()),
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,271 @@
+// Package azblob implements the subset of the S3 API that ctile uses on top of
+// Azure Blob Storage's REST API, so tiles can be cached in Azure with the same
+// keys and encoding as in S3. S3 buckets are Azure containers, and keys are
+// blob names. Requests are authorized with a shared access signature (SAS).
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// apiVersion is the version of the Blob Storage REST API requests ask for.
+const apiVersion = "2021-08-06"
+
+// Client is a stand-in for *s3.Client that stores objects in Azure Blob
+// Storage. It is safe for concurrent use.
+type Client struct {
+	endpoint   string
+	sasToken   string
+	httpClient *http.Client
+}
+
+// New returns a Client for the storage account at endpoint, e.g.
+// https://account.blob.core.windows.net. sasToken is a shared access signature
+// granting read, write, delete, and list access to the containers used, in
+// query string form, with or without a leading "?". It may be empty for an
+// endpoint that doesn't require authorization, such as a local emulator.
+func New(endpoint, sasToken string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Azure Blob Storage endpoint %q", endpoint)
+	}
+	sasToken = strings.TrimPrefix(sasToken, "?")
+	if _, err := url.ParseQuery(sasToken); err != nil {
+		return nil, fmt.Errorf("invalid SAS token: %w", err)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		sasToken:   sasToken,
+		httpClient: httpClient,
+	}, nil
+}
+
+// GetObject returns the blob's body, or a *types.NoSuchKey error if it doesn't
+// exist.
+func (c *Client) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.blobURL(aws.ToString(in.Bucket), aws.ToString(in.Key)), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		err := responseError(resp)
+		if resp.StatusCode == http.StatusNotFound && resp.Header.Get("x-ms-error-code") == "BlobNotFound" {
+			return nil, &types.NoSuchKey{Message: aws.String(err.Error())}
+		}
+		return nil, err
+	}
+	out := &s3.GetObjectOutput{
+		Body:          resp.Body,
+		ContentLength: resp.ContentLength,
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		out.LastModified = aws.Time(lastModified)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		out.ContentType = aws.String(contentType)
+	}
+	return out, nil
+}
+
+// PutObject stores the object as a block blob, replacing any existing blob
+// with the same name.
+func (c *Client) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var body []byte
+	if in.Body != nil {
+		var err error
+		body, err = io.ReadAll(in.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading body: %w", err)
+		}
+	}
+	header := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}
+	if in.ContentType != nil {
+		header.Set("Content-Type", aws.ToString(in.ContentType))
+	}
+	if in.Tagging != nil {
+		// Blob index tags are encoded like S3's tagging.
+		header.Set("X-Ms-Tags", aws.ToString(in.Tagging))
+	}
+	resp, err := c.do(ctx, http.MethodPut, c.blobURL(aws.ToString(in.Bucket), aws.ToString(in.Key)), header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, responseError(resp)
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+// DeleteObjects deletes the given objects, one request each, since batch
+// deletion needs a different authorization scheme. Like S3, it succeeds for
+// keys that don't exist, and reports failures for individual keys in the
+// output's Errors.
+func (c *Client) DeleteObjects(ctx context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	var out s3.DeleteObjectsOutput
+	for _, id := range in.Delete.Objects {
+		err := c.deleteObject(ctx, aws.ToString(in.Bucket), aws.ToString(id.Key))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			out.Errors = append(out.Errors, types.Error{Key: id.Key, Message: aws.String(err.Error())})
+			continue
+		}
+		if !in.Delete.Quiet {
+			out.Deleted = append(out.Deleted, types.DeletedObject{Key: id.Key})
+		}
+	}
+	return &out, nil
+}
+
+func (c *Client) deleteObject(ctx context.Context, container, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.blobURL(container, key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// enumerationResults is the response to a List Blobs request.
+type enumerationResults struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ListObjectsV2 lists blobs in lexicographic order, with pagination. The
+// continuation token is Azure's marker, and StartAfter isn't supported.
+func (c *Client) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if in.StartAfter != nil {
+		return nil, errors.New("StartAfter is not supported by Azure Blob Storage")
+	}
+	query := url.Values{
+		"restype": {"container"},
+		"comp":    {"list"},
+	}
+	if in.Prefix != nil {
+		query.Set("prefix", aws.ToString(in.Prefix))
+	}
+	if in.ContinuationToken != nil {
+		query.Set("marker", aws.ToString(in.ContinuationToken))
+	}
+	if in.MaxKeys > 0 {
+		query.Set("maxresults", strconv.Itoa(int(in.MaxKeys)))
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.containerURL(aws.ToString(in.Bucket), query), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	var results enumerationResults
+	err = xml.NewDecoder(resp.Body).Decode(&results)
+	if err != nil {
+		return nil, fmt.Errorf("decoding blob list: %w", err)
+	}
+
+	out := &s3.ListObjectsV2Output{
+		Name:   in.Bucket,
+		Prefix: in.Prefix,
+	}
+	for _, blob := range results.Blobs {
+		obj := types.Object{
+			Key:  aws.String(blob.Name),
+			Size: blob.Properties.ContentLength,
+		}
+		if lastModified, err := http.ParseTime(blob.Properties.LastModified); err == nil {
+			obj.LastModified = aws.Time(lastModified)
+		}
+		out.Contents = append(out.Contents, obj)
+	}
+	out.KeyCount = int32(len(out.Contents))
+	if results.NextMarker != "" {
+		out.IsTruncated = true
+		out.NextContinuationToken = aws.String(results.NextMarker)
+	}
+	return out, nil
+}
+
+// blobURL returns the URL of a blob. Blob names are escaped segment by
+// segment, so the slashes in keys are kept as Azure's virtual directories.
+func (c *Client) blobURL(container, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	u := c.endpoint + "/" + url.PathEscape(container) + "/" + strings.Join(segments, "/")
+	if c.sasToken != "" {
+		u += "?" + c.sasToken
+	}
+	return u
+}
+
+// containerURL returns the URL of a container with the given query.
+func (c *Client) containerURL(container string, query url.Values) string {
+	u := c.endpoint + "/" + url.PathEscape(container) + "?" + query.Encode()
+	if c.sasToken != "" {
+		u += "&" + c.sasToken
+	}
+	return u
+}
+
+// do makes a request to the Blob Storage API.
+func (c *Client) do(ctx context.Context, method, u string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	resp, err := c.httpClient.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// Keep the SAS token out of the error.
+		urlErr.URL = c.endpoint + req.URL.Path
+	}
+	return resp, err
+}
+
+// responseError returns an error describing an unsuccessful response. It
+// leaves the SAS token, which is in the request URL, out.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	code := resp.Header.Get("x-ms-error-code")
+	if code == "" {
+		code = http.StatusText(resp.StatusCode)
+	}
+	return fmt.Errorf("azure blob storage: %s %s: %d %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, code, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,254 @@
+package azblob
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/letsencrypt/ctile"
+)
+
+// fakeAzure serves the parts of the Blob Storage REST API that Client uses,
+// for a single container, and requires the SAS token "sig=secret".
+type fakeAzure struct {
+	t         *testing.T
+	container string
+
+	mu    sync.Mutex
+	blobs map[string][]byte
+	tags  map[string]string
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("sig") != "secret" {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("x-ms-version") == "" {
+		f.t.Errorf("expected x-ms-version header on %s %s", r.Method, r.URL)
+	}
+	container, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if container != f.container {
+		w.Header().Set("x-ms-error-code", "ContainerNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case name == "" && r.URL.Query().Get("comp") == "list":
+		f.list(w, r)
+	case r.Method == http.MethodGet:
+		body, ok := f.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		_, _ = w.Write(body)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[name], _ = io.ReadAll(r.Body)
+		f.tags[name] = r.Header.Get("x-ms-tags")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list serves List Blobs, with markers that are the name of the last blob
+// returned.
+func (f *fakeAzure) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("maxresults"))
+	if err != nil {
+		limit = 5000
+	}
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	type blob struct {
+		Name          string `xml:"Name"`
+		ContentLength int    `xml:"Properties>Content-Length"`
+		LastModified  string `xml:"Properties>Last-Modified"`
+	}
+	var results struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Blobs      []blob   `xml:"Blobs>Blob"`
+		NextMarker string   `xml:"NextMarker"`
+	}
+	if len(names) > limit {
+		names = names[:limit]
+		results.NextMarker = names[limit-1]
+	}
+	for _, name := range names {
+		results.Blobs = append(results.Blobs, blob{name, len(f.blobs[name]), "Mon, 01 Jan 2024 00:00:00 GMT"})
+	}
+	_ = xml.NewEncoder(w).Encode(results)
+}
+
+func newTestClient(t *testing.T, sasToken string) (*Client, *fakeAzure) {
+	t.Helper()
+	fake := &fakeAzure{t: t, container: "tiles", blobs: make(map[string][]byte), tags: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	c, err := New(server.URL, sasToken, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, fake
+}
+
+func TestGetPut(t *testing.T) {
+	ctx := context.Background()
+	c, fake := newTestClient(t, "?sv=2021-08-06&sig=secret")
+
+	// Keys with a log URL as their prefix have characters that need escaping.
+	key := "https://example.com/2024h1/tile_size=256/0.cbor.gz"
+	_, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("tiles"), Key: aws.String(key)})
+	var nsk *types.NoSuchKey
+	if !errors.As(err, &nsk) {
+		t.Fatalf("expected NoSuchKey, got %v", err)
+	}
+
+	contents := &ctile.Entries{Entries: []ctile.Entry{{LeafInput: []byte("leaf"), ExtraData: []byte("extra")}}}
+	err = ctile.PutTileObject(ctx, c, "tiles", key, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.blobs[key]; !ok {
+		t.Errorf("expected a blob named %q", key)
+	}
+
+	got, err := ctile.GetTileObject(ctx, c, "tiles", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != 1 || string(got.Entries[0].LeafInput) != "leaf" {
+		t.Errorf("expected the stored entries, got %+v", got)
+	}
+
+	// Tags are sent as blob index tags.
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("tiles"), Key: aws.String("tagged"), Tagging: aws.String("ctile-range=0-255")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := fake.tags["tagged"]; tags != "ctile-range=0-255" {
+		t.Errorf("expected blob index tags, got %q", tags)
+	}
+
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("other"), Key: aws.String(key)})
+	if err == nil || errors.As(err, &nsk) {
+		t.Errorf("expected an error other than NoSuchKey from a missing container, got %v", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	c, _ := newTestClient(t, "sig=wrong")
+	_, err := c.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("tiles"), Key: aws.String("k")})
+	if err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Fatalf("expected AuthenticationFailed, got %v", err)
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Errorf("expected the error to leave out the SAS token, got %v", err)
+	}
+}
+
+func TestListAndDelete(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestClient(t, "sig=secret")
+	for i := 0; i < 25; i++ {
+		_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("tiles"), Key: aws.String(fmt.Sprintf("a/%02d", i)), Body: strings.NewReader("x")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("tiles"), Key: aws.String("z")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []types.ObjectIdentifier
+	paginator := s3.NewListObjectsV2Paginator(c, &s3.ListObjectsV2Input{
+		Bucket:  aws.String("tiles"),
+		Prefix:  aws.String("a/"),
+		MaxKeys: 10,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range page.Contents {
+			if obj.Size != 1 || obj.LastModified == nil {
+				t.Errorf("expected size 1 and a last modified time for %q, got %d and %v", aws.ToString(obj.Key), obj.Size, obj.LastModified)
+			}
+			keys = append(keys, types.ObjectIdentifier{Key: obj.Key})
+		}
+	}
+	if len(keys) != 25 {
+		t.Fatalf("expected 25 keys, got %d", len(keys))
+	}
+
+	// A key that doesn't exist is deleted without an error, as in S3.
+	keys = append(keys, types.ObjectIdentifier{Key: aws.String("missing")})
+	out, err := c.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String("tiles"),
+		Delete: &types.Delete{Objects: keys},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Errors) != 0 || len(out.Deleted) != 26 {
+		t.Errorf("expected 26 deleted and no errors, got %d and %v", len(out.Deleted), out.Errors)
+	}
+
+	list, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("tiles")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.KeyCount != 1 || aws.ToString(list.Contents[0].Key) != "z" || list.IsTruncated {
+		t.Errorf("expected only z to remain, got %d keys", list.KeyCount)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, endpoint := range []string{"", "account.blob.core.windows.net", "ftp://example.com"} {
+		_, err := New(endpoint, "", nil)
+		if err == nil {
+			t.Errorf("expected an error for endpoint %q", endpoint)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package fakelog implements a deterministic, in-process CT log that serves
+// the read endpoints ctile needs. It's used for tests, demos, and local
+// development without any external dependencies.
+package fakelog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PastTheEnd is the body the log responds with when asked for entries past the
+// end of the log. Like Trillian, it uses a 400 status code in that case.
+const PastTheEnd = "fake log: requested range is past the end of the log"
+
+// epoch is the timestamp of the first entry in the log. Each subsequent entry
+// is timestamped one second later.
+var epoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Log is an http.Handler that acts like a CT log with a fixed number of
+// entries and a max_getentries limit.
+//
+// The leaf_input of each entry is a well-formed MerkleTreeLeaf whose
+// certificate is just the entry's index, which lets tests check that they got
+// the entries they asked for. See Index.
+type Log struct {
+	size          int64
+	maxGetEntries int64
+
+	rootOnce sync.Once
+	root     []byte
+}
+
+// New returns a Log with `size` entries that returns at most `maxGetEntries`
+// entries per get-entries request.
+func New(size, maxGetEntries int64) *Log {
+	return &Log{size: size, maxGetEntries: maxGetEntries}
+}
+
+// LeafInput returns the leaf_input of the entry at the given index.
+func LeafInput(index int64) []byte {
+	// MerkleTreeLeaf: version v1 (0), leaf_type timestamped_entry (0), then a
+	// TimestampedEntry: timestamp, entry_type x509_entry (0), a 24-bit length
+	// prefixed certificate, and empty extensions.
+	leaf := make([]byte, 0, 2+8+2+3+8+2)
+	leaf = append(leaf, 0, 0)
+	leaf = binary.BigEndian.AppendUint64(leaf, uint64(epoch.Add(time.Duration(index)*time.Second).UnixMilli()))
+	leaf = append(leaf, 0, 0)
+	leaf = append(leaf, 0, 0, 8)
+	leaf = binary.BigEndian.AppendUint64(leaf, uint64(index))
+	leaf = append(leaf, 0, 0)
+	return leaf
+}
+
+// ExtraData returns the extra_data of the entry at the given index: an empty
+// certificate chain.
+func ExtraData(int64) []byte {
+	return []byte{0, 0, 0}
+}
+
+// Index returns the index encoded in a leaf_input created by LeafInput.
+func Index(leafInput []byte) (int64, error) {
+	if len(leafInput) != 25 {
+		return 0, errors.New("leaf_input has unexpected length")
+	}
+	return int64(binary.BigEndian.Uint64(leafInput[15:23])), nil
+}
+
+type entry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// ServeHTTP implements the get-entries, get-sth, get-proof-by-hash, and
+// get-roots endpoints. Other paths get a 404.
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/ct/v1/get-entries":
+		l.getEntries(w, r)
+	case "/ct/v1/get-sth":
+		l.getSTH(w)
+	case "/ct/v1/get-proof-by-hash":
+		l.getProofByHash(w, r)
+	case "/ct/v1/get-roots":
+		writeJSON(w, map[string][][]byte{"certificates": {}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (l *Log) getEntries(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+	if err != nil || start < 0 {
+		http.Error(w, "invalid start parameter", http.StatusBadRequest)
+		return
+	}
+	end, err := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+	if err != nil || end < start {
+		http.Error(w, "invalid end parameter", http.StatusBadRequest)
+		return
+	}
+	if start >= l.size {
+		http.Error(w, PastTheEnd, http.StatusBadRequest)
+		return
+	}
+
+	// The +1 and -1 are because CT uses closed intervals.
+	if end-start+1 > l.maxGetEntries {
+		end = start + l.maxGetEntries - 1
+	}
+	if end >= l.size {
+		end = l.size - 1
+	}
+
+	var resp struct {
+		Entries []entry `json:"entries"`
+	}
+	for i := start; i <= end; i++ {
+		resp.Entries = append(resp.Entries, entry{
+			LeafInput: LeafInput(i),
+			ExtraData: ExtraData(i),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+func (l *Log) getSTH(w http.ResponseWriter) {
+	l.rootOnce.Do(func() {
+		l.root = l.rootHash(0, l.size)
+	})
+	writeJSON(w, map[string]any{
+		"tree_size":           l.size,
+		"timestamp":           epoch.Add(time.Duration(l.size) * time.Second).UnixMilli(),
+		"sha256_root_hash":    l.root,
+		"tree_head_signature": []byte{},
+	})
+}
+
+func (l *Log) getProofByHash(w http.ResponseWriter, r *http.Request) {
+	hash, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("hash"))
+	if err != nil {
+		http.Error(w, "invalid hash parameter", http.StatusBadRequest)
+		return
+	}
+	treeSize, err := strconv.ParseInt(r.URL.Query().Get("tree_size"), 10, 64)
+	if err != nil || treeSize < 1 || treeSize > l.size {
+		http.Error(w, "invalid tree_size parameter", http.StatusBadRequest)
+		return
+	}
+	for i := int64(0); i < treeSize; i++ {
+		if bytes.Equal(l.rootHash(i, i+1), hash) {
+			writeJSON(w, map[string]any{
+				"leaf_index": i,
+				"audit_path": l.auditPath(i, 0, treeSize),
+			})
+			return
+		}
+	}
+	http.Error(w, "no leaf with that hash in the tree", http.StatusNotFound)
+}
+
+// auditPath computes the Merkle audit path of the entry at index m in the
+// tree of the entries in [start, end).
+// https://datatracker.ietf.org/doc/html/rfc6962#section-2.1.1
+func (l *Log) auditPath(m, start, end int64) [][]byte {
+	n := end - start
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := int64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	if m < start+k {
+		return append(l.auditPath(m, start, start+k), l.rootHash(start+k, end))
+	}
+	return append(l.auditPath(m, start+k, end), l.rootHash(start, start+k))
+}
+
+// rootHash computes the Merkle Tree Hash of the entries in [start, end).
+// https://datatracker.ietf.org/doc/html/rfc6962#section-2.1
+func (l *Log) rootHash(start, end int64) []byte {
+	n := end - start
+	if n == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	if n == 1 {
+		h := sha256.Sum256(append([]byte{0}, LeafInput(start)...))
+		return h[:]
+	}
+	k := int64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(l.rootHash(start, start+k))
+	h.Write(l.rootHash(start+k, end))
+	return h.Sum(nil)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Fprintln(w, err)
+	}
+}
@@ -0,0 +1,131 @@
+package fakelog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGetEntries(t *testing.T) {
+	l := New(10, 3)
+
+	get := func(url string) (int, []entry) {
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		var resp struct {
+			Entries []entry `json:"entries"`
+		}
+		if w.Code == http.StatusOK {
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp.Entries
+	}
+
+	code, entries := get("/ct/v1/get-entries?start=2&end=100")
+	if code != http.StatusOK || len(entries) != 3 {
+		t.Fatalf("expected 200 with 3 entries, got %d with %d", code, len(entries))
+	}
+	for i, e := range entries {
+		index, err := Index(e.LeafInput)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != int64(2+i) {
+			t.Errorf("expected index %d, got %d", 2+i, index)
+		}
+	}
+
+	code, entries = get("/ct/v1/get-entries?start=8&end=100")
+	if code != http.StatusOK || len(entries) != 2 {
+		t.Errorf("expected 200 with 2 entries at end of log, got %d with %d", code, len(entries))
+	}
+
+	code, _ = get("/ct/v1/get-entries?start=10&end=100")
+	if code != http.StatusBadRequest {
+		t.Errorf("expected 400 past end of log, got %d", code)
+	}
+
+	code, _ = get("/ct/v1/get-entries?start=5&end=4")
+	if code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid range, got %d", code)
+	}
+}
+
+func TestRootHash(t *testing.T) {
+	// A one-entry tree's root is the leaf hash.
+	l := New(1, 1)
+	leafHash := l.rootHash(0, 1)
+	if len(leafHash) != 32 {
+		t.Fatalf("expected 32-byte hash, got %d bytes", len(leafHash))
+	}
+
+	// The empty tree's root is the hash of the empty string.
+	empty := hex.EncodeToString(New(0, 1).rootHash(0, 0))
+	if empty != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("unexpected empty tree hash %s", empty)
+	}
+
+	// The root of a larger tree is composed of the roots of its subtrees.
+	big := New(5, 1)
+	if hex.EncodeToString(big.rootHash(0, 5)) == hex.EncodeToString(big.rootHash(0, 4)) {
+		t.Error("expected different roots for different tree sizes")
+	}
+}
+
+func TestGetProofByHash(t *testing.T) {
+	l := New(7, 3)
+	for index := int64(0); index < 7; index++ {
+		hash := base64.StdEncoding.EncodeToString(l.rootHash(index, index+1))
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ct/v1/get-proof-by-hash?tree_size=7&hash="+url.QueryEscape(hash), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("entry %d: expected 200, got %d", index, w.Code)
+		}
+		var resp struct {
+			LeafIndex int64    `json:"leaf_index"`
+			AuditPath [][]byte `json:"audit_path"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.LeafIndex != index {
+			t.Errorf("expected leaf index %d, got %d", index, resp.LeafIndex)
+		}
+
+		// Verify the audit path as in RFC 9162, section 2.1.3.2.
+		fn, sn := index, int64(6)
+		r := l.rootHash(index, index+1)
+		for _, p := range resp.AuditPath {
+			h := sha256.New()
+			if fn%2 == 1 || fn == sn {
+				h.Write([]byte{1})
+				h.Write(p)
+				h.Write(r)
+				for fn%2 == 0 && fn != 0 {
+					fn >>= 1
+					sn >>= 1
+				}
+			} else {
+				h.Write([]byte{1})
+				h.Write(r)
+				h.Write(p)
+			}
+			r = h.Sum(nil)
+			fn >>= 1
+			sn >>= 1
+		}
+		if !bytes.Equal(r, l.rootHash(0, 7)) {
+			t.Errorf("entry %d: audit path doesn't lead to the root hash", index)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Package fsstore implements the subset of the S3 API that ctile uses on top
+// of a local directory, for single-host deployments that don't need object
+// storage. Buckets are subdirectories, and each key is a file whose path is the
+// key, with each slash-separated part escaped so that any key is a valid path.
+// Writes are atomic, so readers never see a partly written object.
+package fsstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxKeys is the default and maximum number of keys returned by ListObjectsV2.
+const maxKeys = 1000
+
+// tempPattern names files being written. Its "%" can't appear unescaped in
+// the name of a stored object, so listings skip them.
+const tempPattern = "%tmp-*"
+
+// Client is a stand-in for *s3.Client that stores objects in a directory. It
+// is safe for concurrent use, including by multiple processes sharing the
+// directory.
+type Client struct {
+	dir string
+}
+
+// New returns a Client storing objects under dir, which is created if it
+// doesn't exist.
+func New(dir string) (*Client, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	return &Client{dir: dir}, nil
+}
+
+// GetObject returns the object's body, or a *types.NoSuchKey error.
+func (c *Client) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	path, err := c.path(aws.ToString(in.Bucket), aws.ToString(in.Key))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &types.NoSuchKey{Message: aws.String(fmt.Sprintf("no such key %q", aws.ToString(in.Key)))}
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, &types.NoSuchKey{Message: aws.String(fmt.Sprintf("no such key %q", aws.ToString(in.Key)))}
+	}
+	return &s3.GetObjectOutput{
+		Body:          f,
+		ContentLength: info.Size(),
+		LastModified:  aws.Time(info.ModTime()),
+	}, nil
+}
+
+// PutObject stores the object, replacing any existing object with the same key.
+func (c *Client) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	path, err := c.path(aws.ToString(in.Bucket), aws.ToString(in.Key))
+	if err != nil {
+		return nil, err
+	}
+	body := in.Body
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), tempPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing %s: %w", path, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+// DeleteObjects deletes the given objects. Like S3, it succeeds for keys that
+// don't exist, and reports failures for individual keys in the output's
+// Errors.
+func (c *Client) DeleteObjects(_ context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	var out s3.DeleteObjectsOutput
+	for _, id := range in.Delete.Objects {
+		path, err := c.path(aws.ToString(in.Bucket), aws.ToString(id.Key))
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			out.Errors = append(out.Errors, types.Error{Key: id.Key, Message: aws.String(err.Error())})
+			continue
+		}
+		if !in.Delete.Quiet {
+			out.Deleted = append(out.Deleted, types.DeletedObject{Key: id.Key})
+		}
+	}
+	return &out, nil
+}
+
+// ListObjectsV2 lists objects in lexicographic order, with pagination. Only
+// the directory holding the prefix's complete path parts is read.
+func (c *Client) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	limit := int(in.MaxKeys)
+	if limit <= 0 || limit > maxKeys {
+		limit = maxKeys
+	}
+	prefix := aws.ToString(in.Prefix)
+	after := aws.ToString(in.ContinuationToken)
+	if after == "" {
+		after = aws.ToString(in.StartAfter)
+	}
+
+	bucketDir, err := c.path(aws.ToString(in.Bucket), "")
+	if err != nil {
+		return nil, err
+	}
+	root := bucketDir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = filepath.Join(bucketDir, escapeKey(prefix[:i]))
+	}
+
+	type object struct {
+		key  string
+		info fs.FileInfo
+	}
+	var objects []object
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, path)
+		if err != nil {
+			return err
+		}
+		key, err := unescapeKey(filepath.ToSlash(rel))
+		if err != nil || !strings.HasPrefix(key, prefix) || key <= after {
+			// Files being written, and others that aren't objects.
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		objects = append(objects, object{key, info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+
+	out := &s3.ListObjectsV2Output{
+		Name:   in.Bucket,
+		Prefix: in.Prefix,
+	}
+	if len(objects) > limit {
+		objects = objects[:limit]
+		out.IsTruncated = true
+		out.NextContinuationToken = aws.String(objects[len(objects)-1].key)
+	}
+	for _, obj := range objects {
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(obj.key),
+			Size:         obj.info.Size(),
+			LastModified: aws.Time(obj.info.ModTime()),
+		})
+	}
+	out.KeyCount = int32(len(out.Contents))
+	return out, nil
+}
+
+// path returns the path of the file for key in bucket.
+func (c *Client) path(bucket, key string) (string, error) {
+	if bucket == "" || escapeSegment(bucket) != bucket {
+		return "", fmt.Errorf("invalid bucket name %q for a directory", bucket)
+	}
+	return filepath.Join(c.dir, bucket, filepath.FromSlash(escapeKey(key))), nil
+}
+
+// escapeKey returns key with each slash-separated part escaped by
+// escapeSegment.
+func escapeKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = escapeSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escapeSegment escapes a part of a key so that it's a valid file name that
+// refers to a file in the current directory. Empty parts, as in the "//" of a
+// prefix that's a URL, are "%", which url.PathUnescape would reject, and dots
+// are escaped in "." and "..".
+func escapeSegment(segment string) string {
+	switch segment {
+	case "":
+		return "%"
+	case ".", "..":
+		return strings.ReplaceAll(segment, ".", "%2E")
+	}
+	return url.PathEscape(segment)
+}
+
+// unescapeKey is the inverse of escapeKey. It returns an error for paths that
+// escapeKey can't produce.
+func unescapeKey(path string) (string, error) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "%" {
+			segments[i] = ""
+			continue
+		}
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", err
+		}
+		if escapeSegment(unescaped) != segment {
+			return "", fmt.Errorf("%q is not an escaped key", path)
+		}
+		segments[i] = unescaped
+	}
+	return strings.Join(segments, "/"), nil
+}
@@ -0,0 +1,162 @@
+package fsstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestGetPut(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A prefix that's a log URL has an empty part, and a colon.
+	key := "https://example.com/2024h1/tile_size=256/0.cbor.gz"
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String(key)})
+	var nsk *types.NoSuchKey
+	if !errors.As(err, &nsk) {
+		t.Fatalf("expected NoSuchKey, got %v", err)
+	}
+
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String(key), Body: strings.NewReader("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "b", "https:", "%", "example.com", "2024h1", "tile_size=256", "0.cbor.gz"))
+	if err != nil {
+		t.Errorf("expected the object in a file: %s", err)
+	}
+
+	resp, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", body)
+	}
+
+	// A key that's a directory of other keys is missing.
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("https://example.com/2024h1")})
+	if !errors.As(err, &nsk) {
+		t.Errorf("expected NoSuchKey for a directory, got %v", err)
+	}
+
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("other"), Key: aws.String(key)})
+	if !errors.As(err, &nsk) {
+		t.Errorf("expected NoSuchKey from other bucket, got %v", err)
+	}
+}
+
+func TestKeysStayInside(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := New(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"../../escape", "a/../../escape", "/escape"} {
+		_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String(key), Body: strings.NewReader("x")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatalf("getting %q: %s", key, err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err == nil {
+		t.Errorf("expected keys to stay inside the cache directory")
+	}
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(".."), Key: aws.String("k")})
+	if err == nil {
+		t.Errorf("expected an error for bucket ..")
+	}
+
+	list, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.KeyCount != 3 {
+		t.Errorf("expected 3 keys, got %d", list.KeyCount)
+	}
+}
+
+func TestListAndDelete(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2500; i++ {
+		_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String(fmt.Sprintf("a/%04d", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("z")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A leftover from an interrupted write isn't an object.
+	err = os.WriteFile(filepath.Join(c.dir, "b", "a", "%tmp-123"), nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []types.ObjectIdentifier
+	paginator := s3.NewListObjectsV2Paginator(c, &s3.ListObjectsV2Input{
+		Bucket: aws.String("b"),
+		Prefix: aws.String("a/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, types.ObjectIdentifier{Key: obj.Key})
+		}
+	}
+	if len(keys) != 2500 {
+		t.Fatalf("expected 2500 keys, got %d", len(keys))
+	}
+	if aws.ToString(keys[0].Key) != "a/0000" || aws.ToString(keys[2499].Key) != "a/2499" {
+		t.Errorf("expected keys in order, got %q to %q", aws.ToString(keys[0].Key), aws.ToString(keys[2499].Key))
+	}
+
+	keys = append(keys, types.ObjectIdentifier{Key: aws.String("missing")})
+	out, err := c.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String("b"),
+		Delete: &types.Delete{Objects: keys},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Errors) != 0 || len(out.Deleted) != 2501 {
+		t.Errorf("expected 2501 deleted and no errors, got %d and %v", len(out.Deleted), out.Errors)
+	}
+
+	list, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.KeyCount != 1 || aws.ToString(list.Contents[0].Key) != "z" {
+		t.Errorf("expected only z to remain, got %d keys", list.KeyCount)
+	}
+}
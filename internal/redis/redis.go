@@ -0,0 +1,246 @@
+// Package redis is a minimal Redis client, with just the commands ctile needs
+// to use Redis as a ctile.SharedCache. It speaks RESP2, so it works with Redis
+// and compatible servers such as Valkey and KeyDB.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdle is the number of idle connections kept for reuse.
+const maxIdle = 16
+
+// defaultTimeout bounds each command whose context has no deadline.
+const defaultTimeout = 5 * time.Second
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Client sends commands to a Redis server over a pool of connections. It is
+// safe for concurrent use.
+type Client struct {
+	addr   string
+	ttl    time.Duration
+	dialer net.Dialer
+
+	// mu protects password.
+	mu       sync.Mutex
+	password string
+
+	idle chan *conn
+}
+
+// New returns a Client for the server at addr, e.g. localhost:6379. If
+// password is set, connections authenticate with it. Values stored with Set
+// expire after ttl, unless it's zero.
+func New(addr, password string, ttl time.Duration) *Client {
+	return &Client{
+		addr:     addr,
+		password: password,
+		ttl:      ttl,
+		idle:     make(chan *conn, maxIdle),
+	}
+}
+
+// SetPassword replaces the password new connections authenticate with, e.g.
+// after it's rotated, and closes the idle connections, so they're replaced by
+// connections that use it. Connections in use are kept, since they're
+// already authenticated.
+func (c *Client) SetPassword(password string) {
+	c.mu.Lock()
+	c.password = password
+	c.mu.Unlock()
+	c.Close()
+}
+
+// Get returns the value of key, or nil if it doesn't exist.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.do(ctx, "GET", []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return value, nil
+}
+
+// Set stores value for key, with the Client's TTL.
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	args := [][]byte{[]byte(key), value}
+	if c.ttl > 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(c.ttl.Milliseconds(), 10)))
+	}
+	_, err := c.do(ctx, "SET", args...)
+	return err
+}
+
+// ConfigSet sets a server configuration parameter, like maxmemory.
+func (c *Client) ConfigSet(ctx context.Context, parameter, value string) error {
+	_, err := c.do(ctx, "CONFIG", []byte("SET"), []byte(parameter), []byte(value))
+	return err
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// conn is a connection to the server.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and returns its reply: nil, a string for a status, an
+// int64, []byte for a bulk string, or []any for an array. An error reply is
+// returned as an Error.
+func (c *Client) do(ctx context.Context, command string, args ...[]byte) (any, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.roundTrip(ctx, command, args...)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be out of step with the server.
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// get returns an idle connection, or a new one.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	netConn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: netConn, r: bufio.NewReader(netConn)}
+	c.mu.Lock()
+	password := c.password
+	c.mu.Unlock()
+	if password != "" {
+		_, err := cn.roundTrip(ctx, "AUTH", []byte(password))
+		if err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("authenticating: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+// put keeps cn for reuse, or closes it if enough connections are idle.
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// roundTrip sends a command and reads its reply.
+func (cn *conn) roundTrip(ctx context.Context, command string, args ...[]byte) (any, error) {
+	deadline, _ := ctx.Deadline()
+	err := cn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	buf := fmt.Appendf(nil, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(command), command)
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n", len(arg))
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err = cn.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+// readReply reads a reply in RESP2.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, Error(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed bulk string length %q", rest)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		value := make([]byte, n+2)
+		_, err = io.ReadFull(r, value)
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed array length %q", rest)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			values[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
@@ -0,0 +1,183 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer serves GET, SET, AUTH, and CONFIG SET from a map, and records
+// the commands it receives.
+type fakeServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	password string
+	values   map[string][]byte
+	commands []string
+}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: listener, password: password, values: make(map[string][]byte)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			cn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(cn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(cn net.Conn) {
+	defer cn.Close()
+	r := bufio.NewReader(cn)
+	s.mu.Lock()
+	authenticated := s.password == ""
+	s.mu.Unlock()
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]any) {
+			args = append(args, string(arg.([]byte)))
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		switch {
+		case args[0] == "AUTH" && args[1] == s.password:
+			authenticated = true
+			fmt.Fprint(cn, "+OK\r\n")
+		case args[0] == "AUTH":
+			fmt.Fprint(cn, "-WRONGPASS invalid password\r\n")
+		case !authenticated:
+			fmt.Fprint(cn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "GET":
+			if value, ok := s.values[args[1]]; ok {
+				fmt.Fprintf(cn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				fmt.Fprint(cn, "$-1\r\n")
+			}
+		case args[0] == "SET":
+			s.values[args[1]] = []byte(args[2])
+			fmt.Fprint(cn, "+OK\r\n")
+		case args[0] == "CONFIG":
+			fmt.Fprint(cn, "+OK\r\n")
+		default:
+			fmt.Fprintf(cn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeServer(t, "hunter2")
+	c := New(server.listener.Addr().String(), "hunter2", time.Hour)
+	defer c.Close()
+
+	value, err := c.Get(ctx, "k")
+	if err != nil || value != nil {
+		t.Fatalf("expected a missing key, got %q and %v", value, err)
+	}
+
+	// Values are binary, and may hold the protocol's delimiters.
+	stored := []byte("a\r\nb\x00c")
+	err = c.Set(ctx, "k", stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = c.Get(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, stored) {
+		t.Errorf("expected %q, got %q", stored, value)
+	}
+
+	err = c.ConfigSet(ctx, "maxmemory", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	expected := []string{"AUTH hunter2", "GET k", "SET k a\r\nb\x00c PX 3600000", "GET k", "CONFIG SET maxmemory 1000"}
+	if strings.Join(server.commands, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected commands %q on one connection, got %q", expected, server.commands)
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeServer(t, "hunter2")
+	c := New(server.listener.Addr().String(), "hunter2", 0)
+	defer c.Close()
+
+	_, err := c.Get(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	server.password = "hunter3"
+	server.mu.Unlock()
+	c.SetPassword("hunter3")
+	_, err = c.Get(ctx, "k")
+	if err != nil {
+		t.Fatalf("expected a new connection authenticated with the new password, got %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	expected := []string{"AUTH hunter2", "GET k", "AUTH hunter3", "GET k"}
+	if strings.Join(server.commands, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected commands %q, got %q", expected, server.commands)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeServer(t, "hunter2")
+
+	c := New(server.listener.Addr().String(), "wrong", 0)
+	_, err := c.Get(ctx, "k")
+	var replyErr Error
+	if !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "WRONGPASS") {
+		t.Errorf("expected WRONGPASS, got %v", err)
+	}
+
+	c = New(server.listener.Addr().String(), "hunter2", 0)
+	_, err = c.do(ctx, "BOGUS")
+	if !errors.As(err, &replyErr) {
+		t.Errorf("expected an error reply, got %v", err)
+	}
+	// The connection is still usable after an error reply.
+	err = c.Set(ctx, "k", []byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.listener.Close()
+	c.Close()
+	_, err = c.Get(ctx, "k")
+	if err == nil {
+		t.Errorf("expected an error with the server down")
+	}
+}
@@ -0,0 +1,183 @@
+// Package s3mem implements an in-memory fake of the subset of the S3 API that
+// ctile uses. It's used in tests and for local development without S3
+// credentials. Buckets spring into existence when first written to. A Client
+// from NewBounded holds a limited number of bytes, like a cache.
+package s3mem
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxKeys is the default and maximum number of keys returned by ListObjectsV2.
+const maxKeys = 1000
+
+type object struct {
+	body         []byte
+	metadata     map[string]string
+	lastModified time.Time
+	// written is the object's element in Client.written.
+	written *list.Element
+}
+
+// objectID is the location of an object.
+type objectID struct {
+	bucket, key string
+}
+
+// Client is an in-memory stand-in for *s3.Client. It is safe for concurrent use.
+type Client struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]object
+
+	// maxBytes limits the total size of the objects' bodies, if positive.
+	maxBytes int64
+	bytes    int64
+	// written holds the objectID of each object, most recently written first.
+	written *list.List
+}
+
+// New returns an empty Client.
+func New() *Client {
+	return &Client{buckets: make(map[string]map[string]object), written: list.New()}
+}
+
+// NewBounded returns an empty Client that holds at most maxBytes of object
+// bodies, deleting the least recently written objects to make room for new
+// ones. An object larger than maxBytes isn't stored at all.
+func NewBounded(maxBytes int64) *Client {
+	c := New()
+	c.maxBytes = maxBytes
+	return c
+}
+
+// GetObject returns the object's body, or a *types.NoSuchKey error.
+func (c *Client) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.buckets[aws.ToString(in.Bucket)][aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String(fmt.Sprintf("no such key %q", aws.ToString(in.Key)))}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(obj.body)),
+		ContentLength: int64(len(obj.body)),
+		LastModified:  aws.Time(obj.lastModified),
+		Metadata:      obj.metadata,
+	}, nil
+}
+
+// PutObject stores the object, replacing any existing object with the same key.
+func (c *Client) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var body []byte
+	if in.Body != nil {
+		var err error
+		body, err = io.ReadAll(in.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading body: %w", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := objectID{aws.ToString(in.Bucket), aws.ToString(in.Key)}
+	c.remove(id)
+	if c.maxBytes > 0 {
+		if int64(len(body)) > c.maxBytes {
+			return &s3.PutObjectOutput{}, nil
+		}
+		for c.bytes+int64(len(body)) > c.maxBytes {
+			c.remove(c.written.Back().Value.(objectID))
+		}
+	}
+	if c.buckets[id.bucket] == nil {
+		c.buckets[id.bucket] = make(map[string]object)
+	}
+	c.buckets[id.bucket][id.key] = object{body: body, metadata: in.Metadata, lastModified: time.Now(), written: c.written.PushFront(id)}
+	c.bytes += int64(len(body))
+	return &s3.PutObjectOutput{}, nil
+}
+
+// remove deletes an object, if it exists. c.mu must be held.
+func (c *Client) remove(id objectID) {
+	obj, ok := c.buckets[id.bucket][id.key]
+	if !ok {
+		return
+	}
+	delete(c.buckets[id.bucket], id.key)
+	c.written.Remove(obj.written)
+	c.bytes -= int64(len(obj.body))
+}
+
+// DeleteObjects deletes the given objects. Like S3, it succeeds for keys that
+// don't exist.
+func (c *Client) DeleteObjects(_ context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out s3.DeleteObjectsOutput
+	for _, id := range in.Delete.Objects {
+		c.remove(objectID{aws.ToString(in.Bucket), aws.ToString(id.Key)})
+		if !in.Delete.Quiet {
+			out.Deleted = append(out.Deleted, types.DeletedObject{Key: id.Key})
+		}
+	}
+	return &out, nil
+}
+
+// ListObjectsV2 lists objects in lexicographic order, with pagination.
+func (c *Client) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := int(in.MaxKeys)
+	if limit <= 0 || limit > maxKeys {
+		limit = maxKeys
+	}
+	prefix := aws.ToString(in.Prefix)
+	after := aws.ToString(in.ContinuationToken)
+	if after == "" {
+		after = aws.ToString(in.StartAfter)
+	}
+
+	var keys []string
+	for key := range c.buckets[aws.ToString(in.Bucket)] {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{
+		Name:   in.Bucket,
+		Prefix: in.Prefix,
+	}
+	if len(keys) > limit {
+		keys = keys[:limit]
+		out.IsTruncated = true
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		obj := c.buckets[aws.ToString(in.Bucket)][key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         int64(len(obj.body)),
+			LastModified: aws.Time(obj.lastModified),
+		})
+	}
+	out.KeyCount = int32(len(out.Contents))
+	return out, nil
+}
@@ -0,0 +1,128 @@
+package s3mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestGetPut(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+
+	_, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("k")})
+	var nsk *types.NoSuchKey
+	if !errors.As(err, &nsk) {
+		t.Fatalf("expected NoSuchKey, got %v", err)
+	}
+
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: strings.NewReader("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("k")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", body)
+	}
+
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("other"), Key: aws.String("k")})
+	if !errors.As(err, &nsk) {
+		t.Errorf("expected NoSuchKey from other bucket, got %v", err)
+	}
+}
+
+func TestListAndDelete(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	for i := 0; i < 2500; i++ {
+		_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String(fmt.Sprintf("a/%04d", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("z")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []types.ObjectIdentifier
+	paginator := s3.NewListObjectsV2Paginator(c, &s3.ListObjectsV2Input{Bucket: aws.String("b"), Prefix: aws.String("a/")})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, types.ObjectIdentifier{Key: obj.Key})
+		}
+	}
+	if len(keys) != 2500 {
+		t.Fatalf("expected 2500 keys, got %d", len(keys))
+	}
+	if aws.ToString(keys[0].Key) != "a/0000" || aws.ToString(keys[2499].Key) != "a/2499" {
+		t.Errorf("expected keys in order, got %q ... %q", aws.ToString(keys[0].Key), aws.ToString(keys[2499].Key))
+	}
+
+	_, err = c.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: aws.String("b"), Delete: &types.Delete{Objects: keys[:1000]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.KeyCount != 1000 || !resp.IsTruncated || aws.ToString(resp.Contents[0].Key) != "a/1000" {
+		t.Errorf("expected a full truncated page starting at a/1000, got %d keys starting at %q", resp.KeyCount, aws.ToString(resp.Contents[0].Key))
+	}
+}
+
+func TestBounded(t *testing.T) {
+	ctx := context.Background()
+	c := NewBounded(10)
+	put := func(key, body string) {
+		t.Helper()
+		_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String(key), Body: strings.NewReader(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	has := func(key string) bool {
+		_, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String(key)})
+		return err == nil
+	}
+
+	put("a", "1234")
+	put("b", "1234")
+	// Rewriting a makes b the least recently written.
+	put("a", "1234")
+	put("c", "1234")
+	if !has("a") || has("b") || !has("c") {
+		t.Errorf("expected b to be deleted to make room for c, got a=%t b=%t c=%t", has("a"), has("b"), has("c"))
+	}
+
+	put("big", "12345678901")
+	if has("big") || !has("a") {
+		t.Errorf("expected an object over the limit not to be stored or to delete others")
+	}
+
+	_, err := c.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: aws.String("b"), Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("a")}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("d", "1234")
+	if !has("c") || !has("d") {
+		t.Errorf("expected deletes to free space, got c=%t d=%t", has("c"), has("d"))
+	}
+}
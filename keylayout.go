@@ -0,0 +1,70 @@
+package ctile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// KeyLayout is a way of laying out the keys of tiles in S3, after the prefix.
+type KeyLayout string
+
+const (
+	// KeyLayoutFlat is the default layout, with keys like
+	// tile_size=256/1024.cbor.gz.
+	KeyLayoutFlat KeyLayout = "flat"
+	// KeyLayoutHashed puts a short hash of each tile's start in front of its
+	// key in the flat layout, like 4f2a/tile_size=256/1024.cbor.gz, so
+	// writes of consecutive tiles, e.g. by a backfill, spread over S3's
+	// partitions instead of throttling the one holding the latest tiles. A
+	// Handler with this layout also reads tiles in the flat layout, so an
+	// existing cache keeps working while it's migrated.
+	KeyLayoutHashed KeyLayout = "hashed"
+)
+
+// ParseKeyLayout returns the KeyLayout with the given name, or an error.
+func ParseKeyLayout(s string) (KeyLayout, error) {
+	switch layout := KeyLayout(s); layout {
+	case KeyLayoutFlat, KeyLayoutHashed:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("unknown key layout %q", s)
+	}
+}
+
+// WithKeyLayout sets how the keys of tiles are laid out in S3. Defaults to
+// KeyLayoutFlat.
+func WithKeyLayout(l KeyLayout) Option {
+	return func(o *options) {
+		o.keyLayout = l
+	}
+}
+
+// keyHashLen is the number of hex digits in the hash of KeyLayoutHashed.
+const keyHashLen = 4
+
+// keyHash returns the hash KeyLayoutHashed puts in front of the key of the
+// tile, or super-tile, starting at start.
+func keyHash(start int64) string {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(start, 10)))
+	return hex.EncodeToString(sum[:])[:keyHashLen]
+}
+
+// objectKey returns the key, not including any prefix, to write t at, given
+// its key in the flat layout.
+func (tch *Handler) objectKey(t tile, flatKey string) string {
+	if tch.keyLayout == KeyLayoutHashed {
+		return keyHash(t.start) + "/" + flatKey
+	}
+	return flatKey
+}
+
+// objectKeys returns the keys, not including any prefix, to look for t at,
+// given its key in the flat layout, in the order to try them.
+func (tch *Handler) objectKeys(t tile, flatKey string) []string {
+	if tch.keyLayout == KeyLayoutHashed {
+		return []string{tch.objectKey(t, flatKey), flatKey}
+	}
+	return []string{flatKey}
+}
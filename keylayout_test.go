@@ -0,0 +1,55 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestKeyLayouts(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	svc := s3mem.New()
+
+	newHandler := func(layout KeyLayout) *Handler {
+		t.Helper()
+		handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithKeyLayout(layout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	expectSource := func(handler *Handler, url string, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expected, source)
+		}
+	}
+
+	flat, hashed := newHandler(KeyLayoutFlat), newHandler(KeyLayoutHashed)
+	expectSource(flat, "/ct/v1/get-entries?start=0&end=2", "CT log")
+	expectSource(hashed, "/ct/v1/get-entries?start=3&end=5", "CT log")
+	_, err := GetTileObject(context.Background(), svc, "bucket", "test/"+keyHash(3)+"/"+TileKey(3, 3))
+	if err != nil {
+		t.Errorf("expected the tile at its hashed key, got %v", err)
+	}
+
+	// The hashed layout reads both, during a migration, but the flat layout
+	// only reads its own.
+	expectSource(hashed, "/ct/v1/get-entries?start=0&end=2", "S3")
+	expectSource(flat, "/ct/v1/get-entries?start=3&end=5", "CT log")
+
+	_, err = New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithKeyLayout("sideways"))
+	if err == nil {
+		t.Errorf("expected an error for an unknown key layout")
+	}
+}
@@ -0,0 +1,147 @@
+package ctile
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultKeyTemplate is the template for the keys of tiles, after the prefix,
+// unless WithKeyTemplate sets another.
+const DefaultKeyTemplate = "tile_size={tile_size}/{start}.cbor.gz"
+
+// KeyTemplate is a parsed template for the keys of tiles in S3, after the
+// prefix. Use ParseKeyTemplate to make one.
+type KeyTemplate struct {
+	template string
+	parts    []keyPart
+}
+
+// keyPart is a literal part of a KeyTemplate, or, if variable is set, a
+// variable.
+type keyPart struct {
+	literal  string
+	variable string
+}
+
+// ParseKeyTemplate parses a template for the keys of tiles, e.g. to match a
+// bucket layout shared with other tools. Variables are written in braces, as
+// in ExpandPrefix. The supported variables are:
+//
+//   - tile_size: the tile size, e.g. 256
+//   - start: the index of the tile's first entry, e.g. 1024
+//   - end: the index of its last entry, inclusive, e.g. 1279
+//   - tile_index: the tile's start divided by the tile size, e.g. 4
+//   - log_host, log_path: as in ExpandPrefix
+//
+// It must use start or tile_index, so each tile has its own key.
+func ParseKeyTemplate(template string) (KeyTemplate, error) {
+	var parts []keyPart
+	var unique bool
+	rest := template
+	for rest != "" {
+		begin := strings.IndexByte(rest, '{')
+		end := strings.IndexByte(rest, '}')
+		if begin == -1 && end == -1 {
+			parts = append(parts, keyPart{literal: rest})
+			break
+		}
+		if end != -1 && (begin == -1 || end < begin) {
+			return KeyTemplate{}, fmt.Errorf("key template %q has an unmatched '}'", template)
+		}
+		if end == -1 {
+			return KeyTemplate{}, fmt.Errorf("key template %q has an unmatched '{'", template)
+		}
+		if begin > 0 {
+			parts = append(parts, keyPart{literal: rest[:begin]})
+		}
+		name := rest[begin+1 : end]
+		rest = rest[end+1:]
+
+		switch name {
+		case "start", "tile_index":
+			unique = true
+		case "tile_size", "end", "log_host", "log_path":
+		default:
+			return KeyTemplate{}, fmt.Errorf("key template %q has unknown variable {%s}; supported variables are {tile_size}, {start}, {end}, {tile_index}, {log_host}, and {log_path}",
+				template, name)
+		}
+		parts = append(parts, keyPart{variable: name})
+	}
+	if !unique {
+		return KeyTemplate{}, fmt.Errorf("key template %q must use {start} or {tile_index}", template)
+	}
+	return KeyTemplate{template: template, parts: parts}, nil
+}
+
+// String returns the template k was parsed from.
+func (k KeyTemplate) String() string {
+	return k.template
+}
+
+// WithKeyTemplate sets the template for the keys of tiles in S3, after the
+// prefix. Super-tiles keep their own keys, and so do the markers of the
+// negative cache. Defaults to DefaultKeyTemplate.
+func WithKeyTemplate(k KeyTemplate) Option {
+	return func(o *options) {
+		o.keyTemplate = k
+	}
+}
+
+// resolve returns k with the variables about the log at logURL replaced by
+// their values.
+func (k KeyTemplate) resolve(logURL string) (KeyTemplate, error) {
+	var u *url.URL
+	resolved := KeyTemplate{template: k.template}
+	for _, part := range k.parts {
+		if part.variable == "log_host" || part.variable == "log_path" {
+			if u == nil {
+				var err error
+				u, err = url.Parse(logURL)
+				if err != nil {
+					return KeyTemplate{}, fmt.Errorf("parsing log URL for key template: %w", err)
+				}
+				if u.Hostname() == "" {
+					return KeyTemplate{}, errors.New("key template uses the log URL, but it has no host")
+				}
+			}
+			if part.variable == "log_host" {
+				part = keyPart{literal: u.Hostname()}
+			} else {
+				part = keyPart{literal: strings.Trim(u.Path, "/")}
+			}
+		}
+		resolved.parts = append(resolved.parts, part)
+	}
+	return resolved, nil
+}
+
+// expand returns the key for t. k must be resolved.
+func (k KeyTemplate) expand(t tile) string {
+	var b strings.Builder
+	for _, part := range k.parts {
+		switch part.variable {
+		case "":
+			b.WriteString(part.literal)
+		case "tile_size":
+			b.WriteString(strconv.FormatInt(t.size, 10))
+		case "start":
+			b.WriteString(strconv.FormatInt(t.start, 10))
+		case "end":
+			b.WriteString(strconv.FormatInt(t.end-1, 10))
+		case "tile_index":
+			b.WriteString(strconv.FormatInt(t.start/t.size, 10))
+		}
+	}
+	return b.String()
+}
+
+// tileKey returns the key of t in S3, after the prefix, in the flat layout.
+func (tch *Handler) tileKey(t tile) string {
+	if tch.keyTemplate.parts == nil {
+		return t.key()
+	}
+	return tch.keyTemplate.expand(t)
+}
@@ -0,0 +1,77 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	k, err := ParseKeyTemplate("{log_host}/{log_path}/{tile_size}/{tile_index}-{start}-{end}.cbor.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = k.resolve("https://oak.ct.letsencrypt.org/2023/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "oak.ct.letsencrypt.org/2023/256/4-1024-1279.cbor.gz"
+	if key := k.expand(makeTile(1100, 256, "")); key != expected {
+		t.Errorf("expected %q, got %q", expected, key)
+	}
+
+	// The default template makes the same keys as TileKey.
+	k, err = ParseKeyTemplate(DefaultKeyTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := k.expand(makeTile(1100, 256, "")); key != TileKey(256, 1100) {
+		t.Errorf("expected %q, got %q", TileKey(256, 1100), key)
+	}
+
+	for template, expectedErr := range map[string]string{
+		"{tile_size}/{start":    "unmatched '{'",
+		"{tile_size}/start}":    "unmatched '}'",
+		"{tile_size}/{bogus}":   "unknown variable {bogus}",
+		"{tile_size}/{end}.bin": "must use {start} or {tile_index}",
+	} {
+		_, err := ParseKeyTemplate(template)
+		if err == nil || !strings.Contains(err.Error(), expectedErr) {
+			t.Errorf("%q: expected error mentioning %q, got %v", template, expectedErr, err)
+		}
+	}
+}
+
+func TestKeyTemplateHandler(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	svc := s3mem.New()
+
+	k, err := ParseKeyTemplate("entries/{tile_index}.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithKeyTemplate(k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expectedSource := range []string{"CT log", "S3"} {
+		resp := getResp(handler, "/ct/v1/get-entries?start=3&end=5")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expectedSource {
+			t.Errorf("expected X-Source %q, got %q", expectedSource, source)
+		}
+	}
+	_, err = GetTileObject(context.Background(), svc, "bucket", "test/entries/1.bin")
+	if err != nil {
+		t.Errorf("expected the tile at its templated key, got %v", err)
+	}
+}
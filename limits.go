@@ -0,0 +1,293 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// BackendLimits protect the backend from load caused by cache misses. Zero
+// values mean no limit.
+type BackendLimits struct {
+	// MaxConcurrent is the max number of requests to the backend in flight at
+	// once.
+	MaxConcurrent int
+	// RequestsPerSecond is the max sustained rate of requests to the backend.
+	RequestsPerSecond float64
+	// Burst is the number of requests that may be sent at once before
+	// RequestsPerSecond applies. Defaults to 1.
+	Burst int
+}
+
+// WithBackendLimits sets limits on requests to the backend. Requests over a
+// limit wait for capacity, and fail with a 503 if they would wait longer than
+// their deadline.
+func WithBackendLimits(limits BackendLimits) Option {
+	return func(o *options) {
+		o.backendLimits = limits
+	}
+}
+
+// WithMaxConcurrentRequests limits how many requests the Handler serves at
+// once. Requests over the limit get a 503 immediately rather than waiting, so
+// a traffic spike to one Handler can't tie up resources it shares with
+// others, such as the process's memory and S3 connections. Zero means no
+// limit.
+func WithMaxConcurrentRequests(n int) Option {
+	return func(o *options) {
+		o.maxConcurrentRequests = n
+	}
+}
+
+// ClientLimits keep any one client from taking more than its share of a
+// Handler. Each client has its own budget, so a crawler hammering the Handler
+// doesn't slow down anyone else. Zero values mean no limit.
+type ClientLimits struct {
+	// RequestsPerSecond is the max sustained rate of requests from a client.
+	RequestsPerSecond float64
+	// Burst is the number of requests a client may send at once before
+	// RequestsPerSecond applies. Defaults to 1.
+	Burst int
+	// Header names a request header holding the client's address, such as
+	// X-Forwarded-For, for use behind a proxy. If it holds a list, the last
+	// address is used, since that's the one added by the proxy. By default,
+	// clients are identified by the address of their connection.
+	Header string
+}
+
+// WithClientLimits limits the rate of requests from each client. Requests
+// over the limit get a 429 with a Retry-After header. Requests forwarded by
+// another instance in the cluster are exempt, since they were counted by the
+// instance that received them.
+func WithClientLimits(limits ClientLimits) Option {
+	return func(o *options) {
+		o.clientLimits = limits
+	}
+}
+
+// errBackendLimited is returned when a request can't get backend capacity
+// before its deadline.
+var errBackendLimited = errors.New("too many requests to the backend; try again later")
+
+// backendLimiter enforces BackendLimits.
+type backendLimiter struct {
+	concurrency *semaphore.Weighted
+	rate        *tokenBucket
+}
+
+func newBackendLimiter(limits BackendLimits) *backendLimiter {
+	var l backendLimiter
+	if limits.MaxConcurrent > 0 {
+		l.concurrency = semaphore.NewWeighted(int64(limits.MaxConcurrent))
+	}
+	if limits.RequestsPerSecond > 0 {
+		burst := limits.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		l.rate = newTokenBucket(limits.RequestsPerSecond, burst)
+	}
+	return &l
+}
+
+// acquire waits until a request may be sent to the backend. On success, the
+// caller must call the returned release function when the request is done.
+func (l *backendLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.concurrency != nil {
+		err := l.concurrency.Acquire(ctx, 1)
+		if err != nil {
+			return nil, errBackendLimited
+		}
+	}
+	release := func() {
+		if l.concurrency != nil {
+			l.concurrency.Release(1)
+		}
+	}
+	if l.rate != nil {
+		err := l.rate.wait(ctx)
+		if err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// clientSweepInterval is how often clientLimiter forgets idle clients.
+const clientSweepInterval = time.Minute
+
+// clientLimiter enforces ClientLimits. A nil *clientLimiter allows
+// everything.
+type clientLimiter struct {
+	rate   float64
+	burst  int
+	header string
+
+	// mu protects buckets and lastSweep. Clients whose buckets have refilled
+	// are removed, since a new bucket would be the same.
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newClientLimiter(limits ClientLimits) *clientLimiter {
+	if limits.RequestsPerSecond == 0 {
+		return nil
+	}
+	burst := limits.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	return &clientLimiter{
+		rate:      limits.RequestsPerSecond,
+		burst:     burst,
+		header:    limits.Header,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token for the client that sent r. If the client has none
+// left, it returns how long until it will.
+func (l *clientLimiter) allow(r *http.Request) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	client := l.client(r)
+
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= clientSweepInterval {
+		for c, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst)
+		l.buckets[client] = b
+	}
+	l.mu.Unlock()
+
+	wait := b.take()
+	return wait == 0, wait
+}
+
+// client returns the address identifying the client that sent r.
+func (l *clientLimiter) client(r *http.Request) string {
+	if l.header != "" {
+		values := r.Header.Values(l.header)
+		if len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			addr := strings.TrimSpace(addrs[len(addrs)-1])
+			if addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenBucket is a rate limiter that allows rate events per second on
+// average, in bursts of up to burst events.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token, waiting until one is available. If that would take
+// longer than ctx allows, it returns errBackendLimited without waiting.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	return b.waitN(ctx, 1)
+}
+
+// waitN is wait for n tokens at once, which may be more than the burst.
+func (b *tokenBucket) waitN(ctx context.Context, n int) error {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		b.giveBack(n)
+		return errBackendLimited
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.giveBack(n)
+		return errBackendLimited
+	}
+}
+
+// take takes a token if one is available, without waiting. Otherwise, it
+// returns how long until one will be.
+func (b *tokenBucket) take() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket will have refilled completely by now.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// refill adds the tokens earned since the last refill. b.mu must be held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// giveBack returns n tokens taken by a wait that was abandoned.
+func (b *tokenBucket) giveBack(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+}
@@ -0,0 +1,213 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(100, 2)
+	ctx := context.Background()
+
+	begin := time.Now()
+	for i := 0; i < 4; i++ {
+		err := b.wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two tokens were available immediately, and the other two took 10ms
+	// each.
+	took := time.Since(begin)
+	if took < 15*time.Millisecond {
+		t.Errorf("expected the rate limit to delay requests, but 4 took %s", took)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	b = newTokenBucket(1, 1)
+	err := b.wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.wait(ctx)
+	if !errors.Is(err, errBackendLimited) {
+		t.Errorf("expected errBackendLimited when the wait would outlast the deadline, got %v", err)
+	}
+}
+
+func TestBackendLimiterConcurrency(t *testing.T) {
+	l := newBackendLimiter(BackendLimits{MaxConcurrent: 1})
+
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	if !errors.Is(err, errBackendLimited) {
+		t.Errorf("expected errBackendLimited while at max concurrency, got %v", err)
+	}
+
+	release()
+	release, err = l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("expected capacity after release, got %s", err)
+	}
+	release()
+
+	unlimited := newBackendLimiter(BackendLimits{})
+	for i := 0; i < 100; i++ {
+		_, err := unlimited.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithMaxConcurrentRequests(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		resp := getResp(handler, "/ct/v1/get-sth")
+		resp.Body.Close()
+		close(done)
+	}()
+	<-started
+
+	resp := getResp(handler, "/ct/v1/get-entries?start=0&end=0")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while at max concurrent requests, got %d", resp.StatusCode)
+	}
+	close(release)
+	<-done
+}
+
+func TestClientLimits(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithClientLimits(ClientLimits{RequestsPerSecond: 0.01, Burst: 2, Header: "X-Forwarded-For"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(remoteAddr, forwardedFor string, header http.Header) *http.Response {
+		req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=2", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	testCases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		header       http.Header
+		expected     int
+	}{
+		{"10.0.0.1:1000", "", nil, http.StatusOK},
+		{"10.0.0.1:1001", "", nil, http.StatusOK},
+		{"10.0.0.1:1002", "", nil, http.StatusTooManyRequests},
+		// Another client has its own budget.
+		{"10.0.0.2:1000", "", nil, http.StatusOK},
+		// Behind a proxy, the last address in the header is the client.
+		{"10.0.0.1:1003", "192.0.2.1, 198.51.100.1", nil, http.StatusOK},
+		{"10.0.0.1:1004", "192.0.2.2, 198.51.100.1", nil, http.StatusOK},
+		{"10.0.0.1:1005", "192.0.2.3, 198.51.100.1", nil, http.StatusTooManyRequests},
+		// Requests forwarded by peers were limited where they were received.
+		{"10.0.0.1:1006", "", http.Header{forwardedHeader: {"1"}}, http.StatusOK},
+	}
+	for i, tc := range testCases {
+		resp := get(tc.remoteAddr, tc.forwardedFor, tc.header)
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected {
+			t.Errorf("request %d: expected %d, got %d", i, tc.expected, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "100" {
+			t.Errorf("request %d: expected Retry-After: 100, got %q", i, resp.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestMaxBackendBodySize(t *testing.T) {
+	huge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"entries":[`)
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(w, `{"leaf_input":"%s","extra_data":""},`, strings.Repeat("A", 1000))
+		}
+	}))
+	defer huge.Close()
+	replica := httptest.NewServer(fakelog.New(10, 3))
+	defer replica.Close()
+
+	handler, err := New(huge.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithMaxBackendBodySize(10000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("expected an error for an oversized response, got %d", resp.StatusCode)
+	}
+	expectAndResetMetric(t, handler.requestsMetric, 1, "too_large", "ct_log_get")
+
+	// An oversized response is the backend's fault, so another replica is
+	// tried.
+	handler, err = New(huge.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithMaxBackendBodySize(10000),
+		WithFailover(Failover{Replicas: []string{replica.URL}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = getAndParseResp(t, handler, "/ct/v1/get-entries?start=0&end=2")
+	if err != nil {
+		t.Fatalf("expected failover to the replica, got %s", err)
+	}
+	expectAndResetMetric(t, handler.requestsMetric, 1, "failover", "ct_log_get")
+}
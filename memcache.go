@@ -0,0 +1,143 @@
+package ctile
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithMemoryCache keeps up to maxBytes of recently served tiles in memory, so
+// requests for hot tiles, such as those near the end of the log that many
+// monitors read at once, are served without an S3 request. Only complete
+// tiles, which never change, are kept. The least recently used tiles are
+// dropped to make room. A tile's size is that of its entries' contents, so the
+// memory used is somewhat higher. Tiles deleted from S3 stay cached, unless
+// they're reported to WithS3Events. Zero disables the cache.
+//
+// ctile_memory_cache_requests counts hits and misses, and
+// ctile_memory_cache_bytes is the size of the tiles held, for sizing it.
+func WithMemoryCache(maxBytes int64) Option {
+	return func(o *options) {
+		o.memoryCacheBytes = maxBytes
+	}
+}
+
+// memoryCache is an LRU cache of tiles, keyed by their S3 location. A nil
+// *memoryCache holds nothing.
+type memoryCache struct {
+	maxBytes int64
+
+	requests *prometheus.CounterVec
+	bytes    prometheus.Gauge
+
+	// mu protects the fields below.
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // Of *memoryCacheItem, most recently used first.
+	items map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key      string
+	contents *Entries
+	size     int64
+}
+
+func newMemoryCache(maxBytes int64, promRegisterer prometheus.Registerer) *memoryCache {
+	if maxBytes == 0 {
+		return nil
+	}
+	c := &memoryCache{
+		maxBytes: maxBytes,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_memory_cache_requests",
+			Help: "lookups of tiles in the in-memory cache, by result: hit or miss",
+		}, []string{"result"}),
+		bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ctile_memory_cache_bytes",
+			Help: "size of the tiles held in the in-memory cache",
+		}),
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+	promRegisterer.MustRegister(c.requests, c.bytes)
+	return c
+}
+
+// get returns the tile at key, or nil if it isn't cached. The returned
+// Entries are shared, and must not be modified.
+func (c *memoryCache) get(key string) *Entries {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.requests.WithLabelValues("miss").Inc()
+		return nil
+	}
+	c.requests.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*memoryCacheItem).contents
+}
+
+// add caches the tile at key, unless it's larger than the whole cache.
+func (c *memoryCache) add(key string, contents *Entries) {
+	if c == nil {
+		return
+	}
+	var size int64
+	for _, e := range contents.Entries {
+		size += int64(len(e.LeafInput) + len(e.ExtraData))
+	}
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	for c.size+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.items[key] = c.lru.PushFront(&memoryCacheItem{key, contents, size})
+	c.size += size
+	c.bytes.Set(float64(c.size))
+}
+
+// delete drops the tile at key, if it's cached.
+func (c *memoryCache) delete(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+		c.bytes.Set(float64(c.size))
+	}
+}
+
+// remove drops elem from the cache. c.mu must be held.
+func (c *memoryCache) remove(elem *list.Element) {
+	item := c.lru.Remove(elem).(*memoryCacheItem)
+	delete(c.items, item.key)
+	c.size -= item.size
+}
+
+// cacheKey returns the key of t in the memory, disk, and shared caches: its S3
+// bucket and key.
+func (tch *Handler) cacheKey(t tile) string {
+	bucket, prefix := tch.location(t)
+	return bucket + "/" + prefix + t.key()
+}
+
+// addToLocalCaches keeps a complete tile in the memory and disk caches.
+func (tch *Handler) addToLocalCaches(key string, contents *Entries) {
+	tch.memoryCache.add(key, contents)
+	tch.diskCache.add(key, contents)
+}
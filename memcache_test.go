@@ -0,0 +1,101 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestMemoryCache(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	svc := s3mem.New()
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithMemoryCache(1<<20),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSource := func(url, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("expected X-Source %q, got %q", expected, source)
+		}
+	}
+
+	expectSource("/ct/v1/get-entries?start=0&end=2", "CT log")
+	expectAndResetMetric(t, handler.memoryCache.requests, 1, "miss")
+
+	// Once the tile is in memory, it's served without reading S3.
+	_, err = svc.DeleteObjects(context.Background(), &s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("test/" + TileKey(3, 0))}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource("/ct/v1/get-entries?start=1&end=2", "memory")
+	expectAndResetMetric(t, handler.memoryCache.requests, 1, "hit")
+	expectAndResetMetric(t, handler.requestsMetric, 1, "success", "memory_get")
+
+	// Tiles read from S3 are kept too.
+	err = PutTileObject(context.Background(), svc, "bucket", "test/"+TileKey(3, 3), entriesFor(3, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource("/ct/v1/get-entries?start=3&end=5", "S3")
+	expectSource("/ct/v1/get-entries?start=3&end=5", "memory")
+
+	// Partial tiles aren't.
+	expectSource("/ct/v1/get-entries?start=9&end=9", "CT log")
+	expectSource("/ct/v1/get-entries?start=9&end=9", "CT log")
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	c := newMemoryCache(10, prometheus.NewRegistry())
+	tile := func(size int) *Entries {
+		return &Entries{Entries: []Entry{{LeafInput: make([]byte, size)}}}
+	}
+	c.add("a", tile(4))
+	c.add("b", tile(4))
+	// Using a makes b the least recently used.
+	c.get("a")
+	c.add("c", tile(4))
+	if c.get("a") == nil || c.get("b") != nil || c.get("c") == nil {
+		t.Errorf("expected b to be dropped to make room for c")
+	}
+	c.add("big", tile(11))
+	if c.get("big") != nil || c.get("a") == nil {
+		t.Errorf("expected a tile larger than the cache not to be kept, or to drop others")
+	}
+	if c.size != 8 {
+		t.Errorf("expected size 8, got %d", c.size)
+	}
+}
+
+// entriesFor returns the entries of a fakelog.Log from start to end,
+// exclusive.
+func entriesFor(start, end int64) *Entries {
+	var e Entries
+	for i := start; i < end; i++ {
+		e.Entries = append(e.Entries, Entry{LeafInput: fakelog.LeafInput(i), ExtraData: fakelog.ExtraData(i)})
+	}
+	return &e
+}
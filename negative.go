@@ -0,0 +1,129 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// WithNegativeCache makes Handlers share what they learn about the end of the
+// log through marker objects in S3, which are trusted for ttl. When the
+// backend returns a partial tile, or a 400 for a tile past the end of the
+// log, the Handler writes a marker recording the log's size. Until the
+// marker expires, requests past that size are answered with a 400 by every
+// Handler using the same bucket and prefix, without contacting the backend.
+// This keeps clients polling the head of the log from reaching the backend,
+// at the cost of an extra S3 read for each tile not in the cache.
+//
+// Entries appended to the log within ttl may be reported as past the end, so
+// ttl should be short, e.g. a few seconds. Zero disables markers.
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(o *options) {
+		o.negativeCacheTTL = ttl
+	}
+}
+
+// treeSizeMarker is the body of a marker object, recording that the log had
+// TreeSize entries as of Written.
+type treeSizeMarker struct {
+	TreeSize int64     `json:"tree_size"`
+	Written  time.Time `json:"written"`
+}
+
+// pastTheEndMarker is returned when a marker says that the entries of a tile
+// from TreeSize onward don't exist. Requests for earlier entries of the tile
+// must ignore markers to be served.
+type pastTheEndMarker struct {
+	treeSizeMarker
+}
+
+func (p pastTheEndMarker) Error() string {
+	return fmt.Sprintf("requested range is past the end of the log, which had %d entries as of %s",
+		p.TreeSize, p.Written.UTC().Format(time.RFC3339))
+}
+
+type ignoreMarkersKey struct{}
+
+// ignoresMarkers returns true if ctx is for a request that markers don't
+// apply to.
+func ignoresMarkers(ctx context.Context) bool {
+	ignore, _ := ctx.Value(ignoreMarkersKey{}).(bool)
+	return ignore
+}
+
+// markerLocation returns the S3 bucket and key of the marker for t, which
+// is kept next to where t would be cached. The key doesn't parse as a tile
+// key, so tools that list tiles skip it.
+func (tch *Handler) markerLocation(t tile) (bucket, key string) {
+	bucket, prefix := tch.location(t)
+	return bucket, prefix + "past_the_end/" + t.key()
+}
+
+// readMarker returns a pastTheEndMarker error if there's an unexpired marker
+// for t, and nil otherwise. Errors reading the marker are logged, and
+// otherwise ignored, since the backend can still answer.
+func (tch *Handler) readMarker(ctx context.Context, t tile) error {
+	if tch.negativeCacheTTL == 0 || ignoresMarkers(ctx) {
+		return nil
+	}
+	bucket, key := tch.markerLocation(t)
+	resp, err := tch.s3Service.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if !errors.As(err, &nsk) {
+			tch.requestsMetric.WithLabelValues("error", "marker_get").Inc()
+			log.Printf("error reading past the end marker: %s\n", err)
+		}
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var marker treeSizeMarker
+	err = json.NewDecoder(resp.Body).Decode(&marker)
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "marker_get").Inc()
+		log.Printf("error decoding past the end marker %s: %s\n", key, err)
+		return nil
+	}
+	if time.Since(marker.Written) > tch.negativeCacheTTL {
+		return nil
+	}
+	return pastTheEndMarker{marker}
+}
+
+// writeMarker records that the log had treeSize entries, in the marker for
+// t. Failures are logged, since the marker is only an optimization.
+func (tch *Handler) writeMarker(ctx context.Context, t tile, treeSize int64) {
+	if tch.negativeCacheTTL == 0 || tch.dryRun {
+		return
+	}
+	body, err := json.Marshal(treeSizeMarker{
+		TreeSize: treeSize,
+		Written:  time.Now(),
+	})
+	if err != nil {
+		log.Printf("error encoding past the end marker: %s\n", err)
+		return
+	}
+	bucket, key := tch.markerLocation(t)
+	_, err = tch.s3Service.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "marker_put").Inc()
+		log.Printf("error writing past the end marker: %s\n", err)
+	}
+}
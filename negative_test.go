@@ -0,0 +1,66 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestNegativeCache(t *testing.T) {
+	var backendRequests atomic.Int64
+	fake := fakelog.New(11, 3)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+		fake.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	svc := s3mem.New()
+	newHandler := func() *Handler {
+		handler, err := New(backend.URL,
+			WithTileSize(3),
+			WithS3(svc, "bucket", "test/"),
+			WithNegativeCache(time.Minute),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	first, second := newHandler(), newHandler()
+
+	expectStatus := func(handler *Handler, url string, expectedStatus int, expectedBackendRequests int64) {
+		t.Helper()
+		before := backendRequests.Load()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", url, expectedStatus, resp.StatusCode)
+		}
+		if n := backendRequests.Load() - before; n != expectedBackendRequests {
+			t.Errorf("%s: expected %d backend requests, got %d", url, expectedBackendRequests, n)
+		}
+	}
+
+	// The last tile is partial, with entries 9 and 10.
+	expectStatus(first, "/ct/v1/get-entries?start=11&end=11", http.StatusBadRequest, 1)
+	expectStatus(second, "/ct/v1/get-entries?start=11&end=11", http.StatusBadRequest, 0)
+	expectStatus(second, "/ct/v1/get-entries?start=9&end=10", http.StatusOK, 1)
+
+	// The next tile is entirely past the end.
+	expectStatus(first, "/ct/v1/get-entries?start=12&end=12", http.StatusBadRequest, 1)
+	expectStatus(second, "/ct/v1/get-entries?start=13&end=14", http.StatusBadRequest, 0)
+
+	// Without markers, every request reaches the backend.
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(handler, "/ct/v1/get-entries?start=12&end=12", http.StatusBadRequest, 1)
+	expectStatus(handler, "/ct/v1/get-entries?start=12&end=12", http.StatusBadRequest, 1)
+}
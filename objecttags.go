@@ -0,0 +1,37 @@
+package ctile
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// WithObjectTags tags each tile written to S3 with tags, such as the log's
+// name, and with its tile size and range of entries, as ctile-tile-size and
+// ctile-range, e.g. "256" and "512-767". Bucket lifecycle rules and cost
+// allocation reports can then tell tiles from other objects in the bucket.
+// S3 allows 10 tags per object, so at most 8 may be set. Writing tags needs
+// the s3:PutObjectTagging permission. Nil, the default, disables tagging.
+func WithObjectTags(tags map[string]string) Option {
+	return func(o *options) {
+		o.objectTags = tags
+	}
+}
+
+// maxObjectTags is the most tags S3 allows on an object.
+const maxObjectTags = 10
+
+// objectTagging returns the tags of t's object in S3, encoded for
+// s3.PutObjectInput's Tagging, or "" if tagging is disabled.
+func (tch *Handler) objectTagging(t tile) string {
+	if tch.objectTags == nil {
+		return ""
+	}
+	tags := url.Values{}
+	for k, v := range tch.objectTags {
+		tags.Set(k, v)
+	}
+	tags.Set("ctile-tile-size", strconv.FormatInt(t.size, 10))
+	tags.Set("ctile-range", fmt.Sprintf("%d-%d", t.start, t.end-1))
+	return tags.Encode()
+}
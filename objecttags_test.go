@@ -0,0 +1,74 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// taggingS3 is an in-memory S3 that records the tagging of each object
+// written.
+type taggingS3 struct {
+	*s3mem.Client
+	mu   sync.Mutex
+	tags map[string]string
+}
+
+func (s *taggingS3) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	s.mu.Lock()
+	s.tags[aws.ToString(in.Key)] = aws.ToString(in.Tagging)
+	s.mu.Unlock()
+	return s.Client.PutObject(ctx, in, opts...)
+}
+
+func TestObjectTags(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	svc := &taggingS3{Client: s3mem.New(), tags: make(map[string]string)}
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithObjectTags(map[string]string{"ctile-log": "oak 2024h1"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getResp(handler, "/ct/v1/get-entries?start=3&end=5")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	expected := "ctile-log=oak+2024h1&ctile-range=3-5&ctile-tile-size=3"
+	if tags := svc.tags["test/"+TileKey(3, 3)]; tags != expected {
+		t.Errorf("expected tags %q, got %q", expected, tags)
+	}
+
+	// Without tags, objects aren't tagged.
+	handler, err = New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "untagged/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = getResp(handler, "/ct/v1/get-entries?start=3&end=5")
+	resp.Body.Close()
+	if tags := svc.tags["untagged/"+TileKey(3, 3)]; tags != "" {
+		t.Errorf("expected no tags, got %q", tags)
+	}
+
+	tooMany := make(map[string]string)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"} {
+		tooMany[k] = "v"
+	}
+	_, err = New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithObjectTags(tooMany))
+	if err == nil {
+		t.Errorf("expected an error for 9 tags")
+	}
+}
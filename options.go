@@ -0,0 +1,228 @@
+package ctile
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures a Handler. Pass Options to New.
+type Option func(*options)
+
+// options is the configuration accumulated from a list of Options. New
+// validates it and turns it into a Handler.
+type options struct {
+	tileSize int
+
+	s3Service S3API
+	s3Bucket  string
+	s3Prefix  string
+	shards    []Shard
+
+	timeouts          Timeouts
+	backendLimits     BackendLimits
+	failover          Failover
+	mode              Mode
+	dryRun            bool
+	asyncWrites       bool
+	writeQueue        WriteQueue
+	objectTags        map[string]string
+	secondaryS3       SecondaryS3
+	conditionalWrites bool
+	tileFormat        TileFormat
+	superTiles        int
+	keyLayout         KeyLayout
+	keyTemplate       KeyTemplate
+	chainStore        ChainStore
+	encryption        Encryption
+
+	promRegisterer prometheus.Registerer
+
+	featureFlags *FeatureFlags
+
+	collapseGroup *CollapseGroup
+	collapseKey   CollapseKey
+
+	s3Events *S3Events
+
+	negativeCacheTTL time.Duration
+	tailCacheTTL     time.Duration
+
+	ring            *Ring
+	readThroughPeer string
+	clusterPath     string
+
+	httpClient            *http.Client
+	maxBackendBodySize    int64
+	strictValidation      bool
+	partialTileRetry      PartialTileRetry
+	partialTileCaching    bool
+	tileIndex             bool
+	tileIndexPriming      bool
+	precompressedJSON     bool
+	readaheadDepth        int
+	s3HedgeDelay          time.Duration
+	staticCTAPI           StaticCTAPI
+	backendType           BackendType
+	sthCache              STHCache
+	rootsCacheTTL         time.Duration
+	cachedEntryAndProof   bool
+	maxRequestTiles       int
+	responseEncoders      []Encoder
+	prettyJSON            bool
+	export                bool
+	exportRate            float64
+	tailPollInterval      time.Duration
+	strictAlignment       bool
+	getEntriesLimit       GetEntriesLimit
+	circuitBreaker        CircuitBreaker
+	s3Degradation         S3Degradation
+	maxConcurrentRequests int
+	memoryCacheBytes      int64
+	diskCache             *DiskCache
+	sharedCache           SharedCache
+	clientLimits          ClientLimits
+	coalescedEndpoints    []string
+	debugAuthorize        func(*http.Request) bool
+	requestSigning        RequestSigning
+
+	hooks      Hooks
+	middleware []func(http.Handler) http.Handler
+}
+
+// defaultOptions returns the configuration used for anything not set by an
+// Option.
+func defaultOptions() options {
+	return options{
+		timeouts:       Timeouts{FullRequest: 4 * time.Second},
+		mode:           ModeNormal,
+		promRegisterer: prometheus.NewRegistry(),
+		httpClient:     http.DefaultClient,
+
+		maxBackendBodySize: DefaultMaxBackendBodySize,
+		coalescedEndpoints: DefaultCoalescedEndpoints,
+	}
+}
+
+// WithTileSize sets the number of entries in each tile. It must match the
+// max_getentries value of the backing CT log. It is required.
+func WithTileSize(tileSize int) Option {
+	return func(o *options) {
+		o.tileSize = tileSize
+	}
+}
+
+// WithS3 sets where tiles are cached: in the given bucket, with keys prefixed
+// by prefix. It is required, except in ModeProxyOnly.
+func WithS3(svc S3API, bucket, prefix string) Option {
+	return func(o *options) {
+		o.s3Service = svc
+		o.s3Bucket = bucket
+		o.s3Prefix = prefix
+	}
+}
+
+// Timeouts bounds how long a Handler spends on various operations.
+type Timeouts struct {
+	// FullRequest is the max time to spend handling a get-entries request,
+	// including reading from S3, fetching from the backend, and writing to S3.
+	// Defaults to 4 seconds.
+	FullRequest time.Duration
+	// Backend is the max time to spend on a single request to the backend.
+	// Zero means it's only bounded by FullRequest.
+	Backend time.Duration
+	// S3Write is the max time to spend writing a tile to S3. The write isn't
+	// canceled when the request is, by its client going away or by
+	// FullRequest, so a tile fetched from the backend is still cached. Zero
+	// means the same as FullRequest.
+	S3Write time.Duration
+}
+
+// WithTimeouts overrides the default Timeouts.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(o *options) {
+		o.timeouts = timeouts
+	}
+}
+
+// WithMode sets where tiles may be fetched from. Defaults to ModeNormal.
+func WithMode(mode Mode) Option {
+	return func(o *options) {
+		o.mode = mode
+	}
+}
+
+// WithDryRun, if dryRun is true, makes the Handler log the tiles it would
+// write to S3 instead of writing them.
+func WithDryRun(dryRun bool) Option {
+	return func(o *options) {
+		o.dryRun = dryRun
+	}
+}
+
+// WithAsyncWrites, if asyncWrites is true, makes the Handler write tiles
+// fetched from the backend to S3 in the background, after responding, so
+// clients don't wait for the PutObject. The tile is added to the memory, disk,
+// and shared caches right away, but until the write finishes, other instances
+// and requests missing those caches fetch it from the backend again. The writes
+// wait in the WriteQueue, DefaultWriteQueue unless WithWriteQueue sets one,
+// and a failed write is logged and counted, but the client has already been
+// served. Hooks' OnTileCached is called once the write succeeds.
+func WithAsyncWrites(asyncWrites bool) Option {
+	return func(o *options) {
+		o.asyncWrites = asyncWrites
+	}
+}
+
+// WithMetrics sets the registerer for the Handler's Prometheus metrics. By
+// default, metrics are registered with a private registry, so they aren't
+// exported anywhere.
+func WithMetrics(promRegisterer prometheus.Registerer) Option {
+	return func(o *options) {
+		o.promRegisterer = promRegisterer
+	}
+}
+
+// WithHTTPClient sets the client for requests to the backend and to peers.
+// Giving each Handler its own client, with its own transport, keeps their
+// connection pools apart. Defaults to http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// DefaultMaxBackendBodySize is the default for WithMaxBackendBodySize. It's
+// far more than any real tile needs.
+const DefaultMaxBackendBodySize = 64 << 20
+
+// WithMaxBackendBodySize limits the size of the responses read into memory
+// from the backend and from peers, so a misbehaving backend can't run the
+// process out of memory. Larger responses fail the request, as a backend
+// failure, and are counted as ctile_requests{result="too_large"}. Zero means
+// no limit.
+func WithMaxBackendBodySize(n int64) Option {
+	return func(o *options) {
+		o.maxBackendBodySize = n
+	}
+}
+
+// DefaultCoalescedEndpoints is the default for WithCoalescedEndpoints: the
+// endpoints monitors poll most often, whose responses change slowly.
+var DefaultCoalescedEndpoints = []string{"get-sth", "get-roots"}
+
+// WithCoalescedEndpoints sets the endpoints other than get-entries, by name,
+// e.g. "get-sth", for which simultaneous requests with the same path and
+// query share one request to the backend, so a burst of identical polls costs
+// the backend one response, whose status and headers are served to each of
+// them. The shared request is bounded by the backend timeout, or the full request
+// timeout if that's unset, rather than by the request that started it. Each
+// shared response is read into memory, up to WithMaxBackendBodySize, and
+// counted in ctile_passthrough_shared. No endpoints disables it. Defaults to
+// DefaultCoalescedEndpoints.
+func WithCoalescedEndpoints(endpoints ...string) Option {
+	return func(o *options) {
+		o.coalescedEndpoints = endpoints
+	}
+}
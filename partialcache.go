@@ -0,0 +1,92 @@
+package ctile
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// partialKeySuffix is appended to the key of a tile for the object that holds
+// it while it's partial. The key doesn't parse as a tile key, so tools that
+// list tiles skip it.
+const partialKeySuffix = ".partial"
+
+// WithPartialTileCaching caches partial tiles in S3 too, so a log that grows
+// slowly, whose last tile stays partial for a long time, still has its tail
+// served from the cache. A partial tile is stored under its tile's key with
+// a ".partial" suffix, and replaced whenever a longer version of it is
+// fetched. Requests for entries past the end of the cached version are sent
+// to the backend, and once the tile is complete, it's written under its own
+// key as usual, and the partial version is deleted.
+func WithPartialTileCaching(enabled bool) Option {
+	return func(o *options) {
+		o.partialTileCaching = enabled
+	}
+}
+
+type cachedPartialKey struct{}
+
+// cachedPartialLength returns, if ctx is for a request that found a partial
+// version of its tile in S3 too short to serve it, the number of entries in
+// that version, and otherwise zero.
+func cachedPartialLength(ctx context.Context) int {
+	n, _ := ctx.Value(cachedPartialKey{}).(int)
+	return n
+}
+
+// partialObjectKey returns the bucket and key of the object holding the
+// partial version of t.
+func (tch *Handler) partialObjectKey(t tile) (string, string) {
+	bucket, prefix := tch.location(t)
+	return bucket, prefix + tch.objectKey(t, tch.tileKey(t)+partialKeySuffix)
+}
+
+// getPartialFromS3 returns the partial version of t cached in S3, or an error
+// matching noSuchKey if there isn't one.
+func (tch *Handler) getPartialFromS3(ctx context.Context, t tile) (*Entries, error) {
+	bucket, prefix := tch.location(t)
+	contents, err := tch.getTileObject(ctx, tch.s3Service, bucket, prefix, t, tch.tileKey(t)+partialKeySuffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents.Entries) == 0 || !tch.isPartialTile(contents) {
+		return nil, noSuchKey{}
+	}
+	return contents, nil
+}
+
+// writePartialToS3 caches the partial tile t, whose contents are e, in S3.
+func (tch *Handler) writePartialToS3(ctx context.Context, t tile, e *Entries) error {
+	bucket, key := tch.partialObjectKey(t)
+	body, metadata, err := tch.encodeObject(ctx, key, e)
+	if err != nil {
+		return err
+	}
+	if tch.dryRun {
+		log.Printf("dry run: not writing %d bytes to bucket %q with key %q\n", len(body), bucket, key)
+		return nil
+	}
+	partial := t
+	partial.end = t.start + int64(len(e.Entries))
+	return putTileObject(ctx, tch.s3Service, bucket, key, body, metadata, tch.objectTagging(partial))
+}
+
+// removePartialFromS3 deletes the partial version of t, once t has been
+// cached complete. Failures are only logged, since the complete tile is read
+// first.
+func (tch *Handler) removePartialFromS3(ctx context.Context, t tile) {
+	if tch.dryRun {
+		return
+	}
+	bucket, key := tch.partialObjectKey(t)
+	_, err := tch.s3Service.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String(key)}}, Quiet: true},
+	})
+	if err != nil {
+		log.Printf("warning: deleting the partial version of tile %d-%d: %s\n", t.start, t.end-1, err)
+	}
+}
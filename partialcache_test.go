@@ -0,0 +1,61 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestPartialTileCaching(t *testing.T) {
+	// The log grows during the test.
+	var log atomic.Pointer[fakelog.Log]
+	log.Store(fakelog.New(4, 3))
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Load().ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	ctx := context.Background()
+	svc := s3mem.New()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithPartialTileCaching(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(start string, expectedSource string, expectedEntries int) {
+		t.Helper()
+		entries, headers, err := getAndParseResp(t, handler, "/ct/v1/get-entries?start="+start+"&end=5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectHeader(t, headers, "X-Source", expectedSource)
+		if len(entries.Entries) != expectedEntries {
+			t.Errorf("start=%s: expected %d entries, got %d", start, expectedEntries, len(entries.Entries))
+		}
+	}
+	partialKey := "test/" + TileKey(3, 3) + partialKeySuffix
+
+	get("3", "CT log", 1)
+	get("3", "S3", 1)
+
+	// Requests past the end of the cached version go to the backend, and
+	// replace it if it's grown.
+	log.Store(fakelog.New(5, 3))
+	get("4", "CT log", 1)
+	get("3", "S3", 2)
+
+	// Once the tile is complete, it's cached as usual, and the partial
+	// version is removed.
+	log.Store(fakelog.New(6, 3))
+	get("5", "CT log", 1)
+	get("3", "S3", 3)
+	_, err = GetTileObject(ctx, svc, "bucket", partialKey)
+	if !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected the partial version to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package ctile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// precompressedKeySuffix is appended to the key of a tile for the object that
+// holds its precompressed JSON rendering. The key doesn't parse as a tile key,
+// so tools that list tiles skip it.
+const precompressedKeySuffix = ".json.gz"
+
+// WithPrecompressedJSON stores, next to each tile written to S3, the gzipped
+// JSON response for a request for the whole tile, under the tile's key with a
+// ".json.gz" suffix. Requests for a whole tile from clients that accept gzip
+// are then answered with that object as is, without decoding the tile or
+// encoding JSON, which is most of the work of serving a tile. Other requests,
+// and tiles cached before it was enabled, are served as usual.
+//
+// It doubles the S3 writes and roughly doubles the storage used, and requests
+// for whole tiles that aren't cached take one more S3 read. Served responses
+// are counted in ctile_requests{source="s3_precompressed_get"}.
+func WithPrecompressedJSON(enabled bool) Option {
+	return func(o *options) {
+		o.precompressedJSON = enabled
+	}
+}
+
+// precompressedObjectKey returns the bucket and key of the object holding the
+// precompressed JSON of t.
+func (tch *Handler) precompressedObjectKey(t tile) (string, string) {
+	bucket, prefix := tch.location(t)
+	return bucket, prefix + tch.objectKey(t, tch.tileKey(t)+precompressedKeySuffix)
+}
+
+// writePrecompressed stores the precompressed JSON of the complete tile t,
+// whose contents are e. Failures are only logged, since the tile is served
+// without it.
+func (tch *Handler) writePrecompressed(ctx context.Context, t tile, e *Entries) {
+	var buf bytes.Buffer
+	gzipWriter, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err == nil {
+		err = writeEntriesJSON(gzipWriter, tch.prettyJSON, e.Entries)
+	}
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	body := buf.Bytes()
+	bucket, key := tch.precompressedObjectKey(t)
+	var encryptionKeyID string
+	if encryptor := tch.encryptor.Load(); err == nil && encryptor != nil {
+		body, encryptionKeyID, err = encryptor.seal(key, body)
+	}
+	if err == nil {
+		metadata := tileMetadata(body, 1)
+		if encryptionKeyID != "" {
+			metadata[encryptionMetadataKey] = encryptionKeyID
+		}
+		err = putTileObject(ctx, tch.s3Service, bucket, key, body, metadata, tch.objectTagging(t))
+	}
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "s3_precompressed_put").Inc()
+		log.Printf("warning: writing the precompressed JSON of tile %d-%d to S3: %s\n", t.start, t.end-1, err)
+	}
+}
+
+// getPrecompressed returns the precompressed JSON of t, or an error matching
+// noSuchKey if there isn't any.
+func (tch *Handler) getPrecompressed(ctx context.Context, t tile) ([]byte, error) {
+	bucket, prefix := tch.location(t)
+	var err error
+	for _, key := range tch.objectKeys(t, tch.tileKey(t)+precompressedKeySuffix) {
+		var body []byte
+		var metadata map[string]string
+		body, metadata, err = getObject(ctx, tch.s3Service, bucket, prefix+key)
+		if err == nil {
+			body, err = tch.encryptor.Load().open(bucket, prefix+key, body, metadata)
+		}
+		if !errors.Is(err, noSuchKey{}) {
+			return body, err
+		}
+	}
+	return nil, err
+}
+
+// servePrecompressed answers r, a request for the entries from start to end
+// of tile, with the tile's precompressed JSON, if it can, and returns true if
+// it did.
+func (tch *Handler) servePrecompressed(ctx context.Context, w http.ResponseWriter, r *http.Request, tile tile, start, end int64) bool {
+	if !tch.precompressedJSON || tch.mode == ModeProxyOnly || start != tile.start || end < tile.end ||
+		!acceptsGzip(r) || tch.s3Health.degraded() || !tch.tileIndex.contains(tile) {
+		return false
+	}
+	etag := tch.entriesETag(tile.start, tile.end, "application/json", tch.prettyJSON)
+	if etagMatches(r, etag) {
+		// The tile is complete, so the client's copy is still good.
+		tch.requestsMetric.WithLabelValues("not_modified", "s3_precompressed_get").Inc()
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	debug := debugFrom(ctx)
+	begin := time.Now()
+	body, err := tch.getPrecompressed(ctx, tile)
+	if err != nil {
+		debug.step("s3_precompressed_get", begin, debugResult(nil, err))
+		// A key mismatch is left to the usual path too.
+		if !errors.Is(err, noSuchKey{}) && !errors.Is(err, ErrKeyMismatch) {
+			tch.requestsMetric.WithLabelValues("error", "s3_precompressed_get").Inc()
+			log.Printf("warning: reading the precompressed JSON of tile %d-%d from S3: %s\n", tile.start, tile.end-1, err)
+		}
+		return false
+	}
+	debug.step("s3_precompressed_get", begin, "hit")
+	debug.setResult(sourceS3, false)
+	tch.hooks.cacheHit(ctx, tile)
+	tch.requestsMetric.WithLabelValues("success", "s3_precompressed_get").Inc()
+
+	w.Header().Set("X-Source", string(sourceS3))
+	w.Header().Set("X-Response-Len", strconv.FormatInt(tile.size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	// With Content-Encoding set, the compressor passes the body through.
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("ETag", encodedETag(etag, "gzip"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return true
+}
+
+// acceptsGzip returns true if r's Accept-Encoding allows a gzipped response.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
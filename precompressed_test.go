@@ -0,0 +1,108 @@
+package ctile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestPrecompressedJSON(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	svc := s3mem.New()
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithPrecompressedJSON(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() float64 {
+		return testutil.ToFloat64(handler.requestsMetric.WithLabelValues("success", "s3_precompressed_get"))
+	}
+	// body returns the JSON of the response to url from handler, and its
+	// X-Source.
+	body := func(handler *Handler, url string) ([]byte, string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonBytes, err := io.ReadAll(gzipReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jsonBytes, resp.Header.Get("X-Source")
+	}
+
+	// The first request caches the tile, and its JSON.
+	_, source := body(handler, "/ct/v1/get-entries?start=0&end=2")
+	if source != "CT log" || served() != 0 {
+		t.Errorf("expected the first request to be served from the CT log, got %q", source)
+	}
+	_, err = svc.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("test/tile_size=3/0.cbor.gz.json.gz")})
+	if err != nil {
+		t.Fatalf("expected the precompressed JSON to be stored: %s", err)
+	}
+
+	// Requests for the whole tile are served from it, with the same JSON as
+	// usual.
+	precompressed, source := body(handler, "/ct/v1/get-entries?start=0&end=5")
+	if source != "S3" || served() != 1 {
+		t.Errorf("expected a request for the whole tile to be served precompressed from S3, got %q and %g served", source, served())
+	}
+	expected, _ := body(plain, "/ct/v1/get-entries?start=0&end=5")
+	if !bytes.Equal(precompressed, expected) {
+		t.Errorf("expected the precompressed JSON to match\n%s\ngot\n%s", expected, precompressed)
+	}
+
+	// Other requests are served as usual.
+	body(handler, "/ct/v1/get-entries?start=1&end=2")
+	body(handler, "/ct/v1/get-entries?start=0&end=1")
+	body(handler, "/ct/v1/get-entries?start=0&end=2&verbose=true")
+	req := httptest.NewRequest("GET", "/ct/v1/get-entries?start=0&end=2", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected an uncompressed response without Accept-Encoding, got status %d and Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if served() != 1 {
+		t.Errorf("expected only requests for the whole tile to be served precompressed, got %g", served())
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                 false,
+		"gzip":             true,
+		"deflate, gzip":    true,
+		"gzip;q=0.5, br":   true,
+		"gzip;q=0":         false,
+		"br, gzip; q=0.0":  false,
+		"x-gzip, identity": false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(req); got != expected {
+			t.Errorf("Accept-Encoding %q: expected %t, got %t", header, expected, got)
+		}
+	}
+}
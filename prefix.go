@@ -0,0 +1,87 @@
+package ctile
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ExpandPrefix expands an S3 key prefix template for the log at logURL with
+// the given tile size. Variables are written in braces, e.g.
+// "{log_host}/{log_path}/". The supported variables are:
+//
+//   - log_host: the host name of the log URL, e.g. oak.ct.letsencrypt.org
+//   - log_path: the path of the log URL without surrounding slashes, e.g. 2023
+//   - tile_size: the tile size, e.g. 256
+//
+// A template containing variables is normalized to end in a slash, so the
+// prefix can't run into the tile_size= part of the keys. A template without
+// variables is returned as-is, so existing caches keep their keys.
+func ExpandPrefix(template, logURL string, tileSize int) (string, error) {
+	if !strings.ContainsAny(template, "{}") {
+		return template, nil
+	}
+
+	var u *url.URL
+	var b strings.Builder
+	rest := template
+	for rest != "" {
+		begin := strings.IndexByte(rest, '{')
+		end := strings.IndexByte(rest, '}')
+		if begin == -1 && end == -1 {
+			b.WriteString(rest)
+			break
+		}
+		if end != -1 && (begin == -1 || end < begin) {
+			return "", fmt.Errorf("S3 prefix template %q has an unmatched '}'", template)
+		}
+		if end == -1 {
+			return "", fmt.Errorf("S3 prefix template %q has an unmatched '{'", template)
+		}
+		b.WriteString(rest[:begin])
+		name := rest[begin+1 : end]
+		rest = rest[end+1:]
+
+		switch name {
+		case "log_host", "log_path":
+			if u == nil {
+				var err error
+				u, err = url.Parse(logURL)
+				if err != nil {
+					return "", fmt.Errorf("parsing log URL for S3 prefix template: %w", err)
+				}
+				if u.Hostname() == "" {
+					return "", errors.New("S3 prefix template uses the log URL, but it has no host")
+				}
+			}
+			if name == "log_host" {
+				b.WriteString(u.Hostname())
+			} else {
+				b.WriteString(strings.Trim(u.Path, "/"))
+			}
+		case "tile_size":
+			if tileSize <= 0 {
+				return "", errors.New("S3 prefix template uses tile_size, but the tile size is not set")
+			}
+			b.WriteString(strconv.Itoa(tileSize))
+		default:
+			return "", fmt.Errorf("S3 prefix template %q has unknown variable {%s}; supported variables are {log_host}, {log_path}, and {tile_size}",
+				template, name)
+		}
+	}
+
+	prefix := b.String()
+	for strings.Contains(prefix, "//") {
+		prefix = strings.ReplaceAll(prefix, "//", "/")
+	}
+	prefix = strings.TrimPrefix(prefix, "/")
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if prefix == "/" {
+		return "", fmt.Errorf("S3 prefix template %q expands to an empty prefix", template)
+	}
+	return prefix, nil
+}
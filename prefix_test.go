@@ -0,0 +1,44 @@
+package ctile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandPrefix(t *testing.T) {
+	testCases := []struct {
+		template string
+		expected string
+		errMsg   string
+	}{
+		{"oak2023", "oak2023", ""},
+		{"https://oak.ct.letsencrypt.org/2023", "https://oak.ct.letsencrypt.org/2023", ""},
+		{"{log_host}/{tile_size}/", "oak.ct.letsencrypt.org/256/", ""},
+		{"{log_host}/{log_path}", "oak.ct.letsencrypt.org/2023/", ""},
+		{"/cache//{log_path}/", "cache/2023/", ""},
+		{"{log_host", "", "unmatched '{'"},
+		{"log_host}", "", "unmatched '}'"},
+		{"{bogus}/", "", "unknown variable {bogus}"},
+	}
+	for _, tc := range testCases {
+		got, err := ExpandPrefix(tc.template, "https://oak.ct.letsencrypt.org:443/2023/", 256)
+		if tc.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Errorf("%q: expected error containing %q, got %v", tc.template, tc.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.template, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.template, tc.expected, got)
+		}
+	}
+
+	_, err := ExpandPrefix("{tile_size}/", "https://example.com", 0)
+	if err == nil {
+		t.Error("expected error expanding {tile_size} without a tile size, got none")
+	}
+}
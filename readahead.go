@@ -0,0 +1,168 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// readaheadWindow is how soon after a request for a tile a request for the
+// next one counts as a sequential scan, and how long a tile read ahead is
+// expected to be requested within.
+const readaheadWindow = 30 * time.Second
+
+// readaheadMaxTracked bounds the number of tiles tracked by a readahead.
+const readaheadMaxTracked = 4096
+
+// WithReadahead fetches up to depth tiles following the requested one in the
+// background, when the tile before the requested one was requested recently,
+// as monitors walking the log do. The tiles read ahead are cached as if
+// they'd been requested: fetched from the backend and written to S3 if
+// they're missing, and kept in the memory cache, if there is one, so the next
+// requests of the scan are served without waiting. Tiles are read ahead in
+// order, and it stops at the end of the log, or at the first failure. Nothing
+// is read ahead of partial tiles, past which there's nothing to read. Zero
+// disables it, and it's never used in ModeProxyOnly. It's experimental, so it
+// only reads ahead for requests for which FeatureReadahead is enabled by
+// WithFeatureFlags; other requests are still tracked, to detect scans.
+//
+// ctile_readahead_tiles counts the tiles read ahead, by result: "fetched",
+// "failed", and "used" if the tile was then requested within 30 seconds. The
+// ratio of used to fetched tiles is how effective it is. Partial tiles at the
+// end of the log aren't counted.
+func WithReadahead(depth int) Option {
+	return func(o *options) {
+		o.readaheadDepth = depth
+	}
+}
+
+// readahead tracks requested tiles to detect sequential scans. A nil
+// *readahead never reads ahead.
+type readahead struct {
+	depth int
+	tiles *prometheus.CounterVec
+
+	// mu protects the fields below.
+	mu        sync.Mutex
+	requested map[int64]time.Time // Tile numbers requested recently, and when.
+	fetched   map[int64]time.Time // Tile numbers read ahead and not yet requested, and when.
+}
+
+func newReadahead(depth int, promRegisterer prometheus.Registerer) *readahead {
+	if depth == 0 {
+		return nil
+	}
+	r := &readahead{
+		depth: depth,
+		tiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_readahead_tiles",
+			Help: "tiles read ahead of sequential scans, by result: fetched, failed, or used by a later request",
+		}, []string{"result"}),
+		requested: make(map[int64]time.Time),
+		fetched:   make(map[int64]time.Time),
+	}
+	promRegisterer.MustRegister(r.tiles)
+	return r
+}
+
+// observe records a request for t, and returns the tiles to read ahead of it,
+// in order, if it continues a sequential scan.
+func (r *readahead) observe(t tile) []tile {
+	if r == nil {
+		return nil
+	}
+	n := tileNumber(t)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fetched, ok := r.fetched[n]; ok {
+		if now.Sub(fetched) < readaheadWindow {
+			r.tiles.WithLabelValues("used").Inc()
+		}
+		delete(r.fetched, n)
+	}
+	r.requested[n] = now
+	r.prune(now)
+
+	previous, ok := r.requested[n-1]
+	if !ok || now.Sub(previous) >= readaheadWindow {
+		return nil
+	}
+	var next []tile
+	for m := n + 1; m <= n+int64(r.depth); m++ {
+		_, fetched := r.fetched[m]
+		_, requested := r.requested[m]
+		if fetched || requested {
+			continue
+		}
+		r.fetched[m] = now
+		next = append(next, makeTile(m*t.size, t.size, t.logURL))
+	}
+	return next
+}
+
+// prune drops tiles tracked for longer than readaheadWindow once there are
+// too many, and everything if that isn't enough. r.mu must be held.
+func (r *readahead) prune(now time.Time) {
+	for _, tracked := range []map[int64]time.Time{r.requested, r.fetched} {
+		if len(tracked) <= readaheadMaxTracked {
+			continue
+		}
+		for n, when := range tracked {
+			if now.Sub(when) >= readaheadWindow {
+				delete(tracked, n)
+			}
+		}
+		if len(tracked) > readaheadMaxTracked {
+			for n := range tracked {
+				delete(tracked, n)
+			}
+		}
+	}
+}
+
+// readAhead fetches the tiles that follow t in the background, if a request
+// for t, which was served complete, continues a sequential scan.
+func (tch *Handler) readAhead(t tile) {
+	next := tch.readahead.observe(t)
+	if len(next) == 0 {
+		return
+	}
+	if !tch.features.enabled(FeatureReadahead) {
+		tch.readahead.forget(next)
+		return
+	}
+	go func() {
+		for i, t := range next {
+			ctx, cancel := context.WithTimeout(context.Background(), tch.fullRequestTimeout)
+			contents, _, err := tch.getAndCacheTile(ctx, t)
+			cancel()
+			var marker pastTheEndMarker
+			var statusCodeErr statusCodeError
+			pastTheEnd := errors.As(err, &marker) || errors.As(err, &statusCodeErr) && statusCodeErr.statusCode == http.StatusBadRequest
+			if err != nil && !pastTheEnd {
+				tch.readahead.tiles.WithLabelValues("failed").Inc()
+			}
+			if err != nil || tch.isPartialTile(contents) {
+				// Failing, or at the end of the log: leave the rest.
+				tch.readahead.forget(next[i:])
+				return
+			}
+			tch.readahead.tiles.WithLabelValues("fetched").Inc()
+		}
+	}()
+}
+
+// forget stops tracking tiles that observe returned, but weren't read ahead
+// after all.
+func (r *readahead) forget(tiles []tile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range tiles {
+		delete(r.fetched, tileNumber(t))
+	}
+}
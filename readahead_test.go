@@ -0,0 +1,124 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestReadahead(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(20, 3))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithReadahead(2),
+		WithFeatureFlags(rolledOut(t, 100, FeatureReadahead)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource := func(url string, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expected, source)
+		}
+	}
+	tiles := func(result string) float64 {
+		return testutil.ToFloat64(handler.readahead.tiles.WithLabelValues(result))
+	}
+	waitForFetched := func(expected float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for tiles("fetched") < expected && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if fetched := tiles("fetched"); fetched != expected {
+			t.Fatalf("expected %g tiles read ahead, got %g", expected, fetched)
+		}
+	}
+
+	// A single request isn't a scan.
+	expectSource("/ct/v1/get-entries?start=0&end=2", "CT log")
+	// The next tile is, so the two tiles after it are read ahead.
+	expectSource("/ct/v1/get-entries?start=3&end=5", "CT log")
+	waitForFetched(2)
+	expectSource("/ct/v1/get-entries?start=6&end=8", "S3")
+	if used := tiles("used"); used != 1 {
+		t.Errorf("expected 1 tile read ahead to be used, got %g", used)
+	}
+	// Tile 9-11 is already read ahead, so only 12-14 is fetched.
+	waitForFetched(3)
+	expectSource("/ct/v1/get-entries?start=9&end=11", "S3")
+	expectSource("/ct/v1/get-entries?start=12&end=14", "S3")
+	if used := tiles("used"); used != 3 {
+		t.Errorf("expected 3 tiles read ahead to be used, got %g", used)
+	}
+
+	// Reading ahead stops at the partial tile at the end of the log, which
+	// isn't counted.
+	waitForFetched(4)
+	expectSource("/ct/v1/get-entries?start=15&end=17", "S3")
+	expectSource("/ct/v1/get-entries?start=18&end=20", "CT log")
+	if failed := tiles("failed"); failed != 0 {
+		t.Errorf("expected no failures, got %g", failed)
+	}
+
+	_, err = New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithReadahead(-1))
+	if err == nil {
+		t.Errorf("expected an error for a negative depth")
+	}
+}
+
+func TestReadaheadRollout(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(20, 3))
+	defer backend.Close()
+
+	flags := rolledOut(t, 0, FeatureReadahead)
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithReadahead(1),
+		WithFeatureFlags(flags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := func() float64 {
+		return testutil.ToFloat64(handler.readahead.tiles.WithLabelValues("fetched"))
+	}
+	get := func(url string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+	}
+
+	// Rolled out to no requests, a scan isn't read ahead of.
+	get("/ct/v1/get-entries?start=0&end=2")
+	get("/ct/v1/get-entries?start=3&end=5")
+	time.Sleep(50 * time.Millisecond)
+	if n := fetched(); n != 0 {
+		t.Fatalf("expected nothing read ahead with a rollout of 0, got %g tiles", n)
+	}
+
+	// Rolled out to every request, it is.
+	err = flags.Set(FeatureReadahead, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get("/ct/v1/get-entries?start=6&end=8")
+	deadline := time.Now().Add(5 * time.Second)
+	for fetched() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := fetched(); n != 1 {
+		t.Errorf("expected 1 tile read ahead with a rollout of 100, got %g", n)
+	}
+}
@@ -0,0 +1,72 @@
+package ctile
+
+import (
+	"context"
+	"time"
+)
+
+// PartialTileRetry configures a second attempt at fetching a partial tile.
+// A tile is partial when it holds the end of the log, and at the end of an
+// active log, its missing entries are often being sequenced at that moment.
+// Waiting for them turns the tile into one that can be cached, rather than
+// fetched from the backend again by every request until it's complete.
+type PartialTileRetry struct {
+	// Delay is how long to wait before fetching the tile again. Zero
+	// disables retries. The retry is only made if it can start before the
+	// request's deadline, and if it fails, the partial tile is served.
+	Delay time.Duration
+	// MaxMissing is the largest number of entries a tile may be missing to be
+	// retried, since a tile missing most of its entries won't be completed
+	// within Delay. Zero means any partial tile is retried.
+	MaxMissing int
+}
+
+// WithPartialTileRetry sets when to fetch a partial tile a second time, in the
+// hope it's complete by then.
+func WithPartialTileRetry(retry PartialTileRetry) Option {
+	return func(o *options) {
+		o.partialTileRetry = retry
+	}
+}
+
+// retryPartialTile fetches the partial tile t again, as configured by
+// PartialTileRetry, and returns whichever of contents and the second fetch
+// has more entries.
+func (tch *Handler) retryPartialTile(ctx context.Context, t tile, contents *Entries) *Entries {
+	retry := tch.partialTileRetry
+	if retry.Delay == 0 {
+		return contents
+	}
+	if retry.MaxMissing > 0 && tch.tileSize-len(contents.Entries) > retry.MaxMissing {
+		return contents
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= retry.Delay {
+		return contents
+	}
+
+	timer := time.NewTimer(retry.Delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return contents
+	}
+
+	retried, _, err := tch.fetchFromBackend(ctx, t)
+	result := "complete"
+	switch {
+	case err != nil:
+		result = "error"
+	case tch.isPartialTile(retried):
+		result = "partial"
+	}
+	tch.partialTileRetries.WithLabelValues(result).Inc()
+	debugFrom(ctx).step("partial_tile_retry", time.Time{}, result)
+	if err != nil {
+		return contents
+	}
+	if len(retried.Entries) < len(contents.Entries) {
+		return contents
+	}
+	return retried
+}
@@ -0,0 +1,73 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestPartialTileRetry(t *testing.T) {
+	// The log has 4 entries when first asked, and 6 from then on.
+	var requests atomic.Int64
+	before, after := fakelog.New(4, 3), fakelog.New(6, 3)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			before.ServeHTTP(w, r)
+			return
+		}
+		after.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		name           string
+		retry          PartialTileRetry
+		expectRequests int64
+		expectPartial  bool
+		result         string
+	}{
+		{"disabled", PartialTileRetry{}, 1, true, ""},
+		{"completed", PartialTileRetry{Delay: time.Millisecond}, 2, false, "complete"},
+		{"too many missing", PartialTileRetry{Delay: time.Millisecond, MaxMissing: 1}, 1, true, ""},
+		{"past the deadline", PartialTileRetry{Delay: time.Minute}, 1, true, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			requests.Store(0)
+			svc := s3mem.New()
+			handler, err := New(backend.URL,
+				WithTileSize(3),
+				WithS3(svc, "bucket", "test/"),
+				WithPartialTileRetry(tc.retry),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := getResp(handler, "/ct/v1/get-entries?start=3&end=5")
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+			if partial := resp.Header.Get("X-Partial-Tile") == "true"; partial != tc.expectPartial {
+				t.Errorf("expected partial=%t, got %t", tc.expectPartial, partial)
+			}
+			if requests.Load() != tc.expectRequests {
+				t.Errorf("expected %d requests to the backend, got %d", tc.expectRequests, requests.Load())
+			}
+			_, err = GetTileObject(context.Background(), svc, "bucket", "test/"+TileKey(3, 3))
+			if cached := err == nil; cached == tc.expectPartial {
+				t.Errorf("expected cached=%t, got %t", !tc.expectPartial, cached)
+			}
+			if tc.result != "" {
+				expectAndResetMetric(t, handler.partialTileRetries, 1, tc.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package ctile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// checkRFC9162Options returns an error if o enables a feature that isn't
+// available with a BackendRFC9162 backend. Entries from one are cached with
+// their log_entry as the Entry's LeafInput, and their submitted_entry and sct
+// as its ExtraData, encoded as below, so features that parse RFC 6962 entries
+// can't be used.
+func checkRFC9162Options(o options) error {
+	var unavailable []string
+	if o.strictValidation {
+		unavailable = append(unavailable, "strict validation")
+	}
+	if o.staticCTAPI.Origin != "" {
+		unavailable = append(unavailable, "the static CT API")
+	}
+	if o.chainStore.Prefix != "" {
+		unavailable = append(unavailable, "the chain store")
+	}
+	if o.precompressedJSON {
+		unavailable = append(unavailable, "precompressed JSON")
+	}
+	if o.cachedEntryAndProof {
+		unavailable = append(unavailable, "cached get-entry-and-proof")
+	}
+	if o.export {
+		unavailable = append(unavailable, "the export endpoint")
+	}
+	if o.tailPollInterval != 0 {
+		unavailable = append(unavailable, "the tail endpoint")
+	}
+	if len(unavailable) > 0 {
+		return fmt.Errorf("%s isn't available with an RFC 9162 backend", strings.Join(unavailable, ", "))
+	}
+	return nil
+}
+
+// v2Entries is the JSON response of RFC 9162's get-entries.
+// https://datatracker.ietf.org/doc/html/rfc9162#section-5.6
+type v2Entries struct {
+	Entries []v2Entry `json:"entries"`
+}
+
+type v2Entry struct {
+	LogEntry       []byte           `json:"log_entry"`
+	SubmittedEntry v2SubmittedEntry `json:"submitted_entry"`
+	SCT            []byte           `json:"sct"`
+}
+
+// v2SubmittedEntry is the input of the submit-entry request that added an
+// entry.
+type v2SubmittedEntry struct {
+	Submission []byte   `json:"submission"`
+	Type       uint8    `json:"type"`
+	Chain      [][]byte `json:"chain"`
+}
+
+// The ExtraData of an Entry cached from a BackendRFC9162 backend is, in the
+// TLS presentation language:
+//
+//	struct {
+//	    uint8 type;
+//	    opaque submission<0..2^24-1>;
+//	    opaque chain<0..2^24-1>;  /* of opaque certificate<0..2^24-1> */
+//	    opaque sct<0..2^24-1>;
+//	} v2EntryData;
+
+// appendVector appends b to out, prefixed with its 24-bit length.
+func appendVector(out, b []byte) []byte {
+	out = append(out, byte(len(b)>>16), byte(len(b)>>8), byte(len(b)))
+	return append(out, b...)
+}
+
+// readVector returns the contents of the vector with a 24-bit length at the
+// start of b, and the rest of b.
+func readVector(b []byte) (contents, rest []byte, ok bool) {
+	n, ok := vectorLen(b)
+	if !ok {
+		return nil, nil, false
+	}
+	return b[3:n], b[n:], true
+}
+
+// fromV2 returns the v2 entries as Entries.
+func fromV2(v2 v2Entries) (*Entries, error) {
+	entries := &Entries{Entries: make([]Entry, len(v2.Entries))}
+	for i, e := range v2.Entries {
+		var chain []byte
+		for _, cert := range e.SubmittedEntry.Chain {
+			chain = appendVector(chain, cert)
+		}
+		extraData := []byte{e.SubmittedEntry.Type}
+		extraData = appendVector(extraData, e.SubmittedEntry.Submission)
+		extraData = appendVector(extraData, chain)
+		extraData = appendVector(extraData, e.SCT)
+		for _, vector := range [][]byte{e.SubmittedEntry.Submission, chain, e.SCT} {
+			if len(vector) >= 1<<24 {
+				return nil, fmt.Errorf("entry %d is too large", i)
+			}
+		}
+		entries.Entries[i] = Entry{LeafInput: e.LogEntry, ExtraData: extraData}
+	}
+	return entries, nil
+}
+
+// toV2 returns e, made by fromV2, as v2 entries.
+func toV2(e *Entries) (v2Entries, error) {
+	v2 := v2Entries{Entries: make([]v2Entry, len(e.Entries))}
+	for i, entry := range e.Entries {
+		if len(entry.ExtraData) < 1 {
+			return v2Entries{}, fmt.Errorf("entry %d: malformed v2 entry data", i)
+		}
+		submission, rest, ok1 := readVector(entry.ExtraData[1:])
+		chain, rest, ok2 := readVector(rest)
+		sct, rest, ok3 := readVector(rest)
+		if !ok1 || !ok2 || !ok3 || len(rest) != 0 {
+			return v2Entries{}, fmt.Errorf("entry %d: malformed v2 entry data", i)
+		}
+		certs := [][]byte{}
+		for len(chain) > 0 {
+			var cert []byte
+			cert, chain, ok1 = readVector(chain)
+			if !ok1 {
+				return v2Entries{}, fmt.Errorf("entry %d: malformed chain in v2 entry data", i)
+			}
+			certs = append(certs, cert)
+		}
+		v2.Entries[i] = v2Entry{
+			LogEntry: entry.LeafInput,
+			SubmittedEntry: v2SubmittedEntry{
+				Submission: submission,
+				Type:       entry.ExtraData[0],
+				Chain:      certs,
+			},
+			SCT: sct,
+		}
+	}
+	return v2, nil
+}
+
+// getTileFromRFC9162 fetches tile t from the get-entries endpoint of the RFC
+// 9162 log at backendURL, with the same error handling as getTileFromBackend.
+func (tch *Handler) getTileFromRFC9162(ctx context.Context, backendURL string, t tile) (*Entries, error) {
+	err := injectFault(ctx, faultTargetBackend)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/ct/v2/get-entries?start=%d&end=%d", backendURL, t.start, t.end-1)
+	body, err := tch.getBody(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	var v2 v2Entries
+	err = json.Unmarshal(body, &v2)
+	if err != nil {
+		return nil, fmt.Errorf("parsing response from %s: %w", url, err)
+	}
+	if len(v2.Entries) > int(t.size) || len(v2.Entries) == 0 {
+		return nil, fmt.Errorf("expected %d entries, got %d", t.size, len(v2.Entries))
+	}
+	return fromV2(v2)
+}
+
+// getEntriesSuffix returns the path of the get-entries endpoint served by the
+// backend.
+func (tch *Handler) getEntriesSuffix() string {
+	if tch.backendType == BackendRFC9162 {
+		return "/ct/v2/get-entries"
+	}
+	return "/ct/v1/get-entries"
+}
+
+// errVerboseV2 is returned for verbose requests to an RFC 9162 log.
+var errVerboseV2 = errors.New("verbose responses aren't available for RFC 9162 logs")
@@ -0,0 +1,161 @@
+package ctile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// v2TestEntry returns the entry at index i of the fake RFC 9162 log.
+func v2TestEntry(i int64) v2Entry {
+	chain := [][]byte{[]byte("intermediate"), []byte("root")}
+	if i%2 == 1 {
+		chain = [][]byte{}
+	}
+	return v2Entry{
+		LogEntry: fakelog.LeafInput(i),
+		SubmittedEntry: v2SubmittedEntry{
+			Submission: fakelog.ExtraData(i),
+			Type:       uint8(1 + i%2),
+			Chain:      chain,
+		},
+		SCT: []byte(fmt.Sprintf("sct %d", i)),
+	}
+}
+
+// newRFC9162Log returns a server for RFC 9162's get-entries and get-sth, of
+// a log with size entries.
+func newRFC9162Log(size int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ct/v2/get-sth":
+			fmt.Fprint(w, `{"sth":""}`)
+		case "/ct/v2/get-entries":
+			start, err1 := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+			end, err2 := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+			if err1 != nil || err2 != nil || start < 0 || start >= size || end < start {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if end >= size {
+				end = size - 1
+			}
+			var entries v2Entries
+			for i := start; i <= end; i++ {
+				entries.Entries = append(entries.Entries, v2TestEntry(i))
+			}
+			json.NewEncoder(w).Encode(entries)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestRFC9162Backend(t *testing.T) {
+	backend := newRFC9162Log(250)
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(100), WithS3(s3mem.New(), "bucket", "test/"),
+		WithBackendType(BackendRFC9162))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	for _, test := range []struct {
+		start, end int64
+		expected   int64
+	}{
+		{0, 99, 100},
+		{110, 120, 11},
+		{200, 299, 50},
+	} {
+		url := fmt.Sprintf("/ct/v2/get-entries?start=%d&end=%d", test.start, test.end)
+		// The second read of a whole tile is of the one cached by the first.
+		for read := 0; read < 2; read++ {
+			w := get(url)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status 200, got %d: %s", url, w.Code, w.Body)
+			}
+			if source := w.Header().Get("X-Source"); read == 1 && test.start == 0 && source != "S3" {
+				t.Errorf("%s: expected X-Source S3, got %q", url, source)
+			}
+			var got v2Entries
+			err := json.Unmarshal(w.Body.Bytes(), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(got.Entries)) != test.expected {
+				t.Fatalf("%s: expected %d entries, got %d", url, test.expected, len(got.Entries))
+			}
+			for i, entry := range got.Entries {
+				index := test.start + int64(i)
+				if !reflect.DeepEqual(entry, v2TestEntry(index)) {
+					t.Fatalf("%s: entry %d doesn't match the log's", url, index)
+				}
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		// Past the end of the log.
+		{"/ct/v2/get-entries?start=250&end=260", http.StatusBadRequest},
+		{"/ct/v2/get-entries?start=0&end=10&verbose=true", http.StatusBadRequest},
+		// Passed through to the backend.
+		{"/ct/v2/get-sth", http.StatusOK},
+		{"/ct/v1/get-entries?start=0&end=10", http.StatusNotFound},
+	} {
+		w := get(test.url)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.url, test.status, w.Code, w.Body)
+		}
+	}
+
+	for name, option := range map[string]Option{
+		"strict validation":    WithStrictValidation(true),
+		"precompressed JSON":   WithPrecompressedJSON(true),
+		"chain store":          WithChainStore(ChainStore{Prefix: "chains/"}),
+		"cached entry & proof": WithCachedEntryAndProof(true),
+	} {
+		_, err = New(backend.URL, WithTileSize(100), WithS3(s3mem.New(), "bucket", "test/"),
+			WithBackendType(BackendRFC9162), option)
+		if err == nil {
+			t.Errorf("expected an error for %s with an RFC 9162 backend", name)
+		}
+	}
+}
+
+func TestV2EntryData(t *testing.T) {
+	v2 := v2Entries{Entries: []v2Entry{v2TestEntry(0), v2TestEntry(1)}}
+	entries, err := fromV2(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := toV2(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v2) {
+		t.Errorf("expected %v to round-trip, got %v", v2, got)
+	}
+
+	entries.Entries[0].ExtraData = entries.Entries[0].ExtraData[:10]
+	_, err = toV2(entries)
+	if err == nil {
+		t.Errorf("expected an error for truncated entry data")
+	}
+}
@@ -0,0 +1,157 @@
+package ctile
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+// WithRootsCache keeps the backend's get-roots response in memory for ttl
+// after it's fetched, and serves requests for it from there. Once it's
+// expired, the next request revalidates it with the backend, conditionally if
+// the backend sent an ETag or Last-Modified header, so an unchanged root list
+// isn't downloaded again. If the backend can't be reached, the expired
+// response is served, since root lists change rarely. Only successful
+// responses are cached. Zero disables it.
+//
+// ctile_roots_cache_requests counts requests by result.
+func WithRootsCache(ttl time.Duration) Option {
+	return func(o *options) {
+		o.rootsCacheTTL = ttl
+	}
+}
+
+// rootsCache holds the latest get-roots response from the backend. A nil
+// *rootsCache holds nothing.
+type rootsCache struct {
+	ttl      time.Duration
+	requests *prometheus.CounterVec
+
+	// group collapses revalidations.
+	group singleflight.Group
+
+	// mu protects the fields below.
+	mu      sync.Mutex
+	path    string               // The path the response was fetched from.
+	resp    *passthroughResponse // Nil if there's none.
+	expires time.Time
+}
+
+func newRootsCache(ttl time.Duration, promRegisterer prometheus.Registerer) *rootsCache {
+	if ttl == 0 {
+		return nil
+	}
+	c := &rootsCache{
+		ttl: ttl,
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ctile_roots_cache_requests",
+				Help: "get-roots requests, by whether they were served from memory (hit), after the backend confirmed it unchanged (not_modified) or sent a new one (modified), fetched (miss), or served expired because the backend failed (error)",
+			},
+			[]string{"result"}),
+	}
+	promRegisterer.MustRegister(c.requests)
+	return c
+}
+
+// isRootsPath returns whether path is for the get-roots endpoint.
+func isRootsPath(path string) bool {
+	return strings.HasSuffix(path, "/ct/v1/get-roots")
+}
+
+// get returns the response fetched from path, if it's held, and whether it's
+// expired.
+func (c *rootsCache) get(path string) (resp *passthroughResponse, expired bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resp == nil || c.path != path {
+		return nil, false
+	}
+	return c.resp, time.Now().After(c.expires)
+}
+
+// revalidate fetches the response for path with p, conditionally if cached,
+// the expired response, has validators. It returns the response to serve and
+// the result to count it under.
+func (c *rootsCache) revalidate(ctx context.Context, p passthroughHandler, path string, cached *passthroughResponse) (*passthroughResponse, string, error) {
+	header := make(http.Header)
+	if cached != nil {
+		if etag := cached.header.Get("ETag"); etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.header.Get("Last-Modified"); lastModified != "" {
+			header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	err := p.breaker.allow()
+	var resp *passthroughResponse
+	if err == nil {
+		resp, err = p.fetchBody(ctx, path, header)
+	}
+	if err != nil {
+		if cached == nil {
+			return nil, "miss", err
+		}
+		log.Printf("warning: revalidating get-roots, so serving the expired response: %s\n", err)
+		return cached, "error", nil
+	}
+
+	result := "miss"
+	switch {
+	case cached != nil && resp.statusCode == http.StatusNotModified:
+		resp, result = cached, "not_modified"
+	case resp.statusCode != http.StatusOK:
+		return resp, result, nil
+	case cached != nil:
+		result = "modified"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.path, c.resp, c.expires = path, resp, time.Now().Add(c.ttl)
+	return resp, result, nil
+}
+
+// serve responds to the get-roots request r from the cache, revalidating it
+// with p if it's missing or expired.
+func (c *rootsCache) serve(w http.ResponseWriter, r *http.Request, p passthroughHandler) {
+	if r.Method != "GET" {
+		p.ServeHTTP(w, r)
+		return
+	}
+	begin := time.Now()
+	resp, expired := c.get(r.URL.Path)
+	result := "hit"
+	var err error
+	if resp == nil || expired {
+		type revalidateResult struct {
+			resp   *passthroughResponse
+			result string
+		}
+		var out revalidateResult
+		out, err, _ = singleflightDo(&c.group, r.URL.Path, func() (revalidateResult, error) {
+			resp, result, err := c.revalidate(r.Context(), p, r.URL.Path, resp)
+			return revalidateResult{resp, result}, err
+		})
+		resp, result = out.resp, out.result
+	} else {
+		begin = time.Time{}
+	}
+	debugFrom(r.Context()).step("roots_cache", begin, result)
+	c.requests.WithLabelValues(result).Inc()
+	if writePassthroughError(w, err) {
+		return
+	}
+
+	copyHeader(w.Header(), resp.header)
+	w.WriteHeader(resp.statusCode)
+	_, err = w.Write(resp.body)
+	if err != nil {
+		log.Printf("error copying response body to client: %s\n", err)
+	}
+}
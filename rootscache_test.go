@@ -0,0 +1,92 @@
+package ctile
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestRootsCache(t *testing.T) {
+	// A log whose root list has a version, used as its ETag, and which may
+	// be down.
+	var version, down, requests atomic.Int64
+	version.Store(1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		etag := fmt.Sprintf(`"%d"`, version.Load())
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, `{"certificates":["root%d"]}`, version.Load())
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"),
+		WithRootsCache(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRoots := func(expected string, expectedRequests int64) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-roots")
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.StatusCode, body)
+		}
+		if string(body) != fmt.Sprintf(`{"certificates":[%q]}`, expected) {
+			t.Errorf("expected roots %s, got %s", expected, body)
+		}
+		if requests.Load() != expectedRequests {
+			t.Errorf("expected %d backend requests, got %d", expectedRequests, requests.Load())
+		}
+	}
+	result := func(result string) float64 {
+		return testutil.ToFloat64(handler.rootsCache.requests.WithLabelValues(result))
+	}
+
+	expectRoots("root1", 1)
+	expectRoots("root1", 1)
+
+	// An unchanged root list is revalidated, not downloaded again.
+	time.Sleep(60 * time.Millisecond)
+	expectRoots("root1", 2)
+	if result("not_modified") != 1 {
+		t.Errorf("expected 1 revalidation, got %g", result("not_modified"))
+	}
+
+	// A changed one replaces the cached one.
+	version.Store(2)
+	time.Sleep(60 * time.Millisecond)
+	expectRoots("root2", 3)
+	if result("modified") != 1 {
+		t.Errorf("expected 1 new root list, got %g", result("modified"))
+	}
+
+	// An expired root list is served while the backend is down.
+	down.Store(1)
+	time.Sleep(60 * time.Millisecond)
+	expectRoots("root2", 4)
+	if result("miss") != 1 || result("hit") != 1 || result("error") != 1 {
+		t.Errorf("expected 1 miss, hit and error, got %g, %g and %g", result("miss"), result("hit"), result("error"))
+	}
+
+	_, err = New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithRootsCache(-time.Second))
+	if err == nil {
+		t.Errorf("expected an error for a negative TTL")
+	}
+}
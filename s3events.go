@@ -0,0 +1,144 @@
+package ctile
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// S3Events tells the Handlers sharing it about objects written to or deleted
+// from S3 by others, such as other instances or `ctile purge`, so they learn
+// of them without reading S3. It's meant to be fed S3 event notifications,
+// e.g. from an SQS queue. Use NewS3Events to make one, and WithS3Events to
+// share it. It is safe for concurrent use.
+//
+// The tiles in an object written are added to the index of WithTileIndex, so
+// they're read from S3 rather than fetched from the backend again. The tiles
+// in an object deleted are removed from the index and from the memory cache
+// of WithMemoryCache, so they're no longer served from memory. Each Handler
+// counts them in ctile_s3_event_tiles.
+type S3Events struct {
+	// mu protects handlers.
+	mu       sync.RWMutex
+	handlers map[*Handler]bool
+}
+
+// NewS3Events returns an S3Events to share between Handlers.
+func NewS3Events() *S3Events {
+	return &S3Events{handlers: make(map[*Handler]bool)}
+}
+
+// WithS3Events makes the Handler follow the changes to objects in S3 reported
+// to events, which may be shared with other Handlers. It's ignored in
+// ModeProxyOnly.
+func WithS3Events(events *S3Events) Option {
+	return func(o *options) {
+		o.s3Events = events
+	}
+}
+
+// Created reports that the object at key in bucket was written.
+func (e *S3Events) Created(bucket, key string) {
+	e.notify(bucket, key, false)
+}
+
+// Removed reports that the object at key in bucket was deleted.
+func (e *S3Events) Removed(bucket, key string) {
+	e.notify(bucket, key, true)
+}
+
+// notify passes a change to the object at key in bucket to each Handler.
+func (e *S3Events) notify(bucket, key string, removed bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for tch := range e.handlers {
+		tch.objectChanged(bucket, key, removed)
+	}
+}
+
+// register starts passing changes to tch.
+func (e *S3Events) register(tch *Handler) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers[tch] = true
+}
+
+// unregister stops passing changes to tch.
+func (e *S3Events) unregister(tch *Handler) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.handlers, tch)
+}
+
+// newS3EventTiles returns the metric counting the tiles reported by S3Events.
+func newS3EventTiles(promRegisterer prometheus.Registerer) *prometheus.CounterVec {
+	tiles := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ctile_s3_event_tiles",
+		Help: "tiles reported written or deleted by others through S3 event notifications, by type: created or removed",
+	}, []string{"type"})
+	promRegisterer.MustRegister(tiles)
+	return tiles
+}
+
+// objectChanged updates what the Handler knows of the tiles in the object at
+// key in bucket, which was written or, if removed is true, deleted.
+func (tch *Handler) objectChanged(bucket, key string, removed bool) {
+	for _, t := range tch.tilesInObject(bucket, key) {
+		if removed {
+			tch.tileIndex.remove(t)
+			tch.memoryCache.delete(tch.cacheKey(t))
+			tch.s3EventTiles.WithLabelValues("removed").Inc()
+		} else {
+			tch.tileIndex.add(t)
+			tch.s3EventTiles.WithLabelValues("created").Inc()
+		}
+	}
+}
+
+// s3Location is a bucket and prefix tiles are cached under.
+type s3Location struct{ bucket, prefix string }
+
+// s3Locations returns the distinct buckets and prefixes the Handler caches
+// tiles under: its own, and each Shard's.
+func (tch *Handler) s3Locations() []s3Location {
+	locations := []s3Location{{tch.s3Bucket, tch.s3Prefix}}
+	seen := map[s3Location]bool{locations[0]: true}
+	for _, s := range tch.shards {
+		bucket := s.Bucket
+		if bucket == "" {
+			bucket = tch.s3Bucket
+		}
+		loc := s3Location{bucket, s.Prefix}
+		if !seen[loc] {
+			seen[loc] = true
+			locations = append(locations, loc)
+		}
+	}
+	return locations
+}
+
+// tilesInObject returns the tiles the Handler reads from the object at key in
+// bucket: those tilesForKey finds in it after the prefix of one of the
+// Handler's locations, if that's where they're cached. It returns nil for any
+// other object.
+func (tch *Handler) tilesInObject(bucket, key string) []tile {
+	var tiles []tile
+	for _, loc := range tch.s3Locations() {
+		if bucket != loc.bucket || !strings.HasPrefix(key, loc.prefix) {
+			continue
+		}
+		for _, t := range tch.tilesForKey(key[len(loc.prefix):]) {
+			if b, prefix := tch.location(t); b == loc.bucket && prefix == loc.prefix {
+				tiles = append(tiles, t)
+			}
+		}
+	}
+	return tiles
+}
@@ -0,0 +1,108 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestS3Events(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	svc := s3mem.New()
+	events := NewS3Events()
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithShards([]Shard{{Start: 6, Bucket: "other", Prefix: "sharded/"}}),
+		WithMemoryCache(1<<20),
+		WithTileIndex(true),
+		WithTileIndexPriming(true),
+		WithS3Events(events),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handler.tileIndex.primed
+
+	expectTiles := func(kind string, expected float64) {
+		t.Helper()
+		if count := testutil.ToFloat64(handler.s3EventTiles.WithLabelValues(kind)); count != expected {
+			t.Errorf("expected %g %s tiles, got %g", expected, kind, count)
+		}
+	}
+
+	// Tiles written by others are reported, wherever they're cached.
+	events.Created("bucket", "test/"+TileKey(3, 3))
+	events.Created("other", "sharded/"+TileKey(3, 6))
+	expectTiles("created", 2)
+	for _, start := range []int64{3, 6} {
+		if !handler.tileIndex.mayBeCached(makeTile(start, 3, handler.logURL)) {
+			t.Errorf("expected tile %d to be in the index", start)
+		}
+	}
+
+	// Objects that aren't the Handler's tiles are ignored.
+	for _, obj := range []struct{ bucket, key string }{
+		{"other", "test/" + TileKey(3, 0)},
+		{"bucket", "sharded/" + TileKey(3, 0)},
+		{"bucket", "test/" + TileKey(3, 6)},
+		{"bucket", "test/" + TileKey(4, 0)},
+		{"bucket", "test/" + TileKey(3, 0) + ".partial"},
+	} {
+		events.Created(obj.bucket, obj.key)
+	}
+	expectTiles("created", 2)
+
+	// A tile deleted, e.g. by ctile purge, is no longer served from memory.
+	expectSource := func(url string, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expected, source)
+		}
+	}
+	expectSource("/ct/v1/get-entries?start=3&end=5", "CT log")
+	expectSource("/ct/v1/get-entries?start=3&end=5", "memory")
+	_, err = svc.DeleteObjects(context.Background(), &s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("test/" + TileKey(3, 3))}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.Removed("bucket", "test/"+TileKey(3, 3))
+	expectTiles("removed", 1)
+	if handler.tileIndex.mayBeCached(makeTile(3, 3, handler.logURL)) {
+		t.Errorf("expected a removed tile to be dropped from the index")
+	}
+	expectSource("/ct/v1/get-entries?start=3&end=5", "CT log")
+
+	// Handlers in ModeProxyOnly don't follow events.
+	proxy, err := New(backend.URL, WithTileSize(3), WithMode(ModeProxyOnly), WithS3Events(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.s3Events != nil || len(events.handlers) != 1 {
+		t.Errorf("expected a proxy-only Handler not to follow events")
+	}
+
+	handler.Close()
+	if len(events.handlers) != 0 {
+		t.Errorf("expected a closed Handler to stop following events")
+	}
+}
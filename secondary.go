@@ -0,0 +1,84 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SecondaryS3 configures a second bucket, typically in another region, that a
+// Handler reads tiles from when reading them from the primary bucket fails,
+// other than because they're missing, or while S3 is degraded (see
+// S3Degradation). It lets the Handler ride out an outage of the primary's
+// region without fetching every tile from the backend. Tiles have the same
+// keys in both buckets.
+type SecondaryS3 struct {
+	// Service is the client for the secondary bucket, e.g. configured for its
+	// region. Nil disables the secondary.
+	Service S3API
+	// Bucket is the secondary bucket. It's used for all shards.
+	Bucket string
+	// DualWrite writes each tile to the secondary bucket as well as the
+	// primary. Otherwise, the secondary is expected to be filled by other
+	// means, such as S3 replication. A failed write to the secondary is
+	// logged, but doesn't fail the request.
+	DualWrite bool
+}
+
+// WithSecondaryS3 sets a bucket to fall back to when the primary fails.
+func WithSecondaryS3(s SecondaryS3) Option {
+	return func(o *options) {
+		o.secondaryS3 = s
+	}
+}
+
+// getFromSecondary reads a tile from the secondary bucket. It returns
+// noSuchKey if there's no secondary bucket, or the tile isn't in it.
+func (tch *Handler) getFromSecondary(ctx context.Context, t tile) (*Entries, error) {
+	if tch.secondaryS3.Service == nil {
+		return nil, noSuchKey{}
+	}
+	err := injectFault(ctx, faultTargetS3)
+	if err != nil {
+		return nil, err
+	}
+	_, prefix := tch.location(t)
+	begin := time.Now()
+	var entries *Entries
+	err = noSuchKey{}
+	if tch.superTiles > 1 {
+		entries, err = tch.getFromSuperTile(ctx, tch.secondaryS3.Service, tch.secondaryS3.Bucket, prefix, t)
+	}
+	if errors.Is(err, noSuchKey{}) {
+		entries, err = tch.getTileObject(ctx, tch.secondaryS3.Service, tch.secondaryS3.Bucket, prefix, t, tch.tileKey(t))
+	}
+	tch.backendLatencyMetric.WithLabelValues("secondary_s3_get").Observe(time.Since(begin).Seconds())
+	debugFrom(ctx).step("secondary_s3_get", begin, debugResult(entries, err))
+	if err != nil {
+		if !errors.Is(err, noSuchKey{}) {
+			tch.requestsMetric.WithLabelValues("error", "secondary_s3_get").Inc()
+		}
+		return nil, err
+	}
+	if len(entries.Entries) != int(t.size) {
+		return nil, fmt.Errorf("internal inconsistency: len(entries) == %d; tile = %v", len(entries.Entries), t)
+	}
+	return entries, nil
+}
+
+// putToSecondary writes a tile to the secondary bucket, if DualWrite is set.
+// Failures are logged and counted, but not returned.
+func (tch *Handler) putToSecondary(ctx context.Context, t tile, key string, body []byte, metadata map[string]string) {
+	if tch.secondaryS3.Service == nil || !tch.secondaryS3.DualWrite {
+		return
+	}
+	begin := time.Now()
+	err := tch.putTile(ctx, tch.secondaryS3.Service, tch.secondaryS3.Bucket, key, t, body, metadata)
+	tch.backendLatencyMetric.WithLabelValues("secondary_s3_put").Observe(time.Since(begin).Seconds())
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "secondary_s3_put").Inc()
+		log.Printf("warning: writing tile %d-%d to the secondary bucket: %s\n", t.start, t.end-1, err)
+	}
+}
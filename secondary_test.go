@@ -0,0 +1,76 @@
+package ctile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestSecondaryS3(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(20, 3))
+	defer backend.Close()
+	ctx := context.Background()
+
+	expectSource := func(handler *Handler, url string, expectedStatus int, expectedSource string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("%s: expected status %d, got %d", url, expectedStatus, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); expectedSource != "" && source != expectedSource {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expectedSource, source)
+		}
+	}
+
+	// Dual writes put tiles in both buckets.
+	primary := &flakyS3{Client: s3mem.New()}
+	secondary := s3mem.New()
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(primary, "bucket", "test/"),
+		WithSecondaryS3(SecondaryS3{Service: secondary, Bucket: "backup", DualWrite: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", http.StatusOK, "CT log")
+	_, err = GetTileObject(ctx, primary, "bucket", "test/"+TileKey(3, 0))
+	if err != nil {
+		t.Errorf("expected the tile in the primary bucket, got %v", err)
+	}
+	_, err = GetTileObject(ctx, secondary, "backup", "test/"+TileKey(3, 0))
+	if err != nil {
+		t.Errorf("expected the tile in the secondary bucket, got %v", err)
+	}
+
+	// When the primary fails, tiles are read from the secondary.
+	primary.failing.Store(true)
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", http.StatusOK, "secondary S3")
+	expectAndResetMetric(t, handler.requestsMetric, 1, "success", "secondary_s3_get")
+
+	// Tiles missing from the secondary fail as they would without it.
+	expectSource(handler, "/ct/v1/get-entries?start=3&end=5", http.StatusInternalServerError, "")
+
+	// While S3 is degraded, tiles are still read from the secondary.
+	handler, err = New(backend.URL,
+		WithTileSize(3),
+		WithS3(primary, "bucket", "test/"),
+		WithSecondaryS3(SecondaryS3{Service: secondary, Bucket: "backup"}),
+		WithS3Degradation(S3Degradation{Failures: 1, ProbeInterval: time.Hour}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	expectSource(handler, "/ct/v1/get-entries?start=6&end=8", http.StatusOK, "CT log")
+	if !handler.s3Health.degraded() {
+		t.Fatal("expected S3 to be degraded")
+	}
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", http.StatusOK, "secondary S3")
+}
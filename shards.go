@@ -0,0 +1,61 @@
+package ctile
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Shard caches the tiles of a range of the log in a different bucket or under
+// a different prefix, to keep any one of them under S3's limits on object
+// count and request rate. A Shard applies to the tiles starting at or after
+// Start, up to the Start of the next one. Tiles before the first Shard are
+// cached where WithS3 says.
+type Shard struct {
+	// Start is the index of the first entry in the shard. It must be a
+	// positive multiple of the tile size.
+	Start int64
+	// Bucket defaults to the bucket passed to WithS3.
+	Bucket string
+	// Prefix must not be empty.
+	Prefix string
+}
+
+// WithShards splits the cache by ranges of the log. The shards must be in
+// increasing order of Start.
+func WithShards(shards []Shard) Option {
+	return func(o *options) {
+		o.shards = shards
+	}
+}
+
+// validateShards returns every problem with shards for the given tile size.
+func validateShards(shards []Shard, tileSize int) error {
+	var errs []error
+	for i, s := range shards {
+		if s.Start <= 0 || s.Start%int64(tileSize) != 0 {
+			errs = append(errs, fmt.Errorf("shard %d: start %d must be a positive multiple of the tile size %d", i, s.Start, tileSize))
+		}
+		if i > 0 && s.Start <= shards[i-1].Start {
+			errs = append(errs, fmt.Errorf("shard %d: start %d must be greater than the previous shard's %d", i, s.Start, shards[i-1].Start))
+		}
+		if s.Prefix == "" {
+			errs = append(errs, fmt.Errorf("shard %d: prefix must not be empty", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// location returns the bucket and key prefix that t is cached under.
+func (tch *Handler) location(t tile) (bucket, prefix string) {
+	bucket, prefix = tch.s3Bucket, tch.s3Prefix
+	for _, s := range tch.shards {
+		if t.start < s.Start {
+			break
+		}
+		bucket, prefix = s.Bucket, s.Prefix
+		if bucket == "" {
+			bucket = tch.s3Bucket
+		}
+	}
+	return bucket, prefix
+}
@@ -0,0 +1,66 @@
+package ctile
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestShards(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(20, 3))
+	defer backend.Close()
+
+	svc := s3mem.New()
+	shards := []Shard{
+		{Start: 6, Prefix: "second/"},
+		{Start: 12, Bucket: "other", Prefix: "third/"},
+	}
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "first/"),
+		WithShards(shards),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		start  int64
+		bucket string
+		key    string
+	}{
+		{0, "bucket", "first/" + TileKey(3, 0)},
+		{3, "bucket", "first/" + TileKey(3, 3)},
+		{6, "bucket", "second/" + TileKey(3, 6)},
+		{9, "bucket", "second/" + TileKey(3, 9)},
+		{12, "other", "third/" + TileKey(3, 12)},
+		{15, "other", "third/" + TileKey(3, 15)},
+	}
+	for _, tc := range testCases {
+		_, _, err := getAndParseResp(t, handler, fmt.Sprintf("/ct/v1/get-entries?start=%d&end=%d", tc.start, tc.start+2))
+		if err != nil {
+			t.Fatalf("tile %d: %s", tc.start, err)
+		}
+		_, err = GetTileObject(context.Background(), svc, tc.bucket, tc.key)
+		if err != nil {
+			t.Errorf("tile %d: expected it cached in %s/%s, got %s", tc.start, tc.bucket, tc.key, err)
+		}
+	}
+
+	invalid := [][]Shard{
+		{{Start: 0, Prefix: "a/"}},
+		{{Start: 4, Prefix: "a/"}},
+		{{Start: 6, Prefix: "a/"}, {Start: 6, Prefix: "b/"}},
+		{{Start: 6}},
+	}
+	for _, shards := range invalid {
+		_, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "first/"), WithShards(shards))
+		if err == nil {
+			t.Errorf("expected error for shards %+v", shards)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SharedCache is a low-latency cache of tiles shared by a fleet of instances,
+// such as Redis, consulted after the Handler's memory and disk caches and
+// before S3. It holds tiles encoded with EncodeTile, under their S3 bucket and
+// key joined with a slash. It's a cache, so it may drop tiles at any time, and
+// its errors are logged rather than failing requests.
+type SharedCache interface {
+	// Get returns the value stored for key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value for key.
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// WithSharedCache sets a cache tier between the local caches and S3. Tiles
+// found in S3 or fetched from the backend are added to it, so other instances
+// sharing it don't each read them from S3.
+func WithSharedCache(cache SharedCache) Option {
+	return func(o *options) {
+		o.sharedCache = cache
+	}
+}
+
+// getFromSharedCache returns the tile at key from the shared cache, or nil if
+// it's missing, or the shared cache is disabled or failed.
+func (tch *Handler) getFromSharedCache(ctx context.Context, t tile, key string) *Entries {
+	if tch.sharedCache == nil {
+		return nil
+	}
+	begin := time.Now()
+	value, err := tch.sharedCache.Get(ctx, key)
+	tch.backendLatencyMetric.WithLabelValues("shared_cache_get").Observe(time.Since(begin).Seconds())
+	if err == nil && value == nil {
+		debugFrom(ctx).step("shared_cache_get", begin, "miss")
+		return nil
+	}
+	var contents *Entries
+	if err == nil {
+		contents, err = DecodeTile(bytes.NewReader(value))
+	}
+	if err == nil && len(contents.Entries) != int(t.size) {
+		err = fmt.Errorf("got %d entries, want %d", len(contents.Entries), t.size)
+	}
+	if err != nil {
+		debugFrom(ctx).step("shared_cache_get", begin, err.Error())
+		tch.requestsMetric.WithLabelValues("error", "shared_cache_get").Inc()
+		log.Printf("warning: reading tile %d-%d from the shared cache: %s\n", t.start, t.end-1, err)
+		return nil
+	}
+	debugFrom(ctx).step("shared_cache_get", begin, "hit")
+	return contents
+}
+
+// addToSharedCache stores the tile at key in the shared cache, if there is
+// one.
+func (tch *Handler) addToSharedCache(ctx context.Context, t tile, key string, contents *Entries) {
+	if tch.sharedCache == nil || tch.dryRun {
+		return
+	}
+	begin := time.Now()
+	value, err := EncodeTile(contents)
+	if err == nil {
+		err = tch.sharedCache.Set(ctx, key, value)
+	}
+	tch.backendLatencyMetric.WithLabelValues("shared_cache_put").Observe(time.Since(begin).Seconds())
+	debugFrom(ctx).step("shared_cache_put", begin, debugResult(nil, err))
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "shared_cache_put").Inc()
+		log.Printf("warning: adding tile %d-%d to the shared cache: %s\n", t.start, t.end-1, err)
+	}
+}
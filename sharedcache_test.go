@@ -0,0 +1,90 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// mapCache is a SharedCache in a map, which fails while err is set.
+type mapCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	err    error
+}
+
+func (c *mapCache) Get(_ context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key], c.err
+}
+
+func (c *mapCache) Set(_ context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.values[key] = value
+	return nil
+}
+
+func TestSharedCache(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	cache := &mapCache{values: make(map[string][]byte)}
+	newHandler := func() *Handler {
+		handler, err := New(backend.URL,
+			WithTileSize(3),
+			WithS3(s3mem.New(), "bucket", "test/"),
+			WithSharedCache(cache),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	expectSource := func(handler *Handler, url, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("expected X-Source %q, got %q", expected, source)
+		}
+	}
+
+	first := newHandler()
+	expectSource(first, "/ct/v1/get-entries?start=0&end=2", "CT log")
+	if _, ok := cache.values["bucket/test/"+TileKey(3, 0)]; !ok {
+		t.Fatalf("expected the tile in the shared cache, got keys %v", cache.values)
+	}
+
+	// Another instance, with its own S3, finds the tile in the shared cache.
+	second := newHandler()
+	expectSource(second, "/ct/v1/get-entries?start=0&end=2", "shared cache")
+	expectAndResetMetric(t, second.requestsMetric, 1, "success", "shared_cache_get")
+
+	// A failing shared cache doesn't fail requests.
+	cache.err = errors.New("connection refused")
+	third := newHandler()
+	expectSource(third, "/ct/v1/get-entries?start=0&end=2", "CT log")
+	expectAndResetMetric(t, third.requestsMetric, 1, "error", "shared_cache_get")
+	expectSource(third, "/ct/v1/get-entries?start=3&end=5", "CT log")
+	expectAndResetMetric(t, third.requestsMetric, 1, "error", "shared_cache_put")
+	cache.err = nil
+
+	// Partial tiles aren't added.
+	expectSource(first, "/ct/v1/get-entries?start=9&end=9", "CT log")
+	if _, ok := cache.values["bucket/test/"+TileKey(3, 9)]; ok {
+		t.Errorf("expected the partial tile not to be in the shared cache")
+	}
+}
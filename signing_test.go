@@ -0,0 +1,105 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestRequestSigning(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	signing := RequestSigning{Keys: [][]byte{[]byte("new"), []byte("old")}, MaxSkew: time.Minute}
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithRequestSigning(signing),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const url = "/ct/v1/get-entries?start=0&end=2"
+	testCases := []struct {
+		name     string
+		sign     func(r *http.Request)
+		expected int
+	}{
+		{"unsigned", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"new key", func(r *http.Request) { SignRequest(r, []byte("new"), time.Now()) }, http.StatusOK},
+		{"old key", func(r *http.Request) { SignRequest(r, []byte("old"), time.Now()) }, http.StatusOK},
+		{"wrong key", func(r *http.Request) { SignRequest(r, []byte("bogus"), time.Now()) }, http.StatusUnauthorized},
+		{"expired", func(r *http.Request) { SignRequest(r, []byte("new"), time.Now().Add(-2*time.Minute)) }, http.StatusUnauthorized},
+		{"future", func(r *http.Request) { SignRequest(r, []byte("new"), time.Now().Add(2*time.Minute)) }, http.StatusUnauthorized},
+		{"different query", func(r *http.Request) {
+			SignRequest(r, []byte("new"), time.Now())
+			r.RequestURI = "/ct/v1/get-entries?start=3&end=5"
+		}, http.StatusUnauthorized},
+		{"bad timestamp", func(r *http.Request) {
+			SignRequest(r, []byte("new"), time.Now())
+			r.Header.Set(SignatureTimestampHeader, strconv.FormatInt(time.Now().Unix()+1, 10))
+		}, http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", url, nil)
+		tc.sign(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.expected {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.expected, w.Code, w.Body)
+		}
+	}
+	expectAndResetMetric(t, handler.requestsMetric, 6, "unauthorized", "signature")
+
+	// Requests to peers are signed with the first key.
+	peerHandler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "peer/"),
+		WithRequestSigning(RequestSigning{Keys: [][]byte{[]byte("old"), []byte("new")}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewServer(http.StripPrefix("/2023", peerHandler))
+	defer peer.Close()
+	handler, err = New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithReadThroughPeer(peer.URL, "/2023"),
+		WithRequestSigning(signing),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", url, nil)
+	SignRequest(req, []byte("new"), time.Now())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Result().Header.Get("X-Source") != "peer" {
+		t.Errorf("expected the tile from the peer, got status %d from %q", w.Code, w.Result().Header.Get("X-Source"))
+	}
+
+	// Rotated keys take effect without a new Handler.
+	err = peerHandler.SetRequestSigningKeys([][]byte{[]byte("newer")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]int{"newer": http.StatusOK, "new": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", url, nil)
+		SignRequest(req, []byte(key), time.Now())
+		w := httptest.NewRecorder()
+		peerHandler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("expected status %d for a request signed with the %s key after rotation, got %d", expected, key, w.Code)
+		}
+	}
+	if peerHandler.SetRequestSigningKeys([][]byte{{}}) == nil {
+		t.Error("expected an error for an empty key")
+	}
+}
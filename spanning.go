@@ -0,0 +1,73 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// WithMaxRequestTiles serves get-entries requests whose range continues past
+// the end of their tile with the entries of up to maxTiles tiles, instead of
+// those of the first tile only. The following tiles are fetched concurrently,
+// each as for a request of its own, and the response is cut short at the
+// first that's partial or fails, so it's always a prefix of the requested
+// range, as the CT API allows. A verbose response still describes the first
+// tile. Zero and 1 serve the first tile only.
+func WithMaxRequestTiles(maxTiles int) Option {
+	return func(o *options) {
+		o.maxRequestTiles = maxTiles
+	}
+}
+
+// spans returns whether a get-entries response that starts in t and ends at
+// end, exclusive, is served from more than one tile.
+func (tch *Handler) spans(t tile, end int64) bool {
+	return tch.maxRequestTiles > 1 && end > t.end
+}
+
+// appendFollowingTiles returns contents, the complete tile first, followed by
+// the entries of the tiles after it, up to the one that holds end - 1 or the
+// last one a request may span, and the range of tiles they make up. Tiles
+// after one that's partial or fails aren't used.
+func (tch *Handler) appendFollowingTiles(ctx context.Context, first tile, contents *Entries, end int64) (*Entries, tile) {
+	n := int((end - first.start + first.size - 1) / first.size)
+	if n > tch.maxRequestTiles {
+		n = tch.maxRequestTiles
+	}
+	following := make([]*Entries, n-1)
+	errs := make([]error, n-1)
+	var wg sync.WaitGroup
+	for i := range following {
+		i := i
+		t := makeTile(first.start+int64(i+1)*first.size, first.size, first.logURL)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			following[i], _, errs[i] = tch.getTileFrom(ctx, t, t.start)
+		}()
+	}
+	wg.Wait()
+
+	spanned := first
+	entries := &Entries{Entries: append([]Entry{}, contents.Entries...)}
+	for i, e := range following {
+		var marker pastTheEndMarker
+		var statusCodeErr statusCodeError
+		pastTheEnd := errors.As(errs[i], &marker) || errors.As(errs[i], &statusCodeErr) && statusCodeErr.statusCode == http.StatusBadRequest
+		if errs[i] != nil && !pastTheEnd {
+			log.Printf("warning: serving tiles %d-%d only, since the next failed: %s\n", first.start, spanned.end-1, errs[i])
+		}
+		if errs[i] != nil {
+			break
+		}
+		entries.Entries = append(entries.Entries, e.Entries...)
+		spanned.end += first.size
+		spanned.size += first.size
+		if tch.isPartialTile(e) {
+			break
+		}
+	}
+	return entries, spanned
+}
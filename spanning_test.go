@@ -0,0 +1,74 @@
+package ctile
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestMaxRequestTiles(t *testing.T) {
+	log := fakelog.New(550, 1000)
+	// The backend fails for the tile at 300.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("start") == "300" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(100), WithS3(s3mem.New(), "bucket", "test/"), WithMaxRequestTiles(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := New(backend.URL, WithTileSize(100), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		handler    *Handler
+		start, end int64
+		expected   int64
+		partial    bool
+	}{
+		{handler, 0, 199, 200, false},
+		// Up to three tiles.
+		{handler, 50, 449, 250, false},
+		{handler, 0, 99, 100, false},
+		// Into the partial tile at the end of the log.
+		{handler, 450, 600, 100, true},
+		// Cut short at the tile that fails.
+		{handler, 200, 399, 100, false},
+		{single, 50, 449, 50, false},
+	} {
+		url := fmt.Sprintf("/ct/v1/get-entries?start=%d&end=%d", test.start, test.end)
+		entries, headers, err := getAndParseResp(t, test.handler, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(entries.Entries)) != test.expected {
+			t.Fatalf("%s: expected %d entries, got %d", url, test.expected, len(entries.Entries))
+		}
+		for i, entry := range entries.Entries {
+			index := test.start + int64(i)
+			if !bytes.Equal(entry.LeafInput, fakelog.LeafInput(index)) || !bytes.Equal(entry.ExtraData, fakelog.ExtraData(index)) {
+				t.Fatalf("%s: entry %d doesn't match the log's", url, index)
+			}
+		}
+		if partial := headers.Get("X-Partial-Tile") == "true"; partial != test.partial {
+			t.Errorf("%s: expected X-Partial-Tile %t, got %t", url, test.partial, partial)
+		}
+	}
+
+	_, err = New(backend.URL, WithTileSize(100), WithS3(s3mem.New(), "bucket", "test/"), WithMaxRequestTiles(-1))
+	if err == nil {
+		t.Errorf("expected an error for a negative max")
+	}
+}
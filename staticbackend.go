@@ -0,0 +1,279 @@
+package ctile
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BackendType is the API served by the backend.
+type BackendType string
+
+const (
+	// BackendRFC6962 is a log serving the RFC 6962 API, like Trillian's CTFE.
+	BackendRFC6962 BackendType = "rfc6962"
+	// BackendStaticCT is a tile-based log serving the static CT API,
+	// c2sp.org/static-ct-api, like Sunlight. Its URL is the log's monitoring
+	// prefix.
+	BackendStaticCT BackendType = "static-ct"
+	// BackendRFC9162 is a log serving version 2 of the CT API, RFC 9162.
+	BackendRFC9162 BackendType = "rfc9162"
+)
+
+// ParseBackendType returns the BackendType with the given name, or an error.
+func ParseBackendType(s string) (BackendType, error) {
+	switch backendType := BackendType(s); backendType {
+	case BackendRFC6962, BackendStaticCT, BackendRFC9162:
+		return backendType, nil
+	default:
+		return "", fmt.Errorf("unknown backend type %q", s)
+	}
+}
+
+// staticMaxCachedIssuers bounds the number of issuers kept in memory by a
+// Handler with a BackendStaticCT backend.
+const staticMaxCachedIssuers = 1000
+
+// WithBackendType sets the API served by the backend. Defaults to
+// BackendRFC6962.
+//
+// With BackendStaticCT, tiles are made from the log's data tiles, with the
+// certificate chains of their entries put back together from its issuers, and
+// served and cached like tiles from any other backend, so clients of the RFC
+// 6962 API can keep reading a log that's moved to the static CT API. Only
+// get-entries is translated: other endpoints are passed through to the log,
+// which doesn't serve them, and WithStrictValidation isn't available. The
+// data tile at the end of the log is found with its checkpoint, which is also
+// what WithFailover's probes request.
+//
+// With BackendRFC9162, get-entries is served at /ct/v2/get-entries, with
+// responses in the RFC 9162 format, from tiles fetched from the log's own
+// v2 get-entries. Other endpoints are passed through.
+func WithBackendType(t BackendType) Option {
+	return func(o *options) {
+		o.backendType = t
+	}
+}
+
+// issuerCache holds issuers fetched from a BackendStaticCT backend, by
+// fingerprint. Issuers never change, and a log has few of them.
+type issuerCache struct {
+	mu      sync.Mutex
+	issuers map[[sha256.Size]byte][]byte
+}
+
+func (c *issuerCache) get(fingerprint [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	issuer, ok := c.issuers[fingerprint]
+	return issuer, ok
+}
+
+func (c *issuerCache) add(fingerprint [sha256.Size]byte, issuer []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.issuers == nil || len(c.issuers) >= staticMaxCachedIssuers {
+		c.issuers = make(map[[sha256.Size]byte][]byte)
+	}
+	c.issuers[fingerprint] = issuer
+}
+
+// getTileFromStaticCT fetches tile t from the data tiles of the log with the
+// static CT API at backendURL. Like CTFE, it returns a statusCodeError with
+// status 400 if t starts past the end of the log, and a partial tile if t
+// ends past it.
+func (tch *Handler) getTileFromStaticCT(ctx context.Context, backendURL string, t tile) (*Entries, error) {
+	err := injectFault(ctx, faultTargetBackend)
+	if err != nil {
+		return nil, err
+	}
+	entries := &Entries{}
+	for next := t.start; next < t.end; {
+		n := next / staticTileWidth
+		width := int64(staticTileWidth)
+		body, err := tch.getBody(ctx, backendURL+"/"+staticTilePath(-1, n, staticTileWidth))
+		var statusCodeErr statusCodeError
+		if errors.As(err, &statusCodeErr) && statusCodeErr.statusCode == http.StatusNotFound {
+			// The last data tile of the log is partial.
+			var treeSize int64
+			treeSize, err = tch.getStaticTreeSize(ctx, backendURL)
+			if err != nil {
+				return nil, err
+			}
+			if next >= treeSize {
+				if len(entries.Entries) > 0 {
+					break
+				}
+				return nil, statusCodeError{http.StatusBadRequest, []byte(fmt.Sprintf("entry %d is past the end of the log, of %d entries", next, treeSize))}
+			}
+			width = treeSize - n*staticTileWidth
+			if width >= staticTileWidth {
+				// The tile should be whole, so the 404 stands.
+				return nil, statusCodeErr
+			}
+			body, err = tch.getBody(ctx, backendURL+"/"+staticTilePath(-1, n, int(width)))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		first := n * staticTileWidth
+		for i := first; i < first+width; i++ {
+			var entry Entry
+			var fingerprints [][sha256.Size]byte
+			entry, fingerprints, body, err = parseTileLeaf(body)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d of data tile %d: %w", i, n, err)
+			}
+			if i < next || i >= t.end {
+				continue
+			}
+			entry.ExtraData, err = tch.appendChain(ctx, backendURL, entry.ExtraData, fingerprints)
+			if err != nil {
+				return nil, err
+			}
+			entries.Entries = append(entries.Entries, entry)
+		}
+		if len(body) != 0 {
+			return nil, fmt.Errorf("data tile %d has more than %d entries", n, width)
+		}
+		next = first + width
+		if width < staticTileWidth {
+			// The data tile was partial, so this is the end of the log.
+			break
+		}
+	}
+	return entries, nil
+}
+
+// parseTileLeaf parses the TileLeaf at the start of b, and returns its entry,
+// with the part of its extra_data before the chain, the fingerprints of its
+// chain, and the rest of b.
+func parseTileLeaf(b []byte) (e Entry, fingerprints [][sha256.Size]byte, rest []byte, err error) {
+	// The TimestampedEntry: timestamp, entry_type, then a certificate, or an
+	// issuer_key_hash and a TBSCertificate, then extensions.
+	const headerLen = 8 + 2
+	if len(b) < headerLen || b[8] != 0 || b[9] > 1 {
+		return Entry{}, nil, nil, errors.New("malformed TimestampedEntry")
+	}
+	precert := b[9] == 1
+	n := headerLen
+	if precert {
+		n += sha256.Size
+	}
+	if len(b) < n {
+		return Entry{}, nil, nil, errors.New("malformed TimestampedEntry")
+	}
+	certLen, ok := vectorLen(b[n:])
+	if !ok {
+		return Entry{}, nil, nil, errors.New("malformed certificate")
+	}
+	n += certLen
+	if len(b) < n+2 {
+		return Entry{}, nil, nil, errors.New("malformed extensions")
+	}
+	n += 2 + int(binary.BigEndian.Uint16(b[n:]))
+	if len(b) < n {
+		return Entry{}, nil, nil, errors.New("malformed extensions")
+	}
+	e.LeafInput = append([]byte{0, 0}, b[:n]...)
+	b = b[n:]
+
+	// A precert_entry's pre_certificate, which starts its extra_data.
+	if precert {
+		n, ok := vectorLen(b)
+		if !ok {
+			return Entry{}, nil, nil, errors.New("malformed pre_certificate")
+		}
+		e.ExtraData = append([]byte{}, b[:n]...)
+		b = b[n:]
+	}
+
+	if len(b) < 2 {
+		return Entry{}, nil, nil, errors.New("malformed certificate_chain")
+	}
+	n = int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < n || n%sha256.Size != 0 {
+		return Entry{}, nil, nil, errors.New("malformed certificate_chain")
+	}
+	for i := 0; i < n; i += sha256.Size {
+		fingerprints = append(fingerprints, [sha256.Size]byte(b[i:i+sha256.Size]))
+	}
+	return e, fingerprints, b[n:], nil
+}
+
+// appendChain appends the certificate chain with the given fingerprints to
+// extraData, fetching the issuers it doesn't have from the log at backendURL.
+func (tch *Handler) appendChain(ctx context.Context, backendURL string, extraData []byte, fingerprints [][sha256.Size]byte) ([]byte, error) {
+	var chain []byte
+	for _, fingerprint := range fingerprints {
+		issuer, ok := tch.issuers.get(fingerprint)
+		if !ok {
+			var err error
+			issuer, err = tch.getBody(ctx, backendURL+"/issuer/"+hex.EncodeToString(fingerprint[:]))
+			if err != nil {
+				return nil, err
+			}
+			if sha256.Sum256(issuer) != fingerprint {
+				return nil, fmt.Errorf("issuer %x doesn't match its fingerprint", fingerprint)
+			}
+			tch.issuers.add(fingerprint, issuer)
+		}
+		chain = append(chain, byte(len(issuer)>>16), byte(len(issuer)>>8), byte(len(issuer)))
+		chain = append(chain, issuer...)
+	}
+	extraData = append(extraData, byte(len(chain)>>16), byte(len(chain)>>8), byte(len(chain)))
+	return append(extraData, chain...), nil
+}
+
+// getStaticTreeSize returns the tree size of the log at backendURL, from its
+// checkpoint.
+func (tch *Handler) getStaticTreeSize(ctx context.Context, backendURL string) (int64, error) {
+	checkpoint, err := tch.getBody(ctx, backendURL+"/checkpoint")
+	if err != nil {
+		return 0, err
+	}
+	// The origin, then the tree size.
+	lines := bufio.NewScanner(strings.NewReader(string(checkpoint)))
+	lines.Scan()
+	lines.Scan()
+	treeSize, err := strconv.ParseInt(lines.Text(), 10, 64)
+	if err != nil || treeSize < 0 {
+		return 0, fmt.Errorf("malformed checkpoint from %s", backendURL)
+	}
+	return treeSize, nil
+}
+
+// getBody fetches url from the backend, for backends other than
+// BackendRFC6962. Like getTile, it returns a statusCodeError for responses
+// other than 200.
+func (tch *Handler) getBody(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create backend Request object: %w", err)
+	}
+	resp, err := tch.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	limitBody(resp, tch.maxBackendBodySize)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, readBodyError(url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusCodeError{resp.StatusCode, body}
+	}
+	return body, nil
+}
@@ -0,0 +1,168 @@
+package ctile
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// newStaticCTLog returns a server for the static CT API, made by a Handler
+// from the RFC 6962 log at backendURL.
+func newStaticCTLog(t *testing.T, backendURL string) *httptest.Server {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := New(backendURL, WithTileSize(256), WithS3(s3mem.New(), "bucket", "static/"),
+		WithStaticCTAPI(StaticCTAPI{Origin: "example.com/log", PublicKey: publicKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(handler)
+}
+
+func TestStaticCTBackend(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(550, 1000))
+	defer backend.Close()
+	static := newStaticCTLog(t, backend.URL)
+	defer static.Close()
+
+	handler, err := New(static.URL, WithTileSize(100), WithS3(s3mem.New(), "bucket", "test/"),
+		WithBackendType(BackendStaticCT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		start, end int64
+		expected   int64
+		cached     bool
+	}{
+		{0, 99, 100, true},
+		// Across two data tiles.
+		{200, 299, 100, true},
+		// In the partial data tile at the end of the log, which isn't cached.
+		{500, 599, 50, false},
+		{520, 530, 11, false},
+	} {
+		url := fmt.Sprintf("/ct/v1/get-entries?start=%d&end=%d", test.start, test.end)
+		// The second read of a whole tile is of the one cached by the first.
+		for read := 0; read < 2; read++ {
+			entries, headers, err := getAndParseResp(t, handler, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source := headers.Get("X-Source"); read == 1 && test.cached && source != "S3" {
+				t.Errorf("%s: expected X-Source S3, got %q", url, source)
+			}
+			if int64(len(entries.Entries)) != test.expected {
+				t.Fatalf("%s: expected %d entries, got %d", url, test.expected, len(entries.Entries))
+			}
+			for i, entry := range entries.Entries {
+				index := test.start + int64(i)
+				if !bytes.Equal(entry.LeafInput, fakelog.LeafInput(index)) || !bytes.Equal(entry.ExtraData, fakelog.ExtraData(index)) {
+					t.Fatalf("%s: entry %d doesn't match the log's", url, index)
+				}
+			}
+		}
+	}
+
+	// Past the end of the log, the backend responds like CTFE.
+	resp := getResp(handler, "/ct/v1/get-entries?start=550&end=560")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 past the end of the log, got %d", resp.StatusCode)
+	}
+
+	_, err = New(static.URL, WithBackendType("ctfe"))
+	if err == nil {
+		t.Errorf("expected an error for an unknown backend type")
+	}
+	_, err = New(static.URL, WithBackendType(BackendStaticCT), WithStrictValidation(true))
+	if err == nil {
+		t.Errorf("expected an error for strict validation of a static CT backend")
+	}
+}
+
+func TestStaticCTBackendChains(t *testing.T) {
+	issuers := [][]byte{[]byte("intermediate"), []byte("root")}
+	var chain []byte
+	for _, issuer := range issuers {
+		chain = append(chain, 0, 0, byte(len(issuer)))
+		chain = append(chain, issuer...)
+	}
+	x509Chain := append([]byte{0, 0, byte(len(chain))}, chain...)
+	precert := []byte{0, 0, 7, 'p', 'r', 'e', 'c', 'e', 'r', 't'}
+	// A precert_entry's leaf_input, with an issuer_key_hash, a TBSCertificate
+	// and no extensions.
+	precertLeaf := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1}, make([]byte, 32)...)
+	precertLeaf = append(precertLeaf, 0, 0, 3, 't', 'b', 's', 0, 0)
+	entry := func(i int64) Entry {
+		if i%2 == 1 {
+			return Entry{LeafInput: precertLeaf, ExtraData: append(append([]byte{}, precert...), x509Chain...)}
+		}
+		return Entry{LeafInput: fakelog.LeafInput(i), ExtraData: x509Chain}
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries Entries
+		for i := int64(0); i < 256; i++ {
+			entries.Entries = append(entries.Entries, entry(i))
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	defer backend.Close()
+	static := newStaticCTLog(t, backend.URL)
+	defer static.Close()
+
+	handler, err := New(static.URL, WithTileSize(256), WithS3(s3mem.New(), "bucket", "test/"),
+		WithBackendType(BackendStaticCT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := getAndParseResp(t, handler, "/ct/v1/get-entries?start=0&end=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries.Entries))
+	}
+	for i, got := range entries.Entries {
+		expected := entry(int64(i))
+		if !bytes.Equal(got.LeafInput, expected.LeafInput) || !bytes.Equal(got.ExtraData, expected.ExtraData) {
+			t.Errorf("entry %d: expected %x and %x, got %x and %x", i, expected.LeafInput, expected.ExtraData, got.LeafInput, got.ExtraData)
+		}
+	}
+}
+
+func TestParseTileLeaf(t *testing.T) {
+	for _, leaf := range [][]byte{
+		nil,
+		// An unknown entry_type.
+		{0, 0, 0, 0, 0, 0, 0, 0, 0, 2},
+		// A certificate longer than the leaf.
+		{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 9},
+		// No certificate_chain.
+		{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		// A certificate_chain that isn't of fingerprints.
+		{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0},
+	} {
+		_, _, _, err := parseTileLeaf(leaf)
+		if err == nil {
+			t.Errorf("%x: expected an error", leaf)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package ctile
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StaticCTAPI configures serving the read endpoints of the static CT API,
+// c2sp.org/static-ct-api, generated from the RFC 6962 backend.
+type StaticCTAPI struct {
+	// Origin is the log's origin, the first line of its checkpoints and the
+	// name of the key that signs them, e.g. "oak.ct.letsencrypt.org/2023".
+	// Empty disables the static CT API.
+	Origin string
+	// PublicKey is the log's public key, as a DER SubjectPublicKeyInfo, like
+	// the "key" of a log list. Checkpoint signatures are identified by it.
+	PublicKey []byte
+}
+
+// staticTileWidth is the number of entries in a data tile, and hashes in a
+// hash tile, of the static CT API.
+const staticTileWidth = 256
+
+// staticMaxLevel is the highest level of hash tiles served. A hash at that
+// level covers 2^40 entries.
+const staticMaxLevel = 5
+
+// staticMaxIssuers bounds the number of issuers remembered as stored.
+const staticMaxIssuers = 10000
+
+// WithStaticCTAPI also serves the static CT API's checkpoint, data tiles, hash
+// tiles, and issuers, under any path ending in /checkpoint, /tile/..., or
+// /issuer/..., so monitors that speak it can read a log with an RFC 6962
+// backend, e.g. Trillian's CTFE.
+//
+// Checkpoints are made from the backend's STH on each request, with its
+// signature as an RFC6962NoteSignature. Data tiles are assembled from the
+// tiles cached as usual, and hash tiles are computed from them, the tiles of
+// each level from those of the level below. Whole tiles are stored in S3 in
+// the Sunlight layout, under the S3 prefix, e.g. tile/data/x001/234 and
+// tile/0/x001/234, and so are the issuers in the entries' chains, when the
+// data tiles that include them are made. The first request for a hash tile
+// above level 0 reads many tiles of the level below, so it may take several
+// requests to make, each picking up from the tiles stored by the previous
+// ones.
+//
+// RFC 6962 logs don't put the leaf_index extension in their entries, so
+// entries are served without it, as in the Merkle tree. It isn't available in
+// ModeProxyOnly, and checkpoints aren't available in ModeCacheOnly.
+func WithStaticCTAPI(s StaticCTAPI) Option {
+	return func(o *options) {
+		o.staticCTAPI = s
+	}
+}
+
+// staticCT holds the state of the static CT API. A nil *staticCT disables
+// it.
+type staticCT struct {
+	origin string
+	keyID  [4]byte
+
+	// mu protects issuers.
+	mu      sync.Mutex
+	issuers map[[sha256.Size]byte]bool // Issuers known to be stored.
+}
+
+func newStaticCT(s StaticCTAPI) (*staticCT, error) {
+	if s.Origin == "" {
+		return nil, nil
+	}
+	_, err := x509.ParsePKIXPublicKey(s.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the public key of the static CT API: %w", err)
+	}
+	// The key ID of an RFC6962NoteSignature, signature type 0x05.
+	h := sha256.New()
+	h.Write([]byte(s.Origin + "\n\x05"))
+	h.Write(s.PublicKey)
+	c := &staticCT{origin: s.Origin, issuers: make(map[[sha256.Size]byte]bool)}
+	copy(c.keyID[:], h.Sum(nil))
+	return c, nil
+}
+
+// staticCTRequest is a request for one of the static CT API's resources.
+type staticCTRequest struct {
+	checkpoint bool
+	issuer     string // The hex SHA-256 of the issuer requested, if any.
+	level      int    // The level of the hash tile requested, or -1 for a data tile.
+	n          int64  // The index of the tile in its level.
+	width      int    // The number of entries or hashes, staticTileWidth unless partial.
+}
+
+var staticCTPathPattern = regexp.MustCompile(`/(?:(checkpoint)|issuer/([0-9a-f]{64})|tile/(data|[0-9]+)/((?:x[0-9]{3}/)*[0-9]{3})(?:\.p/([0-9]+))?)$`)
+
+// parseStaticCTPath parses the static CT API request at the end of path, if
+// there's one.
+func parseStaticCTPath(path string) (staticCTRequest, bool) {
+	m := staticCTPathPattern.FindStringSubmatch(path)
+	switch {
+	case m == nil:
+		return staticCTRequest{}, false
+	case m[1] != "":
+		return staticCTRequest{checkpoint: true}, true
+	case m[2] != "":
+		return staticCTRequest{issuer: m[2]}, true
+	}
+
+	req := staticCTRequest{level: -1, width: staticTileWidth}
+	if m[3] != "data" {
+		level, err := strconv.Atoi(m[3])
+		if err != nil || level > staticMaxLevel || strconv.Itoa(level) != m[3] {
+			return staticCTRequest{}, false
+		}
+		req.level = level
+	}
+	// All but the last group of digits have an x, and there are no leading
+	// groups of zeros.
+	groups := strings.Split(m[4], "/")
+	if len(groups) > 1 && groups[0] == "x000" {
+		return staticCTRequest{}, false
+	}
+	for _, group := range groups {
+		if req.n > (math.MaxInt64-999)/1000 {
+			return staticCTRequest{}, false
+		}
+		digits, _ := strconv.ParseInt(strings.TrimPrefix(group, "x"), 10, 64)
+		req.n = req.n*1000 + digits
+	}
+	// Each tile must begin within the range of int64 entries.
+	covered := int64(staticTileWidth)
+	for i := 0; i < req.level; i++ {
+		covered *= staticTileWidth
+	}
+	if req.n > math.MaxInt64/covered {
+		return staticCTRequest{}, false
+	}
+	if m[5] != "" {
+		width, err := strconv.Atoi(m[5])
+		if err != nil || width < 1 || width >= staticTileWidth || strconv.Itoa(width) != m[5] {
+			return staticCTRequest{}, false
+		}
+		req.width = width
+	}
+	return req, true
+}
+
+// staticTilePath returns the path of a tile in the static CT API, and its key
+// in S3 after the prefix. level is -1 for data tiles.
+func staticTilePath(level int, n int64, width int) string {
+	path := fmt.Sprintf("%03d", n%1000)
+	for n >= 1000 {
+		n /= 1000
+		path = fmt.Sprintf("x%03d/", n%1000) + path
+	}
+	name := "data"
+	if level >= 0 {
+		name = strconv.Itoa(level)
+	}
+	path = "tile/" + name + "/" + path
+	if width < staticTileWidth {
+		path += ".p/" + strconv.Itoa(width)
+	}
+	return path
+}
+
+// serveStaticCT answers r, a request for a resource of the static CT API.
+func (tch *Handler) serveStaticCT(w http.ResponseWriter, r *http.Request, req staticCTRequest) {
+	ctx, cancel := context.WithTimeout(r.Context(), tch.fullRequestTimeout)
+	defer cancel()
+
+	var body []byte
+	var err error
+	contentType := "application/octet-stream"
+	var kind string
+	switch {
+	case req.checkpoint:
+		if tch.mode == ModeCacheOnly {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "checkpoints aren't available: the backend is disabled in cache-only mode")
+			return
+		}
+		kind = "static_checkpoint"
+		contentType = "text/plain; charset=utf-8"
+		body, err = tch.staticCheckpoint(ctx)
+	case req.issuer != "":
+		kind = "static_issuer"
+		contentType = "application/pkix-cert"
+		body, err = tch.getStaticObject(ctx, "issuer/"+req.issuer)
+	case req.level < 0:
+		kind = "static_data_tile"
+		body, err = tch.staticDataTile(ctx, req.n, req.width)
+	default:
+		kind = "static_hash_tile"
+		body, err = tch.staticHashTile(ctx, req.level, req.n, req.width)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		result := "error"
+		if errors.Is(err, noSuchKey{}) {
+			status = http.StatusNotFound
+			result = "not_found"
+		} else if errors.Is(err, errBackendLimited) || errors.Is(err, errCircuitOpen) {
+			status = http.StatusServiceUnavailable
+		} else {
+			log.Printf("error: %s\n", err)
+		}
+		tch.requestsMetric.WithLabelValues(result, kind).Inc()
+		w.WriteHeader(status)
+		fmt.Fprintln(w, err)
+		return
+	}
+	tch.requestsMetric.WithLabelValues("success", kind).Inc()
+
+	// Everything but checkpoints and partial tiles is immutable.
+	if !req.checkpoint && req.width == staticTileWidth || req.issuer != "" {
+		w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// staticCheckpoint returns a checkpoint made from the backend's STH.
+func (tch *Handler) staticCheckpoint(ctx context.Context) ([]byte, error) {
+	var sth struct {
+		TreeSize  int64  `json:"tree_size"`
+		Timestamp uint64 `json:"timestamp"`
+		RootHash  []byte `json:"sha256_root_hash"`
+		Signature []byte `json:"tree_head_signature"`
+	}
+	err := tch.getJSON(ctx, tch.backends.candidates()[0].url+"/ct/v1/get-sth", &sth)
+	if err != nil {
+		return nil, err
+	}
+	if len(sth.RootHash) != sha256.Size {
+		return nil, fmt.Errorf("STH has a root hash of %d bytes", len(sth.RootHash))
+	}
+	// An RFC6962NoteSignature is the STH's timestamp, then its
+	// TreeHeadSignature, after the key ID.
+	signature := append([]byte{}, tch.staticCT.keyID[:]...)
+	signature = binary.BigEndian.AppendUint64(signature, sth.Timestamp)
+	signature = append(signature, sth.Signature...)
+	checkpoint := fmt.Sprintf("%s\n%d\n%s\n\n— %s %s\n", tch.staticCT.origin, sth.TreeSize,
+		base64.StdEncoding.EncodeToString(sth.RootHash), tch.staticCT.origin, base64.StdEncoding.EncodeToString(signature))
+	return []byte(checkpoint), nil
+}
+
+// staticDataTile returns the first width entries of data tile n, encoded as
+// TileLeafs, and stores the issuers in their chains.
+func (tch *Handler) staticDataTile(ctx context.Context, n int64, width int) ([]byte, error) {
+	key := staticTilePath(-1, n, width)
+	if width == staticTileWidth {
+		body, err := tch.getStaticObject(ctx, key)
+		if !errors.Is(err, noSuchKey{}) {
+			return body, err
+		}
+	}
+	start := n * staticTileWidth
+	entries, err := tch.staticEntries(ctx, start, start+int64(width))
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	for i, e := range entries {
+		leaf, issuers, err := staticTileLeaf(e)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", start+int64(i), err)
+		}
+		err = tch.putIssuers(ctx, issuers)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, leaf...)
+	}
+	if width == staticTileWidth {
+		tch.storeStaticTile(ctx, key, body)
+	}
+	return body, nil
+}
+
+// staticHashTile returns the first width hashes of hash tile n at level.
+func (tch *Handler) staticHashTile(ctx context.Context, level int, n int64, width int) ([]byte, error) {
+	key := staticTilePath(level, n, width)
+	if width == staticTileWidth {
+		body, err := tch.getStaticObject(ctx, key)
+		if !errors.Is(err, noSuchKey{}) {
+			return body, err
+		}
+	}
+	var hashes []byte
+	if level == 0 {
+		start := n * staticTileWidth
+		entries, err := tch.staticEntries(ctx, start, start+int64(width))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			leafHash := sha256.Sum256(append([]byte{0}, e.LeafInput...))
+			hashes = append(hashes, leafHash[:]...)
+		}
+	} else {
+		// Each hash is the root of the whole tile below it.
+		for i := 0; i < width; i++ {
+			below, err := tch.staticHashTile(ctx, level-1, n*staticTileWidth+int64(i), staticTileWidth)
+			if err != nil {
+				return nil, err
+			}
+			hashes = append(hashes, subtreeRoot(below)...)
+		}
+	}
+	if width == staticTileWidth {
+		tch.storeStaticTile(ctx, key, hashes)
+	}
+	return hashes, nil
+}
+
+// subtreeRoot returns the Merkle Tree Hash of the perfect subtree with the
+// given hashes at its bottom, concatenated.
+func subtreeRoot(hashes []byte) []byte {
+	for len(hashes) > sha256.Size {
+		next := make([]byte, 0, len(hashes)/2)
+		for i := 0; i < len(hashes); i += 2 * sha256.Size {
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(hashes[i : i+2*sha256.Size])
+			next = h.Sum(next)
+		}
+		hashes = next
+	}
+	return hashes
+}
+
+// staticEntries returns the entries of the log from start to end, exclusive,
+// from the tiles they're in. The error matches noSuchKey if the log doesn't
+// have all of them yet.
+func (tch *Handler) staticEntries(ctx context.Context, start, end int64) ([]Entry, error) {
+	entries := make([]Entry, 0, end-start)
+	for next := start; next < end; {
+		t := makeTile(next, int64(tch.tileSize), tch.logURL)
+		contents, _, err := tch.getTileFrom(ctx, t, next)
+		var marker pastTheEndMarker
+		var statusCodeErr statusCodeError
+		if errors.As(err, &marker) || errors.As(err, &statusCodeErr) && statusCodeErr.statusCode == http.StatusBadRequest {
+			return nil, fmt.Errorf("entry %d isn't in the log yet: %w", next, noSuchKey{})
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset := next - t.start
+		available := int64(len(contents.Entries)) - offset
+		if available <= 0 {
+			return nil, fmt.Errorf("entry %d isn't in the log yet: %w", next, noSuchKey{})
+		}
+		if available > end-next {
+			available = end - next
+		}
+		entries = append(entries, contents.Entries[offset:offset+available]...)
+		next += available
+	}
+	return entries, nil
+}
+
+// staticTileLeaf returns e as a TileLeaf of the static CT API: its
+// TimestampedEntry, its precertificate, if it's a precert_entry, and the
+// fingerprints of its chain, which it also returns.
+func staticTileLeaf(e Entry) (leaf []byte, issuers [][]byte, err error) {
+	if len(e.LeafInput) < 2 || e.LeafInput[0] != 0 || e.LeafInput[1] != 0 {
+		return nil, nil, errors.New("leaf_input isn't a MerkleTreeLeaf")
+	}
+	own, chain, ok := splitChain(e.LeafInput, e.ExtraData)
+	if !ok {
+		return nil, nil, errors.New("can't parse extra_data")
+	}
+	for rest := chain[3:]; len(rest) > 0; {
+		n, ok := vectorLen(rest)
+		if !ok {
+			return nil, nil, errors.New("can't parse the chain in extra_data")
+		}
+		issuers = append(issuers, rest[3:n])
+		rest = rest[n:]
+	}
+	if len(issuers)*sha256.Size > math.MaxUint16 {
+		return nil, nil, fmt.Errorf("chain of %d certificates is too long", len(issuers))
+	}
+	leaf = append(leaf, e.LeafInput[2:]...)
+	leaf = append(leaf, own...)
+	leaf = binary.BigEndian.AppendUint16(leaf, uint16(len(issuers)*sha256.Size))
+	for _, issuer := range issuers {
+		fingerprint := sha256.Sum256(issuer)
+		leaf = append(leaf, fingerprint[:]...)
+	}
+	return leaf, issuers, nil
+}
+
+// putIssuers stores the given issuers, unless they're known to be stored
+// already.
+func (tch *Handler) putIssuers(ctx context.Context, issuers [][]byte) error {
+	c := tch.staticCT
+	for _, issuer := range issuers {
+		fingerprint := sha256.Sum256(issuer)
+		c.mu.Lock()
+		known := c.issuers[fingerprint]
+		c.mu.Unlock()
+		if known {
+			continue
+		}
+		err := tch.putStaticObject(ctx, "issuer/"+hex.EncodeToString(fingerprint[:]), issuer)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		if len(c.issuers) >= staticMaxIssuers {
+			c.issuers = make(map[[sha256.Size]byte]bool)
+		}
+		c.issuers[fingerprint] = true
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// getStaticObject returns the object of the static CT API with the given key
+// after the prefix, or an error matching noSuchKey if there isn't one.
+func (tch *Handler) getStaticObject(ctx context.Context, key string) ([]byte, error) {
+	body, metadata, err := getObject(ctx, tch.s3Service, tch.s3Bucket, tch.s3Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	return tch.encryptor.Load().open(tch.s3Bucket, tch.s3Prefix+key, body, metadata)
+}
+
+// storeStaticTile stores the whole tile of the static CT API with the given
+// key after the prefix. Failures are only logged, since it can be made again.
+func (tch *Handler) storeStaticTile(ctx context.Context, key string, body []byte) {
+	err := tch.putStaticObject(ctx, key, body)
+	if err != nil {
+		tch.requestsMetric.WithLabelValues("error", "s3_static_put").Inc()
+		log.Printf("warning: writing %s of the static CT API to S3: %s\n", key, err)
+	}
+}
+
+// putStaticObject stores the object of the static CT API with the given key
+// after the prefix.
+func (tch *Handler) putStaticObject(ctx context.Context, key string, body []byte) error {
+	if tch.dryRun {
+		return nil
+	}
+	var encryptionKeyID string
+	var err error
+	if encryptor := tch.encryptor.Load(); encryptor != nil {
+		body, encryptionKeyID, err = encryptor.seal(tch.s3Prefix+key, body)
+		if err != nil {
+			return err
+		}
+	}
+	metadata := map[string]string{checksumMetadataKey: tileChecksum(body)}
+	if encryptionKeyID != "" {
+		metadata[encryptionMetadataKey] = encryptionKeyID
+	}
+	writeCtx, cancel := tch.s3WriteContext(ctx)
+	defer cancel()
+	return putTileObject(writeCtx, tch.s3Service, tch.s3Bucket, tch.s3Prefix+key, body, metadata, "")
+}
@@ -0,0 +1,294 @@
+package ctile
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestStaticCTAPI(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(600, 100))
+	defer backend.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := s3mem.New()
+	handler, err := New(backend.URL, WithTileSize(100), WithS3(svc, "bucket", "test/"),
+		WithStaticCTAPI(StaticCTAPI{Origin: "example.com/log", PublicKey: publicKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string, expectedStatus int) []byte {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expectedStatus {
+			t.Fatalf("%s: expected status %d, got %d: %s", path, expectedStatus, w.Code, w.Body)
+		}
+		return w.Body.Bytes()
+	}
+	leafHash := func(i int64) []byte {
+		h := sha256.Sum256(append([]byte{0}, fakelog.LeafInput(i)...))
+		return h[:]
+	}
+
+	// The checkpoint matches the backend's STH.
+	resp, err := http.Get(backend.URL + "/ct/v1/get-sth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sth struct {
+		Timestamp uint64 `json:"timestamp"`
+		RootHash  []byte `json:"sha256_root_hash"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sth)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := string(get("/log/checkpoint", http.StatusOK))
+	body, signature, ok := strings.Cut(checkpoint, "\n\n— example.com/log ")
+	if !ok {
+		t.Fatalf("expected a signature line in the checkpoint, got %q", checkpoint)
+	}
+	expectedBody := "example.com/log\n600\n" + base64.StdEncoding.EncodeToString(sth.RootHash)
+	if body != expectedBody {
+		t.Errorf("expected the checkpoint %q, got %q", expectedBody, body)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(signature, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := sha256.Sum256(append([]byte("example.com/log\n\x05"), publicKey...))
+	if len(sig) != 12 || !bytes.Equal(sig[:4], keyID[:4]) || binary.BigEndian.Uint64(sig[4:]) != sth.Timestamp {
+		t.Errorf("expected the key ID %x and timestamp %d in the signature, got %x", keyID[:4], sth.Timestamp, sig)
+	}
+
+	// Data tiles span the log's tiles, and are stored when they're whole.
+	data := get("/log/tile/data/001", http.StatusOK)
+	var expectedData []byte
+	for i := int64(256); i < 512; i++ {
+		// An x509_entry with an empty chain.
+		expectedData = append(append(expectedData, fakelog.LeafInput(i)[2:]...), 0, 0)
+	}
+	if !bytes.Equal(data, expectedData) {
+		t.Errorf("expected data tile 1 to hold entries 256-511")
+	}
+	expectStored := func(key string) {
+		t.Helper()
+		_, err := svc.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("test/" + key)})
+		if err != nil {
+			t.Errorf("expected %s to be stored: %s", key, err)
+		}
+	}
+	expectStored("tile/data/001")
+	if !bytes.Equal(get("/log/tile/data/001", http.StatusOK), data) {
+		t.Errorf("expected the stored data tile to be served")
+	}
+
+	// Hash tiles at level 0 hold the leaf hashes.
+	hashes := get("/log/tile/0/002.p/88", http.StatusOK)
+	if len(hashes) != 88*sha256.Size || !bytes.Equal(hashes[:sha256.Size], leafHash(512)) || !bytes.Equal(hashes[87*sha256.Size:], leafHash(599)) {
+		t.Errorf("expected the partial hash tile to hold the hashes of entries 512-599")
+	}
+	get("/log/tile/0/002", http.StatusNotFound)
+	get("/log/tile/data/002.p/89", http.StatusNotFound)
+
+	// Hash tiles at level 1 hold the roots of the tiles of level 0, so the
+	// first two make the root of a log of 512 entries.
+	level1 := get("/log/tile/1/000.p/2", http.StatusOK)
+	expectStored("tile/0/000")
+	expectStored("tile/0/001")
+	small := httptest.NewServer(fakelog.New(512, 100))
+	defer small.Close()
+	resp, err = http.Get(small.URL + "/ct/v1/get-sth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sth)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := subtreeRoot(level1); !bytes.Equal(root, sth.RootHash) {
+		t.Errorf("expected the level 1 hashes to make the root %x, got %x", sth.RootHash, root)
+	}
+
+	get("/log/issuer/"+strings.Repeat("00", sha256.Size), http.StatusNotFound)
+
+	// Without the option, the paths are passed through to the backend.
+	plain, err := New(backend.URL, WithTileSize(100), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	plain.ServeHTTP(w, httptest.NewRequest("GET", "/log/checkpoint", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the backend's 404 without the static CT API, got %d", w.Code)
+	}
+
+	_, err = New(backend.URL, WithTileSize(100), WithS3(svc, "bucket", "test/"), WithStaticCTAPI(StaticCTAPI{Origin: "example.com/log"}))
+	if err == nil {
+		t.Errorf("expected an error without a public key")
+	}
+}
+
+func TestStaticTileLeaf(t *testing.T) {
+	vector := func(parts ...[]byte) []byte {
+		var n int
+		for _, part := range parts {
+			n += len(part)
+		}
+		v := []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+		for _, part := range parts {
+			v = append(v, part...)
+		}
+		return v
+	}
+	// A precert_entry: its timestamp, entry_type, issuer_key_hash,
+	// tbs_certificate, and empty extensions.
+	timestampedEntry := append(make([]byte, 8), 0, 1)
+	timestampedEntry = append(timestampedEntry, make([]byte, 32)...)
+	timestampedEntry = append(append(timestampedEntry, vector([]byte("tbs"))...), 0, 0)
+	precert := vector([]byte("precert"))
+	intermediate, root := []byte("intermediate"), []byte("root")
+	e := Entry{
+		LeafInput: append([]byte{0, 0}, timestampedEntry...),
+		ExtraData: append(append([]byte{}, precert...), vector(vector(intermediate), vector(root))...),
+	}
+
+	leaf, issuers, err := staticTileLeaf(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issuers) != 2 || !bytes.Equal(issuers[0], intermediate) || !bytes.Equal(issuers[1], root) {
+		t.Errorf("expected the issuers %q and %q, got %q", intermediate, root, issuers)
+	}
+	first, second := sha256.Sum256(intermediate), sha256.Sum256(root)
+	expected := append(append(timestampedEntry, precert...), 0, 64)
+	expected = append(append(expected, first[:]...), second[:]...)
+	if !bytes.Equal(leaf, expected) {
+		t.Errorf("expected the TileLeaf\n%x\ngot\n%x", expected, leaf)
+	}
+
+	_, _, err = staticTileLeaf(Entry{LeafInput: e.LeafInput, ExtraData: precert[:5]})
+	if err == nil {
+		t.Errorf("expected an error for truncated extra_data")
+	}
+}
+
+func TestStaticCTIssuers(t *testing.T) {
+	issuer := []byte("issuer")
+	// A log of one tile, whose x509_entries are all issued by issuer.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries Entries
+		for i := int64(0); i < 256; i++ {
+			chain := []byte{0, 0, byte(3 + len(issuer)), 0, 0, byte(len(issuer))}
+			entries.Entries = append(entries.Entries, Entry{LeafInput: fakelog.LeafInput(i), ExtraData: append(chain, issuer...)})
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	defer backend.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := New(backend.URL, WithTileSize(256), WithS3(s3mem.New(), "bucket", "test/"),
+		WithStaticCTAPI(StaticCTAPI{Origin: "example.com/log", PublicKey: publicKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := sha256.Sum256(issuer)
+	issuerPath := "/issuer/" + hex.EncodeToString(fingerprint[:])
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{issuerPath, http.StatusNotFound},
+		{"/tile/data/000", http.StatusOK},
+		{issuerPath, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d", test.path, test.status, w.Code)
+		}
+		if test.path == issuerPath && w.Code == http.StatusOK {
+			body, _ := io.ReadAll(w.Body)
+			if !bytes.Equal(body, issuer) {
+				t.Errorf("expected the issuer %q, got %q", issuer, body)
+			}
+		}
+	}
+}
+
+func TestParseStaticCTPath(t *testing.T) {
+	for path, expected := range map[string]*staticCTRequest{
+		"/checkpoint":                          {checkpoint: true},
+		"/log/2023/checkpoint":                 {checkpoint: true},
+		"/tile/data/000":                       {level: -1, n: 0, width: 256},
+		"/log/tile/0/x001/x234/067":            {level: 0, n: 1234067, width: 256},
+		"/tile/2/012.p/7":                      {level: 2, n: 12, width: 7},
+		"/issuer/" + strings.Repeat("ab", 32):  {issuer: strings.Repeat("ab", 32)},
+		"/tile/0/1234":                         nil,
+		"/tile/0/x000/001":                     nil,
+		"/tile/0/000.p/0":                      nil,
+		"/tile/0/000.p/256":                    nil,
+		"/tile/0/000.p/07":                     nil,
+		"/tile/6/000":                          nil,
+		"/tile/01/000":                         nil,
+		"/issuer/abc":                          nil,
+		"/ct/v1/get-entries":                   nil,
+		"/checkpoint/extra":                    nil,
+		"/tile/5/x032/768":                     nil,
+		fmt.Sprintf("/tile/data/x%03d/000", 1): {level: -1, n: 1000, width: 256},
+	} {
+		req, ok := parseStaticCTPath(path)
+		if expected == nil {
+			if ok {
+				t.Errorf("%s: expected no request, got %+v", path, req)
+			}
+			continue
+		}
+		if !ok || req != *expected {
+			t.Errorf("%s: expected %+v, got %+v", path, *expected, req)
+		}
+		if !req.checkpoint && req.issuer == "" {
+			if tilePath := staticTilePath(req.level, req.n, req.width); !strings.HasSuffix(path, "/"+tilePath) {
+				t.Errorf("%s: expected the path of the tile to be the same, got %s", path, tilePath)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package ctile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+// STHCache configures WithSTHCache.
+type STHCache struct {
+	// TTL is how long an STH is served from memory after it's fetched. Zero
+	// disables the cache.
+	TTL time.Duration
+	// MaxStale is how much longer than TTL an STH may still be served, while
+	// a new one is fetched in the background. Zero means STHs are never
+	// served stale.
+	MaxStale time.Duration
+}
+
+// WithSTHCache keeps the backend's get-sth response in memory for c.TTL, and
+// serves requests for it from there, so monitors polling get-sth take one
+// backend request each TTL, rather than one each. Once it's expired, it's
+// served for up to c.MaxStale longer while a new STH is fetched in the
+// background, so requests don't wait on the backend, and keep being served
+// while it's unavailable. Only successful responses are cached.
+//
+// ctile_sth_cache_requests counts requests by whether the STH was fresh,
+// stale, or missing, and ctile_sth_age_seconds tracks the age of the STHs
+// served, from their timestamps.
+func WithSTHCache(c STHCache) Option {
+	return func(o *options) {
+		o.sthCache = c
+	}
+}
+
+// sthCache holds the latest STH fetched from the backend. A nil *sthCache
+// holds nothing.
+type sthCache struct {
+	ttl      time.Duration
+	maxStale time.Duration
+	// refreshTimeout bounds background refreshes.
+	refreshTimeout time.Duration
+
+	requests *prometheus.CounterVec
+	age      prometheus.Histogram
+
+	// group collapses fetches of a missing STH.
+	group singleflight.Group
+
+	// mu protects the fields below.
+	mu         sync.Mutex
+	path       string               // The path the STH was fetched from.
+	resp       *passthroughResponse // Nil if there's none.
+	timestamp  time.Time            // The STH's own timestamp.
+	fetched    time.Time
+	refreshing bool
+}
+
+func newSTHCache(c STHCache, refreshTimeout time.Duration, promRegisterer prometheus.Registerer) *sthCache {
+	if c.TTL == 0 {
+		return nil
+	}
+	sc := &sthCache{
+		ttl:            c.TTL,
+		maxStale:       c.MaxStale,
+		refreshTimeout: refreshTimeout,
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ctile_sth_cache_requests",
+				Help: "get-sth requests, by whether the STH in memory was fresh, stale (and refreshed in the background) or missing (and fetched)",
+			},
+			[]string{"result"}),
+		age: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ctile_sth_age_seconds",
+			Help:    "age of the STHs served for get-sth, from their timestamps",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		}),
+	}
+	promRegisterer.MustRegister(sc.requests, sc.age)
+	return sc
+}
+
+// isSTHPath returns whether path is for the get-sth endpoint.
+func isSTHPath(path string) bool {
+	return strings.HasSuffix(path, "/ct/v1/get-sth")
+}
+
+// get returns the STH fetched from path, if it's held, and whether it's
+// stale. An STH past its maximum staleness isn't returned.
+func (c *sthCache) get(path string) (resp *passthroughResponse, timestamp, fetched time.Time, stale bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resp == nil || c.path != path {
+		return nil, time.Time{}, time.Time{}, false
+	}
+	age := time.Since(c.fetched)
+	if age > c.ttl+c.maxStale {
+		return nil, time.Time{}, time.Time{}, false
+	}
+	return c.resp, c.timestamp, c.fetched, age > c.ttl
+}
+
+// fetch fetches the STH at path with p, and holds it if the backend returned
+// one.
+func (c *sthCache) fetch(ctx context.Context, p passthroughHandler, path string) (*passthroughResponse, time.Time, error) {
+	err := p.breaker.allow()
+	if err != nil {
+		return nil, time.Time{}, statusCodeError{http.StatusServiceUnavailable, []byte(err.Error() + "\n")}
+	}
+	fetched := time.Now()
+	resp, err := p.fetchBody(ctx, path, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if resp.statusCode != http.StatusOK {
+		return resp, time.Time{}, nil
+	}
+	var sth struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	err = json.Unmarshal(resp.body, &sth)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("parsing STH from %s: %w", path, err)
+	}
+	timestamp := time.UnixMilli(sth.Timestamp)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A fetch that started earlier may have finished later, so keep the
+	// newer STH.
+	if c.resp == nil || c.path != path || !timestamp.Before(c.timestamp) {
+		c.path, c.resp, c.timestamp, c.fetched = path, resp, timestamp, fetched
+	}
+	return resp, timestamp, nil
+}
+
+// refresh fetches a new STH from path in the background, unless that's
+// already happening.
+func (c *sthCache) refresh(p passthroughHandler, path string) {
+	c.mu.Lock()
+	if c.refreshing {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			c.refreshing = false
+			c.mu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), c.refreshTimeout)
+		defer cancel()
+		_, _, err := c.fetch(ctx, p, path)
+		if err != nil {
+			log.Printf("warning: refreshing the STH in memory: %s\n", err)
+		}
+	}()
+}
+
+// serve responds to the get-sth request r from the cache, fetching the STH
+// with p if it's missing or stale.
+func (c *sthCache) serve(w http.ResponseWriter, r *http.Request, p passthroughHandler) {
+	if r.Method != "GET" {
+		p.ServeHTTP(w, r)
+		return
+	}
+	resp, timestamp, fetched, stale := c.get(r.URL.Path)
+	result := "fresh"
+	if resp == nil {
+		result = "miss"
+	} else if stale {
+		result = "stale"
+	}
+	c.requests.WithLabelValues(result).Inc()
+	debugFrom(r.Context()).step("sth_cache", time.Time{}, result)
+
+	switch result {
+	case "miss":
+		type fetchResult struct {
+			resp      *passthroughResponse
+			timestamp time.Time
+		}
+		out, err, _ := singleflightDo(&c.group, r.URL.Path, func() (fetchResult, error) {
+			resp, timestamp, err := c.fetch(r.Context(), p, r.URL.Path)
+			return fetchResult{resp, timestamp}, err
+		})
+		if writePassthroughError(w, err) {
+			return
+		}
+		resp, timestamp, fetched = out.resp, out.timestamp, time.Now()
+	case "stale":
+		c.refresh(p, r.URL.Path)
+	}
+
+	copyHeader(w.Header(), resp.header)
+	if resp.statusCode == http.StatusOK {
+		c.age.Observe(time.Since(timestamp).Seconds())
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(fetched).Seconds())))
+	}
+	w.WriteHeader(resp.statusCode)
+	_, err := w.Write(resp.body)
+	if err != nil {
+		log.Printf("error copying response body to client: %s\n", err)
+	}
+}
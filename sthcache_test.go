@@ -0,0 +1,94 @@
+package ctile
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestSTHCache(t *testing.T) {
+	// A log whose tree grows with each get-sth, unless it's down.
+	var treeSize, down atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"tree_size":%d,"timestamp":%d}`, treeSize.Add(1), time.Now().UnixMilli())
+	}))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"),
+		WithSTHCache(STHCache{TTL: 50 * time.Millisecond, MaxStale: 100 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTreeSize := func(expected int64) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-sth")
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.StatusCode, body)
+		}
+		if prefix := fmt.Sprintf(`{"tree_size":%d,`, expected); !strings.HasPrefix(string(body), prefix) {
+			t.Errorf("expected an STH with tree size %d, got %s", expected, body)
+		}
+	}
+	requests := func(result string) float64 {
+		return testutil.ToFloat64(handler.sthCache.requests.WithLabelValues(result))
+	}
+
+	expectTreeSize(1)
+	expectTreeSize(1)
+	if requests("miss") != 1 || requests("fresh") != 1 {
+		t.Errorf("expected 1 miss and 1 fresh hit, got %g and %g", requests("miss"), requests("fresh"))
+	}
+	if count := testutil.CollectAndCount(handler.sthCache.age); count != 1 {
+		t.Errorf("expected the STH age to be observed, got %d metrics", count)
+	}
+
+	// A stale STH is served while a new one is fetched in the background.
+	time.Sleep(60 * time.Millisecond)
+	expectTreeSize(1)
+	if requests("stale") != 1 {
+		t.Errorf("expected 1 stale hit, got %g", requests("stale"))
+	}
+	deadline := time.Now().Add(time.Second)
+	for treeSize.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	expectTreeSize(2)
+
+	// While the backend is down, the STH is served until it's too stale.
+	down.Store(1)
+	time.Sleep(60 * time.Millisecond)
+	expectTreeSize(2)
+	time.Sleep(100 * time.Millisecond)
+	resp := getResp(handler, "/ct/v1/get-sth")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the backend's 503 once the STH is too stale, got %d", resp.StatusCode)
+	}
+
+	// Errors aren't cached.
+	down.Store(0)
+	expectTreeSize(3)
+
+	for _, c := range []STHCache{{TTL: -time.Second}, {MaxStale: time.Second}} {
+		_, err = New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithSTHCache(c))
+		if err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
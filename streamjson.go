@@ -0,0 +1,172 @@
+package ctile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// streamBufferSize is the size of the buffer get-entries responses are
+// written through. Responses that fit in it are sent with a Content-Length.
+const streamBufferSize = 32 << 10
+
+// prettyParam is the query parameter of get-entries requests that asks for
+// JSON indented by two spaces, for people reading responses.
+const prettyParam = "pretty"
+
+// WithPrettyJSON indents the JSON of every get-entries response by two spaces,
+// as if each request had ?pretty=1. By default responses are compact, which
+// makes them much smaller. Precompressed JSON is stored in the format set
+// here, and objects written under the other setting are served as they are.
+func WithPrettyJSON(enabled bool) Option {
+	return func(o *options) {
+		o.prettyJSON = enabled
+	}
+}
+
+// parsePretty returns true if values ask for indented JSON.
+func parsePretty(values url.Values) (bool, error) {
+	v := values.Get(prettyParam)
+	if v == "" {
+		return false, nil
+	}
+	pretty, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter: %w", prettyParam, err)
+	}
+	return pretty, nil
+}
+
+// jsonField is a member of a get-entries response after its entries.
+type jsonField struct {
+	name  string
+	value interface{}
+}
+
+// jsonLayout holds the text around the values of a get-entries response.
+type jsonLayout struct {
+	open, element, separator, close, field, end string
+}
+
+var (
+	compactLayout = jsonLayout{`{"entries":`, "", ",", "]", `,%s:`, "}\n"}
+	prettyLayout  = jsonLayout{"{\n  \"entries\": ", "\n    ", ",", "\n  ]", ",\n  %s: ", "\n}\n"}
+)
+
+// writeEntriesJSON writes a get-entries response, the JSON object
+// {"entries": entries, ...fields}, to w, one entry at a time, so a large
+// response is never held in memory whole; w should be buffered. It's indented
+// by two spaces if pretty is true. The output is the same as encoding the
+// equivalent struct with a json.Encoder, so precompressed responses match
+// those encoded per request.
+func writeEntriesJSON[E any](w io.Writer, pretty bool, entries []E, fields ...jsonField) error {
+	layout := compactLayout
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if pretty {
+		layout = prettyLayout
+		// Entries are indented as elements of the array.
+		encoder.SetIndent("    ", "  ")
+	}
+	// encode writes v to w, without the newline the encoder ends it with.
+	encode := func(v interface{}) error {
+		buf.Reset()
+		err := encoder.Encode(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		return err
+	}
+
+	_, err := io.WriteString(w, layout.open)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entries == nil:
+		_, err = io.WriteString(w, "null")
+	case len(entries) == 0:
+		_, err = io.WriteString(w, "[]")
+	default:
+		_, err = io.WriteString(w, "[")
+		for i := 0; i < len(entries) && err == nil; i++ {
+			if i > 0 {
+				_, err = io.WriteString(w, layout.separator)
+			}
+			if err == nil {
+				_, err = io.WriteString(w, layout.element)
+			}
+			if err == nil {
+				err = encode(entries[i])
+			}
+		}
+		if err == nil {
+			_, err = io.WriteString(w, layout.close)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if pretty {
+		encoder.SetIndent("  ", "  ")
+	}
+	for _, field := range fields {
+		name, err := json.Marshal(field.name)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, layout.field, name)
+		if err != nil {
+			return err
+		}
+		err = encode(field.value)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, layout.end)
+	return err
+}
+
+// writeEntriesResponse sends a get-entries response with status 200 and the
+// body written by write, which is streamed to the client as it's written. A
+// body that fits in streamBufferSize is sent with a Content-Length.
+func writeEntriesResponse(w http.ResponseWriter, write func(io.Writer) error) error {
+	body := &responseBody{ResponseWriter: w}
+	bw := bufio.NewWriterSize(body, streamBufferSize)
+	err := write(bw)
+	if err != nil {
+		return err
+	}
+	if !body.started {
+		w.Header().Set("Content-Length", strconv.Itoa(bw.Buffered()))
+	}
+	return bw.Flush()
+}
+
+// responseBody writes the header of a response with status 200 before its
+// body is first written.
+type responseBody struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (b *responseBody) Write(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		b.WriteHeader(http.StatusOK)
+	}
+	return b.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the ResponseWriter b wraps, for http.ResponseController.
+func (b *responseBody) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
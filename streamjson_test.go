@@ -0,0 +1,118 @@
+package ctile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestWriteEntriesJSON(t *testing.T) {
+	var entries []Entry
+	for i := int64(0); i < 3; i++ {
+		entries = append(entries, Entry{LeafInput: fakelog.LeafInput(i), ExtraData: fakelog.ExtraData(i)})
+	}
+	verbose := verboseEntries{
+		Entries: []verboseEntry{{Entry: entries[0], Index: 7}, {Entry: entries[1], Index: 8}},
+		Tile:    verboseTile{Start: 5, Size: 5, Entries: 5, Source: sourceS3},
+	}
+
+	for _, pretty := range []bool{false, true} {
+		for _, test := range []struct {
+			name     string
+			expected interface{}
+			write    func(*bytes.Buffer) error
+		}{
+			{"entries", Entries{entries}, func(b *bytes.Buffer) error { return writeEntriesJSON(b, pretty, entries) }},
+			{"one", Entries{entries[:1]}, func(b *bytes.Buffer) error { return writeEntriesJSON(b, pretty, entries[:1]) }},
+			{"empty", Entries{[]Entry{}}, func(b *bytes.Buffer) error { return writeEntriesJSON(b, pretty, []Entry{}) }},
+			{"nil", Entries{}, func(b *bytes.Buffer) error { return writeEntriesJSON[Entry](b, pretty, nil) }},
+			{"verbose", verbose, func(b *bytes.Buffer) error {
+				return writeEntriesJSON(b, pretty, verbose.Entries, jsonField{"ctile_tile", verbose.Tile})
+			}},
+		} {
+			var expected bytes.Buffer
+			encoder := json.NewEncoder(&expected)
+			if pretty {
+				encoder.SetIndent("", "  ")
+			}
+			err := encoder.Encode(test.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			err = test.write(&got)
+			if err != nil {
+				t.Fatalf("%s (pretty %t): %s", test.name, pretty, err)
+			}
+			if got.String() != expected.String() {
+				t.Errorf("%s (pretty %t): expected\n%s\ngot\n%s", test.name, pretty, expected.String(), got.String())
+			}
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestWriteEntriesJSONError(t *testing.T) {
+	err := writeEntriesJSON(failingWriter{}, false, []Entry{{LeafInput: []byte{1}}})
+	if err == nil || err.Error() != "broken pipe" {
+		t.Errorf("expected the writer's error, got %v", err)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 10))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	compact := get("/ct/v1/get-entries?start=0&end=1")
+	if compact.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", compact.Code, compact.Body)
+	}
+	if ct := compact.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", ct)
+	}
+	if cl := compact.Header().Get("Content-Length"); cl != strconv.Itoa(compact.Body.Len()) {
+		t.Errorf("expected Content-Length %d, got %q", compact.Body.Len(), cl)
+	}
+	if bytes.Contains(compact.Body.Bytes(), []byte("\n  ")) {
+		t.Errorf("expected compact JSON, got %s", compact.Body)
+	}
+
+	pretty := get("/ct/v1/get-entries?start=0&end=1&pretty=1")
+	if !bytes.HasPrefix(pretty.Body.Bytes(), []byte("{\n  \"entries\": [\n    {")) {
+		t.Errorf("expected indented JSON, got %s", pretty.Body)
+	}
+	var compactEntries, prettyEntries Entries
+	if json.Unmarshal(compact.Body.Bytes(), &compactEntries) != nil || json.Unmarshal(pretty.Body.Bytes(), &prettyEntries) != nil ||
+		!reflect.DeepEqual(compactEntries, prettyEntries) {
+		t.Errorf("expected the same entries, got %s and %s", compact.Body, pretty.Body)
+	}
+	if etag := pretty.Header().Get("ETag"); etag == "" || etag == compact.Header().Get("ETag") {
+		t.Errorf("expected the compact and indented responses to have different ETags, got %q and %q", compact.Header().Get("ETag"), etag)
+	}
+
+	if w := get("/ct/v1/get-entries?start=0&end=1&pretty=maybe"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid pretty parameter, got %d", w.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// WithSuperTiles stores n consecutive tiles in each S3 object, called a
+// super-tile, instead of one, to cut the number of PUTs, and, with a memory or
+// disk cache to keep the rest of each super-tile read, GETs. Values below 2
+// disable it.
+//
+// When a tile is written, the other tiles of its super-tile are gathered from
+// the local caches, from their own objects in S3, or from the backend, and if
+// they're all complete, the super-tile is written in place of the tile. If
+// not, e.g. at the end of the log, the tile is written in its own object as
+// usual. Reads look for a tile's super-tile first, then for the tile itself,
+// so super-tiles can be enabled without losing the cache. Since n is part of
+// a super-tile's key, though, changing it leaves existing super-tiles unread.
+func WithSuperTiles(n int) Option {
+	return func(o *options) {
+		o.superTiles = n
+	}
+}
+
+// superTile returns the super-tile containing t.
+func (tch *Handler) superTile(t tile) tile {
+	return makeTile(t.start, t.size*int64(tch.superTiles), t.logURL)
+}
+
+// superTileKey returns the S3 key, not including any prefix, for super-tile
+// st. It doesn't parse with ParseTileKey, so only TileKeys with super-tiles
+// recognizes it.
+func (tch *Handler) superTileKey(st tile) string {
+	return fmt.Sprintf("tile_size=%d/x%d/%d.cbor.gz", st.size/int64(tch.superTiles), tch.superTiles, st.start)
+}
+
+// members returns the tiles in super-tile st.
+func (tch *Handler) members(st tile) []tile {
+	size := st.size / int64(tch.superTiles)
+	tiles := make([]tile, 0, tch.superTiles)
+	for start := st.start; start < st.end; start += size {
+		tiles = append(tiles, makeTile(start, size, st.logURL))
+	}
+	return tiles
+}
+
+// getFromSuperTile reads t from its super-tile in bucket and prefix, and
+// keeps the super-tile's other tiles in the local caches. It returns
+// noSuchKey if the super-tile isn't there.
+func (tch *Handler) getFromSuperTile(ctx context.Context, svc S3API, bucket, prefix string, t tile) (*Entries, error) {
+	st := tch.superTile(t)
+	entries, err := tch.getTileObject(ctx, svc, bucket, prefix, st, tch.superTileKey(st))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries.Entries) != int(st.size) {
+		return nil, fmt.Errorf("internal inconsistency: len(entries) == %d; super-tile = %v", len(entries.Entries), st)
+	}
+
+	var contents *Entries
+	for i, member := range tch.members(st) {
+		// Cap each slice, so it can't be appended to over the next.
+		lo, hi := i*int(t.size), (i+1)*int(t.size)
+		memberContents := &Entries{Entries: entries.Entries[lo:hi:hi]}
+		if member.start == t.start {
+			contents = memberContents
+			continue
+		}
+		tch.addToLocalCaches(tch.cacheKey(member), memberContents)
+	}
+	return contents, nil
+}
+
+// gatherSuperTile returns the super-tile containing t, whose contents are e,
+// if all of its other tiles are complete and can be found, in the local
+// caches, in S3, or from the backend. It stops at the first that can't, so
+// gathering a super-tile at the end of the log costs at most one request to
+// the backend.
+func (tch *Handler) gatherSuperTile(ctx context.Context, t tile, e *Entries) (tile, *Entries, bool) {
+	st := tch.superTile(t)
+	all := make([]Entry, 0, st.size)
+	for _, member := range tch.members(st) {
+		if member.start == t.start {
+			all = append(all, e.Entries...)
+			continue
+		}
+		contents, err := tch.getMember(ctx, member)
+		if err != nil {
+			if !errors.Is(err, noSuchKey{}) {
+				log.Printf("warning: writing tile %d-%d on its own: getting tile %d-%d for its super-tile: %s\n", t.start, t.end-1, member.start, member.end-1, err)
+			}
+			return tile{}, nil, false
+		}
+		all = append(all, contents.Entries...)
+	}
+	return st, &Entries{Entries: all}, true
+}
+
+// getMember gets a complete tile for gatherSuperTile. It returns noSuchKey if
+// the backend doesn't have all of it yet.
+func (tch *Handler) getMember(ctx context.Context, t tile) (*Entries, error) {
+	cacheKey := tch.cacheKey(t)
+	if contents := tch.memoryCache.get(cacheKey); contents != nil && len(contents.Entries) == int(t.size) {
+		return contents, nil
+	}
+	if contents := tch.diskCache.get(cacheKey); contents != nil && len(contents.Entries) == int(t.size) {
+		return contents, nil
+	}
+	bucket, prefix := tch.location(t)
+	contents, err := tch.getTileObject(ctx, tch.s3Service, bucket, prefix, t, tch.tileKey(t))
+	if err == nil && len(contents.Entries) == int(t.size) {
+		return contents, nil
+	}
+	if err != nil && !errors.Is(err, noSuchKey{}) {
+		return nil, err
+	}
+
+	contents, _, err = tch.fetchFromBackend(ctx, t)
+	var statusCodeErr statusCodeError
+	if errors.As(err, &statusCodeErr) && statusCodeErr.statusCode == http.StatusBadRequest {
+		// It's past the end of the log.
+		return nil, noSuchKey{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tch.isPartialTile(contents) {
+		return nil, noSuchKey{}
+	}
+	if tch.strictValidation {
+		err = tch.validateTile(ctx, t, contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
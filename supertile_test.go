@@ -0,0 +1,77 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestSuperTiles(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(30, 3))
+	defer backend.Close()
+	ctx := context.Background()
+	svc := s3mem.New()
+
+	newHandler := func(opts ...Option) *Handler {
+		t.Helper()
+		handler, err := New(backend.URL, append([]Option{WithTileSize(3), WithS3(svc, "bucket", "test/"), WithSuperTiles(4)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	expectSource := func(handler *Handler, url string, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expected, source)
+		}
+	}
+	expectObject := func(key string, expected bool) {
+		t.Helper()
+		_, err := GetTileObject(ctx, svc, "bucket", "test/"+key)
+		if expected && err != nil {
+			t.Errorf("expected %s in S3, got %v", key, err)
+		}
+		if !expected && !errors.Is(err, ErrNoSuchKey) {
+			t.Errorf("expected %s not to be in S3, got %v", key, err)
+		}
+	}
+
+	// Writing a tile writes its whole super-tile, and not the tile itself.
+	handler := newHandler()
+	expectSource(handler, "/ct/v1/get-entries?start=3&end=5", "CT log")
+	expectObject("tile_size=3/x4/0.cbor.gz", true)
+	expectObject(TileKey(3, 3), false)
+
+	// Reading a tile from a super-tile keeps the rest of it in memory.
+	handler = newHandler(WithMemoryCache(1 << 20))
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "S3")
+	expectSource(handler, "/ct/v1/get-entries?start=9&end=11", "memory")
+
+	// At the end of the log, tiles are written on their own.
+	expectSource(handler, "/ct/v1/get-entries?start=24&end=26", "CT log")
+	expectObject("tile_size=3/x4/24.cbor.gz", false)
+	expectObject(TileKey(3, 24), true)
+
+	// Tiles written on their own are read without super-tiles, or with a
+	// different number of tiles in each.
+	handler = newHandler(WithSuperTiles(0))
+	expectSource(handler, "/ct/v1/get-entries?start=24&end=26", "S3")
+	handler = newHandler(WithSuperTiles(2), WithMode(ModeCacheOnly))
+	expectSource(handler, "/ct/v1/get-entries?start=24&end=26", "S3")
+
+	_, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithSuperTiles(4), WithShards([]Shard{{Start: 6, Prefix: "other/"}}))
+	if err == nil {
+		t.Errorf("expected an error for a shard splitting a super-tile")
+	}
+}
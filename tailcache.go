@@ -0,0 +1,79 @@
+package ctile
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithTailCache keeps the partial tile at the end of the log in memory for ttl
+// after it's fetched from the backend, and serves requests for it from there,
+// so monitors polling the end of the log all at once take one backend request
+// each ttl, rather than one each. Entries added to the log within the ttl
+// aren't served until it expires, so keep it to a few seconds. Zero disables
+// it.
+//
+// ctile_tail_cache_hits counts the requests it serves.
+func WithTailCache(ttl time.Duration) Option {
+	return func(o *options) {
+		o.tailCacheTTL = ttl
+	}
+}
+
+// tailCache holds the latest partial tile for a short time. A nil *tailCache
+// holds nothing.
+type tailCache struct {
+	ttl  time.Duration
+	hits prometheus.Counter
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	start    int64    // The start of the tile held.
+	contents *Entries // Nil if there's none.
+	expires  time.Time
+}
+
+func newTailCache(ttl time.Duration, promRegisterer prometheus.Registerer) *tailCache {
+	if ttl == 0 {
+		return nil
+	}
+	c := &tailCache{
+		ttl: ttl,
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ctile_tail_cache_hits",
+			Help: "requests served from the partial tile at the end of the log held in memory",
+		}),
+	}
+	promRegisterer.MustRegister(c.hits)
+	return c
+}
+
+// get returns the partial tile t, if it's held and hasn't expired. The
+// returned Entries are shared, and must not be modified.
+func (c *tailCache) get(t tile) *Entries {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.contents == nil || c.start != t.start || time.Now().After(c.expires) {
+		return nil
+	}
+	c.hits.Inc()
+	return c.contents
+}
+
+// add holds the partial tile t, unless a later one is held already.
+func (c *tailCache) add(t tile, contents *Entries) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.contents != nil && c.start > t.start && now.Before(c.expires) {
+		return
+	}
+	c.start, c.contents, c.expires = t.start, contents, now.Add(c.ttl)
+}
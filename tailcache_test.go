@@ -0,0 +1,52 @@
+package ctile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestTailCache(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(5, 3))
+	defer backend.Close()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithTailCache(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource := func(url string, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expected, source)
+		}
+	}
+
+	expectSource("/ct/v1/get-entries?start=3&end=5", "CT log")
+	expectSource("/ct/v1/get-entries?start=4&end=5", "memory")
+	if hits := testutil.ToFloat64(handler.tailCache.hits); hits != 1 {
+		t.Errorf("expected 1 hit, got %g", hits)
+	}
+
+	// Complete tiles aren't held.
+	expectSource("/ct/v1/get-entries?start=0&end=2", "CT log")
+	expectSource("/ct/v1/get-entries?start=0&end=2", "S3")
+
+	time.Sleep(60 * time.Millisecond)
+	expectSource("/ct/v1/get-entries?start=3&end=5", "CT log")
+
+	_, err = New(backend.URL, WithTileSize(3), WithS3(s3mem.New(), "bucket", "test/"), WithTailCache(-time.Second))
+	if err == nil {
+		t.Errorf("expected an error for a negative TTL")
+	}
+}
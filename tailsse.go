@@ -0,0 +1,267 @@
+package ctile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tailSuffix is the path suffix of requests to follow the end of the log.
+const tailSuffix = "/ctile/v1/tail"
+
+// tailKeepAlive is how often a comment is sent to idle tail clients, so
+// proxies don't close their connections.
+const tailKeepAlive = 15 * time.Second
+
+// WithTailEndpoint serves GET <log>/ctile/v1/tail, which pushes entries to
+// clients as they're added to the log, as Server-Sent Events, so monitors
+// don't have to poll get-sth and the end of the log. While any clients are
+// connected, the backend's tree size is polled every pollInterval, once for
+// all of them. Zero disables it.
+//
+// Each entry is an "entry" event, with its index as the event ID and the
+// {"leaf_input", "extra_data", "ctile_index"} object as data. A "tree_size"
+// event follows once a client has every entry before that tree size. Clients
+// start at the tree size when they connect, or at ?start=, and clients that
+// reconnect with Last-Event-ID carry on after that entry. Entries are read as
+// for get-entries, so clients following the log share tile fetches.
+//
+// ctile_tail_clients tracks the number of connected clients.
+func WithTailEndpoint(pollInterval time.Duration) Option {
+	return func(o *options) {
+		o.tailPollInterval = pollInterval
+	}
+}
+
+// tailFollower polls the tree size of the log while tail clients are
+// connected. A nil *tailFollower serves no clients.
+type tailFollower struct {
+	interval    time.Duration
+	timeout     time.Duration
+	getTreeSize func(context.Context) (int64, error)
+	clients     prometheus.Gauge
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	treeSize int64
+	known    bool          // Whether treeSize has been polled since the first client connected.
+	polled   chan struct{} // Closed, and replaced, after each poll.
+	count    int           // The number of clients connected.
+	stop     context.CancelFunc
+}
+
+func newTailFollower(interval, timeout time.Duration, getTreeSize func(context.Context) (int64, error), promRegisterer prometheus.Registerer) *tailFollower {
+	if interval == 0 {
+		return nil
+	}
+	f := &tailFollower{
+		interval:    interval,
+		timeout:     timeout,
+		getTreeSize: getTreeSize,
+		clients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ctile_tail_clients",
+			Help: "clients connected to /ctile/v1/tail",
+		}),
+		polled: make(chan struct{}),
+	}
+	promRegisterer.MustRegister(f.clients)
+	return f
+}
+
+// subscribe adds a client, starting to poll if it's the first. The client
+// must call the returned function when it's gone.
+func (f *tailFollower) subscribe() func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.count++
+	f.clients.Inc()
+	if f.count == 1 {
+		var ctx context.Context
+		ctx, f.stop = context.WithCancel(context.Background())
+		go f.poll(ctx)
+	}
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.count--
+		f.clients.Dec()
+		if f.count == 0 {
+			f.stop()
+			f.known = false
+		}
+	}
+}
+
+// state returns the latest tree size, whether there is one yet, and a
+// channel closed after the next poll.
+func (f *tailFollower) state() (int64, bool, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.treeSize, f.known, f.polled
+}
+
+// poll polls the tree size until ctx is done. Replicas of the backend may be
+// behind each other, so the tree size never goes down.
+func (f *tailFollower) poll(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, f.timeout)
+		treeSize, err := f.getTreeSize(pollCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("warning: polling the tree size for tail clients: %s\n", err)
+		}
+		f.mu.Lock()
+		if ctx.Err() == nil && err == nil && (!f.known || treeSize > f.treeSize) {
+			f.treeSize, f.known = treeSize, true
+		}
+		close(f.polled)
+		f.polled = make(chan struct{})
+		f.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getTreeSize returns the tree size of the log, from the backend that's first
+// in line for requests.
+func (tch *Handler) getTreeSize(ctx context.Context) (int64, error) {
+	backendURL := tch.backends.candidates()[0].url
+	if tch.backendType == BackendStaticCT {
+		return tch.getStaticTreeSize(ctx, backendURL)
+	}
+	var sth struct {
+		TreeSize int64 `json:"tree_size"`
+	}
+	err := tch.getJSON(ctx, backendURL+"/ct/v1/get-sth", &sth)
+	return sth.TreeSize, err
+}
+
+// isTailPath returns true if path is that of a tail request.
+func (tch *Handler) isTailPath(path string) bool {
+	return tch.follower != nil && strings.HasSuffix(path, tailSuffix)
+}
+
+// parseTailStart returns the index of the first entry r asks for, or -1 to
+// start at the tree size.
+func parseTailStart(r *http.Request) (int64, error) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || last < 0 {
+			return 0, fmt.Errorf("invalid Last-Event-ID %q", id)
+		}
+		return last + 1, nil
+	}
+	start := r.URL.Query().Get("start")
+	if start == "" {
+		return -1, nil
+	}
+	next, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || next < 0 {
+		return 0, fmt.Errorf("invalid start parameter %q", start)
+	}
+	return next, nil
+}
+
+// serveTail answers a tail request, until the client goes away or EndStreams
+// is called.
+func (tch *Handler) serveTail(w http.ResponseWriter, r *http.Request) {
+	next, err := parseTailStart(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	ctx, cancel := tch.streamContext(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+	unsubscribe := tch.follower.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	_ = controller.Flush()
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	var sentTreeSize int64
+	for {
+		// The connection may stay idle until the next keep-alive, and then
+		// take as long as a get-entries request to send a tile.
+		_ = controller.SetWriteDeadline(time.Now().Add(tailKeepAlive + tch.fullRequestTimeout + time.Second))
+		treeSize, known, polled := tch.follower.state()
+		if known && next < 0 {
+			next = treeSize
+		}
+		for known && next < treeSize {
+			sent, err := tch.sendTailEntries(r.Context(), w, next, treeSize)
+			next += sent
+			if err != nil {
+				if r.Context().Err() == nil {
+					log.Printf("warning: sending entries from %d to a tail client: %s\n", next, err)
+				}
+				break
+			}
+			if sent == 0 {
+				// The tile read is behind the tree size. Try again after the
+				// next poll.
+				break
+			}
+		}
+		if known && next == treeSize && treeSize > sentTreeSize {
+			sentTreeSize = treeSize
+			fmt.Fprintf(w, "event: tree_size\ndata: %d\n\n", treeSize)
+		}
+		err = controller.Flush()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-polled:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// sendTailEntries sends the entries from next to the end of its tile, or to
+// treeSize, and returns how many it sent.
+func (tch *Handler) sendTailEntries(ctx context.Context, w http.ResponseWriter, next, treeSize int64) (int64, error) {
+	t := makeTile(next, int64(tch.tileSize), tch.logURL)
+	ctx, cancel := context.WithTimeout(ctx, tch.fullRequestTimeout)
+	defer cancel()
+	contents, _, err := tch.getTileFrom(ctx, t, next)
+	if err != nil {
+		return 0, err
+	}
+	var sent int64
+	for i := next - t.start; i < int64(len(contents.Entries)) && next+sent < treeSize; i++ {
+		data, err := json.Marshal(verboseEntry{Entry: contents.Entries[i], Index: next + sent})
+		if err != nil {
+			return sent, err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: entry\ndata: %s\n\n", next+sent, data)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
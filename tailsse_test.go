@@ -0,0 +1,135 @@
+package ctile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// readEvent reads the next event from an event stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (event, id, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, id, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// expectEntries reads the entry events from start to end, exclusive, and the
+// tree_size event after them.
+func expectEntries(t *testing.T, r *bufio.Reader, start, end int64) {
+	t.Helper()
+	for i := start; i < end; i++ {
+		event, id, data := readEvent(t, r)
+		var entry verboseEntry
+		err := json.Unmarshal([]byte(data), &entry)
+		if event != "entry" || id != fmt.Sprint(i) || err != nil || entry.Index != i {
+			t.Fatalf("expected entry %d, got event %q with ID %q: %s", i, event, id, data)
+		}
+	}
+	event, _, data := readEvent(t, r)
+	if event != "tree_size" || data != fmt.Sprint(end) {
+		t.Fatalf("expected tree size %d, got event %q: %s", end, event, data)
+	}
+}
+
+func TestTailEndpoint(t *testing.T) {
+	var treeSize atomic.Int64
+	treeSize.Store(7)
+	fakeLog := fakelog.New(100, 5)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/ct/v1/get-sth") {
+			fmt.Fprintf(w, `{"tree_size":%d}`, treeSize.Load())
+			return
+		}
+		fakeLog.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(5), WithS3(s3mem.New(), "bucket", "test/"), WithTailEndpoint(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tail := func(query, lastEventID string) (*bufio.Reader, func()) {
+		req, err := http.NewRequest("GET", server.URL+"/ctile/v1/tail"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("expected Content-Type text/event-stream, got %q", ct)
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	events, closeTail := tail("?start=3", "")
+	expectEntries(t, events, 3, 7)
+	// Entries added to the log are pushed as they're polled, across tiles.
+	treeSize.Store(12)
+	expectEntries(t, events, 7, 12)
+	closeTail()
+
+	// A client that reconnects carries on after the last event it got.
+	events, closeTail = tail("?start=0", "9")
+	expectEntries(t, events, 10, 12)
+	closeTail()
+
+	// By default, clients start at the tree size.
+	events, closeTail = tail("", "")
+	expectEntries(t, events, 12, 12)
+	treeSize.Store(13)
+	expectEntries(t, events, 12, 13)
+	closeTail()
+
+	resp, err := http.Get(server.URL + "/ctile/v1/tail?start=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid start, got %d", resp.StatusCode)
+	}
+
+	// EndStreams ends the clients' streams.
+	events, closeTail = tail("", "")
+	defer closeTail()
+	expectEntries(t, events, 13, 13)
+	handler.EndStreams()
+	_, err = io.Copy(io.Discard, events)
+	if err != nil {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+}
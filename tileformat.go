@@ -0,0 +1,119 @@
+package ctile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// TileFormat configures how a Handler encodes the tiles it writes to S3. The
+// zero value is the default: CBOR, gzipped at gzip.DefaultCompression.
+// Whatever the format, keys are the same, and DecodeTile reads tiles in any
+// of them, so it can be changed without invalidating a bucket.
+type TileFormat struct {
+	// Serialization is how entries are serialized, before compression.
+	// Defaults to SerializationCBOR.
+	Serialization Serialization
+	// GzipLevel is the gzip compression level, from gzip.BestSpeed (1) to
+	// gzip.BestCompression (9). Zero means gzip.DefaultCompression.
+	GzipLevel int
+	// Uncompressed stores tiles without gzip, for debugging, or when the
+	// bucket is compressed at rest anyway. GzipLevel is ignored.
+	Uncompressed bool
+}
+
+// Serialization is a way of serializing the entries of a tile.
+type Serialization string
+
+const (
+	// SerializationCBOR serializes entries as CBOR, which is compact, since
+	// their fields needn't be base64-encoded.
+	SerializationCBOR Serialization = "cbor"
+	// SerializationJSON serializes entries as JSON, in the same form as a
+	// get-entries response, so a tile can be read with ordinary tools. It's
+	// about a third larger than CBOR before compression.
+	SerializationJSON Serialization = "json"
+)
+
+// ParseSerialization returns the Serialization with the given name, or an
+// error.
+func ParseSerialization(s string) (Serialization, error) {
+	switch serialization := Serialization(s); serialization {
+	case SerializationCBOR, SerializationJSON:
+		return serialization, nil
+	default:
+		return "", fmt.Errorf("unknown serialization %q", s)
+	}
+}
+
+// WithTileFormat sets how tiles are encoded when they're written to S3.
+func WithTileFormat(f TileFormat) Option {
+	return func(o *options) {
+		o.tileFormat = f
+	}
+}
+
+// validate returns an error if f can't be used to encode tiles.
+func (f TileFormat) validate() error {
+	if f.Serialization != "" {
+		_, err := ParseSerialization(string(f.Serialization))
+		if err != nil {
+			return err
+		}
+	}
+	if f.GzipLevel < 0 || f.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("gzip level must be between 0 and %d, got %d", gzip.BestCompression, f.GzipLevel)
+	}
+	return nil
+}
+
+// Encode encodes entries in format f. EncodeTile is Encode with the zero
+// TileFormat.
+func (f TileFormat) Encode(e *Entries) ([]byte, error) {
+	var serialized []byte
+	var err error
+	switch f.Serialization {
+	case SerializationJSON:
+		serialized, err = json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("encoding JSON: %w", err)
+		}
+	default:
+		serialized, err = cbor.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("encoding CBOR: %w", err)
+		}
+	}
+	if f.Uncompressed {
+		return serialized, nil
+	}
+
+	level := f.GzipLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var body bytes.Buffer
+	w, err := gzip.NewWriterLevel(&body, level)
+	if err != nil {
+		return nil, fmt.Errorf("making gzip writer: %w", err)
+	}
+	_, err = w.Write(serialized)
+	if err != nil {
+		return nil, fmt.Errorf("compressing: %w", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("closing gzip writer: %w", err)
+	}
+	return body.Bytes(), nil
+}
+
+// gzipMagic is the first two bytes of a gzip stream, which DecodeTile uses to
+// tell gzipped tiles from uncompressed ones. Uncompressed CBOR tiles start
+// with a map header, 0xa0 to 0xbf, so they can't be mistaken for gzip, nor,
+// since JSON tiles start with '{', for JSON.
+var gzipMagic = []byte{0x1f, 0x8b}
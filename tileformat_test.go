@@ -0,0 +1,97 @@
+package ctile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestTileFormat(t *testing.T) {
+	entries := &Entries{Entries: []Entry{{LeafInput: []byte("leaf"), ExtraData: []byte("extra")}}}
+	for _, f := range []TileFormat{{}, {GzipLevel: gzip.BestSpeed}, {GzipLevel: gzip.BestCompression}, {Uncompressed: true},
+		{Serialization: SerializationJSON}, {Serialization: SerializationJSON, Uncompressed: true},
+	} {
+		body, err := f.Encode(entries)
+		if err != nil {
+			t.Fatalf("%+v: %s", f, err)
+		}
+		if gzipped := bytes.HasPrefix(body, gzipMagic); gzipped == f.Uncompressed {
+			t.Errorf("%+v: expected gzipped to be %t", f, !f.Uncompressed)
+		}
+		if f.Serialization == SerializationJSON && f.Uncompressed && !json.Valid(body) {
+			t.Errorf("%+v: expected JSON, got %q", f, body)
+		}
+		decoded, err := DecodeTile(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%+v: %s", f, err)
+		}
+		if len(decoded.Entries) != 1 || string(decoded.Entries[0].LeafInput) != "leaf" {
+			t.Errorf("%+v: expected the entries back, got %+v", f, decoded)
+		}
+	}
+
+	_, err := New("http://example.com", WithTileFormat(TileFormat{GzipLevel: 10}))
+	if err == nil {
+		t.Errorf("expected an error for gzip level 10")
+	}
+	_, err = New("http://example.com", WithTileFormat(TileFormat{Serialization: "xml"}))
+	if err == nil {
+		t.Errorf("expected an error for an unknown serialization")
+	}
+}
+
+func TestUncompressedTiles(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+	svc := s3mem.New()
+
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithTileFormat(TileFormat{Uncompressed: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	obj, err := svc.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("test/" + TileKey(3, 0)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	_, err = body.ReadFrom(obj.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasPrefix(body.Bytes(), gzipMagic) {
+		t.Errorf("expected the tile to be stored uncompressed")
+	}
+
+	// A handler writing gzipped tiles still reads it.
+	handler, err = New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithMode(ModeCacheOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 reading the uncompressed tile, got %d", resp.StatusCode)
+	}
+}
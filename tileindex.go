@@ -0,0 +1,274 @@
+package ctile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithTileIndex keeps an index in memory of the tiles known to be cached in
+// S3, and sends requests for tiles missing from it straight to the backend,
+// skipping the S3 read that would miss, which saves its latency on each tile
+// filled. Reads are only skipped once the index has been primed by
+// WithTileIndexPriming, since until then a tile missing from it may still be
+// cached.
+//
+// Tiles are added to the index when they're read from or written to S3, and
+// removed when they turn out to be missing. Tiles cached by other instances
+// after the listing aren't in the index, unless they're reported to
+// WithS3Events, so the first request for each is fetched from the backend and
+// written again, which WithConditionalWrites makes cheap. It's only used in
+// ModeNormal, since ModeCacheOnly has no backend to fall back to.
+//
+// The index holds one bit per tile, up to the last tile cached, so it's small
+// even for large logs. ctile_tile_index_skips counts the S3 reads skipped, and
+// ctile_tile_index_coverage_ratio is the fraction of tiles up to the last one
+// in the index that are in it.
+func WithTileIndex(enabled bool) Option {
+	return func(o *options) {
+		o.tileIndex = enabled
+	}
+}
+
+// WithTileIndexPriming, with WithTileIndex, lists the tiles cached in S3 in
+// the background when the Handler starts, and adds them to the index, after
+// which reads of tiles missing from it are skipped. Until the listing is done,
+// every tile is read from S3, as without the index; if it fails, the index
+// isn't used at all. Listing takes one request per 1000 objects in the bucket
+// under the prefix, and under each Shard's.
+func WithTileIndexPriming(enabled bool) Option {
+	return func(o *options) {
+		o.tileIndexPriming = enabled
+	}
+}
+
+// tileIndex is a set of the tiles known to be cached, by tile number. A nil
+// *tileIndex knows nothing, so any tile may be cached.
+type tileIndex struct {
+	skips prometheus.Counter
+
+	// primed is closed once priming is done, whether or not it succeeded.
+	primed chan struct{}
+	// stop cancels priming.
+	stop context.CancelFunc
+
+	// mu protects the fields below.
+	mu    sync.RWMutex
+	bits  []uint64 // Bit n is set if tile n is cached.
+	ready bool     // True once the index is primed, so tiles missing from it aren't cached. Never set without WithTileIndexPriming.
+}
+
+func newTileIndex(enabled bool, promRegisterer prometheus.Registerer) *tileIndex {
+	if !enabled {
+		return nil
+	}
+	idx := &tileIndex{
+		skips: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ctile_tile_index_skips",
+			Help: "S3 reads skipped because the tile wasn't in the index of cached tiles",
+		}),
+		stop: func() {},
+	}
+	coverage := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ctile_tile_index_coverage_ratio",
+		Help: "the fraction of tiles up to the last one in the index of cached tiles that are in it",
+	}, idx.coverage)
+	promRegisterer.MustRegister(idx.skips, coverage)
+	return idx
+}
+
+// tileNumber returns the position of t in the sequence of tiles of its size.
+func tileNumber(t tile) int64 {
+	return t.start / t.size
+}
+
+// mayBeCached returns false if t is known not to be cached, which is only the
+// case once the index is primed, and counts the S3 read that's skipped as a
+// result.
+func (idx *tileIndex) mayBeCached(t tile) bool {
+	cached := idx.contains(t)
+	if !cached {
+		idx.skips.Inc()
+	}
+	return cached
+}
+
+// contains is mayBeCached, for other reads than the tile's own, which aren't
+// counted.
+func (idx *tileIndex) contains(t tile) bool {
+	if idx == nil {
+		return true
+	}
+	n := tileNumber(t)
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return !idx.ready || n/64 < int64(len(idx.bits)) && idx.bits[n/64]&(1<<(n%64)) != 0
+}
+
+// add records that t is cached.
+func (idx *tileIndex) add(t tile) {
+	if idx == nil {
+		return
+	}
+	n := tileNumber(t)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for n/64 >= int64(len(idx.bits)) {
+		idx.bits = append(idx.bits, 0)
+	}
+	idx.bits[n/64] |= 1 << (n % 64)
+}
+
+// remove records that t isn't cached.
+func (idx *tileIndex) remove(t tile) {
+	if idx == nil {
+		return
+	}
+	n := tileNumber(t)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if n/64 < int64(len(idx.bits)) {
+		idx.bits[n/64] &^= 1 << (n % 64)
+	}
+}
+
+// coverage returns the fraction of tiles up to the last one in the index that
+// are in it.
+func (idx *tileIndex) coverage() float64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var count, last int
+	for i, word := range idx.bits {
+		if word != 0 {
+			count += bits.OnesCount64(word)
+			last = i*64 + 63 - bits.LeadingZeros64(word)
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return float64(count) / float64(last+1)
+}
+
+// close stops priming the index, if it's still going.
+func (idx *tileIndex) close() {
+	if idx == nil {
+		return
+	}
+	idx.stop()
+}
+
+// startPriming makes the index usable once tch.primeTileIndex has filled it
+// in the background.
+func (tch *Handler) startPriming() {
+	idx := tch.tileIndex
+	if idx == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	idx.stop = cancel
+	idx.primed = make(chan struct{})
+	go func() {
+		defer close(idx.primed)
+		begin := time.Now()
+		count, err := tch.primeTileIndex(ctx)
+		if err != nil {
+			log.Printf("error: priming the index of cached tiles, which won't be used: %s\n", err)
+			return
+		}
+		idx.mu.Lock()
+		idx.ready = true
+		idx.mu.Unlock()
+		log.Printf("primed the index of cached tiles with %d tiles in %s\n", count, time.Since(begin).Round(time.Millisecond))
+	}()
+}
+
+// primeTileIndex lists the tiles cached in the Handler's bucket and prefix,
+// and each Shard's, adds them to the index, and returns how many it found.
+func (tch *Handler) primeTileIndex(ctx context.Context) (int, error) {
+	var count int
+	for _, loc := range tch.s3Locations() {
+		paginator := s3.NewListObjectsV2Paginator(tch.s3Service, &s3.ListObjectsV2Input{
+			Bucket: aws.String(loc.bucket),
+			Prefix: aws.String(loc.prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return count, fmt.Errorf("listing bucket %q with prefix %q: %w", loc.bucket, loc.prefix, err)
+			}
+			for _, obj := range page.Contents {
+				for _, t := range tch.tilesInObject(loc.bucket, aws.ToString(obj.Key)) {
+					tch.tileIndex.add(t)
+					count++
+				}
+			}
+		}
+	}
+	return count, nil
+}
+
+// tilesForKey returns the tiles held in the object at key, not including any
+// prefix: the tile, or, if it's a super-tile, its tiles. It returns nil if
+// the object doesn't hold tiles of the Handler's size. Rather than parse key,
+// which may follow a KeyTemplate, it tries each number in key as a tile's
+// start or tile_index, and checks that the tile's key matches.
+func (tch *Handler) tilesForKey(key string) []tile {
+	size := int64(tch.tileSize)
+	for i := 0; i < len(key); {
+		if key[i] < '0' || key[i] > '9' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(key) && key[j] >= '0' && key[j] <= '9' {
+			j++
+		}
+		n, err := strconv.ParseInt(key[i:j], 10, 64)
+		i = j
+		if err != nil {
+			continue
+		}
+		starts := []int64{n}
+		if n <= math.MaxInt64/size {
+			starts = append(starts, n*size)
+		}
+		for _, start := range starts {
+			if start%size != 0 {
+				continue
+			}
+			t := makeTile(start, size, tch.logURL)
+			if tch.isObjectKey(t, tch.tileKey(t), key) {
+				return []tile{t}
+			}
+			if tch.superTiles > 1 {
+				st := tch.superTile(t)
+				if st.start == start && tch.isObjectKey(st, tch.superTileKey(st), key) {
+					return tch.members(st)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isObjectKey returns true if key is one of the keys t, whose key in the flat
+// layout is flatKey, is looked for at.
+func (tch *Handler) isObjectKey(t tile, flatKey, key string) bool {
+	for _, k := range tch.objectKeys(t, flatKey) {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
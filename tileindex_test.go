@@ -0,0 +1,252 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestTileIndex(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	svc := &flakyS3{Client: s3mem.New()}
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithTileIndex(true), WithTileIndexPriming(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	<-handler.tileIndex.primed
+	svc.requests.Store(0)
+	expectSource := func(handler *Handler, url string, expected string) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, resp.StatusCode)
+		}
+		if source := resp.Header.Get("X-Source"); source != expected {
+			t.Errorf("%s: expected X-Source %q, got %q", url, expected, source)
+		}
+	}
+
+	// A tile that isn't in the index is fetched from the backend without
+	// reading S3, and written.
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "CT log")
+	if requests := svc.requests.Load(); requests != 1 {
+		t.Errorf("expected only a write to S3, got %d requests", requests)
+	}
+	expectSource(handler, "/ct/v1/get-entries?start=0&end=2", "S3")
+	if skips := testutil.ToFloat64(handler.tileIndex.skips); skips != 1 {
+		t.Errorf("expected 1 skipped read, got %g", skips)
+	}
+
+	// A tile cached by another instance after the listing is fetched from the
+	// backend the first time, and read from S3 after that.
+	other, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(other, "/ct/v1/get-entries?start=3&end=5", "CT log")
+	expectSource(handler, "/ct/v1/get-entries?start=3&end=5", "CT log")
+	expectSource(handler, "/ct/v1/get-entries?start=3&end=5", "S3")
+
+	// The index isn't used in cache-only mode, which has no backend.
+	cacheOnly, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithMode(ModeCacheOnly), WithTileIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSource(cacheOnly, "/ct/v1/get-entries?start=0&end=2", "S3")
+}
+
+func TestTileIndexBits(t *testing.T) {
+	idx := newTileIndex(true, prometheus.NewRegistry())
+	if !idx.mayBeCached(makeTile(0, 256, "")) {
+		t.Errorf("expected an index that isn't primed to allow any tile")
+	}
+	idx.ready = true
+	tiles := []tile{makeTile(0, 256, ""), makeTile(63*256, 256, ""), makeTile(64*256, 256, ""), makeTile(1000*256, 256, "")}
+	for _, tile := range tiles {
+		if idx.mayBeCached(tile) {
+			t.Errorf("expected tile %d to be missing from an empty index", tile.start)
+		}
+		idx.add(tile)
+		if !idx.mayBeCached(tile) {
+			t.Errorf("expected tile %d to be in the index once added", tile.start)
+		}
+	}
+	if idx.mayBeCached(makeTile(65*256, 256, "")) {
+		t.Errorf("expected tile %d to be missing from the index", 65*256)
+	}
+	idx.remove(tiles[2])
+	idx.remove(makeTile(5000*256, 256, ""))
+	if idx.mayBeCached(tiles[2]) || !idx.mayBeCached(tiles[1]) {
+		t.Errorf("expected only tile %d to be removed", tiles[2].start)
+	}
+
+	var nilIndex *tileIndex
+	if !nilIndex.mayBeCached(tiles[0]) {
+		t.Errorf("expected a nil index to allow any tile")
+	}
+}
+
+func TestTileIndexPriming(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	// Another instance caches tiles 0 and 2 beforehand, one of them in a
+	// shard.
+	svc := &flakyS3{Client: s3mem.New()}
+	shards := WithShards([]Shard{{Start: 6, Prefix: "shard/"}})
+	other, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"/ct/v1/get-entries?start=0&end=2", "/ct/v1/get-entries?start=6&end=8"} {
+		resp := getResp(other, url)
+		resp.Body.Close()
+	}
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), shards, WithTileIndex(true), WithTileIndexPriming(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	<-handler.tileIndex.primed
+	if coverage := handler.tileIndex.coverage(); coverage != 2.0/3 {
+		t.Errorf("expected coverage 2/3, got %g", coverage)
+	}
+
+	for _, tc := range []struct {
+		url    string
+		source string
+	}{
+		{"/ct/v1/get-entries?start=0&end=2", "S3"},
+		{"/ct/v1/get-entries?start=6&end=8", "S3"},
+		{"/ct/v1/get-entries?start=3&end=5", "CT log"},
+	} {
+		resp := getResp(handler, tc.url)
+		resp.Body.Close()
+		if source := resp.Header.Get("X-Source"); source != tc.source {
+			t.Errorf("%s: expected X-Source %q, got %q", tc.url, tc.source, source)
+		}
+	}
+	if skips := testutil.ToFloat64(handler.tileIndex.skips); skips != 1 {
+		t.Errorf("expected 1 skipped read, got %g", skips)
+	}
+	if coverage := handler.tileIndex.coverage(); coverage != 1 {
+		t.Errorf("expected coverage 1, got %g", coverage)
+	}
+}
+
+// listingS3 blocks listing until release is closed, then fails it if err is
+// set.
+type listingS3 struct {
+	*s3mem.Client
+	release chan struct{}
+	err     error
+}
+
+func (l *listingS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, opts ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	select {
+	case <-l.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.Client.ListObjectsV2(ctx, in, opts...)
+}
+
+func TestTileIndexNotPrimed(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 3))
+	defer backend.Close()
+
+	// Another instance cached tile 0 before the Handler started.
+	svc := &listingS3{Client: s3mem.New(), release: make(chan struct{}), err: errors.New("listing failed")}
+	other, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getResp(other, "/ct/v1/get-entries?start=0&end=2")
+	resp.Body.Close()
+
+	handler, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithTileIndex(true), WithTileIndexPriming(true), WithMemoryCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	expectS3 := func(handler *Handler, when string) {
+		t.Helper()
+		resp := getResp(handler, "/ct/v1/get-entries?start=0&end=2")
+		resp.Body.Close()
+		if source := resp.Header.Get("X-Source"); source != "S3" {
+			t.Errorf("%s: expected X-Source %q, got %q", when, "S3", source)
+		}
+		// Forget the read, so the next one doesn't find the tile in the index.
+		handler.tileIndex.remove(makeTile(0, 3, handler.logURL))
+	}
+
+	// Tiles already in S3 are read from it while the index is primed, and if
+	// priming fails.
+	expectS3(handler, "while priming")
+	close(svc.release)
+	<-handler.tileIndex.primed
+	expectS3(handler, "after priming failed")
+	if skips := testutil.ToFloat64(handler.tileIndex.skips); skips != 0 {
+		t.Errorf("expected no skipped reads, got %g", skips)
+	}
+
+	// Without priming, nothing is listed, and reads are never skipped.
+	unprimed, err := New(backend.URL, WithTileSize(3), WithS3(svc, "bucket", "test/"), WithTileIndex(true), WithMemoryCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unprimed.Close()
+	if unprimed.tileIndex.primed != nil {
+		t.Errorf("expected the index not to be primed")
+	}
+	expectS3(unprimed, "without priming")
+	if skips := testutil.ToFloat64(unprimed.tileIndex.skips); skips != 0 {
+		t.Errorf("expected no skipped reads without priming, got %g", skips)
+	}
+}
+
+func TestTilesForKey(t *testing.T) {
+	template, err := ParseKeyTemplate("{log_host}/{tile_size}/{tile_index}.cbor.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := New("https://log.example.com/2023", WithTileSize(256), WithS3(s3mem.New(), "bucket", "test/"),
+		WithKeyTemplate(template), WithKeyLayout(KeyLayoutHashed), WithSuperTiles(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile := makeTile(2560, 256, handler.logURL)
+	for _, key := range handler.objectKeys(tile, handler.tileKey(tile)) {
+		tiles := handler.tilesForKey(key)
+		if len(tiles) != 1 || tiles[0] != tile {
+			t.Errorf("%s: expected tile 2560, got %v", key, tiles)
+		}
+	}
+	st := handler.superTile(tile)
+	tiles := handler.tilesForKey(handler.objectKey(st, handler.superTileKey(st)))
+	if len(tiles) != 4 || tiles[0].start != 2048 || tiles[3].start != 2816 {
+		t.Errorf("expected the 4 tiles of super-tile 2048, got %v", tiles)
+	}
+	for _, key := range []string{"log.example.com/256/10.cbor.gz.partial", "log.example.com/128/10.cbor.gz", "past_the_end/2560", "health-probe"} {
+		if tiles := handler.tilesForKey(key); tiles != nil {
+			t.Errorf("%s: expected no tiles, got %v", key, tiles)
+		}
+	}
+}
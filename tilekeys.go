@@ -0,0 +1,177 @@
+package ctile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TileKeys names the objects tiles are stored in, after the prefix, the way a
+// Handler with the same log URL, WithTileSize, WithKeyLayout, WithKeyTemplate
+// and WithSuperTiles does, for tools that work on the cache directly. Use
+// NewTileKeys to make one.
+type TileKeys struct {
+	tch *Handler
+}
+
+// TileObject is an object that holds cached tiles.
+type TileObject struct {
+	// Key is the object's key, not including the prefix.
+	Key string
+	// Start and End are the index of the first entry in the object's tiles,
+	// and one past their last, so they're the half-open interval [Start, End).
+	Start int64
+	End   int64
+	// Tiles is the number of tiles the object holds: more than one for a
+	// super-tile.
+	Tiles int
+	// Partial is set if the object holds the partial version of a tile, from
+	// WithPartialTileCaching.
+	Partial bool
+	// Precompressed is set if the object holds a tile's precompressed JSON,
+	// from WithPrecompressedJSON, rather than the tile.
+	Precompressed bool
+}
+
+// NewTileKeys returns the TileKeys of the log at logURL, as configured by the
+// options in opts that are about keys; the others are ignored. logURL is only
+// needed if the key template uses {log_host} or {log_path}. Without
+// WithTileSize, it matches tiles of any size, which is only possible with
+// DefaultKeyTemplate and without super-tiles, since only then is the size
+// part of every key.
+func NewTileKeys(logURL string, opts ...Option) (*TileKeys, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.tileSize < 0 {
+		return nil, errors.New("tile size must not be negative")
+	}
+	if o.keyLayout != "" {
+		_, err := ParseKeyLayout(string(o.keyLayout))
+		if err != nil {
+			return nil, err
+		}
+	}
+	keyTemplate, err := o.keyTemplate.resolve(logURL)
+	if err != nil {
+		return nil, err
+	}
+	if keyTemplate.template == DefaultKeyTemplate {
+		// Expanding it gives the same keys, the slow way.
+		keyTemplate = KeyTemplate{}
+	}
+	if o.tileSize == 0 && (keyTemplate.parts != nil || o.superTiles > 1) {
+		return nil, errors.New("a tile size is required with a key template other than the default, or with super-tiles")
+	}
+	return &TileKeys{&Handler{
+		logURL:      logURL,
+		tileSize:    o.tileSize,
+		superTiles:  o.superTiles,
+		keyLayout:   o.keyLayout,
+		keyTemplate: keyTemplate,
+	}}, nil
+}
+
+// Key returns the key the tile starting at start is written at on its own. It
+// needs a tile size.
+func (k *TileKeys) Key(start int64) string {
+	t := makeTile(start, int64(k.tch.tileSize), k.tch.logURL)
+	return k.tch.objectKey(t, k.tch.tileKey(t))
+}
+
+// Lookup returns the objects a Handler looks for the tile containing index
+// in, in the order it tries them: its super-tile, if there are super-tiles,
+// the tile's own object, at each key it may have in the KeyLayout, and its
+// partial version. It needs a tile size.
+func (k *TileKeys) Lookup(index int64) []TileObject {
+	tch := k.tch
+	t := makeTile(index, int64(tch.tileSize), tch.logURL)
+	var objects []TileObject
+	if tch.superTiles > 1 {
+		st := tch.superTile(t)
+		for _, key := range tch.objectKeys(st, tch.superTileKey(st)) {
+			objects = append(objects, TileObject{Key: key, Start: st.start, End: st.end, Tiles: tch.superTiles})
+		}
+	}
+	for _, key := range tch.objectKeys(t, tch.tileKey(t)) {
+		objects = append(objects, TileObject{Key: key, Start: t.start, End: t.end, Tiles: 1})
+	}
+	for _, key := range tch.objectKeys(t, tch.tileKey(t)+partialKeySuffix) {
+		objects = append(objects, TileObject{Key: key, Start: t.start, End: t.end, Tiles: 1, Partial: true})
+	}
+	return objects
+}
+
+// Parse returns the object at key, not including the prefix, and true, if it
+// holds tiles of the TileKeys' size: a tile, in any layout a Handler reads, a
+// super-tile, or a tile's partial version or precompressed JSON. For other
+// objects, it returns false.
+func (k *TileKeys) Parse(key string) (TileObject, bool) {
+	obj, ok := k.parseTiles(key)
+	if ok {
+		return obj, true
+	}
+	if base, ok := strings.CutSuffix(key, partialKeySuffix); ok {
+		obj, ok = k.parseTiles(base)
+		obj.Key, obj.Partial = key, true
+		return obj, ok && obj.Tiles == 1
+	}
+	if base, ok := strings.CutSuffix(key, precompressedKeySuffix); ok {
+		obj, ok = k.parseTiles(base)
+		obj.Key, obj.Precompressed = key, true
+		return obj, ok && obj.Tiles == 1
+	}
+	return TileObject{}, false
+}
+
+// parseTiles is Parse, for the key of a tile or super-tile.
+func (k *TileKeys) parseTiles(key string) (TileObject, bool) {
+	if k.tch.tileSize == 0 {
+		size, start, err := ParseTileKey(key)
+		if err != nil {
+			return TileObject{}, false
+		}
+		return TileObject{Key: key, Start: start, End: start + size, Tiles: 1}, true
+	}
+	tiles := k.tch.tilesForKey(key)
+	if len(tiles) == 0 {
+		return TileObject{}, false
+	}
+	return TileObject{Key: key, Start: tiles[0].start, End: tiles[len(tiles)-1].end, Tiles: len(tiles)}, true
+}
+
+// ListPrefix returns a prefix, after the prefix the tiles are stored under,
+// of the key of every object Parse recognizes, to narrow listings with. It's
+// empty if they have nothing in common, e.g. in KeyLayoutHashed.
+func (k *TileKeys) ListPrefix() string {
+	tch := k.tch
+	if tch.keyLayout == KeyLayoutHashed {
+		return ""
+	}
+	flat := "tile_size="
+	if tch.tileSize != 0 {
+		flat = fmt.Sprintf("tile_size=%d/", tch.tileSize)
+	}
+	if tch.keyTemplate.parts == nil {
+		return flat
+	}
+	var b strings.Builder
+	for _, part := range tch.keyTemplate.parts {
+		if part.variable == "" {
+			b.WriteString(part.literal)
+		} else if part.variable == "tile_size" {
+			fmt.Fprintf(&b, "%d", tch.tileSize)
+		} else {
+			break
+		}
+	}
+	prefix := b.String()
+	if tch.superTiles > 1 {
+		// Super-tiles keep their own keys.
+		for !strings.HasPrefix(flat, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,141 @@
+package ctile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTileKeys(t *testing.T) {
+	template, err := ParseKeyTemplate("{log_host}/entries/{tile_index}.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := keyHash(512)
+
+	testCases := []struct {
+		name       string
+		opts       []Option
+		key        string
+		lookup     []TileObject
+		listPrefix string
+		parse      map[string]TileObject
+		skip       []string
+	}{
+		{
+			name:       "flat",
+			opts:       []Option{WithTileSize(256)},
+			key:        "tile_size=256/512.cbor.gz",
+			listPrefix: "tile_size=256/",
+			lookup: []TileObject{
+				{Key: "tile_size=256/512.cbor.gz", Start: 512, End: 768, Tiles: 1},
+				{Key: "tile_size=256/512.cbor.gz.partial", Start: 512, End: 768, Tiles: 1, Partial: true},
+			},
+			parse: map[string]TileObject{
+				"tile_size=256/512.cbor.gz.json.gz": {Start: 512, End: 768, Tiles: 1, Precompressed: true},
+			},
+			skip: []string{"tile_size=128/512.cbor.gz", hash + "/tile_size=256/512.cbor.gz", "tile_size=256/x4/0.cbor.gz"},
+		},
+		{
+			name:       "hashed",
+			opts:       []Option{WithTileSize(256), WithKeyLayout(KeyLayoutHashed)},
+			key:        hash + "/tile_size=256/512.cbor.gz",
+			listPrefix: "",
+			lookup: []TileObject{
+				{Key: hash + "/tile_size=256/512.cbor.gz", Start: 512, End: 768, Tiles: 1},
+				{Key: "tile_size=256/512.cbor.gz", Start: 512, End: 768, Tiles: 1},
+				{Key: hash + "/tile_size=256/512.cbor.gz.partial", Start: 512, End: 768, Tiles: 1, Partial: true},
+				{Key: "tile_size=256/512.cbor.gz.partial", Start: 512, End: 768, Tiles: 1, Partial: true},
+			},
+			parse: map[string]TileObject{
+				hash + "/tile_size=256/512.cbor.gz.json.gz": {Start: 512, End: 768, Tiles: 1, Precompressed: true},
+			},
+			skip: []string{"0000/tile_size=256/512.cbor.gz"},
+		},
+		{
+			name:       "template",
+			opts:       []Option{WithTileSize(256), WithKeyTemplate(template)},
+			key:        "log.example/entries/2.bin",
+			listPrefix: "log.example/entries/",
+			lookup: []TileObject{
+				{Key: "log.example/entries/2.bin", Start: 512, End: 768, Tiles: 1},
+				{Key: "log.example/entries/2.bin.partial", Start: 512, End: 768, Tiles: 1, Partial: true},
+			},
+			skip: []string{"tile_size=256/512.cbor.gz", "other.example/entries/2.bin"},
+		},
+		{
+			name:       "super-tiles",
+			opts:       []Option{WithTileSize(256), WithKeyTemplate(template), WithSuperTiles(4)},
+			key:        "log.example/entries/2.bin",
+			listPrefix: "",
+			lookup: []TileObject{
+				{Key: "tile_size=256/x4/0.cbor.gz", Start: 0, End: 1024, Tiles: 4},
+				{Key: "log.example/entries/2.bin", Start: 512, End: 768, Tiles: 1},
+				{Key: "log.example/entries/2.bin.partial", Start: 512, End: 768, Tiles: 1, Partial: true},
+			},
+			skip: []string{"tile_size=256/x4/0.cbor.gz.partial", "tile_size=256/x2/0.cbor.gz"},
+		},
+		{
+			name:       "any size",
+			listPrefix: "tile_size=",
+			parse: map[string]TileObject{
+				"tile_size=256/512.cbor.gz":         {Start: 512, End: 768, Tiles: 1},
+				"tile_size=128/512.cbor.gz.partial": {Start: 512, End: 640, Tiles: 1, Partial: true},
+			},
+			skip: []string{"tile_size=256/x4/0.cbor.gz", "log.example/entries/2.bin"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := NewTileKeys("https://log.example/2024/", tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.key != "" {
+				if key := keys.Key(600); key != tc.key {
+					t.Errorf("Key: expected %q, got %q", tc.key, key)
+				}
+			}
+			if prefix := keys.ListPrefix(); prefix != tc.listPrefix {
+				t.Errorf("ListPrefix: expected %q, got %q", tc.listPrefix, prefix)
+			}
+			if tc.parse == nil {
+				tc.parse = map[string]TileObject{}
+			}
+			if tc.lookup != nil {
+				lookup := keys.Lookup(600)
+				if !reflect.DeepEqual(lookup, tc.lookup) {
+					t.Errorf("Lookup: expected %+v, got %+v", tc.lookup, lookup)
+				}
+				// Everything looked up parses back to itself.
+				for _, obj := range lookup {
+					tc.parse[obj.Key] = obj
+				}
+			}
+			for key, expected := range tc.parse {
+				expected.Key = key
+				obj, ok := keys.Parse(key)
+				if !ok || obj != expected {
+					t.Errorf("Parse(%q): expected %+v, got %+v, %t", key, expected, obj, ok)
+				}
+				if !strings.HasPrefix(key, tc.listPrefix) {
+					t.Errorf("%q doesn't start with ListPrefix %q", key, tc.listPrefix)
+				}
+			}
+			for _, key := range tc.skip {
+				if obj, ok := keys.Parse(key); ok {
+					t.Errorf("Parse(%q): expected no match, got %+v", key, obj)
+				}
+			}
+		})
+	}
+
+	_, err = NewTileKeys("https://log.example/2024/", WithKeyTemplate(template))
+	if err == nil || !strings.Contains(err.Error(), "tile size is required") {
+		t.Errorf("expected an error about the tile size, got %v", err)
+	}
+	_, err = NewTileKeys("https://log.example/2024/", WithSuperTiles(4))
+	if err == nil || !strings.Contains(err.Error(), "tile size is required") {
+		t.Errorf("expected an error about the tile size, got %v", err)
+	}
+}
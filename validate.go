@@ -0,0 +1,116 @@
+package ctile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// WithStrictValidation, if strict is true, checks that each tile fetched
+// from the backend is the range of the log it asked for before caching it.
+// The tile must be within the tree size of the backend's STH, and the
+// backend's get-proof-by-hash must place the tile's first and last entries
+// at the tile's first and last indexes. That costs three more requests to the
+// backend for each tile cached, and catches a backend, or a proxy in front of
+// it, that returns the wrong entries, before they're cached for good.
+//
+// A tile that fails a check isn't cached or served, and is counted in
+// ctile_invalid_tiles. If the checks can't be made, e.g. because the backend
+// is unavailable, the tile is served but not cached.
+func WithStrictValidation(strict bool) Option {
+	return func(o *options) {
+		o.strictValidation = strict
+	}
+}
+
+// invalidTileError is returned for a tile that failed a check of
+// WithStrictValidation.
+type invalidTileError struct {
+	// reason is a short label for ctile_invalid_tiles.
+	reason string
+	detail string
+}
+
+func (e invalidTileError) Error() string {
+	return fmt.Sprintf("backend returned an invalid tile: %s", e.detail)
+}
+
+// checkLeaves returns an error if any entry's leaf_input isn't a
+// MerkleTreeLeaf, as defined in RFC 6962, section 3.4: version v1 (0),
+// leaf_type timestamped_entry (0), a timestamp, and entry_type x509_entry (0)
+// or precert_entry (1).
+func checkLeaves(t tile, e *Entries) error {
+	for i, entry := range e.Entries {
+		leaf := entry.LeafInput
+		if len(leaf) < 12 || leaf[0] != 0 || leaf[1] != 0 || leaf[10] != 0 || leaf[11] > 1 {
+			return invalidTileError{"malformed_leaf", fmt.Sprintf("entry %d is not a MerkleTreeLeaf", t.start+int64(i))}
+		}
+	}
+	return nil
+}
+
+// validateTile makes the checks of WithStrictValidation on e, the contents of
+// the full tile t, with the backend that's first in line for requests. It
+// returns an invalidTileError if a check fails, or another error if the
+// checks couldn't be made.
+func (tch *Handler) validateTile(ctx context.Context, t tile, e *Entries) error {
+	err := checkLeaves(t, e)
+	if err != nil {
+		return err
+	}
+	// The tree size and proofs must come from the same replica, since
+	// replicas may be at different tree sizes.
+	backendURL := tch.backends.candidates()[0].url
+	var sth struct {
+		TreeSize int64 `json:"tree_size"`
+	}
+	err = tch.getJSON(ctx, backendURL+"/ct/v1/get-sth", &sth)
+	if err != nil {
+		return err
+	}
+	if t.end > sth.TreeSize {
+		return invalidTileError{"past_tree_size", fmt.Sprintf("tile %d-%d is past the tree size %d", t.start, t.end-1, sth.TreeSize)}
+	}
+	for _, i := range []int64{0, t.size - 1} {
+		leafHash := sha256.Sum256(append([]byte{0}, e.Entries[i].LeafInput...))
+		proofURL := fmt.Sprintf("%s/ct/v1/get-proof-by-hash?hash=%s&tree_size=%d",
+			backendURL, url.QueryEscape(base64.StdEncoding.EncodeToString(leafHash[:])), sth.TreeSize)
+		var proof struct {
+			LeafIndex int64 `json:"leaf_index"`
+		}
+		err := tch.getJSON(ctx, proofURL, &proof)
+		if err != nil {
+			return err
+		}
+		if proof.LeafIndex != t.start+i {
+			return invalidTileError{"wrong_index", fmt.Sprintf("entry %d of the response is entry %d of the log", t.start+i, proof.LeafIndex)}
+		}
+	}
+	return nil
+}
+
+// getJSON fetches url from the backend and decodes its JSON body into v.
+func (tch *Handler) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := tch.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	limitBody(resp, tch.maxBackendBodySize)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: status code %d", url, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return readBodyError(url, err)
+	}
+	return nil
+}
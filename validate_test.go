@@ -0,0 +1,103 @@
+package ctile
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestStrictValidation(t *testing.T) {
+	log := fakelog.New(11, 3)
+
+	// shifted is off by one, like a proxy that mistranslates indexes.
+	shifted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ct/v1/get-entries" {
+			q := r.URL.Query()
+			for _, param := range []string{"start", "end"} {
+				i, _ := strconv.Atoi(q.Get(param))
+				q.Set(param, strconv.Itoa(i+1))
+			}
+			r.URL.RawQuery = q.Encode()
+		}
+		log.ServeHTTP(w, r)
+	})
+	malformed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ct/v1/get-entries" {
+			entries := Entries{Entries: []Entry{{LeafInput: []byte("a")}, {LeafInput: []byte("b")}, {LeafInput: []byte("c")}}}
+			_ = json.NewEncoder(w).Encode(entries)
+			return
+		}
+		log.ServeHTTP(w, r)
+	})
+	noProofs := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ct/v1/get-proof-by-hash" {
+			http.NotFound(w, r)
+			return
+		}
+		log.ServeHTTP(w, r)
+	})
+
+	testCases := []struct {
+		name           string
+		backend        http.Handler
+		expectedStatus int
+		expectCached   bool
+		reason         string
+	}{
+		{"valid", log, http.StatusOK, true, ""},
+		{"shifted", shifted, http.StatusBadGateway, false, "wrong_index"},
+		{"malformed", malformed, http.StatusBadGateway, false, "malformed_leaf"},
+		{"no proofs", noProofs, http.StatusOK, false, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := httptest.NewServer(tc.backend)
+			defer backend.Close()
+			svc := s3mem.New()
+			handler, err := New(backend.URL,
+				WithTileSize(3),
+				WithS3(svc, "bucket", "test/"),
+				WithStrictValidation(true),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := getResp(handler, "/ct/v1/get-entries?start=3&end=5")
+			resp.Body.Close()
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, resp.StatusCode)
+			}
+			_, err = GetTileObject(context.Background(), svc, "bucket", "test/"+TileKey(3, 3))
+			if cached := err == nil; cached != tc.expectCached {
+				t.Errorf("expected cached=%t, got %t (%v)", tc.expectCached, cached, err)
+			}
+			if tc.reason != "" {
+				expectAndResetMetric(t, handler.invalidTiles, 1, tc.reason)
+			}
+		})
+	}
+
+	// Partial tiles aren't cached, so they aren't checked.
+	backend := httptest.NewServer(shifted)
+	defer backend.Close()
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(s3mem.New(), "bucket", "test/"),
+		WithStrictValidation(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getResp(handler, "/ct/v1/get-entries?start=9&end=11")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Partial-Tile") != "true" {
+		t.Errorf("expected partial tile to be served, got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,68 @@
+package ctile
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// verboseParam is the query parameter of get-entries requests that asks for a
+// verbose response, which adds to each entry its index in the log, and
+// describes the tile the entries were served from. Clients can use it to
+// debug off-by-one and alignment issues. The extra fields are prefixed with
+// "ctile_", so they can't clash with the CT API's.
+const verboseParam = "verbose"
+
+// parseVerbose returns true if values ask for a verbose response.
+func parseVerbose(values url.Values) (bool, error) {
+	v := values.Get(verboseParam)
+	if v == "" {
+		return false, nil
+	}
+	verbose, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter: %w", verboseParam, err)
+	}
+	return verbose, nil
+}
+
+// verboseEntries is a verbose get-entries response.
+type verboseEntries struct {
+	Entries []verboseEntry `json:"entries"`
+	Tile    verboseTile    `json:"ctile_tile"`
+}
+
+type verboseEntry struct {
+	Entry
+	Index int64 `json:"ctile_index"`
+}
+
+// verboseTile describes the tile a verbose response was served from.
+type verboseTile struct {
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+	// Entries is the number of entries the tile holds, which is less than
+	// Size for a partial tile.
+	Entries int        `json:"entries"`
+	Partial bool       `json:"partial"`
+	Source  tileSource `json:"source"`
+}
+
+// makeVerbose returns e, whose first entry is at index start in the log, as a
+// verbose response served from t, which holds tileEntries entries.
+func makeVerbose(e *Entries, start int64, t tile, tileEntries int, source tileSource) verboseEntries {
+	v := verboseEntries{
+		Entries: make([]verboseEntry, len(e.Entries)),
+		Tile: verboseTile{
+			Start:   t.start,
+			Size:    t.size,
+			Entries: tileEntries,
+			Partial: int64(tileEntries) < t.size,
+			Source:  source,
+		},
+	}
+	for i, entry := range e.Entries {
+		v.Entries[i] = verboseEntry{entry, start + int64(i)}
+	}
+	return v
+}
@@ -0,0 +1,60 @@
+package ctile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+func TestVerbose(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(10, 4))
+	defer backend.Close()
+	handler, err := New(backend.URL, WithTileSize(4), WithS3(s3mem.New(), "bucket", "test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := getResp(handler, "/ct/v1/get-entries?start=9&end=12&verbose=true")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.StatusCode, body)
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v verboseEntries
+	err = json.NewDecoder(gzipReader).Decode(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTile := verboseTile{Start: 8, Size: 4, Entries: 2, Partial: true, Source: sourceCTLog}
+	if v.Tile != expectedTile {
+		t.Errorf("expected tile %+v, got %+v", expectedTile, v.Tile)
+	}
+	if len(v.Entries) != 1 || v.Entries[0].Index != 9 {
+		t.Errorf("expected entry 9 alone, got %+v", v.Entries)
+	}
+
+	// Verbose responses hold the same entries as the usual ones.
+	entries, _, err := getAndParseResp(t, handler, "/ct/v1/get-entries?start=9&end=12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Entries) != 1 || !bytes.Equal(entries.Entries[0].LeafInput, v.Entries[0].LeafInput) {
+		t.Errorf("expected the verbose entry to match the usual one, got %+v and %+v", v.Entries, entries.Entries)
+	}
+
+	resp = getResp(handler, "/ct/v1/get-entries?start=0&end=1&verbose=maybe")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid verbose parameter, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,189 @@
+package ctile
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WriteQueue configures a queue of tiles waiting to be written to S3 in the
+// background, after their requests are served. It holds the writes of
+// WithAsyncWrites and, once set, retries of writes that failed while a
+// request waited on them, so a transient S3 error doesn't fail a request whose
+// tile was fetched from the backend.
+//
+// Writes that don't fit in the queue, or still fail after Attempts, are
+// dropped, and counted in ctile_s3_writes_dropped by reason: "full" or
+// "failed". Their tiles are fetched from the backend again when next
+// requested. ctile_s3_write_queue_length is the number of writes waiting.
+type WriteQueue struct {
+	// Size is the number of writes that may wait in the queue. Zero disables
+	// the queue, unless WithAsyncWrites is set, which uses
+	// DefaultWriteQueue.
+	Size int
+	// Workers is the number of writes made at once. Defaults to 1.
+	Workers int
+	// Attempts is the max number of times each tile's write is tried,
+	// including the first. Defaults to 1.
+	Attempts int
+	// Backoff is the wait before a write's second attempt, doubled before
+	// each later one.
+	Backoff time.Duration
+}
+
+// DefaultWriteQueue is the WriteQueue used by WithAsyncWrites if none is set.
+var DefaultWriteQueue = WriteQueue{Size: 1000, Workers: 4, Attempts: 3, Backoff: time.Second}
+
+// WithWriteQueue sets the queue of writes to S3 in the background.
+func WithWriteQueue(q WriteQueue) Option {
+	return func(o *options) {
+		o.writeQueue = q
+	}
+}
+
+// queuedWrite is a tile waiting in a writeQueue.
+type queuedWrite struct {
+	ctx      context.Context // Of the request the tile was fetched for.
+	tile     tile
+	contents *Entries
+	attempts int // The attempts made so far.
+}
+
+// writeQueue enforces WriteQueue. A nil *writeQueue drops every write.
+type writeQueue struct {
+	attempts int
+	backoff  time.Duration
+	write    func(ctx context.Context, t tile, e *Entries) error
+
+	length  prometheus.Gauge
+	dropped *prometheus.CounterVec
+
+	writes  chan queuedWrite
+	workers sync.WaitGroup
+
+	// stop is closed by close, to end retries early.
+	stop chan struct{}
+
+	// mu protects closed, so no write is queued after close.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newWriteQueue(q WriteQueue, write func(ctx context.Context, t tile, e *Entries) error, promRegisterer prometheus.Registerer) *writeQueue {
+	if q.Size == 0 {
+		return nil
+	}
+	if q.Workers == 0 {
+		q.Workers = 1
+	}
+	if q.Attempts == 0 {
+		q.Attempts = 1
+	}
+	wq := &writeQueue{
+		attempts: q.Attempts,
+		backoff:  q.Backoff,
+		write:    write,
+		length: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ctile_s3_write_queue_length",
+			Help: "number of tiles waiting to be written to S3 in the background",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ctile_s3_writes_dropped",
+			Help: "tiles never written to S3, by reason: full, if the write queue was full, or failed, if every attempt failed",
+		}, []string{"reason"}),
+		writes: make(chan queuedWrite, q.Size),
+		stop:   make(chan struct{}),
+	}
+	promRegisterer.MustRegister(wq.length, wq.dropped)
+	for i := 0; i < q.Workers; i++ {
+		wq.workers.Add(1)
+		go wq.run()
+	}
+	return wq
+}
+
+// add queues a write of the tile fetched for the request whose context is
+// ctx, after the given number of failed attempts, or drops it if the queue is
+// full.
+func (wq *writeQueue) add(ctx context.Context, t tile, e *Entries, attempts int) {
+	if wq == nil {
+		return
+	}
+	if attempts >= wq.attempts {
+		wq.dropped.WithLabelValues("failed").Inc()
+		return
+	}
+	wq.mu.RLock()
+	defer wq.mu.RUnlock()
+	if wq.closed {
+		// The Handler is closed, so the queue is as good as full.
+		wq.dropped.WithLabelValues("full").Inc()
+		return
+	}
+	select {
+	case wq.writes <- queuedWrite{ctx, t, e, attempts}:
+		wq.length.Inc()
+	default:
+		wq.dropped.WithLabelValues("full").Inc()
+		log.Printf("warning: not writing tile %d-%d to S3: the write queue is full\n", t.start, t.end-1)
+	}
+}
+
+// run makes the queued writes until close.
+func (wq *writeQueue) run() {
+	defer wq.workers.Done()
+	for w := range wq.writes {
+		wq.length.Dec()
+		wq.attempt(w)
+	}
+}
+
+// attempt tries a write until it succeeds or runs out of attempts.
+func (wq *writeQueue) attempt(w queuedWrite) {
+	backoff := wq.backoff
+	for i := 0; i < w.attempts-1; i++ {
+		backoff *= 2
+	}
+	for {
+		if w.attempts > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-wq.stop:
+				wq.dropped.WithLabelValues("failed").Inc()
+				return
+			}
+			backoff *= 2
+		}
+		err := wq.write(w.ctx, w.tile, w.contents)
+		w.attempts++
+		if err == nil {
+			return
+		}
+		if w.attempts >= wq.attempts {
+			wq.dropped.WithLabelValues("failed").Inc()
+			log.Printf("error: giving up writing tile %d-%d to S3 after %d attempts: %s\n", w.tile.start, w.tile.end-1, w.attempts, err)
+			return
+		}
+	}
+}
+
+// close stops queueing writes, and waits for the queued ones to be made.
+// Those waiting to be retried are dropped instead.
+func (wq *writeQueue) close() {
+	if wq == nil {
+		return
+	}
+	wq.mu.Lock()
+	if wq.closed {
+		wq.mu.Unlock()
+		return
+	}
+	wq.closed = true
+	close(wq.stop)
+	close(wq.writes)
+	wq.mu.Unlock()
+	wq.workers.Wait()
+}
@@ -0,0 +1,108 @@
+package ctile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/ctile/internal/fakelog"
+	"github.com/letsencrypt/ctile/internal/s3mem"
+)
+
+// putFailingS3 is an in-memory S3 whose writes fail while failing is set.
+type putFailingS3 struct {
+	*s3mem.Client
+	failing atomic.Bool
+}
+
+func (p *putFailingS3) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if p.failing.Load() {
+		return nil, errors.New("S3 is down")
+	}
+	return p.Client.PutObject(ctx, in, opts...)
+}
+
+func TestWriteQueue(t *testing.T) {
+	backend := httptest.NewServer(fakelog.New(20, 3))
+	defer backend.Close()
+
+	expectStatus := func(handler *Handler, url string, expected int) {
+		t.Helper()
+		resp := getResp(handler, url)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s: expected status %d, got %d", url, expected, resp.StatusCode)
+		}
+	}
+	waitForDropped := func(handler *Handler, reason string, expected float64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(handler.writeQueue.dropped.WithLabelValues(reason)) != expected; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %g writes dropped as %s", expected, reason)
+			}
+		}
+	}
+
+	// A failed write doesn't fail the request, and is retried.
+	svc := &putFailingS3{Client: s3mem.New()}
+	svc.failing.Store(true)
+	cached := make(chan TileInfo, 1)
+	handler, err := New(backend.URL,
+		WithTileSize(3),
+		WithS3(svc, "bucket", "test/"),
+		WithWriteQueue(WriteQueue{Size: 10, Attempts: 3, Backoff: 50 * time.Millisecond}),
+		WithHooks(Hooks{OnTileCached: func(_ context.Context, t TileInfo) { cached <- t }}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(handler, "/ct/v1/get-entries?start=0&end=2", http.StatusOK)
+	svc.failing.Store(false)
+	select {
+	case <-cached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the write to be retried")
+	}
+	_, err = GetTileObject(context.Background(), svc, "bucket", "test/"+TileKey(3, 0))
+	if err != nil {
+		t.Errorf("expected the tile in S3 after the retry, got %v", err)
+	}
+
+	// It's dropped once it runs out of attempts.
+	svc.failing.Store(true)
+	expectStatus(handler, "/ct/v1/get-entries?start=3&end=5", http.StatusOK)
+	waitForDropped(handler, "failed", 1)
+	handler.Close()
+
+	// Writes that don't fit in the queue are dropped.
+	held := &heldS3{Client: s3mem.New(), started: make(chan struct{}, 1), release: make(chan struct{})}
+	handler, err = New(backend.URL,
+		WithTileSize(3),
+		WithS3(held, "bucket", "test/"),
+		WithAsyncWrites(true),
+		WithWriteQueue(WriteQueue{Size: 1}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(handler, "/ct/v1/get-entries?start=0&end=2", http.StatusOK)
+	<-held.started
+	expectStatus(handler, "/ct/v1/get-entries?start=3&end=5", http.StatusOK)
+	expectStatus(handler, "/ct/v1/get-entries?start=6&end=8", http.StatusOK)
+	waitForDropped(handler, "full", 1)
+	close(held.release)
+	handler.Close()
+	for _, start := range []int64{0, 3} {
+		_, err = GetTileObject(context.Background(), held.Client, "bucket", "test/"+TileKey(3, start))
+		if err != nil {
+			t.Errorf("expected tile %d in S3, got %v", start, err)
+		}
+	}
+}